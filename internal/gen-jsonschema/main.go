@@ -6,6 +6,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
 
 	"chainguard.dev/melange/pkg/config"
 	"github.com/invopop/jsonschema"
@@ -22,7 +23,7 @@ func main() {
 		log.Fatal("output path is required")
 	}
 
-	r := new(jsonschema.Reflector)
+	r := &jsonschema.Reflector{FieldNameTag: "yaml", RequiredFromJSONSchemaTags: true, KeyNamer: strings.ToLower}
 	if err := r.AddGoComments("chainguard.dev/melange/pkg/build", "../../pkg/config"); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,39 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hardlink identifies the hard links to a file on the host.
+package hardlink
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// ID identifies a file of the host which has hard links.
+type ID struct {
+	dev, ino uint64
+}
+
+// Of returns the identity of the file whose info is fi if it has hard
+// links, for the filesystems of the host.  The tarball writer writes the
+// links after the first as link entries, from the same information.
+func Of(fi fs.FileInfo) (ID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil || st.Nlink < 2 || fi.IsDir() {
+		return ID{}, false
+	}
+
+	// Dev is an int32 on darwin.
+	return ID{dev: uint64(st.Dev), ino: st.Ino}, true
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hardlink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOf(t *testing.T) {
+	dir := t.TempDir()
+	of := func(name string) (ID, bool) {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return Of(fi)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "single"), []byte("a"), 0o644))
+	require.NoError(t, os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+
+	a, ok := of("a")
+	require.True(t, ok)
+	b, ok := of("b")
+	require.True(t, ok)
+	require.Equal(t, a, b)
+
+	_, ok = of("single")
+	require.False(t, ok)
+
+	// Directories have several links, to their parent and subdirectories,
+	// but are not hard links.
+	_, ok = of("sub")
+	require.False(t, ok)
+}
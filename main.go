@@ -17,17 +17,34 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 
+	"chainguard.dev/melange/pkg/annotations"
 	"chainguard.dev/melange/pkg/cli"
+	"chainguard.dev/melange/pkg/failure"
 )
 
 func main() {
 	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer done()
 
-	if err := cli.New().ExecuteContext(ctx); err != nil {
-		log.Fatalf("error during command execution: %v", err)
+	err := cli.New().ExecuteContext(ctx)
+
+	// The error of the command is annotated too, and the annotations which
+	// are written as a report are written once the command is done.
+	if h, ok := slog.Default().Handler().(*annotations.Handler); ok {
+		if err := h.Finish(err); err != nil {
+			log.Printf("unable to write annotations: %v", err)
+		}
+	}
+
+	if err != nil {
+		// The exit code tells CI which kind of failure it was, e.g.
+		// whether it is worth retrying.
+		log.Printf("error during command execution: %v", err)
+		done()
+		os.Exit(failure.ExitCode(err))
 	}
 }
@@ -0,0 +1,298 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package annotations surfaces the warnings and errors of melange in CI
+// systems, which show them inline on the lines of the configuration files
+// they are about.
+//
+// Warnings are attributed to a configuration file by logging them with the
+// attributes returned by At.
+package annotations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The formats annotations are written in.
+const (
+	// GitHub Actions workflow commands, e.g.
+	// ::warning file=foo.yaml,line=12::message
+	FormatGitHub = "github"
+	// A GitLab code quality report
+	FormatGitLab = "gitlab"
+)
+
+// The attributes of a log record which locate it in a configuration file.
+const (
+	AttrFile = "file"
+	AttrLine = "line"
+)
+
+// At returns the attributes which locate a log record at a line of a
+// configuration file, to pass to Logger.With.  A line of 0 locates it at the
+// file as a whole.
+func At(file string, line int) []any {
+	if line <= 0 {
+		return []any{AttrFile, file}
+	}
+	return []any{AttrFile, file, AttrLine, line}
+}
+
+// Located is implemented by errors which know where in a configuration file
+// they are, such as config.SchemaError.
+type Located interface {
+	Location() (file string, line int)
+}
+
+// Handler is a slog.Handler which writes the warnings and errors logged
+// through it as annotations, and passes every record on to another handler.
+type Handler struct {
+	next slog.Handler
+	// attrs are the attributes added with WithAttrs outside of any group.
+	attrs   []slog.Attr
+	grouped bool
+
+	out *output
+}
+
+// output is the state shared by a Handler and the handlers derived from it.
+type output struct {
+	format string
+	w      io.Writer
+	// The path of the GitLab report
+	report string
+
+	mu     sync.Mutex
+	issues []codeQualityIssue
+}
+
+// NewHandler returns a handler which annotates the records logged through it
+// in format before passing them on to next.  GitHub workflow commands are
+// written to w as they are logged, while the GitLab report is written to the
+// report file by Finish.
+func NewHandler(next slog.Handler, format string, w io.Writer, report string) (*Handler, error) {
+	switch format {
+	case FormatGitHub:
+	case FormatGitLab:
+		if report == "" {
+			return nil, errors.New("the gitlab annotation format needs a report file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown annotation format %q, must be one of %s or %s", format, FormatGitHub, FormatGitLab)
+	}
+
+	return &Handler{
+		next: next,
+		out:  &output{format: format, w: w, report: report, issues: []codeQualityIssue{}},
+	}, nil
+}
+
+// Enabled implements slog.Handler.  Warnings and errors are always enabled,
+// as they are annotated even when next does not log them.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		file, line := h.location(r)
+		h.out.annotate(r.Level, file, line, r.Message)
+	}
+
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	if !h.grouped {
+		c.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	}
+	return &c
+}
+
+// WithGroup implements slog.Handler.  The attributes of groups do not
+// locate records.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.grouped = c.grouped || name != ""
+	return &c
+}
+
+// location returns the file and line of a record, the attributes of the
+// record taking precedence over those of the handler.
+func (h *Handler) location(r slog.Record) (file string, line int) {
+	visit := func(a slog.Attr) bool {
+		switch a.Key {
+		case AttrFile:
+			file = a.Value.String()
+		case AttrLine:
+			if a.Value.Kind() == slog.KindInt64 {
+				line = int(a.Value.Int64())
+			}
+		}
+		return true
+	}
+
+	for _, a := range h.attrs {
+		visit(a)
+	}
+	if !h.grouped {
+		r.Attrs(visit)
+	}
+
+	return file, line
+}
+
+// Finish annotates err, the error a command failed with if any, and writes
+// the GitLab report.  The errors in err which are Located are annotated at
+// their location, and err as a whole otherwise.
+func (h *Handler) Finish(err error) error {
+	if err != nil {
+		located := locatedErrors(err)
+		for _, l := range located {
+			file, line := l.Location()
+			h.out.annotate(slog.LevelError, file, line, l.(error).Error())
+		}
+		if len(located) == 0 {
+			h.out.annotate(slog.LevelError, "", 0, err.Error())
+		}
+	}
+
+	if h.out.format != FormatGitLab {
+		return nil
+	}
+
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	data, err := json.MarshalIndent(h.out.issues, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(h.out.report, data, 0o644); err != nil {
+		return fmt.Errorf("writing annotations: %w", err)
+	}
+
+	return nil
+}
+
+// locatedErrors returns the errors in the tree of err which are Located.
+func locatedErrors(err error) []Located {
+	if l, ok := err.(Located); ok {
+		return []Located{l}
+	}
+
+	located := []Located{}
+	switch u := err.(type) {
+	case interface{ Unwrap() error }:
+		if inner := u.Unwrap(); inner != nil {
+			located = append(located, locatedErrors(inner)...)
+		}
+	case interface{ Unwrap() []error }:
+		for _, inner := range u.Unwrap() {
+			located = append(located, locatedErrors(inner)...)
+		}
+	}
+
+	return located
+}
+
+func (o *output) annotate(level slog.Level, file string, line int, msg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch o.format {
+	case FormatGitHub:
+		command := "warning"
+		if level >= slog.LevelError {
+			command = "error"
+		}
+
+		props := []string{}
+		if file != "" {
+			props = append(props, "file="+escapeProperty(file))
+			if line > 0 {
+				props = append(props, fmt.Sprintf("line=%d", line))
+			}
+		}
+		props = append(props, "title=melange")
+
+		fmt.Fprintf(o.w, "::%s %s::%s\n", command, strings.Join(props, ","), escapeData(msg))
+	case FormatGitLab:
+		// Code quality issues have to be about a file.
+		if file == "" {
+			return
+		}
+
+		severity := "minor"
+		if level >= slog.LevelError {
+			severity = "major"
+		}
+		if line <= 0 {
+			line = 1
+		}
+
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", file, line, msg)))
+		issue := codeQualityIssue{
+			Description: msg,
+			CheckName:   "melange",
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Severity:    severity,
+		}
+		issue.Location.Path = file
+		issue.Location.Lines.Begin = line
+		o.issues = append(o.issues, issue)
+	}
+}
+
+// codeQualityIssue is an issue of a GitLab code quality report.
+type codeQualityIssue struct {
+	Description string `json:"description"`
+	CheckName   string `json:"check_name"`
+	Fingerprint string `json:"fingerprint"`
+	Severity    string `json:"severity"`
+	Location    struct {
+		Path  string `json:"path"`
+		Lines struct {
+			Begin int `json:"begin"`
+		} `json:"lines"`
+	} `json:"location"`
+}
+
+// escapeData escapes the message of a workflow command.
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a property of a workflow command.
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
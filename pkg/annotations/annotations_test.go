@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotations
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type locatedError struct {
+	file string
+	line int
+}
+
+func (e locatedError) Error() string { return fmt.Sprintf("%s:%d: bad", e.file, e.line) }
+
+func (e locatedError) Location() (string, int) { return e.file, e.line }
+
+func TestGitHub(t *testing.T) {
+	var logs, out bytes.Buffer
+	h, err := NewHandler(slog.NewTextHandler(&logs, nil), FormatGitHub, &out, "")
+	require.NoError(t, err)
+
+	log := slog.New(h)
+	log.Info("not annotated")
+	log.With(At("hello.yaml", 0)...).Warn("about the file")
+	log.With(At("hello.yaml", 3)...).WithGroup("g").Warn("line 3: 100%\nsecond line", "line", 7)
+	log.Error("from the record", At("a,b:c.yaml", 12)...)
+
+	require.NoError(t, h.Finish(fmt.Errorf("building: %w", errors.Join(
+		locatedError{"hello.yaml", 5},
+		locatedError{"hello.yaml", 9},
+	))))
+	require.NoError(t, h.Finish(errors.New("failed")))
+
+	require.Equal(t, `::warning file=hello.yaml,title=melange::about the file
+::warning file=hello.yaml,line=3,title=melange::line 3: 100%25%0Asecond line
+::error file=a%2Cb%3Ac.yaml,line=12,title=melange::from the record
+::error file=hello.yaml,line=5,title=melange::hello.yaml:5: bad
+::error file=hello.yaml,line=9,title=melange::hello.yaml:9: bad
+::error title=melange::failed
+`, out.String())
+
+	// Every record still reaches the wrapped handler.
+	require.Contains(t, logs.String(), "not annotated")
+	require.Contains(t, logs.String(), "about the file")
+}
+
+func TestGitLab(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.json")
+	_, err := NewHandler(slog.NewTextHandler(io.Discard, nil), FormatGitLab, io.Discard, "")
+	require.Error(t, err)
+
+	h, err := NewHandler(slog.NewTextHandler(io.Discard, nil), FormatGitLab, io.Discard, report)
+	require.NoError(t, err)
+
+	log := slog.New(h)
+	log.Warn("no file")
+	log.With(At("hello.yaml", 3)...).Warn("unable to resolve dependency foo")
+	require.NoError(t, h.Finish(locatedError{"hello.yaml", 5}))
+
+	data, err := os.ReadFile(report)
+	require.NoError(t, err)
+
+	issues := []codeQualityIssue{}
+	require.NoError(t, json.Unmarshal(data, &issues))
+	require.Len(t, issues, 2)
+
+	require.Equal(t, "unable to resolve dependency foo", issues[0].Description)
+	require.Equal(t, "minor", issues[0].Severity)
+	require.Equal(t, "hello.yaml", issues[0].Location.Path)
+	require.Equal(t, 3, issues[0].Location.Lines.Begin)
+
+	require.Equal(t, "hello.yaml:5: bad", issues[1].Description)
+	require.Equal(t, "major", issues[1].Severity)
+	require.Equal(t, 5, issues[1].Location.Lines.Begin)
+	require.NotEqual(t, issues[0].Fingerprint, issues[1].Fingerprint)
+}
+
+func TestNewHandler_unknownFormat(t *testing.T) {
+	_, err := NewHandler(slog.NewTextHandler(io.Discard, nil), "jenkins", io.Discard, "")
+	require.ErrorContains(t, err, `unknown annotation format "jenkins"`)
+}
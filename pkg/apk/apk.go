@@ -0,0 +1,410 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apk reads the metadata, files, scripts and signature of an apk,
+// without needing apk-tools.
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+)
+
+// File describes a file of a package.
+type File struct {
+	Path string `json:"path"`
+	// The type of the file: file, dir, symlink, hardlink or other
+	Type string `json:"type"`
+	// The permission bits, including setuid, setgid and sticky
+	Mode int64 `json:"mode"`
+	UID  int   `json:"uid"`
+	GID  int   `json:"gid"`
+	Size int64 `json:"size"`
+	// The sha256 digest of the contents of a regular file
+	Digest string `json:"digest,omitempty"`
+	// The target of a link
+	Link string `json:"link,omitempty"`
+}
+
+// Signature describes the signature of a package.
+type Signature struct {
+	// The name of the signature file, e.g. .SIGN.RSA.melange.rsa.pub
+	Name string `json:"name"`
+	// The name of the public key the package claims to be signed with
+	Key string `json:"key"`
+	// The signature itself
+	Data []byte `json:"-"`
+}
+
+// SignatureStream is the gzip stream of signatures which starts a signed
+// package or index.  Everything after it is what is signed.
+type SignatureStream struct {
+	// The signatures, in the order of the stream
+	Signatures []Signature
+	// The compressed length of the stream
+	Length int64
+}
+
+// ErrNotSigned is returned when a package or an index does not start with a
+// signature stream.
+var ErrNotSigned = errors.New("not signed")
+
+// Package is the contents of an apk.
+type Package struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Arch          string   `json:"arch"`
+	Description   string   `json:"description,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	License       string   `json:"license,omitempty"`
+	Origin        string   `json:"origin,omitempty"`
+	Commit        string   `json:"commit,omitempty"`
+	BuildDate     int64    `json:"builddate,omitempty"`
+	InstalledSize int64    `json:"installed-size"`
+	DataHash      string   `json:"datahash,omitempty"`
+	Depends       []string `json:"depends,omitempty"`
+	Provides      []string `json:"provides,omitempty"`
+
+	// Every field of the .PKGINFO, some of which may be repeated
+	Info map[string][]string `json:"info"`
+
+	// The size of the apk in bytes
+	Size int64 `json:"size"`
+	// The checksum of the control section, as recorded in an APKINDEX
+	Checksum string `json:"checksum"`
+	// The signature of the package, unless it is unsigned
+	Signature *Signature `json:"signature,omitempty"`
+	// The names of the install scripts, e.g. .post-install
+	Scripts []string `json:"scripts,omitempty"`
+	// The files of the package, in the order of the data section
+	Files []File `json:"files"`
+}
+
+// Read reads the apk at path.
+func Read(ctx context.Context, path string) (*Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", path, err)
+	}
+	defer exp.Close()
+
+	pkginfo, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+	if err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO of %s: %w", path, err)
+	}
+
+	pkg := &Package{
+		Info:     ParsePkginfo(pkginfo),
+		Size:     exp.Size,
+		Checksum: "Q1" + base64.StdEncoding.EncodeToString(exp.ControlHash),
+		Scripts:  []string{},
+	}
+	if err := pkg.setFields(); err != nil {
+		return nil, fmt.Errorf("reading .PKGINFO of %s: %w", path, err)
+	}
+
+	entries, err := fs.ReadDir(exp.ControlFS, ".")
+	if err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", path, err)
+	}
+	for _, ent := range entries {
+		if ent.Name() != ".PKGINFO" && strings.HasPrefix(ent.Name(), ".") {
+			pkg.Scripts = append(pkg.Scripts, ent.Name())
+		}
+	}
+	sort.Strings(pkg.Scripts)
+
+	if exp.Signed {
+		pkg.Signature, err = readSignature(exp.SignatureFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading signature of %s: %w", path, err)
+		}
+	}
+
+	pkg.Files, err = readFiles(exp.PackageFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the files of %s: %w", path, err)
+	}
+
+	return pkg, nil
+}
+
+// ParsePkginfo returns the values of each field of a .PKGINFO.
+func ParsePkginfo(data []byte) map[string][]string {
+	fields := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			continue
+		}
+		fields[key] = append(fields[key], value)
+	}
+
+	return fields
+}
+
+// setFields sets the fields of the package from its .PKGINFO.
+func (pkg *Package) setFields() error {
+	field := func(key string) string {
+		if v := pkg.Info[key]; len(v) != 0 {
+			return v[len(v)-1]
+		}
+		return ""
+	}
+
+	pkg.Name = field("pkgname")
+	pkg.Version = field("pkgver")
+	pkg.Arch = field("arch")
+	pkg.Description = field("pkgdesc")
+	pkg.URL = field("url")
+	pkg.License = field("license")
+	pkg.Origin = field("origin")
+	pkg.Commit = field("commit")
+	pkg.DataHash = field("datahash")
+	pkg.Depends = pkg.Info["depend"]
+	pkg.Provides = pkg.Info["provides"]
+
+	for key, dst := range map[string]*int64{"builddate": &pkg.BuildDate, "size": &pkg.InstalledSize} {
+		if v := field(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, v, err)
+			}
+			*dst = n
+		}
+	}
+
+	return nil
+}
+
+func readSignature(path string) (*Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stream, err := ReadSignatureStream(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stream.Signatures[0], nil
+}
+
+// ReadSignatureStream reads the signature stream at the start of r, which
+// is an apk, an APKINDEX.tar.gz or the signature section of an expanded apk,
+// and fails with ErrNotSigned if there is none.
+func ReadSignatureStream(r io.Reader) (*SignatureStream, error) {
+	// The gzip reader reads a ByteReader a byte at a time, so the bytes it
+	// consumes are the length of the stream.
+	cr := &countingReader{r: bufio.NewReader(r)}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+
+	stream := &SignatureStream{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading signature: %w", err)
+		}
+		if !strings.HasPrefix(hdr.Name, ".SIGN.") {
+			return nil, fmt.Errorf("%w: found %s instead of a signature", ErrNotSigned, hdr.Name)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading signature: %w", err)
+		}
+
+		sig := Signature{Name: hdr.Name, Data: data}
+		// .SIGN.<algorithm>.<key>
+		if parts := strings.SplitN(hdr.Name, ".", 4); len(parts) == 4 {
+			sig.Key = parts[3]
+		}
+		stream.Signatures = append(stream.Signatures, sig)
+	}
+	if len(stream.Signatures) == 0 {
+		return nil, fmt.Errorf("%w: the first stream is empty", ErrNotSigned)
+	}
+
+	// Signature streams have no end-of-archive marker, so the tar reader
+	// stops at the end of the gzip stream, but any padding is read through.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, err
+	}
+	stream.Length = cr.n
+
+	return stream, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readFiles returns the files of a data section.
+func readFiles(path string) ([]File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := []File{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		file := File{
+			Path: strings.TrimSuffix(hdr.Name, "/"),
+			Mode: hdr.Mode & 0o7777,
+			UID:  hdr.Uid,
+			GID:  hdr.Gid,
+			Size: hdr.Size,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			file.Type = "file"
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+			}
+			file.Digest = hex.EncodeToString(h.Sum(nil))
+		case tar.TypeDir:
+			file.Type = "dir"
+		case tar.TypeSymlink:
+			file.Type = "symlink"
+			file.Link = hdr.Linkname
+		case tar.TypeLink:
+			file.Type = "hardlink"
+			file.Link = hdr.Linkname
+		default:
+			file.Type = "other"
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// WriteText writes a human-readable summary of the package to w, like
+// `apk info -a` would.
+func (pkg *Package) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "%s-%s (%s)\n", pkg.Name, pkg.Version, pkg.Arch)
+	if pkg.Description != "" {
+		fmt.Fprintf(bw, "  %s\n", pkg.Description)
+	}
+
+	fmt.Fprintln(bw, "\n.PKGINFO:")
+	keys := make([]string, 0, len(pkg.Info))
+	for key := range pkg.Info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range pkg.Info[key] {
+			fmt.Fprintf(bw, "  %s = %s\n", key, v)
+		}
+	}
+
+	fmt.Fprintln(bw, "\napk:")
+	fmt.Fprintf(bw, "  size: %d\n", pkg.Size)
+	fmt.Fprintf(bw, "  checksum: %s\n", pkg.Checksum)
+	if pkg.Signature != nil {
+		fmt.Fprintf(bw, "  signed with: %s\n", pkg.Signature.Key)
+	} else {
+		fmt.Fprintln(bw, "  unsigned")
+	}
+	if len(pkg.Scripts) != 0 {
+		fmt.Fprintf(bw, "  scripts: %s\n", strings.Join(pkg.Scripts, ", "))
+	}
+
+	fmt.Fprintln(bw, "\nfiles:")
+	for _, f := range pkg.Files {
+		switch f.Type {
+		case "file":
+			fmt.Fprintf(bw, "  %04o %d:%d %10d %s sha256:%s\n", f.Mode, f.UID, f.GID, f.Size, f.Path, f.Digest)
+		case "symlink", "hardlink":
+			fmt.Fprintf(bw, "  %04o %d:%d %10s %s -> %s\n", f.Mode, f.UID, f.GID, f.Type, f.Path, f.Link)
+		default:
+			fmt.Fprintf(bw, "  %04o %d:%d %10s %s\n", f.Mode, f.UID, f.GID, f.Type, f.Path)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRead(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	pkg, err := Read(ctx, filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+
+	require.Equal(t, "libcap", pkg.Name)
+	require.Equal(t, "2.69-r0", pkg.Version)
+	require.Equal(t, "aarch64", pkg.Arch)
+	require.Equal(t, "BSD-3-Clause OR GPL-2.0-only", pkg.License)
+	require.Equal(t, int64(166451), pkg.InstalledSize)
+	require.Equal(t, []string{"so:ld-linux-aarch64.so.1", "so:libc.so.6", "so:libcap.so.2", "so:libpsx.so.2"}, pkg.Depends)
+	require.Equal(t, []string{""}, pkg.Info["commit"])
+
+	require.Equal(t, "Q1GTjdDWSAN/e8mRmTQLLkcs0qRkA=", pkg.Checksum)
+	require.Equal(t, ".SIGN.RSA.wolfi-signing.rsa.pub", pkg.Signature.Name)
+	require.Equal(t, "wolfi-signing.rsa.pub", pkg.Signature.Key)
+	require.Len(t, pkg.Signature.Data, 512)
+	require.Empty(t, pkg.Scripts)
+
+	require.Len(t, pkg.Files, 11)
+	require.Equal(t, File{Path: "usr/lib/libcap.so.2", Type: "symlink", Mode: 0o777, Link: "libcap.so.2.69"}, pkg.Files[2])
+	require.Equal(t, File{
+		Path:   "usr/lib/libcap.so.2.69",
+		Type:   "file",
+		Mode:   0o755,
+		Size:   67424,
+		Digest: "a22608b0f58d1cb5df0a87abe0eec705acc969071646c6891c88a2e6b5b21444",
+	}, pkg.Files[3])
+
+	var buf bytes.Buffer
+	require.NoError(t, pkg.WriteText(&buf))
+	require.Contains(t, buf.String(), "libcap-2.69-r0 (aarch64)\n")
+	require.Contains(t, buf.String(), "  depend = so:libc.so.6\n")
+	require.Contains(t, buf.String(), "  signed with: wolfi-signing.rsa.pub\n")
+	require.Contains(t, buf.String(), "  0777 0:0    symlink usr/lib/libcap.so.2 -> libcap.so.2.69\n")
+}
+
+func TestReadSignatureStream(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+
+	stream, err := ReadSignatureStream(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, stream.Signatures, 1)
+	require.Equal(t, "wolfi-signing.rsa.pub", stream.Signatures[0].Key)
+
+	// The control section follows the signature.
+	zr, err := gzip.NewReader(bytes.NewReader(data[stream.Length:]))
+	require.NoError(t, err)
+	hdr, err := tar.NewReader(zr).Next()
+	require.NoError(t, err)
+	require.Equal(t, ".PKGINFO", hdr.Name)
+
+	_, err = ReadSignatureStream(bytes.NewReader(data[stream.Length:]))
+	require.ErrorIs(t, err, ErrNotSigned)
+
+	// A stream with several signatures and an end-of-archive marker, as
+	// other tools may write, is read through.
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{".SIGN.RSA.a.rsa.pub", ".SIGN.RSA256.b.rsa.pub"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 3}))
+		_, err := tw.Write([]byte("sig"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	n := buf.Len()
+	buf.WriteString("signed data")
+
+	stream, err = ReadSignatureStream(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(n), stream.Length)
+	require.Equal(t, []Signature{
+		{Name: ".SIGN.RSA.a.rsa.pub", Key: "a.rsa.pub", Data: []byte("sig")},
+		{Name: ".SIGN.RSA256.b.rsa.pub", Key: "b.rsa.pub", Data: []byte("sig")},
+	}, stream.Signatures)
+}
+
+func TestParsePkginfo(t *testing.T) {
+	require.Equal(t, map[string][]string{
+		"pkgname":  {"hello"},
+		"provides": {"cmd:hello=1.0-r0", "so:libhello.so.1=1"},
+		"url":      {""},
+	}, ParsePkginfo([]byte(`# Generated by melange
+pkgname = hello
+url = 
+provides = cmd:hello=1.0-r0
+provides = so:libhello.so.1=1
+`)))
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apkdiff compares the contents of two apks: their files, the fields
+// of their .PKGINFO, and their dependencies and provides, which are compared
+// separately as they are mostly generated.
+package apkdiff
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+// FileChange is a file which both packages ship, but which differs.
+type FileChange struct {
+	Path string   `json:"path"`
+	Old  apk.File `json:"old"`
+	New  apk.File `json:"new"`
+	// What differs: type, mode, owner, content or link
+	Changes []string `json:"changes"`
+}
+
+// FieldChange is a field of the .PKGINFO which differs.  Fields may be
+// repeated, so they have a list of values.
+type FieldChange struct {
+	Field string   `json:"field"`
+	Old   []string `json:"old,omitempty"`
+	New   []string `json:"new,omitempty"`
+}
+
+// ListChange is what was added to and removed from a list.
+type ListChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Empty returns whether the lists are the same.
+func (c ListChange) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// Diff is the difference between two packages.
+type Diff struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+
+	Fields   []FieldChange `json:"fields,omitempty"`
+	Depends  ListChange    `json:"depends"`
+	Provides ListChange    `json:"provides"`
+
+	Added   []apk.File   `json:"added,omitempty"`
+	Removed []apk.File   `json:"removed,omitempty"`
+	Changed []FileChange `json:"changed,omitempty"`
+}
+
+// Empty returns whether the packages have the same contents.
+func (d *Diff) Empty() bool {
+	return len(d.Fields) == 0 && d.Depends.Empty() && d.Provides.Empty() &&
+		len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Fields of the .PKGINFO which are compared as lists rather than fields.
+const (
+	fieldDepend   = "depend"
+	fieldProvides = "provides"
+)
+
+// contents is what is compared of a package.
+type contents struct {
+	name   string
+	fields map[string][]string
+	files  map[string]apk.File
+}
+
+// Compare compares the apks at the paths oldPath and newPath.
+func Compare(ctx context.Context, oldPath, newPath string) (*Diff, error) {
+	oc, err := readPackage(ctx, oldPath)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := readPackage(ctx, newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Diff{
+		Old:     oc.name,
+		New:     nc.name,
+		Added:   []apk.File{},
+		Removed: []apk.File{},
+		Changed: []FileChange{},
+	}
+
+	for _, field := range sortedKeys(oc.fields, nc.fields) {
+		ov, nv := oc.fields[field], nc.fields[field]
+		switch field {
+		case fieldDepend:
+			d.Depends = compareLists(ov, nv)
+		case fieldProvides:
+			d.Provides = compareLists(ov, nv)
+		default:
+			if !equal(ov, nv) {
+				d.Fields = append(d.Fields, FieldChange{Field: field, Old: ov, New: nv})
+			}
+		}
+	}
+
+	for _, path := range sortedKeys(oc.files, nc.files) {
+		of, inOld := oc.files[path]
+		nf, inNew := nc.files[path]
+		switch {
+		case !inOld:
+			d.Added = append(d.Added, nf)
+		case !inNew:
+			d.Removed = append(d.Removed, of)
+		default:
+			if changes := compareFiles(of, nf); len(changes) != 0 {
+				d.Changed = append(d.Changed, FileChange{Path: path, Old: of, New: nf, Changes: changes})
+			}
+		}
+	}
+
+	return d, nil
+}
+
+func readPackage(ctx context.Context, path string) (*contents, error) {
+	pkg, err := apk.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &contents{name: path, fields: pkg.Info, files: map[string]apk.File{}}
+	if pkg.Name != "" && pkg.Version != "" {
+		c.name = pkg.Name + "-" + pkg.Version
+	}
+	for _, f := range pkg.Files {
+		c.files[f.Path] = f
+	}
+
+	return c, nil
+}
+
+func compareFiles(o, n apk.File) []string {
+	changes := []string{}
+	if o.Type != n.Type {
+		changes = append(changes, "type")
+	}
+	if o.Mode != n.Mode {
+		changes = append(changes, "mode")
+	}
+	if o.UID != n.UID || o.GID != n.GID {
+		changes = append(changes, "owner")
+	}
+	if o.Digest != n.Digest {
+		changes = append(changes, "content")
+	}
+	if o.Link != n.Link {
+		changes = append(changes, "link")
+	}
+
+	return changes
+}
+
+func compareLists(o, n []string) ListChange {
+	c := ListChange{Added: []string{}, Removed: []string{}}
+	in := func(list []string, s string) bool {
+		for _, e := range list {
+			if e == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, s := range n {
+		if !in(o, s) {
+			c.Added = append(c.Added, s)
+		}
+	}
+	for _, s := range o {
+		if !in(n, s) {
+			c.Removed = append(c.Removed, s)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Removed)
+
+	return c
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortedKeys returns the keys of both maps, sorted.
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// WriteText writes a human-readable summary of the diff to w.
+func (d *Diff) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", d.Old, d.New)
+	if d.Empty() {
+		fmt.Fprintln(bw, "no differences")
+		return bw.Flush()
+	}
+
+	if len(d.Fields) != 0 {
+		fmt.Fprintln(bw, "\n.PKGINFO:")
+		for _, f := range d.Fields {
+			fmt.Fprintf(bw, "  %s: %s -> %s\n", f.Field, values(f.Old), values(f.New))
+		}
+	}
+
+	for _, l := range []struct {
+		name string
+		c    ListChange
+	}{
+		{"depends", d.Depends},
+		{"provides", d.Provides},
+	} {
+		if l.c.Empty() {
+			continue
+		}
+		fmt.Fprintf(bw, "\n%s:\n", l.name)
+		for _, s := range l.c.Removed {
+			fmt.Fprintf(bw, "  - %s\n", s)
+		}
+		for _, s := range l.c.Added {
+			fmt.Fprintf(bw, "  + %s\n", s)
+		}
+	}
+
+	if len(d.Added) != 0 || len(d.Removed) != 0 || len(d.Changed) != 0 {
+		fmt.Fprintln(bw, "\nfiles:")
+		for _, f := range d.Removed {
+			fmt.Fprintf(bw, "  - %s\n", f.Path)
+		}
+		for _, f := range d.Added {
+			fmt.Fprintf(bw, "  + %s\n", f.Path)
+		}
+		for _, c := range d.Changed {
+			fmt.Fprintf(bw, "  ~ %s (%s)\n", c.Path, strings.Join(c.describe(), ", "))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// describe returns the changes of a file, with the old and new values of
+// its attributes.
+func (c FileChange) describe() []string {
+	desc := []string{}
+	for _, change := range c.Changes {
+		switch change {
+		case "type":
+			desc = append(desc, fmt.Sprintf("type %s -> %s", c.Old.Type, c.New.Type))
+		case "mode":
+			desc = append(desc, fmt.Sprintf("mode %04o -> %04o", c.Old.Mode, c.New.Mode))
+		case "owner":
+			desc = append(desc, fmt.Sprintf("owner %d:%d -> %d:%d", c.Old.UID, c.Old.GID, c.New.UID, c.New.GID))
+		case "content":
+			desc = append(desc, fmt.Sprintf("content, %d -> %d bytes", c.Old.Size, c.New.Size))
+		case "link":
+			desc = append(desc, fmt.Sprintf("link %s -> %s", c.Old.Link, c.New.Link))
+		}
+	}
+
+	return desc
+}
+
+func values(v []string) string {
+	if len(v) == 0 {
+		return "(none)"
+	}
+
+	return strings.Join(v, ", ")
+}
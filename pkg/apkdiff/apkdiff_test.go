@@ -0,0 +1,142 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	name, content, link string
+	mode                int64
+}
+
+// writeAPK writes an unsigned apk with the .PKGINFO and the entries.
+func writeAPK(t *testing.T, pkginfo string, entries ...entry) string {
+	t.Helper()
+
+	section := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+			switch {
+			case e.link != "":
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+			case strings.HasSuffix(e.name, "/"):
+				hdr.Typeflag = tar.TypeDir
+			}
+			require.NoError(t, tw.WriteHeader(hdr))
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(e.content))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	path := filepath.Join(t.TempDir(), "test.apk")
+	data := append(section(entry{name: ".PKGINFO", content: pkginfo, mode: 0o644}), section(entries...)...)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	return path
+}
+
+func TestCompare(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	oldAPK := writeAPK(t, `# Generated by melange
+pkgname = hello
+pkgver = 1.0-r0
+license = MIT
+depend = so:libc.so.6
+depend = so:libz.so.1
+provides = cmd:hello=1.0-r0
+`,
+		entry{name: "usr/", mode: 0o755},
+		entry{name: "usr/bin/", mode: 0o755},
+		entry{name: "usr/bin/hello", content: "v1", mode: 0o755},
+		entry{name: "usr/bin/hi", link: "hello", mode: 0o777},
+		entry{name: "usr/share/doc", content: "docs", mode: 0o644},
+	)
+	newAPK := writeAPK(t, `# Generated by melange
+pkgname = hello
+pkgver = 1.1-r0
+license = MIT
+depend = so:libc.so.6
+depend = so:libzstd.so.1
+provides = cmd:hello=1.1-r0
+`,
+		entry{name: "usr/", mode: 0o755},
+		entry{name: "usr/bin/", mode: 0o755},
+		entry{name: "usr/bin/hello", content: "v1.1", mode: 0o4755},
+		entry{name: "usr/bin/hi", link: "hello", mode: 0o777},
+		entry{name: "usr/bin/hello-config", content: "#!/bin/sh", mode: 0o755},
+	)
+
+	d, err := Compare(ctx, oldAPK, oldAPK)
+	require.NoError(t, err)
+	require.True(t, d.Empty())
+
+	d, err = Compare(ctx, oldAPK, newAPK)
+	require.NoError(t, err)
+	require.False(t, d.Empty())
+	require.Equal(t, "hello-1.0-r0", d.Old)
+	require.Equal(t, "hello-1.1-r0", d.New)
+	require.Equal(t, []FieldChange{{Field: "pkgver", Old: []string{"1.0-r0"}, New: []string{"1.1-r0"}}}, d.Fields)
+	require.Equal(t, ListChange{Added: []string{"so:libzstd.so.1"}, Removed: []string{"so:libz.so.1"}}, d.Depends)
+	require.Equal(t, ListChange{Added: []string{"cmd:hello=1.1-r0"}, Removed: []string{"cmd:hello=1.0-r0"}}, d.Provides)
+
+	require.Len(t, d.Added, 1)
+	require.Equal(t, "usr/bin/hello-config", d.Added[0].Path)
+	require.Len(t, d.Removed, 1)
+	require.Equal(t, "usr/share/doc", d.Removed[0].Path)
+	require.Len(t, d.Changed, 1)
+	require.Equal(t, "usr/bin/hello", d.Changed[0].Path)
+	require.Equal(t, []string{"mode", "content"}, d.Changed[0].Changes)
+
+	var buf bytes.Buffer
+	require.NoError(t, d.WriteText(&buf))
+	require.Equal(t, `--- hello-1.0-r0
++++ hello-1.1-r0
+
+.PKGINFO:
+  pkgver: 1.0-r0 -> 1.1-r0
+
+depends:
+  - so:libz.so.1
+  + so:libzstd.so.1
+
+provides:
+  - cmd:hello=1.0-r0
+  + cmd:hello=1.1-r0
+
+files:
+  - usr/share/doc
+  + usr/bin/hello-config
+  ~ usr/bin/hello (mode 0755 -> 4755, content, 2 -> 4 bytes)
+`, buf.String())
+}
@@ -26,8 +26,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	apko_build "chainguard.dev/apko/pkg/build"
@@ -35,6 +37,8 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/chainguard-dev/clog"
 	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/go-git/go-git/v5"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/yookoala/realpath"
 	"github.com/zealic/xignore"
 	"go.opentelemetry.io/otel"
@@ -42,12 +46,20 @@ import (
 	"google.golang.org/api/option"
 	"k8s.io/kube-openapi/pkg/util/sets"
 
+	"chainguard.dev/melange/pkg/annotations"
+	"chainguard.dev/melange/pkg/cachecrypt"
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/elfindex"
+	"chainguard.dev/melange/pkg/failure"
 	"chainguard.dev/melange/pkg/index"
 	"chainguard.dev/melange/pkg/linter"
+	"chainguard.dev/melange/pkg/plugin"
+	"chainguard.dev/melange/pkg/progress"
+	"chainguard.dev/melange/pkg/publish"
 	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/scan"
 )
 
 var ErrSkipThisArch = errors.New("error: skip this arch")
@@ -73,11 +85,15 @@ type Build struct {
 	ExtraRepos        []string
 	ExtraPackages     []string
 	DependencyLog     string
+	BuildReport       string
+	Profile           string
 	BinShOverlay      string
 	CreateBuildLog    bool
 	CacheDir          string
 	ApkCacheDir       string
 	CacheSource       string
+	CacheKey          string
+	CompilerCacheDir  string
 	StripOriginName   bool
 	EnvFile           string
 	VarsFile          string
@@ -86,14 +102,232 @@ type Build struct {
 	Debug             bool
 	DebugRunner       bool
 	Interactive       bool
+	// ArchParallelism is how many architectures are built at a time when
+	// several are requested, or 0 to build all of them at once.
+	ArchParallelism   int
 	Remove            bool
 	LogPolicy         []string
 	FailOnLintWarning bool
-	DefaultCPU        string
-	DefaultMemory     string
-	DefaultTimeout    time.Duration
+	// Fail the build if a generated shared library dependency is not
+	// provided by any package.
+	FailOnUnresolvedLibs bool
+	// Fail the build if a license of the package is not a valid SPDX
+	// license expression.
+	FailOnUnknownLicense bool
+	// Strict enables all of the checks which turn warnings into failures.
+	Strict         bool
+	DefaultCPU     string
+	DefaultMemory  string
+	DefaultTimeout time.Duration
+	Nameservers    []string
+	ExtraHosts     []string
 
 	EnabledBuildOptions []string
+
+	// RebuildReport is where the packages of ReferenceRepository which must
+	// be rebuilt because of a removed shared library are written.
+	RebuildReport       string
+	ReferenceRepository string
+	// RemovedFiles is what to do with the files of the packages in
+	// ReferenceRepository which the build no longer ships: warn or fail.
+	// They are not checked if it is empty.
+	RemovedFiles string
+
+	// ReproducibilityCheck emits every package a second time, and fails
+	// the build unless the apks are identical.
+	ReproducibilityCheck bool
+
+	// VerifyRepositories verifies the signatures of the repositories used
+	// to build the build environment, and of the packages installed from
+	// them, against the keyring.
+	VerifyRepositories bool
+
+	// PrefetchSources fetches the sources of the fetch steps into CacheDir
+	// on the host, verifying their digests, before the build starts.
+	PrefetchSources bool
+
+	// ServeRepository indexes OutDir and appends it to the repositories of
+	// the build environment, mounted into the guest, so that packages
+	// emitted by earlier builds can be installed.
+	ServeRepository bool
+
+	// Resume skips the top-level pipeline steps which completed in the
+	// workspace during a previous, failed build.
+	Resume bool
+
+	// KeepWorkspace keeps the build environment and the workspace of a
+	// failed build, and describes them next to the workspace so that they
+	// can be exported for debugging.
+	KeepWorkspace bool
+
+	// MinFreeSpace is the space in bytes which must be left free on the
+	// filesystems used by the build, on top of its estimated needs.
+	MinFreeSpace uint64
+
+	// MaxSparseSize is the size in bytes above which the sparse files of
+	// the packages fail the build, as they are packaged expanded, or 0.
+	MaxSparseSize uint64
+
+	// CompressionLevel is the gzip compression level of the sections of the
+	// packages, from 1 to 9, or 0 for the default level.
+	CompressionLevel int
+
+	// TarOwners is the policy for the owners of the entries of the
+	// tarballs of the emitted packages.
+	TarOwners TarOwners
+
+	// WorkspaceFS returns the filesystems the packages are emitted from, in
+	// place of the melange-out directory of the workspace, e.g. for runners
+	// which keep the workspace on a remote filesystem.  The packages are
+	// checked, linted and scanned for their SBOMs through it, with the files
+	// which melange adds written to the melange-out directory, and the
+	// options which change the files of the packages in place cannot be
+	// used with it.
+	WorkspaceFS WorkspaceFSFunc
+
+	// WorkspaceUIDMap and WorkspaceGIDMap map the owners of the files of the
+	// workspace on the host to their owners in the build environment, for
+	// rootless runners which run it in a user namespace.
+	WorkspaceUIDMap []IDMap
+	WorkspaceGIDMap []IDMap
+
+	// WorkspaceOverlay is whether the workspace is the upper directory of
+	// an overlayfs, whose whiteouts are left out of the packages.
+	WorkspaceOverlay bool
+
+	// UsrMerge moves the files of the packages in /bin, /sbin, /lib and
+	// /lib64 to their /usr counterparts, as UsrMergeMove or UsrMergeSymlink
+	// say, or is empty.
+	UsrMerge string
+
+	// StampBinaries adds a package metadata note to the ELF executables and
+	// shared libraries of the packages, identifying the package, the version
+	// and the build which produced them.
+	StampBinaries bool
+
+	// NoHardLinks packages the hard links of the workspace as copies, for
+	// the filesystems whose inode numbers are not stable.
+	NoHardLinks bool
+
+	// Rootless runs the build without privileges, in a user namespace in
+	// which the user running melange is root.  The runner must implement
+	// container.RootlessRunner.
+	Rootless bool
+
+	// PluginDirs are searched for plugin executables, which are described
+	// in docs/PLUGINS.md.
+	PluginDirs []string
+
+	// plugins are the plugins discovered in PluginDirs.
+	plugins []plugin.Plugin
+
+	// ConfigHooks is whether the hooks declared in the build file are run,
+	// as they run commands on the host.
+	ConfigHooks bool
+	// hooks are the hooks run at each point of the lifecycle of the build.
+	hooks map[string][]Hook
+
+	// Publish are the URLs of the remote repositories the packages are
+	// uploaded to after a successful build, along with their regenerated
+	// index.
+	Publish []string
+	// PublishDryRun logs what would be published instead of uploading it.
+	PublishDryRun bool
+	// publishers upload the packages to each repository of Publish.
+	publishers []*publish.Publisher
+	// Checksums is whether the SHA-256 digests of the packages, the index
+	// and the reports of the build are added to the SHA256SUMS file of the
+	// output directory of the architecture.
+	Checksums bool
+	// FileDigests is whether the control section of the packages lists the
+	// SHA-256 digests of their files, in a .SHA256SUMS file.
+	FileDigests bool
+	// ControlTemplate is the path of a template replacing the one of the
+	// .PKGINFO of the packages, if it is set.
+	ControlTemplate string
+	// controlTemplate is the parsed ControlTemplate.
+	controlTemplate *template.Template
+	// ArtifactRepository is the OCI repository each package is pushed to
+	// as an artifact after a successful build, with its SBOM and
+	// attestation attached, if it is set.
+	ArtifactRepository string
+	// Locked is whether the build environment is installed with exactly
+	// the versions of the packages recorded in the lockfile next to the
+	// configuration file, rather than recording them there.
+	Locked bool
+	// Scanner is the vulnerability scanner, grype or trivy, run over the
+	// build environment and the emitted packages, if it is set.
+	Scanner string
+	// ScanFailOn is the severity from which the vulnerabilities the
+	// scanner finds fail the build.  They are only logged if it is empty.
+	ScanFailOn string
+	// scanner runs Scanner.
+	scanner *scan.Scanner
+	// Proxy is the URL of the HTTP(S) proxy used by melange and by the
+	// build environment, if any.
+	Proxy string
+	// NoProxy are the hosts, domains and networks reached without the
+	// proxy.
+	NoProxy []string
+	// CACertificates are PEM files of certificates trusted by melange and by
+	// the build environment in addition to the usual ones, e.g. of a proxy
+	// intercepting TLS.
+	CACertificates []string
+
+	// buildDateSet is whether WithBuildDate set SourceDateEpoch, which is
+	// otherwise derived from the git history of the configuration file.
+	buildDateSet bool
+
+	// resolverDir holds generated resolv.conf and hosts overrides, if any.
+	resolverDir string
+	// secrets are the values of the secrets given to the build, by name.
+	secrets map[string]string
+	// secretsDir holds the secrets which are files, if any.
+	secretsDir string
+	// secretMasker replaces the values of the secrets in the output of the
+	// build.
+	secretMasker *strings.Replacer
+	// caCertificates are the CACertificates, as a PEM bundle.
+	caCertificates []byte
+	// kept is whether the build failed and keepEnvironment kept its
+	// environment and workspace.
+	kept bool
+	// caDir holds the CA bundles of the host and of the build environment,
+	// if there are CACertificates.
+	caDir string
+
+	// locks are held on the workspace and temporary directories until the
+	// build is closed.
+	locks []*fileLock
+
+	// report collects the build report, if one was requested.
+	report *Report
+
+	// trustedFingerprints are the fingerprints of the keys which verified the
+	// repositories of the build environment, with VerifyRepositories.
+	trustedFingerprints []string
+
+	// profile collects the profile, if one was requested.
+	profile *profiler
+
+	// tracker reports the progress of the packages of the build, if the
+	// context of the build carries one.
+	tracker *progress.Tracker
+
+	// checkpoint records the steps completed in the workspace, and resumed
+	// the steps completed by the previous build, when resuming builds.
+	checkpoint *checkpoint
+	resumed    *checkpoint
+	// completed is whether the build succeeded, after which its workspace
+	// is not kept to resume it.
+	completed bool
+
+	// dependencyLog collects the dependency log, if one was requested.
+	dependencyLog *DependencyLog
+
+	// elfIndexes are the indexes of the ELF files of the packages, by
+	// package name, which are built once their contents are final.
+	elfIndexes map[string]*elfindex.Index
 }
 
 func New(ctx context.Context, opts ...Option) (*Build, error) {
@@ -104,6 +338,9 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		CacheDir:        "./melange-cache/",
 		Arch:            apko_types.ParseArchitecture(runtime.GOARCH),
 		LogPolicy:       []string{"builtin:stderr"},
+		MinFreeSpace:    DefaultMinFreeSpace,
+		TarOwners:       TarOwnersNames,
+		hooks:           map[string][]Hook{},
 	}
 
 	for _, opt := range opts {
@@ -115,6 +352,27 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 	log := clog.New(slog.Default().Handler()).With("arch", b.Arch.ToAPK())
 	ctx = clog.WithLogger(ctx, log)
 
+	if b.RebuildReport != "" && b.ReferenceRepository == "" {
+		return nil, fmt.Errorf("a reference repository is required to write a rebuild report")
+	}
+
+	if b.RemovedFiles != "" && b.ReferenceRepository == "" {
+		return nil, fmt.Errorf("a reference repository is required to check for removed files")
+	}
+
+	if b.Resume && b.WorkspaceDir == "" {
+		return nil, fmt.Errorf("a workspace directory is required to resume builds")
+	}
+
+	if b.ServeRepository {
+		if b.SigningKey == "" {
+			return nil, fmt.Errorf("a signing key is required to use the output directory as a repository")
+		}
+		if _, err := os.Stat(b.SigningKey + ".pub"); err != nil {
+			return nil, fmt.Errorf("the public key of the signing key is required to use the output directory as a repository: %w", err)
+		}
+	}
+
 	// If no workspace directory is explicitly requested, create a
 	// temporary directory for it.  Otherwise, ensure we are in a
 	// subdir for this specific build context.
@@ -129,14 +387,27 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		}
 
 		b.WorkspaceDir = absdir
+
+		// Builds sharing a workspace would corrupt each other.
+		if err := os.MkdirAll(filepath.Dir(b.WorkspaceDir), 0755); err != nil {
+			return nil, fmt.Errorf("mkdir -p %s: %w", filepath.Dir(b.WorkspaceDir), err)
+		}
+		l, err := lockBeside(b.WorkspaceDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lock workspace dir: %w", err)
+		}
+		b.locks = append(b.locks, l)
 	} else {
-		tmpdir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-workspace-*")
+		tmpdir, l, err := lockedTempDir(b.Runner.TempDir(), "workspace-*")
 		if err != nil {
 			return nil, fmt.Errorf("unable to create workspace dir: %w", err)
 		}
 		b.WorkspaceDir = tmpdir
+		b.locks = append(b.locks, l)
 	}
 
+	b.cleanStale(ctx)
+
 	// If no config file is explicitly requested for the build context
 	// we check if .melange.yaml or melange.yaml exist.
 	checks := []string{".melange.yaml", ".melange.yml", "melange.yaml", "melange.yml"}
@@ -169,6 +440,12 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 
 	b.Configuration = *parsedCfg
 
+	if b.FailOnUnknownLicense || b.Strict {
+		if err := b.Configuration.ValidateLicenses(); err != nil {
+			return nil, err
+		}
+	}
+
 	if len(b.Configuration.Package.TargetArchitecture) == 1 &&
 		b.Configuration.Package.TargetArchitecture[0] == "all" {
 		log.Warnf("target-architecture: ['all'] is deprecated and will become an error; remove this field to build for all available archs")
@@ -177,6 +454,25 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		return nil, ErrSkipThisArch
 	}
 
+	pb := &PipelineBuild{Build: &b, Package: &b.Configuration.Package}
+	if result, err := pb.ShouldBuild(); err != nil {
+		return nil, err
+	} else if !result {
+		log.Infof("package if-conditional %q is false for %s", b.Configuration.Package.If, b.Arch.ToAPK())
+		return nil, ErrSkipThisArch
+	}
+
+	// Unless the build flag is set, the timestamps are those of the last
+	// commit of the configuration file.
+	if !b.buildDateSet {
+		if t, ok := configCommitTime(ctx, b.ConfigFile); ok {
+			log.Infof("using the time of the last commit of %s, %s, as the build date", b.ConfigFile, t.Format(time.RFC3339))
+			b.SourceDateEpoch = t
+		} else {
+			b.SourceDateEpoch = time.Unix(0, 0)
+		}
+	}
+
 	// SOURCE_DATE_EPOCH will always overwrite the build flag
 	if _, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
 		t, err := sourceDateEpoch(b.SourceDateEpoch)
@@ -191,6 +487,22 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		return nil, fmt.Errorf("unable to run containers using %s, specify --runner and one of %s", b.Runner.Name(), GetAllRunners())
 	}
 
+	if b.Rootless {
+		if err := b.checkRootless(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.Resume {
+		if err := b.checkResumable(); err != nil {
+			return nil, err
+		}
+	}
+
+	if b.KeepWorkspace && !slices.Contains(resumableRunners, b.Runner.Name()) {
+		return nil, fmt.Errorf("the %s runner does not keep the workspace on the host, which --keep-workspace needs", b.Runner.Name())
+	}
+
 	// Apply build options to the context.
 	for _, optName := range b.EnabledBuildOptions {
 		log.Infof("applying configuration patches for build option %s", optName)
@@ -202,22 +514,111 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		}
 	}
 
+	b.plugins, err = plugin.Discover(b.PluginDirs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range b.plugins {
+		log.Infof("using %s plugin %s from %s", p.Kind, p.Name, p.Path)
+	}
+
+	if err := b.checkWorkspaceFS(); err != nil {
+		return nil, err
+	}
+
+	if hooks := b.Configuration.Hooks; len(hooks) != 0 {
+		if b.ConfigHooks {
+			for _, h := range hooks {
+				b.hooks[h.On] = append(b.hooks[h.On], ExecHook{Command: h.Runs})
+			}
+		} else {
+			log.Warnf("ignoring the %d hooks of the build file, which only run with --config-hooks", len(hooks))
+		}
+	}
+
+	for _, url := range b.Publish {
+		store, err := publish.New(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		b.publishers = append(b.publishers, &publish.Publisher{
+			Store:      store,
+			SigningKey: b.SigningKey,
+			DryRun:     b.PublishDryRun,
+			Attempts:   3,
+			Backoff:    time.Second,
+		})
+	}
+
+	if b.Scanner != "" {
+		if b.ScanFailOn != "" {
+			if err := scan.ValidateSeverity(b.ScanFailOn); err != nil {
+				return nil, err
+			}
+		}
+		b.scanner, err = scan.New(b.Scanner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if b.ControlTemplate != "" {
+		data, err := os.ReadFile(b.ControlTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("reading control template: %w", err)
+		}
+		b.controlTemplate, err = parseControlTemplate(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing control template %s: %w", b.ControlTemplate, err)
+		}
+	}
+
+	if err := b.checkSecrets(); err != nil {
+		return nil, err
+	}
+
+	if err := b.configureProxy(); err != nil {
+		return nil, err
+	}
+
+	if b.ArtifactRepository != "" {
+		if _, err := name.NewRepository(b.ArtifactRepository); err != nil {
+			return nil, fmt.Errorf("invalid artifact repository %q: %w", b.ArtifactRepository, err)
+		}
+	}
+
 	return &b, nil
 }
 
 func (b *Build) Close(ctx context.Context) error {
 	log := clog.FromContext(ctx)
 	errs := []error{}
-	if b.Remove {
+	if b.kept {
+		log.Infof("keeping guest dir %s and workspace dir %s", b.GuestDir, b.WorkspaceDir)
+	} else if b.Remove {
 		log.Infof("deleting guest dir %s", b.GuestDir)
 		errs = append(errs, os.RemoveAll(b.GuestDir))
-		log.Infof("deleting workspace dir %s", b.WorkspaceDir)
-		errs = append(errs, os.RemoveAll(b.WorkspaceDir))
+		if b.Resume && !b.completed {
+			log.Infof("keeping workspace dir %s to resume the build", b.WorkspaceDir)
+		} else {
+			log.Infof("deleting workspace dir %s", b.WorkspaceDir)
+			errs = append(errs, os.RemoveAll(b.WorkspaceDir))
+		}
 		if b.containerConfig != nil && b.containerConfig.ImgRef != "" {
 			errs = append(errs, b.Runner.OCIImageLoader().RemoveImage(context.WithoutCancel(ctx), b.containerConfig.ImgRef))
 		}
 	}
+	if b.resolverDir != "" {
+		errs = append(errs, os.RemoveAll(b.resolverDir))
+	}
+	if b.secretsDir != "" {
+		errs = append(errs, os.RemoveAll(b.secretsDir))
+	}
+	if b.caDir != "" {
+		errs = append(errs, os.RemoveAll(b.caDir))
+	}
 	errs = append(errs, b.Runner.Close())
+	errs = append(errs, unlockAll(b.locks))
 
 	return errors.Join(errs...)
 }
@@ -229,10 +630,11 @@ func (b *Build) BuildGuest(ctx context.Context, imgConfig apko_types.ImageConfig
 	ctx, span := otel.Tracer("melange").Start(ctx, "BuildGuest")
 	defer span.End()
 
-	tmp, err := os.MkdirTemp(os.TempDir(), "apko-temp-*")
+	tmp, l, err := lockedTempDir(os.TempDir(), "apko-temp-*")
 	if err != nil {
 		return "", fmt.Errorf("creating apko tempdir: %w", err)
 	}
+	defer l.Unlock()
 	defer os.RemoveAll(tmp)
 
 	bc, err := apko_build.New(ctx, guestFS,
@@ -415,7 +817,9 @@ func (b *Build) OverlayBinSh() error {
 	return nil
 }
 
-func fetchBucket(ctx context.Context, cacheSource string, cmm CacheMembershipMap) (string, error) {
+// fetchBucket copies the objects of the cache bucket which the build needs to
+// a temporary directory, decrypting them if there is a key.
+func fetchBucket(ctx context.Context, cacheSource string, cmm CacheMembershipMap, key *cachecrypt.Key) (string, error) {
 	log := clog.FromContext(ctx)
 	tmp, err := os.MkdirTemp("", "melange-cache")
 	if err != nil {
@@ -454,9 +858,18 @@ func fetchBucket(ctx context.Context, cacheSource string, cmm CacheMembershipMap
 		if err != nil {
 			return tmp, err
 		}
-		if _, err := io.Copy(w, rc); err != nil {
+		if key != nil {
+			err = key.Decrypt(w, rc)
+		} else {
+			_, err = io.Copy(w, rc)
+		}
+		if err != nil {
+			w.Close()
 			return tmp, fmt.Errorf("failed to copy remote cache object %s: %w", on, err)
 		}
+		if err := w.Close(); err != nil {
+			return tmp, err
+		}
 		if err := rc.Close(); err != nil {
 			return tmp, fmt.Errorf("failed to close remote cache object %s: %w", on, err)
 		}
@@ -466,6 +879,19 @@ func fetchBucket(ctx context.Context, cacheSource string, cmm CacheMembershipMap
 	return tmp, nil
 }
 
+// failOnUnresolvedLibs returns whether the build fails when a binary needs a
+// shared library which nothing provides, as it does in strict mode.
+func (b *Build) failOnUnresolvedLibs() bool {
+	return b.FailOnUnresolvedLibs || b.Strict
+}
+
+// annotationsAt returns the log attributes which locate the package or
+// subpackage called name in the configuration file, so that CI annotations
+// point at it.
+func (b *Build) annotationsAt(name string) []any {
+	return annotations.At(b.ConfigFile, b.Configuration.PackageLine(name))
+}
+
 // IsBuildLess returns true if the build context does not actually do any building.
 // TODO(kaniini): Improve the heuristic for this by checking for uses/runs statements
 // in the pipeline.
@@ -473,6 +899,16 @@ func (b *Build) IsBuildLess() bool {
 	return len(b.Configuration.Pipeline) == 0
 }
 
+// loadCacheKey resolves the reference to the key of the cache, if there is
+// one.
+func loadCacheKey(ctx context.Context, ref string) (*cachecrypt.Key, error) {
+	if ref == "" {
+		return nil, nil
+	}
+
+	return cachecrypt.LoadKey(ctx, ref)
+}
+
 func (b *Build) PopulateCache(ctx context.Context) error {
 	log := clog.FromContext(ctx)
 	ctx, span := otel.Tracer("melange").Start(ctx, "PopulateCache")
@@ -494,10 +930,15 @@ func (b *Build) PopulateCache(ctx context.Context) error {
 	// --cache-dir=gs://bucket/path/to/cache first pulls all found objects to a
 	// tmp dir which is subsequently used as the cache.
 	if strings.HasPrefix(b.CacheSource, "gs://") {
-		tmp, err := fetchBucket(ctx, b.CacheSource, cmm)
+		key, err := loadCacheKey(ctx, b.CacheKey)
 		if err != nil {
 			return err
 		}
+
+		tmp, err := fetchBucket(ctx, b.CacheSource, cmm, key)
+		if err != nil {
+			return failure.Wrap(failure.Fetch, err)
+		}
 		defer os.RemoveAll(tmp)
 		log.Infof("cache bucket copied to %s", tmp)
 
@@ -590,8 +1031,30 @@ func (b *Build) PopulateWorkspace(ctx context.Context, src fs.FS) error {
 	})
 }
 
+// ShouldBuild evaluates the if-conditional of the package.
+func (pb *PipelineBuild) ShouldBuild() (bool, error) {
+	result, err := pb.evaluateCondition(pb.Package.If)
+	if err != nil {
+		return false, fmt.Errorf("evaluating package if-conditional: %w", err)
+	}
+
+	return result, nil
+}
+
+// ShouldRun evaluates the if-conditional of the subpackage.
 func (pb *PipelineBuild) ShouldRun(sp config.Subpackage) (bool, error) {
-	if sp.If == "" {
+	result, err := pb.evaluateCondition(sp.If)
+	if err != nil {
+		return false, fmt.Errorf("evaluating subpackage if-conditional: %w", err)
+	}
+
+	return result, nil
+}
+
+// evaluateCondition evaluates an if-conditional against the substitutions of
+// the build, which holds if there is none.
+func (pb *PipelineBuild) evaluateCondition(expr string) (bool, error) {
+	if expr == "" {
 		return true, nil
 	}
 
@@ -604,20 +1067,52 @@ func (pb *PipelineBuild) ShouldRun(sp config.Subpackage) (bool, error) {
 		return mutated[nk], nil
 	}
 
-	result, err := cond.Evaluate(sp.If, lookupWith)
+	return cond.Evaluate(expr, lookupWith)
+}
+
+// elfIndex returns the index of the ELF files of the package in the
+// workspace, building it on first use.
+func (b *Build) elfIndex(pkgName string) (*elfindex.Index, error) {
+	if idx, ok := b.elfIndexes[pkgName]; ok {
+		return idx, nil
+	}
+
+	fsys, err := b.workspaceFS(pkgName)
 	if err != nil {
-		return false, fmt.Errorf("evaluating subpackage if-conditional: %w", err)
+		return nil, err
+	}
+	idx, err := elfindex.New(fsys)
+	if err != nil {
+		return nil, fmt.Errorf("indexing the ELF files of %s: %w", pkgName, err)
 	}
 
-	return result, nil
+	if b.elfIndexes == nil {
+		b.elfIndexes = map[string]*elfindex.Index{}
+	}
+	b.elfIndexes[pkgName] = idx
+
+	return idx, nil
 }
 
 type linterTarget struct {
-	pkgName string
-	checks  config.Checks
+	pkgName       string
+	checks        config.Checks
+	rpath         string
+	rpathRewrites []config.RPathRewrite
+	devFiles      string
+	keepDirs      []string
+	// empty is set for the packages which are empty by design.
+	empty bool
+}
+
+// progressName is the name of a package of the build in its progress, which
+// tells the builds of several architectures apart.
+func (b *Build) progressName(pkgName string) string {
+	return fmt.Sprintf("%s (%s)", pkgName, b.Arch.ToAPK())
 }
 
-func (b *Build) BuildPackage(ctx context.Context) error {
+func (b *Build) BuildPackage(ctx context.Context) (retErr error) {
+	ctx = b.maskSecrets(ctx)
 	log := clog.FromContext(ctx)
 	ctx, span := otel.Tracer("melange").Start(ctx, "BuildPackage")
 	defer span.End()
@@ -638,12 +1133,113 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		Package: pkg,
 	}
 
+	if b.KeepWorkspace && !b.IsBuildLess() {
+		defer func() {
+			if retErr == nil {
+				return
+			}
+			if err := b.keepEnvironment(ctx, retErr); err != nil {
+				log.Warnf("unable to keep the build environment: %v", err)
+			}
+		}()
+	}
+
+	b.tracker = progress.FromContext(ctx)
+	if b.tracker != nil {
+		names := []string{b.progressName(pkg.Name)}
+		for _, sp := range b.Configuration.Subpackages {
+			names = append(names, b.progressName(sp.Name))
+		}
+		for _, name := range names {
+			b.tracker.Add(name)
+		}
+		defer func() { b.tracker.Settle(ctx, names, retErr) }()
+	}
+
+	if b.DependencyLog != "" || b.failOnUnresolvedLibs() || b.RebuildReport != "" {
+		b.dependencyLog = &DependencyLog{
+			Version:  DependencyLogVersion,
+			Arch:     b.Arch.ToAPK(),
+			Packages: []DependencyLogPackage{},
+		}
+	}
+
+	if b.BuildReport != "" {
+		b.report = &Report{
+			Package:  pkg.Name,
+			Version:  pkg.Version,
+			Epoch:    pkg.Epoch,
+			Arch:     b.Arch.ToAPK(),
+			Packages: []PackageReport{},
+			Steps:    []StepReport{},
+		}
+		// A failed build still writes its report, so that CI can tell why
+		// it failed.  This is deferred before the disk monitor annotates
+		// the error, so that it sees the annotation.
+		defer func() {
+			if retErr == nil {
+				return
+			}
+			b.report.setError(retErr)
+			if b.report.Error != nil {
+				b.report.Error.Message = b.mask(b.report.Error.Message)
+			}
+			path := reportPath(b.BuildReport, b.Arch.ToAPK())
+			log.Infof("writing build report to %s", path)
+			if err := b.report.Write(path); err != nil {
+				log.Warnf("unable to write build report: %v", err)
+			}
+		}()
+	}
+
+	if b.Profile != "" {
+		b.profile = newProfiler(fmt.Sprintf("%s-%s-r%d", pkg.Name, pkg.Version, pkg.Epoch))
+		// The profile is most useful for slow builds, which are written
+		// even if the build fails.
+		defer func() {
+			path := reportPath(b.Profile, b.Arch.ToAPK())
+			log.Infof("writing profile to %s", path)
+			if err := b.profile.Write(path); err != nil {
+				log.Warnf("unable to write profile: %v", err)
+			}
+		}()
+	}
+
+	if err := b.runHooks(ctx, b.hookContext(config.HookPreBuild, pkg.Name)); err != nil {
+		return err
+	}
+	defer func() {
+		hc := b.hookContext(config.HookPostBuild, pkg.Name)
+		if retErr != nil {
+			hc.Error = retErr.Error()
+		}
+		if err := b.runHooks(ctx, hc); err != nil {
+			if retErr != nil {
+				log.Warnf("the build failed, and so did a hook: %v", err)
+				return
+			}
+			retErr = err
+		}
+	}()
+
+	if b.ServeRepository {
+		repo, err := b.localRepository(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to add the output directory as a repository: %w", err)
+		}
+
+		// The options of the builds of every architecture share these.
+		b.ExtraRepos = append(slices.Clone(b.ExtraRepos), repo)
+		b.ExtraKeys = append(slices.Clone(b.ExtraKeys), b.SigningKey+".pub")
+	}
+
 	if b.GuestDir == "" {
-		guestDir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-guest-*")
+		guestDir, l, err := lockedTempDir(b.Runner.TempDir(), "guest-*")
 		if err != nil {
 			return fmt.Errorf("unable to make guest directory: %w", err)
 		}
 		b.GuestDir = guestDir
+		b.locks = append(b.locks, l)
 	}
 
 	log.Infof("evaluating pipelines for package requirements")
@@ -669,8 +1265,39 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 	}
 	pb.Subpackage = nil
 
+	if err := b.preflightDiskSpace(ctx); err != nil {
+		return err
+	}
+
+	monitor := newDiskMonitor(b)
+	mctx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	monitor.start(mctx)
+	defer func() {
+		retErr = monitor.annotate(ctx, retErr)
+	}()
+
+	resumed := false
+	if b.Resume {
+		r, err := b.resumeWorkspace(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to resume build: %w", err)
+		}
+		resumed = r
+	}
+
+	if !resumed {
+		// Drop the outputs of an earlier build which used the workspace,
+		// which would end up in the packages otherwise.
+		if err := os.RemoveAll(filepath.Join(b.WorkspaceDir, "melange-out")); err != nil {
+			return fmt.Errorf("unable to clean workspace: %w", err)
+		}
+	}
+
 	if b.EmptyWorkspace {
 		log.Infof("empty workspace requested")
+	} else if resumed {
+		log.Infof("reusing workspace %s from the previous build", b.WorkspaceDir)
 	} else {
 		// Prepare workspace directory
 		if err := os.MkdirAll(b.WorkspaceDir, 0755); err != nil {
@@ -678,17 +1305,39 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 
 		log.Infof("populating workspace %s from %s", b.WorkspaceDir, b.SourceDir)
+		end := b.profile.begin(profilePhase, "populate workspace", nil)
 		if err := b.PopulateWorkspace(ctx, os.DirFS(b.SourceDir)); err != nil {
 			return fmt.Errorf("unable to populate workspace: %w", err)
 		}
+		end()
 	}
 
 	if err := os.MkdirAll(filepath.Join(b.WorkspaceDir, "melange-out", b.Configuration.Package.Name), 0o755); err != nil {
 		return err
 	}
 
+	if !b.IsBuildLess() {
+		if err := b.writeResolverFiles(); err != nil {
+			return fmt.Errorf("unable to configure name resolution: %w", err)
+		}
+		if err := b.writeSecretFiles(); err != nil {
+			return err
+		}
+	}
+
+	// The cache directory must exist when the workspace configuration is
+	// made, for it to be mounted in the guest.
+	if b.PrefetchSources {
+		end := b.profile.begin(profilePhase, "prefetch sources", nil)
+		if err := b.prefetchSources(ctx); err != nil {
+			return fmt.Errorf("unable to prefetch sources: %w", err)
+		}
+		end()
+	}
+
 	linterQueue := []linterTarget{}
 	cfg := b.WorkspaceConfig(ctx)
+	var ccStats *compilerCacheStats
 
 	if !b.IsBuildLess() {
 		// Prepare guest directory
@@ -698,15 +1347,74 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 		log.Infof("building workspace in '%s' with apko", b.GuestDir)
 
+		var trusted []verifiedIndex
+		if b.VerifyRepositories {
+			indexes, err := b.verifyRepositories(ctx)
+			if err != nil {
+				return failure.Wrap(failure.Policy, err)
+			}
+			trusted = indexes
+		}
+
+		env := b.Configuration.Environment
+		var locked []LockedPackage
+		if b.Locked {
+			var err error
+			env, locked, err = b.lockedEnvironment(env)
+			if err != nil {
+				return err
+			}
+			log.Infof("installing the %d packages locked in %s", len(locked), LockfilePath(b.ConfigFile))
+		}
+
 		guestFS := apkofs.DirFS(b.GuestDir, apkofs.WithCreateDir())
-		imgRef, err := b.BuildGuest(ctx, b.Configuration.Environment, guestFS)
+		end := b.profile.begin(profilePhase, "build guest", nil)
+		imgRef, err := b.BuildGuest(ctx, env, guestFS)
 		if err != nil {
 			return fmt.Errorf("unable to build guest: %w", err)
 		}
+		end()
+
+		installed, err := b.installedPackages()
+		if err != nil {
+			return err
+		}
+		b.report.setEnvironment(installed)
+		if b.scanner != nil {
+			if err := b.scanEnvironment(ctx); err != nil {
+				return err
+			}
+		}
+		if b.Locked {
+			if err := checkLocked(locked, installed); err != nil {
+				return fmt.Errorf("the build environment does not match %s: %w", LockfilePath(b.ConfigFile), err)
+			}
+		} else {
+			path := LockfilePath(b.ConfigFile)
+			log.Infof("recording the %d packages of the build environment in %s", len(installed), path)
+			if err := writeLockfile(path, b.Arch.ToAPK(), installed); err != nil {
+				log.Warnf("unable to write lockfile: %v", err)
+			}
+		}
+
+		if b.VerifyRepositories {
+			if err := b.verifyInstalled(trusted); err != nil {
+				return failure.Wrap(failure.Policy, err)
+			}
+			for _, idx := range trusted {
+				b.report.addRepository(idx.repo)
+			}
+			b.trustedFingerprints = trustedFingerprints(trusted)
+		}
 
 		cfg.ImgRef = imgRef
 		log.Infof("ImgRef = %s", cfg.ImgRef)
 
+		if err := b.installCACertificates(); err != nil {
+			return fmt.Errorf("unable to install CA certificates: %w", err)
+		}
+		cfg.Mounts = append(cfg.Mounts, b.caMounts()...)
+
 		// TODO(kaniini): Make overlay-binsh work with Docker and Kubernetes.
 		// Probably needs help from apko.
 		if err := b.OverlayBinSh(); err != nil {
@@ -717,9 +1425,11 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			return fmt.Errorf("unable to populate cache: %w", err)
 		}
 
+		end = b.profile.begin(profilePhase, "start pod", nil)
 		if err := b.Runner.StartPod(ctx, cfg); err != nil {
 			return fmt.Errorf("unable to start pod: %w", err)
 		}
+		end()
 		if !b.DebugRunner {
 			defer func() {
 				if err := b.Runner.TerminatePod(context.WithoutCancel(ctx), cfg); err != nil {
@@ -728,19 +1438,48 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			}()
 		}
 
+		if b.CompilerCacheDir != "" {
+			ccStats, err = b.newCompilerCacheStats()
+			if err != nil {
+				return err
+			}
+			ccStats.snapshot(ctx, b.Runner, cfg, "before")
+		}
+
 		// run the main pipeline
 		log.Debug("running the main pipeline")
 		for _, p := range b.Configuration.Pipeline {
+			step, skip, err := b.nextStep(ctx, p, nil)
+			if err != nil {
+				return err
+			} else if skip {
+				continue
+			}
+
 			pctx := NewPipelineContext(&p, &b.Configuration.Environment, cfg, b.PipelineDirs)
-			if _, err := pctx.Run(ctx, &pb); err != nil {
+			start := time.Now()
+			end := b.tracker.Begin(ctx, b.progressName(pkg.Name), fmt.Sprintf("step %q", pctx.Identity()))
+			_, err = pctx.Run(ctx, &pb)
+			end(err)
+			if err != nil {
 				return fmt.Errorf("unable to run pipeline: %w", err)
 			}
+			b.report.addStep(pctx.Identity(), "", time.Since(start))
+
+			if err := b.recordCheckpoint(step); err != nil {
+				return err
+			}
 		}
 
 		// add the main package to the linter queue
 		lintTarget := linterTarget{
-			pkgName: b.Configuration.Package.Name,
-			checks:  b.Configuration.Package.Checks,
+			pkgName:       b.Configuration.Package.Name,
+			checks:        b.Configuration.Package.Checks,
+			rpath:         b.Configuration.Package.Options.RPath,
+			rpathRewrites: b.Configuration.Package.Options.RPathRewrites,
+			devFiles:      b.Configuration.Package.Options.DevFiles,
+			keepDirs:      b.Configuration.Package.Options.KeepDirs,
+			empty:         b.Configuration.Package.Options.Empty || b.Configuration.Package.Options.NoProvides,
 		}
 		linterQueue = append(linterQueue, lintTarget)
 	}
@@ -762,14 +1501,31 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 				return err
 			}
 			if !result {
+				b.tracker.Skip(ctx, b.progressName(sp.Name))
 				continue
 			}
 
 			for _, p := range sp.Pipeline {
+				step, skip, err := b.nextStep(ctx, p, &sp)
+				if err != nil {
+					return err
+				} else if skip {
+					continue
+				}
+
 				pctx := NewPipelineContext(&p, &b.Configuration.Environment, cfg, b.PipelineDirs)
-				if _, err := pctx.Run(ctx, &pb); err != nil {
+				start := time.Now()
+				end := b.tracker.Begin(ctx, b.progressName(sp.Name), fmt.Sprintf("step %q", pctx.Identity()))
+				_, err = pctx.Run(ctx, &pb)
+				end(err)
+				if err != nil {
 					return fmt.Errorf("unable to run pipeline: %w", err)
 				}
+				b.report.addStep(pctx.Identity(), sp.Name, time.Since(start))
+
+				if err := b.recordCheckpoint(step); err != nil {
+					return err
+				}
 			}
 		}
 
@@ -779,43 +1535,155 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 		// add the main package to the linter queue
 		lintTarget := linterTarget{
-			pkgName: sp.Name,
-			checks:  sp.Checks,
+			pkgName:       sp.Name,
+			checks:        sp.Checks,
+			rpath:         sp.Options.RPath,
+			rpathRewrites: sp.Options.RPathRewrites,
+			devFiles:      sp.Options.DevFiles,
+			keepDirs:      sp.Options.KeepDirs,
+			empty:         sp.Options.Empty || sp.Options.NoProvides,
 		}
 		linterQueue = append(linterQueue, lintTarget)
 	}
 
+	if ccStats != nil {
+		ccStats.snapshot(ctx, b.Runner, cfg, "after")
+		for _, cr := range ccStats.reports(ctx) {
+			b.report.addCompilerCache(cr)
+		}
+	}
+
 	// Retrieve the post build workspace from the runner
 	log.Infof("retrieving workspace from builder: %s", cfg.PodID)
 	fs := apkofs.DirFS(b.WorkspaceDir)
+	end := b.profile.begin(profilePhase, "retrieve workspace", nil)
 	if err := b.RetrieveWorkspace(ctx, fs); err != nil {
 		return fmt.Errorf("retrieving workspace: %w", err)
 	}
+	end()
 	log.Infof("retrieved and wrote post-build workspace to: %s", b.WorkspaceDir)
 
+	// split out any subpackages which are declared by a files manifest
+	manifested := []config.Subpackage{}
+	for _, sp := range b.Configuration.Subpackages {
+		sp := sp
+		pb.Subpackage = &sp
+
+		result, err := pb.ShouldRun(sp)
+		if err != nil {
+			return err
+		}
+		if result {
+			manifested = append(manifested, sp)
+		}
+	}
+	pb.Subpackage = nil
+
+	if err := splitByManifest(ctx, filepath.Join(b.WorkspaceDir, "melange-out"), b.Configuration.Package.Name, manifested); err != nil {
+		return fmt.Errorf("splitting subpackages by manifest: %w", err)
+	}
+
+	for _, sp := range manifested {
+		if err := createCompatLinks(ctx, filepath.Join(b.WorkspaceDir, "melange-out"), b.Configuration.Package.Name, sp); err != nil {
+			return err
+		}
+	}
+
+	if err := moveDevFiles(ctx, filepath.Join(b.WorkspaceDir, "melange-out"), b.Configuration.Package, manifested); err != nil {
+		return fmt.Errorf("moving static libraries and headers: %w", err)
+	}
+
+	for _, lt := range linterQueue {
+		if err := mergeUsr(ctx, lt.pkgName, filepath.Join(b.WorkspaceDir, "melange-out", lt.pkgName), b.UsrMerge); err != nil {
+			return err
+		}
+	}
+
+	if err := b.installLicenses(ctx); err != nil {
+		return err
+	}
+
 	// perform package linting
 	for _, lt := range linterQueue {
 		log.Infof("running package linters for %s", lt.pkgName)
 
 		path := filepath.Join(b.WorkspaceDir, "melange-out", lt.pkgName)
 		linters := lt.checks.GetLinters()
+		if lt.devFiles == config.DevFilesPolicyKeep {
+			linters = slices.DeleteFunc(linters, func(l string) bool { return l == "static" || l == "headers" })
+		}
+		if lt.empty {
+			linters = slices.DeleteFunc(linters, func(l string) bool { return l == "empty" })
+		}
+		end := b.profile.begin(profilePhase, "lint", map[string]any{"package": lt.pkgName})
+
+		// The directories of a WorkspaceFS are packaged as they are.
+		if b.WorkspaceFS == nil {
+			if err := pruneEmptyDirs(ctx, lt.pkgName, path, lt.keepDirs); err != nil {
+				return fmt.Errorf("pruning the empty directories of %s: %w", lt.pkgName, err)
+			}
+		}
+		fsys, err := b.workspaceFS(lt.pkgName)
+		if err != nil {
+			return err
+		}
+		if err := checkPaths(lt.pkgName, fsys, lt.checks.Paths); err != nil {
+			return failure.Wrap(failure.Policy, err)
+		}
+		if err := rewriteRPaths(ctx, lt.pkgName, path, lt.rpathRewrites); err != nil {
+			return err
+		}
+		if err := applyRPathPolicy(ctx, lt.pkgName, path, lt.rpath); err != nil {
+			return err
+		}
+		if err := b.stampBinaries(ctx, lt.pkgName, path); err != nil {
+			return err
+		}
+
+		// The stamps are the last changes to the contents of the package.
+		elfIdx, err := b.elfIndex(lt.pkgName)
+		if err != nil {
+			return err
+		}
+
+		severities := map[string]linter.Severity{}
+		for name, sev := range lt.checks.Severity {
+			if severities[name], err = linter.ParseSeverity(sev); err != nil {
+				return err
+			}
+		}
 
 		var innerErr error
-		if err := linter.LintBuild(lt.pkgName, path, func(err error) {
-			if b.FailOnLintWarning {
+		warn := func(err error) {
+			var finding *linter.Finding
+			switch {
+			case errors.As(err, &finding) && finding.Severity == linter.SeverityInfo:
+				log.Infof("%s: %v", lt.pkgName, err)
+			case b.FailOnLintWarning || b.Strict:
 				innerErr = err
-			} else {
-				log.Warnf("WARNING: %v", err)
+			default:
+				log.With(b.annotationsAt(lt.pkgName)...).Warnf("WARNING: %v", err)
 			}
-		}, linters); err != nil {
-			return fmt.Errorf("package linter error: %w", err)
+		}
+		if err := linter.LintBuildFS(lt.pkgName, fsys, elfIdx, warn, linters, severities); err != nil {
+			return failure.Wrap(failure.Policy, fmt.Errorf("package linter error: %w", err))
+		} else if err := b.runLinterPlugins(ctx, lt.pkgName, warn); err != nil {
+			return failure.Wrap(failure.Policy, fmt.Errorf("package linter error: %w", err))
 		} else if innerErr != nil {
-			return fmt.Errorf("package linter warning: %w", err)
+			return failure.Wrap(failure.Policy, fmt.Errorf("package linter warning: %w", innerErr))
 		}
+		end()
 	}
 
 	// Run the SBOM generator.
 	generator := sbom.NewGenerator()
+	end = b.profile.begin(profilePhase, "generate SBOMs", nil)
+
+	// The SBOMs of the subpackages share the sources of the origin package.
+	sourceLoc, err := sourceLocation(&pb, b.Configuration.Pipeline)
+	if err != nil {
+		return fmt.Errorf("evaluating the source location: %w", err)
+	}
 
 	// generate SBOMs for subpackages
 	for _, sp := range b.Configuration.Subpackages {
@@ -834,22 +1702,46 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			}
 		}
 
+		// A subpackage with its own copyrights is licensed under them.
+		licensed := &b.Configuration.Package
+		if len(sp.Copyright) != 0 {
+			licensed = &config.Package{Copyright: sp.Copyright}
+		}
+
+		fsys, err := b.sbomFS(sp.Name)
+		if err != nil {
+			return err
+		}
+		version, epoch := b.Configuration.VersionOf(sp.Name)
 		if err := generator.GenerateSBOM(ctx, &sbom.Spec{
 			Path:            filepath.Join(b.WorkspaceDir, "melange-out", sp.Name),
+			FS:              fsys,
 			PackageName:     sp.Name,
-			PackageVersion:  fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
-			License:         b.Configuration.Package.LicenseExpression(),
-			Copyright:       b.Configuration.Package.FullCopyright(),
+			PackageVersion:  fmt.Sprintf("%s-r%d", version, epoch),
+			License:         licensed.LicenseExpression(),
+			Copyright:       licensed.FullCopyright(),
 			Namespace:       namespace,
 			Arch:            b.Arch.ToAPK(),
 			SourceDateEpoch: b.SourceDateEpoch,
+			OriginName:      b.Configuration.Package.Name,
+			SourceLocation:  sourceLoc,
+			TrustedKeys:     b.trustedFingerprints,
 		}); err != nil {
 			return fmt.Errorf("writing SBOMs: %w", err)
 		}
+
+		if err := b.runSBOMPlugins(ctx, sp.Name, fmt.Sprintf("%s-r%d", version, epoch)); err != nil {
+			return fmt.Errorf("enriching SBOMs: %w", err)
+		}
 	}
 
+	fsys, err := b.sbomFS(b.Configuration.Package.Name)
+	if err != nil {
+		return err
+	}
 	if err := generator.GenerateSBOM(ctx, &sbom.Spec{
 		Path:            filepath.Join(b.WorkspaceDir, "melange-out", b.Configuration.Package.Name),
+		FS:              fsys,
 		PackageName:     b.Configuration.Package.Name,
 		PackageVersion:  fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
 		License:         b.Configuration.Package.LicenseExpression(),
@@ -857,14 +1749,32 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		Namespace:       namespace,
 		Arch:            b.Arch.ToAPK(),
 		SourceDateEpoch: b.SourceDateEpoch,
+		SourceLocation:  sourceLoc,
+		TrustedKeys:     b.trustedFingerprints,
 	}); err != nil {
 		return fmt.Errorf("writing SBOMs: %w", err)
 	}
 
+	if err := b.runSBOMPlugins(ctx, b.Configuration.Package.Name, fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch)); err != nil {
+		return fmt.Errorf("enriching SBOMs: %w", err)
+	}
+	end()
+
+	if b.RemovedFiles != "" {
+		if err := b.checkRemovedFiles(ctx); err != nil {
+			return failure.Wrap(failure.Policy, err)
+		}
+	}
+
+	if err := b.emitDiskSpace(); err != nil {
+		return fmt.Errorf("unable to emit packages: %w", err)
+	}
+
 	// emit main package
 	if err := pb.Emit(ctx, pkg); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+		return failure.Wrap(failure.Packaging, fmt.Errorf("unable to emit package: %w", err))
 	}
+	emitted := []*config.Package{pkg}
 
 	// emit subpackages
 	for _, sp := range b.Configuration.Subpackages {
@@ -876,11 +1786,62 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			return err
 		}
 		if !result {
+			b.tracker.Skip(ctx, b.progressName(sp.Name))
 			continue
 		}
 
-		if err := pb.Emit(ctx, pkgFromSub(&sp)); err != nil {
-			return fmt.Errorf("unable to emit package: %w", err)
+		spkg := pkgFromSub(&sp)
+		if err := pb.Emit(ctx, spkg); err != nil {
+			return failure.Wrap(failure.Packaging, fmt.Errorf("unable to emit package: %w", err))
+		}
+		emitted = append(emitted, spkg)
+	}
+	pb.Subpackage = nil
+
+	if b.ReproducibilityCheck {
+		end = b.profile.begin(profilePhase, "reproducibility check", nil)
+		if err := pb.checkReproducibility(ctx, emitted); err != nil {
+			pb.removeEmitted(ctx, emitted)
+			return failure.Wrap(failure.Policy, err)
+		}
+		end()
+	}
+
+	if b.dependencyLog != nil {
+		b.resolveDependencies(ctx)
+	}
+
+	if b.DependencyLog != "" {
+		if err := b.writeDependencyLog(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.failOnUnresolvedLibs() {
+		if err := b.checkUnresolvedLibraries(); err != nil {
+			pb.removeEmitted(ctx, emitted)
+			return failure.Wrap(failure.Policy, err)
+		}
+	}
+
+	if b.scanner != nil {
+		if err := b.scanPackages(ctx, &pb, emitted); err != nil {
+			pb.removeEmitted(ctx, emitted)
+			return err
+		}
+	}
+
+	if b.RebuildReport != "" {
+		if err := b.writeRebuildReport(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.report != nil {
+		path := reportPath(b.BuildReport, b.Arch.ToAPK())
+		log.Infof("writing build report to %s", path)
+		if err := b.report.Write(path); err != nil {
+			return err
 		}
 	}
 
@@ -891,6 +1852,10 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
+	if err := b.removeCheckpoint(); err != nil {
+		log.Warnf("unable to remove checkpoint: %v", err)
+	}
+
 	// clean build environment
 	// TODO(epsilon-phase): implement a way to clean up files that are not owned by the user
 	// that is running melange. files created inside the build not owned by the build user are
@@ -920,7 +1885,8 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 				continue
 			}
 
-			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+			version, epoch := b.Configuration.VersionOf(subpkg.Name)
+			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, version, epoch)
 			apkFiles = append(apkFiles, filepath.Join(packageDir, subpkgFileName))
 		}
 
@@ -937,7 +1903,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 
 		if err := idx.GenerateIndex(ctx); err != nil {
-			return fmt.Errorf("unable to generate index: %w", err)
+			return failure.Wrap(failure.Packaging, fmt.Errorf("unable to generate index: %w", err))
 		}
 
 		if err := idx.WriteJSONIndex(filepath.Join(packageDir, "APKINDEX.json")); err != nil {
@@ -945,6 +1911,53 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		}
 	}
 
+	apks := make([]string, 0, len(emitted))
+	for _, p := range emitted {
+		apks = append(apks, pb.packageBuild(p).Filename())
+	}
+
+	if b.Checksums {
+		arch := b.Arch.ToAPK()
+		files := slices.Clone(apks)
+		if b.GenerateIndex {
+			files = append(files, filepath.Join(b.OutDir, arch, "APKINDEX.tar.gz"), filepath.Join(b.OutDir, arch, "APKINDEX.json"))
+		}
+		if b.DependencyLog != "" {
+			files = append(files, fmt.Sprintf("%s.%s", b.DependencyLog, arch))
+		}
+		if b.report != nil {
+			files = append(files, reportPath(b.BuildReport, arch))
+		}
+		if b.RebuildReport != "" {
+			files = append(files, reportPath(b.RebuildReport, arch))
+		}
+
+		log.Infof("writing the checksums of %d files to %s", len(files), filepath.Join(b.OutDir, arch, checksumsName))
+		if err := writeChecksums(filepath.Join(b.OutDir, arch), files); err != nil {
+			return fmt.Errorf("unable to write checksums: %w", err)
+		}
+	}
+
+	if len(b.publishers) != 0 {
+		for _, p := range b.publishers {
+			if err := p.Publish(ctx, b.Arch.ToAPK(), apks); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.ArtifactRepository != "" {
+		repo, err := name.NewRepository(b.ArtifactRepository)
+		if err != nil {
+			return err
+		}
+		for _, apk := range apks {
+			if _, err := publish.PushArtifact(ctx, repo, apk); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -999,8 +2012,10 @@ func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 
 	mounts := []container.BindMount{
 		{Source: b.WorkspaceDir, Destination: container.DefaultWorkspaceDir},
-		{Source: "/etc/resolv.conf", Destination: container.DefaultResolvConfPath},
 	}
+	mounts = append(mounts, b.resolverMounts()...)
+	mounts = append(mounts, b.secretMounts()...)
+	mounts = append(mounts, b.localRepositoryMounts()...)
 
 	if b.CacheDir != "" {
 		if fi, err := os.Stat(b.CacheDir); err == nil && fi.IsDir() {
@@ -1015,10 +2030,27 @@ func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 		}
 	}
 
-	// TODO(kaniini): Disable networking capability according to the pipeline requirements.
+	if b.CompilerCacheDir != "" {
+		if err := os.MkdirAll(b.CompilerCacheDir, 0o755); err == nil {
+			mountSource, err := realpath.Realpath(b.CompilerCacheDir)
+			if err != nil {
+				log.Infof("could not resolve path for --compiler-cache-dir: %s", err)
+			}
+
+			mounts = append(mounts, container.BindMount{Source: mountSource, Destination: compilerCacheDir})
+		} else {
+			log.Infof("--compiler-cache-dir %s not usable; skipping: %s", b.CompilerCacheDir, err)
+		}
+	}
+
+	// The pod has network access, which the runners that can isolate the
+	// network of each step take away from the steps which don't need it.
 	caps := container.Capabilities{
 		Networking: true,
 	}
+	if ni, ok := b.Runner.(container.NetworkIsolator); !ok || !ni.IsolatesNetwork() {
+		log.Warnf("the %s runner cannot isolate the network of the pipeline steps, which all have network access", b.Runner.Name())
+	}
 
 	cfg := container.Config{
 		Arch:         b.Arch,
@@ -1030,6 +2062,7 @@ func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 		},
 		WorkspaceDir: b.WorkspaceDir,
 		Timeout:      b.Configuration.Package.Timeout,
+		Rootless:     b.Rootless,
 	}
 
 	if b.Configuration.Package.Resources != nil {
@@ -1037,10 +2070,24 @@ func (b *Build) buildWorkspaceConfig(ctx context.Context) *container.Config {
 		cfg.Memory = b.Configuration.Package.Resources.Memory
 	}
 
+	if b.CompilerCacheDir != "" {
+		for k, v := range b.compilerCacheEnv() {
+			cfg.Environment[k] = v
+		}
+	}
+
 	for k, v := range b.Configuration.Environment.Environment {
 		cfg.Environment[k] = v
 	}
 
+	for k, v := range b.proxyEnvironment() {
+		cfg.Environment[k] = v
+	}
+
+	for k, v := range b.secretEnvironment() {
+		cfg.Environment[k] = v
+	}
+
 	return &cfg
 }
 
@@ -1144,6 +2191,54 @@ func (b *Build) RetrieveWorkspace(ctx context.Context, fs apkofs.FullFS) error {
 	return nil
 }
 
+// configCommitTime returns the time of the last commit of the git repository
+// the configuration file is in which changed it, and whether there is one.
+func configCommitTime(ctx context.Context, configFile string) (time.Time, bool) {
+	log := clog.FromContext(ctx)
+
+	path, err := filepath.Abs(configFile)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	repo, err := git.PlainOpenWithOptions(filepath.Dir(path), &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		log.Debugf("unable to open the git repository of %s: %v", configFile, err)
+		return time.Time{}, false
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return time.Time{}, false
+	}
+	root := wt.Filesystem.Root()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	rel = filepath.ToSlash(rel)
+
+	commits, err := repo.Log(&git.LogOptions{FileName: &rel})
+	if err != nil {
+		log.Debugf("unable to read the git history of %s: %v", configFile, err)
+		return time.Time{}, false
+	}
+	defer commits.Close()
+
+	commit, err := commits.Next()
+	if err != nil {
+		// io.EOF: the configuration file was never committed.
+		return time.Time{}, false
+	}
+
+	return commit.Committer.When.UTC(), true
+}
+
 // sourceDateEpoch parses the SOURCE_DATE_EPOCH environment variable.
 // If it is not set, it returns the defaultTime.
 // If it is set, it MUST be an ASCII representation of an integer.
@@ -25,6 +25,8 @@ import (
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/require"
@@ -223,6 +225,8 @@ func TestConfiguration_Load(t *testing.T) {
 
 			if !tt.skipConfigCleanStep {
 				cleanTestConfig(cfg)
+			} else {
+				clearTestCommits(cfg)
 			}
 
 			if tt.expected == nil {
@@ -250,12 +254,26 @@ func cleanTestConfig(cfg *config.Configuration) {
 	cfg.Environment.Accounts.Users = nil
 	cfg.Environment.Accounts.Groups = nil
 	cfg.Environment.Environment = nil
+	clearTestCommits(cfg)
 
 	if len(cfg.Subpackages) == 0 {
 		cfg.Subpackages = nil
 	}
 }
 
+// clearTestCommits clears the commits of a configuration, which are detected
+// from the checkout the tests run in.
+func clearTestCommits(cfg *config.Configuration) {
+	if cfg == nil {
+		return
+	}
+
+	cfg.Package.Commit = ""
+	for i := range cfg.Subpackages {
+		cfg.Subpackages[i].Commit = ""
+	}
+}
+
 // TestConfiguration_Load_Raw tests loading a configuration file with raw
 // resolved values for fields not specified by the input YAML file.
 func TestConfiguration_Load_Raw(t *testing.T) {
@@ -369,3 +387,45 @@ func TestSourceDateEpoch(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigCommitTime(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+
+	commit := func(path string, when time.Time) {
+		fp := filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fp), 0o755))
+		require.NoError(t, os.WriteFile(fp, []byte(when.String()), 0o644))
+		_, err := wt.Add(path)
+		require.NoError(t, err)
+		sig := &object.Signature{Name: "hello", Email: "hello@example.com", When: when}
+		_, err = wt.Commit(path, &git.CommitOptions{Author: sig, Committer: sig})
+		require.NoError(t, err)
+	}
+
+	// The last commit changed another file.
+	commit("hello/hello.yaml", time.Unix(1000, 0))
+	commit("hello/hello.yaml", time.Unix(2000, 0))
+	commit("world/world.yaml", time.Unix(3000, 0))
+
+	got, ok := configCommitTime(ctx, filepath.Join(root, "hello", "hello.yaml"))
+	require.True(t, ok)
+	require.True(t, got.Equal(time.Unix(2000, 0)), "got %v", got)
+
+	// A file which was never committed.
+	fp := filepath.Join(root, "hello", "new.yaml")
+	require.NoError(t, os.WriteFile(fp, nil, 0o644))
+	_, ok = configCommitTime(ctx, fp)
+	require.False(t, ok)
+
+	// A file outside of any repository.
+	fp = filepath.Join(t.TempDir(), "hello.yaml")
+	require.NoError(t, os.WriteFile(fp, nil, 0o644))
+	_, ok = configCommitTime(ctx, fp)
+	require.False(t, ok)
+}
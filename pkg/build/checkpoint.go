@@ -0,0 +1,264 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/container/docker"
+	"github.com/chainguard-dev/clog"
+)
+
+// CheckpointVersion is the version of the checkpoint file format.  A
+// checkpoint with another version is ignored.
+const CheckpointVersion = 1
+
+// resumableRunners are the runners which keep the workspace on the host,
+// so that it survives a failed build.
+var resumableRunners = []string{container.BubblewrapName, container.QEMUName, docker.DockerName}
+
+// checkpoint records the top-level pipeline steps which completed in the
+// workspace, so that a failed build can be resumed after the last one.
+type checkpoint struct {
+	Version int `json:"version"`
+	// The digest of the configuration, without its pipelines
+	Configuration string `json:"configuration"`
+	// The steps which completed, in the order they were run
+	Steps []checkpointStep `json:"steps"`
+}
+
+type checkpointStep struct {
+	// The name of the step, or the pipeline it uses
+	Name string `json:"name"`
+	// The subpackage the step belongs to, if any
+	Subpackage string `json:"subpackage,omitempty"`
+	// The digest of the step
+	Digest string `json:"digest"`
+}
+
+func digestJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// configurationDigest returns the digest of everything in cfg which may
+// affect the steps, apart from the steps themselves.
+func configurationDigest(cfg config.Configuration) (string, error) {
+	cfg.Pipeline = nil
+	cfg.Subpackages = nil
+	return digestJSON(cfg)
+}
+
+// stepDigest returns the digest of a top-level step of the main package,
+// or of the subpackage sp.
+func stepDigest(p config.Pipeline, sp *config.Subpackage) (string, error) {
+	var sub *config.Subpackage
+	if sp != nil {
+		s := *sp
+		s.Pipeline = nil
+		sub = &s
+	}
+
+	return digestJSON(struct {
+		Pipeline   config.Pipeline    `json:"pipeline"`
+		Subpackage *config.Subpackage `json:"subpackage,omitempty"`
+	}{p, sub})
+}
+
+// checkpointPath returns where the checkpoint of the workspace is kept.  It
+// is next to the workspace, so that the build cannot see it.
+func (b *Build) checkpointPath() string {
+	return b.WorkspaceDir + ".checkpoint.json"
+}
+
+// loadCheckpoint returns the checkpoint of the workspace.  It returns an
+// empty checkpoint if there is none or it cannot be used.
+func (b *Build) loadCheckpoint(ctx context.Context) (*checkpoint, error) {
+	log := clog.FromContext(ctx)
+
+	digest, err := configurationDigest(b.Configuration)
+	if err != nil {
+		return nil, fmt.Errorf("computing configuration digest: %w", err)
+	}
+	fresh := &checkpoint{Version: CheckpointVersion, Configuration: digest, Steps: []checkpointStep{}}
+
+	data, err := os.ReadFile(b.checkpointPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return fresh, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+
+	cp := &checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		log.Warnf("ignoring invalid checkpoint %s: %v", b.checkpointPath(), err)
+		return fresh, nil
+	}
+	if cp.Version != CheckpointVersion {
+		log.Warnf("ignoring checkpoint %s with version %d", b.checkpointPath(), cp.Version)
+		return fresh, nil
+	}
+	if cp.Configuration != digest {
+		log.Warnf("the configuration changed since the checkpoint was written, not resuming")
+		return fresh, nil
+	}
+
+	return cp, nil
+}
+
+// recordCheckpoint adds a completed step to the checkpoint and writes it.
+func (b *Build) recordCheckpoint(step checkpointStep) error {
+	if b.checkpoint == nil {
+		return nil
+	}
+
+	b.checkpoint.Steps = append(b.checkpoint.Steps, step)
+
+	data, err := json.MarshalIndent(b.checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+
+	// Write the checkpoint atomically, so that it is never truncated.
+	tmp := b.checkpointPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, b.checkpointPath()); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Build) checkpointStep(p config.Pipeline, sp *config.Subpackage) (checkpointStep, error) {
+	digest, err := stepDigest(p, sp)
+	if err != nil {
+		return checkpointStep{}, fmt.Errorf("computing step digest: %w", err)
+	}
+
+	pctx := NewPipelineContext(&p, &b.Configuration.Environment, nil, b.PipelineDirs)
+	step := checkpointStep{Name: pctx.Identity(), Digest: digest}
+	if sp != nil {
+		step.Subpackage = sp.Name
+	}
+
+	return step, nil
+}
+
+// nextStep returns the checkpoint entry of a top-level step of the main
+// package, or of the subpackage sp, which is about to be run.  It returns
+// whether the step can be skipped because it completed in the workspace
+// during a previous build.
+func (b *Build) nextStep(ctx context.Context, p config.Pipeline, sp *config.Subpackage) (checkpointStep, bool, error) {
+	if b.resumed == nil {
+		return checkpointStep{}, false, nil
+	}
+
+	step, err := b.checkpointStep(p, sp)
+	if err != nil {
+		return step, false, err
+	}
+
+	// Steps are only skipped until the first one which does not match
+	// the checkpoint.
+	n := len(b.checkpoint.Steps)
+	if n >= len(b.resumed.Steps) {
+		return step, false, nil
+	}
+	if b.resumed.Steps[n] != step {
+		clog.FromContext(ctx).Warnf("step %q changed since the checkpoint was written, resuming before it", step.Name)
+		b.resumed.Steps = b.resumed.Steps[:n]
+		return step, false, nil
+	}
+
+	clog.FromContext(ctx).Infof("skipping step %q, which completed in a previous build", step.Name)
+	b.checkpoint.Steps = append(b.checkpoint.Steps, step)
+	return step, true, nil
+}
+
+// resumeWorkspace prepares the workspace for a resumable build.  It returns
+// whether the workspace holds the progress of a previous build, in which
+// case it must not be populated again.
+func (b *Build) resumeWorkspace(ctx context.Context) (bool, error) {
+	log := clog.FromContext(ctx)
+
+	cp, err := b.loadCheckpoint(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	b.resumed = cp
+	b.checkpoint = &checkpoint{Version: cp.Version, Configuration: cp.Configuration, Steps: []checkpointStep{}}
+
+	if len(cp.Steps) != 0 {
+		log.Infof("resuming build after %d completed steps", len(cp.Steps))
+		return true, nil
+	}
+
+	// An unusable checkpoint means the workspace holds the progress of
+	// another build, which must not leak into this one.
+	if _, err := os.Stat(b.checkpointPath()); err == nil {
+		log.Infof("starting over in a clean workspace %s", b.WorkspaceDir)
+		if err := os.RemoveAll(b.WorkspaceDir); err != nil {
+			return false, fmt.Errorf("cleaning workspace: %w", err)
+		}
+		if err := os.Remove(b.checkpointPath()); err != nil {
+			return false, fmt.Errorf("removing checkpoint: %w", err)
+		}
+	}
+
+	return false, nil
+}
+
+// removeCheckpoint removes the checkpoint once the build has succeeded, and
+// the workspace is no longer kept to resume it.
+func (b *Build) removeCheckpoint() error {
+	b.completed = true
+	if b.checkpoint == nil {
+		return nil
+	}
+
+	if err := os.Remove(b.checkpointPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// checkResumable returns an error if the build cannot be resumed.
+func (b *Build) checkResumable() error {
+	for _, name := range resumableRunners {
+		if b.Runner.Name() == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("builds cannot be resumed with the %s runner, which does not keep the workspace on the host", b.Runner.Name())
+}
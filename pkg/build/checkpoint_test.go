@@ -0,0 +1,143 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	ctx := context.Background()
+
+	newBuild := func(ws string, runs ...string) *Build {
+		b := &Build{WorkspaceDir: ws}
+		b.Configuration.Package = config.Package{Name: "foo", Version: "1.0"}
+		for _, r := range runs {
+			b.Configuration.Pipeline = append(b.Configuration.Pipeline, config.Pipeline{Runs: r})
+		}
+		return b
+	}
+
+	// run runs the steps until one named fail, and returns the steps which
+	// were run.
+	run := func(b *Build) []string {
+		ran := []string{}
+		for _, p := range b.Configuration.Pipeline {
+			step, skip, err := b.nextStep(ctx, p, nil)
+			require.NoError(t, err)
+			if skip {
+				continue
+			}
+			if p.Runs == "fail" {
+				break
+			}
+			ran = append(ran, p.Runs)
+			require.NoError(t, b.recordCheckpoint(step))
+		}
+		return ran
+	}
+
+	ws := filepath.Join(t.TempDir(), "x86_64")
+	require.NoError(t, os.MkdirAll(ws, 0o755))
+
+	b := newBuild(ws, "configure", "make", "fail")
+	resumed, err := b.resumeWorkspace(ctx)
+	require.NoError(t, err)
+	require.False(t, resumed)
+	require.Equal(t, []string{"configure", "make"}, run(b))
+
+	// The completed steps are skipped when the build is resumed.
+	b = newBuild(ws, "configure", "make", "make install")
+	resumed, err = b.resumeWorkspace(ctx)
+	require.NoError(t, err)
+	require.True(t, resumed)
+	require.Equal(t, []string{"make install"}, run(b))
+
+	// A changed step is run again, along with every step after it.
+	b = newBuild(ws, "configure", "make -j4", "make install")
+	resumed, err = b.resumeWorkspace(ctx)
+	require.NoError(t, err)
+	require.True(t, resumed)
+	require.Equal(t, []string{"make -j4", "make install"}, run(b))
+
+	// A changed configuration starts over in a clean workspace.
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "config.log"), nil, 0o644))
+	b = newBuild(ws, "configure", "make -j4", "make install")
+	b.Configuration.Package.Version = "1.1"
+	resumed, err = b.resumeWorkspace(ctx)
+	require.NoError(t, err)
+	require.False(t, resumed)
+	require.NoFileExists(t, filepath.Join(ws, "config.log"))
+	require.Equal(t, []string{"configure", "make -j4", "make install"}, run(b))
+
+	require.NoError(t, b.removeCheckpoint())
+	require.NoFileExists(t, b.checkpointPath())
+}
+
+// closingRunner is a runner which only has a name, and closes.
+type closingRunner struct {
+	fakeRunner
+}
+
+func (closingRunner) Close() error {
+	return nil
+}
+
+func TestCheckpointClose(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	newBuild := func(t *testing.T) *Build {
+		dir := t.TempDir()
+		b := &Build{
+			WorkspaceDir: filepath.Join(dir, "workspace"),
+			GuestDir:     filepath.Join(dir, "guest"),
+			Remove:       true,
+			Resume:       true,
+			Runner:       closingRunner{},
+		}
+		require.NoError(t, os.MkdirAll(b.WorkspaceDir, 0o755))
+		require.NoError(t, os.MkdirAll(b.GuestDir, 0o755))
+		_, err := b.resumeWorkspace(ctx)
+		require.NoError(t, err)
+		require.NoError(t, b.recordCheckpoint(checkpointStep{Name: "configure"}))
+		return b
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		// The workspace of a failed build is kept with its checkpoint, to
+		// resume the build.
+		b := newBuild(t)
+		require.NoError(t, b.Close(ctx))
+		require.NoDirExists(t, b.GuestDir)
+		require.DirExists(t, b.WorkspaceDir)
+		require.FileExists(t, b.checkpointPath())
+	})
+
+	t.Run("succeeded", func(t *testing.T) {
+		b := newBuild(t)
+		require.NoError(t, b.removeCheckpoint())
+		require.NoError(t, b.Close(ctx))
+		require.NoDirExists(t, b.GuestDir)
+		require.NoDirExists(t, b.WorkspaceDir)
+		require.NoFileExists(t, b.checkpointPath())
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/util"
+)
+
+// checksumsName is the name of the checksum manifest of the packages of an
+// architecture, which is beside them.
+const checksumsName = "SHA256SUMS"
+
+// writeChecksums adds the SHA-256 digests of files to the SHA256SUMS file of
+// dir, in the format of sha256sum, so that `sha256sum -c` verifies them from
+// dir.  The lines of the files it already lists are replaced, so that the
+// builds sharing an output directory add up.  Files are listed relative to
+// dir when they are below it, and by their absolute path otherwise.
+func writeChecksums(dir string, files []string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, checksumsName)
+
+	sums, err := readChecksums(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(absDir, abs)
+		if err != nil || name == ".." || strings.HasPrefix(name, "../") {
+			name = abs
+		}
+
+		sum, err := util.HashFile(file, sha256.New())
+		if err != nil {
+			return err
+		}
+		sums[name] = sum
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The manifest is written beside its final name and renamed, so that it
+	// is never read partially written.
+	f, err := os.CreateTemp(dir, "."+checksumsName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s  %s\n", sums[name], name)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// readChecksums returns the digests listed by the checksum manifest at
+// path, by name, which are none if there is no manifest.
+func readChecksums(path string) (map[string]string, error) {
+	sums := map[string]string{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return sums, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || len(name) < 2 {
+			return nil, fmt.Errorf("invalid line %q", scanner.Text())
+		}
+		// The name follows a space, or an asterisk in binary mode.
+		sums[name[1:]] = sum
+	}
+
+	return sums, scanner.Err()
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	outDir := filepath.Join(dir, "packages", "x86_64")
+	require.NoError(t, os.MkdirAll(outDir, 0o755))
+
+	write := func(path, content string) string {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	foo := write(filepath.Join(outDir, "foo-1.0-r0.apk"), "foo")
+	report := write(filepath.Join(dir, "report.x86_64.json"), "{}")
+
+	require.NoError(t, writeChecksums(outDir, []string{foo, report}))
+
+	data, err := os.ReadFile(filepath.Join(outDir, checksumsName))
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a  "+report+"\n"+
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae  foo-1.0-r0.apk\n",
+		string(data))
+
+	// Another build adds its packages, and replaces those built again.
+	write(foo, "foo again")
+	bar := write(filepath.Join(outDir, "bar-1.0-r0.apk"), "bar")
+	require.NoError(t, writeChecksums(outDir, []string{foo, bar}))
+
+	data, err = os.ReadFile(filepath.Join(outDir, checksumsName))
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a  "+report+"\n"+
+		"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9  bar-1.0-r0.apk\n"+
+		"60ab2d8c534545dc01a24333c01b873b766799a38105110ea3ae35ff137ee5aa  foo-1.0-r0.apk\n",
+		string(data))
+
+	entries, err := os.ReadDir(outDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "the temporary file was renamed")
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+)
+
+// lockedPrefix is the prefix of the temporary files and directories which
+// melange locks while it uses them.  Only those are cleaned up when a build
+// starts: the ones of apko, or of older versions of melange which did not
+// lock them, may be in use.
+const lockedPrefix = "melange-locked-"
+
+// tempPatterns match the temporary files and directories of builds and
+// tests, including those of older versions of melange and of apko, which
+// melange clean removes on demand.
+var tempPatterns = []string{
+	lockedPrefix + "*",
+	"melange-workspace-*",
+	"melange-guest-*",
+	"melange-resolver-*",
+	"melange-reproducibility-*",
+	"melange-secrets-*",
+	"melange-ca-*",
+	"melange-data-*.tar.gz",
+	"apko-temp-*",
+}
+
+// partialPrefix is the prefix of the packages being written to an output
+// directory.
+const partialPrefix = ".partial-"
+
+// staleAge is how long debris is left alone, as temporary files and
+// directories are locked right after they are created.
+const staleAge = time.Minute
+
+// removeStale removes the paths which are not locked by a running build.
+// It returns the removed paths.  With dryRun, nothing is removed.
+func removeStale(ctx context.Context, paths []string, dryRun bool) ([]string, error) {
+	log := clog.FromContext(ctx)
+
+	removed := []string{}
+	errs := []error{}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if time.Since(fi.ModTime()) < staleAge {
+			log.Debugf("not removing %s: it was just created", path)
+			continue
+		}
+
+		l, err := tryLock(path)
+		if errors.Is(err, ErrLocked) {
+			log.Debugf("not removing %s: %v", path, err)
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if !dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				errs = append(errs, fmt.Errorf("removing %s: %w", path, err))
+				l.Unlock()
+				continue
+			}
+		}
+		l.Unlock()
+
+		removed = append(removed, path)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// CleanTempDir removes the temporary files and directories left in dir by
+// crashed builds.  It returns the removed paths.
+func CleanTempDir(ctx context.Context, dir string, dryRun bool) ([]string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return cleanTempDir(ctx, dir, tempPatterns, nil, dryRun)
+}
+
+// cleanTempDir removes the paths of dir which match the patterns, except
+// those of keep.
+func cleanTempDir(ctx context.Context, dir string, patterns []string, keep map[string]bool, dryRun bool) ([]string, error) {
+	paths := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !keep[m] {
+				paths = append(paths, m)
+			}
+		}
+	}
+
+	return removeStale(ctx, paths, dryRun)
+}
+
+// keptEnvironments returns the temporary workspaces and build environments
+// of dir which failed builds kept, and their descriptions.
+func keptEnvironments(dir string) map[string]bool {
+	kept := map[string]bool{}
+	matches, _ := filepath.Glob(filepath.Join(dir, lockedPrefix+"*.env.json"))
+	for _, m := range matches {
+		env, err := ReadKeptEnvironment(m)
+		if err != nil {
+			continue
+		}
+		kept[m] = true
+		kept[env.WorkspaceDir] = true
+		kept[env.GuestDir] = true
+	}
+
+	return kept
+}
+
+// CleanOutDir removes the half-written packages left in the architecture
+// directories of outDir by crashed builds.  It returns the removed paths.
+func CleanOutDir(ctx context.Context, outDir string, dryRun bool) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(outDir, "*", partialPrefix+"*.apk.*"))
+	if err != nil {
+		return nil, err
+	}
+
+	return removeStale(ctx, matches, dryRun)
+}
+
+// CleanWorkspaceDir removes the architecture workspaces in workspaceDir,
+// and their checkpoints and lock files, unless they are used by a running build.  It
+// returns the removed paths.  With dryRun, nothing is removed.
+func CleanWorkspaceDir(ctx context.Context, workspaceDir string, dryRun bool) ([]string, error) {
+	log := clog.FromContext(ctx)
+
+	removed := []string{}
+	errs := []error{}
+	for _, arch := range apko_types.AllArchs {
+		path := filepath.Join(workspaceDir, arch.ToAPK())
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		l, err := lockBeside(path)
+		if errors.Is(err, ErrLocked) {
+			log.Debugf("not removing %s: %v", path, err)
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if !dryRun {
+			// The lock file is removed while it is held, so no other build
+			// can take it in between.
+			for _, p := range []string{path, path + ".checkpoint.json", path + ".lock"} {
+				if err := os.RemoveAll(p); err != nil {
+					errs = append(errs, fmt.Errorf("removing %s: %w", p, err))
+				}
+			}
+		}
+		l.Unlock()
+
+		removed = append(removed, path)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// cleanStale removes the debris of crashed builds from the temporary and
+// output directories: only what melange locks while it uses it, and not the
+// environments kept by failed builds.  Failing to clean up is not fatal.
+func (b *Build) cleanStale(ctx context.Context) {
+	log := clog.FromContext(ctx)
+
+	dirs := []string{os.TempDir()}
+	if dir := b.Runner.TempDir(); dir != "" && dir != os.TempDir() {
+		dirs = append(dirs, dir)
+	}
+
+	removed := []string{}
+	for _, dir := range dirs {
+		paths, err := cleanTempDir(ctx, dir, []string{lockedPrefix + "*"}, keptEnvironments(dir), false)
+		if err != nil {
+			log.Warnf("unable to clean up %s: %v", dir, err)
+		}
+		removed = append(removed, paths...)
+	}
+
+	paths, err := CleanOutDir(ctx, b.OutDir, false)
+	if err != nil {
+		log.Warnf("unable to clean up %s: %v", b.OutDir, err)
+	}
+	removed = append(removed, paths...)
+
+	for _, path := range removed {
+		log.Infof("removed %s left by a crashed build", path)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// age makes path look older than staleAge.
+func age(t *testing.T, path string) {
+	old := time.Now().Add(-2 * staleAge)
+	require.NoError(t, os.Chtimes(path, old, old))
+}
+
+func TestLockedTempDir(t *testing.T) {
+	dir, l, err := lockedTempDir(t.TempDir(), "guest-*")
+	require.NoError(t, err)
+
+	require.True(t, strings.HasPrefix(filepath.Base(dir), lockedPrefix+"guest-"), dir)
+	_, err = tryLock(dir)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, l.Unlock())
+	l, err = tryLock(dir)
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+}
+
+func TestCleanTempDir(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	stale := filepath.Join(tmp, "melange-guest-1")
+	require.NoError(t, os.MkdirAll(filepath.Join(stale, "usr"), 0o755))
+	age(t, stale)
+
+	staleCA := filepath.Join(tmp, "melange-ca-1")
+	require.NoError(t, os.Mkdir(staleCA, 0o755))
+	age(t, staleCA)
+
+	staleFile := filepath.Join(tmp, "melange-data-1.tar.gz")
+	require.NoError(t, os.WriteFile(staleFile, []byte("data"), 0o644))
+	age(t, staleFile)
+
+	inUse, l, err := lockedTempDir(tmp, "workspace-*")
+	require.NoError(t, err)
+	defer l.Unlock()
+	age(t, inUse)
+
+	fresh := filepath.Join(tmp, "melange-guest-2")
+	require.NoError(t, os.Mkdir(fresh, 0o755))
+
+	other := filepath.Join(tmp, "other")
+	require.NoError(t, os.Mkdir(other, 0o755))
+	age(t, other)
+
+	removed, err := CleanTempDir(ctx, tmp, true)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{stale, staleCA, staleFile}, removed)
+	require.DirExists(t, stale)
+
+	removed, err = CleanTempDir(ctx, tmp, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{stale, staleCA, staleFile}, removed)
+	require.NoDirExists(t, stale)
+	require.NoDirExists(t, staleCA)
+	require.NoFileExists(t, staleFile)
+	require.DirExists(t, inUse)
+	require.DirExists(t, fresh)
+	require.DirExists(t, other)
+}
+
+// tempDirRunner is a runner whose temporary directory is the default one.
+type tempDirRunner struct {
+	fakeRunner
+}
+
+func (tempDirRunner) TempDir() string {
+	return ""
+}
+
+func TestCleanStale(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	mkdir := func(name string) string {
+		p := filepath.Join(tmp, name)
+		require.NoError(t, os.Mkdir(p, 0o755))
+		age(t, p)
+		return p
+	}
+
+	crashed := mkdir(lockedPrefix + "guest-1")
+	// Those of apko and of older versions of melange are not locked while
+	// they are used.
+	unlocked := []string{mkdir("melange-guest-1"), mkdir("melange-workspace-1"), mkdir("apko-temp-1")}
+
+	// The environments kept by failed builds are left for melange env
+	// export.
+	keptWorkspace, keptGuest := mkdir(lockedPrefix+"workspace-2"), mkdir(lockedPrefix+"guest-2")
+	keptEnv := keptEnvironmentPath(keptWorkspace)
+	data, err := json.Marshal(KeptEnvironment{WorkspaceDir: keptWorkspace, GuestDir: keptGuest})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keptEnv, data, 0o644))
+	age(t, keptEnv)
+
+	b := &Build{Runner: tempDirRunner{}, OutDir: t.TempDir()}
+	b.cleanStale(ctx)
+	require.NoDirExists(t, crashed)
+	for _, p := range append(unlocked, keptWorkspace, keptGuest) {
+		require.DirExists(t, p)
+	}
+	require.FileExists(t, keptEnv)
+
+	// melange clean removes them all.
+	removed, err := CleanTempDir(ctx, tmp, false)
+	require.NoError(t, err)
+	require.ElementsMatch(t, append(unlocked, keptWorkspace, keptGuest, keptEnv), removed)
+}
+
+func TestCleanOutDir(t *testing.T) {
+	ctx := context.Background()
+	out := t.TempDir()
+	archDir := filepath.Join(out, "x86_64")
+	require.NoError(t, os.Mkdir(archDir, 0o755))
+
+	pkg := filepath.Join(archDir, "hello-2.12-r0.apk")
+	require.NoError(t, os.WriteFile(pkg, []byte("apk"), 0o644))
+	age(t, pkg)
+
+	partial := filepath.Join(archDir, partialPrefix+"hello-2.12-r0.apk.123")
+	require.NoError(t, os.WriteFile(partial, []byte("ap"), 0o644))
+	age(t, partial)
+
+	writing, err := lockedTempFile(archDir, partialPrefix+"hello-doc-2.12-r0.apk.*")
+	require.NoError(t, err)
+	defer writing.Close()
+	age(t, writing.Name())
+
+	removed, err := CleanOutDir(ctx, out, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{partial}, removed)
+	require.FileExists(t, pkg)
+	require.FileExists(t, writing.Name())
+}
+
+func TestCleanWorkspaceDir(t *testing.T) {
+	ctx := context.Background()
+	ws := t.TempDir()
+
+	for _, dir := range []string{"x86_64", "aarch64", "src"} {
+		require.NoError(t, os.Mkdir(filepath.Join(ws, dir), 0o755))
+	}
+	checkpoint := filepath.Join(ws, "aarch64.checkpoint.json")
+	require.NoError(t, os.WriteFile(checkpoint, []byte("{}"), 0o644))
+
+	l, err := lockBeside(filepath.Join(ws, "aarch64"))
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+
+	l, err = lockBeside(filepath.Join(ws, "x86_64"))
+	require.NoError(t, err)
+	defer l.Unlock()
+
+	// The lock survives the workspace being cleaned by the build.
+	require.NoError(t, os.RemoveAll(filepath.Join(ws, "x86_64")))
+	require.NoError(t, os.Mkdir(filepath.Join(ws, "x86_64"), 0o755))
+
+	removed, err := CleanWorkspaceDir(ctx, ws, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(ws, "aarch64")}, removed)
+	require.NoDirExists(t, filepath.Join(ws, "aarch64"))
+	require.NoFileExists(t, checkpoint)
+	require.NoFileExists(t, filepath.Join(ws, "aarch64.lock"))
+	require.DirExists(t, filepath.Join(ws, "x86_64"))
+	require.FileExists(t, filepath.Join(ws, "x86_64.lock"))
+	require.DirExists(t, filepath.Join(ws, "src"))
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// createCompatLinks creates the symlinks of a compat subpackage.  A legacy
+// path which the main package installed itself is relocated to the compat
+// subpackage, so that the main package only ships the new paths.
+func createCompatLinks(ctx context.Context, outDir, origin string, sp config.Subpackage) error {
+	log := clog.FromContext(ctx)
+
+	for _, l := range sp.Compat.Links {
+		dst := filepath.Join(outDir, sp.Name, l.Path)
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("subpackage %s: compat link %s already exists", sp.Name, l.Path)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		src := filepath.Join(outDir, origin, l.Path)
+		if fi, err := os.Lstat(src); err == nil {
+			if fi.IsDir() {
+				return fmt.Errorf("subpackage %s: compat link %s is a directory in %s", sp.Name, l.Path, origin)
+			}
+			log.Infof("  relocating %s from %s to %s", l.Path, origin, sp.Name)
+			if err := os.Remove(src); err != nil {
+				return fmt.Errorf("removing %s from %s: %w", l.Path, origin, err)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("mkdir -p %s: %w", filepath.Dir(dst), err)
+		}
+
+		log.Infof("  %s -> %s (%s)", l.Path, l.Target, sp.Name)
+		if err := os.Symlink(l.Target, dst); err != nil {
+			return fmt.Errorf("creating compat link %s: %w", l.Path, err)
+		}
+	}
+
+	return nil
+}
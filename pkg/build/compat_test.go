@@ -0,0 +1,58 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func Test_createCompatLinks(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	outDir := t.TempDir()
+	writeTree(t, filepath.Join(outDir, "python-3.12"),
+		"usr/bin/python3",
+		"usr/bin/python",
+	)
+
+	sp := config.Subpackage{
+		Name: "python-3-compat",
+		Compat: config.Compat{Links: []config.CompatLink{
+			{Path: "/usr/bin/python", Target: "python3"},
+			{Path: "/bin/python", Target: "/usr/bin/python3"},
+		}},
+	}
+	require.NoError(t, createCompatLinks(ctx, outDir, "python-3.12", sp))
+
+	for path, target := range map[string]string{
+		"usr/bin/python": "python3",
+		"bin/python":     "/usr/bin/python3",
+	} {
+		got, err := os.Readlink(filepath.Join(outDir, sp.Name, path))
+		require.NoError(t, err)
+		require.Equal(t, target, got)
+	}
+	require.FileExists(t, filepath.Join(outDir, "python-3.12", "usr", "bin", "python3"))
+	require.NoFileExists(t, filepath.Join(outDir, "python-3.12", "usr", "bin", "python"))
+
+	err := createCompatLinks(ctx, outDir, "python-3.12", sp)
+	require.ErrorContains(t, err, "already exists")
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// compilerCacheDir is where the compiler cache directory is mounted in the
+// build environment.
+const compilerCacheDir = "/var/cache/melange-compilers"
+
+// ccacheBinDir is where the ccache package installs the wrappers of the
+// compilers.
+const ccacheBinDir = "/usr/lib/ccache/bin"
+
+// CompilerCacheReport records how a compiler cache was used by a build.
+type CompilerCacheReport struct {
+	// The compiler cache, ccache or sccache
+	Name string `json:"name" yaml:"name"`
+	// The number of compilations which were found in the cache
+	Hits int64 `json:"hits" yaml:"hits"`
+	// The number of compilations which were not
+	Misses int64 `json:"misses" yaml:"misses"`
+}
+
+func (r *Report) addCompilerCache(cr CompilerCacheReport) {
+	if r == nil {
+		return
+	}
+
+	r.CompilerCaches = append(r.CompilerCaches, cr)
+}
+
+// compilerCacheEnv returns the environment which points ccache and sccache
+// at the compiler cache directory.  Cargo only uses sccache if it is told to,
+// which is done when it is in the build environment.
+func (b *Build) compilerCacheEnv() map[string]string {
+	env := map[string]string{
+		"CCACHE_DIR":     path.Join(compilerCacheDir, "ccache"),
+		"CCACHE_BASEDIR": container.DefaultWorkspaceDir,
+		"SCCACHE_DIR":    path.Join(compilerCacheDir, "sccache"),
+	}
+	if slices.Contains(b.Configuration.Environment.Contents.Packages, "sccache") {
+		env["RUSTC_WRAPPER"] = "sccache"
+	}
+
+	return env
+}
+
+// compilerCacheStats snapshots the statistics of the compiler caches in the
+// build environment, so that the difference between two snapshots is what
+// the build did.  The snapshots are written to a directory of their own in
+// the compiler cache directory, as it may be shared by concurrent builds.
+type compilerCacheStats struct {
+	hostDir  string
+	guestDir string
+}
+
+func (b *Build) newCompilerCacheStats() (*compilerCacheStats, error) {
+	dir, err := os.MkdirTemp(b.CompilerCacheDir, ".stats-")
+	if err != nil {
+		return nil, fmt.Errorf("creating compiler cache statistics directory: %w", err)
+	}
+
+	return &compilerCacheStats{
+		hostDir:  dir,
+		guestDir: path.Join(compilerCacheDir, filepath.Base(dir)),
+	}, nil
+}
+
+// snapshot records the statistics of the compiler caches which are
+// installed in the build environment.
+func (s *compilerCacheStats) snapshot(ctx context.Context, runner container.Runner, cfg *container.Config, name string) {
+	script := fmt.Sprintf(`cd '%[1]s'
+if command -v ccache >/dev/null; then ccache --print-stats > ccache.%[2]s || rm -f ccache.%[2]s; fi
+if command -v sccache >/dev/null; then sccache --show-stats --stats-format=json > sccache.%[2]s || rm -f sccache.%[2]s; fi
+true`, s.guestDir, name)
+
+	if err := runner.Run(ctx, cfg, "/bin/sh", "-c", script); err != nil {
+		clog.FromContext(ctx).Warnf("unable to record compiler cache statistics: %v", err)
+	}
+}
+
+// reports returns the difference between the two snapshots of each compiler
+// cache, and removes them.
+func (s *compilerCacheStats) reports(ctx context.Context) []CompilerCacheReport {
+	log := clog.FromContext(ctx)
+	defer os.RemoveAll(s.hostDir)
+
+	parsers := []struct {
+		name  string
+		parse func([]byte) (int64, int64, error)
+	}{
+		{"ccache", parseCcacheStats},
+		{"sccache", parseSccacheStats},
+	}
+
+	reports := []CompilerCacheReport{}
+	for _, p := range parsers {
+		after, err := os.ReadFile(filepath.Join(s.hostDir, p.name+".after"))
+		if err != nil {
+			continue
+		}
+		hits, misses, err := p.parse(after)
+		if err != nil {
+			log.Warnf("unable to parse %s statistics: %v", p.name, err)
+			continue
+		}
+
+		// The statistics of sccache start with its server, so there may be
+		// nothing before the build.
+		if before, err := os.ReadFile(filepath.Join(s.hostDir, p.name+".before")); err == nil {
+			h, m, err := p.parse(before)
+			if err != nil {
+				log.Warnf("unable to parse %s statistics: %v", p.name, err)
+				continue
+			}
+			hits, misses = hits-h, misses-m
+		}
+
+		log.Infof("%s: %d hits, %d misses", p.name, hits, misses)
+		reports = append(reports, CompilerCacheReport{Name: p.name, Hits: hits, Misses: misses})
+	}
+
+	return reports
+}
+
+// parseCcacheStats parses the output of ccache --print-stats, which is a
+// counter and its value on each line.
+func parseCcacheStats(data []byte) (int64, int64, error) {
+	counters := map[string]int64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[k] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	if _, ok := counters["cache_miss"]; !ok {
+		return 0, 0, fmt.Errorf("no cache_miss counter")
+	}
+
+	return counters["direct_cache_hit"] + counters["preprocessed_cache_hit"], counters["cache_miss"], nil
+}
+
+// parseSccacheStats parses the output of sccache --show-stats
+// --stats-format=json, which counts the hits and misses of each language.
+func parseSccacheStats(data []byte) (int64, int64, error) {
+	type counts struct {
+		Counts map[string]int64 `json:"counts"`
+	}
+	var stats struct {
+		Stats struct {
+			CacheHits   counts `json:"cache_hits"`
+			CacheMisses counts `json:"cache_misses"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return 0, 0, err
+	}
+
+	sum := func(c counts) int64 {
+		total := int64(0)
+		for _, n := range c.Counts {
+			total += n
+		}
+		return total
+	}
+
+	return sum(stats.Stats.CacheHits), sum(stats.Stats.CacheMisses), nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_compilerCacheEnv(t *testing.T) {
+	b := &Build{CompilerCacheDir: t.TempDir()}
+	env := b.compilerCacheEnv()
+	require.Equal(t, "/var/cache/melange-compilers/ccache", env["CCACHE_DIR"])
+	require.Equal(t, "/var/cache/melange-compilers/sccache", env["SCCACHE_DIR"])
+	require.NotContains(t, env, "RUSTC_WRAPPER")
+
+	b.Configuration.Environment.Contents.Packages = []string{"rust", "sccache"}
+	require.Equal(t, "sccache", b.compilerCacheEnv()["RUSTC_WRAPPER"])
+}
+
+func Test_compilerCacheStats(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	b := &Build{CompilerCacheDir: t.TempDir()}
+
+	s, err := b.newCompilerCacheStats()
+	require.NoError(t, err)
+	require.Equal(t, "/var/cache/melange-compilers/"+filepath.Base(s.hostDir), s.guestDir)
+
+	files := map[string]string{
+		"ccache.before": "stats_updated_timestamp\t1700000000\ndirect_cache_hit\t10\npreprocessed_cache_hit\t2\ncache_miss\t5\n",
+		"ccache.after":  "stats_updated_timestamp\t1700000100\ndirect_cache_hit\t30\npreprocessed_cache_hit\t4\ncache_miss\t6\n",
+		// The sccache server was started by the first snapshot.
+		"sccache.after": `{"stats":{"compile_requests":9,"cache_hits":{"counts":{"Rust":7,"C/C++":1}},"cache_misses":{"counts":{"Rust":1}}}}`,
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(s.hostDir, name), []byte(content), 0o644))
+	}
+
+	require.Equal(t, []CompilerCacheReport{
+		{Name: "ccache", Hits: 22, Misses: 1},
+		{Name: "sccache", Hits: 8, Misses: 1},
+	}, s.reports(ctx))
+	require.NoDirExists(t, s.hostDir)
+}
+
+func Test_compilerCacheStats_missing(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	b := &Build{CompilerCacheDir: t.TempDir()}
+
+	s, err := b.newCompilerCacheStats()
+	require.NoError(t, err)
+
+	// ccache is too old for --print-stats.
+	require.NoError(t, os.WriteFile(filepath.Join(s.hostDir, "ccache.after"), []byte("cache hit (direct) 3\n"), 0o644))
+
+	require.Empty(t, s.reports(ctx))
+}
@@ -0,0 +1,255 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/elfindex"
+	"chainguard.dev/melange/pkg/sca"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// DependencyLogVersion is the version of the dependency log schema.  It is
+// incremented whenever a field is removed or its meaning is changed.
+const DependencyLogVersion = 1
+
+// DependencyLogSourceConfig is the generator recorded for dependencies which
+// were declared in the build configuration rather than generated.
+const DependencyLogSourceConfig = "config"
+
+// DependencyLog is the document written to the dependency log.  It is
+// described in docs/DEPENDENCY-LOG.md.
+type DependencyLog struct {
+	// The version of the dependency log schema
+	Version int `json:"version"`
+	// The architecture which was built
+	Arch string `json:"arch"`
+	// The dependencies of each package emitted by the build
+	Packages []DependencyLogPackage `json:"packages"`
+}
+
+// DependencyLogPackage holds the final dependencies of a single package.
+type DependencyLogPackage struct {
+	// The name of the package
+	Name string `json:"name"`
+	// The runtime dependencies of the package
+	Depends []LoggedDependency `json:"depends"`
+	// The provides of the package
+	Provides []LoggedDependency `json:"provides"`
+	// The vendored provides of the package, which do not affect resolution
+	Vendored []LoggedDependency `json:"vendored"`
+}
+
+// LoggedDependency is a single entry in the dependency log.
+type LoggedDependency struct {
+	// The dependency, e.g. so:libc.so.6
+	Name string `json:"name"`
+	// The generator which found the dependency, e.g. soname or cmd, or
+	// config if it was declared in the build configuration
+	Generator string `json:"generator"`
+	// The package which satisfies the dependency, if known.  Only set on
+	// runtime dependencies.
+	ResolvedBy string `json:"resolved-by,omitempty"`
+	// Whether the dependency could not be resolved against the packages
+	// emitted by the build or installed in the build environment.
+	Unresolved bool `json:"unresolved,omitempty"`
+}
+
+// newDependencyLogPackage records the final dependencies of a package,
+// attributing each to the generator which found it.
+func newDependencyLogPackage(name string, declared config.Dependencies, results []sca.Result, final config.Dependencies) DependencyLogPackage {
+	attribute := func(deps []string, declared []string, generated func(config.Dependencies) []string) []LoggedDependency {
+		sources := map[string]string{}
+		for _, res := range results {
+			for _, dep := range generated(res.Dependencies) {
+				if _, ok := sources[dep]; !ok {
+					sources[dep] = res.Generator
+				}
+			}
+		}
+		for _, dep := range declared {
+			sources[dep] = DependencyLogSourceConfig
+		}
+
+		logged := make([]LoggedDependency, 0, len(deps))
+		for _, dep := range deps {
+			logged = append(logged, LoggedDependency{Name: dep, Generator: sources[dep]})
+		}
+
+		return logged
+	}
+
+	return DependencyLogPackage{
+		Name:     name,
+		Depends:  attribute(final.Runtime, declared.Runtime, func(d config.Dependencies) []string { return d.Runtime }),
+		Provides: attribute(final.Provides, declared.Provides, func(d config.Dependencies) []string { return d.Provides }),
+		Vendored: attribute(final.Vendored, declared.Vendored, func(d config.Dependencies) []string { return d.Vendored }),
+	}
+}
+
+// resolve fills in the package which satisfies each runtime dependency,
+// first looking at the packages emitted by the build, then at the packages
+// installed in the build environment.  Dependencies which cannot be resolved
+// are flagged.
+func (dl *DependencyLog) resolve(installed []*apk.Package) {
+	providers := map[string]string{}
+	for _, pkg := range installed {
+		providers[pkg.Name] = pkg.Name
+		for _, prov := range pkg.Provides {
+			providers[util.DependencyName(prov)] = pkg.Name
+		}
+	}
+
+	// Packages from this build take precedence over the build environment.
+	for _, pkg := range dl.Packages {
+		providers[pkg.Name] = pkg.Name
+		for _, prov := range pkg.Provides {
+			providers[util.DependencyName(prov.Name)] = pkg.Name
+		}
+	}
+
+	for i := range dl.Packages {
+		pkg := &dl.Packages[i]
+		for j := range pkg.Depends {
+			dep := &pkg.Depends[j]
+
+			// Conflicts (!foo) are not something to resolve.
+			if strings.HasPrefix(dep.Name, "!") {
+				continue
+			}
+
+			if provider, ok := providers[util.DependencyName(dep.Name)]; ok {
+				dep.ResolvedBy = provider
+				continue
+			}
+
+			dep.Unresolved = true
+		}
+	}
+}
+
+// installedPackages returns the packages installed in the build guest, if
+// its package database is available.
+func installedPackages(guestDir string) ([]*apk.Package, error) {
+	f, err := os.Open(filepath.Join(guestDir, "lib", "apk", "db", "installed"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return apk.ParsePackageIndex(f)
+}
+
+// resolveDependencies resolves the dependencies of the emitted packages
+// against each other and the build environment, and logs the dependencies
+// which cannot be resolved as warnings.
+func (b *Build) resolveDependencies(ctx context.Context) {
+	log := clog.FromContext(ctx)
+
+	installed, err := installedPackages(b.GuestDir)
+	if err != nil {
+		log.Warnf("unable to read installed packages of build environment: %v", err)
+	}
+
+	b.dependencyLog.resolve(installed)
+
+	for _, pkg := range b.dependencyLog.Packages {
+		for _, dep := range pkg.Depends {
+			if dep.Unresolved {
+				log.With(b.annotationsAt(pkg.Name)...).Warnf("%s: unable to resolve dependency %s", pkg.Name, dep.Name)
+			}
+		}
+	}
+}
+
+// writeDependencyLog writes the resolved dependency log for the build.
+func (b *Build) writeDependencyLog(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	path := fmt.Sprintf("%s.%s", b.DependencyLog, b.Arch.ToAPK())
+	log.Infof("writing dependency log to %s", path)
+
+	data, err := json.MarshalIndent(b.dependencyLog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding dependency log: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing dependency log: %w", err)
+	}
+
+	return nil
+}
+
+// checkUnresolvedLibraries returns an error listing the binaries which need
+// a shared library that is not provided by any package emitted by the build
+// or installed in the build environment.
+func (b *Build) checkUnresolvedLibraries() error {
+	errs := []error{}
+	for _, pkg := range b.dependencyLog.Packages {
+		for _, dep := range pkg.Depends {
+			soname, ok := strings.CutPrefix(dep.Name, "so:")
+			if !ok || !dep.Unresolved {
+				continue
+			}
+
+			idx, err := b.elfIndex(pkg.Name)
+			if err != nil {
+				return err
+			}
+			users := binariesNeeding(idx, soname)
+
+			errs = append(errs, fmt.Errorf("%s: nothing provides %s, needed by %s", pkg.Name, soname, strings.Join(users, ", ")))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("unresolved shared library dependencies:\n%w", err)
+	}
+
+	return nil
+}
+
+// binariesNeeding returns the ELF objects of idx which import soname, or
+// use it as their interpreter.
+func binariesNeeding(idx *elfindex.Index, soname string) []string {
+	users := []string{}
+	for _, f := range idx.Files() {
+		libs := f.Needed
+		if f.Interpreter != "" {
+			libs = append(slices.Clip(libs), strings.ReplaceAll(filepath.Base(f.Interpreter), "ld-musl", "libc.musl"))
+		}
+
+		if slices.Contains(libs, soname) {
+			users = append(users, "/"+f.Path)
+		}
+	}
+
+	return users
+}
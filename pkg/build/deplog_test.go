@@ -0,0 +1,97 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/sca"
+)
+
+func TestDependencyLog(t *testing.T) {
+	results := []sca.Result{{
+		Generator: "soname",
+		Dependencies: config.Dependencies{
+			Runtime: []string{"so:libc.so.6", "so:libfoo.so.1"},
+		},
+	}, {
+		Generator: "cmd",
+		Dependencies: config.Dependencies{
+			Provides: []string{"cmd:foo=1.0-r0"},
+		},
+	}}
+
+	dl := &DependencyLog{Version: DependencyLogVersion, Arch: "x86_64"}
+	dl.Packages = append(dl.Packages,
+		newDependencyLogPackage("foo",
+			config.Dependencies{Runtime: []string{"bash"}},
+			results,
+			config.Dependencies{
+				Runtime:  []string{"bash", "so:libc.so.6", "so:libfoo.so.1"},
+				Provides: []string{"cmd:foo=1.0-r0"},
+			}),
+		newDependencyLogPackage("foo-libs", config.Dependencies{}, []sca.Result{{
+			Generator: "soname",
+			Dependencies: config.Dependencies{
+				Provides: []string{"so:libfoo.so.1=1"},
+			},
+		}}, config.Dependencies{
+			Provides: []string{"so:libfoo.so.1=1"},
+		}),
+	)
+
+	dl.resolve([]*apk.Package{{
+		Name:     "glibc",
+		Provides: []string{"so:libc.so.6=6"},
+	}})
+
+	require.Equal(t, []LoggedDependency{
+		{Name: "bash", Generator: DependencyLogSourceConfig, Unresolved: true},
+		{Name: "so:libc.so.6", Generator: "soname", ResolvedBy: "glibc"},
+		{Name: "so:libfoo.so.1", Generator: "soname", ResolvedBy: "foo-libs"},
+	}, dl.Packages[0].Depends)
+	require.Equal(t, []LoggedDependency{
+		{Name: "cmd:foo=1.0-r0", Generator: "cmd"},
+	}, dl.Packages[0].Provides)
+}
+
+func Test_checkUnresolvedLibraries(t *testing.T) {
+	b := &Build{
+		WorkspaceDir: t.TempDir(),
+		dependencyLog: &DependencyLog{
+			Packages: []DependencyLogPackage{{
+				Name: "foo",
+				Depends: []LoggedDependency{
+					{Name: "so:libc.so.6", Generator: "soname", ResolvedBy: "glibc"},
+					{Name: "so:libmissing.so.1", Generator: "soname", Unresolved: true},
+					{Name: "bash", Generator: DependencyLogSourceConfig, Unresolved: true},
+				},
+			}},
+		},
+	}
+	writeTree(t, filepath.Join(b.WorkspaceDir, "melange-out", "foo"), "usr/bin/foo")
+
+	err := b.checkUnresolvedLibraries()
+	require.ErrorContains(t, err, "foo: nothing provides libmissing.so.1")
+	require.NotContains(t, err.Error(), "bash")
+
+	b.dependencyLog.Packages[0].Depends = b.dependencyLog.Packages[0].Depends[:1]
+	require.NoError(t, b.checkUnresolvedLibraries())
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/linter"
+)
+
+// moveDevFiles moves the static libraries of the main package to its -static
+// subpackage, or to its -dev subpackage if it has no -static one, and its
+// headers to its -dev subpackage, when the dev-files option of the package
+// is move.  The directories left empty are removed.
+func moveDevFiles(ctx context.Context, outDir string, pkg config.Package, subpackages []config.Subpackage) error {
+	log := clog.FromContext(ctx)
+
+	if pkg.Options.DevFiles != config.DevFilesPolicyMove {
+		return nil
+	}
+
+	has := func(name string) bool {
+		return slices.ContainsFunc(subpackages, func(sp config.Subpackage) bool { return sp.Name == name })
+	}
+	devTarget, staticTarget := "", ""
+	if has(pkg.Name + "-dev") {
+		devTarget, staticTarget = pkg.Name+"-dev", pkg.Name+"-dev"
+	}
+	if has(pkg.Name + "-static") {
+		staticTarget = pkg.Name + "-static"
+	}
+
+	originDir := filepath.Join(outDir, pkg.Name)
+	moves := map[string]string{}
+	if err := fs.WalkDir(os.DirFS(originDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+		case linter.IsStaticLibrary(path) && staticTarget != "":
+			moves[path] = staticTarget
+		case linter.IsHeader(path) && devTarget != "":
+			moves[path] = devTarget
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// emptied are the directories which may be left empty by the moves.
+	emptied := map[string]bool{}
+	for path, target := range moves {
+		for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+			emptied[dir] = true
+		}
+
+		dst := filepath.Join(outDir, target, path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(originDir, path), dst); err != nil {
+			return fmt.Errorf("moving %s to %s: %w", path, target, err)
+		}
+	}
+	if len(moves) != 0 {
+		log.Infof("moved %d static libraries and headers out of %s", len(moves), pkg.Name)
+	}
+
+	// Remove the directories left empty, deepest first.
+	dirs := make([]string, 0, len(emptied))
+	for dir := range emptied {
+		dirs = append(dirs, dir)
+	}
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(originDir, dir))
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(filepath.Join(originDir, dir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
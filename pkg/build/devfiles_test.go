@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestMoveDevFiles(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	pkg := config.Package{Name: "foo", Options: config.PackageOption{DevFiles: config.DevFilesPolicyMove}}
+
+	t.Run("dev and static", func(t *testing.T) {
+		outDir := t.TempDir()
+		writeTree(t, filepath.Join(outDir, "foo"),
+			"usr/bin/foo",
+			"usr/include/foo/foo.h",
+			"usr/lib/libfoo.a",
+			"usr/lib/libfoo.so.1",
+			"var/lib/foo/.keep",
+		)
+
+		require.NoError(t, moveDevFiles(ctx, outDir, pkg, []config.Subpackage{{Name: "foo-dev"}, {Name: "foo-static"}}))
+
+		require.FileExists(t, filepath.Join(outDir, "foo-dev", "usr/include/foo/foo.h"))
+		require.FileExists(t, filepath.Join(outDir, "foo-static", "usr/lib/libfoo.a"))
+		require.FileExists(t, filepath.Join(outDir, "foo", "usr/lib/libfoo.so.1"))
+		require.NoDirExists(t, filepath.Join(outDir, "foo", "usr/include"))
+		require.DirExists(t, filepath.Join(outDir, "foo", "var/lib/foo"))
+	})
+
+	t.Run("dev only", func(t *testing.T) {
+		outDir := t.TempDir()
+		writeTree(t, filepath.Join(outDir, "foo"), "usr/include/foo.h", "usr/lib/libfoo.a")
+
+		require.NoError(t, moveDevFiles(ctx, outDir, pkg, []config.Subpackage{{Name: "foo-dev"}}))
+
+		require.FileExists(t, filepath.Join(outDir, "foo-dev", "usr/include/foo.h"))
+		require.FileExists(t, filepath.Join(outDir, "foo-dev", "usr/lib/libfoo.a"))
+		require.NoDirExists(t, filepath.Join(outDir, "foo", "usr"))
+	})
+
+	t.Run("static only", func(t *testing.T) {
+		outDir := t.TempDir()
+		writeTree(t, filepath.Join(outDir, "foo"), "usr/include/foo.h", "usr/lib/libfoo.a")
+
+		require.NoError(t, moveDevFiles(ctx, outDir, pkg, []config.Subpackage{{Name: "foo-static"}}))
+
+		require.FileExists(t, filepath.Join(outDir, "foo", "usr/include/foo.h"))
+		require.FileExists(t, filepath.Join(outDir, "foo-static", "usr/lib/libfoo.a"))
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		outDir := t.TempDir()
+		writeTree(t, filepath.Join(outDir, "foo"), "usr/include/foo.h")
+
+		require.NoError(t, moveDevFiles(ctx, outDir, config.Package{Name: "foo"}, []config.Subpackage{{Name: "foo-dev"}}))
+
+		require.FileExists(t, filepath.Join(outDir, "foo", "usr/include/foo.h"))
+	})
+}
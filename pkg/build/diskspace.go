@@ -0,0 +1,333 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMinFreeSpace is the space which must be left free on every
+// filesystem used by a build, on top of what the build is estimated to need.
+const DefaultMinFreeSpace = 1 << 30
+
+// diskSpaceInterval is how often free space is checked during a build.
+const diskSpaceInterval = 15 * time.Second
+
+// ErrInsufficientDiskSpace is returned when a filesystem used by the build
+// does not have enough free space.
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// diskRequirement is the space a build needs in a directory.
+type diskRequirement struct {
+	// What the directory is used for, e.g. "workspace"
+	use string
+	dir string
+	// The estimated space needed in dir, not counting the margin
+	need uint64
+}
+
+// filesystem is the free space on the filesystem holding a directory.
+type filesystem struct {
+	id    [2]int32
+	avail uint64
+}
+
+// statFilesystem returns the filesystem holding dir.  As the directories of
+// a build may not have been created yet, the closest existing parent is used.
+func statFilesystem(dir string) (filesystem, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return filesystem{}, err
+	}
+
+	for {
+		var st unix.Statfs_t
+		err := unix.Statfs(dir, &st)
+		if err == nil {
+			return filesystem{
+				id:    st.Fsid.Val,
+				avail: uint64(st.Bavail) * uint64(st.Bsize), //nolint:gosec
+			}, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, unix.ENOENT) || parent == dir {
+			return filesystem{}, fmt.Errorf("checking free space of %s: %w", dir, err)
+		}
+		dir = parent
+	}
+}
+
+// dirSize returns the apparent size of the regular files below dir.
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(fi.Size()) //nolint:gosec
+
+		return nil
+	})
+
+	return size, err
+}
+
+// checkDiskSpace checks that the filesystem holding each directory has
+// enough free space for all of the requirements on it, plus margin.
+func checkDiskSpace(reqs []diskRequirement, margin uint64) error {
+	type usage struct {
+		fs   filesystem
+		need uint64
+		uses []string
+	}
+
+	usages := []*usage{}
+	byID := map[[2]int32]*usage{}
+	for _, req := range reqs {
+		st, err := statFilesystem(req.dir)
+		if err != nil {
+			return err
+		}
+
+		u, ok := byID[st.id]
+		if !ok {
+			u = &usage{fs: st, need: margin}
+			byID[st.id] = u
+			usages = append(usages, u)
+		}
+		u.need += req.need
+		if req.need != 0 {
+			u.uses = append(u.uses, fmt.Sprintf("%s for the %s in %s", humanize.IBytes(req.need), req.use, req.dir))
+		} else {
+			u.uses = append(u.uses, fmt.Sprintf("the %s in %s", req.use, req.dir))
+		}
+	}
+
+	errs := []error{}
+	for _, u := range usages {
+		if u.fs.avail >= u.need {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%w: %s available, about %s needed (%s, and %s left free)",
+			ErrInsufficientDiskSpace, humanize.IBytes(u.fs.avail), humanize.IBytes(u.need),
+			strings.Join(u.uses, ", "), humanize.IBytes(margin)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// previousInstalledSize returns the installed size of the packages from the
+// last build of origin found in the index of dir, or 0 if there is none.
+func previousInstalledSize(dir, origin string) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, "APKINDEX.tar.gz"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	idx, err := apk.IndexFromArchive(f)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", f.Name(), err)
+	}
+
+	pkgs := []*apk.Package{}
+	for _, pkg := range idx.Packages {
+		if pkg.Origin == origin {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+
+	var size uint64
+	for _, pkg := range latestPackages(pkgs) {
+		size += pkg.InstalledSize
+	}
+
+	return size, nil
+}
+
+// preflightDiskSpace checks that there is enough space for the build before
+// it starts.  The workspace needs room for the sources and the installed
+// contents of the packages, which are estimated from their previous build,
+// and the output directory needs room for the packages themselves.
+func (b *Build) preflightDiskSpace(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	var source uint64
+	if !b.EmptyWorkspace {
+		size, err := dirSize(b.SourceDir)
+		if err != nil {
+			return fmt.Errorf("estimating the size of %s: %w", b.SourceDir, err)
+		}
+		source = size
+	}
+
+	installed, err := previousInstalledSize(filepath.Join(b.OutDir, b.Arch.ToAPK()), b.Configuration.Package.Name)
+	if err != nil {
+		log.Warnf("unable to estimate the installed size from the previous build: %v", err)
+	}
+
+	log.Infof("estimated disk usage: %s of sources, %s of installed packages", humanize.IBytes(source), humanize.IBytes(installed))
+
+	return checkDiskSpace([]diskRequirement{
+		{use: "workspace", dir: b.WorkspaceDir, need: source + installed},
+		{use: "guest", dir: b.GuestDir},
+		{use: "output directory", dir: b.OutDir, need: installed},
+	}, b.MinFreeSpace)
+}
+
+// emitDiskSpace checks that there is enough space to emit the packages,
+// which are written straight to the output directory.  The uncompressed size
+// of a package bounds the space it needs.
+func (b *Build) emitDiskSpace() error {
+	out := filepath.Join(b.WorkspaceDir, "melange-out")
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	for _, e := range entries {
+		size, err := dirSize(filepath.Join(out, e.Name()))
+		if err != nil {
+			return err
+		}
+		total += size
+	}
+
+	return checkDiskSpace([]diskRequirement{
+		{use: "packages", dir: b.OutDir, need: total},
+	}, 0)
+}
+
+// diskMonitor periodically checks the free space of the filesystems used by
+// a build, so that a build which runs out of space can say so.
+type diskMonitor struct {
+	dirs   map[string]string
+	margin uint64
+
+	mu  sync.Mutex
+	low map[string]uint64
+}
+
+func newDiskMonitor(b *Build) *diskMonitor {
+	return &diskMonitor{
+		dirs: map[string]string{
+			"workspace":        b.WorkspaceDir,
+			"guest":            b.GuestDir,
+			"output directory": b.OutDir,
+		},
+		margin: b.MinFreeSpace,
+		low:    map[string]uint64{},
+	}
+}
+
+// check warns about every directory whose filesystem has less than the
+// margin left.
+func (m *diskMonitor) check(ctx context.Context) {
+	log := clog.FromContext(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for use, dir := range m.dirs {
+		st, err := statFilesystem(dir)
+		if err != nil {
+			continue
+		}
+
+		if st.avail < m.margin {
+			if _, warned := m.low[use]; !warned {
+				log.Warnf("running low on disk space: %s left for the %s in %s", humanize.IBytes(st.avail), use, dir)
+			}
+			m.low[use] = st.avail
+		} else {
+			delete(m.low, use)
+		}
+	}
+}
+
+// start checks the free space until ctx is done.
+func (m *diskMonitor) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(diskSpaceInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.check(ctx)
+			}
+		}
+	}()
+}
+
+// annotate explains err if the build failed because it ran out of space.
+func (m *diskMonitor) annotate(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrInsufficientDiskSpace) {
+		return err
+	}
+
+	m.check(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !errors.Is(err, unix.ENOSPC) && len(m.low) == 0 {
+		return err
+	}
+
+	uses := []string{}
+	for use, avail := range m.low {
+		uses = append(uses, fmt.Sprintf("%s left for the %s in %s", humanize.IBytes(avail), use, m.dirs[use]))
+	}
+	sort.Strings(uses)
+	if len(uses) == 0 {
+		return fmt.Errorf("%w, the build ran out of disk space: %w", ErrInsufficientDiskSpace, err)
+	}
+
+	return fmt.Errorf("%w, the build likely ran out of disk space (%s): %w", ErrInsufficientDiskSpace, strings.Join(uses, ", "), err)
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "one"), make([]byte, 100), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b", "two"), make([]byte, 23), 0o644))
+	require.NoError(t, os.Symlink("one", filepath.Join(dir, "a", "link")))
+
+	size, err := dirSize(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(123), size)
+
+	size, err = dirSize(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), size)
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	// A directory which does not exist yet is checked on its parent.
+	missing := filepath.Join(dir, "not", "yet")
+	require.NoError(t, checkDiskSpace([]diskRequirement{
+		{use: "workspace", dir: missing, need: 1},
+	}, 0))
+
+	// Requirements on the same filesystem add up.
+	st, err := statFilesystem(dir)
+	require.NoError(t, err)
+
+	err = checkDiskSpace([]diskRequirement{
+		{use: "workspace", dir: dir, need: st.avail / 2},
+		{use: "output directory", dir: dir, need: st.avail / 2},
+	}, 1<<40)
+	require.ErrorIs(t, err, ErrInsufficientDiskSpace)
+	require.ErrorContains(t, err, "for the workspace in "+dir)
+	require.ErrorContains(t, err, "for the output directory in "+dir)
+}
+
+func TestDiskMonitorAnnotate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	m := &diskMonitor{dirs: map[string]string{"workspace": dir}, low: map[string]uint64{}}
+
+	err := fmt.Errorf("unable to run pipeline: %w", os.ErrPermission)
+	require.Equal(t, err, m.annotate(ctx, err))
+
+	err = fmt.Errorf("writing file: %w", syscall.ENOSPC)
+	require.ErrorIs(t, m.annotate(ctx, err), ErrInsufficientDiskSpace)
+	require.ErrorIs(t, m.annotate(ctx, err), syscall.ENOSPC)
+
+	// A build which was low on space when it failed is likely to have
+	// failed because of it.
+	m.margin = 1 << 62
+	err = fmt.Errorf("unable to run pipeline: exit status 1")
+	require.ErrorContains(t, m.annotate(ctx, err), "left for the workspace in "+dir)
+
+	require.NoError(t, m.annotate(ctx, nil))
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// pruneEmptyDirs removes the directories of the package pkgName in dir
+// which are empty, or only hold empty directories, so that the directories
+// which build systems leave behind do not end up in the package.  The
+// directories matching one of the keep-dirs patterns keep are shipped even
+// when empty, and so are those holding a .keep file, which are not empty.
+func pruneEmptyDirs(ctx context.Context, pkgName, dir string, keep []string) error {
+	pruned := 0
+
+	var prune func(rel string) (bool, error)
+	prune = func(rel string) (bool, error) {
+		entries, err := os.ReadDir(filepath.Join(dir, rel))
+		if err != nil {
+			return false, err
+		}
+
+		empty := true
+		for _, e := range entries {
+			if !e.IsDir() {
+				empty = false
+				continue
+			}
+			removed, err := prune(path.Join(rel, e.Name()))
+			if err != nil {
+				return false, err
+			}
+			if !removed {
+				empty = false
+			}
+		}
+
+		if !empty || rel == "." || keptDir(rel, keep) {
+			return false, nil
+		}
+		if err := os.Remove(filepath.Join(dir, rel)); err != nil {
+			return false, err
+		}
+		pruned++
+
+		return true, nil
+	}
+
+	if _, err := prune("."); err != nil {
+		return err
+	}
+	if pruned != 0 {
+		clog.FromContext(ctx).Infof("%s: pruned %d empty directories", pkgName, pruned)
+	}
+
+	return nil
+}
+
+// keptDir returns whether the directory p of a package matches one of the
+// keep-dirs patterns keep, which may be absolute.
+func keptDir(p string, keep []string) bool {
+	for _, pattern := range keep {
+		// The patterns were validated with the configuration.
+		if ok, _ := path.Match(strings.Trim(pattern, "/"), p); ok {
+			return true
+		}
+	}
+
+	return false
+}
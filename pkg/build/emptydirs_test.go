@@ -0,0 +1,70 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneEmptyDirs(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir := t.TempDir()
+	for _, d := range []string{
+		"usr/bin",
+		"usr/share/man/man1",
+		"usr/lib/foo/plugins",
+		"var/lib/foo",
+		"var/cache/foo",
+		"var/log/foo",
+		"etc/foo.d",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0o755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "foo"), []byte("foo"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "var", "log", "foo", ".keep"), nil, 0o644))
+	require.NoError(t, os.Symlink("../../var/lib/foo", filepath.Join(dir, "usr", "lib", "foo", "state")))
+
+	require.NoError(t, pruneEmptyDirs(ctx, "foo", dir, []string{"/var/lib/*", "etc/foo.d/"}))
+
+	got := []string{}
+	require.NoError(t, fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		got = append(got, path)
+		return err
+	}))
+	require.Equal(t, []string{
+		".",
+		"etc",
+		"etc/foo.d",
+		"usr",
+		"usr/bin",
+		"usr/bin/foo",
+		"usr/lib",
+		"usr/lib/foo",
+		"usr/lib/foo/state",
+		"var",
+		"var/lib",
+		"var/lib/foo",
+		"var/log",
+		"var/log/foo",
+		"var/log/foo/.keep",
+	}, got)
+}
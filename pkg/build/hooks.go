@@ -0,0 +1,119 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/plugin"
+)
+
+// HookContext describes the build or the package a hook is run for.  Exec
+// hooks read it as JSON on their standard input.
+type HookContext struct {
+	// The point of the lifecycle the hook is run at, e.g. post-emit
+	Point string `json:"point"`
+	// The package the hook is run for: the main package for the pre-build
+	// and post-build hooks
+	Package plugin.Package `json:"package"`
+	// The build file of the package
+	ConfigFile string `json:"config-file"`
+	// The directory holding the contents of the package, for the pre-emit
+	// and post-emit hooks
+	Path string `json:"path,omitempty"`
+	// The apk which was written, for the post-emit hooks
+	APK string `json:"apk,omitempty"`
+	// The error the build failed with, for the post-build hooks
+	Error string `json:"error,omitempty"`
+}
+
+// Hook is run at points of the lifecycle of builds, e.g. to scan, upload or
+// notify about their packages.  An error fails the build, unless it already
+// failed.
+type Hook interface {
+	Run(ctx context.Context, hc HookContext) error
+}
+
+// HookFunc is a function which is a Hook.
+type HookFunc func(ctx context.Context, hc HookContext) error
+
+func (f HookFunc) Run(ctx context.Context, hc HookContext) error {
+	return f(ctx, hc)
+}
+
+// ExecHook is a Hook which runs Command with sh -c on the host, with the
+// HookContext as JSON on its standard input and the point it is run at in
+// $MELANGE_HOOK.  Its output is logged.
+type ExecHook struct {
+	Command string
+}
+
+func (h ExecHook) Run(ctx context.Context, hc HookContext) error {
+	log := clog.FromContext(ctx)
+
+	in, err := json.Marshal(hc)
+	if err != nil {
+		return fmt.Errorf("encoding hook context: %w", err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = append(os.Environ(), "MELANGE_HOOK="+hc.Point)
+
+	log.Infof("running %s hook %q", hc.Point, h.Command)
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line != "" {
+			log.Infof("%s hook: %s", hc.Point, line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("running %s hook %q: %w", hc.Point, h.Command, err)
+	}
+
+	return nil
+}
+
+// hookContext returns the context of the hooks run at point for pkgName.
+func (b *Build) hookContext(point, pkgName string) HookContext {
+	return HookContext{
+		Point:      point,
+		Package:    b.pluginRequest(pkgName).Package,
+		ConfigFile: b.ConfigFile,
+	}
+}
+
+// runHooks runs the hooks of the point of hc in turn, stopping at the first
+// which fails.
+func (b *Build) runHooks(ctx context.Context, hc HookContext) error {
+	for _, h := range b.hooks[hc.Point] {
+		if err := h.Run(ctx, hc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestExecHook(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	b := &Build{
+		Arch:       apko_types.ParseArchitecture("x86_64"),
+		ConfigFile: "hello.yaml",
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0", Epoch: 2},
+		},
+	}
+	hc := b.hookContext(config.HookPostEmit, "hello-dev")
+	hc.APK = "packages/x86_64/hello-dev-1.0-r2.apk"
+
+	out := filepath.Join(t.TempDir(), "context.json")
+	require.NoError(t, ExecHook{Command: `cat > ` + out + ` && test "$MELANGE_HOOK" = post-emit`}.Run(ctx, hc))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	got := HookContext{}
+	require.NoError(t, json.Unmarshal(data, &got))
+	require.Equal(t, hc, got)
+	require.Equal(t, "hello", got.Package.Origin)
+
+	err = ExecHook{Command: "echo scanning; exit 3"}.Run(ctx, hc)
+	require.ErrorContains(t, err, `running post-emit hook "echo scanning; exit 3": exit status 3`)
+}
+
+func TestRunHooks(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	ran := []string{}
+	record := func(name string, err error) Hook {
+		return HookFunc(func(_ context.Context, hc HookContext) error {
+			ran = append(ran, name+":"+hc.Point)
+			return err
+		})
+	}
+
+	b := &Build{hooks: map[string][]Hook{}}
+	require.NoError(t, WithHook(config.HookPreBuild, record("first", nil))(b))
+	require.NoError(t, WithHook(config.HookPreBuild, record("second", errors.New("denied")))(b))
+	require.NoError(t, WithHook(config.HookPreBuild, record("third", nil))(b))
+	require.NoError(t, WithHook(config.HookPostBuild, record("post", nil))(b))
+	require.ErrorContains(t, WithHook("post-upload", record("upload", nil))(b), `hook point "post-upload" must be one of`)
+
+	require.ErrorContains(t, b.runHooks(ctx, HookContext{Point: config.HookPreBuild}), "denied")
+	require.NoError(t, b.runHooks(ctx, HookContext{Point: config.HookPreEmit}))
+	require.Equal(t, []string{"first:pre-build", "second:pre-build"}, ran)
+}
@@ -0,0 +1,236 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// KeptEnvironment describes the build environment and the workspace which a
+// failed build kept with --keep-workspace, for them to be exported.
+type KeptEnvironment struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+	// The root filesystem of the build environment
+	GuestDir string `json:"guestDir"`
+	// The workspace, mounted at /home/build
+	WorkspaceDir string `json:"workspaceDir"`
+	// The environment variables of the pipelines, without the secrets
+	Environment map[string]string `json:"environment,omitempty"`
+	// Why the build failed
+	Error string `json:"error"`
+}
+
+// keptEnvironmentPath returns where the description of a kept environment
+// is written.  It is next to the workspace, like the checkpoint.
+func keptEnvironmentPath(workspaceDir string) string {
+	return workspaceDir + ".env.json"
+}
+
+// keepEnvironment keeps the build environment and the workspace of a failed
+// build from being removed, and describes them next to the workspace.
+func (b *Build) keepEnvironment(ctx context.Context, buildErr error) error {
+	env := map[string]string{}
+	if b.containerConfig != nil {
+		for k, v := range b.containerConfig.Environment {
+			if _, ok := b.secrets[k]; !ok {
+				env[k] = v
+			}
+		}
+	}
+
+	kept := KeptEnvironment{
+		Package:      b.Configuration.Package.Name,
+		Version:      fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch),
+		Arch:         b.Arch.ToAPK(),
+		GuestDir:     b.GuestDir,
+		WorkspaceDir: b.WorkspaceDir,
+		Environment:  env,
+		Error:        b.mask(buildErr.Error()),
+	}
+
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := keptEnvironmentPath(b.WorkspaceDir)
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		return fmt.Errorf("describing the kept environment: %w", err)
+	}
+	b.kept = true
+
+	clog.FromContext(ctx).Infof("keeping the build environment %s and the workspace %s; export them with: melange env export %s", b.GuestDir, b.WorkspaceDir, p)
+
+	return nil
+}
+
+// ReadKeptEnvironment reads the description of a kept environment, at p or
+// next to the workspace p.
+func ReadKeptEnvironment(p string) (*KeptEnvironment, error) {
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		p = keptEnvironmentPath(strings.TrimSuffix(p, string(filepath.Separator)))
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("reading kept environment: %w", err)
+	}
+
+	kept := &KeptEnvironment{}
+	if err := json.Unmarshal(data, kept); err != nil {
+		return nil, fmt.Errorf("parsing kept environment %s: %w", p, err)
+	}
+
+	return kept, nil
+}
+
+// Image returns the kept environment as an image for the architecture of
+// the build, whose layers are the build environment and the workspace at
+// /home/build, and which runs a shell in the workspace with the environment
+// of the pipelines.
+func (k *KeptEnvironment) Image(ctx context.Context) (v1.Image, error) {
+	log := clog.FromContext(ctx)
+
+	guest, err := dirLayer(k.GuestDir, "")
+	if err != nil {
+		return nil, fmt.Errorf("archiving the build environment: %w", err)
+	}
+	workspace, err := dirLayer(k.WorkspaceDir, "home/build")
+	if err != nil {
+		return nil, fmt.Errorf("archiving the workspace: %w", err)
+	}
+
+	env := []string{}
+	for name, value := range k.Environment {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	platform := apko_types.ParseArchitecture(k.Arch).ToOCIPlatform()
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+		OS:           platform.OS,
+		Architecture: platform.Architecture,
+		Variant:      platform.Variant,
+		Config: v1.Config{
+			Env:        env,
+			WorkingDir: "/home/build",
+			Cmd:        []string{"/bin/sh"},
+			Labels: map[string]string{
+				"dev.chainguard.melange.package": k.Package,
+				"dev.chainguard.melange.version": k.Version,
+				"dev.chainguard.melange.error":   k.Error,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("snapshotting %s and %s", k.GuestDir, k.WorkspaceDir)
+	return mutate.AppendLayers(img, guest, workspace)
+}
+
+// dirLayer returns a layer of the files of dir, under prefix.
+func dirLayer(dir, prefix string) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeDirTar(pw, dir, prefix))
+		}()
+		return pr, nil
+	})
+}
+
+// writeDirTar writes the files of dir to w as a tar archive, under prefix.
+func writeDirTar(w io.Writer, dir, prefix string) error {
+	tw := tar.NewWriter(w)
+
+	if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if name == "." || name == "" {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// Sockets and the like only live as long as the build.
+		if !fi.Mode().IsRegular() && !fi.IsDir() && fi.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+func TestKeepEnvironment(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	guest := filepath.Join(dir, "melange-guest-1")
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "usr", "bin"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "home", "build"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(guest, "usr", "bin", "make"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.Symlink("make", filepath.Join(guest, "usr", "bin", "gmake")))
+
+	workspace := filepath.Join(dir, "melange-workspace-1")
+	require.NoError(t, os.MkdirAll(filepath.Join(workspace, "src"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(workspace, "src", "config.log"), []byte("checking for gcc... no\n"), 0o644))
+
+	b := &Build{
+		Configuration: config.Configuration{Package: config.Package{Name: "foo", Version: "1.2.3", Epoch: 1}},
+		Arch:          apko_types.ParseArchitecture("arm64"),
+		GuestDir:      guest,
+		WorkspaceDir:  workspace,
+		containerConfig: &container.Config{Environment: map[string]string{
+			"CFLAGS":       "-O2",
+			"GITHUB_TOKEN": "ghp_abc",
+		}},
+	}
+	require.NoError(t, WithSecret("GITHUB_TOKEN", "ghp_abc")(b))
+	ctx = b.maskSecrets(ctx)
+
+	require.NoError(t, b.keepEnvironment(ctx, errors.New("fetching with ghp_abc: exit status 1")))
+	require.True(t, b.kept)
+
+	k, err := ReadKeptEnvironment(workspace + "/")
+	require.NoError(t, err)
+	require.Equal(t, &KeptEnvironment{
+		Package:      "foo",
+		Version:      "1.2.3-r1",
+		Arch:         "aarch64",
+		GuestDir:     guest,
+		WorkspaceDir: workspace,
+		Environment:  map[string]string{"CFLAGS": "-O2"},
+		Error:        "fetching with ***: exit status 1",
+	}, k)
+
+	img, err := k.Image(ctx)
+	require.NoError(t, err)
+
+	cf, err := img.ConfigFile()
+	require.NoError(t, err)
+	require.Equal(t, "arm64", cf.Architecture)
+	require.Equal(t, []string{"CFLAGS=-O2"}, cf.Config.Env)
+	require.Equal(t, "/home/build", cf.Config.WorkingDir)
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+
+	files := func(i int) map[string]string {
+		rc, err := layers[i].Uncompressed()
+		require.NoError(t, err)
+		defer rc.Close()
+
+		files := map[string]string{}
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(data) + hdr.Linkname
+		}
+		return files
+	}
+	require.Equal(t, map[string]string{
+		"home/":         "",
+		"home/build/":   "",
+		"usr/":          "",
+		"usr/bin/":      "",
+		"usr/bin/gmake": "make",
+		"usr/bin/make":  "#!/bin/sh\n",
+	}, files(0))
+	require.Equal(t, map[string]string{
+		"home/build/":               "",
+		"home/build/src/":           "",
+		"home/build/src/config.log": "checking for gcc... no\n",
+	}, files(1))
+}
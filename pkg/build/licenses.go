@@ -0,0 +1,193 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/github/go-spdx/v2/spdxexp"
+
+	"chainguard.dev/melange/pkg/license"
+)
+
+// licenseSkipDirs are the directories of the workspace which hold the
+// licenses of other projects, or no sources.
+var licenseSkipDirs = []string{"melange-out", "vendor", "node_modules", "third_party", "third-party"}
+
+// findLicenseFiles returns the license files at the top of the workspace,
+// and at the top of its directories, e.g. sources fetched into a
+// subdirectory, relative to the workspace.
+func findLicenseFiles(workspaceDir string) ([]string, error) {
+	files := []string{}
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := os.ReadDir(filepath.Join(workspaceDir, dir))
+		if err != nil {
+			return err
+		}
+		for _, ent := range entries {
+			name := ent.Name()
+			switch {
+			case ent.IsDir():
+				if depth == 0 && !strings.HasPrefix(name, ".") && !slices.Contains(licenseSkipDirs, name) {
+					if err := walk(filepath.Join(dir, name), depth+1); err != nil {
+						return err
+					}
+				}
+			case ent.Type().IsRegular() && license.IsFile(name):
+				files = append(files, filepath.Join(dir, name))
+			}
+		}
+		return nil
+	}
+
+	if err := walk(".", 0); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// installLicenses checks the license files of the workspace against the
+// license of the package, and installs them in usr/share/licenses/NAME of
+// the -doc subpackage, or of the package if it has none, unless the
+// pipelines installed licenses there already.  It warns when no package
+// ships the text of the license.
+func (b *Build) installLicenses(ctx context.Context) error {
+	log := clog.FromContext(ctx).With(b.annotationsAt(b.Configuration.Package.Name)...)
+	pkg := &b.Configuration.Package
+
+	if b.IsBuildLess() || pkg.Options.NoLicenseFiles {
+		return nil
+	}
+
+	files, err := findLicenseFiles(b.WorkspaceDir)
+	if err != nil {
+		return fmt.Errorf("finding license files: %w", err)
+	}
+
+	declared := []string{}
+	if expr := pkg.LicenseExpression(); expr != "" {
+		if ids, err := spdxexp.ExtractLicenses(expr); err == nil {
+			declared = ids
+		}
+	}
+
+	for _, file := range files {
+		text, err := os.ReadFile(filepath.Join(b.WorkspaceDir, file))
+		if err != nil {
+			return err
+		}
+
+		ids := license.Classify(text)
+		if len(ids) == 0 || len(declared) == 0 {
+			continue
+		}
+		if !slices.ContainsFunc(ids, func(id string) bool {
+			return slices.ContainsFunc(declared, func(d string) bool { return license.Matches(id, d) })
+		}) {
+			log.Warnf("%s looks like %s, but the package declares %s", file, strings.Join(ids, " and "), pkg.LicenseExpression())
+		}
+	}
+
+	target := pkg.Name
+	for _, sp := range b.Configuration.Subpackages {
+		if sp.Name == pkg.Name+"-doc" {
+			target = sp.Name
+		}
+	}
+
+	fsys, err := b.workspaceFS(target)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.Stat(path.Join("usr/share/licenses", pkg.Name)); err == nil {
+		log.Infof("not installing license files, as %s installed its own", target)
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// The license files are added to the package, which may be on a
+	// WorkspaceFS, in the melange-out directory of the workspace.
+	licenseDir := filepath.Join(b.WorkspaceDir, "melange-out", target, "usr", "share", "licenses", pkg.Name)
+
+	if len(files) == 0 {
+		if pkg.LicenseExpression() != "" && !b.shipsLicense() {
+			log.Warnf("%s declares the license %s, but ships no license text", pkg.Name, pkg.LicenseExpression())
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(licenseDir, 0o755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		text, err := os.ReadFile(filepath.Join(b.WorkspaceDir, file))
+		if err != nil {
+			return err
+		}
+
+		// Licenses from subdirectories keep the directory in their name.
+		name := strings.ReplaceAll(filepath.ToSlash(file), "/", "-")
+		if err := os.WriteFile(filepath.Join(licenseDir, name), text, 0o644); err != nil {
+			return fmt.Errorf("installing %s: %w", file, err)
+		}
+	}
+	log.Infof("installed %d license files in %s", len(files), target)
+
+	return nil
+}
+
+// shipsLicense returns whether a package of the build ships a license file.
+func (b *Build) shipsLicense() bool {
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	for _, name := range names {
+		fsys, err := b.workspaceFS(name)
+		if err != nil {
+			continue
+		}
+
+		found := false
+		_ = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !d.IsDir() && (license.IsFile(d.Name()) || strings.HasPrefix(p, "usr/share/licenses/")) {
+				found = true
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func licenseBuild(t *testing.T, subpackages ...string) *Build {
+	t.Helper()
+	b := &Build{
+		WorkspaceDir: t.TempDir(),
+		Configuration: config.Configuration{
+			Package: config.Package{
+				Name:      "hello",
+				Copyright: []config.Copyright{{License: "MIT"}},
+			},
+			Pipeline: []config.Pipeline{{Runs: "make"}},
+		},
+	}
+	for _, sp := range subpackages {
+		b.Configuration.Subpackages = append(b.Configuration.Subpackages, config.Subpackage{Name: sp})
+	}
+	return b
+}
+
+func TestFindLicenseFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir,
+		"LICENSE",
+		"README.md",
+		"lib/COPYING",
+		"lib/src/LICENSE",
+		"vendor/foo/LICENSE",
+		".git/LICENSE",
+		"melange-out/hello/LICENSE",
+	)
+
+	files, err := findLicenseFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"LICENSE", "lib/COPYING"}, files)
+}
+
+func TestInstallLicenses(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	t.Run("doc subpackage", func(t *testing.T) {
+		b := licenseBuild(t, "hello-dev", "hello-doc")
+		writeTree(t, b.WorkspaceDir, "LICENSE", "lib/COPYING")
+		require.NoError(t, b.installLicenses(ctx))
+
+		licenseDir := filepath.Join(b.WorkspaceDir, "melange-out", "hello-doc", "usr", "share", "licenses", "hello")
+		entries, err := os.ReadDir(licenseDir)
+		require.NoError(t, err)
+		names := []string{}
+		for _, ent := range entries {
+			names = append(names, ent.Name())
+		}
+		require.Equal(t, []string{"LICENSE", "lib-COPYING"}, names)
+
+		text, err := os.ReadFile(filepath.Join(licenseDir, "lib-COPYING"))
+		require.NoError(t, err)
+		require.Equal(t, "lib/COPYING", string(text))
+	})
+
+	t.Run("main package", func(t *testing.T) {
+		b := licenseBuild(t, "hello-dev")
+		writeTree(t, b.WorkspaceDir, "COPYING")
+		require.NoError(t, b.installLicenses(ctx))
+		require.FileExists(t, filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "licenses", "hello", "COPYING"))
+	})
+
+	t.Run("installed by the pipelines", func(t *testing.T) {
+		b := licenseBuild(t)
+		writeTree(t, b.WorkspaceDir, "LICENSE", "melange-out/hello/usr/share/licenses/hello/LICENSE.txt")
+		require.NoError(t, b.installLicenses(ctx))
+		require.NoFileExists(t, filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "licenses", "hello", "LICENSE"))
+	})
+
+	t.Run("no-license-files", func(t *testing.T) {
+		b := licenseBuild(t)
+		b.Configuration.Package.Options.NoLicenseFiles = true
+		writeTree(t, b.WorkspaceDir, "LICENSE")
+		require.NoError(t, b.installLicenses(ctx))
+		require.NoDirExists(t, filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "licenses"))
+	})
+
+	t.Run("no license files", func(t *testing.T) {
+		b := licenseBuild(t)
+		require.NoError(t, b.installLicenses(ctx))
+		require.NoDirExists(t, filepath.Join(b.WorkspaceDir, "melange-out", "hello", "usr", "share", "licenses"))
+	})
+}
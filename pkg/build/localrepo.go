@@ -0,0 +1,75 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// localRepository indexes the packages of the architecture of the build in
+// OutDir, and returns the repository they make: the absolute path of
+// OutDir, which is mounted at the same path in the guest, so that both apko
+// on the host and the steps of any runner can install from it, without the
+// network.
+func (b *Build) localRepository(ctx context.Context) (string, error) {
+	dir, err := filepath.Abs(b.OutDir)
+	if err != nil {
+		return "", err
+	}
+
+	packageDir := filepath.Join(dir, b.Arch.ToAPK())
+	if err := os.MkdirAll(packageDir, 0o755); err != nil {
+		return "", err
+	}
+
+	clog.FromContext(ctx).Infof("indexing %s as a repository of the build environment", packageDir)
+	idx, err := index.New(
+		index.WithPackageDir(packageDir),
+		index.WithSigningKey(b.SigningKey),
+		index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+		index.WithExpectedArch(b.Arch.ToAPK()),
+	)
+	if err != nil {
+		return "", err
+	}
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return "", fmt.Errorf("indexing %s: %w", packageDir, err)
+	}
+
+	return dir, nil
+}
+
+// localRepositoryMounts returns the mount of the repository of
+// localRepository into the guest.
+func (b *Build) localRepositoryMounts() []container.BindMount {
+	if !b.ServeRepository {
+		return nil
+	}
+
+	dir, err := filepath.Abs(b.OutDir)
+	if err != nil {
+		return nil
+	}
+
+	return []container.BindMount{{Source: dir, Destination: dir, ReadOnly: true}}
+}
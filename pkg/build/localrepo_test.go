@@ -0,0 +1,93 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+func TestLocalRepository(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	privPath, pubPath := writeTestKeypair(t, t.TempDir(), "local.rsa")
+
+	out := t.TempDir()
+	archDir := filepath.Join(out, "aarch64")
+	require.NoError(t, os.MkdirAll(archDir, 0o755))
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(archDir, "libcap-2.69-r0.apk"), data, 0o644))
+
+	// A runner which does not share the filesystem or the network of the
+	// host, like docker or kubernetes.
+	b := &Build{
+		Configuration: config.Configuration{
+			Package:  config.Package{Name: "foo", Version: "1.0"},
+			Pipeline: []config.Pipeline{{Runs: "apk add libcap"}},
+		},
+		Arch:            apko_types.ParseArchitecture("aarch64"),
+		OutDir:          out,
+		WorkspaceDir:    t.TempDir(),
+		GuestDir:        t.TempDir(),
+		SigningKey:      privPath,
+		ServeRepository: true,
+		Runner:          fakeRunner{},
+	}
+
+	repo, err := b.localRepository(ctx)
+	require.NoError(t, err)
+	require.Equal(t, out, repo)
+
+	f, err := os.Open(filepath.Join(archDir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	idx, err := apk.IndexFromArchive(f)
+	require.NoError(t, err)
+	require.Len(t, idx.Packages, 1)
+	require.Equal(t, "libcap", idx.Packages[0].Name)
+
+	// The repository is a path rather than a URL, which apko reads on the
+	// host, and the index is signed by the key the guest trusts.
+	b.Configuration.Environment.Contents.Repositories = []string{repo}
+	b.ExtraKeys = []string{pubPath}
+	_, err = b.verifyRepositories(ctx)
+	require.NoError(t, err)
+
+	// The guest has the repository at the same path, read-only.
+	cfg := b.buildWorkspaceConfig(ctx)
+	require.Contains(t, cfg.Mounts, container.BindMount{Source: out, Destination: out, ReadOnly: true})
+
+	b.ServeRepository = false
+	cfg = b.buildWorkspaceConfig(ctx)
+	for _, m := range cfg.Mounts {
+		require.NotEqual(t, out, m.Source)
+	}
+
+	// An architecture without packages has an empty index.
+	b.ServeRepository = true
+	b.Arch = apko_types.ParseArchitecture("x86_64")
+	_, err = b.localRepository(ctx)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(out, "x86_64", "APKINDEX.tar.gz"))
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned when a file or directory is locked by another build.
+var ErrLocked = errors.New("in use by another build")
+
+// fileLock is an advisory flock(2) lock on a file or directory.  The kernel
+// releases it when the process exits, so the locks of crashed builds never
+// go stale: anything melange creates which is not locked is debris.
+type fileLock struct {
+	f *os.File
+}
+
+// tryLock takes an exclusive lock on path without waiting.  It returns
+// ErrLocked if the lock is held elsewhere.
+func tryLock(path string) (*fileLock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+// lockBeside takes an exclusive lock on a lock file next to dir, named
+// after it, without waiting.  Unlike a lock on dir itself, it survives dir
+// being removed and created again.
+func lockBeside(dir string) (*fileLock, error) {
+	path := dir + ".lock"
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	return l, nil
+}
+
+// lockFile takes an exclusive lock on f without waiting.  The lock is
+// released when f is closed.
+func lockFile(f *os.File) (*fileLock, error) {
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// lockedTempDir creates a temporary directory like os.MkdirTemp, named
+// after the pattern with lockedPrefix, locked until the lock is released so
+// that cleaning up leaves it alone.
+func lockedTempDir(dir, pattern string) (string, *fileLock, error) {
+	path, err := os.MkdirTemp(dir, lockedPrefix+pattern)
+	if err != nil {
+		return "", nil, err
+	}
+
+	l, err := tryLock(path)
+	if err != nil {
+		os.RemoveAll(path)
+		return "", nil, err
+	}
+
+	return path, l, nil
+}
+
+// unlockAll releases the locks.
+func unlockAll(locks []*fileLock) error {
+	errs := []error{}
+	for _, l := range locks {
+		errs = append(errs, l.Unlock())
+	}
+
+	return errors.Join(errs...)
+}
+
+// lockedTempFile creates a temporary file like os.CreateTemp, locked until
+// it is closed so that cleaning up leaves it alone.
+func lockedTempFile(dir, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := lockFile(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("locking %s: %w", f.Name(), err)
+	}
+
+	return f, nil
+}
+
+// syncDir flushes the entries of dir to disk, such as a file renamed into
+// it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
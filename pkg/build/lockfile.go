@@ -0,0 +1,206 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+
+	"chainguard.dev/melange/pkg/util"
+)
+
+// Lockfile records the exact versions of the packages which were installed
+// in the build environment of each architecture, so that a build can be
+// repeated with them against repositories which have moved on.
+type Lockfile struct {
+	// The packages installed in the build environment, by architecture
+	Environment map[string][]LockedPackage `json:"environment"`
+}
+
+// LockedPackage is a package installed in the build environment.
+type LockedPackage struct {
+	// The name of the package
+	Name string `json:"name"`
+	// The version of the package, including its epoch
+	Version string `json:"version"`
+}
+
+// lockfileMu serializes the updates of lockfiles by the builds of several
+// architectures, which share the lockfile of their configuration.
+var lockfileMu sync.Mutex
+
+// LockfilePath returns the path of the lockfile of the configuration file
+// at configFile, which is next to it, e.g. foo.lock.json for foo.yaml.
+func LockfilePath(configFile string) string {
+	return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".lock.json"
+}
+
+// readLockfile reads the lockfile at path, which is empty if there is none.
+func readLockfile(path string) (*Lockfile, error) {
+	lf := &Lockfile{Environment: map[string][]LockedPackage{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lf, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, lf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if lf.Environment == nil {
+		lf.Environment = map[string][]LockedPackage{}
+	}
+
+	return lf, nil
+}
+
+// writeLockfile records pkgs as the build environment of arch in the
+// lockfile at path, leaving the ones of the other architectures alone.
+func writeLockfile(path, arch string, pkgs []LockedPackage) error {
+	lockfileMu.Lock()
+	defer lockfileMu.Unlock()
+
+	lf, err := readLockfile(path)
+	if err != nil {
+		return err
+	}
+	lf.Environment[arch] = pkgs
+
+	data, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The lockfile is written beside its final name and renamed, so that
+	// it is never read partially written.
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// installedPackages returns the packages installed in the guest, sorted by
+// name.
+func (b *Build) installedPackages() ([]LockedPackage, error) {
+	f, err := os.Open(filepath.Join(b.GuestDir, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return nil, fmt.Errorf("reading installed packages: %w", err)
+	}
+	defer f.Close()
+
+	installed, err := apk.ParsePackageIndex(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing installed packages: %w", err)
+	}
+
+	pkgs := make([]LockedPackage, 0, len(installed))
+	for _, pkg := range installed {
+		pkgs = append(pkgs, LockedPackage{Name: pkg.Name, Version: pkg.Version})
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+
+	return pkgs, nil
+}
+
+// lockedEnvironment returns env with its packages replaced by the ones
+// locked for the architecture of the build, each pinned to its version, and
+// the locked packages.  The lockfile must lock every package env asks for,
+// so that a dependency added to the configuration since it was written is
+// not silently left out.
+func (b *Build) lockedEnvironment(env apko_types.ImageConfiguration) (apko_types.ImageConfiguration, []LockedPackage, error) {
+	path := LockfilePath(b.ConfigFile)
+	lf, err := readLockfile(path)
+	if err != nil {
+		return env, nil, err
+	}
+	locked, ok := lf.Environment[b.Arch.ToAPK()]
+	if !ok {
+		return env, nil, fmt.Errorf("%s locks no build environment for %s", path, b.Arch.ToAPK())
+	}
+
+	names := map[string]bool{}
+	packages := make([]string, 0, len(locked))
+	for _, pkg := range locked {
+		names[pkg.Name] = true
+		packages = append(packages, pkg.Name+"="+pkg.Version)
+	}
+
+	for _, want := range env.Contents.Packages {
+		name, _, _ := strings.Cut(want, "@")
+		name = util.DependencyName(name)
+		if !names[name] {
+			return env, nil, fmt.Errorf("%s does not lock %s, which the build environment installs: build without --locked to update it", path, name)
+		}
+	}
+
+	env.Contents.Packages = packages
+	return env, locked, nil
+}
+
+// checkLocked checks that the guest has exactly the packages which were
+// locked.
+func checkLocked(locked, installed []LockedPackage) error {
+	want := map[string]string{}
+	for _, pkg := range locked {
+		want[pkg.Name] = pkg.Version
+	}
+
+	errs := []error{}
+	for _, pkg := range installed {
+		version, ok := want[pkg.Name]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s-%s was installed but is not locked", pkg.Name, pkg.Version))
+		case version != pkg.Version:
+			errs = append(errs, fmt.Errorf("%s-%s was installed instead of the locked %s", pkg.Name, pkg.Version, version))
+		}
+		delete(want, pkg.Name)
+	}
+	missing := make([]string, 0, len(want))
+	for name := range want {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		errs = append(errs, fmt.Errorf("%s-%s is locked but was not installed", name, want[name]))
+	}
+
+	return errors.Join(errs...)
+}
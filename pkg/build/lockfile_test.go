@@ -0,0 +1,78 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockfilePath(t *testing.T) {
+	require.Equal(t, "/src/foo.lock.json", LockfilePath("/src/foo.yaml"))
+	require.Equal(t, "foo.lock.json", LockfilePath("foo.yml"))
+	require.Equal(t, ".melange.lock.json", LockfilePath(".melange.yaml"))
+}
+
+func TestLockedBuild(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "foo.yaml")
+	path := LockfilePath(configFile)
+
+	busybox := LockedPackage{Name: "busybox", Version: "1.36.1-r5"}
+	gcc := LockedPackage{Name: "gcc", Version: "13.2.0-r3"}
+	gccArm := LockedPackage{Name: "gcc", Version: "13.2.0-r4"}
+
+	// The builds of each architecture record their own environment.
+	require.NoError(t, writeLockfile(path, "x86_64", []LockedPackage{busybox, gcc}))
+	require.NoError(t, writeLockfile(path, "aarch64", []LockedPackage{busybox, gccArm}))
+
+	lf, err := readLockfile(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]LockedPackage{
+		"x86_64":  {busybox, gcc},
+		"aarch64": {busybox, gccArm},
+	}, lf.Environment)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	b := &Build{ConfigFile: configFile, Arch: apko_types.ParseArchitecture("aarch64")}
+	env := apko_types.ImageConfiguration{}
+	env.Contents.Packages = []string{"busybox", "gcc>13"}
+
+	locked, pkgs, err := b.lockedEnvironment(env)
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox=1.36.1-r5", "gcc=13.2.0-r4"}, locked.Contents.Packages)
+	require.Equal(t, []string{"busybox", "gcc>13"}, env.Contents.Packages)
+
+	require.NoError(t, checkLocked(pkgs, []LockedPackage{busybox, gccArm}))
+	require.ErrorContains(t, checkLocked(pkgs, []LockedPackage{busybox, gcc}), "gcc-13.2.0-r3 was installed instead of the locked 13.2.0-r4")
+	require.ErrorContains(t, checkLocked(pkgs, []LockedPackage{busybox}), "gcc-13.2.0-r4 is locked but was not installed")
+
+	// A package added to the configuration since the lockfile was written
+	// must be locked first.
+	env.Contents.Packages = append(env.Contents.Packages, "make")
+	_, _, err = b.lockedEnvironment(env)
+	require.ErrorContains(t, err, "does not lock make")
+
+	b.Arch = apko_types.ParseArchitecture("riscv64")
+	_, _, err = b.lockedEnvironment(env)
+	require.ErrorContains(t, err, "locks no build environment for riscv64")
+}
@@ -17,9 +17,12 @@ package build
 import (
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
 )
 
@@ -41,15 +44,198 @@ func WithFailOnLintWarning(fail bool) Option {
 	}
 }
 
+// WithFailOnUnresolvedLibs sets whether or not to fail when a generated
+// shared library dependency is not provided by any package in the build or
+// the build environment.
+func WithFailOnUnresolvedLibs(fail bool) Option {
+	return func(b *Build) error {
+		b.FailOnUnresolvedLibs = fail
+		return nil
+	}
+}
+
+// WithFailOnUnknownLicense sets whether or not to fail when a license of the
+// package is not a valid SPDX license expression.
+func WithFailOnUnknownLicense(fail bool) Option {
+	return func(b *Build) error {
+		b.FailOnUnknownLicense = fail
+		return nil
+	}
+}
+
+// WithStrict sets whether or not to enable all checks which turn warnings
+// into failures, i.e. failing on linter warnings, unresolved shared library
+// dependencies and unknown licenses.
+func WithStrict(strict bool) Option {
+	return func(b *Build) error {
+		b.Strict = strict
+		return nil
+	}
+}
+
+// WithPluginDirs sets the directories which are searched for plugin
+// executables.
+func WithPluginDirs(dirs []string) Option {
+	return func(b *Build) error {
+		b.PluginDirs = dirs
+		return nil
+	}
+}
+
+// WithHook adds a hook which is run at point, one of config.HookPoints.
+func WithHook(point string, h Hook) Option {
+	return func(b *Build) error {
+		if !slices.Contains(config.HookPoints, point) {
+			return fmt.Errorf("hook point %q must be one of %s", point, strings.Join(config.HookPoints, ", "))
+		}
+		b.hooks[point] = append(b.hooks[point], h)
+		return nil
+	}
+}
+
+// WithConfigHooks sets whether the hooks declared in the build file are run.
+func WithConfigHooks(configHooks bool) Option {
+	return func(b *Build) error {
+		b.ConfigHooks = configHooks
+		return nil
+	}
+}
+
+// WithPublish sets the URLs of the remote repositories the packages are
+// uploaded to after a successful build: s3://bucket/path, gs://bucket/path
+// or oci://registry/repository.
+func WithPublish(urls []string) Option {
+	return func(b *Build) error {
+		b.Publish = urls
+		return nil
+	}
+}
+
+// WithPublishDryRun logs what would be published instead of uploading it.
+func WithPublishDryRun(dryRun bool) Option {
+	return func(b *Build) error {
+		b.PublishDryRun = dryRun
+		return nil
+	}
+}
+
+// WithArtifactRepository sets the OCI repository each package is pushed to
+// as an artifact after a successful build, with its SBOM and attestation
+// attached.
+func WithArtifactRepository(repo string) Option {
+	return func(b *Build) error {
+		b.ArtifactRepository = repo
+		return nil
+	}
+}
+
+// WithChecksums sets whether the SHA-256 digests of the packages, the index
+// and the reports of the build are added to the SHA256SUMS file beside the
+// packages.
+func WithChecksums(checksums bool) Option {
+	return func(b *Build) error {
+		b.Checksums = checksums
+		return nil
+	}
+}
+
+// WithFileDigests sets whether the control section of the packages lists
+// the SHA-256 digests of their files.
+func WithFileDigests(fileDigests bool) Option {
+	return func(b *Build) error {
+		b.FileDigests = fileDigests
+		return nil
+	}
+}
+
+// WithControlTemplate sets the path of a template replacing the one of the
+// .PKGINFO of the packages.  It is executed with the PackageBuild of each
+// package.
+func WithControlTemplate(path string) Option {
+	return func(b *Build) error {
+		b.ControlTemplate = path
+		return nil
+	}
+}
+
+// WithLocked sets whether the build environment is installed with exactly
+// the versions of the packages recorded in the lockfile next to the
+// configuration file, rather than recording them there.
+func WithLocked(locked bool) Option {
+	return func(b *Build) error {
+		b.Locked = locked
+		return nil
+	}
+}
+
+// WithScanner sets the vulnerability scanner, grype or trivy, which is run
+// over the build environment and the emitted packages.
+func WithScanner(tool string) Option {
+	return func(b *Build) error {
+		b.Scanner = tool
+		return nil
+	}
+}
+
+// WithScanFailOn sets the severity from which the vulnerabilities the
+// scanner finds fail the build.  They are only logged if it is empty.
+func WithScanFailOn(severity string) Option {
+	return func(b *Build) error {
+		b.ScanFailOn = severity
+		return nil
+	}
+}
+
+// WithProxy sets the URL of the HTTP(S) proxy used by melange and by the
+// build environment.
+func WithProxy(proxy string) Option {
+	return func(b *Build) error {
+		b.Proxy = proxy
+		return nil
+	}
+}
+
+// WithNoProxy sets the hosts, domains and networks reached without the proxy.
+func WithNoProxy(noProxy []string) Option {
+	return func(b *Build) error {
+		b.NoProxy = noProxy
+		return nil
+	}
+}
+
+// WithCACertificates adds PEM files of certificates to those trusted by
+// melange and by the build environment.
+func WithCACertificates(paths []string) Option {
+	return func(b *Build) error {
+		b.CACertificates = paths
+		return nil
+	}
+}
+
+// WithSecret gives the build the value of the secret name, which the build
+// file must declare.  See ParseSecret for reading it from the environment or
+// a file.
+func WithSecret(name, value string) Option {
+	return func(b *Build) error {
+		if b.secrets == nil {
+			b.secrets = map[string]string{}
+		}
+		b.secrets[name] = value
+		return nil
+	}
+}
+
 // WithBuildDate sets the timestamps for the build context.
 // The string is parsed according to RFC3339.
-// An empty string is a special case and will default to
-// the unix epoch.
+// An empty string is a special case: the timestamps are those of the
+// last commit of the configuration file, or the unix epoch if it has
+// none.
 func WithBuildDate(s string) Option {
 	return func(bc *Build) error {
 		// default to 0 for reproducibility
 		if s == "" {
 			bc.SourceDateEpoch = time.Unix(0, 0)
+			bc.buildDateSet = false
 			return nil
 		}
 
@@ -59,6 +245,7 @@ func WithBuildDate(s string) Option {
 		}
 
 		bc.SourceDateEpoch = t
+		bc.buildDateSet = true
 		return nil
 	}
 }
@@ -131,6 +318,24 @@ func WithCacheSource(sourceDir string) Option {
 	}
 }
 
+// WithCompilerCacheDir sets the directory which is mounted into the build
+// environment to persist the ccache and sccache caches across builds.
+func WithCompilerCacheDir(dir string) Option {
+	return func(b *Build) error {
+		b.CompilerCacheDir = dir
+		return nil
+	}
+}
+
+// WithCacheKey sets the reference to the passphrase which the objects of the
+// cache source are encrypted with, as accepted by cachecrypt.LoadKey.
+func WithCacheKey(ref string) Option {
+	return func(b *Build) error {
+		b.CacheKey = ref
+		return nil
+	}
+}
+
 // WithSigningKey sets the signing key path to use.
 func WithSigningKey(signingKey string) Option {
 	return func(b *Build) error {
@@ -193,6 +398,62 @@ func WithDependencyLog(logFile string) Option {
 	}
 }
 
+// WithBuildReport sets a filename to write a machine-readable build report
+// to.  The report is written as YAML if the filename ends in .yaml or .yml,
+// and as JSON otherwise.
+func WithBuildReport(path string) Option {
+	return func(b *Build) error {
+		b.BuildReport = path
+		return nil
+	}
+}
+
+// WithProfile sets a filename to write a profile of the build to, in the
+// Chrome trace event format.  The architecture is inserted before the
+// extension.
+func WithProfile(path string) Option {
+	return func(b *Build) error {
+		b.Profile = path
+		return nil
+	}
+}
+
+// WithRebuildReport sets a filename to write the packages of the reference
+// repository which must be rebuilt to.  The architecture is inserted before
+// the extension.
+func WithRebuildReport(path string) Option {
+	return func(b *Build) error {
+		b.RebuildReport = path
+		return nil
+	}
+}
+
+// WithReferenceRepository sets the repository the provides of the build are
+// compared against when writing a rebuild report.  It may be a local
+// directory or an HTTP(S) URL, and must contain an APKINDEX.tar.gz for each
+// architecture.
+func WithReferenceRepository(repo string) Option {
+	return func(b *Build) error {
+		b.ReferenceRepository = repo
+		return nil
+	}
+}
+
+// WithRemovedFiles sets what to do with the files of the previous release
+// of each package in the reference repository which the build no longer
+// ships, unless the build file acknowledges them: warn or fail.
+func WithRemovedFiles(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", "warn", "fail":
+		default:
+			return fmt.Errorf("invalid removed files mode %q: must be warn or fail", mode)
+		}
+		b.RemovedFiles = mode
+		return nil
+	}
+}
+
 // WithBinShOverlay sets a filename to copy from when installing /bin/sh
 // into a build environment.
 func WithBinShOverlay(binShOverlay string) Option {
@@ -281,6 +542,15 @@ func WithDebugRunner(debug bool) Option {
 	}
 }
 
+// WithArchParallelism sets how many architectures are built at a time, or 0
+// to build all of them at once.
+func WithArchParallelism(n int) Option {
+	return func(b *Build) error {
+		b.ArchParallelism = n
+		return nil
+	}
+}
+
 // WithInteractive indicates whether to attach stdin and a tty to the runner on failures
 func WithInteractive(interactive bool) Option {
 	return func(b *Build) error {
@@ -343,6 +613,200 @@ func WithTimeout(dur time.Duration) Option {
 	}
 }
 
+// WithVerifyRepositories sets whether to verify the signatures of the
+// repositories used to build the build environment, and of the packages
+// installed from them, against the keyring.
+func WithVerifyRepositories(verify bool) Option {
+	return func(b *Build) error {
+		b.VerifyRepositories = verify
+		return nil
+	}
+}
+
+// WithServeRepository sets whether to index the output directory and add
+// it as a repository of the build environment.
+func WithServeRepository(serve bool) Option {
+	return func(b *Build) error {
+		b.ServeRepository = serve
+		return nil
+	}
+}
+
+// WithPrefetchSources sets whether to fetch the sources of the fetch steps
+// into the cache directory on the host before the build starts.
+func WithPrefetchSources(prefetch bool) Option {
+	return func(b *Build) error {
+		b.PrefetchSources = prefetch
+		return nil
+	}
+}
+
+// WithReproducibilityCheck sets whether to emit every package a second time
+// and fail unless the apks are identical.
+func WithReproducibilityCheck(check bool) Option {
+	return func(b *Build) error {
+		b.ReproducibilityCheck = check
+		return nil
+	}
+}
+
+// WithResume sets whether to skip the top-level pipeline steps which
+// completed in the workspace during a previous, failed build.
+func WithResume(resume bool) Option {
+	return func(b *Build) error {
+		b.Resume = resume
+		return nil
+	}
+}
+
+// WithKeepWorkspace sets whether to keep the build environment and the
+// workspace of a failed build, to be exported for debugging.
+func WithKeepWorkspace(keep bool) Option {
+	return func(b *Build) error {
+		b.KeepWorkspace = keep
+		return nil
+	}
+}
+
+// WithMinFreeSpace sets the space in bytes which must be left free on the
+// filesystems used by the build, on top of its estimated needs.
+func WithMinFreeSpace(bytes uint64) Option {
+	return func(b *Build) error {
+		b.MinFreeSpace = bytes
+		return nil
+	}
+}
+
+// WithMaxSparseSize sets the size in bytes above which a sparse file of a
+// package fails the build, or 0 for no limit.
+func WithMaxSparseSize(bytes uint64) Option {
+	return func(b *Build) error {
+		b.MaxSparseSize = bytes
+		return nil
+	}
+}
+
+// WithCompressionLevel sets the gzip compression level of the sections of
+// the packages, from 1 (fastest) to 9 (smallest), or 0 for the default.
+func WithCompressionLevel(level int) Option {
+	return func(b *Build) error {
+		if level < 0 || level > 9 {
+			return fmt.Errorf("compression level %d must be from 1 to 9", level)
+		}
+		b.CompressionLevel = level
+		return nil
+	}
+}
+
+// WithTarOwners sets the policy for the owners of the entries of the
+// tarballs of the emitted packages.
+func WithTarOwners(owners string) Option {
+	return func(b *Build) error {
+		o, err := ParseTarOwners(owners)
+		if err != nil {
+			return err
+		}
+		b.TarOwners = o
+		return nil
+	}
+}
+
+// WithWorkspaceFS sets the function returning the filesystems the packages
+// are emitted from, in place of the melange-out directory of the workspace.
+func WithWorkspaceFS(fn WorkspaceFSFunc) Option {
+	return func(b *Build) error {
+		b.WorkspaceFS = fn
+		return nil
+	}
+}
+
+// WithWorkspaceIDMaps sets the maps of the owners of the files of the
+// workspace on the host to their owners in the build environment, as
+// comma-separated container:host:size maps.
+func WithWorkspaceIDMaps(uidMap, gidMap string) Option {
+	return func(b *Build) error {
+		uids, err := ParseIDMaps(uidMap)
+		if err != nil {
+			return fmt.Errorf("parsing the workspace UID map: %w", err)
+		}
+		gids, err := ParseIDMaps(gidMap)
+		if err != nil {
+			return fmt.Errorf("parsing the workspace GID map: %w", err)
+		}
+		b.WorkspaceUIDMap = uids
+		b.WorkspaceGIDMap = gids
+		return nil
+	}
+}
+
+// WithWorkspaceOverlay sets whether the workspace is the upper directory of
+// an overlayfs.
+func WithWorkspaceOverlay(overlay bool) Option {
+	return func(b *Build) error {
+		b.WorkspaceOverlay = overlay
+		return nil
+	}
+}
+
+// WithUsrMerge sets how the files of the packages in /bin, /sbin, /lib and
+// /lib64 are moved to /usr: UsrMergeMove, UsrMergeSymlink, or "" to leave
+// them.
+func WithUsrMerge(policy string) Option {
+	return func(b *Build) error {
+		switch policy {
+		case "", UsrMergeMove, UsrMergeSymlink:
+		default:
+			return fmt.Errorf("usr-merge policy %q must be one of %s or %s", policy, UsrMergeMove, UsrMergeSymlink)
+		}
+		b.UsrMerge = policy
+		return nil
+	}
+}
+
+// WithStampBinaries sets whether the ELF files of the packages are stamped
+// with the package metadata note.
+func WithStampBinaries(stampBinaries bool) Option {
+	return func(b *Build) error {
+		b.StampBinaries = stampBinaries
+		return nil
+	}
+}
+
+// WithNoHardLinks sets whether the hard links of the workspace are packaged
+// as copies.
+func WithNoHardLinks(noHardLinks bool) Option {
+	return func(b *Build) error {
+		b.NoHardLinks = noHardLinks
+		return nil
+	}
+}
+
+// WithRootless sets whether the build runs without privileges, in a user
+// namespace.
+func WithRootless(rootless bool) Option {
+	return func(b *Build) error {
+		b.Rootless = rootless
+		return nil
+	}
+}
+
+// WithNameservers overrides the nameservers used for name resolution in the
+// build environment.
+func WithNameservers(nameservers []string) Option {
+	return func(b *Build) error {
+		b.Nameservers = nameservers
+		return nil
+	}
+}
+
+// WithExtraHosts adds host:ip entries to /etc/hosts in the build environment.
+func WithExtraHosts(extraHosts []string) Option {
+	return func(b *Build) error {
+		b.ExtraHosts = extraHosts
+		return nil
+	}
+}
+
 // WithExtraPackages specifies packages that are added to each build by default.
 func WithExtraPackages(extraPackages []string) Option {
 	return func(b *Build) error {
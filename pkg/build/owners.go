@@ -0,0 +1,243 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/passwd"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+// TarOwners is the policy for the owners of the entries of the tarballs
+// of an emitted package.
+type TarOwners string
+
+const (
+	// TarOwnersNames gives the entries of the data section the owner
+	// names of the users and groups of the build environment, and the
+	// entries of the control section to root/root.  This is the default.
+	TarOwnersNames TarOwners = "names"
+	// TarOwnersNumeric only records the numeric owners of the entries,
+	// without user or group names, for extraction tools which mishandle
+	// them.
+	TarOwnersNumeric TarOwners = "numeric"
+	// TarOwnersRoot gives every entry to 0/0 root/root.
+	TarOwnersRoot TarOwners = "root"
+	// TarOwnersDeclared gives every entry to 0/0 root/root, like
+	// TarOwnersRoot, except the files whose owners the build file
+	// declares, which get the names and IDs of those users and groups in
+	// the build environment.
+	TarOwnersDeclared TarOwners = "declared"
+)
+
+// TarOwnersPolicies are the valid values of TarOwners.
+var TarOwnersPolicies = []TarOwners{TarOwnersNames, TarOwnersNumeric, TarOwnersRoot, TarOwnersDeclared}
+
+// ParseTarOwners returns the TarOwners named s.
+func ParseTarOwners(s string) (TarOwners, error) {
+	for _, o := range TarOwnersPolicies {
+		if string(o) == s {
+			return o, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown tar owners policy %q, must be one of %v", s, TarOwnersPolicies)
+}
+
+// controlOptions returns the tarball options of the control section.
+func (o TarOwners) controlOptions() []tarball.Option {
+	opts := []tarball.Option{tarball.WithOverrideUIDGID(0, 0)}
+	if o != TarOwnersNumeric {
+		opts = append(opts, tarball.WithOverrideUname("root"), tarball.WithOverrideGname("root"))
+	}
+
+	return opts
+}
+
+// dataOptions returns the tarball options of the data section.
+func (o TarOwners) dataOptions() []tarball.Option {
+	if o != TarOwnersRoot && o != TarOwnersDeclared {
+		return nil
+	}
+
+	return []tarball.Option{
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+	}
+}
+
+// writeTar writes the tar stream produced by write to dst, applying the
+// policy.  The owner names of the entries are dropped with the numeric
+// policy, as tar.FileInfoHeader fills them in from the host otherwise.
+// If closeTar is unset, the stream is left without the end of archive
+// marker so that it can be concatenated.
+func (o TarOwners) writeTar(dst io.Writer, closeTar bool, write func(io.Writer) error) error {
+	if o != TarOwnersNumeric {
+		return write(dst)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(dst)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			pr.CloseWithError(err)
+			return err
+		}
+
+		hdr.Uname = ""
+		hdr.Gname = ""
+		delete(hdr.PAXRecords, "uname")
+		delete(hdr.PAXRecords, "gname")
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("writing header of %s: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+
+	// Read the end of archive marker, along with any error from write.
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		return err
+	}
+
+	if closeTar {
+		return tw.Close()
+	}
+	return tw.Flush()
+}
+
+// ownerOverrides returns the headers which give the files of the package the
+// owners its configuration declares, as chown would in the build environment,
+// which rootless builds cannot do.  User and group names are resolved from
+// the etc/passwd and etc/group of userinfofs, and the owner which is not
+// declared is the one the file has, remapped like the other entries, or
+// root with TarOwnersDeclared.
+func (pc *PackageBuild) ownerOverrides(fsys fs.FS, userinfofs fs.FS, remapUIDs, remapGIDs map[int]int) ([]tar.Header, error) {
+	if len(pc.Owners) == 0 || pc.Build.TarOwners == TarOwnersRoot {
+		return nil, nil
+	}
+
+	usersFile, _ := passwd.ReadUserFile(userinfofs, "etc/passwd")
+	groupsFile, _ := passwd.ReadGroupFile(userinfofs, "etc/group")
+	users, uids := map[int]string{}, map[string]int{}
+	for _, u := range usersFile.Entries {
+		users[int(u.UID)] = u.UserName
+		uids[u.UserName] = int(u.UID)
+	}
+	groups, gids := map[int]string{}, map[string]int{}
+	for _, g := range groupsFile.Entries {
+		groups[int(g.GID)] = g.GroupName
+		gids[g.GroupName] = int(g.GID)
+	}
+
+	hdrs := make([]tar.Header, 0, len(pc.Owners))
+	for _, o := range pc.Owners {
+		name := strings.TrimPrefix(o.Path, "/")
+
+		// The entry of its directory describes a symlink rather than its
+		// target.
+		entries, err := fs.ReadDir(fsys, path.Dir(name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		var fi fs.FileInfo
+		for _, d := range entries {
+			if d.Name() == path.Base(name) {
+				if fi, err = d.Info(); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if fi == nil {
+			return nil, fmt.Errorf("%s declares the owner of %s, which it does not ship", pc.PackageName, o.Path)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return nil, err
+		}
+		hdr.Name = name
+		if uid, ok := remapUIDs[hdr.Uid]; ok {
+			hdr.Uid = uid
+		}
+		if gid, ok := remapGIDs[hdr.Gid]; ok {
+			hdr.Gid = gid
+		}
+		if pc.Build.TarOwners == TarOwnersDeclared {
+			hdr.Uid, hdr.Gid = 0, 0
+		}
+
+		if o.User != "" {
+			if hdr.Uid, err = ownerID(o.User, uids); err != nil {
+				return nil, fmt.Errorf("owner of %s: user %w", o.Path, err)
+			}
+		}
+		if o.Group != "" {
+			if hdr.Gid, err = ownerID(o.Group, gids); err != nil {
+				return nil, fmt.Errorf("owner of %s: group %w", o.Path, err)
+			}
+		}
+		hdr.Uname = users[hdr.Uid]
+		hdr.Gname = groups[hdr.Gid]
+		if pc.Build.TarOwners == TarOwnersDeclared {
+			// Like the other entries, whatever the build environment.
+			if hdr.Uid == 0 {
+				hdr.Uname = "root"
+			}
+			if hdr.Gid == 0 {
+				hdr.Gname = "root"
+			}
+		}
+
+		hdrs = append(hdrs, *hdr)
+	}
+
+	return hdrs, nil
+}
+
+// ownerID returns the ID of a user or group given as a numeric ID, or as a
+// name of ids.
+func ownerID(owner string, ids map[string]int) (int, error) {
+	if id, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return int(id), nil
+	}
+	if id, ok := ids[owner]; ok {
+		return id, nil
+	}
+
+	return 0, fmt.Errorf("%q is not a name of the build environment", owner)
+}
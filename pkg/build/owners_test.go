@@ -0,0 +1,196 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func readTarHeaders(t *testing.T, r io.Reader) []*tar.Header {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	require.NoError(t, err)
+
+	hdrs := []*tar.Header{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		hdrs = append(hdrs, hdr)
+	}
+
+	return hdrs
+}
+
+func TestTarOwners(t *testing.T) {
+	ctx := context.Background()
+
+	ws := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "hello"), []byte("hello\n"), 0o644))
+
+	uid, gid := os.Getuid(), os.Getgid()
+	guest := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(guest, "etc", "passwd"), []byte(fmt.Sprintf("builder:x:%d:%d::/home/build:/bin/sh\n", uid, gid)), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(guest, "etc", "group"), []byte(fmt.Sprintf("builders:x:%d:\n", gid)), 0o644))
+
+	for _, tc := range []struct {
+		owners       TarOwners
+		uid, gid     int
+		uname, gname string
+		controlName  string
+	}{
+		{TarOwnersNames, uid, gid, "builder", "builders", "root"},
+		{TarOwnersNumeric, uid, gid, "", "", ""},
+		{TarOwnersRoot, 0, 0, "root", "root", "root"},
+		{TarOwnersDeclared, 0, 0, "root", "root", "root"},
+	} {
+		t.Run(string(tc.owners), func(t *testing.T) {
+			pc := &PackageBuild{
+				Build:       &Build{SourceDateEpoch: time.Unix(0, 0), TarOwners: tc.owners},
+				Origin:      &config.Package{Name: "hello", Version: "1.0"},
+				PackageName: "hello",
+			}
+
+			var data bytes.Buffer
+			digest, err := pc.emitDataSection(ctx, readlinkFS(ws), os.DirFS(guest), map[int]int{}, map[int]int{}, &data)
+			require.NoError(t, err)
+			pc.DataHash = digest
+
+			hdrs := readTarHeaders(t, &data)
+			require.Len(t, hdrs, 1)
+			hdr := hdrs[0]
+			require.Equal(t, "hello", hdr.Name)
+			require.Equal(t, tc.uid, hdr.Uid)
+			require.Equal(t, tc.gid, hdr.Gid)
+			require.Equal(t, tc.uname, hdr.Uname)
+			require.Equal(t, tc.gname, hdr.Gname)
+			require.Contains(t, hdr.PAXRecords, "APK-TOOLS.checksum.SHA1")
+
+			control, err := pc.generateControlSection(ctx)
+			require.NoError(t, err)
+
+			hdrs = readTarHeaders(t, bytes.NewReader(control))
+			require.Len(t, hdrs, 1)
+			require.Equal(t, ".PKGINFO", hdrs[0].Name)
+			require.Equal(t, 0, hdrs[0].Uid)
+			require.Equal(t, tc.controlName, hdrs[0].Uname)
+			require.Equal(t, tc.controlName, hdrs[0].Gname)
+		})
+	}
+}
+
+func TestOwnerOverrides(t *testing.T) {
+	ctx := context.Background()
+
+	ws := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "var", "lib", "hello"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "var", "lib", "hello", "state"), []byte("hello\n"), 0o755))
+	require.NoError(t, os.Chmod(filepath.Join(ws, "var", "lib", "hello", "state"), 0o755|os.ModeSetuid))
+	require.NoError(t, os.Symlink("state", filepath.Join(ws, "var", "lib", "hello", "link")))
+
+	uid, gid := os.Getuid(), os.Getgid()
+	guest := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(guest, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\nhello:x:100:101::/var/lib/hello:/bin/sh\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(guest, "etc", "group"), []byte("root:x:0:\nhello:x:101:\n"), 0o644))
+
+	owners := []config.FileOwner{
+		{Path: "/var/lib/hello", User: "hello", Group: "hello"},
+		{Path: "/var/lib/hello/state", User: "200"},
+		{Path: "/var/lib/hello/link", Group: "hello"},
+	}
+	emit := func(owners []config.FileOwner, tarOwners TarOwners) (map[string]*tar.Header, error) {
+		pc := &PackageBuild{
+			Build:       &Build{SourceDateEpoch: time.Unix(0, 0), TarOwners: tarOwners},
+			Origin:      &config.Package{Name: "hello", Version: "1.0"},
+			PackageName: "hello",
+			Owners:      owners,
+		}
+
+		var data bytes.Buffer
+		remap := map[int]int{uid: 0}
+		if _, err := pc.emitDataSection(ctx, readlinkFS(ws), os.DirFS(guest), remap, map[int]int{gid: 0}, &data); err != nil {
+			return nil, err
+		}
+
+		hdrs := map[string]*tar.Header{}
+		for _, hdr := range readTarHeaders(t, &data) {
+			hdrs[hdr.Name] = hdr
+		}
+		return hdrs, nil
+	}
+
+	hdrs, err := emit(owners, TarOwnersNames)
+	require.NoError(t, err)
+
+	dir := hdrs["var/lib/hello"]
+	require.Equal(t, []any{100, 101, "hello", "hello", int64(0o750)}, []any{dir.Uid, dir.Gid, dir.Uname, dir.Gname, dir.Mode})
+	state := hdrs["var/lib/hello/state"]
+	require.Equal(t, []any{200, 0, "", "root", int64(0o4755)}, []any{state.Uid, state.Gid, state.Uname, state.Gname, state.Mode})
+	link := hdrs["var/lib/hello/link"]
+	require.Equal(t, byte(tar.TypeSymlink), link.Typeflag)
+	require.Equal(t, []any{0, 101, "root", "hello"}, []any{link.Uid, link.Gid, link.Uname, link.Gname})
+	require.Equal(t, 0, hdrs["var/lib"].Uid)
+
+	// Everything is owned by root with the root policy.
+	hdrs, err = emit(owners, TarOwnersRoot)
+	require.NoError(t, err)
+	require.Equal(t, 0, hdrs["var/lib/hello"].Uid)
+
+	// Everything is owned by root but the declared owners with the declared
+	// policy.
+	hdrs, err = emit(owners, TarOwnersDeclared)
+	require.NoError(t, err)
+	dir = hdrs["var/lib/hello"]
+	require.Equal(t, []any{100, 101, "hello", "hello", int64(0o750)}, []any{dir.Uid, dir.Gid, dir.Uname, dir.Gname, dir.Mode})
+	state = hdrs["var/lib/hello/state"]
+	require.Equal(t, []any{200, 0, "", "root", int64(0o4755)}, []any{state.Uid, state.Gid, state.Uname, state.Gname, state.Mode})
+	link = hdrs["var/lib/hello/link"]
+	require.Equal(t, []any{0, 101, "root", "hello"}, []any{link.Uid, link.Gid, link.Uname, link.Gname})
+	require.Equal(t, []any{0, 0, "root", "root"}, []any{hdrs["var/lib"].Uid, hdrs["var/lib"].Gid, hdrs["var/lib"].Uname, hdrs["var/lib"].Gname})
+
+	_, err = emit([]config.FileOwner{{Path: "/var/lib/missing", User: "hello"}}, TarOwnersNames)
+	require.ErrorContains(t, err, "hello declares the owner of /var/lib/missing, which it does not ship")
+
+	_, err = emit([]config.FileOwner{{Path: "/var/lib/hello", User: "nobody"}}, TarOwnersNames)
+	require.ErrorContains(t, err, `owner of /var/lib/hello: user "nobody" is not a name of the build environment`)
+}
+
+func TestParseTarOwners(t *testing.T) {
+	o, err := ParseTarOwners("numeric")
+	require.NoError(t, err)
+	require.Equal(t, TarOwnersNumeric, o)
+
+	_, err = ParseTarOwners("nobody")
+	require.ErrorContains(t, err, "unknown tar owners policy")
+}
@@ -19,7 +19,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -32,10 +32,9 @@ import (
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"sigs.k8s.io/release-utils/version"
 
-	"github.com/klauspost/compress/gzip"
-	"github.com/klauspost/pgzip"
-
+	"chainguard.dev/melange/internal/hardlink"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/failure"
 	"chainguard.dev/melange/pkg/sca"
 	"chainguard.dev/melange/pkg/util"
 
@@ -69,6 +68,8 @@ type PackageBuild struct {
 	Origin         *config.Package
 	PackageName    string
 	OriginName     string
+	Version        string
+	Epoch          uint64
 	InstalledSize  int64
 	DataHash       string
 	OutDir         string
@@ -79,27 +80,76 @@ type PackageBuild struct {
 	Description    string
 	URL            string
 	Commit         string
+	Owners         []config.FileOwner
+	Copyright      []config.Copyright
+
+	// verifying is set when the package is emitted again to check that it
+	// is reproducible, which must not be recorded anywhere.
+	verifying bool
+	// fileDigests is the .SHA256SUMS file of the control section, if
+	// Build.FileDigests is set.
+	fileDigests []byte
 }
 
 func pkgFromSub(sub *config.Subpackage) *config.Package {
 	return &config.Package{
 		Name:         sub.Name,
+		Version:      sub.Version,
+		Epoch:        sub.Epoch,
 		Dependencies: sub.Dependencies,
 		Options:      sub.Options,
 		Scriptlets:   sub.Scriptlets,
 		Description:  sub.Description,
 		URL:          sub.URL,
 		Commit:       sub.Commit,
+		Owners:       sub.Owners,
+		Copyright:    sub.Copyright,
 	}
 }
 
 func (pb *PipelineBuild) Emit(ctx context.Context, pkg *config.Package) error {
-	pc := PackageBuild{
+	pc := pb.packageBuild(pkg)
+
+	hc := pb.Build.hookContext(config.HookPreEmit, pkg.Name)
+	hc.Path = pc.WorkspaceSubdir()
+	if err := pb.Build.runHooks(ctx, hc); err != nil {
+		return err
+	}
+
+	name := pb.Build.progressName(pkg.Name)
+	end := pb.Build.tracker.Begin(ctx, name, "emitting")
+	err := pc.EmitPackage(ctx)
+	end(err)
+	if err != nil {
+		return err
+	}
+	pb.Build.tracker.Done(ctx, name)
+
+	hc.Point, hc.APK = config.HookPostEmit, pc.Filename()
+	return pb.Build.runHooks(ctx, hc)
+}
+
+// removeEmitted removes the packages which Emit wrote, so that those of a
+// build which fails a check after emitting them are neither indexed nor
+// installed by the builds which follow it.
+func (pb *PipelineBuild) removeEmitted(ctx context.Context, emitted []*config.Package) {
+	for _, pkg := range emitted {
+		path := pb.packageBuild(pkg).Filename()
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			clog.FromContext(ctx).Warnf("unable to remove %s: %v", path, err)
+		}
+	}
+}
+
+func (pb *PipelineBuild) packageBuild(pkg *config.Package) *PackageBuild {
+	pc := &PackageBuild{
 		MelangeVersion: version.GetVersionInfo().GitVersion,
 		Build:          pb.Build,
 		Origin:         &pb.Build.Configuration.Package,
 		PackageName:    pkg.Name,
 		OriginName:     pkg.Name,
+		Version:        pkg.Version,
+		Epoch:          pkg.Epoch,
 		OutDir:         filepath.Join(pb.Build.OutDir, pb.Build.Arch.ToAPK()),
 		Dependencies:   pkg.Dependencies,
 		Arch:           pb.Build.Arch.ToAPK(),
@@ -108,13 +158,27 @@ func (pb *PipelineBuild) Emit(ctx context.Context, pkg *config.Package) error {
 		Description:    pkg.Description,
 		URL:            pkg.URL,
 		Commit:         pkg.Commit,
+		Owners:         pkg.Owners,
+		Copyright:      pkg.Copyright,
+	}
+
+	// Subpackages share the version, the homepage and the licenses of their
+	// origin, unless they have their own.
+	if pc.Version == "" {
+		pc.Version, pc.Epoch = pc.Origin.Version, pc.Origin.Epoch
+	}
+	if pc.URL == "" {
+		pc.URL = pc.Origin.URL
+	}
+	if len(pc.Copyright) == 0 {
+		pc.Copyright = pc.Origin.Copyright
 	}
 
 	if !pb.Build.StripOriginName {
 		pc.OriginName = pc.Origin.Name
 	}
 
-	return pc.EmitPackage(ctx)
+	return pc
 }
 
 // AppendBuildLog will create or append a list of packages that were built by melange build
@@ -131,12 +195,12 @@ func (pc *PackageBuild) AppendBuildLog(dir string) error {
 	defer f.Close()
 
 	// separate with pipe so it is easy to parse
-	_, err = f.WriteString(fmt.Sprintf("%s|%s|%s|%s-r%d\n", pc.Arch, pc.OriginName, pc.PackageName, pc.Origin.Version, pc.Origin.Epoch))
+	_, err = f.WriteString(fmt.Sprintf("%s|%s|%s|%s-r%d\n", pc.Arch, pc.OriginName, pc.PackageName, pc.Version, pc.Epoch))
 	return err
 }
 
 func (pc *PackageBuild) Identity() string {
-	return fmt.Sprintf("%s-%s-r%d", pc.PackageName, pc.Origin.Version, pc.Origin.Epoch)
+	return fmt.Sprintf("%s-%s-r%d", pc.PackageName, pc.Version, pc.Epoch)
 }
 
 func (pc *PackageBuild) Filename() string {
@@ -149,17 +213,24 @@ func (pc *PackageBuild) WorkspaceSubdir() string {
 
 var controlTemplate = `# Generated by melange {{.MelangeVersion}}
 pkgname = {{.PackageName}}
-pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
+pkgver = {{.Version}}-r{{.Epoch}}
 arch = {{.Arch}}
 size = {{.InstalledSize}}
 origin = {{.OriginName}}
 pkgdesc = {{.Description}}
+{{- if .URL }}
 url = {{.URL}}
+{{- end }}
+{{- if .Commit }}
 commit = {{.Commit}}
+{{- end }}
+{{- if .Origin.Maintainer }}
+maintainer = {{.Origin.Maintainer}}
+{{- end }}
 {{- if ne .Build.SourceDateEpoch.Unix 0 }}
 builddate = {{ .Build.SourceDateEpoch.Unix }}
 {{- end}}
-{{- range $copyright := .Origin.Copyright }}
+{{- range $copyright := .Copyright }}
 license = {{ $copyright.License }}
 {{- end }}
 {{- range $dep := .Dependencies.Runtime }}
@@ -177,25 +248,42 @@ replaces = {{ $dep }}
 {{- if .Dependencies.ProviderPriority }}
 provider_priority = {{ .Dependencies.ProviderPriority }}
 {{- end }}
+{{- if .Dependencies.ReplacesPriority }}
+replaces_priority = {{ .Dependencies.ReplacesPriority }}
+{{- end }}
+{{- if .Dependencies.InstallIf }}
+install_if = {{ join .Dependencies.InstallIf " " }}
+{{- end }}
 {{- if .Scriptlets.Trigger.Paths }}
 triggers = {{ range $item := .Scriptlets.Trigger.Paths }}{{ $item }} {{ end }}
 {{- end }}
+{{- range $key, $value := .Origin.Metadata }}
+{{ $key }} = {{ $value }}
+{{- end }}
 datahash = {{.DataHash}}
 `
 
+// parseControlTemplate parses a template of .PKGINFO, which is executed
+// with the PackageBuild of each package.
+func parseControlTemplate(text string) (*template.Template, error) {
+	return template.New("control").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+var defaultControlTemplate = template.Must(parseControlTemplate(controlTemplate))
+
 func (pc *PackageBuild) GenerateControlData(w io.Writer) error {
-	tmpl := template.New("control")
-	return template.Must(tmpl.Parse(controlTemplate)).Execute(w, pc)
+	tmpl := defaultControlTemplate
+	if pc.Build.controlTemplate != nil {
+		tmpl = pc.Build.controlTemplate
+	}
+	return tmpl.Execute(w, pc)
 }
 
 func (pc *PackageBuild) generateControlSection(ctx context.Context) ([]byte, error) {
-	tarctx, err := tarball.NewContext(
+	tarctx, err := tarball.NewContext(append([]tarball.Option{
 		tarball.WithSourceDateEpoch(pc.Build.SourceDateEpoch),
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
 		tarball.WithSkipClose(true),
-	)
+	}, pc.Build.TarOwners.controlOptions()...)...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to build tarball context: %w", err)
 	}
@@ -210,6 +298,12 @@ func (pc *PackageBuild) generateControlSection(ctx context.Context) ([]byte, err
 		return nil, fmt.Errorf("unable to build control FS: %w", err)
 	}
 
+	if pc.fileDigests != nil {
+		if err := fsys.WriteFile(fileDigestsName, pc.fileDigests, 0644); err != nil {
+			return nil, fmt.Errorf("unable to build control FS: %w", err)
+		}
+	}
+
 	if pc.Scriptlets.Trigger.Script != "" {
 		// #nosec G306 -- scriptlets must be executable
 		if err := fsys.WriteFile(".trigger", []byte(pc.Scriptlets.Trigger.Script), 0755); err != nil {
@@ -260,9 +354,14 @@ func (pc *PackageBuild) generateControlSection(ctx context.Context) ([]byte, err
 	}
 
 	var buf bytes.Buffer
-	zw := gzip.NewWriter(&buf)
+	zw, err := newGzipWriter(&buf, pc.Build.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := tarctx.WriteTar(ctx, zw, fsys, fsys); err != nil {
+	if err := pc.Build.TarOwners.writeTar(zw, false, func(w io.Writer) error {
+		return tarctx.WriteTar(ctx, w, fsys, fsys)
+	}); err != nil {
 		return nil, fmt.Errorf("unable to write control tarball: %w", err)
 	}
 	if err := zw.Close(); err != nil {
@@ -299,31 +398,25 @@ func removeSelfProvidedDeps(runtimeDeps, providedDeps []string) []string {
 }
 
 func (pc *PackageBuild) GenerateDependencies(ctx context.Context) error {
-	log := clog.FromContext(ctx)
 	generated := config.Dependencies{}
+	declared := pc.Dependencies
 
 	hdl := SCABuildInterface{
 		PackageBuild: pc,
 	}
 
-	if err := sca.Analyze(ctx, &hdl, &generated); err != nil {
+	results, err := sca.AnalyzeResults(ctx, &hdl)
+	if err != nil {
 		return fmt.Errorf("analyzing package: %w", err)
 	}
 
-	if pc.Build.DependencyLog != "" {
-		log.Info("writing dependency log")
-
-		logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Build.DependencyLog, pc.Arch))
-		if err != nil {
-			log.Warnf("Unable to open dependency log: %v", err)
-		}
-		defer logFile.Close()
-
-		je := json.NewEncoder(logFile)
-		if err := je.Encode(&generated); err != nil {
-			return err
-		}
+	pluginResults, err := pc.runGeneratorPlugins(ctx)
+	if err != nil {
+		return fmt.Errorf("running generator plugins: %w", err)
 	}
+	results = append(results, pluginResults...)
+
+	sca.MergeResults(results, &generated)
 
 	// Only consider vendored deps for self-provided generated runtime deps.
 	// If a runtime dep is explicitly configured, assume we actually do need it.
@@ -344,6 +437,11 @@ func (pc *PackageBuild) GenerateDependencies(ctx context.Context) error {
 
 	pc.Dependencies.Summarize(ctx)
 
+	if pc.Build.dependencyLog != nil && !pc.verifying {
+		pc.Build.dependencyLog.Packages = append(pc.Build.dependencyLog.Packages,
+			newDependencyLogPackage(pc.PackageName, declared, results, pc.Dependencies))
+	}
+
 	return nil
 }
 
@@ -358,17 +456,34 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 }
 
 // TODO(kaniini): generate APKv3 packages
+
+// calculateInstalledSize sets the installed size of the package to the size
+// of its files, counting the hard links to a file once.  The size of
+// directories depends on the file system of the workspace, so it is left
+// out, and an empty package has no size.
 func (pc *PackageBuild) calculateInstalledSize(fsys fs.FS) error {
+	pc.InstalledSize = 0
+	links := map[hardlink.ID]struct{}{}
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if d.IsDir() {
+			return nil
+		}
 
 		fi, err := d.Info()
 		if err != nil {
 			return err
 		}
 
+		if id, ok := hardlink.Of(fi); ok {
+			if _, seen := links[id]; seen {
+				return nil
+			}
+			links[id] = struct{}{}
+		}
+
 		pc.InstalledSize += fi.Size()
 		return nil
 	}); err != nil {
@@ -378,69 +493,161 @@ func (pc *PackageBuild) calculateInstalledSize(fsys fs.FS) error {
 	return nil
 }
 
-func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, userinfofs fs.FS, remapUIDs map[int]int, remapGIDs map[int]int, w io.WriteSeeker) error {
-	log := clog.FromContext(ctx)
-	tarctx, err := tarball.NewContext(
+// fileDigestsName is the control file listing the SHA-256 digests of the
+// files of a package.
+const fileDigestsName = ".SHA256SUMS"
+
+// generateFileDigests lists the SHA-256 digests of the regular files of fsys
+// in the format of sha256sum, relative to the root, so that the files of an
+// installed package can be audited with `sha256sum -c` from the root.  apk
+// ignores the control files it does not know.
+func (pc *PackageBuild) generateFileDigests(fsys fs.FS) error {
+	var buf bytes.Buffer
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+
+		// Like sha256sum, a line whose name holds a backslash or a newline
+		// starts with a backslash, and they are escaped.
+		if strings.ContainsAny(path, "\\\n") {
+			path = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(path)
+			buf.WriteByte('\\')
+		}
+		fmt.Fprintf(&buf, "%x  %s\n", h.Sum(nil), path)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to compute file digests: %w", err)
+	}
+
+	pc.fileDigests = buf.Bytes()
+	return nil
+}
+
+// checkEmpty fails if a package declared empty ships files other than its
+// SBOM.
+func (pc *PackageBuild) checkEmpty(fsys fs.FS) error {
+	if !pc.Options.Empty {
+		return nil
+	}
+
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(path, "var/lib/db/sbom/") {
+			return nil
+		}
+		return fmt.Errorf("%s is declared empty, but ships %s", pc.PackageName, path)
+	})
+}
+
+// emitDataSection writes the data section to w, and returns its sha256
+// digest.  The data section is reproducible, so it can be written twice: once
+// to compute the digest which the control section records, and once to the
+// apk itself.
+func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, userinfofs fs.FS, remapUIDs map[int]int, remapGIDs map[int]int, w io.Writer) (string, error) {
+	owners, err := pc.ownerOverrides(fsys, userinfofs, remapUIDs, remapGIDs)
+	if err != nil {
+		return "", err
+	}
+
+	tarctx, err := tarball.NewContext(append([]tarball.Option{
 		tarball.WithSourceDateEpoch(pc.Build.SourceDateEpoch),
 		tarball.WithRemapUIDs(remapUIDs),
 		tarball.WithRemapGIDs(remapGIDs),
 		tarball.WithUseChecksums(true),
-	)
+		tarball.WithOverridePerms(owners),
+	}, pc.Build.TarOwners.dataOptions()...)...)
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return "", fmt.Errorf("unable to build tarball context: %w", err)
 	}
 
 	digest := sha256.New()
 	mw := io.MultiWriter(digest, w)
-	zw := pgzip.NewWriter(mw)
+	zw, err := newPgzipWriter(mw, pc.Build.CompressionLevel)
+	if err != nil {
+		return "", err
+	}
 	if err := zw.SetConcurrency(1<<20, pgzipThreads); err != nil {
-		return fmt.Errorf("tried to set pgzip concurrency to %d: %w", pgzipThreads, err)
+		return "", fmt.Errorf("tried to set pgzip concurrency to %d: %w", pgzipThreads, err)
 	}
 
-	if err := tarctx.WriteTar(ctx, zw, fsys, userinfofs); err != nil {
-		return fmt.Errorf("unable to write data tarball: %w", err)
+	if err := pc.Build.TarOwners.writeTar(zw, true, func(w io.Writer) error {
+		return tarctx.WriteTar(ctx, w, fsys, userinfofs)
+	}); err != nil {
+		return "", fmt.Errorf("unable to write data tarball: %w", err)
 	}
 
 	if err := zw.Close(); err != nil {
-		return fmt.Errorf("flushing data section gzip: %w", err)
-	}
-
-	pc.DataHash = hex.EncodeToString(digest.Sum(nil))
-	log.Infof("  data.tar.gz digest: %s", pc.DataHash)
-
-	if _, err := w.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("unable to rewind data tarball: %w", err)
+		return "", fmt.Errorf("flushing data section gzip: %w", err)
 	}
 
-	return nil
+	return hex.EncodeToString(digest.Sum(nil)), nil
 }
 
+// maxBufferedData is the largest installed size of a package whose data
+// section is held in memory while the apk is written.  The data section of
+// larger packages is compressed twice instead, as it must be hashed before
+// the sections which precede it in the apk can be written.
+var maxBufferedData int64 = 64 << 20
+
 func (pc *PackageBuild) wantSignature() bool {
 	return pc.Build.SigningKey != ""
 }
 
 func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
-	log := clog.FromContext(ctx)
+	log := clog.FromContext(ctx).With("package", pc.PackageName)
+	ctx = clog.WithLogger(ctx, log)
 	ctx, span := otel.Tracer("melange").Start(ctx, "EmitPackage")
 	defer span.End()
 
-	err := os.MkdirAll(pc.WorkspaceSubdir(), 0o755)
-	if err != nil {
-		return fmt.Errorf("unable to ensure workspace exists: %w", err)
+	if pc.Build.WorkspaceFS == nil {
+		if err := os.MkdirAll(pc.WorkspaceSubdir(), 0o755); err != nil {
+			return fmt.Errorf("unable to ensure workspace exists: %w", err)
+		}
 	}
 
 	log.Info("generating package " + pc.Identity())
+	defer pc.Build.profile.begin(profileEmit, "emit", map[string]any{"package": pc.PackageName})()
 
 	// filesystem for the data package
-	fsys := readlinkFS(pc.WorkspaceSubdir())
+	fsys, err := pc.Build.workspaceFS(pc.PackageName)
+	if err != nil {
+		return err
+	}
 
 	// provide the tar writer etc/passwd and etc/group of guest filesystem
 	userinfofs := os.DirFS(pc.Build.GuestDir)
 
 	// generate so:/cmd: virtuals for the filesystem
+	end := pc.Build.profile.begin(profileEmit, "dependencies", nil)
 	if err := pc.GenerateDependencies(ctx); err != nil {
 		return fmt.Errorf("unable to build final dependencies set: %w", err)
 	}
+	end()
+
+	if err := pc.checkEmpty(fsys); err != nil {
+		return err
+	}
+
+	if err := pc.checkSparseFiles(ctx, fsys); err != nil {
+		return err
+	}
 
 	// walk the filesystem to calculate the installed-size
 	if err := pc.calculateInstalledSize(fsys); err != nil {
@@ -449,13 +656,17 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 
 	log.Infof("  installed-size: %d", pc.InstalledSize)
 
-	// prepare data.tar.gz
-	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
-	if err != nil {
-		return fmt.Errorf("unable to open temporary file for writing: %w", err)
+	if err := pc.checkSizeBudget(ctx, "installed size", pc.InstalledSize, pc.Options.MaxInstalledSize); err != nil {
+		return err
+	}
+
+	if pc.Build.FileDigests {
+		end := pc.Build.profile.begin(profileEmit, "file digests", nil)
+		if err := pc.generateFileDigests(fsys); err != nil {
+			return err
+		}
+		end()
 	}
-	defer dataTarGz.Close()
-	defer os.Remove(dataTarGz.Name())
 
 	// why remap UIDs and GIDs of build?
 	// the build user is not intended to be exposed as an owner of the contents of the package.
@@ -489,22 +700,39 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 	remapUIDs[int(buildUser.UID)] = 0
 	remapGIDs[int(buildGroup.GID)] = 0
 
-	if err := pc.emitDataSection(ctx, fsys, userinfofs, remapUIDs, remapGIDs, dataTarGz); err != nil {
+	// The data section is written last, but its digest is part of the
+	// control section, so it is either buffered or hashed beforehand.
+	var dataTarGz *bytes.Buffer
+	dataWriter := io.Discard
+	if pc.InstalledSize <= maxBufferedData {
+		dataTarGz = &bytes.Buffer{}
+		dataWriter = dataTarGz
+	}
+
+	end = pc.Build.profile.begin(profileEmit, "data tar", nil)
+	pc.DataHash, err = pc.emitDataSection(ctx, fsys, userinfofs, remapUIDs, remapGIDs, dataWriter)
+	if err != nil {
 		return err
 	}
+	log.Infof("  data.tar.gz digest: %s", pc.DataHash)
+	end()
 
+	end = pc.Build.profile.begin(profileEmit, "control tar", nil)
 	controlSectionData, err := pc.generateControlSection(ctx)
 	if err != nil {
 		return err
 	}
+	end()
 
-	combinedParts := []io.Reader{bytes.NewReader(controlSectionData), dataTarGz}
+	combinedParts := []io.Reader{bytes.NewReader(controlSectionData)}
 
 	if pc.wantSignature() {
-		signatureData, err := EmitSignature(ctx, pc.Signer(), controlSectionData, pc.Build.SourceDateEpoch)
+		end = pc.Build.profile.begin(profileEmit, "signing", nil)
+		signatureData, err := emitSignature(ctx, pc.Signer(), controlSectionData, pc.Build.SourceDateEpoch, pc.Build.CompressionLevel)
 		if err != nil {
-			return fmt.Errorf("emitting signature: %w", err)
+			return failure.Wrap(failure.Signing, fmt.Errorf("emitting signature: %w", err))
 		}
+		end()
 
 		combinedParts = append([]io.Reader{bytes.NewReader(signatureData)}, combinedParts...)
 	}
@@ -514,17 +742,80 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 		return fmt.Errorf("unable to create output directory: %w", err)
 	}
 
-	outFile, err := os.Create(pc.Filename())
+	// Write the package next to its final name, so that a crashed build
+	// never leaves a truncated package behind.
+	outFile, err := lockedTempFile(pc.OutDir, partialPrefix+filepath.Base(pc.Filename())+".*")
 	if err != nil {
 		return fmt.Errorf("unable to create apk file: %w", err)
 	}
+	defer os.Remove(outFile.Name())
 	defer outFile.Close()
 
+	end = pc.Build.profile.begin(profileEmit, "write apk", nil)
 	if err := combine(outFile, combinedParts...); err != nil {
 		return fmt.Errorf("unable to write apk file: %w", err)
 	}
+	if dataTarGz != nil {
+		if _, err := dataTarGz.WriteTo(outFile); err != nil {
+			return fmt.Errorf("unable to write apk file: %w", err)
+		}
+	} else {
+		digest, err := pc.emitDataSection(ctx, fsys, userinfofs, remapUIDs, remapGIDs, outFile)
+		if err != nil {
+			return err
+		}
+		if digest != pc.DataHash {
+			return fmt.Errorf("the data section of %s is not reproducible: its digest changed from %s to %s", pc.PackageName, pc.DataHash, digest)
+		}
+	}
+	if err := outFile.Chmod(0o644); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if pc.Options.MaxAPKSize != "" {
+		fi, err := outFile.Stat()
+		if err != nil {
+			return fmt.Errorf("unable to stat apk file: %w", err)
+		}
+		if err := pc.checkSizeBudget(ctx, "apk size", fi.Size(), pc.Options.MaxAPKSize); err != nil {
+			return err
+		}
+	}
+	// The package is on disk before it is renamed, and the rename is on disk
+	// before the package is indexed, so that a crash of the host cannot leave
+	// an index listing a package which is empty or missing.
+	if err := outFile.Sync(); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if err := os.Rename(outFile.Name(), pc.Filename()); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if err := syncDir(pc.OutDir); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	end()
 
-	log.Infof("wrote %s", outFile.Name())
+	log.Infof("wrote %s", pc.Filename())
+
+	if pc.verifying {
+		return nil
+	}
+
+	if pc.Build.report != nil {
+		fi, err := outFile.Stat()
+		if err != nil {
+			return fmt.Errorf("unable to stat apk file: %w", err)
+		}
+
+		pc.Build.report.addPackage(PackageReport{
+			Name:          pc.PackageName,
+			Filename:      pc.Filename(),
+			Size:          fi.Size(),
+			InstalledSize: pc.InstalledSize,
+			DataHash:      pc.DataHash,
+			Depends:       pc.Dependencies.Runtime,
+			Provides:      pc.Dependencies.Provides,
+		})
+	}
 
 	// add the package to the build log if requested
 	if err := pc.AppendBuildLog(""); err != nil {
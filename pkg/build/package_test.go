@@ -15,12 +15,35 @@
 package build
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"text/template"
 	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/elfindex"
+	"chainguard.dev/melange/pkg/sca"
 
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 	"github.com/stretchr/testify/require"
 )
 
@@ -77,6 +100,8 @@ func Test_GenerateControlData(t *testing.T) {
 			Arch:          "aarch64",
 			InstalledSize: 666,
 			OriginName:    "bigbang",
+			Version:       "1.2.3",
+			Epoch:         4,
 			Description:   "I'm a unit test",
 			URL:           "https://chainguard.dev",
 			Commit:        "deadbeef",
@@ -105,6 +130,8 @@ datahash = baadf00d
 			Arch:          "aarch64",
 			InstalledSize: 666,
 			OriginName:    "bigbang",
+			Version:       "1.2.3",
+			Epoch:         4,
 			Description:   "I'm a unit test",
 			URL:           "https://chainguard.dev",
 			Commit:        "deadbeef",
@@ -121,6 +148,124 @@ url = https://chainguard.dev
 commit = deadbeef
 builddate = 12345678
 datahash = baadf00d
+`,
+	}, {
+		name: "replaces and install_if",
+		pb: &PackageBuild{
+			MelangeVersion: "v1.2.3",
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+			},
+			Origin:        pkg,
+			PackageName:   "glibc-bash-completion",
+			Arch:          "aarch64",
+			InstalledSize: 666,
+			OriginName:    "bigbang",
+			Version:       "1.2.3",
+			Epoch:         4,
+			Description:   "I'm a unit test",
+			URL:           "https://chainguard.dev",
+			Commit:        "deadbeef",
+			DataHash:      "baadf00d",
+			Dependencies: config.Dependencies{
+				Provides:         []string{"libc"},
+				Replaces:         []string{"musl"},
+				ProviderPriority: 10,
+				ReplacesPriority: 20,
+				InstallIf:        []string{"glibc=1.2.3-r4", "bash"},
+			},
+		},
+		want: `# Generated by melange v1.2.3
+pkgname = glibc-bash-completion
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+url = https://chainguard.dev
+commit = deadbeef
+provides = libc
+replaces = musl
+provider_priority = 10
+replaces_priority = 20
+install_if = glibc=1.2.3-r4 bash
+datahash = baadf00d
+`,
+	}, {
+		name: "maintainer without url or commit",
+		pb: &PackageBuild{
+			MelangeVersion: "v1.2.3",
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+			},
+			Origin:        &config.Package{Version: "1.2.3", Epoch: 4, Maintainer: "Jane Doe <jane@example.com>"},
+			PackageName:   "glibc",
+			Arch:          "aarch64",
+			InstalledSize: 666,
+			OriginName:    "bigbang",
+			Version:       "1.2.3",
+			Epoch:         4,
+			Description:   "I'm a unit test",
+			DataHash:      "baadf00d",
+		},
+		want: `# Generated by melange v1.2.3
+pkgname = glibc
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+maintainer = Jane Doe <jane@example.com>
+datahash = baadf00d
+`,
+	}, {
+		name: "metadata",
+		pb: &PackageBuild{
+			MelangeVersion: "v1.2.3",
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+			},
+			Origin:        &config.Package{Version: "1.2.3", Epoch: 4, Metadata: map[string]string{"support-tier": "gold", "cpe": "cpe:2.3:a:gnu:glibc"}},
+			PackageName:   "glibc",
+			Arch:          "aarch64",
+			InstalledSize: 666,
+			OriginName:    "bigbang",
+			Version:       "1.2.3",
+			Epoch:         4,
+			Description:   "I'm a unit test",
+			DataHash:      "baadf00d",
+		},
+		want: `# Generated by melange v1.2.3
+pkgname = glibc
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+cpe = cpe:2.3:a:gnu:glibc
+support-tier = gold
+datahash = baadf00d
+`,
+	}, {
+		name: "custom template",
+		pb: &PackageBuild{
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+				controlTemplate: template.Must(parseControlTemplate(`pkgname = {{.PackageName}}
+pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
+x-origin = {{.OriginName}}
+datahash = {{.DataHash}}
+`)),
+			},
+			Origin:      pkg,
+			PackageName: "glibc",
+			OriginName:  "bigbang",
+			DataHash:    "baadf00d",
+		},
+		want: `pkgname = glibc
+pkgver = 1.2.3-r4
+x-origin = bigbang
+datahash = baadf00d
 `,
 	}}
 
@@ -138,3 +283,458 @@ datahash = baadf00d
 		})
 	}
 }
+
+// syntheticEntry is a file or directory of a syntheticTree.
+type syntheticEntry struct {
+	name string
+	size int64
+	mode fs.FileMode
+}
+
+func (e syntheticEntry) Name() string               { return e.name }
+func (e syntheticEntry) Size() int64                { return e.size }
+func (e syntheticEntry) Mode() fs.FileMode          { return e.mode }
+func (e syntheticEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e syntheticEntry) ModTime() time.Time         { return time.Unix(0, 0) }
+func (e syntheticEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e syntheticEntry) Sys() any                   { return nil }
+func (e syntheticEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+type syntheticFile struct {
+	syntheticEntry
+	*bytes.Reader
+}
+
+func (f syntheticFile) Stat() (fs.FileInfo, error) { return f.syntheticEntry, nil }
+func (f syntheticFile) Close() error               { return nil }
+
+// syntheticTree is a package with dirs directories of files files each,
+// under usr/lib/big, which are generated as they are read so that the tree
+// itself takes no memory.  The first file of every directory is a shared
+// library, the others are zeros.  It records the peak heap in use every
+// time a directory is read.
+type syntheticTree struct {
+	dirs, files int
+	lib         []byte
+	peak        uint64
+}
+
+const syntheticFileSize = 64
+
+// syntheticData is the contents of the files other than the libraries.
+var syntheticData = make([]byte, syntheticFileSize)
+
+func (t *syntheticTree) stat(name string) (syntheticEntry, error) {
+	dir := syntheticEntry{name: filepath.Base(name), mode: fs.ModeDir | 0o755}
+	switch name {
+	case ".", "usr", "usr/lib", "usr/lib/big":
+		return dir, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, "usr/lib/big/"), "/")
+	if !strings.HasPrefix(name, "usr/lib/big/") || len(parts) > 2 || !strings.HasPrefix(parts[0], "d") {
+		return syntheticEntry{}, fs.ErrNotExist
+	}
+	if d, err := strconv.Atoi(parts[0][1:]); err != nil || d >= t.dirs {
+		return syntheticEntry{}, fs.ErrNotExist
+	}
+	if len(parts) == 1 {
+		return dir, nil
+	}
+
+	if parts[1] == "libfoo.so.1" {
+		return syntheticEntry{name: parts[1], size: int64(len(t.lib)), mode: 0o755}, nil
+	}
+	if f, err := strconv.Atoi(strings.TrimPrefix(parts[1], "f")); err != nil || f < 1 || f >= t.files {
+		return syntheticEntry{}, fs.ErrNotExist
+	}
+	return syntheticEntry{name: parts[1], size: syntheticFileSize, mode: 0o644}, nil
+}
+
+func (t *syntheticTree) Open(name string) (fs.File, error) {
+	e, err := t.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	data := syntheticData
+	if e.name == "libfoo.so.1" {
+		data = t.lib
+	}
+	return syntheticFile{e, bytes.NewReader(data)}, nil
+}
+
+func (t *syntheticTree) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return e, nil
+}
+
+func (t *syntheticTree) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+}
+
+func (t *syntheticTree) ReadDir(name string) ([]fs.DirEntry, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	t.peak = max(t.peak, ms.HeapAlloc)
+
+	e, err := t.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	dir := func(name string) []fs.DirEntry {
+		return []fs.DirEntry{syntheticEntry{name: name, mode: fs.ModeDir | 0o755}}
+	}
+	switch name {
+	case ".":
+		return dir("usr"), nil
+	case "usr":
+		return dir("lib"), nil
+	case "usr/lib":
+		return dir("big"), nil
+	case "usr/lib/big":
+		entries := make([]fs.DirEntry, 0, t.dirs)
+		for i := 0; i < t.dirs; i++ {
+			entries = append(entries, syntheticEntry{name: fmt.Sprintf("d%d", i), mode: fs.ModeDir | 0o755})
+		}
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+		return entries, nil
+	}
+
+	entries := make([]fs.DirEntry, 0, t.files)
+	entries = append(entries, syntheticEntry{name: "libfoo.so.1", size: int64(len(t.lib)), mode: 0o755})
+	for i := 1; i < t.files; i++ {
+		entries = append(entries, syntheticEntry{name: fmt.Sprintf("f%d", i), size: syntheticFileSize, mode: 0o644})
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// syntheticHandle is the SCA handle of a syntheticTree.
+type syntheticHandle struct {
+	tree *syntheticTree
+}
+
+func (h syntheticHandle) PackageName() string     { return "big" }
+func (h syntheticHandle) RelativeNames() []string { return []string{"big"} }
+func (h syntheticHandle) Version() string         { return "1.0-r0" }
+func (h syntheticHandle) VersionForRelative(string) string {
+	return "1.0-r0"
+}
+func (h syntheticHandle) Filesystem() (sca.SCAFS, error) {
+	return h.tree, nil
+}
+func (h syntheticHandle) FilesystemForRelative(string) (sca.SCAFS, error) {
+	return h.tree, nil
+}
+func (h syntheticHandle) ELFIndexForRelative(string) (*elfindex.Index, error) {
+	return elfindex.New(h.tree)
+}
+func (h syntheticHandle) Options() config.PackageOption         { return config.PackageOption{} }
+func (h syntheticHandle) BaseDependencies() config.Dependencies { return config.Dependencies{} }
+
+// readApkFile returns the contents of a file of an apk.
+func readApkFile(t *testing.T, apk, name string) []byte {
+	t.Helper()
+
+	f, err := os.Open(apk)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// The sections of an apk are concatenated gzip streams of tar streams,
+	// which read as one.
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatalf("%s not found in %s", name, apk)
+		}
+		require.NoError(t, err)
+		if hdr.Name == name {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			return data
+		}
+	}
+}
+
+// heapWriter discards what is written to it, and records the peak heap in
+// use every time it is written to.
+type heapWriter struct {
+	peak *uint64
+}
+
+func (w heapWriter) Write(p []byte) (int, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	*w.peak = max(*w.peak, ms.HeapAlloc)
+	return len(p), nil
+}
+
+// packagingMemoryCeiling is the most heap the analysis of the contents of
+// a package, and the writing of its data section, may use on top of what
+// was in use before, whatever its number of files.  What is kept across files is bounded by the distinct
+// dependencies found, and the directory being read.
+const packagingMemoryCeiling = 64 << 20
+
+func TestPackagingMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("walks a tree of a million files")
+	}
+
+	ctx := clog.WithLogger(context.Background(), clog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tree := &syntheticTree{
+		dirs:  1000,
+		files: 1000,
+		lib:   readApkFile(t, filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"), "usr/lib/libcap.so.2.69"),
+	}
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapAlloc
+	tree.peak = base
+
+	pc := &PackageBuild{}
+	require.NoError(t, pc.calculateInstalledSize(tree))
+	require.Equal(t, int64(tree.dirs)*(int64(len(tree.lib))+int64(tree.files-1)*syntheticFileSize), pc.InstalledSize)
+
+	results, err := sca.AnalyzeResults(ctx, syntheticHandle{tree})
+	require.NoError(t, err)
+
+	got := map[string]config.Dependencies{}
+	for _, res := range results {
+		got[res.Generator] = res.Dependencies
+	}
+	// Each dependency is found in a thousand libraries, and kept once.
+	require.Equal(t, []string{"so:ld-linux-aarch64.so.1", "so:libc.so.6"}, got["soname"].Runtime)
+	// The libraries are in private directories under usr/lib/big.
+	require.Empty(t, got["soname"].Provides)
+	require.Equal(t, []string{"so:libcap.so.2=2"}, got["soname"].Vendored)
+
+	// The data section is written as the files are walked, too.
+	pc.Build = &Build{SourceDateEpoch: time.Unix(0, 0)}
+	_, err = pc.emitDataSection(ctx, tree, os.DirFS(t.TempDir()), map[int]int{}, map[int]int{}, heapWriter{&tree.peak})
+	require.NoError(t, err)
+
+	t.Logf("peak heap growth: %d MiB", (tree.peak-base)>>20)
+	require.Less(t, tree.peak-base, uint64(packagingMemoryCeiling))
+}
+
+func TestEmitPackage_streamed(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	ws := t.TempDir()
+	writeTree(t, filepath.Join(ws, "melange-out", "hello"),
+		"usr/share/hello/a.txt", "usr/share/hello/b.txt")
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "melange-out", "hello", "usr", "share", "hello", "c.txt"), bytes.Repeat([]byte("hello\n"), 1<<16), 0o644))
+
+	emit := func(outDir string) []byte {
+		pc := &PackageBuild{
+			Build:       &Build{WorkspaceDir: ws, GuestDir: t.TempDir(), SourceDateEpoch: time.Unix(0, 0)},
+			Origin:      &config.Package{Name: "hello", Version: "1.0"},
+			PackageName: "hello",
+			OriginName:  "hello",
+			Arch:        "x86_64",
+			OutDir:      outDir,
+		}
+		require.NoError(t, pc.EmitPackage(ctx))
+
+		data, err := os.ReadFile(pc.Filename())
+		require.NoError(t, err)
+		return data
+	}
+
+	buffered := emit(t.TempDir())
+
+	prev := maxBufferedData
+	maxBufferedData = 0
+	t.Cleanup(func() { maxBufferedData = prev })
+	streamed := emit(t.TempDir())
+
+	require.Equal(t, buffered, streamed, "streaming the data section writes the same apk")
+
+	exp, err := expandapk.ExpandApk(ctx, bytes.NewReader(streamed), t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	data, err := os.ReadFile(exp.PackageFile)
+	require.NoError(t, err)
+	pkginfo, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+	require.NoError(t, err)
+	require.Contains(t, string(pkginfo), fmt.Sprintf("datahash = %x\n", sha256.Sum256(data)))
+}
+
+func TestEmitPackage_empty(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	// The workspace of a meta package may not even exist.
+	ws := t.TempDir()
+	pc := &PackageBuild{
+		Build:        &Build{WorkspaceDir: ws, GuestDir: t.TempDir(), SourceDateEpoch: time.Unix(0, 0)},
+		Origin:       &config.Package{Name: "hello-meta", Version: "1.0"},
+		PackageName:  "hello-meta",
+		OriginName:   "hello-meta",
+		Arch:         "x86_64",
+		OutDir:       t.TempDir(),
+		Options:      config.PackageOption{Empty: true},
+		Dependencies: config.Dependencies{Runtime: []string{"hello"}},
+	}
+	require.NoError(t, pc.EmitPackage(ctx))
+	require.Zero(t, pc.InstalledSize)
+
+	// The temporary file the package was written to was renamed.
+	entries, err := os.ReadDir(pc.OutDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, filepath.Base(pc.Filename()), entries[0].Name())
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	pkginfo, err := fs.ReadFile(exp.ControlFS, ".PKGINFO")
+	require.NoError(t, err)
+	require.Contains(t, string(pkginfo), "size = 0\n")
+	require.Contains(t, string(pkginfo), "depend = hello\n")
+
+	data, err := os.ReadFile(exp.PackageFile)
+	require.NoError(t, err)
+	require.Contains(t, string(pkginfo), fmt.Sprintf("datahash = %x\n", sha256.Sum256(data)))
+
+	entries, err = fs.ReadDir(exp.TarFS, ".")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// A package declared empty must not ship files.
+	writeTree(t, filepath.Join(ws, "melange-out", "hello-meta"), "usr/share/hello/a.txt")
+	require.ErrorContains(t, pc.EmitPackage(ctx), "hello-meta is declared empty, but ships usr/share/hello/a.txt")
+}
+
+func TestEmitPackage_fileDigests(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	ws := t.TempDir()
+	root := filepath.Join(ws, "melange-out", "hello")
+	writeTree(t, root, "usr/bin/hello", "usr/share/hello/a\nb.txt")
+	require.NoError(t, os.Symlink("hello", filepath.Join(root, "usr", "bin", "hi")))
+
+	pc := &PackageBuild{
+		Build:       &Build{WorkspaceDir: ws, GuestDir: t.TempDir(), SourceDateEpoch: time.Unix(0, 0), FileDigests: true},
+		Origin:      &config.Package{Name: "hello", Version: "1.0"},
+		PackageName: "hello",
+		OriginName:  "hello",
+		Arch:        "x86_64",
+		OutDir:      t.TempDir(),
+	}
+	require.NoError(t, pc.EmitPackage(ctx))
+
+	f, err := os.Open(pc.Filename())
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+
+	// Symbolic links are left out, and names with a newline are escaped.
+	sums, err := fs.ReadFile(exp.ControlFS, ".SHA256SUMS")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x  usr/bin/hello\n\\%x  usr/share/hello/a\\nb.txt\n",
+		sha256.Sum256([]byte("usr/bin/hello")), sha256.Sum256([]byte("usr/share/hello/a\nb.txt"))), string(sums))
+}
+
+func TestPackageBuild_subpackageCopyright(t *testing.T) {
+	b := &Build{Arch: apko_types.ParseArchitecture("x86_64"), SourceDateEpoch: time.Unix(0, 0)}
+	b.Configuration.Package = config.Package{
+		Name:      "hello",
+		Version:   "1.0",
+		URL:       "https://example.com/hello",
+		Copyright: []config.Copyright{{License: "GPL-3.0-or-later"}},
+	}
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+
+	license := func(pkg *config.Package) []string {
+		var buf bytes.Buffer
+		require.NoError(t, pb.packageBuild(pkg).GenerateControlData(&buf))
+
+		licenses := []string{}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if l, ok := strings.CutPrefix(line, "license = "); ok {
+				licenses = append(licenses, l)
+			}
+		}
+		return licenses
+	}
+
+	// Subpackages are licensed like their origin, unless they have their
+	// own copyrights.
+	require.Equal(t, []string{"GPL-3.0-or-later"}, license(pb.Package))
+	require.Equal(t, []string{"GPL-3.0-or-later"}, license(pkgFromSub(&config.Subpackage{Name: "hello-dev"})))
+	require.Equal(t, []string{"GFDL-1.3-or-later", "CC-BY-SA-4.0"}, license(pkgFromSub(&config.Subpackage{
+		Name:      "hello-doc",
+		Copyright: []config.Copyright{{License: "GFDL-1.3-or-later"}, {License: "CC-BY-SA-4.0"}},
+	})))
+}
+
+func TestPackageBuild_subpackageVersion(t *testing.T) {
+	b := &Build{Arch: apko_types.ParseArchitecture("x86_64"), SourceDateEpoch: time.Unix(0, 0), OutDir: "/out"}
+	b.Configuration.Package = config.Package{Name: "hello", Version: "2.0", Epoch: 3}
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+
+	// Subpackages have the version of their origin, unless they have their
+	// own.
+	for _, c := range []struct {
+		pkg      *config.Package
+		filename string
+		pkgver   string
+	}{
+		{pb.Package, "/out/x86_64/hello-2.0-r3.apk", "pkgver = 2.0-r3"},
+		{pkgFromSub(&config.Subpackage{Name: "hello-dev"}), "/out/x86_64/hello-dev-2.0-r3.apk", "pkgver = 2.0-r3"},
+		{pkgFromSub(&config.Subpackage{Name: "hello-compat", Version: "1.4", Epoch: 1}), "/out/x86_64/hello-compat-1.4-r1.apk", "pkgver = 1.4-r1"},
+	} {
+		pc := pb.packageBuild(c.pkg)
+		require.Equal(t, c.filename, pc.Filename())
+
+		var buf bytes.Buffer
+		require.NoError(t, pc.GenerateControlData(&buf))
+		require.Contains(t, strings.Split(buf.String(), "\n"), c.pkgver)
+	}
+}
+
+func TestPipelineBuild_removeEmitted(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	b := &Build{Arch: apko_types.ParseArchitecture("x86_64"), OutDir: t.TempDir()}
+	b.Configuration.Package = config.Package{Name: "hello", Version: "2.0", Epoch: 3}
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+
+	dir := filepath.Join(b.OutDir, "x86_64")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	for _, name := range []string{"hello-2.0-r3.apk", "hello-dev-2.0-r3.apk", "other-1.0-r0.apk"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o644))
+	}
+
+	// The packages of the build are removed, even if some were not
+	// emitted, and those of other builds are left alone.
+	pb.removeEmitted(ctx, []*config.Package{
+		pb.Package,
+		pkgFromSub(&config.Subpackage{Name: "hello-dev"}),
+		pkgFromSub(&config.Subpackage{Name: "hello-doc"}),
+	})
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "other-1.0-r0.apk", entries[0].Name())
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// checkPaths checks the paths of the package pkgName in fsys against the
+// path assertions of its checks, so that a build whose pipelines did not lay
+// out the package as expected fails before the package is emitted.
+func checkPaths(pkgName string, fsys WorkspaceFS, chk config.PathChecks) error {
+	if len(chk.MustExist) == 0 && len(chk.MustNotExist) == 0 && len(chk.MustBeExecutable) == 0 {
+		return nil
+	}
+
+	matched := map[string]bool{}
+	var errs []error
+	if err := fs.WalkDir(fsys, ".", func(rel string, d fs.DirEntry, err error) error {
+		if err != nil || rel == "." {
+			return err
+		}
+
+		for _, pattern := range chk.MustExist {
+			if matchPath(pattern, rel) {
+				matched[pattern] = true
+			}
+		}
+		for _, pattern := range chk.MustNotExist {
+			if matchPath(pattern, rel) {
+				errs = append(errs, fmt.Errorf("%s must not exist, but %s matches it", pattern, rel))
+			}
+		}
+		for _, pattern := range chk.MustBeExecutable {
+			if !matchPath(pattern, rel) {
+				continue
+			}
+			matched[pattern] = true
+			// Symlinks are executable when their targets are.
+			fi, err := fsys.Stat(rel)
+			if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+				errs = append(errs, fmt.Errorf("%s must be executable, but %s matches it and is not an executable file", pattern, rel))
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("checking the paths of %s: %w", pkgName, err)
+	}
+
+	for _, patterns := range [][]string{chk.MustExist, chk.MustBeExecutable} {
+		for _, pattern := range patterns {
+			if !matched[pattern] {
+				errs = append(errs, fmt.Errorf("%s must exist, but nothing matches it", pattern))
+			}
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("the paths of %s fail their checks:\n%w", pkgName, err)
+	}
+
+	return nil
+}
+
+// matchPath returns whether the path p of a package matches pattern, which
+// may be absolute.
+func matchPath(pattern, p string) bool {
+	// The patterns were validated with the configuration.
+	ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), p)
+	return ok
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestCheckPaths(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{
+		"usr/bin/hello":          0o755,
+		"usr/lib/libhello.so.1":  0o755,
+		"usr/share/hello/README": 0o644,
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), mode))
+	}
+	require.NoError(t, os.Symlink("hello", filepath.Join(dir, "usr", "bin", "hi")))
+
+	require.NoError(t, checkPaths("hello", readlinkFS(dir), config.PathChecks{}))
+	require.NoError(t, checkPaths("hello", readlinkFS(dir), config.PathChecks{
+		MustExist:        []string{"usr/lib/libhello.so.*", "/usr/share/hello"},
+		MustNotExist:     []string{"usr/include/*", "usr/lib/*.a"},
+		MustBeExecutable: []string{"usr/bin/*"},
+	}))
+
+	err := checkPaths("hello", readlinkFS(dir), config.PathChecks{
+		MustExist:        []string{"usr/lib/libhello.so"},
+		MustNotExist:     []string{"usr/share/hello/*"},
+		MustBeExecutable: []string{"usr/share/hello/README", "usr/sbin/*"},
+	})
+	require.EqualError(t, err, `the paths of hello fail their checks:
+usr/share/hello/* must not exist, but usr/share/hello/README matches it
+usr/share/hello/README must be executable, but usr/share/hello/README matches it and is not an executable file
+usr/lib/libhello.so must exist, but nothing matches it
+usr/sbin/* must exist, but nothing matches it`)
+}
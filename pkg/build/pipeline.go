@@ -17,7 +17,9 @@ package build
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -28,6 +30,7 @@ import (
 	"github.com/chainguard-dev/clog"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/exp/maps"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	"gopkg.in/yaml.v3"
 
@@ -36,6 +39,7 @@ import (
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/failure"
 	"chainguard.dev/melange/pkg/util"
 )
 
@@ -46,6 +50,16 @@ type PipelineContext struct {
 	// Ordered list of pipeline directories to search for pipelines
 	PipelineDirs []string
 	steps        int
+	// network is whether the steps of the pipeline have network access,
+	// which they inherit from their parent unless they set it.
+	network bool
+	// limits are the resource limits of the steps of the pipeline, which
+	// they inherit from their parent unless they set their own.
+	limits *config.Limits
+	// retries and retryOn are the retry policy of the steps of the pipeline,
+	// which they inherit from their parent unless they set their own.
+	retries int
+	retryOn *config.RetryOn
 }
 
 func NewPipelineContext(p *config.Pipeline, environment *apko_types.ImageConfiguration, config *container.Config, pipelineDirs []string) *PipelineContext {
@@ -133,7 +147,7 @@ func substitutionMap(pb *PipelineBuild) (map[string]string, error) {
 		config.SubstitutionPackageName:        pb.Package.Name,
 		config.SubstitutionPackageVersion:     pb.Package.Version,
 		config.SubstitutionPackageEpoch:       strconv.FormatUint(pb.Package.Epoch, 10),
-		config.SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%s", config.SubstitutionPackageVersion, config.SubstitutionPackageEpoch),
+		config.SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%d", pb.Package.Version, pb.Package.Epoch),
 		config.SubstitutionTargetsDestdir:     fmt.Sprintf("/home/build/melange-out/%s", pb.Package.Name),
 		config.SubstitutionTargetsContextdir:  fmt.Sprintf("/home/build/melange-out/%s", pb.Package.Name),
 	}
@@ -147,21 +161,14 @@ func substitutionMap(pb *PipelineBuild) (map[string]string, error) {
 		nw[config.SubstitutionCrossTripletRustGlibc] = pb.Build.Arch.ToRustTriplet("gnu")
 		nw[config.SubstitutionCrossTripletRustMusl] = pb.Build.Arch.ToRustTriplet("musl")
 		nw[config.SubstitutionBuildArch] = pb.Build.Arch.ToAPK()
+	} else if pb.Test != nil {
+		// The conditionals of the package and subpackages depend on it.
+		nw[config.SubstitutionBuildArch] = pb.Test.Arch.ToAPK()
 	}
 
-	// Retrieve vars from config
-	subst_nw, err := pb.GetConfiguration().GetVarsFromConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	for k, v := range subst_nw {
-		nw[k] = v
-	}
-
-	// Perform substitutions on current map
-	err = pb.GetConfiguration().PerformVarSubstitutions(nw)
-	if err != nil {
+	// Resolve the vars and var-transforms from the config against the
+	// current map.
+	if err := pb.GetConfiguration().PerformVarSubstitutions(nw); err != nil {
 		return nil, err
 	}
 
@@ -226,7 +233,9 @@ func loadPipelineData(dir string, uses string) ([]byte, error) {
 	return data, nil
 }
 
-func (pctx *PipelineContext) loadUse(ctx context.Context, pb *PipelineBuild, uses string, with map[string]string) error {
+// readPipeline returns the definition of the pipeline uses, from the first
+// of pipelineDirs which has it or from the embedded pipelines.
+func readPipeline(ctx context.Context, pipelineDirs []string, uses string) ([]byte, error) {
 	log := clog.FromContext(ctx)
 	var data []byte
 	// Set this to fail up front in case there are no pipeline dirs specified
@@ -234,7 +243,7 @@ func (pctx *PipelineContext) loadUse(ctx context.Context, pb *PipelineBuild, use
 	err := fmt.Errorf("could not find 'uses' pipeline %q", uses)
 	// See first if we can read from the specified pipeline dirs
 	// and if we can't, below we'll try from the embedded pipelines.
-	for _, pd := range pctx.PipelineDirs {
+	for _, pd := range pipelineDirs {
 		log.Debugf("trying to load pipeline %q from %q", uses, pd)
 		data, err = loadPipelineData(pd, uses)
 		if err == nil {
@@ -246,10 +255,35 @@ func (pctx *PipelineContext) loadUse(ctx context.Context, pb *PipelineBuild, use
 		log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
 		data, err = f.ReadFile("pipelines/" + uses + ".yaml")
 		if err != nil {
-			return fmt.Errorf("unable to load pipeline: %w", err)
+			return nil, fmt.Errorf("unable to load pipeline: %w", err)
 		}
 	}
 
+	return data, nil
+}
+
+// PipelineInputs returns the inputs of the pipeline uses, from the first of
+// pipelineDirs which has it or from the built-in pipelines.
+func PipelineInputs(ctx context.Context, pipelineDirs []string, uses string) (map[string]config.Input, error) {
+	data, err := readPipeline(ctx, pipelineDirs, uses)
+	if err != nil {
+		return nil, err
+	}
+
+	p := config.Pipeline{}
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
+	}
+
+	return p.Inputs, nil
+}
+
+func (pctx *PipelineContext) loadUse(ctx context.Context, pb *PipelineBuild, uses string, with map[string]string) error {
+	data, err := readPipeline(ctx, pctx.PipelineDirs, uses)
+	if err != nil {
+		return err
+	}
+
 	if err := yaml.Unmarshal(data, &pctx.Pipeline); err != nil {
 		return fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
 	}
@@ -296,6 +330,21 @@ func (pctx *PipelineContext) evalUse(ctx context.Context, pb *PipelineBuild) err
 	}
 	spctx.Pipeline.WorkDir = pctx.Pipeline.WorkDir
 
+	// The network access set by the step overrides the one of the pipeline
+	// it uses.
+	spctx.network = pctx.network
+	if pctx.Pipeline.Network != nil {
+		spctx.Pipeline.Network = pctx.Pipeline.Network
+	}
+	spctx.limits = pctx.limits
+	if pctx.Pipeline.Limits != nil {
+		spctx.Pipeline.Limits = pctx.Pipeline.Limits
+	}
+	spctx.retries, spctx.retryOn = pctx.retries, pctx.retryOn
+	if pctx.Pipeline.Retries > 0 {
+		spctx.Pipeline.Retries, spctx.Pipeline.RetryOn = pctx.Pipeline.Retries, pctx.Pipeline.RetryOn
+	}
+
 	log.Debugf("  using %s", pctx.Pipeline.Uses)
 	spctx.dumpWith(ctx)
 
@@ -318,7 +367,7 @@ func (pctx *PipelineContext) buildEvalRunCommand(debugOption rune, sysPath strin
 	for k, v := range pctx.Pipeline.Environment {
 		envArr = append(envArr, fmt.Sprintf(envExport, k, v))
 	}
-	envString := strings.Join(envArr, "\n")
+	envString := strings.Join(append(pctx.limitCommands(), envArr...), "\n")
 	script := fmt.Sprintf(`set -e%c
 export PATH='%s'
 %s
@@ -329,6 +378,28 @@ exit 0`, debugOption, sysPath, envString, workdir, workdir, workdir, fragment)
 	return []string{"/bin/sh", "-c", script}
 }
 
+// limitCommands returns the ulimit commands which enforce the resource
+// limits of a step.  The memory limit is on the data segment, which unlike
+// the address space does not count the memory reserved but never written,
+// as by the heaps of the JVM and Go.
+func (pctx *PipelineContext) limitCommands() []string {
+	if pctx.limits == nil {
+		return nil
+	}
+
+	cmds := []string{}
+	if pctx.limits.Memory != "" {
+		// The limit was validated with the configuration.
+		q := resource.MustParse(pctx.limits.Memory)
+		cmds = append(cmds, fmt.Sprintf("ulimit -d %d", q.Value()/1024))
+	}
+	if to := pctx.limits.CPUTime; to > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -t %d", int64(math.Ceil(to.Seconds()))))
+	}
+
+	return cmds
+}
+
 func (pctx *PipelineContext) evalRun(ctx context.Context, pb *PipelineBuild) error {
 	var err error
 	pctx.Pipeline.With, err = MutateWith(pb, pctx.Pipeline.With)
@@ -343,6 +414,10 @@ func (pctx *PipelineContext) evalRun(ctx context.Context, pb *PipelineBuild) err
 	}
 
 	sysPath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	if pb.Build != nil && pb.Build.CompilerCacheDir != "" {
+		// The compiler wrappers of ccache come first, if it is installed.
+		sysPath = ccacheBinDir + ":" + sysPath
+	}
 
 	workdir := "/home/build"
 	if pctx.Pipeline.WorkDir != "" {
@@ -365,15 +440,87 @@ func (pctx *PipelineContext) evalRun(ctx context.Context, pb *PipelineBuild) err
 		defer stop()
 	}
 
+	cfg := pctx.stepConfig(ctx, pb)
 	command := pctx.buildEvalRunCommand(debugOption, sysPath, workdir, fragment)
-	if err := pb.GetRunner().Run(ctx, pctx.WorkspaceConfig, command...); err != nil {
-		return pctx.maybeDebug(ctx, pb, command, err)
+	if err := pctx.runWithRetries(ctx, pb, cfg, command); err != nil {
+		return failure.Wrap(stepFailure(err), pctx.maybeDebug(ctx, pb, cfg, command, pctx.debugCommand(sysPath, workdir, fragment), err))
 	}
 
 	return nil
 }
 
-func (pctx *PipelineContext) maybeDebug(ctx context.Context, pb *PipelineBuild, cmd []string, runErr error) error {
+// The exit statuses of sysexits.h which steps use to report failures which
+// are not breakages of the build, as the fetch and git-checkout pipelines do.
+const (
+	exitDataErr  = 65
+	exitTempFail = 75
+)
+
+// stepFailure returns the kind of failure of a step which failed with err:
+// a step exiting with EX_TEMPFAIL failed to fetch something, and one
+// exiting with EX_DATAERR fetched something which did not match its
+// checksum.
+func stepFailure(err error) failure.Kind {
+	var exitErr *container.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.Code {
+		case exitTempFail:
+			return failure.Fetch
+		case exitDataErr:
+			return failure.Checksum
+		}
+	}
+
+	return failure.Pipeline
+}
+
+// failedStepScript is where the script of a failed step is saved in the
+// build environment when debugging interactively.
+const failedStepScript = "/tmp/melange-failed-step.sh"
+
+// debugCommand returns the command which saves the script of a failed step
+// and opens a shell in the environment and working directory of the step.
+func (pctx *PipelineContext) debugCommand(sysPath, workdir, fragment string) []string {
+	env := []string{fmt.Sprintf("export PATH='%s'", sysPath)}
+	for k, v := range pctx.Pipeline.Environment {
+		env = append(env, fmt.Sprintf("export %s='%s'", k, v))
+	}
+	sort.Strings(env[1:])
+
+	script := fmt.Sprintf(`printf '%%s\n' "$1" > %s
+%s
+[ -d '%s' ] || mkdir -p '%s'
+cd '%s'
+exec /bin/sh`, failedStepScript, strings.Join(env, "\n"), workdir, workdir, workdir)
+
+	return []string{"/bin/sh", "-c", script, "sh", "set -e\n" + fragment}
+}
+
+// isTerminal returns whether f is a terminal, which interactive debugging
+// needs.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// stepConfig returns the configuration of the workspace for a step, which
+// only has network access if the step does.  Tests keep the network access
+// of their workspace.
+func (pctx *PipelineContext) stepConfig(ctx context.Context, pb *PipelineBuild) *container.Config {
+	if pb.Test != nil || pctx.WorkspaceConfig == nil {
+		return pctx.WorkspaceConfig
+	}
+
+	cfg := *pctx.WorkspaceConfig
+	cfg.Capabilities.Networking = cfg.Capabilities.Networking && pctx.network
+	if cfg.Capabilities.Networking {
+		clog.FromContext(ctx).Infof("step %q has network access", pctx.Identity())
+	}
+
+	return &cfg
+}
+
+func (pctx *PipelineContext) maybeDebug(ctx context.Context, pb *PipelineBuild, cfg *container.Config, cmd, debugCmd []string, runErr error) error {
 	if !pb.Interactive() {
 		return runErr
 	}
@@ -382,12 +529,19 @@ func (pctx *PipelineContext) maybeDebug(ctx context.Context, pb *PipelineBuild,
 
 	dbg, ok := pb.GetRunner().(container.Debugger)
 	if !ok {
-		log.Errorf("TODO: Implement Debug() for Runner: %T", pb.GetRunner())
+		log.Warnf("the %s runner does not support interactive debugging", pb.GetRunner().Name())
+		return runErr
+	}
+
+	if !isTerminal(os.Stdin) {
+		log.Warnf("not debugging interactively, as stdin is not a terminal")
 		return runErr
 	}
 
 	log.Errorf("Step failed: %v\n%s", runErr, strings.Join(cmd, " "))
-	log.Infof("Execing into pod %q to debug interactively.", pctx.WorkspaceConfig.PodID)
+	log.Infof("Execing into pod %q to debug interactively.", cfg.PodID)
+	log.Infof("The shell is in the working directory of the step, with its environment. The workspace is mounted at /home/build.")
+	log.Infof("The script of the step is saved in %s; run 'sh -x %s' to retry it.", failedStepScript, failedStepScript)
 	log.Infof("Type 'exit 0' to continue the next pipeline step or 'exit 1' to abort.")
 
 	// If the context has already been cancelled, return before we mess with it.
@@ -398,7 +552,7 @@ func (pctx *PipelineContext) maybeDebug(ctx context.Context, pb *PipelineBuild,
 	// Don't cancel the context if we hit ctrl+C while debugging.
 	signal.Ignore(os.Interrupt)
 
-	if dbgErr := dbg.Debug(ctx, pctx.WorkspaceConfig, "/bin/sh"); dbgErr != nil {
+	if dbgErr := dbg.Debug(ctx, cfg, debugCmd...); dbgErr != nil {
 		return fmt.Errorf("failed to debug: %w; original error: %w", dbgErr, runErr)
 	}
 
@@ -467,7 +621,36 @@ func (pctx *PipelineContext) Run(ctx context.Context, pb *PipelineBuild) (bool,
 		return false, nil
 	}
 
+	if pctx.Pipeline.Network != nil {
+		pctx.network = *pctx.Pipeline.Network
+	}
+	if pctx.Pipeline.Limits != nil {
+		pctx.limits = pctx.Pipeline.Limits
+	}
+	if pctx.Pipeline.Retries > 0 {
+		pctx.retries, pctx.retryOn = pctx.Pipeline.Retries, pctx.Pipeline.RetryOn
+	}
+
+	var timeout error
+	if to := pctx.Pipeline.Timeout; to > 0 {
+		timeout = fmt.Errorf("step %q exceeded its timeout of %s", pctx.Identity(), to)
+		tctx, cancel := context.WithTimeoutCause(ctx, to, timeout)
+		defer cancel()
+		ctx = tctx
+	}
+
+	if pb.Build != nil {
+		args := map[string]any{}
+		if pb.Subpackage != nil {
+			args["subpackage"] = pb.Subpackage.Name
+		}
+		defer pb.Build.profile.begin(profileStep, pctx.Identity(), args)()
+	}
+
 	if err := pctx.evaluateBranch(ctx, pb); err != nil {
+		if timeout != nil && context.Cause(ctx) == timeout {
+			return false, fmt.Errorf("%w: %w", timeout, err)
+		}
 		return false, err
 	}
 
@@ -476,10 +659,16 @@ func (pctx *PipelineContext) Run(ctx context.Context, pb *PipelineBuild) (bool,
 		if spctx.Pipeline.WorkDir == "" {
 			spctx.Pipeline.WorkDir = pctx.Pipeline.WorkDir
 		}
+		spctx.network = pctx.network
+		spctx.limits = pctx.limits
+		spctx.retries, spctx.retryOn = pctx.retries, pctx.retryOn
 
 		ran, err := spctx.Run(ctx, pb)
 
 		if err != nil {
+			if timeout != nil && context.Cause(ctx) == timeout {
+				return false, fmt.Errorf("%w: %w", timeout, err)
+			}
 			return false, err
 		}
 
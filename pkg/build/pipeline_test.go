@@ -15,15 +15,26 @@
 package build
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/failure"
 	"chainguard.dev/melange/pkg/util"
 
+	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/clog/slogtest"
 	"github.com/stretchr/testify/require"
 )
@@ -173,6 +184,23 @@ exit 0`}
 	require.Equal(t, command, expected)
 }
 
+func Test_debugCommand(t *testing.T) {
+	p := &config.Pipeline{
+		Environment: map[string]string{"FOO": "bar"},
+	}
+
+	pctx := NewPipelineContext(p, nil, nil, []string{})
+
+	command := pctx.debugCommand("/foo", "/bar", "baz")
+	expected := []string{"/bin/sh", "-c", `printf '%s\n' "$1" > /tmp/melange-failed-step.sh
+export PATH='/foo'
+export FOO='bar'
+[ -d '/bar' ] || mkdir -p '/bar'
+cd '/bar'
+exec /bin/sh`, "sh", "set -e\nbaz"}
+	require.Equal(t, expected, command)
+}
+
 func TestAllPipelines(t *testing.T) {
 	// Get all the yamls in pipelines/*/*.yaml and test that they unmarshal
 	pipelines, err := filepath.Glob("pipelines/*/*.yaml")
@@ -192,3 +220,506 @@ func TestAllPipelines(t *testing.T) {
 		})
 	}
 }
+
+func Test_builtinPipelinesNetwork(t *testing.T) {
+	// Only the pipelines which fetch the sources have network access: the
+	// ones which compile them have to be given it by the build file.
+	pipelines, err := filepath.Glob("pipelines/*.yaml")
+	require.NoError(t, err)
+	nested, err := filepath.Glob("pipelines/*/*.yaml")
+	require.NoError(t, err)
+
+	online := []string{}
+	for _, p := range append(pipelines, nested...) {
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		pipeline := config.Pipeline{}
+		require.NoError(t, yaml.Unmarshal(data, &pipeline), p)
+		if pipeline.Network != nil && *pipeline.Network {
+			online = append(online, strings.TrimPrefix(p, "pipelines/"))
+		}
+	}
+	require.ElementsMatch(t, []string{"fetch.yaml", "git-checkout.yaml"}, online)
+}
+
+func Test_MutateWithVars(t *testing.T) {
+	pb := &PipelineBuild{
+		Package: &config.Package{Name: "foo", Version: "1.2.3"},
+		Build: &Build{
+			Arch: apko_types.ParseArchitecture("aarch64"),
+			Configuration: config.Configuration{
+				Environment: apko_types.ImageConfiguration{
+					Environment: map[string]string{"FLAVOR": "gnu"},
+				},
+				Vars: map[string]string{
+					"tarball": "${{package.name}}-${{vars.underscored}}-${{build.arch}}.tar.gz",
+				},
+				VarTransforms: []config.VarTransforms{{
+					From:    "${{package.version}}",
+					Match:   `\.`,
+					Replace: "_",
+					To:      "underscored",
+				}},
+			},
+		},
+	}
+
+	got, err := MutateWith(pb, map[string]string{
+		"uri":    "https://example.com/${{vars.tarball}}",
+		"flavor": "${{env.FLAVOR}}",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/foo-1_2_3-aarch64.tar.gz", got["${{inputs.uri}}"])
+	require.Equal(t, "gnu", got["${{inputs.flavor}}"])
+}
+
+func Test_conditions(t *testing.T) {
+	for _, arch := range []string{"x86_64", "riscv64"} {
+		pkg := &config.Package{
+			Name:    "foo",
+			Version: "1.2.3",
+			If:      "${{build.arch}} != 'riscv64'",
+		}
+		sp := config.Subpackage{
+			Name: "foo-systemd",
+			If:   "${{build.arch}} == 'x86_64' && ${{vars.systemd}} == 'yes'",
+		}
+		cfg := config.Configuration{
+			Vars: map[string]string{"systemd": "yes"},
+		}
+		want := arch == "x86_64"
+
+		build := &PipelineBuild{
+			Package: pkg,
+			Build:   &Build{Arch: apko_types.ParseArchitecture(arch), Configuration: cfg},
+		}
+		test := &PipelineBuild{
+			Package: pkg,
+			Test:    &Test{Arch: apko_types.ParseArchitecture(arch), Configuration: cfg},
+		}
+		for _, pb := range []*PipelineBuild{build, test} {
+			got, err := pb.ShouldBuild()
+			require.NoError(t, err)
+			require.Equal(t, want, got, arch)
+
+			got, err = pb.ShouldRun(sp)
+			require.NoError(t, err)
+			require.Equal(t, want, got, arch)
+		}
+	}
+}
+
+// networkRunner records the network access of each step it runs.
+type networkRunner struct {
+	container.Runner
+	network []bool
+}
+
+func (r *networkRunner) Run(_ context.Context, cfg *container.Config, _ ...string) error {
+	r.network = append(r.network, cfg.Capabilities.Networking)
+	return nil
+}
+
+func Test_network(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "download.yaml"), []byte(`
+network: true
+pipeline:
+  - runs: wget https://example.com
+`), 0o644))
+
+	yes, no := true, false
+	p := &config.Pipeline{
+		Pipeline: []config.Pipeline{
+			{Runs: "make"},
+			{Uses: "download"},
+			{Uses: "download", Network: &no},
+			{Network: &yes, Pipeline: []config.Pipeline{
+				{Runs: "go mod download"},
+				{Runs: "go build", Network: &no},
+			}},
+			{Runs: "make install"},
+		},
+	}
+	pkg := &config.Package{Name: "foo", Version: "1.2.3"}
+
+	runner := &networkRunner{}
+	cfg := &container.Config{Capabilities: container.Capabilities{Networking: true}}
+	pb := &PipelineBuild{
+		Package: pkg,
+		Build:   &Build{Runner: runner},
+	}
+	_, err := NewPipelineContext(p, nil, cfg, []string{dir}).Run(ctx, pb)
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, false, true, false, false}, runner.network)
+	require.True(t, cfg.Capabilities.Networking, "the workspace config is unchanged")
+
+	runner = &networkRunner{}
+	pb = &PipelineBuild{
+		Package: pkg,
+		Test:    &Test{Runner: runner},
+	}
+	_, err = NewPipelineContext(p, nil, cfg, []string{dir}).Run(ctx, pb)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true, true, true}, runner.network, "tests keep network access")
+}
+
+// limitsRunner records the scripts of the steps it runs, and blocks on the
+// ones which sleep until they are cancelled.
+type limitsRunner struct {
+	container.Runner
+	scripts []string
+}
+
+func (r *limitsRunner) Run(ctx context.Context, _ *container.Config, args ...string) error {
+	script := args[len(args)-1]
+	r.scripts = append(r.scripts, script)
+	if strings.Contains(script, "sleep") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func Test_limits(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	p := &config.Pipeline{
+		Limits: &config.Limits{Memory: "2Gi", CPUTime: 90 * time.Minute},
+		Pipeline: []config.Pipeline{
+			{Runs: "make"},
+			{Runs: "make check", Limits: &config.Limits{Memory: "512Mi"}},
+		},
+	}
+	pb := &PipelineBuild{
+		Package: &config.Package{Name: "foo", Version: "1.2.3"},
+		Build:   &Build{Runner: &limitsRunner{}},
+	}
+	runner := pb.Build.Runner.(*limitsRunner)
+	_, err := NewPipelineContext(p, nil, &container.Config{}, nil).Run(ctx, pb)
+	require.NoError(t, err)
+	require.Len(t, runner.scripts, 2)
+	require.Contains(t, runner.scripts[0], "ulimit -d 2097152\nulimit -t 5400\n")
+	require.Contains(t, runner.scripts[1], "ulimit -d 524288\n")
+	require.NotContains(t, runner.scripts[1], "ulimit -t")
+
+	p = &config.Pipeline{
+		Pipeline: []config.Pipeline{
+			{Name: "test suite", Runs: "sleep infinity", Timeout: 10 * time.Millisecond},
+			{Runs: "make install"},
+		},
+	}
+	_, err = NewPipelineContext(p, nil, &container.Config{}, nil).Run(ctx, pb)
+	require.ErrorContains(t, err, `step "test suite" exceeded its timeout of 10ms`)
+	require.Len(t, runner.scripts, 3, "the steps after the timeout do not run")
+}
+
+// flakyRunner fails the steps it runs with their exit code and output until
+// they ran as many times as they need.
+type flakyRunner struct {
+	container.Runner
+	runs  map[string]int
+	needs map[string]int
+}
+
+func (r *flakyRunner) Run(ctx context.Context, _ *container.Config, args ...string) error {
+	script := args[len(args)-1]
+	for cmd, needs := range r.needs {
+		if !strings.Contains(script, cmd) {
+			continue
+		}
+		r.runs[cmd]++
+		if r.runs[cmd] < needs {
+			code, output, _ := strings.Cut(cmd, " ")
+			clog.FromContext(ctx).Warn(output)
+			c, _ := strconv.Atoi(code)
+			return &container.ExitError{Code: c}
+		}
+	}
+	return nil
+}
+
+func Test_retries(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = 10 * time.Second })
+
+	p := &config.Pipeline{
+		Retries: 2,
+		Pipeline: []config.Pipeline{
+			{Runs: "1 flaky test"},
+			{Runs: "75 connection reset", RetryOn: &config.RetryOn{ExitCodes: []int{75}}, Retries: 1},
+			{Runs: "2 TLS handshake timeout", RetryOn: &config.RetryOn{Output: "timeout$"}, Retries: 3},
+		},
+	}
+	runner := &flakyRunner{runs: map[string]int{}, needs: map[string]int{
+		"1 flaky test":            3,
+		"75 connection reset":     2,
+		"2 TLS handshake timeout": 4,
+	}}
+	pb := &PipelineBuild{
+		Package: &config.Package{Name: "foo", Version: "1.2.3"},
+		Build:   &Build{Runner: runner},
+	}
+	_, err := NewPipelineContext(p, nil, &container.Config{}, nil).Run(ctx, pb)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"1 flaky test":            3,
+		"75 connection reset":     2,
+		"2 TLS handshake timeout": 4,
+	}, runner.runs)
+
+	// The failures retry-on does not select, and those left after the
+	// retries, fail the step.
+	for _, tc := range []struct {
+		step  config.Pipeline
+		needs int
+		runs  int
+	}{
+		{config.Pipeline{Runs: "1 flaky test", Retries: 2}, 4, 3},
+		{config.Pipeline{Runs: "1 flaky test", Retries: 2, RetryOn: &config.RetryOn{ExitCodes: []int{75}}}, 2, 1},
+		{config.Pipeline{Runs: "1 flaky test", Retries: 2, RetryOn: &config.RetryOn{Output: "timeout"}}, 2, 1},
+	} {
+		runner := &flakyRunner{runs: map[string]int{}, needs: map[string]int{tc.step.Runs: tc.needs}}
+		pb.Build.Runner = runner
+		_, err := NewPipelineContext(&tc.step, nil, &container.Config{}, nil).Run(ctx, pb)
+		require.ErrorContains(t, err, "command exited with status 1")
+		require.Equal(t, tc.runs, runner.runs[tc.step.Runs])
+	}
+}
+
+func Test_stepFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want failure.Kind
+	}{
+		{&container.ExitError{Code: 1}, failure.Pipeline},
+		{fmt.Errorf("running step: %w", &container.ExitError{Code: 75}), failure.Fetch},
+		{&container.ExitError{Code: 65}, failure.Checksum},
+		{context.DeadlineExceeded, failure.Pipeline},
+	} {
+		require.Equal(t, tc.want, stepFailure(tc.err), "%v", tc.err)
+	}
+}
+
+// hostRunner runs the steps on the host with bash, with bin first in their
+// PATH.
+type hostRunner struct {
+	container.Runner
+	bash, bin string
+}
+
+func (r *hostRunner) Run(ctx context.Context, _ *container.Config, args ...string) error {
+	script := strings.Replace(args[len(args)-1], "export PATH='", "export PATH='"+r.bin+":", 1)
+	cmd := exec.CommandContext(ctx, r.bash, "-c", script)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	var ee *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &ee) {
+		return &container.ExitError{Code: ee.ExitCode()}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func Test_fetchFallback(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum is not installed")
+	}
+
+	const (
+		digest = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // hello
+		origin = "https://example.com/hello-1.0.tar.gz"
+		swh    = "https://archive.softwareheritage.org/api/1/content/sha256:" + digest + "/raw/"
+	)
+
+	// wget serves the URLs of served, records those it is asked for, and
+	// fails on the others.
+	fetch := func(t *testing.T, with map[string]string, served map[string]string) ([]string, string, error) {
+		bin, work := t.TempDir(), t.TempDir()
+		log := filepath.Join(bin, "requests")
+		wget := "#!/bin/sh\nout=\nwhile [ $# -gt 1 ]; do\n  [ \"$1\" = -O ] && { out=$2; shift; }\n  shift\ndone\n" +
+			"[ -n \"$out\" ] || out=$(basename \"$1\")\necho \"$1\" >> " + log + "\ncase \"$1\" in\n"
+		for url, data := range served {
+			wget += fmt.Sprintf("  '%s') printf '%s' > \"$out\" ;;\n", url, data)
+		}
+		wget += "  *) exit 4 ;;\nesac\n"
+		require.NoError(t, os.WriteFile(filepath.Join(bin, "wget"), []byte(wget), 0o755))
+
+		with["uri"] = origin
+		with["expected-sha256"] = digest
+		with["extract"] = "false"
+		p := &config.Pipeline{Uses: "fetch", With: with, WorkDir: work}
+		pb := &PipelineBuild{
+			Package: &config.Package{Name: "hello", Version: "1.0"},
+			Build:   &Build{Runner: &hostRunner{bash: bash, bin: bin}},
+		}
+		_, err := NewPipelineContext(p, nil, &container.Config{}, nil).Run(ctx, pb)
+
+		requests, _ := os.ReadFile(log)
+		fetched, _ := os.ReadFile(filepath.Join(work, "hello-1.0.tar.gz"))
+		return strings.Fields(string(requests)), string(fetched), err
+	}
+
+	t.Run("mirror", func(t *testing.T) {
+		// A mirror with the wrong artifact is skipped for the next one.
+		requests, fetched, err := fetch(t, map[string]string{
+			"mirrors": "https://bad.example.com/{algo}/{digest} https://good.example.com/{algo}/{digest}",
+		}, map[string]string{
+			"https://bad.example.com/sha256/" + digest:  "goodbye",
+			"https://good.example.com/sha256/" + digest: "hello",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{origin, "https://bad.example.com/sha256/" + digest, "https://good.example.com/sha256/" + digest}, requests)
+		require.Equal(t, "hello", fetched)
+	})
+
+	t.Run("software heritage", func(t *testing.T) {
+		requests, fetched, err := fetch(t, map[string]string{"archive-fallback": "true"}, map[string]string{swh: "hello"})
+		require.NoError(t, err)
+		require.Equal(t, []string{origin, swh}, requests)
+		require.Equal(t, "hello", fetched)
+	})
+
+	t.Run("no origin", func(t *testing.T) {
+		// Only the artifacts which match the checksum are taken.
+		requests, _, err := fetch(t, map[string]string{
+			"mirrors":          "https://bad.example.com/{algo}/{digest}",
+			"archive-fallback": "true",
+		}, map[string]string{
+			"https://bad.example.com/sha256/" + digest: "goodbye",
+			swh: "goodbye",
+		})
+		require.Equal(t, failure.Fetch, stepFailure(err))
+		require.Equal(t, []string{origin, "https://bad.example.com/sha256/" + digest, swh}, requests)
+
+		// Software Heritage is only tried when it is asked for.
+		requests, _, err = fetch(t, map[string]string{}, map[string]string{swh: "hello"})
+		require.Equal(t, failure.Fetch, stepFailure(err))
+		require.Equal(t, []string{origin}, requests)
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		// The artifact of the origin is verified too, and not replaced by
+		// one of a mirror.
+		requests, _, err := fetch(t, map[string]string{
+			"mirrors": "https://good.example.com/{algo}/{digest}",
+		}, map[string]string{
+			origin: "goodbye",
+			"https://good.example.com/sha256/" + digest: "hello",
+		})
+		require.Equal(t, failure.Checksum, stepFailure(err))
+		require.Equal(t, []string{origin}, requests)
+	})
+}
+
+func Test_gitCheckoutFlags(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	const (
+		repository = "https://example.com/hello.git"
+		commit     = "6e9ba5a01e1e19d4f9e4d2b1e2e2b0b9a1d5d0c4"
+	)
+
+	// git records the commands it is asked to run, other than those which
+	// configure it, and resolves every revision to commit.
+	checkout := func(t *testing.T, with map[string]string) []string {
+		bin, work := t.TempDir(), t.TempDir()
+		log := filepath.Join(bin, "commands")
+		git := "#!/bin/sh\n[ \"$1\" = config ] && exit 0\necho \"$*\" >> " + log + "\n" +
+			"[ \"$1\" = rev-parse ] && echo " + commit + "\nexit 0\n"
+		require.NoError(t, os.WriteFile(filepath.Join(bin, "git"), []byte(git), 0o755))
+
+		with["repository"] = repository
+		p := &config.Pipeline{Uses: "git-checkout", With: with, WorkDir: work}
+		pb := &PipelineBuild{
+			Package: &config.Package{Name: "hello", Version: "1.0"},
+			Build:   &Build{Runner: &hostRunner{bash: bash, bin: bin}},
+		}
+		_, err := NewPipelineContext(p, nil, &container.Config{}, nil).Run(ctx, pb)
+		require.NoError(t, err)
+
+		commands, err := os.ReadFile(log)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(commands)), "\n")
+	}
+
+	// clone returns the arguments of the clone command, without the
+	// directory it clones to.
+	clone := func(t *testing.T, commands []string) string {
+		t.Helper()
+		require.NotEmpty(t, commands)
+		args, ok := strings.CutPrefix(commands[0], "clone ")
+		require.True(t, ok, commands[0])
+		return args[:strings.LastIndex(args, " ")]
+	}
+
+	for _, tc := range []struct {
+		name string
+		with map[string]string
+		want string
+	}{{
+		// Like before the inputs were added, a shallow clone without
+		// the submodules.
+		name: "defaults",
+		with: map[string]string{"tag": "v1.0"},
+		want: "--branch v1.0 --depth 1 " + repository,
+	}, {
+		name: "depth",
+		with: map[string]string{"tag": "v1.0", "depth": "10"},
+		want: "--branch v1.0 --depth 10 " + repository,
+	}, {
+		name: "full history",
+		with: map[string]string{"tag": "v1.0", "depth": "-1"},
+		want: "--branch v1.0 " + repository,
+	}, {
+		name: "submodules",
+		with: map[string]string{"branch": "main", "recurse-submodules": "true"},
+		want: "--recurse-submodules --branch main --depth 1 " + repository,
+	}, {
+		name: "shallow submodules",
+		with: map[string]string{"branch": "main", "recurse-submodules": "true", "shallow-submodules": "true"},
+		want: "--recurse-submodules --shallow-submodules --branch main --depth 1 " + repository,
+	}, {
+		// shallow-submodules alone does not clone the submodules.
+		name: "shallow submodules only",
+		with: map[string]string{"branch": "main", "shallow-submodules": "true"},
+		want: "--branch main --depth 1 " + repository,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, clone(t, checkout(t, tc.with)))
+		})
+	}
+
+	t.Run("pinned commit", func(t *testing.T) {
+		// The commit is fetched alone, and its submodules updated after
+		// it is checked out.
+		commands := checkout(t, map[string]string{"expected-commit": commit})
+		require.Contains(t, commands, "fetch --depth 1 origin "+commit)
+		require.NotContains(t, strings.Join(commands, "\n"), "submodule")
+
+		commands = checkout(t, map[string]string{
+			"expected-commit":    commit,
+			"depth":              "-1",
+			"recurse-submodules": "true",
+			"shallow-submodules": "true",
+		})
+		require.Contains(t, commands, "fetch origin "+commit)
+		require.Contains(t, commands, "checkout -q FETCH_HEAD")
+		require.Contains(t, commands, "submodule update --init --recursive --depth 1")
+
+		commands = checkout(t, map[string]string{"expected-commit": commit, "recurse-submodules": "true"})
+		require.Contains(t, commands, "submodule update --init --recursive")
+	})
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/plugin"
+	"chainguard.dev/melange/pkg/sca"
+)
+
+// pluginRequest returns the request sent to the plugins run for pkgName.
+func (b *Build) pluginRequest(pkgName string) plugin.Request {
+	version, epoch := b.Configuration.VersionOf(pkgName)
+	return plugin.Request{
+		Package: plugin.Package{
+			Name:    pkgName,
+			Version: version,
+			Epoch:   epoch,
+			Arch:    b.Arch.ToAPK(),
+			Origin:  b.Configuration.Package.Name,
+		},
+		Path: filepath.Join(b.WorkspaceDir, "melange-out", pkgName),
+	}
+}
+
+// runGeneratorPlugins runs the generator plugins for the package, returning
+// a result for each so they are attributed in the dependency log.  Like
+// those of the built-in generators, the provides and vendored dependencies
+// they find are dropped for packages with no-provides, and the runtime
+// dependencies for packages with no-depends.
+func (pc *PackageBuild) runGeneratorPlugins(ctx context.Context) ([]sca.Result, error) {
+	results := []sca.Result{}
+	for _, p := range plugin.OfKind(pc.Build.plugins, plugin.KindGenerator) {
+		resp, err := p.Run(ctx, pc.Build.pluginRequest(pc.PackageName))
+		if err != nil {
+			return nil, err
+		}
+
+		deps := config.Dependencies{}
+		if !pc.Options.NoDepends {
+			deps.Runtime = resp.Dependencies.Runtime
+		}
+		if !pc.Options.NoProvides {
+			deps.Provides = resp.Dependencies.Provides
+			deps.Vendored = resp.Dependencies.Vendored
+		}
+
+		results = append(results, sca.Result{
+			Generator:    "plugin:" + p.Name,
+			Dependencies: deps,
+		})
+	}
+
+	return results, nil
+}
+
+// runLinterPlugins runs the linter plugins for pkgName and passes each
+// finding to warn.
+func (b *Build) runLinterPlugins(ctx context.Context, pkgName string, warn func(error)) error {
+	for _, p := range plugin.OfKind(b.plugins, plugin.KindLinter) {
+		resp, err := p.Run(ctx, b.pluginRequest(pkgName))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range resp.Findings {
+			if f.Path != "" {
+				warn(fmt.Errorf("%s: %s: %s", p.Name, f.Path, f.Message))
+			} else {
+				warn(fmt.Errorf("%s: %s", p.Name, f.Message))
+			}
+		}
+	}
+
+	return nil
+}
+
+// runSBOMPlugins passes the SBOM of pkgName through the sbom plugins in
+// turn, replacing it with the document each of them returns.
+func (b *Build) runSBOMPlugins(ctx context.Context, pkgName, pkgVersion string) error {
+	sbomPlugins := plugin.OfKind(b.plugins, plugin.KindSBOM)
+	if len(sbomPlugins) == 0 {
+		return nil
+	}
+
+	req := b.pluginRequest(pkgName)
+	path := filepath.Join(req.Path, "var", "lib", "db", "sbom", fmt.Sprintf("%s-%s.spdx.json", pkgName, pkgVersion))
+
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading SBOM: %w", err)
+	}
+
+	for _, p := range sbomPlugins {
+		req.SBOM = doc
+
+		resp, err := p.Run(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		if len(resp.SBOM) != 0 {
+			doc = resp.SBOM
+		}
+	}
+
+	if err := os.WriteFile(path, doc, 0o644); err != nil {
+		return fmt.Errorf("writing SBOM: %w", err)
+	}
+
+	return nil
+}
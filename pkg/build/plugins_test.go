@@ -0,0 +1,88 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/plugin"
+	"chainguard.dev/melange/pkg/sca"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunGeneratorPlugins(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "melange-generator-foo"), []byte(`#!/bin/sh
+cat >/dev/null
+echo '{"version": 1, "dependencies": {"runtime": ["so:libbar.so.1"], "provides": ["cmd:foo=1.0-r0"], "vendored": ["so:libbaz.so.2=2"]}}'
+`), 0o755))
+	plugins, err := plugin.Discover(dir)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name    string
+		options config.PackageOption
+		want    config.Dependencies
+	}{{
+		name: "default",
+		want: config.Dependencies{
+			Runtime:  []string{"so:libbar.so.1"},
+			Provides: []string{"cmd:foo=1.0-r0"},
+			Vendored: []string{"so:libbaz.so.2=2"},
+		},
+	}, {
+		name:    "no-provides",
+		options: config.PackageOption{NoProvides: true},
+		want: config.Dependencies{
+			Runtime: []string{"so:libbar.so.1"},
+		},
+	}, {
+		name:    "no-depends",
+		options: config.PackageOption{NoDepends: true},
+		want: config.Dependencies{
+			Provides: []string{"cmd:foo=1.0-r0"},
+			Vendored: []string{"so:libbaz.so.2=2"},
+		},
+	}, {
+		name:    "both",
+		options: config.PackageOption{NoProvides: true, NoDepends: true},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := &PackageBuild{
+				Build: &Build{
+					plugins:      plugins,
+					WorkspaceDir: t.TempDir(),
+				},
+				PackageName: "foo",
+				Options:     tt.options,
+			}
+
+			results, err := pc.runGeneratorPlugins(ctx)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.Equal(t, "plugin:foo", results[0].Generator)
+
+			generated := config.Dependencies{}
+			sca.MergeResults(results, &generated)
+			require.Equal(t, tt.want, generated)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Categories of the events in a profile.
+const (
+	profilePhase = "phase"
+	profileStep  = "step"
+	profileEmit  = "emit"
+)
+
+// traceEvent is an event in the Chrome trace event format, which can be
+// loaded in chrome://tracing or https://ui.perfetto.dev.
+type traceEvent struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat,omitempty"`
+	Ph   string `json:"ph"`
+	// The start of the event, in microseconds
+	Ts int64 `json:"ts"`
+	// The duration of the event, in microseconds
+	Dur  int64          `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// profiler records how long each phase of a build, pipeline step and
+// package emission phase took, along with the CPU time it used.
+type profiler struct {
+	start time.Time
+
+	mu     sync.Mutex
+	events []traceEvent
+}
+
+func newProfiler(name string) *profiler {
+	return &profiler{
+		start: time.Now(),
+		events: []traceEvent{{
+			Name: "process_name",
+			Ph:   "M",
+			Pid:  1,
+			Args: map[string]any{"name": name},
+		}},
+	}
+}
+
+// cpuTime returns the user and system CPU time used by melange and the
+// processes it waited for, which includes the commands run by the local
+// runners.  Commands run in a remote container are not accounted for.
+func cpuTime() (user, system time.Duration) {
+	for _, who := range []int{unix.RUSAGE_SELF, unix.RUSAGE_CHILDREN} {
+		var ru unix.Rusage
+		if err := unix.Getrusage(who, &ru); err != nil {
+			continue
+		}
+		user += time.Duration(ru.Utime.Nano())
+		system += time.Duration(ru.Stime.Nano())
+	}
+
+	return user, system
+}
+
+// begin starts an event, and returns the function which ends it.  It is
+// safe to call on a nil profiler, which records nothing.
+func (p *profiler) begin(cat, name string, args map[string]any) func() {
+	if p == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	user, system := cpuTime()
+
+	return func() {
+		end := time.Now()
+		endUser, endSystem := cpuTime()
+
+		if args == nil {
+			args = map[string]any{}
+		}
+		args["cpu-user"] = (endUser - user).Seconds()
+		args["cpu-system"] = (endSystem - system).Seconds()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.events = append(p.events, traceEvent{
+			Name: name,
+			Cat:  cat,
+			Ph:   "X",
+			Ts:   start.Sub(p.start).Microseconds(),
+			Dur:  end.Sub(start).Microseconds(),
+			Pid:  1,
+			Tid:  1,
+			Args: args,
+		})
+	}
+}
+
+// Write encodes the events recorded so far to path.
+func (p *profiler) Write(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := json.MarshalIndent(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{p.events, "ms"}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding profile: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing profile: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfile(t *testing.T) {
+	// A nil profiler records nothing.
+	var np *profiler
+	np.begin(profileStep, "nothing", nil)()
+
+	p := newProfiler("foo-1.0-r0")
+
+	endEmit := p.begin(profileEmit, "emit", map[string]any{"package": "foo"})
+	endData := p.begin(profileEmit, "data tar", nil)
+	time.Sleep(2 * time.Millisecond)
+	endData()
+	endEmit()
+
+	path := filepath.Join(t.TempDir(), "profile.json")
+	require.NoError(t, p.Write(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	got := struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &got))
+	require.Len(t, got.TraceEvents, 3)
+
+	meta, tar, emit := got.TraceEvents[0], got.TraceEvents[1], got.TraceEvents[2]
+	require.Equal(t, "M", meta.Ph)
+	require.Equal(t, "foo-1.0-r0", meta.Args["name"])
+
+	require.Equal(t, "data tar", tar.Name)
+	require.Equal(t, "X", tar.Ph)
+	require.GreaterOrEqual(t, tar.Dur, int64(2000))
+	require.Contains(t, tar.Args, "cpu-user")
+	require.Contains(t, tar.Args, "cpu-system")
+
+	// The enclosing event starts first and ends last, so that they nest.
+	require.Equal(t, "emit", emit.Name)
+	require.Equal(t, "foo", emit.Args["package"])
+	require.LessOrEqual(t, emit.Ts, tar.Ts)
+	require.GreaterOrEqual(t, emit.Ts+emit.Dur, tar.Ts+tar.Dur)
+}
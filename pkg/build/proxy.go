@@ -0,0 +1,207 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// caBundlePath is where the CA certificates are read from in the build
+// environment, by OpenSSL and most tools.
+const caBundlePath = "/etc/ssl/certs/ca-certificates.crt"
+
+// hostCABundles are where the CA certificates of the host are looked for,
+// like Go does on Linux.
+var hostCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// proxyEnvironment returns the variables which point the tools of the build
+// environment to the proxy, in both the upper and lower case spellings
+// which they variously read.
+func (b *Build) proxyEnvironment() map[string]string {
+	env := map[string]string{}
+	if b.Proxy == "" {
+		return env
+	}
+
+	vars := map[string]string{
+		"HTTP_PROXY":  b.Proxy,
+		"HTTPS_PROXY": b.Proxy,
+	}
+	if len(b.NoProxy) > 0 {
+		vars["NO_PROXY"] = strings.Join(b.NoProxy, ",")
+	}
+	for k, v := range vars {
+		env[k] = v
+		env[strings.ToLower(k)] = v
+	}
+
+	return env
+}
+
+// readCACertificates reads the CACertificates, which must be PEM files of
+// certificates, into a single bundle.
+func (b *Build) readCACertificates() ([]byte, error) {
+	var bundle bytes.Buffer
+	for _, path := range b.CACertificates {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+
+		certs := 0
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("CA certificate %s: %w", path, err)
+			}
+			if err := pem.Encode(&bundle, block); err != nil {
+				return nil, err
+			}
+			certs++
+		}
+		if certs == 0 {
+			return nil, fmt.Errorf("CA certificate %s holds no PEM certificate", path)
+		}
+	}
+
+	return bundle.Bytes(), nil
+}
+
+// configureProxy points the HTTP clients of melange, and of apko which
+// installs the build environment, to the proxy and makes them trust the CA
+// certificates.  They all take the proxy from the environment of the
+// process, and the certificates from SSL_CERT_FILE, which is set to those of
+// the host followed by the CA certificates.  Go reads both once, so this
+// must happen before anything is fetched.
+func (b *Build) configureProxy() error {
+	if b.Proxy != "" {
+		u, err := url.Parse(b.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("proxy %q must be a URL, e.g. http://proxy.example.com:3128", b.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("proxy %q must be an http, https or socks5 URL", b.Proxy)
+		}
+
+		for k, v := range b.proxyEnvironment() {
+			if err := os.Setenv(k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(b.CACertificates) == 0 {
+		return nil
+	}
+
+	extra, err := b.readCACertificates()
+	if err != nil {
+		return err
+	}
+	b.caCertificates = extra
+
+	dir, l, err := lockedTempDir(b.Runner.TempDir(), "ca-*")
+	if err != nil {
+		return fmt.Errorf("unable to create CA certificates dir: %w", err)
+	}
+	b.caDir = dir
+	b.locks = append(b.locks, l)
+
+	hostBundle := os.Getenv("SSL_CERT_FILE")
+	if hostBundle == "" {
+		for _, path := range hostCABundles {
+			if fileExists(path) {
+				hostBundle = path
+				break
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "host.crt")
+	if err := writeCABundle(path, hostBundle, extra); err != nil {
+		return err
+	}
+
+	return os.Setenv("SSL_CERT_FILE", path)
+}
+
+// installCACertificates writes the CA bundle of the build environment, that
+// of the guest followed by the CA certificates, to be mounted over it.
+// Nothing is written if there are no CA certificates.
+func (b *Build) installCACertificates() error {
+	if b.caDir == "" {
+		return nil
+	}
+
+	return writeCABundle(filepath.Join(b.caDir, "guest.crt"), filepath.Join(b.GuestDir, caBundlePath), b.caCertificates)
+}
+
+// caMounts returns the mount of the CA bundle of the build environment, if
+// installCACertificates wrote it.
+func (b *Build) caMounts() []container.BindMount {
+	if b.caDir == "" {
+		return nil
+	}
+
+	return []container.BindMount{{Source: filepath.Join(b.caDir, "guest.crt"), Destination: caBundlePath, ReadOnly: true}}
+}
+
+// writeCABundle writes the bundle at base, if there is one, followed by
+// extra, to path.
+func writeCABundle(path, base string, extra []byte) error {
+	var bundle []byte
+	if base != "" {
+		data, err := os.ReadFile(base)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("reading CA bundle: %w", err)
+		}
+		bundle = data
+		if len(bundle) > 0 && !bytes.HasSuffix(bundle, []byte("\n")) {
+			bundle = append(bundle, '\n')
+		}
+	}
+	bundle = append(bundle, extra...)
+
+	if err := os.WriteFile(path, bundle, 0o644); err != nil {
+		return fmt.Errorf("unable to write CA bundle: %w", err)
+	}
+
+	return nil
+}
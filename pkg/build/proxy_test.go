@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyEnvironment(t *testing.T) {
+	b := &Build{}
+	require.Empty(t, b.proxyEnvironment())
+
+	b.Proxy = "http://proxy.example.com:3128"
+	b.NoProxy = []string{"localhost", ".internal", "10.0.0.0/8"}
+	require.Equal(t, map[string]string{
+		"HTTP_PROXY":  "http://proxy.example.com:3128",
+		"http_proxy":  "http://proxy.example.com:3128",
+		"HTTPS_PROXY": "http://proxy.example.com:3128",
+		"https_proxy": "http://proxy.example.com:3128",
+		"NO_PROXY":    "localhost,.internal,10.0.0.0/8",
+		"no_proxy":    "localhost,.internal,10.0.0.0/8",
+	}, b.proxyEnvironment())
+
+	for _, k := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(k, "")
+	}
+	require.NoError(t, b.configureProxy())
+	require.Equal(t, "http://proxy.example.com:3128", os.Getenv("HTTPS_PROXY"))
+	require.Equal(t, "localhost,.internal,10.0.0.0/8", os.Getenv("no_proxy"))
+
+	b.Proxy = "proxy.example.com:3128"
+	require.ErrorContains(t, b.configureProxy(), `proxy "proxy.example.com:3128" must be`)
+	b.Proxy = "ftp://proxy.example.com"
+	require.ErrorContains(t, b.configureProxy(), `proxy "ftp://proxy.example.com" must be an http, https or socks5 URL`)
+}
+
+func TestCACertificates(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Example Proxy CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	ca := filepath.Join(dir, "proxy-ca.pem")
+	require.NoError(t, os.WriteFile(ca, append([]byte("# Example Proxy CA\n"), cert...), 0o644))
+	notCA := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(notCA, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")}), 0o644))
+
+	b := &Build{CACertificates: []string{ca}}
+	extra, err := b.readCACertificates()
+	require.NoError(t, err)
+	require.Equal(t, cert, extra)
+
+	b.CACertificates = []string{ca, notCA}
+	_, err = b.readCACertificates()
+	require.ErrorContains(t, err, "holds no PEM certificate")
+
+	// The bundle of the guest comes first, and a missing one is no error.
+	guest := filepath.Join(dir, "guest.crt")
+	require.NoError(t, os.WriteFile(guest, []byte("guest certificates"), 0o644))
+	bundle := filepath.Join(dir, "bundle.crt")
+	require.NoError(t, writeCABundle(bundle, guest, extra))
+	data, err := os.ReadFile(bundle)
+	require.NoError(t, err)
+	require.Equal(t, "guest certificates\n"+string(cert), string(data))
+
+	require.NoError(t, writeCABundle(bundle, filepath.Join(dir, "missing.crt"), extra))
+	data, err = os.ReadFile(bundle)
+	require.NoError(t, err)
+	require.Equal(t, cert, data)
+}
@@ -134,7 +134,7 @@ func (f *rlfs) ListXattrs(path string) (map[string][]byte, error) {
 	return xattrMap, nil
 }
 
-func readlinkFS(dir string) apkofs.ReadLinkFS {
+func readlinkFS(dir string) WorkspaceFS {
 	return &rlfs{
 		base: dir,
 		f:    os.DirFS(dir),
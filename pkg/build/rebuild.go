@@ -0,0 +1,268 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+
+	"chainguard.dev/melange/pkg/util"
+)
+
+// RebuildReportVersion is the version of the rebuild report schema.
+const RebuildReportVersion = 1
+
+// RebuildReport lists the packages of a reference repository which must be
+// rebuilt because the build no longer provides a shared library they need.
+type RebuildReport struct {
+	// The version of the rebuild report schema
+	Version int `json:"version"`
+	// The architecture which was built
+	Arch string `json:"arch"`
+	// The index the build was compared against
+	Reference string `json:"reference"`
+	// The packages whose provided shared libraries changed
+	Changes []SonameChange `json:"changes"`
+	// The packages which must be rebuilt
+	Rebuild []RebuildNeeded `json:"rebuild"`
+}
+
+// SonameChange records the shared libraries a package stopped or started
+// providing, compared to the reference repository.
+type SonameChange struct {
+	// The name of the package
+	Package string `json:"package"`
+	// The shared libraries which are no longer provided, e.g. so:libfoo.so.1
+	Removed []string `json:"removed,omitempty"`
+	// The shared libraries which are newly provided
+	Added []string `json:"added,omitempty"`
+}
+
+// RebuildNeeded is a package of the reference repository which depends on a
+// shared library that is no longer provided.
+type RebuildNeeded struct {
+	// The name of the package
+	Name string `json:"name"`
+	// The version of the package in the reference repository
+	Version string `json:"version"`
+	// The origin of the package, which is what needs to be rebuilt
+	Origin string `json:"origin"`
+	// The removed shared libraries the package depends on
+	Needs []string `json:"needs"`
+}
+
+// sonames returns the shared libraries in a list of provides, without their
+// versions.
+func sonames(provides []string) map[string]bool {
+	names := map[string]bool{}
+	for _, prov := range provides {
+		if name := util.DependencyName(prov); strings.HasPrefix(name, "so:") {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// latestPackages returns the most recently built version of each package.
+func latestPackages(pkgs []*apk.Package) map[string]*apk.Package {
+	latest := map[string]*apk.Package{}
+	for _, pkg := range pkgs {
+		if cur, ok := latest[pkg.Name]; !ok || !pkg.BuildTime.Before(cur.BuildTime) {
+			latest[pkg.Name] = pkg
+		}
+	}
+
+	return latest
+}
+
+// newRebuildReport compares the provides of the packages in the dependency
+// log, which were all built from origin, against the reference packages.
+func newRebuildReport(dl *DependencyLog, origin, reference string, refPackages []*apk.Package) *RebuildReport {
+	r := &RebuildReport{
+		Version:   RebuildReportVersion,
+		Arch:      dl.Arch,
+		Reference: reference,
+		Changes:   []SonameChange{},
+		Rebuild:   []RebuildNeeded{},
+	}
+
+	latest := latestPackages(refPackages)
+
+	provided := map[string]bool{}
+	for _, pkg := range dl.Packages {
+		provides := []string{}
+		for _, prov := range pkg.Provides {
+			provides = append(provides, prov.Name)
+		}
+		for name := range sonames(provides) {
+			provided[name] = true
+		}
+	}
+
+	// Libraries which are still provided by a package from another origin
+	// do not require a rebuild.
+	for _, pkg := range latest {
+		if pkg.Origin == origin {
+			continue
+		}
+		for name := range sonames(pkg.Provides) {
+			provided[name] = true
+		}
+	}
+
+	removed := map[string]bool{}
+	for _, pkg := range dl.Packages {
+		old, ok := latest[pkg.Name]
+		if !ok {
+			continue
+		}
+
+		provides := []string{}
+		for _, prov := range pkg.Provides {
+			provides = append(provides, prov.Name)
+		}
+		before, after := sonames(old.Provides), sonames(provides)
+
+		change := SonameChange{Package: pkg.Name}
+		for name := range before {
+			if !after[name] {
+				change.Removed = append(change.Removed, name)
+				if !provided[name] {
+					removed[name] = true
+				}
+			}
+		}
+		for name := range after {
+			if !before[name] {
+				change.Added = append(change.Added, name)
+			}
+		}
+
+		if len(change.Removed) != 0 || len(change.Added) != 0 {
+			sort.Strings(change.Removed)
+			sort.Strings(change.Added)
+			r.Changes = append(r.Changes, change)
+		}
+	}
+
+	for _, pkg := range latest {
+		if pkg.Origin == origin {
+			continue
+		}
+
+		needs := []string{}
+		for _, dep := range pkg.Dependencies {
+			if name := util.DependencyName(dep); removed[name] {
+				needs = append(needs, name)
+			}
+		}
+
+		if len(needs) != 0 {
+			sort.Strings(needs)
+			r.Rebuild = append(r.Rebuild, RebuildNeeded{
+				Name:    pkg.Name,
+				Version: pkg.Version,
+				Origin:  pkg.Origin,
+				Needs:   needs,
+			})
+		}
+	}
+
+	sort.Slice(r.Rebuild, func(i, j int) bool {
+		return r.Rebuild[i].Name < r.Rebuild[j].Name
+	})
+
+	return r
+}
+
+// openLocation opens a local file, or fetches an http(s) URL.
+func openLocation(ctx context.Context, location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		return os.Open(location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", location, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", location, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// referenceIndex returns the index of the reference repository for arch.
+func referenceIndex(ctx context.Context, repo, arch string) (string, []*apk.Package, error) {
+	path := fmt.Sprintf("%s/%s/APKINDEX.tar.gz", strings.TrimSuffix(repo, "/"), arch)
+
+	rc, err := openLocation(ctx, path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+
+	idx, err := apk.IndexFromArchive(rc)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return path, idx.Packages, nil
+}
+
+// writeRebuildReport compares the built packages against the reference
+// repository and writes the packages which must be rebuilt.
+func (b *Build) writeRebuildReport(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	reference, refPackages, err := referenceIndex(ctx, b.ReferenceRepository, b.Arch.ToAPK())
+	if err != nil {
+		return fmt.Errorf("loading reference repository: %w", err)
+	}
+
+	r := newRebuildReport(b.dependencyLog, b.Configuration.Package.Name, reference, refPackages)
+	for _, rn := range r.Rebuild {
+		log.Warnf("%s must be rebuilt, it needs %s", rn.Origin, strings.Join(rn.Needs, ", "))
+	}
+
+	path := reportPath(b.RebuildReport, b.Arch.ToAPK())
+	log.Infof("writing rebuild report to %s", path)
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding rebuild report: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing rebuild report: %w", err)
+	}
+
+	return nil
+}
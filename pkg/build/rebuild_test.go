@@ -0,0 +1,64 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildReport(t *testing.T) {
+	dl := &DependencyLog{
+		Arch: "x86_64",
+		Packages: []DependencyLogPackage{{
+			Name:     "foo",
+			Provides: []LoggedDependency{{Name: "cmd:foo=2.0-r0"}},
+		}, {
+			Name: "foo-libs",
+			Provides: []LoggedDependency{
+				{Name: "so:libfoo.so.2=2"},
+				{Name: "so:libfoo-util.so.1=1"},
+			},
+		}},
+	}
+
+	old, older := time.Unix(2000, 0), time.Unix(1000, 0)
+	ref := []*apk.Package{
+		{Name: "foo-libs", Origin: "foo", Version: "1.0-r0", BuildTime: old, Provides: []string{"so:libfoo.so.1=1"}},
+		// An older version is ignored.
+		{Name: "foo-libs", Origin: "foo", Version: "0.9-r0", BuildTime: older, Provides: []string{"so:libfoo.so.0=0"}},
+		// libfoo-util moved from foo-util into foo-libs, so it is still provided.
+		{Name: "foo-util", Origin: "foo", Version: "1.0-r0", BuildTime: old, Provides: []string{"so:libfoo-util.so.1=1"}},
+		{Name: "bar", Origin: "bar", Version: "3.0-r1", BuildTime: old, Dependencies: []string{"so:libfoo.so.1", "so:libfoo-util.so.1", "so:libc.so.6"}},
+		{Name: "bar-doc", Origin: "bar", Version: "3.0-r1", BuildTime: old},
+		{Name: "baz", Origin: "baz", Version: "1-r0", BuildTime: old, Dependencies: []string{"so:libfoo.so.0"}},
+		{Name: "qux", Origin: "qux", Version: "1-r0", BuildTime: old, Dependencies: []string{"so:libfoo.so.1"}, Provides: []string{"so:libqux.so.1=1"}},
+	}
+
+	r := newRebuildReport(dl, "foo", "ref/x86_64/APKINDEX.tar.gz", ref)
+	require.Equal(t, RebuildReportVersion, r.Version)
+	require.Equal(t, []SonameChange{{
+		Package: "foo-libs",
+		Removed: []string{"so:libfoo.so.1"},
+		Added:   []string{"so:libfoo-util.so.1", "so:libfoo.so.2"},
+	}}, r.Changes)
+	require.Equal(t, []RebuildNeeded{
+		{Name: "bar", Version: "3.0-r1", Origin: "bar", Needs: []string{"so:libfoo.so.1"}},
+		{Name: "qux", Version: "1-r0", Origin: "qux", Needs: []string{"so:libfoo.so.1"}},
+	}, r.Rebuild)
+}
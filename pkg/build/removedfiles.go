@@ -0,0 +1,183 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// packageFiles returns the paths of the files in the data of an apk, which
+// is a local file or an http(s) URL.
+func packageFiles(ctx context.Context, location string) ([]string, error) {
+	rc, err := openLocation(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, rc, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", location, err)
+	}
+	defer exp.Close()
+
+	files := []string{}
+	if err := fs.WalkDir(exp.TarFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("listing %s: %w", location, err)
+	}
+
+	return files, nil
+}
+
+// sbomDir holds the SBOMs of packages, which are named after their version.
+const sbomDir = "var/lib/db/sbom/"
+
+// removedFiles returns the files of the previous release of a package which
+// no package of the build ships, except for the acknowledged ones.  Files
+// which moved to another package of the build are not removed.
+func removedFiles(previous []string, built []WorkspaceFS, acknowledged []string) ([]string, error) {
+	removed := []string{}
+	for _, path := range previous {
+		if strings.HasPrefix(path, sbomDir) {
+			continue
+		}
+
+		shipped := false
+		for _, fsys := range built {
+			ok, err := lexists(fsys, path)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				shipped = true
+				break
+			}
+		}
+		if shipped {
+			continue
+		}
+
+		ack := false
+		for _, pattern := range acknowledged {
+			ok, err := util.MatchGlob(pattern, path)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				ack = true
+				break
+			}
+		}
+		if !ack {
+			removed = append(removed, path)
+		}
+	}
+
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// checkRemovedFiles compares the files of the packages to be emitted against
+// their latest release in the reference repository, and warns about or fails
+// on the files which are no longer shipped unless the build file
+// acknowledges their removal.
+func (b *Build) checkRemovedFiles(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	reference, refPackages, err := referenceIndex(ctx, b.ReferenceRepository, b.Arch.ToAPK())
+	if err != nil {
+		return fmt.Errorf("loading reference repository: %w", err)
+	}
+	latest := latestPackages(refPackages)
+
+	type builtPackage struct {
+		name    string
+		options config.PackageOption
+	}
+	pkgs := []builtPackage{{b.Configuration.Package.Name, b.Configuration.Package.Options}}
+
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+	for _, sp := range b.Configuration.Subpackages {
+		sp := sp
+		pb.Subpackage = &sp
+		result, err := pb.ShouldRun(sp)
+		if err != nil {
+			return err
+		}
+		if result {
+			pkgs = append(pkgs, builtPackage{sp.Name, sp.Options})
+		}
+	}
+
+	built := []WorkspaceFS{}
+	for _, pkg := range pkgs {
+		fsys, err := b.workspaceFS(pkg.name)
+		if err != nil {
+			return err
+		}
+		built = append(built, fsys)
+	}
+
+	base := strings.TrimSuffix(reference, "APKINDEX.tar.gz")
+	errs := []error{}
+	for _, pkg := range pkgs {
+		prev, ok := latest[pkg.name]
+		if !ok {
+			continue
+		}
+
+		previous, err := packageFiles(ctx, base+prev.Filename())
+		if err != nil {
+			return fmt.Errorf("loading the previous release of %s: %w", pkg.name, err)
+		}
+
+		removed, err := removedFiles(previous, built, pkg.options.RemovedFiles)
+		if err != nil {
+			return fmt.Errorf("comparing %s with its previous release: %w", pkg.name, err)
+		}
+
+		for _, path := range removed {
+			log.Warnf("%s no longer ships %s, which %s-%s did", pkg.name, path, prev.Name, prev.Version)
+		}
+		if len(removed) != 0 {
+			errs = append(errs, fmt.Errorf("%s no longer ships %s of %s-%s; acknowledge their removal with options.removed-files", pkg.name, strings.Join(removed, ", "), prev.Name, prev.Version))
+		}
+	}
+
+	if b.RemovedFiles == "fail" || b.Strict {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+)
+
+func Test_removedFiles(t *testing.T) {
+	outDir := t.TempDir()
+	writeTree(t, filepath.Join(outDir, "foo"), "usr/bin/foo")
+	writeTree(t, filepath.Join(outDir, "foo-dev"), "usr/include/foo.h")
+	// Dangling symlinks are shipped too.
+	require.NoError(t, os.Symlink("foo-missing", filepath.Join(outDir, "foo", "usr", "bin", "foo-link")))
+
+	previous := []string{
+		"usr/bin/foo",
+		"usr/bin/foo-link",
+		"usr/bin/foo-legacy",
+		"usr/bin/foo-config",
+		"usr/include/foo.h",
+		"usr/share/man/man1/foo.1",
+		"var/lib/db/sbom/foo-1.0-r0.spdx.json",
+	}
+	built := []WorkspaceFS{readlinkFS(filepath.Join(outDir, "foo")), readlinkFS(filepath.Join(outDir, "foo-dev"))}
+	removed, err := removedFiles(previous, built, []string{"usr/share/man/**"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"usr/bin/foo-config", "usr/bin/foo-legacy"}, removed)
+}
+
+func Test_checkRemovedFiles(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	repo := t.TempDir()
+	archDir := filepath.Join(repo, "x86_64")
+	require.NoError(t, os.MkdirAll(archDir, 0o755))
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(archDir, "libcap-2.69-r0.apk"), data, 0o644))
+
+	idx, err := index.New(
+		index.WithPackageDir(archDir),
+		index.WithIndexFile(filepath.Join(archDir, "APKINDEX.tar.gz")),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	previous, err := packageFiles(ctx, filepath.Join(archDir, "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	require.Contains(t, previous, "usr/lib/libcap.so.2.69")
+
+	b := &Build{
+		Arch:                apko_types.ParseArchitecture("x86_64"),
+		WorkspaceDir:        t.TempDir(),
+		ReferenceRepository: repo,
+		RemovedFiles:        "fail",
+	}
+	b.Configuration.Package = config.Package{Name: "libcap", Version: "2.70"}
+	b.Configuration.Subpackages = []config.Subpackage{{Name: "libpsx"}}
+	writeTree(t, filepath.Join(b.WorkspaceDir, "melange-out", "libcap"), "usr/lib/libcap.so.2", "usr/lib/libcap.so.2.70")
+	writeTree(t, filepath.Join(b.WorkspaceDir, "melange-out", "libpsx"), "usr/lib/libpsx.so.2", "usr/lib/libpsx.so.2.69")
+
+	err = b.checkRemovedFiles(ctx)
+	require.ErrorContains(t, err, "libcap no longer ships usr/lib/libcap.so.2.69 of libcap-2.69-r0")
+
+	b.Configuration.Package.Options.RemovedFiles = []string{"usr/lib/libcap.so.2.*"}
+	require.NoError(t, b.checkRemovedFiles(ctx))
+
+	b.Configuration.Package.Options.RemovedFiles = nil
+	b.RemovedFiles = "warn"
+	require.NoError(t, b.checkRemovedFiles(ctx))
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/failure"
+	"chainguard.dev/melange/pkg/scan"
+)
+
+// Report is a machine-readable summary of a single build for one
+// architecture, written when a build report path is configured.
+type Report struct {
+	// The name of the origin package
+	Package string `json:"package" yaml:"package"`
+	// The version of the origin package
+	Version string `json:"version" yaml:"version"`
+	// The epoch of the origin package
+	Epoch uint64 `json:"epoch" yaml:"epoch"`
+	// The architecture which was built
+	Arch string `json:"arch" yaml:"arch"`
+	// The packages which were emitted by the build
+	Packages []PackageReport `json:"packages" yaml:"packages"`
+	// The pipeline steps which were run, in the order they were run
+	Steps []StepReport `json:"steps" yaml:"steps"`
+	// The repositories the build environment was installed from, if their
+	// signatures were verified
+	Repositories []RepositoryReport `json:"repositories,omitempty" yaml:"repositories,omitempty"`
+	// The packages which were installed in the build environment
+	Environment []LockedPackage `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// The vulnerabilities the scanner found in the build environment and
+	// the packages, if one was run
+	Vulnerabilities []VulnerabilityReport `json:"vulnerabilities,omitempty" yaml:"vulnerabilities,omitempty"`
+	// How the compiler caches were used, if there is a compiler cache
+	// directory
+	CompilerCaches []CompilerCacheReport `json:"compiler-caches,omitempty" yaml:"compiler-caches,omitempty"`
+	// Why the build failed, if it did
+	Error *ErrorReport `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ErrorReport describes the failure of a build.
+type ErrorReport struct {
+	// The category of the failure, e.g. fetch or pipeline
+	Kind failure.Kind `json:"kind" yaml:"kind"`
+	// The error message
+	Message string `json:"message" yaml:"message"`
+	// The exit code melange exits with
+	ExitCode int `json:"exit-code" yaml:"exit-code"`
+	// Whether the failure may be transient, so that retrying the build
+	// may succeed
+	Retryable bool `json:"retryable" yaml:"retryable"`
+}
+
+// PackageReport describes a single emitted apk.
+type PackageReport struct {
+	// The name of the package
+	Name string `json:"name" yaml:"name"`
+	// The path of the apk file which was written
+	Filename string `json:"filename" yaml:"filename"`
+	// The size of the apk file in bytes
+	Size int64 `json:"size" yaml:"size"`
+	// The sum of the sizes of the files in the package
+	InstalledSize int64 `json:"installed-size" yaml:"installed-size"`
+	// The sha256 digest of the data section
+	DataHash string `json:"datahash" yaml:"datahash"`
+	// The final runtime dependencies, including generated ones
+	Depends []string `json:"depends,omitempty" yaml:"depends,omitempty"`
+	// The final provides, including generated ones
+	Provides []string `json:"provides,omitempty" yaml:"provides,omitempty"`
+}
+
+// VulnerabilityReport is a vulnerability found by the scanner.
+type VulnerabilityReport struct {
+	// What was scanned: environment, or the name of a package
+	Target string `json:"target" yaml:"target"`
+
+	scan.Finding `yaml:",inline"`
+}
+
+// StepReport records how long a top-level pipeline step took.
+type StepReport struct {
+	// The name of the step, or the pipeline it uses
+	Name string `json:"name" yaml:"name"`
+	// The subpackage the step belongs to, if any
+	Subpackage string `json:"subpackage,omitempty" yaml:"subpackage,omitempty"`
+	// How long the step took to run, in seconds
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+func (r *Report) addStep(name, subpackage string, d time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.Steps = append(r.Steps, StepReport{Name: name, Subpackage: subpackage, Duration: d.Seconds()})
+}
+
+func (r *Report) addRepository(rr RepositoryReport) {
+	if r == nil {
+		return
+	}
+
+	r.Repositories = append(r.Repositories, rr)
+}
+
+func (r *Report) setEnvironment(pkgs []LockedPackage) {
+	if r == nil {
+		return
+	}
+
+	r.Environment = pkgs
+}
+
+func (r *Report) addVulnerability(vr VulnerabilityReport) {
+	if r == nil {
+		return
+	}
+
+	r.Vulnerabilities = append(r.Vulnerabilities, vr)
+}
+
+func (r *Report) addPackage(pr PackageReport) {
+	if r == nil {
+		return
+	}
+
+	r.Packages = append(r.Packages, pr)
+}
+
+func (r *Report) setError(err error) {
+	if r == nil || err == nil {
+		return
+	}
+
+	r.Error = &ErrorReport{
+		Kind:      failure.KindOf(err),
+		Message:   err.Error(),
+		ExitCode:  failure.ExitCode(err),
+		Retryable: failure.Retryable(err),
+	}
+}
+
+// reportPath returns the path the report for arch is written to.  The
+// architecture is inserted before the extension, so that the reports of
+// builds for several architectures do not overwrite each other.
+func reportPath(path, arch string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(path, ext), arch, ext)
+}
+
+// Write encodes the report to path.  It is encoded as YAML if path ends
+// in .yaml or .yml, and as JSON otherwise.
+func (r *Report) Write(path string) error {
+	var (
+		data []byte
+		err  error
+	)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(r)
+	default:
+		data, err = json.MarshalIndent(r, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("encoding build report: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing build report: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_reportPath(t *testing.T) {
+	require.Equal(t, "out/report.x86_64.json", reportPath("out/report.json", "x86_64"))
+	require.Equal(t, "report.aarch64.yaml", reportPath("report.yaml", "aarch64"))
+	require.Equal(t, "report.x86_64", reportPath("report", "x86_64"))
+}
+
+func TestReportWrite(t *testing.T) {
+	r := &Report{Package: "foo", Version: "1.2.3", Arch: "x86_64"}
+	r.addStep("fetch", "", 1500*time.Millisecond)
+	r.addPackage(PackageReport{
+		Name:     "foo",
+		Filename: "packages/x86_64/foo-1.2.3-r0.apk",
+		Size:     1024,
+		Depends:  []string{"so:libc.musl-x86_64.so.1"},
+	})
+
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "report.json")
+	require.NoError(t, r.Write(jsonPath))
+	data, err := os.ReadFile(jsonPath)
+	require.NoError(t, err)
+	require.Equal(t, `{
+  "package": "foo",
+  "version": "1.2.3",
+  "epoch": 0,
+  "arch": "x86_64",
+  "packages": [
+    {
+      "name": "foo",
+      "filename": "packages/x86_64/foo-1.2.3-r0.apk",
+      "size": 1024,
+      "installed-size": 0,
+      "datahash": "",
+      "depends": [
+        "so:libc.musl-x86_64.so.1"
+      ]
+    }
+  ],
+  "steps": [
+    {
+      "name": "fetch",
+      "duration": 1.5
+    }
+  ]
+}
+`, string(data))
+	got := Report{}
+	require.NoError(t, json.Unmarshal(data, &got))
+	require.Equal(t, r, &got)
+
+	yamlPath := filepath.Join(dir, "report.yaml")
+	require.NoError(t, r.Write(yamlPath))
+	data, err = os.ReadFile(yamlPath)
+	require.NoError(t, err)
+	require.Equal(t, `package: foo
+version: 1.2.3
+epoch: 0
+arch: x86_64
+packages:
+    - name: foo
+      filename: packages/x86_64/foo-1.2.3-r0.apk
+      size: 1024
+      installed-size: 0
+      datahash: ""
+      depends:
+        - so:libc.musl-x86_64.so.1
+steps:
+    - name: fetch
+      duration: 1.5
+`, string(data))
+	got = Report{}
+	require.NoError(t, yaml.Unmarshal(data, &got))
+	require.Equal(t, r, &got)
+	require.Equal(t, 1.5, got.Steps[0].Duration)
+}
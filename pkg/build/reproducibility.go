@@ -0,0 +1,193 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// gzipUnknownOS is the OS recorded in the gzip header of every section of an
+// apk, so that the header does not depend on the host the package was built
+// on.  The header has no name, and its timestamp is the epoch, which means no
+// timestamp: the gzip writers record the zero time.Time as a date in 2042.
+const gzipUnknownOS = 255
+
+// gzipLevel returns the gzip compression level of the sections of an apk
+// for the CompressionLevel level, which is the default level if it is 0.
+func gzipLevel(level int) int {
+	if level == 0 {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// newGzipWriter returns a gzip writer of a section of an apk to w, whose
+// header does not depend on the host.
+func newGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	zw, err := gzip.NewWriterLevel(w, gzipLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	zw.Header = gzip.Header{OS: gzipUnknownOS, ModTime: time.Unix(0, 0)}
+	return zw, nil
+}
+
+// newPgzipWriter is newGzipWriter for the parallel gzip writer of the data
+// section, which writes the same bytes whatever its concurrency.
+func newPgzipWriter(w io.Writer, level int) (*pgzip.Writer, error) {
+	zw, err := pgzip.NewWriterLevel(w, gzipLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	zw.Header = pgzip.Header{OS: gzipUnknownOS, ModTime: time.Unix(0, 0)}
+	return zw, nil
+}
+
+// checkReproducibility emits the packages a second time from the same
+// workspace, and fails unless every apk is identical to the one which was
+// emitted first.
+func (pb *PipelineBuild) checkReproducibility(ctx context.Context, pkgs []*config.Package) error {
+	log := clog.FromContext(ctx)
+
+	dir, l, err := lockedTempDir("", "reproducibility-*")
+	if err != nil {
+		return fmt.Errorf("unable to make reproducibility check directory: %w", err)
+	}
+	defer l.Unlock()
+	defer os.RemoveAll(dir)
+
+	errs := []error{}
+	for _, pkg := range pkgs {
+		first := pb.packageBuild(pkg)
+
+		again := pb.packageBuild(pkg)
+		again.OutDir = dir
+		again.verifying = true
+		if err := again.EmitPackage(ctx); err != nil {
+			return fmt.Errorf("emitting %s again: %w", pkg.Name, err)
+		}
+
+		diff, err := diffPackages(ctx, first.Filename(), again.Filename())
+		if err != nil {
+			return err
+		}
+		if len(diff) != 0 {
+			errs = append(errs, fmt.Errorf("%s is not reproducible: its %s differ", filepath.Base(first.Filename()), strings.Join(diff, " and ")))
+			continue
+		}
+
+		log.Infof("%s is reproducible", filepath.Base(first.Filename()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// diffPackages returns the sections of two apks which differ.  The apks are
+// only expanded if their digests differ.
+func diffPackages(ctx context.Context, a, b string) ([]string, error) {
+	da, err := fileDigest(a)
+	if err != nil {
+		return nil, err
+	}
+	db, err := fileDigest(b)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(da, db) {
+		return nil, nil
+	}
+
+	ea, err := expandPackage(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	defer ea.Close()
+
+	eb, err := expandPackage(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	defer eb.Close()
+
+	diff := []string{}
+	if !bytes.Equal(ea.ControlHash, eb.ControlHash) {
+		diff = append(diff, "control sections")
+	}
+
+	ha, err := fileDigest(ea.PackageFile)
+	if err != nil {
+		return nil, err
+	}
+	hb, err := fileDigest(eb.PackageFile)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ha, hb) {
+		diff = append(diff, "data sections")
+	}
+
+	// Only the signatures differ if the signed sections do not.
+	if len(diff) == 0 {
+		diff = append(diff, "signatures")
+	}
+
+	return diff, nil
+}
+
+func expandPackage(ctx context.Context, path string) (*expandapk.APKExpanded, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", path, err)
+	}
+
+	return exp, nil
+}
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
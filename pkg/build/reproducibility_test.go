@@ -0,0 +1,132 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func reproducibilityBuild(t *testing.T) *PipelineBuild {
+	t.Helper()
+
+	b := &Build{
+		WorkspaceDir:    t.TempDir(),
+		GuestDir:        t.TempDir(),
+		OutDir:          t.TempDir(),
+		SourceDateEpoch: time.Unix(0, 0),
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		report:          &Report{},
+	}
+	b.Configuration.Package = config.Package{Name: "hello", Version: "1.0"}
+
+	// The names are in a different order in most locales.
+	writeTree(t, filepath.Join(b.WorkspaceDir, "melange-out", "hello"),
+		"usr/share/hello/b", "usr/share/hello/B", "usr/share/hello/_a", "usr/share/hello/a")
+
+	return &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+}
+
+func Test_checkReproducibility(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	pb := reproducibilityBuild(t)
+	pkgs := []*config.Package{pb.Package}
+
+	require.NoError(t, pb.Emit(ctx, pb.Package))
+	require.NoError(t, pb.checkReproducibility(ctx, pkgs))
+	require.Len(t, pb.Build.report.Packages, 1, "the second emission is not reported")
+
+	// A file which changes between the emissions changes the data section,
+	// and the data hash in the control section.
+	require.NoError(t, os.WriteFile(filepath.Join(pb.Build.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello", "a"), []byte("changed"), 0o644))
+	require.ErrorContains(t, pb.checkReproducibility(ctx, pkgs), "hello-1.0-r0.apk is not reproducible: its control sections and data sections differ")
+}
+
+func Test_apkSections(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	pb := reproducibilityBuild(t)
+	require.NoError(t, pb.Emit(ctx, pb.Package))
+
+	data, err := os.ReadFile(pb.packageBuild(pb.Package).Filename())
+	require.NoError(t, err)
+
+	// Every section has the same gzip header, whatever the host.
+	br := bytes.NewReader(data)
+	names := []string{}
+	for br.Len() > 0 {
+		zr, err := gzip.NewReader(br)
+		require.NoError(t, err)
+		zr.Multistream(false)
+		require.Empty(t, zr.Name)
+		require.Empty(t, zr.Extra)
+		require.Zero(t, zr.ModTime.Unix())
+		require.Equal(t, byte(gzipUnknownOS), zr.OS)
+
+		tr := tar.NewReader(zr)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, hdr.Name)
+		}
+		_, err = io.Copy(io.Discard, zr)
+		require.NoError(t, err)
+	}
+
+	// The entries are sorted by their bytes.
+	require.Equal(t, []string{
+		".PKGINFO",
+		"usr", "usr/share", "usr/share/hello",
+		"usr/share/hello/B", "usr/share/hello/_a", "usr/share/hello/a", "usr/share/hello/b",
+	}, names)
+}
+
+func Test_compressionLevel(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	pb := reproducibilityBuild(t)
+	pkgs := []*config.Package{pb.Package}
+
+	emit := func(level int) []byte {
+		t.Helper()
+		require.NoError(t, WithCompressionLevel(level)(pb.Build))
+		require.NoError(t, pb.Emit(ctx, pb.Package))
+		data, err := os.ReadFile(pb.packageBuild(pb.Package).Filename())
+		require.NoError(t, err)
+		return data
+	}
+
+	best := emit(9)
+	require.NoError(t, pb.checkReproducibility(ctx, pkgs))
+	require.Equal(t, best, emit(9))
+	require.NotEqual(t, best, emit(1))
+
+	require.ErrorContains(t, WithCompressionLevel(10)(pb.Build), "compression level 10 must be from 1 to 9")
+	require.ErrorContains(t, WithCompressionLevel(-1)(pb.Build), "compression level -1 must be from 1 to 9")
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+// resolverOverrides merges the resolver configuration of the package with any
+// overrides given on the command line.  Nameservers given on the command line
+// replace the configured ones, while extra hosts are merged into them.
+func (b *Build) resolverOverrides() (config.Resolver, error) {
+	r := config.Resolver{Hosts: map[string]string{}}
+	if cr := b.Configuration.Package.Resolver; cr != nil {
+		r.Nameservers = cr.Nameservers
+		r.Search = cr.Search
+		for host, addr := range cr.Hosts {
+			r.Hosts[host] = addr
+		}
+	}
+
+	if len(b.Nameservers) > 0 {
+		r.Nameservers = b.Nameservers
+	}
+
+	for _, ns := range r.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return r, fmt.Errorf("nameserver %q is not an IP address", ns)
+		}
+	}
+
+	for _, entry := range b.ExtraHosts {
+		host, addr, ok := strings.Cut(entry, ":")
+		if !ok || host == "" || net.ParseIP(addr) == nil {
+			return r, fmt.Errorf("extra host %q must be in the form host:ip", entry)
+		}
+		r.Hosts[host] = addr
+	}
+
+	return r, nil
+}
+
+// writeResolverFiles generates the resolv.conf and hosts files used in the
+// build environment when their contents are overridden.  Files which are not
+// overridden are not written, and the host's files are used instead.
+func (b *Build) writeResolverFiles() error {
+	r, err := b.resolverOverrides()
+	if err != nil {
+		return err
+	}
+
+	if len(r.Nameservers) == 0 && len(r.Search) == 0 && len(r.Hosts) == 0 {
+		return nil
+	}
+
+	dir, l, err := lockedTempDir(b.Runner.TempDir(), "resolver-*")
+	if err != nil {
+		return fmt.Errorf("unable to create resolver dir: %w", err)
+	}
+	b.resolverDir = dir
+	b.locks = append(b.locks, l)
+
+	if len(r.Nameservers) > 0 || len(r.Search) > 0 {
+		var sb strings.Builder
+		sb.WriteString("# Generated by melange\n")
+		if len(r.Search) > 0 {
+			fmt.Fprintf(&sb, "search %s\n", strings.Join(r.Search, " "))
+		}
+		for _, ns := range r.Nameservers {
+			fmt.Fprintf(&sb, "nameserver %s\n", ns)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte(sb.String()), 0o644); err != nil {
+			return fmt.Errorf("unable to write resolv.conf: %w", err)
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		hosts := make([]string, 0, len(r.Hosts))
+		for host := range r.Hosts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+
+		var sb strings.Builder
+		sb.WriteString("# Generated by melange\n")
+		sb.WriteString("127.0.0.1\tlocalhost\n")
+		sb.WriteString("::1\tlocalhost\n")
+		for _, host := range hosts {
+			fmt.Fprintf(&sb, "%s\t%s\n", r.Hosts[host], host)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "hosts"), []byte(sb.String()), 0o644); err != nil {
+			return fmt.Errorf("unable to write hosts: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// resolverMounts returns the bind mounts which expose the name resolution
+// files to the build environment.
+func (b *Build) resolverMounts() []container.BindMount {
+	resolvConf := container.DefaultResolvConfPath
+	mounts := []container.BindMount{}
+
+	if b.resolverDir != "" {
+		if path := filepath.Join(b.resolverDir, "resolv.conf"); fileExists(path) {
+			resolvConf = path
+		}
+
+		if path := filepath.Join(b.resolverDir, "hosts"); fileExists(path) {
+			mounts = append(mounts, container.BindMount{Source: path, Destination: container.DefaultHostsPath})
+		}
+	}
+
+	return append([]container.BindMount{{Source: resolvConf, Destination: container.DefaultResolvConfPath}}, mounts...)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
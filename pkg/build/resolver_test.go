@@ -0,0 +1,50 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func Test_resolverOverrides(t *testing.T) {
+	b := Build{
+		Configuration: config.Configuration{
+			Package: config.Package{
+				Resolver: &config.Resolver{
+					Nameservers: []string{"10.0.0.53"},
+					Hosts:       map[string]string{"ftp.gnu.org": "10.1.2.3"},
+				},
+			},
+		},
+		Nameservers: []string{"192.168.1.1"},
+		ExtraHosts:  []string{"mirror.example.com:10.9.9.9", "ftp.gnu.org:10.4.5.6"},
+	}
+
+	r, err := b.resolverOverrides()
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.1.1"}, r.Nameservers)
+	require.Equal(t, map[string]string{
+		"ftp.gnu.org":        "10.4.5.6",
+		"mirror.example.com": "10.9.9.9",
+	}, r.Hosts)
+
+	b.ExtraHosts = []string{"mirror.example.com"}
+	_, err = b.resolverOverrides()
+	require.ErrorContains(t, err, "must be in the form host:ip")
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// retryBackoff is the delay before the first retry of a step, which doubles
+// with every retry up to maxRetryBackoff.
+var retryBackoff = 10 * time.Second
+
+const maxRetryBackoff = 5 * time.Minute
+
+// runWithRetries runs the command of a step, and runs it again while it
+// fails in a way which its retry policy retries.
+func (pctx *PipelineContext) runWithRetries(ctx context.Context, pb *PipelineBuild, cfg *container.Config, command []string) error {
+	log := clog.FromContext(ctx)
+
+	var output *regexp.Regexp
+	if pctx.retryOn != nil && pctx.retryOn.Output != "" {
+		// The expression was validated with the configuration.
+		output = regexp.MustCompile(pctx.retryOn.Output)
+	}
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		runCtx := ctx
+		var m *outputMatcher
+		if output != nil {
+			// The runners log the output of the command line by line.
+			m = &outputMatcher{Handler: log.Handler(), re: output, matched: &atomic.Bool{}}
+			runCtx = clog.WithLogger(ctx, clog.New(m))
+		}
+
+		err := pb.GetRunner().Run(runCtx, cfg, command...)
+		if err == nil || attempt > pctx.retries || !pctx.shouldRetry(ctx, err, m) {
+			return err
+		}
+
+		log.Warnf("step %q failed: %v; retrying in %s (%d/%d)", pctx.Identity(), err, backoff, attempt, pctx.retries)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// shouldRetry returns whether the failure err of a step is retried.  Without
+// retry-on every failure is, and with it those with one of its exit codes
+// or whose output matched, unless the step ran out of time.
+func (pctx *PipelineContext) shouldRetry(ctx context.Context, err error, m *outputMatcher) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if pctx.retryOn == nil {
+		return true
+	}
+
+	var exitErr *container.ExitError
+	if errors.As(err, &exitErr) && slices.Contains(pctx.retryOn.ExitCodes, exitErr.Code) {
+		return true
+	}
+
+	return m != nil && m.matched.Load()
+}
+
+// outputMatcher records whether a message logged through it matches re.
+type outputMatcher struct {
+	slog.Handler
+	re      *regexp.Regexp
+	matched *atomic.Bool
+}
+
+func (h *outputMatcher) Handle(ctx context.Context, r slog.Record) error {
+	if h.re.MatchString(r.Message) {
+		h.matched.Store(true)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *outputMatcher) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &outputMatcher{Handler: h.Handler.WithAttrs(attrs), re: h.re, matched: h.matched}
+}
+
+func (h *outputMatcher) WithGroup(name string) slog.Handler {
+	return &outputMatcher{Handler: h.Handler.WithGroup(name), re: h.re, matched: h.matched}
+}
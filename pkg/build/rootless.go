@@ -0,0 +1,56 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// checkRootless checks that the runner can run the build without privileges,
+// and maps the owners of the files of the workspace back to root, which the
+// user running melange is in the user namespace of the build, unless maps
+// were given.
+//
+// Nothing else in the build and packaging path needs privileges: the guest is
+// laid out by apko, which keeps the owners of its files to itself, and the
+// owners of the packaged files come from the workspace maps and the owners
+// of the configuration, as the build cannot change them.
+func (b *Build) checkRootless(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	rr, ok := b.Runner.(container.RootlessRunner)
+	if !ok {
+		return fmt.Errorf("the %s runner cannot run rootless builds", b.Runner.Name())
+	}
+	if err := rr.TestRootless(ctx); err != nil {
+		return fmt.Errorf("unable to run a rootless build using %s: %w", b.Runner.Name(), err)
+	}
+
+	if len(b.WorkspaceUIDMap) == 0 {
+		b.WorkspaceUIDMap = []IDMap{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}
+	}
+	if len(b.WorkspaceGIDMap) == 0 {
+		b.WorkspaceGIDMap = []IDMap{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}
+	}
+	log.Infof("running a rootless build as %d:%d", os.Geteuid(), os.Getegid())
+
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// fakeRunner is a runner which only has a name.
+type fakeRunner struct {
+	container.Runner
+}
+
+func (fakeRunner) Name() string {
+	return "fake"
+}
+
+// fakeRootlessRunner is a runner which can run rootless builds, unless
+// rootlessErr is set.
+type fakeRootlessRunner struct {
+	fakeRunner
+
+	rootlessErr error
+}
+
+func (r fakeRootlessRunner) TestRootless(context.Context) error {
+	return r.rootlessErr
+}
+
+func TestCheckRootless(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	b := &Build{Runner: fakeRootlessRunner{}}
+	require.NoError(t, b.checkRootless(ctx))
+	require.Equal(t, []IDMap{{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}}, b.WorkspaceUIDMap)
+	require.Equal(t, []IDMap{{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}}, b.WorkspaceGIDMap)
+
+	// The maps which were given are kept.
+	maps := []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	b = &Build{Runner: fakeRootlessRunner{}, WorkspaceUIDMap: maps, WorkspaceGIDMap: maps}
+	require.NoError(t, b.checkRootless(ctx))
+	require.Equal(t, maps, b.WorkspaceUIDMap)
+	require.Equal(t, maps, b.WorkspaceGIDMap)
+
+	b = &Build{Runner: fakeRootlessRunner{rootlessErr: errors.New("no user namespaces")}}
+	require.ErrorContains(t, b.checkRootless(ctx), "unable to run a rootless build using fake: no user namespaces")
+
+	b = &Build{Runner: fakeRunner{}}
+	require.ErrorContains(t, b.checkRootless(ctx), "the fake runner cannot run rootless builds")
+}
@@ -0,0 +1,324 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/linter"
+)
+
+// applyRPathPolicy enforces the rpath package option on the ELF files of the
+// package in dir.  With the fail policy, any insecure RPATH or RUNPATH entry
+// fails the build; with the strip policy, the insecure entries are removed.
+// Otherwise, they are left for the rpath linter to warn about.
+func applyRPathPolicy(ctx context.Context, pkgName, dir, policy string) error {
+	if policy != config.RPathPolicyFail && policy != config.RPathPolicyStrip {
+		return nil
+	}
+
+	log := clog.FromContext(ctx)
+
+	errs := []error{}
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		insecure := func(entry string) bool {
+			return linter.InsecureRPath(rel, entry) != ""
+		}
+
+		if policy == config.RPathPolicyFail {
+			for _, entry := range rpathEntries(path) {
+				if reason := linter.InsecureRPath(rel, entry); reason != "" {
+					errs = append(errs, fmt.Errorf("/%s: %s", rel, reason))
+				}
+			}
+			return nil
+		}
+
+		stripped, err := stripRPath(path, insecure)
+		if err != nil {
+			return fmt.Errorf("stripping RPATH of /%s: %w", rel, err)
+		}
+		for _, entry := range stripped {
+			log.Infof("%s: stripped RPATH entry %q from /%s", pkgName, entry, rel)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%s has insecure RPATH or RUNPATH entries:\n%w", pkgName, err)
+	}
+
+	return nil
+}
+
+// rpathEntries returns the DT_RPATH and DT_RUNPATH entries of the ELF file
+// at path.  Files which are not dynamic ELF objects have none.
+func rpathEntries(path string) []string {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer ef.Close()
+
+	entries := []string{}
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, err := ef.DynString(tag)
+		if err != nil {
+			return nil
+		}
+		for _, value := range values {
+			entries = append(entries, strings.Split(value, ":")...)
+		}
+	}
+
+	return entries
+}
+
+// stripRPath removes the DT_RPATH and DT_RUNPATH entries of the ELF file at
+// path for which remove returns true, and returns the entries it removed.
+func stripRPath(path string, remove func(entry string) bool) ([]string, error) {
+	changes, err := editRPath(path, func(entry string) string {
+		if remove(entry) {
+			return ""
+		}
+		return entry
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := []string{}
+	for _, c := range changes {
+		stripped = append(stripped, c.old)
+	}
+	if len(stripped) == 0 {
+		return nil, nil
+	}
+
+	return stripped, nil
+}
+
+// rpathChange is an entry changed by editRPath.  The new entry is empty if
+// it was removed.
+type rpathChange struct {
+	old, new string
+}
+
+// editRPath replaces the DT_RPATH and DT_RUNPATH entries of the ELF file at
+// path with what edit returns for them, removing those for which it returns
+// "" and the duplicates, and returns the changes.  The file is rewritten in
+// place: the new entries are written over the old string, which they must
+// fit in, and a tag which is left without entries is removed from the
+// dynamic section.
+func editRPath(path string, edit func(entry string) string) ([]rpathChange, error) {
+	if len(rpathEntries(path)) == 0 {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binaries are often installed read-only.
+	if info.Mode().Perm()&0o200 == 0 {
+		if err := os.Chmod(path, info.Mode().Perm()|0o200); err != nil {
+			return nil, err
+		}
+		defer os.Chmod(path, info.Mode().Perm()) //nolint:errcheck
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamic := ef.Section(".dynamic")
+	if dynamic == nil || int(dynamic.Link) >= len(ef.Sections) {
+		return nil, fmt.Errorf("no dynamic section")
+	}
+	strtab := ef.Sections[dynamic.Link]
+
+	data, err := dynamic.Data()
+	if err != nil {
+		return nil, err
+	}
+	strs, err := strtab.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	size := 8
+	if ef.Class == elf.ELFCLASS64 {
+		size = 16
+	}
+
+	changes := []rpathChange{}
+	removedTag := false
+	kept := make([]byte, 0, len(data))
+	for off := 0; off+size <= len(data); off += size {
+		ent := data[off : off+size]
+
+		var tag elf.DynTag
+		var val uint64
+		if ef.Class == elf.ELFCLASS64 {
+			tag = elf.DynTag(ef.ByteOrder.Uint64(ent[0:8]))
+			val = ef.ByteOrder.Uint64(ent[8:16])
+		} else {
+			tag = elf.DynTag(ef.ByteOrder.Uint32(ent[0:4]))
+			val = uint64(ef.ByteOrder.Uint32(ent[4:8]))
+		}
+
+		if tag == elf.DT_NULL {
+			break
+		}
+
+		if (tag == elf.DT_RPATH || tag == elf.DT_RUNPATH) && val < uint64(len(strs)) {
+			old := strs[val:]
+			if i := bytes.IndexByte(old, 0); i >= 0 {
+				old = old[:i]
+			}
+
+			remaining := []string{}
+			for _, entry := range strings.Split(string(old), ":") {
+				edited := edit(entry)
+				if edited != entry {
+					changes = append(changes, rpathChange{old: entry, new: edited})
+				}
+				if edited != "" && !slices.Contains(remaining, edited) {
+					remaining = append(remaining, edited)
+				}
+			}
+
+			if len(remaining) == 0 {
+				removedTag = true
+				continue
+			}
+
+			if joined := strings.Join(remaining, ":"); joined != string(old) {
+				if len(joined) > len(old) {
+					return nil, fmt.Errorf("%q does not fit in place of %q", joined, old)
+				}
+				if _, err := f.WriteAt(append([]byte(joined), 0), int64(strtab.Offset+val)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		kept = append(kept, ent...)
+	}
+
+	if removedTag {
+		// Pad the dynamic section with DT_NULL entries.
+		kept = append(kept, make([]byte, len(data)-len(kept))...)
+		if _, err := f.WriteAt(kept, int64(dynamic.Offset)); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// rewriteRPaths applies the rpath-rewrites package option to the ELF files
+// of the package in dir.
+func rewriteRPaths(ctx context.Context, pkgName, dir string, rewrites []config.RPathRewrite) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	log := clog.FromContext(ctx)
+
+	res := make([]*regexp.Regexp, len(rewrites))
+	for i, r := range rewrites {
+		re, err := r.Regexp()
+		if err != nil {
+			return err
+		}
+		res[i] = re
+	}
+
+	edit := func(entry string) string {
+		for i, re := range res {
+			if re.MatchString(entry) {
+				return re.ReplaceAllString(entry, rewrites[i].Replace)
+			}
+		}
+		return entry
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		changes, err := editRPath(path, edit)
+		if err != nil {
+			return fmt.Errorf("rewriting RPATH of /%s: %w", rel, err)
+		}
+		for _, c := range changes {
+			if c.new == "" {
+				log.Infof("%s: removed RPATH entry %q from /%s", pkgName, c.old, rel)
+			} else {
+				log.Infof("%s: rewrote RPATH entry %q to %q in /%s", pkgName, c.old, c.new, rel)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// buildWithRPath compiles a small program into dir/usr/bin/hello with the
+// given RUNPATH, skipping the test if no C compiler is available.
+func buildWithRPath(t *testing.T, dir, rpath string) string {
+	t.Helper()
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	src := filepath.Join(t.TempDir(), "hello.c")
+	require.NoError(t, os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0o644))
+
+	bin := filepath.Join(dir, "usr", "bin", "hello")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0o755))
+
+	out, err := exec.Command(cc, "-o", bin, src, "-Wl,--enable-new-dtags,-rpath,"+rpath).CombinedOutput()
+	if err != nil {
+		t.Skipf("unable to compile test program: %v: %s", err, out)
+	}
+
+	return bin
+}
+
+func TestRPathPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fail", func(t *testing.T) {
+		dir := t.TempDir()
+		buildWithRPath(t, dir, "/usr/lib:/home/build/lib")
+
+		require.NoError(t, applyRPathPolicy(ctx, "hello", dir, config.RPathPolicyWarn))
+		require.ErrorContains(t, applyRPathPolicy(ctx, "hello", dir, config.RPathPolicyFail), "/home/build/lib")
+	})
+
+	t.Run("strip some", func(t *testing.T) {
+		dir := t.TempDir()
+		bin := buildWithRPath(t, dir, "/usr/lib:/home/build/lib:$ORIGIN/../lib")
+
+		require.NoError(t, applyRPathPolicy(ctx, "hello", dir, config.RPathPolicyStrip))
+		require.Equal(t, []string{"/usr/lib", "$ORIGIN/../lib"}, rpathEntries(bin))
+		require.NoError(t, applyRPathPolicy(ctx, "hello", dir, config.RPathPolicyFail))
+
+		// The program must still run.
+		require.NoError(t, exec.Command(bin).Run())
+	})
+
+	t.Run("strip all", func(t *testing.T) {
+		dir := t.TempDir()
+		bin := buildWithRPath(t, dir, "/tmp/build/lib")
+		require.NoError(t, os.Chmod(bin, 0o555))
+
+		require.NoError(t, applyRPathPolicy(ctx, "hello", dir, config.RPathPolicyStrip))
+		require.Empty(t, rpathEntries(bin))
+		require.NoError(t, exec.Command(bin).Run())
+
+		info, err := os.Stat(bin)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o555), info.Mode().Perm())
+	})
+}
+
+func TestRewriteRPaths(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rewrite", func(t *testing.T) {
+		dir := t.TempDir()
+		bin := buildWithRPath(t, dir, "/home/build/melange-out/foo/usr/lib:/tmp/deps:/usr/lib")
+
+		require.NoError(t, rewriteRPaths(ctx, "foo", dir, []config.RPathRewrite{
+			{Match: "/home/build/melange-out/([^/]+)/usr/lib", Replace: "/usr/lib/$1"},
+			{Match: "/tmp/.*"},
+		}))
+		require.Equal(t, []string{"/usr/lib/foo", "/usr/lib"}, rpathEntries(bin))
+		require.NoError(t, applyRPathPolicy(ctx, "foo", dir, config.RPathPolicyFail))
+		require.NoError(t, exec.Command(bin).Run())
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		dir := t.TempDir()
+		bin := buildWithRPath(t, dir, "/home/build/lib:/usr/lib")
+
+		require.NoError(t, rewriteRPaths(ctx, "foo", dir, []config.RPathRewrite{
+			{Match: "/home/build/lib", Replace: "/usr/lib"},
+		}))
+		require.Equal(t, []string{"/usr/lib"}, rpathEntries(bin))
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		dir := t.TempDir()
+		bin := buildWithRPath(t, dir, "/opt/a")
+
+		require.ErrorContains(t, rewriteRPaths(ctx, "foo", dir, []config.RPathRewrite{
+			{Match: "/opt/a", Replace: "/usr/lib/a-much-longer-path"},
+		}), "does not fit")
+		require.Equal(t, []string{"/opt/a"}, rpathEntries(bin))
+	})
+}
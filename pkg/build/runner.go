@@ -3,10 +3,13 @@ package build
 type Runner string
 
 const (
-	runnerBubblewrap Runner = "bubblewrap"
-	runnerDocker     Runner = "docker"
-	runnerLima       Runner = "lima"
-	runnerKubernetes Runner = "kubernetes"
+	runnerBubblewrap        Runner = "bubblewrap"
+	runnerBubblewrapSandbox Runner = "bubblewrap-sandbox"
+	runnerDocker            Runner = "docker"
+	runnerPodman            Runner = "podman"
+	runnerLima              Runner = "lima"
+	runnerKubernetes        Runner = "kubernetes"
+	runnerQEMU              Runner = "qemu"
 	// more to come
 )
 
@@ -14,8 +17,11 @@ const (
 func GetAllRunners() []Runner {
 	return []Runner{
 		runnerBubblewrap,
+		runnerBubblewrapSandbox,
 		runnerDocker,
+		runnerPodman,
 		runnerLima,
 		runnerKubernetes,
+		runnerQEMU,
 	}
 }
@@ -16,9 +16,9 @@ package build
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/elfindex"
 	"chainguard.dev/melange/pkg/sca"
 )
 
@@ -48,20 +48,20 @@ func (scabi *SCABuildInterface) RelativeNames() []string {
 
 // Version returns the version of the package being built including epoch.
 func (scabi *SCABuildInterface) Version() string {
-	return fmt.Sprintf("%s-r%d", scabi.PackageBuild.Origin.Version, scabi.PackageBuild.Origin.Epoch)
+	return fmt.Sprintf("%s-r%d", scabi.PackageBuild.Version, scabi.PackageBuild.Epoch)
+}
+
+// VersionForRelative returns the version of a given package name including
+// epoch.
+func (scabi *SCABuildInterface) VersionForRelative(pkgName string) string {
+	version, epoch := scabi.PackageBuild.Build.Configuration.VersionOf(pkgName)
+	return fmt.Sprintf("%s-r%d", version, epoch)
 }
 
 // FilesystemForRelative implements an abstract filesystem for any of the packages being
 // built.
 func (scabi *SCABuildInterface) FilesystemForRelative(pkgName string) (sca.SCAFS, error) {
-	pkgDir := filepath.Join(scabi.PackageBuild.Build.WorkspaceDir, "melange-out", pkgName)
-	rlFS := readlinkFS(pkgDir)
-	scaFS, ok := rlFS.(sca.SCAFS)
-	if !ok {
-		return nil, fmt.Errorf("SCAFS not implemented")
-	}
-
-	return scaFS, nil
+	return scabi.PackageBuild.Build.workspaceFS(pkgName)
 }
 
 // Filesystem implements an abstract filesystem providing access to a package filesystem.
@@ -69,6 +69,12 @@ func (scabi *SCABuildInterface) Filesystem() (sca.SCAFS, error) {
 	return scabi.FilesystemForRelative(scabi.PackageName())
 }
 
+// ELFIndexForRelative returns the index of the ELF files of any of the
+// packages being built.
+func (scabi *SCABuildInterface) ELFIndexForRelative(pkgName string) (*elfindex.Index, error) {
+	return scabi.PackageBuild.Build.elfIndex(pkgName)
+}
+
 // Options returns the configured SCA engine options for the package being built.
 func (scabi *SCABuildInterface) Options() config.PackageOption {
 	return scabi.PackageBuild.Options
@@ -0,0 +1,93 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/failure"
+	"chainguard.dev/melange/pkg/scan"
+)
+
+// scanTargetEnvironment is the target of the findings in the build
+// environment; the others are the names of the packages.
+const scanTargetEnvironment = "environment"
+
+// scanEnvironment scans the packages installed in the build environment.
+func (b *Build) scanEnvironment(ctx context.Context) error {
+	clog.FromContext(ctx).Infof("scanning the build environment with %s", b.scanner.Tool)
+
+	findings, err := b.scanner.ScanDir(ctx, b.GuestDir)
+	if err != nil {
+		return fmt.Errorf("scanning the build environment: %w", err)
+	}
+
+	return b.scanFailure(b.checkFindings(ctx, scanTargetEnvironment, findings))
+}
+
+// scanPackages scans the SBOMs of the emitted packages, which are still in
+// the workspace.
+func (b *Build) scanPackages(ctx context.Context, pb *PipelineBuild, emitted []*config.Package) error {
+	log := clog.FromContext(ctx)
+
+	failing := 0
+	for _, pkg := range emitted {
+		pc := pb.packageBuild(pkg)
+		sbom := filepath.Join(pc.WorkspaceSubdir(), "var", "lib", "db", "sbom", fmt.Sprintf("%s-%s-r%d.spdx.json", pc.PackageName, pc.Version, pc.Epoch))
+
+		log.Infof("scanning %s with %s", pc.PackageName, b.scanner.Tool)
+		findings, err := b.scanner.ScanSBOM(ctx, sbom)
+		if err != nil {
+			return fmt.Errorf("scanning %s: %w", pc.PackageName, err)
+		}
+		failing += b.checkFindings(ctx, pc.PackageName, findings)
+	}
+
+	return b.scanFailure(failing)
+}
+
+// checkFindings logs the findings of target and adds them to the build
+// report.  It returns how many are at least as severe as ScanFailOn.
+func (b *Build) checkFindings(ctx context.Context, target string, findings []scan.Finding) int {
+	log := clog.FromContext(ctx)
+
+	failing := 0
+	for _, f := range findings {
+		if b.ScanFailOn != "" && f.AtLeast(b.ScanFailOn) {
+			log.Errorf("%s: %s", target, f)
+			failing++
+		} else {
+			log.Warnf("%s: %s", target, f)
+		}
+		b.report.addVulnerability(VulnerabilityReport{Target: target, Finding: f})
+	}
+
+	return failing
+}
+
+// scanFailure returns the policy failure of a scan which found failing
+// vulnerabilities, if it did.
+func (b *Build) scanFailure(failing int) error {
+	if failing == 0 {
+		return nil
+	}
+
+	return failure.Wrap(failure.Policy, fmt.Errorf("%s found %d vulnerabilities of severity %s or higher", b.scanner.Tool, failing, b.ScanFailOn))
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/failure"
+	"chainguard.dev/melange/pkg/scan"
+)
+
+func TestCheckFindings(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	critical := scan.Finding{ID: "CVE-2024-0001", Package: "zlib", Version: "1.2.3-r0", Severity: scan.SeverityCritical}
+	low := scan.Finding{ID: "CVE-2024-0002", Package: "busybox", Version: "1.36.1-r0", Severity: scan.SeverityLow}
+
+	// Without a policy, findings are only reported.
+	b := &Build{scanner: &scan.Scanner{Tool: scan.ToolGrype}, report: &Report{}}
+	require.Equal(t, 0, b.checkFindings(ctx, scanTargetEnvironment, []scan.Finding{critical, low}))
+	require.NoError(t, b.scanFailure(0))
+	require.Equal(t, []VulnerabilityReport{
+		{Target: "environment", Finding: critical},
+		{Target: "environment", Finding: low},
+	}, b.report.Vulnerabilities)
+
+	b = &Build{scanner: &scan.Scanner{Tool: scan.ToolGrype}, ScanFailOn: scan.SeverityHigh, report: &Report{}}
+	failing := b.checkFindings(ctx, "zlib", []scan.Finding{critical, low})
+	require.Equal(t, 1, failing)
+	err := b.scanFailure(failing)
+	require.ErrorContains(t, err, "grype found 1 vulnerabilities of severity high or higher")
+	require.Equal(t, failure.Policy, failure.KindOf(err))
+	require.Len(t, b.report.Vulnerabilities, 2)
+}
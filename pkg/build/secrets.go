@@ -0,0 +1,226 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+)
+
+// secretsDir is where the secrets which are files are mounted in the build
+// environment.
+const secretsDir = "/run/secrets"
+
+// secretMask replaces the values of secrets in the output of the build.
+const secretMask = "***"
+
+// ParseSecret parses the value of --secret, which is either NAME, taking
+// the value of the environment variable NAME, NAME=env:VAR, taking the
+// value of the environment variable VAR, or NAME=file:PATH, taking the
+// contents of the file at PATH.  Values are never given on the command
+// line, where they would be recorded by shells and process listings.
+func ParseSecret(spec string) (string, string, error) {
+	name, source, ok := strings.Cut(spec, "=")
+	if !ok {
+		source = "env:" + name
+	}
+
+	kind, from, _ := strings.Cut(source, ":")
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(from)
+		if !ok {
+			return "", "", fmt.Errorf("secret %s: environment variable %s is not set", name, from)
+		}
+		return name, value, nil
+	case "file":
+		data, err := os.ReadFile(from)
+		if err != nil {
+			return "", "", fmt.Errorf("secret %s: %w", name, err)
+		}
+		return name, string(data), nil
+	}
+
+	return "", "", fmt.Errorf("secret %q must be NAME, NAME=env:VAR or NAME=file:PATH", spec)
+}
+
+// checkSecrets checks that the secrets given to the build are declared by
+// the configuration, and that those it needs are given.
+func (b *Build) checkSecrets() error {
+	declared := map[string]bool{}
+	for _, s := range b.Configuration.Secrets {
+		declared[s.Name] = true
+		if _, ok := b.secrets[s.Name]; !ok && !s.Optional {
+			return fmt.Errorf("the build needs secret %s, which is not given with --secret", s.Name)
+		}
+	}
+
+	for name := range b.secrets {
+		if !declared[name] {
+			return fmt.Errorf("secret %s is not declared in the secrets of the build file", name)
+		}
+	}
+
+	return nil
+}
+
+// secretEnvironment returns the secrets which are environment variables.
+func (b *Build) secretEnvironment() map[string]string {
+	env := map[string]string{}
+	for _, s := range b.Configuration.Secrets {
+		if value, ok := b.secrets[s.Name]; ok && !s.File {
+			env[s.Name] = value
+		}
+	}
+
+	return env
+}
+
+// writeSecretFiles writes the secrets which are files in a temporary
+// directory, outside of the workspace so that they are never packaged, to be
+// mounted at /run/secrets.  Nothing is written if there are none.
+func (b *Build) writeSecretFiles() error {
+	files := []config.Secret{}
+	for _, s := range b.Configuration.Secrets {
+		if _, ok := b.secrets[s.Name]; ok && s.File {
+			files = append(files, s)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	dir, l, err := lockedTempDir(b.Runner.TempDir(), "secrets-*")
+	if err != nil {
+		return fmt.Errorf("unable to create secrets dir: %w", err)
+	}
+	b.secretsDir = dir
+	b.locks = append(b.locks, l)
+
+	for _, s := range files {
+		if err := os.WriteFile(filepath.Join(dir, s.Name), []byte(b.secrets[s.Name]), 0o600); err != nil {
+			return fmt.Errorf("unable to write secret %s: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// secretMounts returns the mount of the secrets which are files, if any.
+func (b *Build) secretMounts() []container.BindMount {
+	if b.secretsDir == "" {
+		return nil
+	}
+
+	return []container.BindMount{{Source: b.secretsDir, Destination: secretsDir, ReadOnly: true}}
+}
+
+// maskSecrets returns ctx with a logger which masks the values of the
+// secrets, and of each of their lines, in what is logged.
+func (b *Build) maskSecrets(ctx context.Context) context.Context {
+	if len(b.secrets) == 0 {
+		return ctx
+	}
+
+	values := []string{}
+	for _, value := range b.secrets {
+		values = append(values, value)
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				values = append(values, line)
+			}
+		}
+	}
+	// The longest values are replaced first, so that a line does not
+	// leave the rest of the value it is part of behind.
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	oldnew := []string{}
+	for _, value := range values {
+		if value != "" {
+			oldnew = append(oldnew, value, secretMask)
+		}
+	}
+	b.secretMasker = strings.NewReplacer(oldnew...)
+
+	h := &maskingHandler{Handler: clog.FromContext(ctx).Handler(), r: b.secretMasker}
+	return clog.WithLogger(ctx, clog.New(h))
+}
+
+// mask replaces the values of the secrets in s.
+func (b *Build) mask(s string) string {
+	if b.secretMasker == nil {
+		return s
+	}
+	return b.secretMasker.Replace(s)
+}
+
+// maskingHandler replaces strings in the messages and the string attributes
+// of log records, before they reach its handler.
+type maskingHandler struct {
+	slog.Handler
+	r *strings.Replacer
+}
+
+func (h *maskingHandler) Handle(ctx context.Context, r slog.Record) error {
+	masked := slog.NewRecord(r.Time, r.Level, h.r.Replace(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		masked.AddAttrs(h.maskAttr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, masked)
+}
+
+func (h *maskingHandler) maskAttr(a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.r.Replace(a.Value.String()))
+	case slog.KindGroup:
+		attrs := []any{}
+		for _, ga := range a.Value.Group() {
+			attrs = append(attrs, h.maskAttr(ga))
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny, slog.KindLogValuer:
+		return slog.String(a.Key, h.r.Replace(a.Value.Resolve().String()))
+	}
+
+	return a
+}
+
+func (h *maskingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	masked := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		masked = append(masked, h.maskAttr(a))
+	}
+	return &maskingHandler{Handler: h.Handler.WithAttrs(masked), r: h.r}
+}
+
+func (h *maskingHandler) WithGroup(name string) slog.Handler {
+	return &maskingHandler{Handler: h.Handler.WithGroup(name), r: h.r}
+}
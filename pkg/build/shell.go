@@ -0,0 +1,167 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"github.com/chainguard-dev/clog"
+	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"go.opentelemetry.io/otel"
+)
+
+// sourcePipelines are the pipelines which fetch the sources of a package.
+var sourcePipelines = []string{"fetch", "git-checkout", "patch"}
+
+// SourceSteps returns the leading steps of the main pipeline which fetch
+// and patch the sources of the package.
+func SourceSteps(cfg *config.Configuration) []config.Pipeline {
+	steps := []config.Pipeline{}
+	for _, p := range cfg.Pipeline {
+		if !slices.Contains(sourcePipelines, p.Uses) {
+			break
+		}
+		steps = append(steps, p)
+	}
+
+	return steps
+}
+
+// Shell provisions the build environment of the package, without running
+// its pipelines, and runs an interactive shell in it.  If fetchSources is
+// set, the steps returned by SourceSteps are run first.
+func (b *Build) Shell(ctx context.Context, fetchSources bool, args ...string) error {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("melange").Start(ctx, "Shell")
+	defer span.End()
+
+	dbg, ok := b.Runner.(container.Debugger)
+	if !ok {
+		return fmt.Errorf("the %s runner does not support interactive shells", b.Runner.Name())
+	}
+
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+
+	pb := PipelineBuild{
+		Build:   b,
+		Package: &b.Configuration.Package,
+	}
+
+	if b.GuestDir == "" {
+		guestDir, l, err := lockedTempDir(b.Runner.TempDir(), "guest-*")
+		if err != nil {
+			return fmt.Errorf("unable to make guest directory: %w", err)
+		}
+		b.GuestDir = guestDir
+		b.locks = append(b.locks, l)
+	}
+	defer func() {
+		if err := os.RemoveAll(b.GuestDir); err != nil {
+			log.Warnf("unable to clean guest container: %s", err)
+		}
+	}()
+
+	// The shell is provisioned with everything needed by the pipelines of
+	// the package and its subpackages.
+	for _, p := range b.Configuration.Pipeline {
+		pctx := NewPipelineContext(&p, &b.Configuration.Environment, nil, b.PipelineDirs)
+		if err := pctx.ApplyNeeds(ctx, &pb); err != nil {
+			return fmt.Errorf("unable to apply pipeline requirements: %w", err)
+		}
+	}
+	for _, spkg := range b.Configuration.Subpackages {
+		spkg := spkg
+		pb.Subpackage = &spkg
+		for _, p := range spkg.Pipeline {
+			pctx := NewPipelineContext(&p, &b.Configuration.Environment, nil, b.PipelineDirs)
+			if err := pctx.ApplyNeeds(ctx, &pb); err != nil {
+				return fmt.Errorf("unable to apply pipeline requirements: %w", err)
+			}
+		}
+	}
+	pb.Subpackage = nil
+
+	if !b.EmptyWorkspace {
+		if err := os.MkdirAll(b.WorkspaceDir, 0o755); err != nil {
+			return fmt.Errorf("mkdir -p %s: %w", b.WorkspaceDir, err)
+		}
+
+		log.Infof("populating workspace %s from %s", b.WorkspaceDir, b.SourceDir)
+		if err := b.PopulateWorkspace(ctx, os.DirFS(b.SourceDir)); err != nil {
+			return fmt.Errorf("unable to populate workspace: %w", err)
+		}
+	}
+
+	if err := b.writeResolverFiles(); err != nil {
+		return fmt.Errorf("unable to configure name resolution: %w", err)
+	}
+
+	cfg := b.WorkspaceConfig(ctx)
+
+	if err := os.MkdirAll(b.GuestDir, 0o755); err != nil {
+		return fmt.Errorf("mkdir -p %s: %w", b.GuestDir, err)
+	}
+
+	log.Infof("building workspace in '%s' with apko", b.GuestDir)
+
+	guestFS := apkofs.DirFS(b.GuestDir, apkofs.WithCreateDir())
+	imgRef, err := b.BuildGuest(ctx, b.Configuration.Environment, guestFS)
+	if err != nil {
+		return fmt.Errorf("unable to build guest: %w", err)
+	}
+	cfg.ImgRef = imgRef
+
+	if err := b.OverlayBinSh(); err != nil {
+		return fmt.Errorf("unable to install overlay /bin/sh: %w", err)
+	}
+
+	if err := b.PopulateCache(ctx); err != nil {
+		return fmt.Errorf("unable to populate cache: %w", err)
+	}
+
+	if err := b.Runner.StartPod(ctx, cfg); err != nil {
+		return fmt.Errorf("unable to start pod: %w", err)
+	}
+	defer func() {
+		if err := b.Runner.TerminatePod(context.WithoutCancel(ctx), cfg); err != nil {
+			log.Warnf("unable to terminate pod: %s", err)
+		}
+	}()
+
+	if fetchSources {
+		for _, p := range SourceSteps(&b.Configuration) {
+			pctx := NewPipelineContext(&p, &b.Configuration.Environment, cfg, b.PipelineDirs)
+			if _, err := pctx.Run(ctx, &pb); err != nil {
+				return fmt.Errorf("unable to fetch sources: %w", err)
+			}
+		}
+	}
+
+	log.Infof("running %q in the build environment of %s, changes to /home/build are kept in %s", args[0], b.Configuration.Package.Name, b.WorkspaceDir)
+
+	// Leave ctrl+C to the shell.
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+
+	return dbg.Debug(ctx, cfg, args...)
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceSteps(t *testing.T) {
+	cfg := &config.Configuration{
+		Pipeline: []config.Pipeline{
+			{Uses: "git-checkout"},
+			{Uses: "patch"},
+			{Uses: "autoconf/configure"},
+			{Uses: "fetch"},
+		},
+	}
+
+	// Only the leading steps are run, as later ones may depend on the
+	// steps before them.
+	require.Equal(t, cfg.Pipeline[:2], SourceSteps(cfg))
+
+	require.Empty(t, SourceSteps(&config.Configuration{
+		Pipeline: []config.Pipeline{{Runs: "make"}, {Uses: "fetch"}},
+	}))
+}
@@ -13,7 +13,6 @@ import (
 	"time"
 
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
-	"github.com/klauspost/compress/gzip"
 	"go.opentelemetry.io/otel"
 )
 
@@ -24,6 +23,12 @@ type ApkSigner interface {
 }
 
 func EmitSignature(ctx context.Context, signer ApkSigner, controlData []byte, sde time.Time) ([]byte, error) {
+	return emitSignature(ctx, signer, controlData, sde, 0)
+}
+
+// emitSignature is EmitSignature with the gzip compression level of the
+// section, which is the default level if it is 0.
+func emitSignature(ctx context.Context, signer ApkSigner, controlData []byte, sde time.Time, level int) ([]byte, error) {
 	_, span := otel.Tracer("melange").Start(ctx, "EmitSignature")
 	defer span.End()
 
@@ -34,7 +39,10 @@ func EmitSignature(ctx context.Context, signer ApkSigner, controlData []byte, sd
 
 	var sigbuf bytes.Buffer
 
-	zw := gzip.NewWriter(&sigbuf)
+	zw, err := newGzipWriter(&sigbuf, level)
+	if err != nil {
+		return nil, err
+	}
 	tw := tar.NewWriter(zw)
 
 	// The signature tarball only contains a single file
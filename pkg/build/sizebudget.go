@@ -0,0 +1,51 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/dustin/go-humanize"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// checkSizeBudget checks a size of the package against its budget, the
+// max-installed-size or max-apk-size option, and fails or warns as the
+// size-budget option says when it is exceeded.
+func (pc *PackageBuild) checkSizeBudget(ctx context.Context, what string, size int64, budget string) error {
+	if budget == "" {
+		return nil
+	}
+
+	// The budget was validated with the configuration.
+	limit, err := humanize.ParseBytes(budget)
+	if err != nil {
+		return err
+	}
+	if size < 0 || uint64(size) <= limit {
+		return nil
+	}
+
+	msg := fmt.Sprintf("the %s of %s is %s, over its budget of %s", what, pc.PackageName, humanize.IBytes(uint64(size)), humanize.IBytes(limit))
+	if pc.Options.SizeBudget == config.SizeBudgetPolicyWarn {
+		clog.FromContext(ctx).Warn(msg)
+		return nil
+	}
+
+	return fmt.Errorf("%s", msg)
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestCheckSizeBudget(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	pc := &PackageBuild{PackageName: "hello"}
+	require.NoError(t, pc.checkSizeBudget(ctx, "installed size", 1<<30, ""))
+	require.NoError(t, pc.checkSizeBudget(ctx, "installed size", 100<<20, "100MiB"))
+	require.EqualError(t, pc.checkSizeBudget(ctx, "installed size", 100<<20+1, "100MiB"),
+		"the installed size of hello is 100 MiB, over its budget of 100 MiB")
+	require.EqualError(t, pc.checkSizeBudget(ctx, "apk size", 3<<20, "2MB"),
+		"the apk size of hello is 3.0 MiB, over its budget of 1.9 MiB")
+
+	pc.Options = config.PackageOption{SizeBudget: config.SizeBudgetPolicyWarn}
+	require.NoError(t, pc.checkSizeBudget(ctx, "installed size", 1<<30, "100MiB"))
+}
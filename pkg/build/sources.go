@@ -0,0 +1,139 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/failure"
+	"chainguard.dev/melange/pkg/fetch"
+	"github.com/chainguard-dev/clog"
+)
+
+// fetchSources returns the sources of the fetch steps of the pipelines, with
+// their inputs substituted.
+func fetchSources(pb *PipelineBuild, pipelines []config.Pipeline) ([]fetch.Source, error) {
+	sources := []fetch.Source{}
+	for _, p := range pipelines {
+		nested, err := fetchSources(pb, p.Pipeline)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Uses == "fetch" {
+			with, err := MutateWith(pb, p.With)
+			if err != nil {
+				return nil, err
+			}
+
+			input := func(name string) string {
+				return with[fmt.Sprintf("${{inputs.%s}}", name)]
+			}
+			sources = append(sources, fetch.Source{
+				URI:     input("uri"),
+				Mirrors: strings.Fields(input("mirrors")),
+				SHA256:  input("expected-sha256"),
+				SHA512:  input("expected-sha512"),
+			})
+		}
+
+		sources = append(sources, nested...)
+	}
+
+	return sources, nil
+}
+
+// prefetchSources fetches the sources of the fetch steps of the package and
+// its subpackages into the cache directory on the host, where the fetch
+// pipeline finds them.
+func (b *Build) prefetchSources(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	if b.CacheDir == "" {
+		log.Warnf("not prefetching sources without a cache directory")
+		return nil
+	}
+
+	pb := &PipelineBuild{Build: b, Package: &b.Configuration.Package}
+	sources, err := fetchSources(pb, b.Configuration.Pipeline)
+	if err != nil {
+		return fmt.Errorf("evaluating fetch steps: %w", err)
+	}
+	for _, sp := range b.Configuration.Subpackages {
+		sp := sp
+		pb.Subpackage = &sp
+		ss, err := fetchSources(pb, sp.Pipeline)
+		if err != nil {
+			return fmt.Errorf("evaluating fetch steps: %w", err)
+		}
+		sources = append(sources, ss...)
+	}
+
+	f, err := fetch.New(b.CacheDir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sources {
+		if _, err := f.Fetch(ctx, s); errors.Is(err, fetch.ErrDigestMismatch) {
+			return failure.Wrap(failure.Checksum, err)
+		} else if err != nil {
+			return failure.Wrap(failure.Fetch, err)
+		}
+	}
+
+	return nil
+}
+
+// sourceLocation returns the SPDX download location of the sources of the
+// pipelines: that of the first fetch or git-checkout step, or "" if there
+// is none.
+func sourceLocation(pb *PipelineBuild, pipelines []config.Pipeline) (string, error) {
+	for _, p := range pipelines {
+		switch p.Uses {
+		case "fetch", "git-checkout":
+			with, err := MutateWith(pb, p.With)
+			if err != nil {
+				return "", err
+			}
+			input := func(name string) string {
+				return with[fmt.Sprintf("${{inputs.%s}}", name)]
+			}
+
+			if p.Uses == "fetch" {
+				return input("uri"), nil
+			}
+
+			loc := "git+" + input("repository")
+			for _, rev := range []string{"expected-commit", "tag", "branch"} {
+				if v := input(rev); v != "" {
+					return loc + "@" + v, nil
+				}
+			}
+			return loc, nil
+		}
+
+		loc, err := sourceLocation(pb, p.Pipeline)
+		if err != nil || loc != "" {
+			return loc, err
+		}
+	}
+
+	return "", nil
+}
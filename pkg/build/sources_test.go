@@ -0,0 +1,111 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/fetch"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchSources(t *testing.T) {
+	pb := &PipelineBuild{
+		Build:   &Build{},
+		Package: &config.Package{Name: "hello", Version: "2.12"},
+	}
+
+	got, err := fetchSources(pb, []config.Pipeline{{
+		Uses: "fetch",
+		With: map[string]string{
+			"uri":             "https://ftp.gnu.org/gnu/hello/hello-${{package.version}}.tar.gz",
+			"expected-sha256": "cf04af86dc085268c5f4470fbae49b18afbc221b78096aab842d934a76bad0ab",
+			"mirrors":         "https://mirror.example/{algo}/{digest}  https://other.example/{digest}",
+		},
+	}, {
+		Runs: "make",
+	}, {
+		Pipeline: []config.Pipeline{{
+			Uses: "fetch",
+			With: map[string]string{
+				"uri":             "https://example.com/extra.tar.gz",
+				"expected-sha512": "abcd",
+			},
+		}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []fetch.Source{{
+		URI:     "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz",
+		Mirrors: []string{"https://mirror.example/{algo}/{digest}", "https://other.example/{digest}"},
+		SHA256:  "cf04af86dc085268c5f4470fbae49b18afbc221b78096aab842d934a76bad0ab",
+	}, {
+		URI:     "https://example.com/extra.tar.gz",
+		Mirrors: []string{},
+		SHA512:  "abcd",
+	}}, got)
+}
+
+func TestSourceLocation(t *testing.T) {
+	pb := &PipelineBuild{
+		Build:   &Build{},
+		Package: &config.Package{Name: "hello", Version: "2.12"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		pipelines []config.Pipeline
+		want      string
+	}{{
+		name:      "none",
+		pipelines: []config.Pipeline{{Runs: "make"}},
+	}, {
+		name: "fetch",
+		pipelines: []config.Pipeline{{Runs: "true"}, {
+			Uses: "fetch",
+			With: map[string]string{"uri": "https://ftp.gnu.org/gnu/hello/hello-${{package.version}}.tar.gz"},
+		}},
+		want: "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz",
+	}, {
+		name: "git-checkout",
+		pipelines: []config.Pipeline{{
+			Pipeline: []config.Pipeline{{
+				Uses: "git-checkout",
+				With: map[string]string{
+					"repository":      "https://git.example/hello.git",
+					"tag":             "v${{package.version}}",
+					"expected-commit": "a73c4feb284dc6ed1e5758740f717f99dcd4c9d7",
+				},
+			}},
+		}},
+		want: "git+https://git.example/hello.git@a73c4feb284dc6ed1e5758740f717f99dcd4c9d7",
+	}, {
+		name: "git-checkout tag",
+		pipelines: []config.Pipeline{{
+			Uses: "git-checkout",
+			With: map[string]string{
+				"repository": "https://git.example/hello.git",
+				"tag":        "v${{package.version}}",
+			},
+		}},
+		want: "git+https://git.example/hello.git@v2.12",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sourceLocation(pb, tc.pipelines)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
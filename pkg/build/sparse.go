@@ -0,0 +1,74 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/dustin/go-humanize"
+)
+
+// sparseBlockSize is the unit of the block counts of syscall.Stat_t.
+const sparseBlockSize = 512
+
+// allocatedSize returns how much of the file whose info is fi is allocated
+// on the filesystem, if the filesystem says.
+func allocatedSize(fi fs.FileInfo) (int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 0, false
+	}
+
+	return st.Blocks * sparseBlockSize, true
+}
+
+// checkSparseFiles warns about the sparse files of a package, whose holes
+// the data section holds as zeroes as apk has no sparse entries, and fails
+// for those larger than MaxSparseSize.  Compressed filesystems make files
+// look sparse too, so only the files with holes of a block or more are
+// reported.
+func (pc *PackageBuild) checkSparseFiles(ctx context.Context, fsys fs.FS) error {
+	log := clog.FromContext(ctx)
+
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		allocated, ok := allocatedSize(fi)
+		if !ok || fi.Size()-allocated < 1<<12 {
+			return nil
+		}
+
+		size := uint64(fi.Size())
+		if limit := pc.Build.MaxSparseSize; limit != 0 && size > limit {
+			return fmt.Errorf("%s is a sparse file of %s, which is larger than the %s allowed to be packaged expanded", path, humanize.IBytes(size), humanize.IBytes(limit))
+		}
+		log.Warnf("%s is a sparse file of %s with %s allocated, which is packaged expanded", path, humanize.IBytes(size), humanize.IBytes(uint64(allocated)))
+
+		return nil
+	})
+}
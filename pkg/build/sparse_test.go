@@ -0,0 +1,50 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSparseFiles(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "small"), []byte("hello\n"), 0o644))
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(64<<20))
+	require.NoError(t, f.Close())
+
+	fi, err := os.Stat(filepath.Join(dir, "disk.img"))
+	require.NoError(t, err)
+	if allocated, ok := allocatedSize(fi); !ok || allocated != 0 {
+		t.Skip("the filesystem of the temporary directory has no sparse files")
+	}
+
+	pc := &PackageBuild{Build: &Build{}}
+	require.NoError(t, pc.checkSparseFiles(ctx, os.DirFS(dir)))
+
+	pc.Build.MaxSparseSize = 1 << 30
+	require.NoError(t, pc.checkSparseFiles(ctx, os.DirFS(dir)))
+
+	pc.Build.MaxSparseSize = 1 << 20
+	require.ErrorContains(t, pc.checkSparseFiles(ctx, os.DirFS(dir)), "disk.img is a sparse file of 64 MiB, which is larger than the 1.0 MiB allowed")
+}
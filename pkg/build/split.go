@@ -0,0 +1,176 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// manifestClaim records which subpackage claimed a path in the main package,
+// and whether the claim was made directly by a pattern or inherited from a
+// claimed parent directory.
+type manifestClaim struct {
+	owner     string
+	inherited bool
+}
+
+// splitByManifest moves the paths selected by the files manifest of each
+// subpackage out of the main package and into that subpackage.
+//
+// The manifests are verified before anything is moved: every pattern must
+// match at least one path, and no path may be claimed by more than one
+// subpackage.
+func splitByManifest(ctx context.Context, outDir, origin string, subpackages []config.Subpackage) error {
+	log := clog.FromContext(ctx)
+
+	manifested := slices.DeleteFunc(slices.Clone(subpackages), func(sp config.Subpackage) bool {
+		return len(sp.Files) == 0
+	})
+	if len(manifested) == 0 {
+		return nil
+	}
+
+	originDir := filepath.Join(outDir, origin)
+	hits := map[string][]int{}
+	for _, sp := range manifested {
+		hits[sp.Name] = make([]int, len(sp.Files))
+	}
+
+	claims := map[string]manifestClaim{}
+	if err := fs.WalkDir(os.DirFS(originDir), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		parent, inherited := claims[filepath.Dir(path)]
+
+		owners := []string{}
+		for _, sp := range manifested {
+			for i, pattern := range sp.Files {
+				ok, err := util.MatchGlob(pattern, path)
+				if err != nil {
+					return fmt.Errorf("subpackage %s: %w", sp.Name, err)
+				}
+				if !ok {
+					continue
+				}
+
+				hits[sp.Name][i]++
+				if !slices.Contains(owners, sp.Name) {
+					owners = append(owners, sp.Name)
+				}
+			}
+		}
+
+		if inherited {
+			owners = slices.DeleteFunc(owners, func(s string) bool { return s == parent.owner })
+			if len(owners) > 0 {
+				return fmt.Errorf("%s is claimed by both %s and %s", path, parent.owner, owners[0])
+			}
+
+			claims[path] = manifestClaim{owner: parent.owner, inherited: true}
+			return nil
+		}
+
+		switch len(owners) {
+		case 0:
+		case 1:
+			claims[path] = manifestClaim{owner: owners[0]}
+		default:
+			sort.Strings(owners)
+			return fmt.Errorf("%s is claimed by both %s and %s", path, owners[0], owners[1])
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, sp := range manifested {
+		for i, pattern := range sp.Files {
+			if hits[sp.Name][i] == 0 {
+				errs = append(errs, fmt.Errorf("subpackage %s: pattern %q matched no files in %s", sp.Name, pattern, origin))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(claims))
+	for path := range claims {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Move everything which is not a directory first, then remove the claimed
+	// directories deepest-first once they have been emptied.
+	dirs := []string{}
+	for _, path := range paths {
+		claim := claims[path]
+		src := filepath.Join(originDir, path)
+		dst := filepath.Join(outDir, claim.owner, path)
+
+		fi, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+
+		if !claim.inherited {
+			log.Infof("  %s -> %s", path, claim.owner)
+		}
+
+		if fi.IsDir() {
+			if err := os.MkdirAll(dst, fi.Mode().Perm()); err != nil {
+				return fmt.Errorf("mkdir -p %s: %w", dst, err)
+			}
+			dirs = append(dirs, src)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("mkdir -p %s: %w", filepath.Dir(dst), err)
+		}
+
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("moving %s to %s: %w", path, claim.owner, err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil {
+			return fmt.Errorf("removing emptied directory %s: %w", dirs[i], err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func writeTree(t *testing.T, root string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		path := filepath.Join(root, f)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(f), 0o644))
+	}
+}
+
+func Test_splitByManifest(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	outDir := t.TempDir()
+	writeTree(t, filepath.Join(outDir, "foo"),
+		"usr/bin/foo",
+		"usr/include/foo/foo.h",
+		"usr/lib/libfoo.a",
+		"usr/lib/libfoo.so.1",
+	)
+
+	subpackages := []config.Subpackage{{
+		Name:  "foo-dev",
+		Files: []string{"usr/include", "usr/lib/*.a"},
+	}, {
+		Name: "foo-other",
+	}}
+
+	require.NoError(t, splitByManifest(ctx, outDir, "foo", subpackages))
+
+	for _, f := range []string{"foo/usr/bin/foo", "foo/usr/lib/libfoo.so.1", "foo-dev/usr/include/foo/foo.h", "foo-dev/usr/lib/libfoo.a"} {
+		require.FileExists(t, filepath.Join(outDir, f))
+	}
+	require.NoDirExists(t, filepath.Join(outDir, "foo", "usr", "include"))
+	require.NoFileExists(t, filepath.Join(outDir, "foo", "usr", "lib", "libfoo.a"))
+}
+
+func Test_splitByManifest_Unmatched(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	outDir := t.TempDir()
+	writeTree(t, filepath.Join(outDir, "foo"), "usr/bin/foo")
+
+	err := splitByManifest(ctx, outDir, "foo", []config.Subpackage{{
+		Name:  "foo-doc",
+		Files: []string{"usr/share/doc/**"},
+	}})
+	require.ErrorContains(t, err, "matched no files")
+
+	// Nothing should have been moved.
+	require.FileExists(t, filepath.Join(outDir, "foo", "usr", "bin", "foo"))
+}
+
+func Test_splitByManifest_Overlap(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	outDir := t.TempDir()
+	writeTree(t, filepath.Join(outDir, "foo"), "usr/lib/libfoo.a")
+
+	err := splitByManifest(ctx, outDir, "foo", []config.Subpackage{{
+		Name:  "foo-dev",
+		Files: []string{"usr/lib"},
+	}, {
+		Name:  "foo-static",
+		Files: []string{"usr/lib/*.a"},
+	}})
+	require.ErrorContains(t, err, "claimed by both foo-dev and foo-static")
+	require.FileExists(t, filepath.Join(outDir, "foo", "usr", "lib", "libfoo.a"))
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// The package metadata note of the ELF files, as specified by
+// https://systemd.io/ELF_PACKAGE_METADATA/ and read by readelf --notes and
+// systemd-analyze inspect-elf.
+const (
+	packageNoteSection = ".note.package"
+	packageNoteOwner   = "FDO"
+	packageNoteType    = 0xcafe1a7e
+)
+
+// packageNote is the description of the package metadata note.
+type packageNote struct {
+	Type         string `json:"type"`
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	BuildID      string `json:"buildId"`
+}
+
+// buildID identifies the build of the package pkgName.  It is derived from
+// what the build is of, rather than random, for the packages to be
+// reproducible.
+func (b *Build) buildID(pkgName string) string {
+	version, epoch := b.Configuration.VersionOf(pkgName)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s-r%d\x00%s\x00%s\x00%d",
+		b.Configuration.Package.Name,
+		version, epoch,
+		b.Arch.ToAPK(),
+		b.Configuration.Package.Commit,
+		b.SourceDateEpoch.Unix())
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// stampBinaries adds the package metadata note to the ELF executables and
+// shared libraries of the package in dir, recording the package, its
+// version and the build which produced them.  The files which have one
+// already, such as those linked with --package-metadata, are left alone.
+func (b *Build) stampBinaries(ctx context.Context, pkgName, dir string) error {
+	if !b.StampBinaries {
+		return nil
+	}
+
+	version, epoch := b.Configuration.VersionOf(pkgName)
+	desc, err := json.Marshal(packageNote{
+		Type:         "apk",
+		Name:         pkgName,
+		Version:      fmt.Sprintf("%s-r%d", version, epoch),
+		Architecture: b.Arch.ToAPK(),
+		BuildID:      b.buildID(pkgName),
+	})
+	if err != nil {
+		return err
+	}
+
+	stamped := 0
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		ok, err := stampELF(path, desc)
+		if err != nil {
+			rel, _ := filepath.Rel(dir, path)
+			return fmt.Errorf("stamping /%s: %w", rel, err)
+		}
+		if ok {
+			stamped++
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if stamped != 0 {
+		clog.FromContext(ctx).Infof("%s: stamped %d binaries with the package metadata", pkgName, stamped)
+	}
+
+	return nil
+}
+
+// packageNoteData returns the package metadata note with the description
+// desc, padded to 4 bytes.
+func packageNoteData(order binary.ByteOrder, desc []byte) []byte {
+	pad := func(n int) int { return (n + 3) &^ 3 }
+
+	name := append([]byte(packageNoteOwner), 0)
+	note := make([]byte, 12, 12+pad(len(name))+pad(len(desc)+1))
+	order.PutUint32(note[0:4], uint32(len(name)))
+	// The description is a NUL-terminated string.
+	order.PutUint32(note[4:8], uint32(len(desc)+1))
+	order.PutUint32(note[8:12], packageNoteType)
+	note = append(note, name...)
+	note = append(note, make([]byte, pad(len(name))-len(name))...)
+	note = append(note, desc...)
+	note = append(note, make([]byte, pad(len(desc)+1)-len(desc))...)
+
+	return note
+}
+
+// stampELF adds a package metadata note with the description desc to the
+// ELF executable or shared library at path, and returns whether it did.
+// The note, a copy of the section name string table with the name of the
+// note, and a copy of the section header table with the header of the note
+// are appended to the file, which is rewritten in place: the contents of
+// the sections which are loaded are left as they were.
+func stampELF(path string, desc []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		f.Close()
+		return false, nil
+	}
+	stampable := (ef.Type == elf.ET_EXEC || ef.Type == elf.ET_DYN) && len(ef.Sections) != 0 && ef.Section(packageNoteSection) == nil
+	f.Close()
+	if !stampable {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	// Binaries are often installed read-only, and writing to a setuid or
+	// setgid binary clears those bits, so its mode is restored once it is
+	// written, whatever happened.
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if mode&0o200 == 0 {
+		if err := os.Chmod(path, mode.Perm()|0o200); err != nil {
+			return false, err
+		}
+	}
+	ok, err := appendPackageNote(path, desc)
+	return ok, errors.Join(err, os.Chmod(path, mode))
+}
+
+// appendPackageNote appends the package metadata note with the description
+// desc to the ELF file at path, as stampELF describes.
+func appendPackageNote(path string, desc []byte) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return false, err
+	}
+
+	hdr := make([]byte, 64)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return false, err
+	}
+	order := ef.ByteOrder
+	var shoff uint64
+	var shentsize, shnum, shstrndx uint16
+	var shoffAt, shnumAt int
+	shdrSize, align := uint16(40), uint64(4)
+	if ef.Class == elf.ELFCLASS64 {
+		shoff, shoffAt = order.Uint64(hdr[0x28:]), 0x28
+		shentsize, shnum, shnumAt, shstrndx = order.Uint16(hdr[0x3a:]), order.Uint16(hdr[0x3c:]), 0x3c, order.Uint16(hdr[0x3e:])
+		shdrSize, align = 64, 8
+	} else {
+		shoff, shoffAt = uint64(order.Uint32(hdr[0x20:])), 0x20
+		shentsize, shnum, shnumAt, shstrndx = order.Uint16(hdr[0x2e:]), order.Uint16(hdr[0x30:]), 0x30, order.Uint16(hdr[0x32:])
+	}
+
+	// Extended section numbering is too rare to bother with.
+	if shentsize != shdrSize || shnum == 0 || shnum >= uint16(elf.SHN_LORESERVE)-1 || shstrndx == 0 || shstrndx >= shnum {
+		return false, nil
+	}
+
+	headers := make([]byte, int(shentsize)*int(shnum))
+	if _, err := f.ReadAt(headers, int64(shoff)); err != nil {
+		return false, err
+	}
+	strtab := ef.Sections[shstrndx]
+	strs, err := strtab.Data()
+	if err != nil {
+		return false, err
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	alignTo := func(off, align uint64) uint64 { return (off + align - 1) &^ (align - 1) }
+
+	var buf bytes.Buffer
+	at := func() uint64 { return uint64(end) + uint64(buf.Len()) }
+	padTo := func(align uint64) { buf.Write(make([]byte, alignTo(at(), align)-at())) }
+
+	padTo(4)
+	noteOff := at()
+	note := packageNoteData(order, desc)
+	buf.Write(note)
+
+	strtabOff := at()
+	nameOff := uint64(len(strs))
+	buf.Write(strs)
+	buf.WriteString(packageNoteSection)
+	buf.WriteByte(0)
+	strtabSize := at() - strtabOff
+
+	padTo(align)
+	newShoff := at()
+	if ef.Class == elf.ELFCLASS64 {
+		shdrs := make([]elf.Section64, shnum)
+		if err := binary.Read(bytes.NewReader(headers), order, shdrs); err != nil {
+			return false, err
+		}
+		shdrs[shstrndx].Off, shdrs[shstrndx].Size = strtabOff, strtabSize
+		shdrs = append(shdrs, elf.Section64{
+			Name:      uint32(nameOff),
+			Type:      uint32(elf.SHT_NOTE),
+			Off:       noteOff,
+			Size:      uint64(len(note)),
+			Addralign: 4,
+		})
+		if err := binary.Write(&buf, order, shdrs); err != nil {
+			return false, err
+		}
+		order.PutUint64(hdr[shoffAt:], newShoff)
+	} else {
+		shdrs := make([]elf.Section32, shnum)
+		if err := binary.Read(bytes.NewReader(headers), order, shdrs); err != nil {
+			return false, err
+		}
+		shdrs[shstrndx].Off, shdrs[shstrndx].Size = uint32(strtabOff), uint32(strtabSize)
+		shdrs = append(shdrs, elf.Section32{
+			Name:      uint32(nameOff),
+			Type:      uint32(elf.SHT_NOTE),
+			Off:       uint32(noteOff),
+			Size:      uint32(len(note)),
+			Addralign: 4,
+		})
+		if err := binary.Write(&buf, order, shdrs); err != nil {
+			return false, err
+		}
+		if newShoff > 0xffffffff {
+			return false, fmt.Errorf("file too large")
+		}
+		order.PutUint32(hdr[shoffAt:], uint32(newShoff))
+	}
+	order.PutUint16(hdr[shnumAt:], shnum+1)
+
+	if _, err := f.WriteAt(buf.Bytes(), end); err != nil {
+		return false, err
+	}
+	// Only the ELF header is rewritten, once the rest is written.
+	if _, err := f.WriteAt(hdr[:shnumAt+2], 0); err != nil {
+		return false, err
+	}
+
+	return true, f.Close()
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestStampBinaries(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is not an ELF file")
+	}
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	// The test binary is as good an ELF executable as any.
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(exe)
+	require.NoError(t, err)
+	bin := filepath.Join(dir, "usr", "bin", "foo")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0o755))
+	require.NoError(t, os.WriteFile(bin, data, 0o555))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "foo.sh"), []byte("#!/bin/sh\n"), 0o755))
+
+	b := &Build{
+		Configuration:   config.Configuration{Package: config.Package{Name: "foo", Version: "1.2.3", Epoch: 1, Commit: "abc"}},
+		Arch:            apko_types.ParseArchitecture("amd64"),
+		SourceDateEpoch: time.Unix(1700000000, 0),
+	}
+
+	// Without --stamp-binaries, nothing changes.
+	require.NoError(t, b.stampBinaries(ctx, "foo-bin", dir))
+	after, err := os.ReadFile(bin)
+	require.NoError(t, err)
+	require.Equal(t, data, after)
+
+	b.StampBinaries = true
+	require.NoError(t, b.stampBinaries(ctx, "foo-bin", dir))
+
+	ef, err := elf.Open(bin)
+	require.NoError(t, err)
+	sec := ef.Section(packageNoteSection)
+	require.NotNil(t, sec)
+	require.Equal(t, elf.SHT_NOTE, sec.Type)
+	note, err := sec.Data()
+	require.NoError(t, err)
+	// The sections which were there are untouched.
+	text, err := ef.Section(".text").Data()
+	require.NoError(t, err)
+	ef.Close()
+
+	orig, err := elf.NewFile(bytes.NewReader(data))
+	require.NoError(t, err)
+	origText, err := orig.Section(".text").Data()
+	require.NoError(t, err)
+	require.Equal(t, origText, text)
+
+	require.Equal(t, uint32(4), ef.ByteOrder.Uint32(note[0:4]))
+	require.Equal(t, uint32(packageNoteType), ef.ByteOrder.Uint32(note[8:12]))
+	require.Equal(t, "FDO\x00", string(note[12:16]))
+	descsz := ef.ByteOrder.Uint32(note[4:8])
+	desc := note[16 : 16+descsz]
+	require.Equal(t, byte(0), desc[len(desc)-1])
+
+	got := packageNote{}
+	require.NoError(t, json.Unmarshal(desc[:len(desc)-1], &got))
+	require.Equal(t, packageNote{
+		Type:         "apk",
+		Name:         "foo-bin",
+		Version:      "1.2.3-r1",
+		Architecture: "x86_64",
+		BuildID:      b.buildID("foo-bin"),
+	}, got)
+	require.Len(t, got.BuildID, 32)
+
+	// The permissions are kept, and the binary still runs.
+	fi, err := os.Stat(bin)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o555), fi.Mode().Perm())
+	require.NoError(t, exec.Command(bin, "-test.run=^$").Run())
+
+	// A binary is only stamped once.
+	stamped, err := os.ReadFile(bin)
+	require.NoError(t, err)
+	require.NoError(t, b.stampBinaries(ctx, "foo-bin", dir))
+	after, err = os.ReadFile(bin)
+	require.NoError(t, err)
+	require.Equal(t, stamped, after)
+
+	// The build ID depends on the build.
+	other := *b
+	other.SourceDateEpoch = time.Unix(1700000001, 0)
+	require.NotEqual(t, b.buildID("foo-bin"), other.buildID("foo-bin"))
+
+	// Subpackages with their own version are stamped with it.
+	b.Configuration.Subpackages = []config.Subpackage{{Name: "foo-compat", Version: "0.9", Epoch: 2}}
+	require.NoError(t, os.WriteFile(bin, data, 0o555))
+	require.NoError(t, b.stampBinaries(ctx, "foo-compat", dir))
+	ef, err = elf.Open(bin)
+	require.NoError(t, err)
+	note, err = ef.Section(packageNoteSection).Data()
+	require.NoError(t, err)
+	ef.Close()
+	descsz = ef.ByteOrder.Uint32(note[4:8])
+	got = packageNote{}
+	require.NoError(t, json.Unmarshal(note[16:16+descsz-1], &got))
+	require.Equal(t, "0.9-r2", got.Version)
+	require.Equal(t, b.buildID("foo-compat"), got.BuildID)
+	require.NotEqual(t, b.buildID("foo-bin"), got.BuildID)
+}
+
+func TestStampBinaries_setuid(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the test binary is not an ELF file")
+	}
+	ctx := slogtest.TestContextWithLogger(t)
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(exe)
+	require.NoError(t, err)
+
+	b := &Build{
+		Configuration: config.Configuration{Package: config.Package{Name: "foo", Version: "1.2.3"}},
+		Arch:          apko_types.ParseArchitecture("amd64"),
+		StampBinaries: true,
+	}
+
+	// The setuid, setgid and sticky bits are kept, whether the binary is
+	// writable or not.
+	for _, mode := range []os.FileMode{
+		0o555 | os.ModeSetuid,
+		0o755 | os.ModeSetuid,
+		0o755 | os.ModeSetgid,
+		0o755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky,
+	} {
+		dir := t.TempDir()
+		bin := filepath.Join(dir, "su")
+		require.NoError(t, os.WriteFile(bin, data, 0o600))
+		require.NoError(t, os.Chmod(bin, mode))
+
+		require.NoError(t, b.stampBinaries(ctx, "foo", dir))
+
+		ef, err := elf.Open(bin)
+		require.NoError(t, err)
+		require.NotNil(t, ef.Section(packageNoteSection))
+		ef.Close()
+
+		fi, err := os.Stat(bin)
+		require.NoError(t, err)
+		require.Equal(t, mode, fi.Mode(), "%v", mode)
+	}
+}
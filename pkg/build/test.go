@@ -57,11 +57,16 @@ type Test struct {
 	CacheDir          string
 	ApkCacheDir       string
 	CacheSource       string
+	CacheKey          string
 	Runner            container.Runner
 	Debug             bool
 	DebugRunner       bool
 	Interactive       bool
 	LogPolicy         []string
+
+	// locks are held on the temporary directories until the test is
+	// closed.
+	locks []*fileLock
 }
 
 func NewTest(ctx context.Context, opts ...TestOption) (*Test, error) {
@@ -95,11 +100,12 @@ func NewTest(ctx context.Context, opts ...TestOption) (*Test, error) {
 
 		t.WorkspaceDir = absdir
 	} else {
-		tmpdir, err := os.MkdirTemp(t.Runner.TempDir(), "melange-workspace-*")
+		tmpdir, l, err := lockedTempDir(t.Runner.TempDir(), "workspace-*")
 		if err != nil {
 			return nil, fmt.Errorf("unable to create workspace dir: %w", err)
 		}
 		t.WorkspaceDir = tmpdir
+		t.locks = append(t.locks, l)
 	}
 
 	parsedCfg, err := config.ParseConfiguration(ctx, t.ConfigFile)
@@ -118,7 +124,7 @@ func NewTest(ctx context.Context, opts ...TestOption) (*Test, error) {
 }
 
 func (t *Test) Close() error {
-	return t.Runner.Close()
+	return errors.Join(t.Runner.Close(), unlockAll(t.locks))
 }
 
 // BuildGuest invokes apko to create the test image for the guest environment.
@@ -130,10 +136,11 @@ func (t *Test) BuildGuest(ctx context.Context, imgConfig apko_types.ImageConfigu
 	ctx, span := otel.Tracer("melange").Start(ctx, "BuildGuest")
 	defer span.End()
 
-	tmp, err := os.MkdirTemp(os.TempDir(), "apko-temp-*")
+	tmp, l, err := lockedTempDir(os.TempDir(), "apko-temp-*")
 	if err != nil {
 		return "", fmt.Errorf("creating apko tempdir: %w", err)
 	}
+	defer l.Unlock()
 	defer os.RemoveAll(tmp)
 
 	bc, err := apko_build.New(ctx, guestFS,
@@ -241,7 +248,12 @@ func (t *Test) PopulateCache(ctx context.Context) error {
 	// --cache-dir=gs://bucket/path/to/cache first pulls all found objects to a
 	// tmp dir which is subsequently used as the cache.
 	if strings.HasPrefix(t.CacheSource, "gs://") {
-		tmp, err := fetchBucket(ctx, t.CacheSource, cmm)
+		key, err := loadCacheKey(ctx, t.CacheKey)
+		if err != nil {
+			return err
+		}
+
+		tmp, err := fetchBucket(ctx, t.CacheSource, cmm, key)
 		if err != nil {
 			return err
 		}
@@ -352,12 +364,20 @@ func (t *Test) TestPackage(ctx context.Context) error {
 		return nil
 	}
 
+	if result, err := pb.ShouldBuild(); err != nil {
+		return err
+	} else if !result {
+		log.Warnf("skipping test for %s on %s: package if-conditional %q is false", pkg.Name, t.Arch, pkg.If)
+		return nil
+	}
+
 	if t.GuestDir == "" {
-		guestDir, err := os.MkdirTemp(t.Runner.TempDir(), "melange-guest-*")
+		guestDir, l, err := lockedTempDir(t.Runner.TempDir(), "guest-*")
 		if err != nil {
 			return fmt.Errorf("unable to make guest directory: %w", err)
 		}
 		t.GuestDir = guestDir
+		t.locks = append(t.locks, l)
 	}
 
 	log.Infof("evaluating main pipeline for package requirements")
@@ -567,7 +587,7 @@ func (t *Test) buildWorkspaceConfig(ctx context.Context, imgRef, pkgName string,
 		}
 	}
 
-	// TODO(kaniini): Disable networking capability according to the pipeline requirements.
+	// Unlike builds, tests keep network access in every step.
 	caps := container.Capabilities{
 		Networking: true,
 	}
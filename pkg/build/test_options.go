@@ -86,6 +86,15 @@ func WithTestCacheSource(sourceDir string) TestOption {
 	}
 }
 
+// WithTestCacheKey sets the reference to the passphrase which the objects of
+// the cache source are encrypted with, as accepted by cachecrypt.LoadKey.
+func WithTestCacheKey(ref string) TestOption {
+	return func(t *Test) error {
+		t.CacheKey = ref
+		return nil
+	}
+}
+
 // WithTestArch sets the build architecture to use for this test context.
 func WithTestArch(arch apko_types.Architecture) TestOption {
 	return func(t *Test) error {
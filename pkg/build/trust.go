@@ -0,0 +1,214 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"chainguard.dev/melange/pkg/verify"
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// RepositoryReport records the key which verified the index of a
+// repository used to build the build environment.
+type RepositoryReport struct {
+	// The repository, as configured
+	URL string `json:"url" yaml:"url"`
+	// The file name of the key which signed its index
+	Key string `json:"key" yaml:"key"`
+	// The fingerprint of the key, the SHA-256 digest of its DER encoding
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+}
+
+// verifiedIndex is the index of a repository whose signature was verified.
+type verifiedIndex struct {
+	repo RepositoryReport
+	pkgs []*apk.Package
+}
+
+// buildRepositories returns the repositories the build environment is
+// installed from, without their tags.
+func (b *Build) buildRepositories() []string {
+	repos := []string{}
+	for _, repo := range append(b.Configuration.Environment.Contents.Repositories, b.ExtraRepos...) {
+		// Tagged repositories are written as "@tag url".
+		if strings.HasPrefix(repo, "@") {
+			if _, url, ok := strings.Cut(repo, " "); ok {
+				repo = strings.TrimSpace(url)
+			}
+		}
+		repos = append(repos, strings.TrimSuffix(repo, "/"))
+	}
+
+	return repos
+}
+
+// trustedKeys loads the keys of the build environment keyring.
+func (b *Build) trustedKeys(ctx context.Context) (verify.Keys, error) {
+	keys := verify.Keys{}
+	for _, loc := range append(b.Configuration.Environment.Contents.Keyring, b.ExtraKeys...) {
+		rc, err := openLocation(ctx, loc)
+		if err != nil {
+			return nil, fmt.Errorf("loading key %s: %w", loc, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("loading key %s: %w", loc, err)
+		}
+
+		keys[path.Base(loc)] = data
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no trusted keys are configured in environment.contents.keyring or with --keyring-append")
+	}
+
+	return keys, nil
+}
+
+// verifyRepositories verifies the signature of the index of every
+// repository used to build the build environment against the trusted keys.
+func (b *Build) verifyRepositories(ctx context.Context) ([]verifiedIndex, error) {
+	log := clog.FromContext(ctx)
+
+	keys, err := b.trustedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := []verifiedIndex{}
+	errs := []error{}
+	for _, repo := range b.buildRepositories() {
+		loc := apk.IndexURL(repo, b.Arch.ToAPK())
+
+		rc, err := openLocation(ctx, loc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading index of %s: %w", repo, err))
+			continue
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading index of %s: %w", repo, err))
+			continue
+		}
+
+		key, err := verify.IndexSignature(data, keys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("verifying index of %s: %w", repo, err))
+			continue
+		}
+
+		idx, err := apk.IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing index of %s: %w", repo, err))
+			continue
+		}
+
+		fingerprint, err := keys.Fingerprint(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("verifying index of %s: %w", repo, err))
+			continue
+		}
+
+		log.Infof("verified index of %s with %s (%s)", repo, key, fingerprint)
+		indexes = append(indexes, verifiedIndex{
+			repo: RepositoryReport{URL: repo, Key: key, Fingerprint: fingerprint},
+			pkgs: idx.Packages,
+		})
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("untrusted repositories: %w", err)
+	}
+
+	return indexes, nil
+}
+
+// trustedFingerprints returns the fingerprints of the keys which verified
+// the indexes, once each, in order.
+func trustedFingerprints(indexes []verifiedIndex) []string {
+	fingerprints := []string{}
+	for _, idx := range indexes {
+		if !slices.Contains(fingerprints, idx.repo.Fingerprint) {
+			fingerprints = append(fingerprints, idx.repo.Fingerprint)
+		}
+	}
+
+	return fingerprints
+}
+
+// verifyInstalled checks that every package installed in the build
+// environment is listed, with the same control checksum, in a verified
+// index.  As the control section of a package holds the digest of its
+// data, this verifies the contents of the packages too.
+func (b *Build) verifyInstalled(indexes []verifiedIndex) error {
+	f, err := os.Open(filepath.Join(b.GuestDir, "lib", "apk", "db", "installed"))
+	if err != nil {
+		return fmt.Errorf("reading installed packages: %w", err)
+	}
+	defer f.Close()
+
+	installed, err := apk.ParsePackageIndex(f)
+	if err != nil {
+		return fmt.Errorf("parsing installed packages: %w", err)
+	}
+
+	type nameVersion struct{ name, version string }
+	checksums := map[nameVersion][][]byte{}
+	for _, idx := range indexes {
+		for _, pkg := range idx.pkgs {
+			nv := nameVersion{pkg.Name, pkg.Version}
+			checksums[nv] = append(checksums[nv], pkg.Checksum)
+		}
+	}
+
+	errs := []error{}
+	for _, pkg := range installed {
+		sums, ok := checksums[nameVersion{pkg.Name, pkg.Version}]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s-%s is not in any verified repository", pkg.Name, pkg.Version))
+			continue
+		}
+
+		found := false
+		for _, sum := range sums {
+			if bytes.Equal(sum, pkg.Checksum) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("%s-%s does not match the checksum in its verified repository", pkg.Name, pkg.Version))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("untrusted packages in the build environment: %w", err)
+	}
+
+	return nil
+}
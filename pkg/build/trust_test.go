@@ -0,0 +1,126 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/verify"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestKeypair(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	privPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), 0o600))
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	pubPath := privPath + ".pub"
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0o644))
+
+	return privPath, pubPath
+}
+
+func TestVerifyRepositories(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	keyDir := t.TempDir()
+	privPath, pubPath := writeTestKeypair(t, keyDir, "trusted.rsa")
+	_, otherPath := writeTestKeypair(t, keyDir, "other.rsa")
+
+	repo := t.TempDir()
+	archDir := filepath.Join(repo, "x86_64")
+	require.NoError(t, os.MkdirAll(archDir, 0o755))
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(archDir, "libcap-2.69-r0.apk"), data, 0o644))
+
+	idx, err := index.New(
+		index.WithPackageDir(archDir),
+		index.WithIndexFile(filepath.Join(archDir, "APKINDEX.tar.gz")),
+		index.WithSigningKey(privPath),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	b := &Build{Arch: apko_types.ParseArchitecture("x86_64"), GuestDir: t.TempDir()}
+	b.Configuration.Environment.Contents.Repositories = []string{"@local " + repo + "/"}
+
+	// Without keys, nothing can be trusted.
+	_, err = b.verifyRepositories(ctx)
+	require.ErrorContains(t, err, "no trusted keys")
+
+	b.ExtraKeys = []string{otherPath}
+	_, err = b.verifyRepositories(ctx)
+	require.ErrorContains(t, err, "untrusted repositories")
+
+	b.ExtraKeys = []string{pubPath}
+	indexes, err := b.verifyRepositories(ctx)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	keys, err := verify.LoadKeys([]string{pubPath})
+	require.NoError(t, err)
+	fingerprint, err := keys.Fingerprint("trusted.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, RepositoryReport{URL: repo, Key: "trusted.rsa.pub", Fingerprint: fingerprint}, indexes[0].repo)
+
+	// A key which verified several repositories is recorded once.
+	require.Equal(t, []string{fingerprint}, trustedFingerprints(append(indexes, indexes[0])))
+
+	checksum := indexes[0].pkgs[0].ChecksumString()
+
+	dbDir := filepath.Join(b.GuestDir, "lib", "apk", "db")
+	require.NoError(t, os.MkdirAll(dbDir, 0o755))
+	writeInstalled := func(entries ...string) {
+		db := ""
+		for _, e := range entries {
+			db += e + "\n"
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dbDir, "installed"), []byte(db), 0o644))
+	}
+
+	writeInstalled(fmt.Sprintf("C:%s\nP:libcap\nV:2.69-r0\n", checksum))
+	require.NoError(t, b.verifyInstalled(indexes))
+
+	// A package with another control section than the one in the index.
+	writeInstalled("C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:libcap\nV:2.69-r0\n")
+	require.ErrorContains(t, b.verifyInstalled(indexes), "does not match the checksum")
+
+	writeInstalled(fmt.Sprintf("C:%s\nP:libcap\nV:2.69-r0\n", checksum), "C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:evil\nV:1.0-r0\n")
+	require.ErrorContains(t, b.verifyInstalled(indexes), "evil-1.0-r0 is not in any verified repository")
+}
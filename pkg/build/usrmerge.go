@@ -0,0 +1,196 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// The policies which Build.UsrMerge may be set to.
+const (
+	// UsrMergeMove moves the files, for the distributions whose /bin, /sbin,
+	// /lib and /lib64 are symlinks to their /usr counterparts.
+	UsrMergeMove = "move"
+	// UsrMergeSymlink moves the files and leaves symlinks to them at their
+	// old paths.
+	UsrMergeSymlink = "symlink"
+)
+
+// usrMergeDirs are the directories of the root whose files belong in their
+// /usr counterparts.
+var usrMergeDirs = []string{"bin", "sbin", "lib", "lib64"}
+
+// usrPath returns the absolute path p with usr-merge applied.
+func usrPath(p string) string {
+	for _, top := range usrMergeDirs {
+		if p == "/"+top || strings.HasPrefix(p, "/"+top+"/") {
+			return "/usr" + p
+		}
+	}
+
+	return p
+}
+
+// linkTarget returns the absolute path of the target of the symlink p of a
+// package, whose target is target.
+func linkTarget(p, target string) string {
+	if path.IsAbs(target) {
+		return path.Clean(target)
+	}
+	return path.Join("/", path.Dir(p), target)
+}
+
+// relativeLink returns the target of a symlink at p to the absolute path
+// target, relative to p.
+func relativeLink(p, target string) (string, error) {
+	return filepath.Rel(path.Dir("/"+p), target)
+}
+
+// mergeUsr moves the files which the package pkgName in dir installed in
+// /bin, /sbin, /lib and /lib64 to their /usr counterparts, as the policy
+// says, so that the packages follow usr-merge without moving them in their
+// pipelines.  The targets of the moved symlinks are rewritten.
+func mergeUsr(ctx context.Context, pkgName, dir, policy string) error {
+	if policy == "" {
+		return nil
+	}
+	log := clog.FromContext(ctx)
+
+	moved := 0
+	for _, top := range usrMergeDirs {
+		// A symlink, e.g. of a base layout package, is left alone.
+		if fi, err := os.Lstat(filepath.Join(dir, top)); errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.IsDir()) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		files := []string{}
+		dirs := []string{}
+		if err := fs.WalkDir(os.DirFS(dir), top, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				dirs = append(dirs, p)
+			} else {
+				files = append(files, p)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, p := range files {
+			if err := moveToUsr(dir, p, policy); err != nil {
+				return fmt.Errorf("usr-merge of %s: %w", pkgName, err)
+			}
+			moved++
+		}
+
+		// Remove the directories left empty, deepest first.
+		slices.Reverse(dirs)
+		for _, d := range dirs {
+			entries, err := os.ReadDir(filepath.Join(dir, d))
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				if err := os.Remove(filepath.Join(dir, d)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if moved != 0 {
+		log.Infof("%s: moved %d files to /usr", pkgName, moved)
+	}
+
+	return nil
+}
+
+// moveToUsr moves the file p of the package in dir to its /usr counterpart.
+func moveToUsr(dir, p, policy string) error {
+	dst := strings.TrimPrefix(usrPath("/"+p), "/")
+	src, dstPath := filepath.Join(dir, p), filepath.Join(dir, dst)
+
+	srcTarget, err := os.Readlink(src)
+	isLink := err == nil
+
+	if fi, err := os.Lstat(dstPath); err == nil {
+		dstTarget, err := os.Readlink(dstPath)
+		switch {
+		case err == nil && usrPath(linkTarget(dst, dstTarget)) == "/"+dst:
+			// The new path links to the old one, which replaces it.
+			if err := os.Remove(dstPath); err != nil {
+				return err
+			}
+		case isLink && usrPath(linkTarget(p, srcTarget)) == "/"+dst:
+			// The old path already links to the new one.
+			if policy == UsrMergeMove {
+				return os.Remove(src)
+			}
+			return nil
+		case fi.IsDir():
+			return fmt.Errorf("/%s is a directory, where /%s moves to", dst, p)
+		default:
+			return fmt.Errorf("both /%s and /%s exist", p, dst)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+
+	if isLink {
+		target := usrPath(linkTarget(p, srcTarget))
+		if !path.IsAbs(srcTarget) {
+			if target, err = relativeLink(dst, target); err != nil {
+				return err
+			}
+		}
+		if err := os.Symlink(target, dstPath); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+	} else if err := os.Rename(src, dstPath); err != nil {
+		return err
+	}
+
+	if policy == UsrMergeSymlink {
+		target, err := relativeLink(p, "/"+dst)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, src)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeUsr(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		for _, d := range []string{"bin", "sbin", "lib/modules/6.1", "usr/bin"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0o755))
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "bin", "busybox"), []byte("busybox"), 0o755))
+		require.NoError(t, os.Symlink("busybox", filepath.Join(dir, "bin", "sh")))
+		require.NoError(t, os.Symlink("../bin/busybox", filepath.Join(dir, "sbin", "init")))
+		require.NoError(t, os.Symlink("/bin/busybox", filepath.Join(dir, "sbin", "halt")))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "lib", "modules", "6.1", "foo.ko"), []byte("foo"), 0o644))
+		require.NoError(t, os.Symlink("../../bin/busybox", filepath.Join(dir, "usr", "bin", "busybox")))
+		return dir
+	}
+
+	contents := func(t *testing.T, dir string) map[string]string {
+		got := map[string]string{}
+		require.NoError(t, fs.WalkDir(os.DirFS(dir), ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if target, err := os.Readlink(filepath.Join(dir, p)); err == nil {
+				got[p] = "-> " + target
+				return nil
+			}
+			data, err := os.ReadFile(filepath.Join(dir, p))
+			got[p] = string(data)
+			return err
+		}))
+		return got
+	}
+
+	dir := setup(t)
+	require.NoError(t, mergeUsr(ctx, "busybox", dir, UsrMergeMove))
+	require.Equal(t, map[string]string{
+		"usr/bin/busybox":            "busybox",
+		"usr/bin/sh":                 "-> busybox",
+		"usr/sbin/init":              "-> ../bin/busybox",
+		"usr/sbin/halt":              "-> /usr/bin/busybox",
+		"usr/lib/modules/6.1/foo.ko": "foo",
+	}, contents(t, dir))
+	for _, d := range []string{"bin", "sbin", "lib"} {
+		_, err := os.Lstat(filepath.Join(dir, d))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	}
+
+	dir = setup(t)
+	require.NoError(t, mergeUsr(ctx, "busybox", dir, UsrMergeSymlink))
+	require.Equal(t, map[string]string{
+		"bin/busybox":                "-> ../usr/bin/busybox",
+		"bin/sh":                     "-> ../usr/bin/sh",
+		"sbin/init":                  "-> ../usr/sbin/init",
+		"sbin/halt":                  "-> ../usr/sbin/halt",
+		"lib/modules/6.1/foo.ko":     "-> ../../../usr/lib/modules/6.1/foo.ko",
+		"usr/bin/busybox":            "busybox",
+		"usr/bin/sh":                 "-> busybox",
+		"usr/sbin/init":              "-> ../bin/busybox",
+		"usr/sbin/halt":              "-> /usr/bin/busybox",
+		"usr/lib/modules/6.1/foo.ko": "foo",
+	}, contents(t, dir))
+
+	dir = setup(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "sh"), []byte("sh"), 0o755))
+	require.ErrorContains(t, mergeUsr(ctx, "busybox", dir, UsrMergeMove), "both /bin/sh and /usr/bin/sh exist")
+}
@@ -0,0 +1,482 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/plugin"
+	"chainguard.dev/melange/pkg/sca"
+)
+
+// WorkspaceFS is the filesystem of the files installed for a package, which
+// its data section, installed size and dependencies are generated from.
+type WorkspaceFS interface {
+	sca.SCAFS
+	apkofs.XattrFS
+}
+
+// WorkspaceFSFunc returns the WorkspaceFS of the files installed for the
+// package named pkgName, e.g. on a remote filesystem.
+type WorkspaceFSFunc func(pkgName string) (WorkspaceFS, error)
+
+// IDMap maps a range of user or group IDs of the build environment to the
+// IDs which own the files of the workspace on the host, like a line of
+// /proc/<pid>/uid_map.
+type IDMap struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// ParseIDMaps parses comma-separated container:host:size ID maps, e.g.
+// 0:100000:65536.
+func ParseIDMaps(s string) ([]IDMap, error) {
+	maps := []IDMap{}
+	if s == "" {
+		return maps, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid ID map %q, must be container:host:size", entry)
+		}
+
+		ids := [3]uint32{}
+		for i, f := range fields {
+			id, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID map %q: %w", entry, err)
+			}
+			ids[i] = uint32(id)
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid ID map %q, its size is 0", entry)
+		}
+
+		maps = append(maps, IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+
+	return maps, nil
+}
+
+// mapID returns the ID of the build environment which owns the files of the
+// host owned by id, or id itself if no map covers it.
+func mapID(maps []IDMap, id uint32) uint32 {
+	for _, m := range maps {
+		if id >= m.HostID && id-m.HostID < m.Size {
+			return m.ContainerID + (id - m.HostID)
+		}
+	}
+	return id
+}
+
+// workspaceFS returns the WorkspaceFS of the files installed for pkgName:
+// the one of WorkspaceFS if it is set, or the melange-out directory of the
+// workspace.  The files which melange adds to the packages itself, such as
+// their SBOMs and license files, are written to the melange-out directory
+// either way, so they are added to those of WorkspaceFS.
+func (b *Build) workspaceFS(pkgName string) (WorkspaceFS, error) {
+	local := readlinkFS(filepath.Join(b.WorkspaceDir, "melange-out", pkgName))
+
+	fsys := local
+	if b.WorkspaceFS != nil {
+		var err error
+		if fsys, err = b.WorkspaceFS(pkgName); err != nil {
+			return nil, fmt.Errorf("opening the workspace of %s: %w", pkgName, err)
+		}
+	}
+
+	if b.WorkspaceOverlay {
+		fsys = &overlayUpperFS{WorkspaceFS: fsys}
+	}
+	if len(b.WorkspaceUIDMap) != 0 || len(b.WorkspaceGIDMap) != 0 {
+		fsys = &idmapFS{WorkspaceFS: fsys, uids: b.WorkspaceUIDMap, gids: b.WorkspaceGIDMap}
+	}
+	if b.NoHardLinks {
+		fsys = &copyLinksFS{WorkspaceFS: fsys}
+	}
+
+	if b.WorkspaceFS != nil {
+		fsys = &addedFilesFS{WorkspaceFS: fsys, added: local}
+	}
+
+	return fsys, nil
+}
+
+// sbomFS returns the files of pkgName which its SBOM lists: those of
+// workspaceFS if WorkspaceFS is set, or nil for the SBOM generator to read
+// the melange-out directory of the workspace, which it writes the SBOM to.
+func (b *Build) sbomFS(pkgName string) (fs.FS, error) {
+	if b.WorkspaceFS == nil {
+		return nil, nil
+	}
+	return b.workspaceFS(pkgName)
+}
+
+// checkWorkspaceFS returns an error if the build needs to change the files
+// installed for the packages in place, which it can only do in the
+// melange-out directory of the workspace, and WorkspaceFS is set.
+func (b *Build) checkWorkspaceFS() error {
+	if b.WorkspaceFS == nil {
+		return nil
+	}
+
+	needs := []string{}
+	if b.UsrMerge != "" {
+		needs = append(needs, "--usrmerge")
+	}
+	if b.StampBinaries {
+		needs = append(needs, "--stamp-binaries")
+	}
+	if len(plugin.OfKind(b.plugins, plugin.KindGenerator)) != 0 || len(plugin.OfKind(b.plugins, plugin.KindLinter)) != 0 {
+		needs = append(needs, "generator and linter plugins")
+	}
+
+	rpaths := func(name string, options config.PackageOption) {
+		if len(options.RPathRewrites) != 0 {
+			needs = append(needs, fmt.Sprintf("the rpath-rewrites of %s", name))
+		}
+		if options.RPath == config.RPathPolicyFail || options.RPath == config.RPathPolicyStrip {
+			needs = append(needs, fmt.Sprintf("the rpath policy of %s", name))
+		}
+	}
+
+	pkg := b.Configuration.Package
+	if pkg.Options.DevFiles == config.DevFilesPolicyMove {
+		needs = append(needs, "dev-files: move")
+	}
+	rpaths(pkg.Name, pkg.Options)
+	for _, sp := range b.Configuration.Subpackages {
+		if len(sp.Files) != 0 {
+			needs = append(needs, fmt.Sprintf("the files of %s", sp.Name))
+		}
+		if len(sp.Compat.Links) != 0 {
+			needs = append(needs, fmt.Sprintf("the compat links of %s", sp.Name))
+		}
+		rpaths(sp.Name, sp.Options)
+	}
+
+	if len(needs) != 0 {
+		return fmt.Errorf("%s need the packages to be in the workspace, not on a WorkspaceFS", strings.Join(needs, ", "))
+	}
+
+	return nil
+}
+
+// addedFilesFS adds the files which melange wrote to the melange-out
+// directory of the workspace to those of a WorkspaceFS.  A directory which
+// both have is the one of the WorkspaceFS, with the entries of both.
+type addedFilesFS struct {
+	WorkspaceFS
+
+	added WorkspaceFS
+}
+
+// of returns the filesystem which name is taken from.
+func (f *addedFilesFS) of(name string) WorkspaceFS {
+	fi, err := f.added.Stat(name)
+	if err != nil {
+		return f.WorkspaceFS
+	}
+	if fi.IsDir() {
+		if _, err := f.WorkspaceFS.Stat(name); err == nil {
+			return f.WorkspaceFS
+		}
+	}
+	return f.added
+}
+
+func (f *addedFilesFS) Open(name string) (fs.File, error) {
+	return f.of(name).Open(name)
+}
+
+func (f *addedFilesFS) Stat(name string) (fs.FileInfo, error) {
+	return f.of(name).Stat(name)
+}
+
+func (f *addedFilesFS) Readlink(name string) (string, error) {
+	return f.of(name).Readlink(name)
+}
+
+func (f *addedFilesFS) GetXattr(path string, attr string) ([]byte, error) {
+	return f.of(path).GetXattr(path, attr)
+}
+
+func (f *addedFilesFS) ListXattrs(path string) (map[string][]byte, error) {
+	return f.of(path).ListXattrs(path)
+}
+
+func (f *addedFilesFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.WorkspaceFS, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	added, addedErr := fs.ReadDir(f.added, name)
+	if errors.Is(addedErr, fs.ErrNotExist) {
+		return entries, err
+	} else if addedErr != nil {
+		return nil, addedErr
+	}
+
+	byName := map[string]fs.DirEntry{}
+	for _, d := range entries {
+		byName[d.Name()] = d
+	}
+	for _, d := range added {
+		if prev, ok := byName[d.Name()]; !ok || !(prev.IsDir() && d.IsDir()) {
+			byName[d.Name()] = d
+		}
+	}
+
+	merged := make([]fs.DirEntry, 0, len(byName))
+	for _, d := range byName {
+		merged = append(merged, d)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+
+	return merged, nil
+}
+
+// lexists returns whether fsys has a file at name, which may be a dangling
+// symlink.
+func lexists(fsys WorkspaceFS, name string) (bool, error) {
+	if _, err := fsys.Stat(name); err == nil {
+		return true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	_, err := fsys.Readlink(name)
+	return err == nil, nil
+}
+
+// copyLinksFS hides the hard links of a WorkspaceFS, so that each of them is
+// packaged as a copy of the file.
+type copyLinksFS struct {
+	WorkspaceFS
+}
+
+// copyLinksDirEntry is a DirEntry whose hard links are hidden.
+type copyLinksDirEntry struct {
+	fs.DirEntry
+}
+
+func (d copyLinksDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return unlinkInfo(fi), nil
+}
+
+// unlinkInfo returns fi as the info of a file with a single link.
+func unlinkInfo(fi fs.FileInfo) fs.FileInfo {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil || st.Nlink < 2 {
+		return fi
+	}
+
+	unlinked := *st
+	unlinked.Nlink = 1
+
+	return statFileInfo{FileInfo: fi, sys: &unlinked}
+}
+
+func (f *copyLinksFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := f.WorkspaceFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return unlinkInfo(fi), nil
+}
+
+func (f *copyLinksFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.WorkspaceFS, name)
+	if err != nil {
+		return nil, err
+	}
+
+	unlinked := make([]fs.DirEntry, 0, len(entries))
+	for _, d := range entries {
+		unlinked = append(unlinked, copyLinksDirEntry{DirEntry: d})
+	}
+
+	return unlinked, nil
+}
+
+// idmapFS gives the files of a WorkspaceFS the owners they have in the build
+// environment, when it ran in a user namespace which maps its IDs to others
+// on the host.  Only the files whose FileInfo holds a syscall.Stat_t are
+// mapped.
+type idmapFS struct {
+	WorkspaceFS
+
+	uids, gids []IDMap
+}
+
+// statFileInfo is a FileInfo whose syscall.Stat_t is changed, e.g. to map
+// its owners.
+type statFileInfo struct {
+	fs.FileInfo
+
+	sys *syscall.Stat_t
+}
+
+func (fi statFileInfo) Sys() any {
+	return fi.sys
+}
+
+// idmapDirEntry is a DirEntry whose owners are mapped.
+type idmapDirEntry struct {
+	fs.DirEntry
+
+	fsys *idmapFS
+}
+
+func (d idmapDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return d.fsys.mapInfo(fi), nil
+}
+
+func (f *idmapFS) mapInfo(fi fs.FileInfo) fs.FileInfo {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return fi
+	}
+
+	mapped := *st
+	mapped.Uid = mapID(f.uids, st.Uid)
+	mapped.Gid = mapID(f.gids, st.Gid)
+
+	return statFileInfo{FileInfo: fi, sys: &mapped}
+}
+
+func (f *idmapFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := f.WorkspaceFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.mapInfo(fi), nil
+}
+
+func (f *idmapFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.WorkspaceFS, name)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := make([]fs.DirEntry, 0, len(entries))
+	for _, d := range entries {
+		mapped = append(mapped, idmapDirEntry{DirEntry: d, fsys: f})
+	}
+
+	return mapped, nil
+}
+
+// overlayXattrPrefixes are the prefixes of the extended attributes overlayfs
+// keeps its state in, which are not part of the files.
+var overlayXattrPrefixes = []string{"trusted.overlay.", "user.overlay."}
+
+// overlayUpperFS hides the whiteouts of a WorkspaceFS which is the upper
+// directory of an overlayfs, which record the files of the lower directories
+// the build removed, and the extended attributes overlayfs keeps its state
+// in.
+type overlayUpperFS struct {
+	WorkspaceFS
+}
+
+// isWhiteout returns whether fi is an overlayfs whiteout: a character device
+// whose device number is 0.
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st != nil && st.Rdev == 0
+}
+
+func (f *overlayUpperFS) Open(name string) (fs.File, error) {
+	if _, err := f.Stat(name); err != nil {
+		return nil, err
+	}
+	return f.WorkspaceFS.Open(name)
+}
+
+func (f *overlayUpperFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := f.WorkspaceFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if isWhiteout(fi) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fi, nil
+}
+
+func (f *overlayUpperFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.WorkspaceFS, name)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]fs.DirEntry, 0, len(entries))
+	for _, d := range entries {
+		if d.Type()&fs.ModeCharDevice != 0 {
+			fi, err := d.Info()
+			if err != nil {
+				return nil, err
+			}
+			if isWhiteout(fi) {
+				continue
+			}
+		}
+		kept = append(kept, d)
+	}
+
+	return kept, nil
+}
+
+func (f *overlayUpperFS) ListXattrs(path string) (map[string][]byte, error) {
+	xattrs, err := f.WorkspaceFS.ListXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range xattrs {
+		for _, pfx := range overlayXattrPrefixes {
+			if strings.HasPrefix(name, pfx) {
+				delete(xattrs, name)
+				break
+			}
+		}
+	}
+
+	return xattrs, nil
+}
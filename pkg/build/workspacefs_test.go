@@ -0,0 +1,309 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+// mapWorkspaceFS is a WorkspaceFS of files held in memory, as a remote
+// filesystem would provide.
+type mapWorkspaceFS struct {
+	fstest.MapFS
+
+	xattrs map[string]map[string][]byte
+}
+
+func (f mapWorkspaceFS) Readlink(name string) (string, error) {
+	file, ok := f.MapFS[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	return string(file.Data), nil
+}
+
+func (f mapWorkspaceFS) SetXattr(string, string, []byte) error {
+	return errors.ErrUnsupported
+}
+
+func (f mapWorkspaceFS) GetXattr(path string, attr string) ([]byte, error) {
+	return f.xattrs[path][attr], nil
+}
+
+func (f mapWorkspaceFS) RemoveXattr(string, string) error {
+	return errors.ErrUnsupported
+}
+
+func (f mapWorkspaceFS) ListXattrs(path string) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	for k, v := range f.xattrs[path] {
+		xattrs[k] = v
+	}
+	return xattrs, nil
+}
+
+func TestParseIDMaps(t *testing.T) {
+	maps, err := ParseIDMaps("0:100000:65536,65536:1000:1")
+	require.NoError(t, err)
+	require.Equal(t, []IDMap{{0, 100000, 65536}, {65536, 1000, 1}}, maps)
+
+	maps, err = ParseIDMaps("")
+	require.NoError(t, err)
+	require.Empty(t, maps)
+
+	for _, s := range []string{"0:100000", "0:100000:0", "a:b:c", "0:-1:1"} {
+		_, err := ParseIDMaps(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestWorkspaceFS(t *testing.T) {
+	owned := func(uid, gid uint32, mode fs.FileMode) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte("hello"), Mode: mode, Sys: &syscall.Stat_t{Uid: uid, Gid: gid}}
+	}
+	remote := mapWorkspaceFS{
+		MapFS: fstest.MapFS{
+			"usr/bin/hello":   owned(101000, 101000, 0o755),
+			"etc/hello.conf":  owned(100000, 100001, 0o644),
+			"etc/removed":     owned(100000, 100000, fs.ModeDevice|fs.ModeCharDevice),
+			"etc/unmapped":    owned(42, 42, 0o644),
+			"etc/hello.d/foo": owned(100000, 100000, 0o644),
+		},
+		xattrs: map[string]map[string][]byte{
+			"etc/hello.d": {"trusted.overlay.opaque": []byte("y"), "user.hello": []byte("world")},
+		},
+	}
+
+	b := &Build{
+		WorkspaceFS:      func(string) (WorkspaceFS, error) { return remote, nil },
+		WorkspaceUIDMap:  []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		WorkspaceGIDMap:  []IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		WorkspaceOverlay: true,
+	}
+	fsys, err := b.workspaceFS("hello")
+	require.NoError(t, err)
+
+	owners := map[string][2]uint32{}
+	require.NoError(t, fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		owners[path] = [2]uint32{st.Uid, st.Gid}
+		return nil
+	}))
+	require.Equal(t, map[string][2]uint32{
+		"usr/bin/hello":   {1000, 1000},
+		"etc/hello.conf":  {0, 1},
+		"etc/unmapped":    {42, 42},
+		"etc/hello.d/foo": {0, 0},
+	}, owners)
+
+	fi, err := fsys.Stat("usr/bin/hello")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1000), fi.Sys().(*syscall.Stat_t).Uid)
+
+	_, err = fsys.Stat("etc/removed")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.Open("etc/removed")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	xattrs, err := fsys.ListXattrs("etc/hello.d")
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"user.hello": []byte("world")}, xattrs)
+}
+
+func TestWorkspaceFS_emit(t *testing.T) {
+	ctx := context.Background()
+
+	ws := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "melange-out", "hello"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "melange-out", "hello", "hello"), []byte("hello\n"), 0o644))
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	pc := &PackageBuild{
+		Build: &Build{
+			WorkspaceDir:    ws,
+			SourceDateEpoch: time.Unix(0, 0),
+			TarOwners:       TarOwnersNumeric,
+			WorkspaceUIDMap: []IDMap{{ContainerID: 1234, HostID: uid, Size: 1}},
+			WorkspaceGIDMap: []IDMap{{ContainerID: 5678, HostID: gid, Size: 1}},
+		},
+		Origin:      &config.Package{Name: "hello", Version: "1.0"},
+		PackageName: "hello",
+	}
+	fsys, err := pc.Build.workspaceFS(pc.PackageName)
+	require.NoError(t, err)
+
+	var data bytes.Buffer
+	_, err = pc.emitDataSection(ctx, fsys, os.DirFS(t.TempDir()), map[int]int{}, map[int]int{}, &data)
+	require.NoError(t, err)
+
+	hdrs := readTarHeaders(t, &data)
+	require.Len(t, hdrs, 1)
+	require.Equal(t, 1234, hdrs[0].Uid)
+	require.Equal(t, 5678, hdrs[0].Gid)
+}
+
+func TestWorkspaceFS_hardLinks(t *testing.T) {
+	ctx := context.Background()
+
+	ws := t.TempDir()
+	bin := filepath.Join(ws, "melange-out", "git", "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "git"), []byte("git\n"), 0o755))
+	require.NoError(t, os.Link(filepath.Join(bin, "git"), filepath.Join(bin, "git-add")))
+	require.NoError(t, os.Link(filepath.Join(bin, "git"), filepath.Join(bin, "git-commit")))
+
+	for _, noHardLinks := range []bool{false, true} {
+		pc := &PackageBuild{
+			Build:       &Build{WorkspaceDir: ws, SourceDateEpoch: time.Unix(0, 0), NoHardLinks: noHardLinks},
+			Origin:      &config.Package{Name: "git", Version: "1.0"},
+			PackageName: "git",
+		}
+		fsys, err := pc.Build.workspaceFS(pc.PackageName)
+		require.NoError(t, err)
+
+		require.NoError(t, pc.calculateInstalledSize(fsys))
+		var data bytes.Buffer
+		_, err = pc.emitDataSection(ctx, fsys, os.DirFS(t.TempDir()), map[int]int{}, map[int]int{}, &data)
+		require.NoError(t, err)
+
+		links := map[string]string{}
+		for _, hdr := range readTarHeaders(t, &data) {
+			if hdr.Typeflag == tar.TypeLink {
+				links[hdr.Name] = hdr.Linkname
+			}
+		}
+		if noHardLinks {
+			require.Equal(t, int64(12), pc.InstalledSize)
+			require.Empty(t, links)
+		} else {
+			require.Equal(t, int64(4), pc.InstalledSize)
+			require.Equal(t, map[string]string{
+				"usr/bin/git-add":    "usr/bin/git",
+				"usr/bin/git-commit": "usr/bin/git",
+			}, links)
+		}
+	}
+}
+
+func TestWorkspaceFS_added(t *testing.T) {
+	remote := mapWorkspaceFS{
+		MapFS: fstest.MapFS{
+			"usr/bin/hello":                  {Data: []byte("remote"), Mode: 0o755},
+			"usr/share/licenses/hello/NOTES": {Data: []byte("remote"), Mode: 0o644},
+		},
+	}
+
+	ws := t.TempDir()
+	out := filepath.Join(ws, "melange-out", "hello")
+	require.NoError(t, os.MkdirAll(filepath.Join(out, "usr", "share", "licenses", "hello"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(out, "usr", "share", "licenses", "hello", "LICENSE"), []byte("local"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(out, "var", "lib", "db", "sbom"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(out, "var", "lib", "db", "sbom", "hello-1.0-r0.spdx.json"), []byte("{}"), 0o644))
+
+	b := &Build{
+		WorkspaceDir: ws,
+		WorkspaceFS:  func(string) (WorkspaceFS, error) { return remote, nil },
+	}
+	fsys, err := b.workspaceFS("hello")
+	require.NoError(t, err)
+
+	// The files written to the workspace are added to those of the
+	// WorkspaceFS, and the directories which both have are merged.
+	files := map[string]string{}
+	require.NoError(t, fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, path)
+		files[path] = string(data)
+		return err
+	}))
+	require.Equal(t, map[string]string{
+		"usr/bin/hello":                          "remote",
+		"usr/share/licenses/hello/LICENSE":       "local",
+		"usr/share/licenses/hello/NOTES":         "remote",
+		"var/lib/db/sbom/hello-1.0-r0.spdx.json": "{}",
+	}, files)
+
+	fi, err := fsys.Stat("usr/share/licenses/hello/LICENSE")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("local")), fi.Size())
+
+	ok, err := lexists(fsys, "usr/bin/hello")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = lexists(fsys, "usr/bin/goodbye")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestCheckWorkspaceFS(t *testing.T) {
+	remote := func(string) (WorkspaceFS, error) { return mapWorkspaceFS{MapFS: fstest.MapFS{}}, nil }
+
+	// Without a WorkspaceFS, anything goes.
+	b := &Build{StampBinaries: true}
+	require.NoError(t, b.checkWorkspaceFS())
+
+	b = &Build{
+		WorkspaceFS: remote,
+		Configuration: config.Configuration{
+			Package:     config.Package{Name: "hello"},
+			Subpackages: []config.Subpackage{{Name: "hello-doc"}},
+		},
+	}
+	require.NoError(t, b.checkWorkspaceFS())
+
+	// The options which change the files in place are rejected.
+	for _, change := range []func(b *Build){
+		func(b *Build) { b.UsrMerge = "move" },
+		func(b *Build) { b.StampBinaries = true },
+		func(b *Build) { b.Configuration.Package.Options.DevFiles = config.DevFilesPolicyMove },
+		func(b *Build) { b.Configuration.Package.Options.RPath = config.RPathPolicyStrip },
+		func(b *Build) { b.Configuration.Subpackages[0].Files = []string{"usr/share/doc"} },
+		func(b *Build) {
+			b.Configuration.Subpackages[0].Compat.Links = []config.CompatLink{{Path: "/bin/hello", Target: "/usr/bin/hello"}}
+		},
+	} {
+		b := &Build{
+			WorkspaceFS: remote,
+			Configuration: config.Configuration{
+				Package:     config.Package{Name: "hello"},
+				Subpackages: []config.Subpackage{{Name: "hello-doc"}},
+			},
+		}
+		change(b)
+		require.ErrorContains(t, b.checkWorkspaceFS(), "need the packages to be in the workspace")
+	}
+}
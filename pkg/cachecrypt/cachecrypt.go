@@ -0,0 +1,226 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cachecrypt encrypts the artifacts of a shared cache on the client,
+// so that the storage holding the cache never sees their contents.
+//
+// An artifact is encrypted with AES-256-GCM, under a key derived with scrypt
+// from the passphrase and a salt of its own, in chunks so that artifacts of
+// any size are streamed.  Each chunk is authenticated along with its position
+// and whether it is the last one, so that chunks can neither be reordered nor
+// dropped.
+package cachecrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	magic     = "melange-cache-v1"
+	saltSize  = 16
+	chunkSize = 64 * 1024
+)
+
+// ErrNotEncrypted is returned when decrypting an artifact which was not
+// encrypted.
+var ErrNotEncrypted = errors.New("the artifact is not encrypted")
+
+// Key is the passphrase the artifacts of a cache are encrypted with.
+type Key struct {
+	passphrase []byte
+}
+
+// NewKey returns a key for a passphrase.
+func NewKey(passphrase []byte) (*Key, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the cache passphrase is empty")
+	}
+
+	return &Key{passphrase: passphrase}, nil
+}
+
+// LoadKey resolves a reference to a passphrase: "env:NAME" reads it from the
+// environment variable NAME, "file:PATH" from a file, and "cmd:COMMAND" from
+// the output of a shell command, which fetches keys kept in a KMS, e.g.
+// "cmd:gcloud kms decrypt --ciphertext-file=cache.key.enc --plaintext-file=- ...".
+// Trailing newlines are removed from files and the output of commands.
+func LoadKey(ctx context.Context, ref string) (*Key, error) {
+	kind, value, ok := strings.Cut(ref, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid cache key %q: expected env:NAME, file:PATH or cmd:COMMAND", ref)
+	}
+
+	var passphrase []byte
+	switch kind {
+	case "env":
+		passphrase = []byte(os.Getenv(value))
+	case "file":
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("reading cache key: %w", err)
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	case "cmd":
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", value)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running cache key command: %w", err)
+		}
+		passphrase = bytes.TrimRight(out, "\r\n")
+	default:
+		return nil, fmt.Errorf("invalid cache key %q: unknown kind %q", ref, kind)
+	}
+
+	key, err := NewKey(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cache key %s: %w", ref, err)
+	}
+
+	return key, nil
+}
+
+func (k *Key) aead(salt []byte) (cipher.AEAD, error) {
+	dk, err := scrypt.Key(k.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of a chunk.  Every artifact has its own key, so
+// the position of the chunk makes the nonce unique.
+func nonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-9:], counter)
+	if last {
+		n[len(n)-1] = 1
+	}
+
+	return n
+}
+
+// readChunk reads up to size bytes from r, and reports whether they are the
+// last ones.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return n, true, nil
+	case err != nil:
+		return n, false, err
+	}
+
+	if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+
+	return n, false, nil
+}
+
+// Encrypt writes the encryption of r to w.
+func (k *Key) Encrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, len(magic)+saltSize)
+	copy(header, magic)
+	if _, err := rand.Read(header[len(magic):]); err != nil {
+		return err
+	}
+
+	aead, err := k.aead(header[len(magic):])
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, chunkSize)
+	out := make([]byte, 0, chunkSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, last, err := readChunk(br, buf)
+		if err != nil {
+			return err
+		}
+
+		out = aead.Seal(out[:0], nonce(aead, counter, last), buf[:n], header)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt writes the decryption of r to w.  It fails if r was not encrypted
+// with the key or was tampered with, in which case some of the decryption
+// may have been written already.
+func (k *Key) Decrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, len(magic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != magic {
+		return ErrNotEncrypted
+	}
+
+	aead, err := k.aead(header[len(magic):])
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, chunkSize+aead.Overhead())
+	out := make([]byte, 0, chunkSize)
+	for counter := uint64(0); ; counter++ {
+		n, last, err := readChunk(br, buf)
+		if err != nil {
+			return err
+		}
+
+		out, err = aead.Open(out[:0], nonce(aead, counter, last), buf[:n], header)
+		if err != nil {
+			return fmt.Errorf("decrypting the artifact: wrong key, or the artifact is corrupted")
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
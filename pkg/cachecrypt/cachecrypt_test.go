@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachecrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	key, err := NewKey([]byte("hunter2"))
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := make([]byte, size)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			enc := &bytes.Buffer{}
+			require.NoError(t, key.Encrypt(enc, bytes.NewReader(data)))
+			if size > 0 {
+				require.NotContains(t, enc.String(), string(data))
+			}
+
+			dec := &bytes.Buffer{}
+			require.NoError(t, key.Decrypt(dec, bytes.NewReader(enc.Bytes())))
+			require.Equal(t, data, append([]byte{}, dec.Bytes()...))
+		})
+	}
+}
+
+func TestDecrypt_Errors(t *testing.T) {
+	key, err := NewKey([]byte("hunter2"))
+	require.NoError(t, err)
+	other, err := NewKey([]byte("hunter3"))
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("x"), 2*chunkSize+10)
+	enc := &bytes.Buffer{}
+	require.NoError(t, key.Encrypt(enc, bytes.NewReader(data)))
+
+	err = other.Decrypt(&bytes.Buffer{}, bytes.NewReader(enc.Bytes()))
+	require.ErrorContains(t, err, "wrong key")
+
+	tampered := bytes.Clone(enc.Bytes())
+	tampered[len(tampered)-1] ^= 1
+	err = key.Decrypt(&bytes.Buffer{}, bytes.NewReader(tampered))
+	require.ErrorContains(t, err, "corrupted")
+
+	// Dropping the last chunk leaves whole chunks, which were not the last.
+	truncated := enc.Bytes()[:len(magic)+saltSize+2*(chunkSize+16)]
+	err = key.Decrypt(&bytes.Buffer{}, bytes.NewReader(truncated))
+	require.ErrorContains(t, err, "corrupted")
+
+	err = key.Decrypt(&bytes.Buffer{}, bytes.NewReader(data))
+	require.ErrorIs(t, err, ErrNotEncrypted)
+}
+
+func TestLoadKey(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("TEST_CACHE_KEY", "from-env")
+	key, err := LoadKey(ctx, "env:TEST_CACHE_KEY")
+	require.NoError(t, err)
+	require.Equal(t, "from-env", string(key.passphrase))
+
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+	key, err = LoadKey(ctx, "file:"+path)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", string(key.passphrase))
+
+	key, err = LoadKey(ctx, "cmd:echo from-cmd")
+	require.NoError(t, err)
+	require.Equal(t, "from-cmd", string(key.passphrase))
+
+	_, err = LoadKey(ctx, "env:TEST_CACHE_KEY_UNSET")
+	require.ErrorContains(t, err, "empty")
+
+	_, err = LoadKey(ctx, "hunter2")
+	require.ErrorContains(t, err, "invalid cache key")
+
+	_, err = LoadKey(ctx, "vault:secret")
+	require.ErrorContains(t, err, "unknown kind")
+}
@@ -22,6 +22,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -31,6 +33,7 @@ import (
 	"chainguard.dev/melange/pkg/container/docker"
 	"chainguard.dev/melange/pkg/container/k8s"
 	"github.com/chainguard-dev/clog"
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
@@ -47,6 +50,8 @@ func Build() *cobra.Command {
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
+	var cacheKey string
+	var compilerCacheDir string
 	var apkCacheDir string
 	var guestDir string
 	var signingKey string
@@ -58,6 +63,8 @@ func Build() *cobra.Command {
 	var extraKeys []string
 	var extraRepos []string
 	var dependencyLog string
+	var buildReport string
+	var profile string
 	var overlayBinSh string
 	var envFile string
 	var varsFile string
@@ -68,12 +75,55 @@ func Build() *cobra.Command {
 	var debug bool
 	var debugRunner bool
 	var interactive bool
+	var archParallelism int
 	var remove bool
+	var resume bool
+	var keepWorkspace bool
+	var prefetchSources bool
+	var serveRepository bool
+	var reproducibilityCheck bool
+	var verifyRepositories bool
 	var runner string
 	var failOnLintWarning bool
+	var failOnUnresolvedLibs bool
+	var failOnUnknownLicense bool
+	var strict bool
+	var pluginDirs []string
+	var rebuildReport string
+	var referenceRepository string
+	var removedFiles string
 	var cpu, memory string
 	var timeout time.Duration
+	var minFreeSpace string
+	var maxSparseSize string
+	var tarOwners string
+	var compressionLevel int
 	var extraPackages []string
+	var nameservers []string
+	var extraHosts []string
+	var workspaceUIDMap string
+	var workspaceGIDMap string
+	var workspaceOverlay bool
+	var noHardLinks bool
+	var stampBinaries bool
+	var usrMerge string
+	var rootless bool
+	var sandboxBinds []string
+	var hooks []string
+	var configHooks bool
+	var publishURLs []string
+	var publishDryRun bool
+	var artifactRepository string
+	var checksums bool
+	var fileDigests bool
+	var controlTemplate string
+	var locked bool
+	var scanner string
+	var scanFailOn string
+	var secrets []string
+	var proxy string
+	var noProxy []string
+	var caCertificates []string
 
 	var traceFile string
 
@@ -110,11 +160,32 @@ func Build() *cobra.Command {
 				ctx = tctx
 			}
 
-			r, err := getRunner(ctx, runner)
+			binds := []container.BindMount{}
+			for _, s := range sandboxBinds {
+				bind, err := container.ParseBindMount(s)
+				if err != nil {
+					return fmt.Errorf("parsing --sandbox-bind: %w", err)
+				}
+				binds = append(binds, bind)
+			}
+
+			r, err := getRunner(ctx, runner, binds...)
 			if err != nil {
 				return err
 			}
 
+			freeSpace, err := humanize.ParseBytes(minFreeSpace)
+			if err != nil {
+				return fmt.Errorf("parsing --min-free-space: %w", err)
+			}
+
+			var sparseSize uint64
+			if maxSparseSize != "" {
+				if sparseSize, err = humanize.ParseBytes(maxSparseSize); err != nil {
+					return fmt.Errorf("parsing --max-sparse-size: %w", err)
+				}
+			}
+
 			archs := apko_types.ParseArchitectures(archstrs)
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
@@ -125,6 +196,8 @@ func Build() *cobra.Command {
 				build.WithPipelineDir(BuiltinPipelineDir),
 				build.WithCacheDir(cacheDir),
 				build.WithCacheSource(cacheSource),
+				build.WithCacheKey(cacheKey),
+				build.WithCompilerCacheDir(compilerCacheDir),
 				build.WithPackageCacheDir(apkCacheDir),
 				build.WithGuestDir(guestDir),
 				build.WithSigningKey(signingKey),
@@ -135,6 +208,11 @@ func Build() *cobra.Command {
 				build.WithExtraRepos(extraRepos),
 				build.WithExtraPackages(extraPackages),
 				build.WithDependencyLog(dependencyLog),
+				build.WithBuildReport(buildReport),
+				build.WithProfile(profile),
+				build.WithRebuildReport(rebuildReport),
+				build.WithReferenceRepository(referenceRepository),
+				build.WithRemovedFiles(removedFiles),
 				build.WithBinShOverlay(overlayBinSh),
 				build.WithStripOriginName(stripOriginName),
 				build.WithEnvFile(envFile),
@@ -145,13 +223,65 @@ func Build() *cobra.Command {
 				build.WithDebug(debug),
 				build.WithDebugRunner(debugRunner),
 				build.WithInteractive(interactive),
+				build.WithArchParallelism(archParallelism),
 				build.WithRemove(remove),
+				build.WithResume(resume),
+				build.WithKeepWorkspace(keepWorkspace),
+				build.WithPrefetchSources(prefetchSources),
+				build.WithServeRepository(serveRepository),
+				build.WithReproducibilityCheck(reproducibilityCheck),
+				build.WithVerifyRepositories(verifyRepositories),
 				build.WithLogPolicy(logPolicy),
 				build.WithRunner(r),
 				build.WithFailOnLintWarning(failOnLintWarning),
+				build.WithFailOnUnresolvedLibs(failOnUnresolvedLibs),
+				build.WithFailOnUnknownLicense(failOnUnknownLicense),
+				build.WithStrict(strict),
+				build.WithPluginDirs(pluginDirs),
 				build.WithCPU(cpu),
 				build.WithMemory(memory),
 				build.WithTimeout(timeout),
+				build.WithMinFreeSpace(freeSpace),
+				build.WithMaxSparseSize(sparseSize),
+				build.WithTarOwners(tarOwners),
+				build.WithCompressionLevel(compressionLevel),
+				build.WithNameservers(nameservers),
+				build.WithExtraHosts(extraHosts),
+				build.WithWorkspaceIDMaps(workspaceUIDMap, workspaceGIDMap),
+				build.WithWorkspaceOverlay(workspaceOverlay),
+				build.WithNoHardLinks(noHardLinks),
+				build.WithStampBinaries(stampBinaries),
+				build.WithUsrMerge(usrMerge),
+				build.WithRootless(rootless),
+				build.WithConfigHooks(configHooks),
+				build.WithPublish(publishURLs),
+				build.WithPublishDryRun(publishDryRun),
+				build.WithArtifactRepository(artifactRepository),
+				build.WithChecksums(checksums),
+				build.WithFileDigests(fileDigests),
+				build.WithControlTemplate(controlTemplate),
+				build.WithLocked(locked),
+				build.WithScanner(scanner),
+				build.WithScanFailOn(scanFailOn),
+				build.WithProxy(proxy),
+				build.WithNoProxy(noProxy),
+				build.WithCACertificates(caCertificates),
+			}
+
+			for _, spec := range secrets {
+				name, value, err := build.ParseSecret(spec)
+				if err != nil {
+					return err
+				}
+				options = append(options, build.WithSecret(name, value))
+			}
+
+			for _, h := range hooks {
+				point, command, ok := strings.Cut(h, "=")
+				if !ok {
+					return fmt.Errorf("invalid hook %q, must be point=command", h)
+				}
+				options = append(options, build.WithHook(point, build.ExecHook{Command: command}))
 			}
 
 			if len(args) > 0 {
@@ -170,14 +300,16 @@ func Build() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
+	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image, in RFC3339 format (default: the time of the last commit of the configuration file)")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
+	cmd.Flags().StringVar(&cacheKey, "cache-key", "", "decrypt the objects of the cache bucket with the passphrase at env:NAME, file:PATH or the output of cmd:COMMAND")
+	cmd.Flags().StringVar(&compilerCacheDir, "compiler-cache-dir", "", "directory mounted into the build environment to persist the ccache and sccache caches across builds")
 	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
-	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
+	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest; the architecture is added as a subdirectory when several are built at a time")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
 	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
 	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
@@ -186,9 +318,15 @@ func Build() *cobra.Command {
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
 	cmd.Flags().StringVar(&outDir, "out-dir", "./packages/", "directory where packages will be output")
 	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "log dependencies to a specified file")
+	cmd.Flags().StringVar(&rebuildReport, "rebuild-report", "", "write a JSON report of the packages in the reference repository which must be rebuilt because a shared library is no longer provided; the architecture is added before the extension")
+	cmd.Flags().StringVar(&referenceRepository, "reference-repository", "", "repository to compare the shared libraries and files provided by the build against, for --rebuild-report and --removed-files")
+	cmd.Flags().StringVar(&removedFiles, "removed-files", "", "what to do with the files of the previous release in the reference repository which the build no longer ships, unless the build file acknowledges their removal: warn or fail")
+	cmd.Flags().StringVar(&buildReport, "build-report", "", "write a JSON (or YAML, if the filename ends in .yaml) report of the build to a specified file; the architecture is added before the extension")
+	cmd.Flags().StringVar(&profile, "profile", "", "write the wall-clock and CPU time of each build phase, pipeline step and package emission phase to a specified file in the Chrome trace format; the architecture is added before the extension")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
 	cmd.Flags().StringVar(&purlNamespace, "namespace", "unknown", "namespace to use in package URLs in SBOM (eg wolfi, alpine)")
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config")
+	cmd.Flags().IntVar(&archParallelism, "arch-parallelism", 0, "number of architectures to build at a time, each in its own workspace and build environment (default is all of them)")
 	cmd.Flags().StringSliceVar(&buildOption, "build-option", []string{}, "build options to enable")
 	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{"builtin:stderr"}, "logging policy to use")
 	cmd.Flags().StringVar(&runner, "runner", "", fmt.Sprintf("which runner to use to enable running commands, default is based on your platform. Options are %q", build.GetAllRunners()))
@@ -198,26 +336,74 @@ func Build() *cobra.Command {
 	cmd.Flags().BoolVar(&createBuildLog, "create-build-log", false, "creates a package.log file containing a list of packages that were built by the command")
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of build pipelines")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
-	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, attaches stdin with a tty to the pod on failure")
+	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, opens a shell in the build environment, in the working directory of a step which fails")
 	cmd.Flags().BoolVar(&remove, "rm", false, "clean up intermediate artifacts (e.g. container images)")
+	cmd.Flags().BoolVar(&verifyRepositories, "verify-repositories", false, "fail unless the index of every repository of the build environment is signed by a key of its keyring, and every installed package is listed in one; the keys are recorded in the build report and the SBOMs")
+	cmd.Flags().BoolVar(&prefetchSources, "prefetch-sources", false, "fetch the sources of the fetch steps into the cache directory on the host before the build, with retries and failover to their mirrors, failing unless they match their expected digests")
+	cmd.Flags().BoolVar(&serveRepository, "serve-repository", false, "index the output directory when the build starts and add it as a repository of the build environment, mounted into the guest at the same path (requires --signing-key)")
+	cmd.Flags().BoolVar(&reproducibilityCheck, "reproducibility-check", false, "emit every package a second time from the same workspace, and fail unless the apks are identical")
+	cmd.Flags().BoolVar(&keepWorkspace, "keep-workspace", false, "keep the build environment and the workspace of a failed build, to be snapshotted with melange env export")
+	cmd.Flags().BoolVar(&resume, "resume", false, "keep the progress of the build in the workspace, and skip the pipeline steps which completed in a previous build (requires --workspace-dir)")
 	cmd.Flags().BoolVar(&failOnLintWarning, "fail-on-lint-warning", false, "turns linter warnings into failures")
+	cmd.Flags().BoolVar(&failOnUnresolvedLibs, "fail-on-unresolved-libs", false, "fail if a binary needs a shared library which no package provides")
+	cmd.Flags().StringSliceVar(&pluginDirs, "plugin-dir", []string{}, "directories to search for dependency generator, linter and SBOM plugins")
+	cmd.Flags().BoolVar(&failOnUnknownLicense, "fail-on-unknown-license", false, "fail if a license of the package is not a valid SPDX license expression")
+	cmd.Flags().BoolVar(&strict, "strict", false, "enables all checks which turn warnings into failures (implies --fail-on-lint-warning, --fail-on-unresolved-libs and --fail-on-unknown-license, and fails on the files reported by --removed-files)")
 	cmd.Flags().StringVar(&cpu, "cpu", "", "default CPU resources to use for builds")
 	cmd.Flags().StringVar(&memory, "memory", "", "default memory resources to use for builds")
 	cmd.Flags().DurationVar(&timeout, "timeout", 0, "default timeout for builds")
+	cmd.Flags().StringVar(&maxSparseSize, "max-sparse-size", "", "size above which a sparse file, which is packaged expanded, fails the build, e.g. 1GiB")
+	cmd.Flags().StringVar(&minFreeSpace, "min-free-space", "1GiB", "disk space to leave free on the filesystems used by the build, on top of its estimated needs")
+	cmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "gzip compression level of the packages, from 1 (fastest) to 9 (smallest), or 0 for the default")
+	cmd.Flags().StringVar(&tarOwners, "tar-owners", string(build.TarOwnersNames), "owners of the entries of the package tarballs: names (user and group names of the build environment), numeric (numeric IDs only), root (everything owned by root) or declared (everything owned by root but the files whose owners the build file declares)")
 	cmd.Flags().StringVar(&traceFile, "trace", "", "where to write trace output")
+	cmd.Flags().StringSliceVar(&nameservers, "dns", []string{}, "nameservers to use in the build environment instead of the host's")
+	cmd.Flags().StringSliceVar(&extraHosts, "add-host", []string{}, "extra host:ip entries to add to /etc/hosts in the build environment")
+	cmd.Flags().StringVar(&workspaceUIDMap, "workspace-uidmap", "", "map of the user IDs of the build environment to those owning the files of the workspace on the host, as comma-separated container:host:size ranges")
+	cmd.Flags().StringVar(&workspaceGIDMap, "workspace-gidmap", "", "map of the group IDs of the build environment to those owning the files of the workspace on the host, as comma-separated container:host:size ranges")
+	cmd.Flags().StringSliceVar(&sandboxBinds, "sandbox-bind", []string{}, "extra source:destination[:ro] bind mounts of the bubblewrap-sandbox runner")
+	cmd.Flags().StringArrayVar(&hooks, "hook", []string{}, "point=command to run on the host at a point of the lifecycle of the build (pre-build, post-build, pre-emit or post-emit), with its context as JSON on its standard input")
+	cmd.Flags().BoolVar(&configHooks, "config-hooks", false, "run the hooks declared in the build file, which run commands on the host")
+	cmd.Flags().StringSliceVar(&publishURLs, "publish", []string{}, "remote repositories to upload the packages and their regenerated index to after a successful build: s3://bucket/path, gs://bucket/path or oci://registry/repository")
+	cmd.Flags().BoolVar(&publishDryRun, "publish-dry-run", false, "log what --publish would upload instead of uploading it")
+	cmd.Flags().StringVar(&artifactRepository, "push-artifacts", "", "OCI repository to push each package to as an artifact after a successful build, with its SBOM and attestation attached as referrers")
+	cmd.Flags().BoolVar(&checksums, "checksums", false, "add the SHA-256 digests of the packages, the index and the reports of the build to the SHA256SUMS file beside the packages")
+	cmd.Flags().BoolVar(&fileDigests, "file-digests", false, "list the SHA-256 digests of the files of each package in a .SHA256SUMS file of its control section")
+	cmd.Flags().StringVar(&controlTemplate, "control-template", "", "Go template replacing the one of the .PKGINFO of the packages, for custom apk tooling")
+	cmd.Flags().BoolVar(&locked, "locked", false, "install the build environment with exactly the package versions of the lockfile next to the config, e.g. foo.lock.json for foo.yaml")
+	cmd.Flags().StringArrayVar(&secrets, "secret", []string{}, "secret declared by the build file, from the environment variable of its name (NAME), another one (NAME=env:VAR) or a file (NAME=file:PATH); its value is masked in the output")
+	cmd.Flags().StringVar(&proxy, "proxy", "", "URL of the HTTP(S) proxy used to fetch the build environment and the sources, and set as HTTP_PROXY and HTTPS_PROXY in the build environment")
+	cmd.Flags().StringSliceVar(&noProxy, "no-proxy", []string{}, "hosts, domains and networks reached without --proxy, also set as NO_PROXY in the build environment")
+	cmd.Flags().StringSliceVar(&caCertificates, "ca-certificate", []string{}, "PEM file of CA certificates to trust, in addition to the usual ones, when fetching and in the build environment, e.g. of a proxy intercepting TLS")
+	cmd.Flags().StringVar(&scanner, "scanner", "", "vulnerability scanner to run over the build environment and the packages: grype or trivy")
+	cmd.Flags().StringVar(&scanFailOn, "scan-fail-on", "", "severity from which the vulnerabilities found by --scanner fail the build, e.g. high; they are only logged otherwise")
+	cmd.Flags().BoolVar(&rootless, "rootless", false, "run the build without privileges, in a user namespace (bubblewrap runner only)")
+	cmd.Flags().BoolVar(&workspaceOverlay, "workspace-overlay", false, "the workspace is the upper directory of an overlayfs, whose whiteouts are left out of the packages")
+	cmd.Flags().StringVar(&usrMerge, "usrmerge", "", "move the files of the packages in /bin, /sbin, /lib and /lib64 to /usr: move, or symlink to leave symlinks at their old paths")
+	cmd.Flags().BoolVar(&noHardLinks, "no-hardlinks", false, "package the hard links of the workspace as copies, for filesystems whose inode numbers are not stable")
+	cmd.Flags().BoolVar(&stampBinaries, "stamp-binaries", false, "add a .note.package ELF note to the executables and shared libraries of the packages, recording their package, version and build ID")
 
 	return cmd
 }
 
-func getRunner(ctx context.Context, runner string) (container.Runner, error) {
+// getRunner returns the runner named runner, or the default one of the
+// platform.  binds are the extra bind mounts of the bubblewrap-sandbox
+// runner.
+func getRunner(ctx context.Context, runner string, binds ...container.BindMount) (container.Runner, error) {
 	if runner != "" {
 		switch runner {
 		case "bubblewrap":
 			return container.BubblewrapRunner(), nil
+		case "bubblewrap-sandbox":
+			return container.BubblewrapSandboxRunner(binds), nil
 		case "docker":
 			return docker.NewRunner(ctx)
+		case "podman":
+			return docker.NewPodmanRunner(ctx)
 		case "kubernetes":
 			return k8s.NewRunner(ctx)
+		case "qemu":
+			return container.QEMURunner(), nil
 		case "experimentaldagger":
 			return dagger.NewRunner(ctx)
 		default:
@@ -272,15 +458,47 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 		return nil
 	}
 
-	var errg errgroup.Group
+	return buildArchs(ctx, bcs, func(ctx context.Context, bc *build.Build) error {
+		return bc.BuildPackage(ctx)
+	})
+}
+
+// buildArchs runs buildPackage for each of the builds, at the same time
+// unless they are interactive or limited by their ArchParallelism, and
+// returns the errors of all of those which fail.
+func buildArchs(ctx context.Context, bcs []*build.Build, buildPackage func(context.Context, *build.Build) error) error {
+	log := clog.FromContext(ctx)
 
+	limit := len(bcs)
 	if bcs[0].Interactive {
 		// Concurrent interactive debugging will break your terminal.
-		errg.SetLimit(1)
+		limit = 1
+	} else if bcs[0].ArchParallelism > 0 {
+		limit = min(limit, bcs[0].ArchParallelism)
 	}
 
-	for _, bc := range bcs {
-		bc := bc
+	// Builds running at the same time cannot share an explicitly requested
+	// guest directory, so each gets a subdirectory for its architecture.
+	if limit > 1 {
+		for _, bc := range bcs {
+			if bc.GuestDir != "" {
+				bc.GuestDir = filepath.Join(bc.GuestDir, bc.Arch.ToAPK())
+			}
+		}
+	}
+
+	var errg errgroup.Group
+	errg.SetLimit(limit)
+
+	progress := newArchProgress(bcs)
+	if len(bcs) != 1 {
+		stop := progress.report(ctx, archProgressInterval)
+		defer stop()
+	}
+
+	errs := make([]error, len(bcs))
+	for i, bc := range bcs {
+		i, bc := i, bc
 
 		errg.Go(func() error {
 			lctx := ctx
@@ -289,16 +507,112 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 				lctx = clog.WithLogger(ctx, log)
 			}
 
-			if err := bc.BuildPackage(lctx); err != nil {
+			progress.start(bc.Arch.ToAPK())
+			err := buildPackage(lctx, bc)
+			progress.finish(bc.Arch.ToAPK(), err)
+			if err != nil {
 				if !bc.Remove {
 					log.Error("ERROR: failed to build package. the build environment has been preserved:")
 					bc.SummarizePaths(lctx)
 				}
 
-				return fmt.Errorf("failed to build package: %w", err)
+				errs[i] = fmt.Errorf("failed to build package for %s: %w", bc.Arch.ToAPK(), err)
 			}
 			return nil
 		})
 	}
-	return errg.Wait()
+
+	_ = errg.Wait()
+	if len(bcs) != 1 {
+		log.Infof("builds: %s", progress)
+	}
+	return errors.Join(errs...)
+}
+
+// archProgressInterval is how often the progress of the builds of several
+// architectures is logged.
+const archProgressInterval = 30 * time.Second
+
+// archProgress tracks the builds of several architectures running at the
+// same time, so that their progress is logged as one line rather than only
+// interleaved in their logs.
+type archProgress struct {
+	mu     sync.Mutex
+	archs  []string
+	starts map[string]time.Time
+	ends   map[string]time.Time
+	errs   map[string]error
+}
+
+func newArchProgress(bcs []*build.Build) *archProgress {
+	p := &archProgress{
+		starts: map[string]time.Time{},
+		ends:   map[string]time.Time{},
+		errs:   map[string]error{},
+	}
+	for _, bc := range bcs {
+		p.archs = append(p.archs, bc.Arch.ToAPK())
+	}
+	return p
+}
+
+func (p *archProgress) start(arch string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starts[arch] = time.Now()
+}
+
+func (p *archProgress) finish(arch string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ends[arch] = time.Now()
+	p.errs[arch] = err
+}
+
+// String returns the state of the build of each architecture, e.g.
+// "x86_64: done in 3m2s, aarch64: running for 4m10s, riscv64: waiting".
+func (p *archProgress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	states := make([]string, 0, len(p.archs))
+	for _, arch := range p.archs {
+		start, started := p.starts[arch]
+		end, ended := p.ends[arch]
+		switch {
+		case !started:
+			states = append(states, fmt.Sprintf("%s: waiting", arch))
+		case !ended:
+			states = append(states, fmt.Sprintf("%s: running for %s", arch, now.Sub(start).Round(time.Second)))
+		case p.errs[arch] != nil:
+			states = append(states, fmt.Sprintf("%s: failed after %s", arch, end.Sub(start).Round(time.Second)))
+		default:
+			states = append(states, fmt.Sprintf("%s: done in %s", arch, end.Sub(start).Round(time.Second)))
+		}
+	}
+
+	return strings.Join(states, ", ")
+}
+
+// report logs the progress every interval until the returned function is
+// called.
+func (p *archProgress) report(ctx context.Context, interval time.Duration) func() {
+	log := clog.FromContext(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				log.Infof("progress: %s", p)
+			}
+		}
+	}()
+
+	return func() { close(done) }
 }
@@ -0,0 +1,183 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/graph"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// BuildAll is a constructor for a cobra.Command which wraps the BuildAllCmd
+// function.
+func BuildAll() *cobra.Command {
+	var archstrs []string
+	var outDir string
+	var signingKey string
+	var extraKeys []string
+	var extraRepos []string
+	var pipelineDir string
+	var cacheDir string
+	var runner string
+	var jobs int
+
+	cmd := &cobra.Command{
+		Use:   "build-all DIR",
+		Short: "Build every build file of a directory in dependency order",
+		Long: `Build every build file of a directory in dependency order.
+
+Builds each configuration after the configurations which build the packages it
+installs to build, as resolved by "melange graph", running up to --jobs builds
+at a time.  The output directory is a local repository which is appended to
+the repositories of every build, so that freshly built packages are installed
+into the build environments of their dependents.  Its index is updated after
+each build, and signed with the signing key, whose public key is appended to
+the keyring of every build.
+
+When a build fails, the configurations which depend on it are skipped, and the
+others are still built.`,
+		Example: `  melange keygen
+  melange build-all --signing-key melange.rsa --arch x86_64 -j 4 .`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			if signingKey == "" {
+				return fmt.Errorf("--signing-key is required, so that the builds trust the packages built before them")
+			}
+
+			r, err := getRunner(ctx, runner)
+			if err != nil {
+				return err
+			}
+
+			options := []build.Option{
+				build.WithPipelineDir(pipelineDir),
+				build.WithPipelineDir(BuiltinPipelineDir),
+				build.WithCacheDir(cacheDir),
+				build.WithSigningKey(signingKey),
+				build.WithRunner(r),
+			}
+
+			return BuildAllCmd(ctx, args[0], apko_types.ParseArchitectures(archstrs), jobs, outDir, signingKey, extraKeys, extraRepos, options...)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config")
+	cmd.Flags().StringVar(&outDir, "out-dir", "./packages/", "directory where packages will be output, and which the builds install packages from")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing the packages and the index of the output directory")
+	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
+	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
+	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
+	cmd.Flags().StringVar(&runner, "runner", "", fmt.Sprintf("which runner to use to enable running commands, default is based on your platform. Options are %q", build.GetAllRunners()))
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "number of configurations to build at a time")
+
+	return cmd
+}
+
+// BuildAllCmd is the backend implementation of the "melange build-all"
+// command.  The options are applied to the build of every configuration.
+func BuildAllCmd(ctx context.Context, dir string, archs []apko_types.Architecture, jobs int, outDir, signingKey string, extraKeys, extraRepos []string, baseOpts ...build.Option) error {
+	log := clog.FromContext(ctx)
+
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	g, err := graph.Load(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	order, err := g.Order()
+	if err != nil {
+		return err
+	}
+	log.Infof("building %d configurations: %v", len(order), order)
+
+	repo, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	keys := append(append([]string{}, extraKeys...), signingKey+".pub")
+	repos := append(append([]string{}, extraRepos...), repo)
+
+	// The index of the local repository has to exist before the first build
+	// installs from it, and is rewritten by one build at a time.
+	var mu sync.Mutex
+	updateIndexes := func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, arch := range archs {
+			packageDir := filepath.Join(repo, arch.ToAPK())
+			if err := os.MkdirAll(packageDir, 0o755); err != nil {
+				return err
+			}
+
+			idx, err := index.New(
+				index.WithPackageDir(packageDir),
+				index.WithSigningKey(signingKey),
+				index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+			)
+			if err != nil {
+				return fmt.Errorf("unable to create index: %w", err)
+			}
+			if err := idx.GenerateIndex(ctx); err != nil {
+				return fmt.Errorf("unable to generate index of %s: %w", packageDir, err)
+			}
+		}
+
+		return nil
+	}
+
+	if err := updateIndexes(ctx); err != nil {
+		return err
+	}
+
+	return g.Walk(ctx, jobs, func(ctx context.Context, n graph.Node) error {
+		log := clog.FromContext(ctx).With("config", n.File)
+		ctx = clog.WithLogger(ctx, log)
+
+		configFile := filepath.Join(dir, n.File)
+		opts := append(append([]build.Option{}, baseOpts...),
+			build.WithConfig(configFile),
+			build.WithSourceDir(filepath.Dir(configFile)),
+			build.WithOutDir(repo),
+			build.WithExtraKeys(keys),
+			build.WithExtraRepos(repos),
+			// The index is updated below, one build at a time.
+			build.WithGenerateIndex(false),
+		)
+
+		log.Infof("building %s-%s", n.Name, n.Version)
+		if err := BuildCmd(ctx, archs, opts...); err != nil {
+			return err
+		}
+
+		return updateIndexes(ctx)
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/build"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func testBuilds(guestDir string, parallelism int, archs ...string) []*build.Build {
+	bcs := []*build.Build{}
+	for _, arch := range archs {
+		bcs = append(bcs, &build.Build{
+			Arch:            apko_types.ParseArchitecture(arch),
+			GuestDir:        guestDir,
+			ArchParallelism: parallelism,
+			Remove:          true,
+		})
+	}
+	return bcs
+}
+
+func TestBuildArchs_guestDir(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	guestDir := t.TempDir()
+
+	for _, tt := range []struct {
+		name        string
+		archs       []string
+		parallelism int
+		want        map[string]string
+	}{{
+		name:  "one arch",
+		archs: []string{"x86_64"},
+		want:  map[string]string{"x86_64": guestDir},
+	}, {
+		name:  "concurrent",
+		archs: []string{"x86_64", "aarch64"},
+		want: map[string]string{
+			"x86_64":  filepath.Join(guestDir, "x86_64"),
+			"aarch64": filepath.Join(guestDir, "aarch64"),
+		},
+	}, {
+		name:        "one at a time",
+		archs:       []string{"x86_64", "aarch64"},
+		parallelism: 1,
+		want:        map[string]string{"x86_64": guestDir, "aarch64": guestDir},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			got := map[string]string{}
+
+			err := buildArchs(ctx, testBuilds(guestDir, tt.parallelism, tt.archs...), func(_ context.Context, bc *build.Build) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[bc.Arch.ToAPK()] = bc.GuestDir
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBuildArchs_concurrent(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	bcs := testBuilds("", 2, "x86_64", "aarch64", "riscv64")
+
+	// The first two builds only finish once they are running at the same
+	// time, and the third one has to wait for one of them.
+	both := make(chan struct{})
+	var mu sync.Mutex
+	running, most := 0, 0
+	err := buildArchs(ctx, bcs, func(_ context.Context, _ *build.Build) error {
+		mu.Lock()
+		running++
+		if running == 2 && most < 2 {
+			close(both)
+		}
+		most = max(most, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		select {
+		case <-both:
+			return nil
+		case <-time.After(10 * time.Second):
+			return errors.New("timed out waiting for the other build")
+		}
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, most)
+}
+
+func TestBuildArchs_errors(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	bcs := testBuilds("", 0, "x86_64", "aarch64", "riscv64")
+
+	errX86 := errors.New("x86_64 broke")
+	errArm := errors.New("aarch64 broke")
+	var mu sync.Mutex
+	built := []string{}
+	err := buildArchs(ctx, bcs, func(_ context.Context, bc *build.Build) error {
+		mu.Lock()
+		built = append(built, bc.Arch.ToAPK())
+		mu.Unlock()
+
+		switch bc.Arch.ToAPK() {
+		case "x86_64":
+			return errX86
+		case "aarch64":
+			return errArm
+		}
+		return nil
+	})
+
+	// A failure does not stop the other builds, and all of the failures
+	// are reported.
+	require.ElementsMatch(t, []string{"x86_64", "aarch64", "riscv64"}, built)
+	require.ErrorIs(t, err, errX86)
+	require.ErrorIs(t, err, errArm)
+	require.ErrorContains(t, err, "failed to build package for x86_64")
+	require.ErrorContains(t, err, "failed to build package for aarch64")
+}
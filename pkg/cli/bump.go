@@ -15,6 +15,8 @@
 package cli
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 
 	"chainguard.dev/melange/pkg/renovate"
@@ -23,26 +25,45 @@ import (
 
 func Bump() *cobra.Command {
 	var expectedCommit string
+	var version string
 	cmd := &cobra.Command{
-		Use:     "bump",
-		Short:   "Update a Melange YAML file to reflect a new package version",
-		Long:    `Update a Melange YAML file to reflect a new package version.`,
-		Example: `  melange bump <config.yaml> <1.2.3.4>`,
-		Args:    cobra.MinimumNArgs(2),
+		Use:   "bump",
+		Short: "Update a Melange YAML file to reflect a new package version",
+		Long: `Update a Melange YAML file to reflect a new package version.
+
+The epoch is reset to 0 when the version changes, and incremented otherwise,
+so that bumping without a version rebuilds the same version.  The sources of
+the fetch steps are fetched again to update their expected checksums, and the
+expected commit of the git-checkout step of the package is resolved from its
+tag, unless --expected-commit is given.  Comments and formatting are kept.`,
+		Example: `  melange bump <config.yaml> <1.2.3.4>
+
+  melange bump <config.yaml> --version 1.2.3.4
+
+  melange bump <config.yaml>`,
+		Args: cobra.RangeArgs(1, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
+			if len(args) == 2 {
+				if version != "" && version != args[1] {
+					return fmt.Errorf("the version is given as both %s and --version %s", args[1], version)
+				}
+				version = args[1]
+			}
+
 			rc, err := renovate.New(renovate.WithConfig(args[0]))
 			if err != nil {
 				return err
 			}
 
 			bumpRenovator := bump.New(ctx,
-				bump.WithTargetVersion(args[1]),
+				bump.WithTargetVersion(version),
 				bump.WithExpectedCommit(expectedCommit),
 			)
 			return rc.Renovate(cmd.Context(), bumpRenovator)
 		},
 	}
 	cmd.Flags().StringVar(&expectedCommit, "expected-commit", "", "optional flag to update the expected-commit value of a git-checkout pipeline")
+	cmd.Flags().StringVar(&version, "version", "", "the new version of the package; the epoch is incremented if it is left out")
 	return cmd
 }
@@ -0,0 +1,151 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/upstream"
+)
+
+// CheckUpstream is a constructor for a cobra.Command which wraps the
+// CheckUpstreamCmd function.
+func CheckUpstream() *cobra.Command {
+	var jsonOutput bool
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "check-upstream CONFIG...",
+		Short: "Check whether newer upstream versions of packages exist",
+		Long: `Check whether newer upstream versions of packages exist.
+
+Finds the latest upstream version of the package of each build file, from the
+update block of the build file, and compares it with the version of the
+package.  The upstream versions are found with one of:
+
+  release-monitor  the stable versions of a release-monitoring.org project
+  github           the releases, or the tags, of a GitHub repository
+  git              the tags of a git repository, by default the repository of
+                   the git-checkout step of the pipeline, which match tag-regex
+
+The prefixes, suffixes, separators and ignored patterns of the update block
+are applied to the upstream versions.  Packages whose updates are disabled
+are reported without being checked.  The GitHub API is authenticated with
+$GITHUB_TOKEN if it is set.
+
+Build files which cannot be checked are reported with an error, and the
+command fails after checking the others.`,
+		Example: `  melange check-upstream curl.yaml
+
+  melange check-upstream --json *.yaml`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return CheckUpstreamCmd(cmd.Context(), args, jsonOutput, output)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "write the results as a JSON array")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the results to FILE instead of stdout")
+
+	return cmd
+}
+
+// CheckUpstreamCmd is the backend implementation of the "melange
+// check-upstream" command.
+func CheckUpstreamCmd(ctx context.Context, configFiles []string, jsonOutput bool, output string) error {
+	checker := &upstream.Checker{}
+
+	results := []*upstream.Result{}
+	failed := 0
+	for _, configFile := range configFiles {
+		res, err := checkUpstream(ctx, checker, configFile)
+		if err != nil {
+			failed++
+			if res == nil {
+				res = &upstream.Result{}
+			}
+			res.Error = fmt.Sprintf("%s: %v", configFile, err)
+		}
+		results = append(results, res)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating output: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return fmt.Errorf("writing results: %w", err)
+		}
+	} else {
+		for _, res := range results {
+			if _, err := fmt.Fprintln(w, describeUpstream(res)); err != nil {
+				return fmt.Errorf("writing results: %w", err)
+			}
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("unable to check %d of %d configurations", failed, len(configFiles))
+	}
+
+	return nil
+}
+
+// checkUpstream checks a configuration, returning what is known of the
+// package when the check fails.
+func checkUpstream(ctx context.Context, checker *upstream.Checker, configFile string) (*upstream.Result, error) {
+	cfg, err := config.ParseConfiguration(ctx, configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := checker.Check(ctx, cfg)
+	if err != nil {
+		return &upstream.Result{Package: cfg.Package.Name, Current: cfg.Package.Version}, err
+	}
+
+	return res, nil
+}
+
+func describeUpstream(res *upstream.Result) string {
+	switch {
+	case res.Error != "":
+		return "error: " + res.Error
+	case res.Source == "":
+		return fmt.Sprintf("%s %s: updates are disabled", res.Package, res.Current)
+	case res.Latest == "":
+		return fmt.Sprintf("%s %s: no upstream versions found with %s", res.Package, res.Current, res.Source)
+	case res.UpdateAvailable:
+		return fmt.Sprintf("%s %s: %s is available from %s", res.Package, res.Current, res.Latest, res.Source)
+	default:
+		return fmt.Sprintf("%s %s: up to date with %s", res.Package, res.Current, res.Source)
+	}
+}
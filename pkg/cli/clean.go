@@ -0,0 +1,84 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/chainguard-dev/clog"
+	"github.com/spf13/cobra"
+)
+
+// Clean is a constructor for a cobra.Command which wraps the CleanCmd function.
+func Clean() *cobra.Command {
+	var outDir string
+	var workspaceDir string
+	var tempDir string
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Remove the debris of crashed builds",
+		Long: `Remove the temporary files and directories and the half-written
+packages left behind by crashed builds, and the workspaces in the
+workspace directory.  Anything in use by a running build is left alone.`,
+		Example: `  melange clean --out-dir ./packages/ --workspace-dir ./workspace/`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return CleanCmd(cmd.Context(), outDir, workspaceDir, tempDir, dryRun)
+		},
+	}
+
+	cmd.Flags().StringVar(&outDir, "out-dir", "./packages/", "directory where packages are output")
+	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspaces, whose workspaces are removed (optional)")
+	cmd.Flags().StringVar(&tempDir, "temp-dir", "", "directory holding the temporary files of builds (defaults to the system temporary directory)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print what would be removed")
+
+	return cmd
+}
+
+// CleanCmd is the backend implementation of the "melange clean" command.
+func CleanCmd(ctx context.Context, outDir, workspaceDir, tempDir string, dryRun bool) error {
+	log := clog.FromContext(ctx)
+
+	removed := []string{}
+	errs := []error{}
+
+	paths, err := build.CleanTempDir(ctx, tempDir, dryRun)
+	removed = append(removed, paths...)
+	errs = append(errs, err)
+
+	paths, err = build.CleanOutDir(ctx, outDir, dryRun)
+	removed = append(removed, paths...)
+	errs = append(errs, err)
+
+	if workspaceDir != "" {
+		paths, err := build.CleanWorkspaceDir(ctx, workspaceDir, dryRun)
+		removed = append(removed, paths...)
+		errs = append(errs, err)
+	}
+
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	for _, path := range removed {
+		log.Infof("%s %s", verb, path)
+	}
+
+	return errors.Join(errs...)
+}
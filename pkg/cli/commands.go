@@ -18,16 +18,24 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 
 	"chainguard.dev/apko/pkg/log"
 	charmlog "github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 	"sigs.k8s.io/release-utils/version"
+
+	"chainguard.dev/melange/pkg/annotations"
+	"chainguard.dev/melange/pkg/progress"
 )
 
 func New() *cobra.Command {
 	var logPolicy []string
 	var level log.CharmLogLevel
+	var logFormat string
+	var annotationFormat string
+	var annotationReport string
+	var showProgress bool
 	cmd := &cobra.Command{
 		Use:               "melange",
 		DisableAutoGenTag: true,
@@ -40,27 +48,69 @@ func New() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to create log writer: %w", err)
 			}
-			slog.SetDefault(slog.New(charmlog.NewWithOptions(out, charmlog.Options{ReportTimestamp: true, Level: charmlog.Level(level)})))
+
+			if showProgress {
+				// The logs scroll above the progress drawn on the terminal.
+				tracker := progress.New(os.Stderr)
+				out = tracker.Writer(out)
+				cmd.SetContext(progress.WithTracker(cmd.Context(), tracker))
+			}
+
+			var handler slog.Handler
+			switch logFormat {
+			case "text":
+				handler = charmlog.NewWithOptions(out, charmlog.Options{ReportTimestamp: true, Level: charmlog.Level(level)})
+			case "json":
+				// charmlog levels share their numeric values with slog levels.
+				handler = slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.Level(level)})
+			default:
+				return fmt.Errorf("unknown log format %q, must be one of text or json", logFormat)
+			}
+			if annotationFormat != "" {
+				// Workflow commands are read from the output of the step,
+				// and stdout is taken by the output of some commands.
+				handler, err = annotations.NewHandler(handler, annotationFormat, os.Stderr, annotationReport)
+				if err != nil {
+					return err
+				}
+			}
+			slog.SetDefault(slog.New(handler))
 
 			return nil
 		},
 	}
 	cmd.PersistentFlags().StringSliceVar(&logPolicy, "log-policy", []string{"builtin:stderr"}, "log policy (e.g. builtin:stderr, /tmp/log/foo)")
 	cmd.PersistentFlags().Var(&level, "log-level", "log level (e.g. debug, info, warn, error)")
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log output format (text or json)")
+	cmd.PersistentFlags().StringVar(&annotationFormat, "annotations", "", "also report warnings and errors as CI annotations on the lines of the configuration file (github or gitlab)")
+	cmd.PersistentFlags().BoolVar(&showProgress, "progress", false, "show the pipeline step each package of a build runs and its emission, redrawn in place below the logs on a terminal, or as log lines otherwise")
+	cmd.PersistentFlags().StringVar(&annotationReport, "annotations-file", "gl-code-quality-report.json", "the code quality report to write the gitlab annotations to")
 
 	cmd.AddCommand(Build())
+	cmd.AddCommand(BuildAll())
 	cmd.AddCommand(Bump())
+	cmd.AddCommand(CheckUpstream())
+	cmd.AddCommand(Clean())
 	cmd.AddCommand(Completion())
 	cmd.AddCommand(Convert())
+	cmd.AddCommand(Demote())
+	cmd.AddCommand(Diff())
+	cmd.AddCommand(Env())
+	cmd.AddCommand(Graph())
 	cmd.AddCommand(Index())
 	cmd.AddCommand(Keygen())
 	cmd.AddCommand(Lint())
 	cmd.AddCommand(PackageVersion())
+	cmd.AddCommand(Promote())
+	cmd.AddCommand(PushArtifacts())
 	cmd.AddCommand(Query())
+	cmd.AddCommand(ReSign())
+	cmd.AddCommand(Shell())
 	cmd.AddCommand(Sign())
 	cmd.AddCommand(SignIndex())
 	cmd.AddCommand(Test())
 	cmd.AddCommand(UpdateCache())
+	cmd.AddCommand(VerifyRepo())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
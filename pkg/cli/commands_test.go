@@ -0,0 +1,85 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	charmlog "github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// runLogged runs melange with args and a command which logs a message, and
+// returns the default handler it set and the log it wrote.
+func runLogged(t *testing.T, args ...string) (slog.Handler, string, error) {
+	t.Helper()
+
+	prevLogger, prevTransport := slog.Default(), http.DefaultTransport
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		http.DefaultTransport = prevTransport
+	})
+
+	logPath := filepath.Join(t.TempDir(), "log")
+	cmd := New()
+	cmd.AddCommand(&cobra.Command{
+		Use: "log",
+		Run: func(*cobra.Command, []string) {
+			slog.Info("hello", "name", "world")
+		},
+	})
+	cmd.SetArgs(append([]string{"--log-policy", logPath, "log"}, args...))
+	err := cmd.ExecuteContext(context.Background())
+
+	data, _ := os.ReadFile(logPath)
+	return slog.Default().Handler(), string(data), err
+}
+
+func TestLogFormat(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		handler, out, err := runLogged(t)
+		require.NoError(t, err)
+		require.IsType(t, &charmlog.Logger{}, handler)
+		require.Contains(t, out, "INFO hello name=world")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		handler, out, err := runLogged(t, "--log-format", "json")
+		require.NoError(t, err)
+		require.IsType(t, &slog.JSONHandler{}, handler)
+
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		require.Len(t, lines, 1)
+		entry := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		require.Equal(t, "INFO", entry["level"])
+		require.Equal(t, "hello", entry["msg"])
+		require.Equal(t, "world", entry["name"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, out, err := runLogged(t, "--log-format", "xml")
+		require.EqualError(t, err, `unknown log format "xml", must be one of text or json`)
+		require.Empty(t, out)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+// Diff is a constructor for a cobra.Command which wraps the DiffCmd function.
+func Diff() *cobra.Command {
+	var jsonOutput bool
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "diff OLD.apk NEW.apk",
+		Short: "Compare the contents of two packages",
+		Long: `Compare the contents of two packages.
+
+Compares the files of the packages, with their type, mode, owner, contents and
+link target, the fields of their .PKGINFO, and their dependencies and provides,
+most of which are generated.  This is meant to review package updates and the
+churn of rebuilds.`,
+		Example: `  melange diff packages/x86_64/hello-1.0-r0.apk packages/x86_64/hello-1.1-r0.apk
+
+  melange diff --json -o diff.json old/hello-1.0-r0.apk new/hello-1.0-r0.apk`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DiffCmd(cmd.Context(), args[0], args[1], jsonOutput, output)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "write the diff as JSON")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the diff to FILE instead of stdout")
+
+	return cmd
+}
+
+// DiffCmd is the backend implementation of the "melange diff" command.
+func DiffCmd(ctx context.Context, oldPath, newPath string, jsonOutput bool, output string) error {
+	d, err := apkdiff.Compare(ctx, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating diff: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if !jsonOutput {
+		return d.WriteText(w)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return fmt.Errorf("writing diff: %w", err)
+	}
+
+	return nil
+}
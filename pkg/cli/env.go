@@ -0,0 +1,103 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/build"
+)
+
+func Env() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "Work with the build environments kept by failed builds",
+	}
+	cmd.AddCommand(EnvExport())
+
+	return cmd
+}
+
+func EnvExport() *cobra.Command {
+	var tarballPath string
+	var image string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Snapshot the build environment and workspace of a failed build",
+		Long: `Snapshot the build environment and the workspace which a failed build
+kept with --keep-workspace into an image, to debug the failure offline.
+
+The image runs a shell in the workspace, at /home/build, with the
+environment variables of the pipelines, except for the secrets.  It is
+written to a tarball which docker load and podman load read, or pushed to a
+registry.`,
+		Example: `  melange env export --tarball foo.tar /tmp/melange-workspace-123.env.json
+  docker load -i foo.tar && docker run -it melange-env/foo:1.2.3-r0`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return EnvExportCmd(cmd.Context(), args[0], tarballPath, image)
+		},
+	}
+
+	cmd.Flags().StringVar(&tarballPath, "tarball", "", "file to write the image to, for docker load")
+	cmd.Flags().StringVar(&image, "image", "", "reference of the image, which is pushed to its registry unless --tarball is given (default melange-env/<package>:<version>)")
+
+	return cmd
+}
+
+// EnvExportCmd is the backend implementation of the "melange env export"
+// command.
+func EnvExportCmd(ctx context.Context, kept, tarballPath, image string) error {
+	log := clog.FromContext(ctx)
+
+	if tarballPath == "" && image == "" {
+		return fmt.Errorf("one of --tarball or --image is required")
+	}
+
+	k, err := build.ReadKeptEnvironment(kept)
+	if err != nil {
+		return err
+	}
+
+	if image == "" {
+		image = fmt.Sprintf("melange-env/%s:%s", k.Package, k.Version)
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return fmt.Errorf("invalid image %q: %w", image, err)
+	}
+
+	img, err := k.Image(ctx)
+	if err != nil {
+		return err
+	}
+
+	if tarballPath != "" {
+		log.Infof("writing %s to %s", ref, tarballPath)
+		return tarball.WriteToFile(tarballPath, ref, img)
+	}
+
+	log.Infof("pushing %s", ref)
+	return remote.Write(ref, img, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/graph"
+)
+
+// Graph is a constructor for a cobra.Command which wraps the GraphCmd function.
+func Graph() *cobra.Command {
+	var format string
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "graph DIR",
+		Short: "Export the dependency graph of a repository of build files",
+		Long: `Export the dependency graph of a repository of build files.
+
+Parses every build file in DIR, and resolves which configurations build the
+packages the others install to build, and depend on at runtime.  Dependencies
+which no build file in DIR provides are left out.
+
+The graph is written in the DOT language of graphviz, or as JSON along with
+the order to build the configurations in.  The order format writes only the
+order, one configuration per line.  A configuration is built after the ones
+it installs to build, and after their runtime dependencies.`,
+		Example: `  melange graph . | dot -Tsvg > graph.svg
+
+  melange graph --format json -o graph.json .
+
+  melange graph --format order .`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return GraphCmd(cmd.Context(), args[0], format, output)
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "dot", "the format of the graph: dot, json or order")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the graph to FILE instead of stdout")
+
+	return cmd
+}
+
+// graphOutput is the JSON output of "melange graph".
+type graphOutput struct {
+	*graph.Graph
+	Order []string `json:"order"`
+}
+
+// GraphCmd is the backend implementation of the "melange graph" command.
+func GraphCmd(ctx context.Context, dir, format, output string) error {
+	if format != "dot" && format != "json" && format != "order" {
+		return fmt.Errorf("unknown format %q: expected dot, json or order", format)
+	}
+
+	g, err := graph.Load(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	var order []string
+	if format != "dot" {
+		order, err = g.Order()
+		if err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating graph: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(graphOutput{Graph: g, Order: order}); err != nil {
+			return fmt.Errorf("writing graph: %w", err)
+		}
+	case "order":
+		for _, name := range order {
+			if _, err := fmt.Fprintln(w, name); err != nil {
+				return fmt.Errorf("writing order: %w", err)
+			}
+		}
+	default:
+		return g.WriteDOT(w)
+	}
+
+	return nil
+}
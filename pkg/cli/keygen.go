@@ -16,20 +16,55 @@ package cli
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
+	"chainguard.dev/melange/pkg/verify"
 	"github.com/chainguard-dev/clog"
 	"github.com/spf13/cobra"
 )
 
+// The types of keys keygen generates.  APK signatures are RSA signatures, so
+// only RSA keys can sign packages and indexes.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
 type KeygenContext struct {
 	KeyName string
+	KeyType string
+	// BitSize is the size of RSA keys, or of the curve of ECDSA keys.
 	BitSize int
+	Comment string
+	// Expires is how long the key may be used before it is rotated, which
+	// is recorded in its metadata.  Keys do not expire if it is zero.
+	Expires time.Duration
+}
+
+// KeyMetadata describes a generated key.  It is written next to the keys
+// and is not read by melange or apk.
+type KeyMetadata struct {
+	// The filename of the public key, which is what repositories refer to
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Bits        int        `json:"bits,omitempty"`
+	Fingerprint string     `json:"fingerprint"`
+	Comment     string     `json:"comment,omitempty"`
+	Created     time.Time  `json:"created"`
+	Expires     *time.Time `json:"expires,omitempty"`
 }
 
 type KeygenOption func(*KeygenContext) error
@@ -41,6 +76,18 @@ func withKeyName(keyName string) KeygenOption {
 	}
 }
 
+func withKeyType(keyType string) KeygenOption {
+	return func(kc *KeygenContext) error {
+		switch keyType {
+		case KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519:
+		default:
+			return fmt.Errorf("unsupported key type %q: must be %s, %s or %s", keyType, KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519)
+		}
+		kc.KeyType = keyType
+		return nil
+	}
+}
+
 func withBitSize(bitSize int) KeygenOption {
 	return func(kc *KeygenContext) error {
 		kc.BitSize = bitSize
@@ -48,10 +95,26 @@ func withBitSize(bitSize int) KeygenOption {
 	}
 }
 
+func withComment(comment string) KeygenOption {
+	return func(kc *KeygenContext) error {
+		kc.Comment = comment
+		return nil
+	}
+}
+
+func withExpires(expires time.Duration) KeygenOption {
+	return func(kc *KeygenContext) error {
+		if expires < 0 {
+			return fmt.Errorf("the expiry of the key cannot be negative")
+		}
+		kc.Expires = expires
+		return nil
+	}
+}
+
 func newKeygenContext(opts ...KeygenOption) (*KeygenContext, error) {
 	kc := KeygenContext{
-		KeyName: "melange.rsa",
-		BitSize: 4096,
+		KeyType: KeyTypeRSA,
 	}
 
 	for _, opt := range opts {
@@ -60,10 +123,54 @@ func newKeygenContext(opts ...KeygenOption) (*KeygenContext, error) {
 		}
 	}
 
+	if kc.KeyName == "" {
+		kc.KeyName = "melange." + kc.KeyType
+	}
+
+	switch kc.KeyType {
+	case KeyTypeRSA:
+		if kc.BitSize == 0 {
+			kc.BitSize = 4096
+		}
+		if kc.BitSize < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits, not %d", kc.BitSize)
+		}
+	case KeyTypeECDSA:
+		if kc.BitSize == 0 {
+			kc.BitSize = 256
+		}
+		if _, err := kc.curve(); err != nil {
+			return nil, err
+		}
+	case KeyTypeEd25519:
+		// Ed25519 keys have a fixed size.
+		kc.BitSize = 0
+	}
+
 	return &kc, nil
 }
 
+func (kc *KeygenContext) curve() (elliptic.Curve, error) {
+	switch kc.BitSize {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	}
+
+	return nil, fmt.Errorf("ECDSA keys must be 256, 384 or 521 bits, not %d", kc.BitSize)
+}
+
+// GenerateKeypair generates an RSA key of the size of the context, which
+// can sign packages and indexes.  Use GenerateKeypairWithAlgorithm for the
+// other types of keys.
 func (kc *KeygenContext) GenerateKeypair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	if kc.KeyType != KeyTypeRSA {
+		return nil, nil, fmt.Errorf("unable to generate RSA private key: the key type is %s", kc.KeyType)
+	}
+
 	privateKey, err := rsa.GenerateKey(rand.Reader, kc.BitSize)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to generate RSA private key: %w", err)
@@ -73,18 +180,100 @@ func (kc *KeygenContext) GenerateKeypair() (*rsa.PrivateKey, *rsa.PublicKey, err
 	return privateKey, publicKey, nil
 }
 
+// GenerateKeypairWithAlgorithm generates a key of the type and size of the
+// context.
+func (kc *KeygenContext) GenerateKeypairWithAlgorithm() (crypto.Signer, crypto.PublicKey, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch kc.KeyType {
+	case KeyTypeRSA:
+		var rsaKey *rsa.PrivateKey
+		rsaKey, _, err = kc.GenerateKeypair()
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKey = rsaKey
+	case KeyTypeECDSA:
+		var curve elliptic.Curve
+		curve, err = kc.curve()
+		if err != nil {
+			return nil, nil, err
+		}
+		privateKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyTypeEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %q", kc.KeyType)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate %s private key: %w", kc.KeyType, err)
+	}
+
+	return privateKey, privateKey.Public(), nil
+}
+
+// marshalPrivateKey encodes RSA keys as PKCS #1 and ECDSA keys as SEC 1, as
+// openssl does, and Ed25519 keys as PKCS #8.
+func marshalPrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		data, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}, nil
+	default:
+		data, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: data}, nil
+	}
+}
+
+func writePEM(path string, block *pem.Block, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, block); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
 func Keygen() *cobra.Command {
+	var keyType string
 	var keySize int
+	var comment string
+	var expires time.Duration
 
 	cmd := &cobra.Command{
-		Use:     "keygen",
-		Short:   "Generate a key for package signing",
-		Long:    `Generate a key for package signing.`,
-		Example: `  melange keygen [key.rsa]`,
-		Args:    cobra.MinimumNArgs(0),
+		Use:   "keygen",
+		Short: "Generate a key for package signing",
+		Long: `Generate a key for package signing.
+
+The private key is written to the given file, melange.rsa by default, the
+public key to the same file with a .pub extension, and the metadata of the
+key, with its fingerprint, comment and expiry, to the same file with a .json
+extension.
+
+APK signatures are RSA signatures, so only RSA keys can sign packages and
+indexes.`,
+		Example: `  melange keygen [key.rsa]
+  melange keygen --key-size 2048 --comment "build key" --expires 8760h`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			options := []KeygenOption{
+				withKeyType(keyType),
 				withBitSize(keySize),
+				withComment(comment),
+				withExpires(expires),
 			}
 
 			if len(args) > 0 {
@@ -95,7 +284,10 @@ func Keygen() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().IntVar(&keySize, "key-size", 4096, "the size of the prime to calculate (in bits)")
+	cmd.Flags().StringVar(&keyType, "type", KeyTypeRSA, "the type of key to generate: rsa, ecdsa or ed25519")
+	cmd.Flags().IntVar(&keySize, "key-size", 0, "the size of the key in bits: at least 2048 for rsa (default 4096), and 256, 384 or 521 for ecdsa (default 256)")
+	cmd.Flags().StringVar(&comment, "comment", "", "a comment to record in the metadata of the key")
+	cmd.Flags().DurationVar(&expires, "expires", 0, "how long the key may be used before it is rotated, recorded in the metadata of the key (e.g. 8760h)")
 
 	return cmd
 }
@@ -107,49 +299,72 @@ func KeygenCmd(ctx context.Context, opts ...KeygenOption) error {
 		return err
 	}
 
-	log.Infof("generating keypair with a %d bit prime, please wait...", kc.BitSize)
-
-	privkey, pubkey, err := kc.GenerateKeypair()
-	if err != nil {
-		return err
+	if kc.KeyType != KeyTypeRSA {
+		log.Warnf("%s keys cannot sign packages or indexes, which only support RSA signatures", kc.KeyType)
 	}
 
-	privateKeyData := x509.MarshalPKCS1PrivateKey(privkey)
-	privateKeyBlock := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyData,
+	if kc.BitSize != 0 {
+		log.Infof("generating %s keypair of %d bits, please wait...", kc.KeyType, kc.BitSize)
+	} else {
+		log.Infof("generating %s keypair...", kc.KeyType)
 	}
-	privatePem, err := os.Create(kc.KeyName)
+
+	privkey, pubkey, err := kc.GenerateKeypairWithAlgorithm()
 	if err != nil {
-		return fmt.Errorf("unable to open private key for writing: %w", err)
+		return err
 	}
-	defer privatePem.Close()
+	created := time.Now().UTC().Truncate(time.Second)
 
-	if err := pem.Encode(privatePem, &privateKeyBlock); err != nil {
+	privateKeyBlock, err := marshalPrivateKey(privkey)
+	if err != nil {
 		return fmt.Errorf("unable to encode private key: %w", err)
 	}
+	if err := writePEM(kc.KeyName, privateKeyBlock, 0o600); err != nil {
+		return fmt.Errorf("unable to write private key: %w", err)
+	}
 
-	log.Infof("wrote private key to %s", privatePem.Name())
+	log.Infof("wrote private key to %s", kc.KeyName)
 
 	publicKeyData, err := x509.MarshalPKIXPublicKey(pubkey)
 	if err != nil {
 		return fmt.Errorf("unable to calculate public key: %w", err)
 	}
-	publicKeyBlock := pem.Block{
+	publicKeyBlock := &pem.Block{
 		Type:  "PUBLIC KEY",
 		Bytes: publicKeyData,
 	}
-	publicPem, err := os.Create(fmt.Sprintf("%s.pub", kc.KeyName))
-	if err != nil {
-		return fmt.Errorf("unable to open public key for writing: %w", err)
+	publicKeyName := fmt.Sprintf("%s.pub", kc.KeyName)
+	if err := writePEM(publicKeyName, publicKeyBlock, 0o644); err != nil {
+		return fmt.Errorf("unable to write public key: %w", err)
 	}
-	defer publicPem.Close()
 
-	if err := pem.Encode(publicPem, &publicKeyBlock); err != nil {
-		return fmt.Errorf("unable to encode public key: %w", err)
+	log.Infof("wrote public key to %s", publicKeyName)
+
+	md := KeyMetadata{
+		Name:        filepath.Base(publicKeyName),
+		Type:        kc.KeyType,
+		Bits:        kc.BitSize,
+		Fingerprint: verify.Fingerprint(publicKeyData),
+		Comment:     kc.Comment,
+		Created:     created,
+	}
+	if kc.Expires > 0 {
+		expires := created.Add(kc.Expires)
+		md.Expires = &expires
+	}
+
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode key metadata: %w", err)
+	}
+	metadataName := fmt.Sprintf("%s.json", kc.KeyName)
+	if err := os.WriteFile(metadataName, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("unable to write key metadata: %w", err)
 	}
 
-	log.Infof("wrote public key to %s", publicPem.Name())
+	log.Infof("wrote key metadata to %s", metadataName)
+	log.Infof("the fingerprint of the key is %s", md.Fingerprint)
+	fmt.Println(md.Fingerprint)
 
 	return nil
 }
@@ -0,0 +1,151 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/pkg/verify"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateKeypair(t *testing.T) {
+	kc, err := newKeygenContext(withBitSize(2048))
+	require.NoError(t, err)
+
+	privkey, pubkey, err := kc.GenerateKeypair()
+	require.NoError(t, err)
+	require.Equal(t, 2048, privkey.N.BitLen())
+	require.True(t, pubkey.Equal(privkey.Public()))
+
+	kc, err = newKeygenContext(withKeyType(KeyTypeEd25519))
+	require.NoError(t, err)
+	_, _, err = kc.GenerateKeypair()
+	require.Error(t, err)
+}
+
+func readPEM(t *testing.T, path string) *pem.Block {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block, path)
+	return block
+}
+
+func TestKeygenCmd(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	message := []byte("the signed data of a package")
+
+	for _, tt := range []struct {
+		keyType string
+		bitSize int
+		// sign signs the message with the private key, and verify checks
+		// the signature with the public key.
+		sign   func(t *testing.T, key any) []byte
+		verify func(key crypto.PublicKey, sig []byte) bool
+	}{{
+		keyType: KeyTypeRSA,
+		bitSize: 2048,
+		// Like apk, which signs the SHA-1 digest of the control section.
+		sign: func(t *testing.T, key any) []byte {
+			digest := sha1.Sum(message)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA1, digest[:])
+			require.NoError(t, err)
+			return sig
+		},
+		verify: func(key crypto.PublicKey, sig []byte) bool {
+			digest := sha1.Sum(message)
+			return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA1, digest[:], sig) == nil
+		},
+	}, {
+		keyType: KeyTypeECDSA,
+		bitSize: 384,
+		sign: func(t *testing.T, key any) []byte {
+			digest := sha256.Sum256(message)
+			sig, err := ecdsa.SignASN1(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+			require.NoError(t, err)
+			return sig
+		},
+		verify: func(key crypto.PublicKey, sig []byte) bool {
+			digest := sha256.Sum256(message)
+			return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], sig)
+		},
+	}, {
+		keyType: KeyTypeEd25519,
+		sign: func(t *testing.T, key any) []byte {
+			return ed25519.Sign(key.(ed25519.PrivateKey), message)
+		},
+		verify: func(key crypto.PublicKey, sig []byte) bool {
+			return ed25519.Verify(key.(ed25519.PublicKey), message, sig)
+		},
+	}} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			keyName := filepath.Join(t.TempDir(), "test."+tt.keyType)
+			require.NoError(t, KeygenCmd(ctx,
+				withKeyName(keyName),
+				withKeyType(tt.keyType),
+				withBitSize(tt.bitSize),
+			))
+
+			// The keys are read back the way the tools which use them do.
+			block := readPEM(t, keyName)
+			var privkey any
+			var err error
+			switch block.Type {
+			case "RSA PRIVATE KEY":
+				privkey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "EC PRIVATE KEY":
+				privkey, err = x509.ParseECPrivateKey(block.Bytes)
+			default:
+				privkey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			}
+			require.NoError(t, err)
+
+			block = readPEM(t, keyName+".pub")
+			require.Equal(t, "PUBLIC KEY", block.Type)
+			pubkey, err := x509.ParsePKIXPublicKey(block.Bytes)
+			require.NoError(t, err)
+			require.True(t, privkey.(crypto.Signer).Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(pubkey))
+
+			sig := tt.sign(t, privkey)
+			require.True(t, tt.verify(pubkey, sig))
+			sig[len(sig)/2] ^= 0xff
+			require.False(t, tt.verify(pubkey, sig))
+
+			data, err := os.ReadFile(keyName + ".json")
+			require.NoError(t, err)
+			var md KeyMetadata
+			require.NoError(t, json.Unmarshal(data, &md))
+			require.Equal(t, filepath.Base(keyName)+".pub", md.Name)
+			require.Equal(t, tt.keyType, md.Type)
+			require.Equal(t, tt.bitSize, md.Bits)
+			require.Equal(t, verify.Fingerprint(block.Bytes), md.Fingerprint)
+		})
+	}
+}
@@ -16,7 +16,10 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"path/filepath"
 	"slices"
 	"strings"
 
@@ -25,12 +28,20 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/linter"
 	linter_defaults "chainguard.dev/melange/pkg/linter/defaults"
 )
 
 type LintOpts struct {
 	linters []string
+
+	// output is the format of the findings in the configuration files:
+	// text or json.
+	output string
+	// pipelineDir extends the built-in pipelines whose inputs are checked.
+	pipelineDir string
 }
 
 func Lint() *cobra.Command {
@@ -39,11 +50,19 @@ func Lint() *cobra.Command {
 	var enabled, disabled []string
 
 	cmd := &cobra.Command{
-		Use:     "lint",
-		Short:   "EXPERIMENTAL COMMAND - Lints an APK, checking for problems and errors",
-		Long:    `Lint is an EXPERIMENTAL COMMAND - Lints an APK file, checking for problems and errors.`,
-		Example: `  melange lint [--enable=foo[,bar]] [--disable=baz] foo.apk`,
-		Args:    cobra.MinimumNArgs(1),
+		Use:   "lint",
+		Short: "EXPERIMENTAL COMMAND - Lints an APK or a build file, checking for problems and errors",
+		Long: `Lint is an EXPERIMENTAL COMMAND - Lints an APK file, checking for problems and errors.
+
+A build file, whose name ends in .yaml or .yml, is checked against the
+schema, and for the inputs given to pipelines which do not have them, the
+fetched sources which do not refer to the version of the package or have no
+checksum, the git checkouts without an expected commit, the duplicate
+subpackages, the licenses which are not SPDX expressions and the references
+to undefined variables.  The command fails if any is found.`,
+		Example: `  melange lint [--enable=foo[,bar]] [--disable=baz] foo.apk
+  melange lint --output json foo.yaml`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
@@ -77,12 +96,30 @@ func Lint() *cobra.Command {
 
 			o.linters = linters
 
-			return o.RunAllE(ctx, args...)
+			if o.output != "text" && o.output != "json" {
+				return fmt.Errorf("unknown output format %q, must be text or json", o.output)
+			}
+
+			apks, configs := []string{}, []string{}
+			for _, arg := range args {
+				if ext := filepath.Ext(arg); ext == ".yaml" || ext == ".yml" {
+					configs = append(configs, arg)
+				} else {
+					apks = append(apks, arg)
+				}
+			}
+
+			if err := o.LintConfigs(ctx, cmd.OutOrStdout(), configs...); err != nil {
+				return err
+			}
+			return o.RunAllE(ctx, apks...)
 		},
 	}
 
 	cmd.Flags().StringSliceVar(&enabled, "enabled", []string{}, "enable additional, non-default lints, `--disabled` overrides this")
 	cmd.Flags().StringSliceVar(&disabled, "disabled", []string{}, "disable linters enabled by default or passed in `--enabled`")
+	cmd.Flags().StringVar(&o.output, "output", "text", "format of the problems found in build files: text, or json for a list of objects with a check, a file, a line and a message")
+	cmd.Flags().StringVar(&o.pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines, whose inputs are checked")
 
 	return cmd
 }
@@ -115,3 +152,45 @@ func (o LintOpts) run(ctx context.Context, pkg string) error {
 	}
 	return nil
 }
+
+// LintConfigs lints the build files configs, writes the problems found to w
+// and fails if there are any.
+func (o LintOpts) LintConfigs(ctx context.Context, w io.Writer, configs ...string) error {
+	if len(configs) == 0 {
+		return nil
+	}
+
+	pipelineDirs := []string{BuiltinPipelineDir}
+	if o.pipelineDir != "" {
+		pipelineDirs = []string{o.pipelineDir, BuiltinPipelineDir}
+	}
+	inputs := func(uses string) (map[string]config.Input, error) {
+		return build.PipelineInputs(ctx, pipelineDirs, uses)
+	}
+
+	findings := []config.LintFinding{}
+	for _, cfg := range configs {
+		found, err := config.Lint(ctx, cfg, inputs)
+		if err != nil {
+			return fmt.Errorf("linting %s: %w", cfg, err)
+		}
+		findings = append(findings, found...)
+	}
+
+	if o.output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			fmt.Fprintln(w, f)
+		}
+	}
+
+	if len(findings) != 0 {
+		return fmt.Errorf("found %d problems in the build files", len(findings))
+	}
+	return nil
+}
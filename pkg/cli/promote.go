@@ -0,0 +1,146 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/promote"
+	"chainguard.dev/melange/pkg/verify"
+)
+
+// Promote is a constructor for a cobra.Command which wraps the PromoteCmd function.
+func Promote() *cobra.Command {
+	var policyPath string
+	var keys []string
+	var signingKey string
+	var archs []string
+
+	cmd := &cobra.Command{
+		Use:   "promote FROM TO PACKAGE...",
+		Short: "Move packages to another repository once they meet a policy",
+		Long: `Move packages to another repository once they meet a policy.
+
+Moves the packages, their index entries and the files named after their apk,
+such as signatures, SBOMs and attestations, from the repository in FROM to the
+one in TO, for example from staging to stable.  A package is either selected
+by name, which selects all of its versions, or by name-version.
+
+Nothing is moved unless every selected package matches its index entry and
+meets the policy, which may require the package to be signed, to be
+accompanied by files with given suffixes, and to be built some time ago:
+
+  signed: true
+  require:
+    - .intoto.jsonl
+    - .tested
+  min-age: 24h
+
+Both indexes are replaced rather than rewritten in place.`,
+		Example: `  melange promote --policy promote.yaml -k melange.rsa.pub --signing-key melange.rsa --arch x86_64,aarch64 ./staging ./stable foo bar-1.2.3-r0`,
+		Args:    cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := []promote.Option{promote.WithSigningKey(signingKey)}
+
+			if policyPath != "" {
+				p, err := promote.LoadPolicy(policyPath)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, promote.WithPolicy(*p))
+			}
+
+			k, err := verify.LoadKeys(keys)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, promote.WithKeys(k))
+
+			return PromoteCmd(cmd.Context(), args[0], args[1], archs, args[2:], opts...)
+		},
+	}
+
+	cmd.Flags().StringVar(&policyPath, "policy", "", "path to the policy which the packages must meet")
+	cmd.Flags().StringSliceVarP(&keys, "keyring-append", "k", []string{}, "path to public keys which packages must be signed with, if the policy requires it")
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing the indexes (optional)")
+	cmd.Flags().StringSliceVar(&archs, "arch", nil, "architectures to move the packages of, each in its own subdirectory of FROM and TO")
+
+	return cmd
+}
+
+// Demote is a constructor for a cobra.Command which wraps the DemoteCmd function.
+func Demote() *cobra.Command {
+	var signingKey string
+	var archs []string
+
+	cmd := &cobra.Command{
+		Use:   "demote FROM TO PACKAGE...",
+		Short: "Move packages back to another repository",
+		Long: `Move packages back to another repository.
+
+Moves the packages, their index entries and the files named after their apk
+from the repository in FROM to the one in TO, for example from stable back to
+staging, like promote does but without checking any policy.`,
+		Example: `  melange demote --signing-key melange.rsa --arch x86_64 ./stable ./staging foo-1.2.3-r0`,
+		Args:    cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DemoteCmd(cmd.Context(), args[0], args[1], archs, args[2:], promote.WithSigningKey(signingKey))
+		},
+	}
+
+	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing the indexes (optional)")
+	cmd.Flags().StringSliceVar(&archs, "arch", nil, "architectures to move the packages of, each in its own subdirectory of FROM and TO")
+
+	return cmd
+}
+
+// PromoteCmd is the backend implementation of the "melange promote" command.
+func PromoteCmd(ctx context.Context, from, to string, archs, packages []string, opts ...promote.Option) error {
+	return transitionCmd(ctx, promote.Promote, from, to, archs, packages, opts)
+}
+
+// DemoteCmd is the backend implementation of the "melange demote" command.
+func DemoteCmd(ctx context.Context, from, to string, archs, packages []string, opts ...promote.Option) error {
+	return transitionCmd(ctx, promote.Demote, from, to, archs, packages, opts)
+}
+
+type transitionFunc func(ctx context.Context, from, to string, selectors []string, opts ...promote.Option) (*promote.Result, error)
+
+// transitionCmd moves the packages of each architecture, or of the
+// repositories themselves if there are none.
+func transitionCmd(ctx context.Context, move transitionFunc, from, to string, archs, packages []string, opts []promote.Option) error {
+	log := clog.FromContext(ctx)
+
+	if len(archs) == 0 {
+		archs = []string{""}
+	}
+
+	for _, arch := range archs {
+		res, err := move(ctx, filepath.Join(from, arch), filepath.Join(to, arch), packages, opts...)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range res.Files {
+			log.Infof("moved %s", filepath.Join(arch, f))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/publish"
+)
+
+// PushArtifacts is a constructor for a cobra.Command which wraps the
+// PushArtifactsCmd function.
+func PushArtifacts() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "push-artifacts",
+		Short: "Push packages to an OCI registry as artifacts",
+		Long: `Push packages to an OCI repository as artifacts, each tagged with the
+name, version and architecture of its package, e.g. libcap-2.69-r0-x86_64.
+
+The SBOM of a package, and its attestation if a .intoto.jsonl file is
+beside its apk, are pushed as artifacts which refer to it, so that they are
+listed by the referrers API of the registry, or by the sha256-<digest> tag
+of registries which do not support it.`,
+		Example: `  melange push-artifacts registry.example.com/packages packages/x86_64/*.apk`,
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return PushArtifactsCmd(cmd.Context(), args[0], args[1:])
+		},
+	}
+
+	return cmd
+}
+
+// PushArtifactsCmd is the backend implementation of the "melange
+// push-artifacts" command.
+func PushArtifactsCmd(ctx context.Context, repository string, apks []string) error {
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		return fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+
+	for _, apk := range apks {
+		digest, err := publish.PushArtifact(ctx, repo, apk)
+		if err != nil {
+			return err
+		}
+		fmt.Println(digest)
+	}
+
+	return nil
+}
@@ -16,27 +16,59 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"text/template"
 
+	"chainguard.dev/melange/pkg/apk"
 	"chainguard.dev/melange/pkg/config"
 	"github.com/spf13/cobra"
 )
 
 func Query() *cobra.Command {
+	var jsonOutput bool
+	var output string
+
 	cmd := &cobra.Command{
 		Use:   "query",
-		Short: "Query a Melange YAML file for information",
-		Long: `Query a Melange YAML file for information.
-		Uses templates with go templates syntax to query the YAML file.`,
-		Example: `  melange query config.yaml "{{ .Package.Name }}-{{ .Package.Version }}-{{ .Package.Epoch }}"`,
-		Args:    cobra.MinimumNArgs(2),
+		Short: "Query a Melange YAML file or a package for information",
+		Long: `Query a Melange YAML file or a package for information.
+		Uses templates with go templates syntax to query the YAML file.
+
+Given an apk, prints its .PKGINFO, its files with their modes, sizes and
+digests, its install scripts and the key it is signed with, without needing
+apk-tools.  A template can query the package too.`,
+		Example: `  melange query config.yaml "{{ .Package.Name }}-{{ .Package.Version }}-{{ .Package.Epoch }}"
+
+  melange query packages/x86_64/hello-1.0-r0.apk
+
+  melange query --json packages/x86_64/hello-1.0-r0.apk
+
+  melange query packages/x86_64/hello-1.0-r0.apk "{{ range .Files }}{{ .Path }}{{ println }}{{ end }}"`,
+		Args: cobra.RangeArgs(1, 2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return QueryCmd(cmd.Context(), args[0], args[1])
+			pattern := ""
+			if len(args) == 2 {
+				pattern = args[1]
+			}
+
+			if strings.HasSuffix(args[0], ".apk") {
+				return QueryApkCmd(cmd.Context(), args[0], pattern, jsonOutput, output)
+			}
+
+			if pattern == "" {
+				return fmt.Errorf("a template is required to query %s", args[0])
+			}
+			return QueryCmd(cmd.Context(), args[0], pattern)
 		},
 	}
 
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "write the package as JSON")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the package to FILE instead of stdout")
+
 	return cmd
 }
 
@@ -55,3 +87,44 @@ func QueryCmd(ctx context.Context, configFile, pattern string) error {
 	}
 	return nil
 }
+
+// QueryApkCmd is the backend implementation of "melange query" for apks.
+// The package is queried with pattern if it is set, and otherwise written
+// as text, or as JSON.
+func QueryApkCmd(ctx context.Context, path, pattern string, jsonOutput bool, output string) error {
+	pkg, err := apk.Read(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating output: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch {
+	case pattern != "":
+		tmpl, err := template.New("query").Parse(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+		if err := tmpl.Execute(w, pkg); err != nil {
+			return fmt.Errorf("error executing template: %w", err)
+		}
+		return nil
+	case jsonOutput:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(pkg); err != nil {
+			return fmt.Errorf("writing package: %w", err)
+		}
+		return nil
+	default:
+		return pkg.WriteText(w)
+	}
+}
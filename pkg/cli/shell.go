@@ -0,0 +1,139 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Shell() *cobra.Command {
+	var arch string
+	var workspaceDir string
+	var pipelineDir string
+	var sourceDir string
+	var cacheDir string
+	var apkCacheDir string
+	var envFile string
+	var varsFile string
+	var buildOption []string
+	var extraKeys []string
+	var extraRepos []string
+	var extraPackages []string
+	var runner string
+	var fetchSources bool
+	var emptyWorkspace bool
+
+	cmd := &cobra.Command{
+		Use:   "shell",
+		Short: "Open a shell in the build environment of a package",
+		Long: `Open a shell in the build environment of a package.
+
+The build environment is provisioned as for a build, with the packages needed
+by the pipelines installed and the environment variables set, but no pipeline
+is run.  Changes to /home/build are kept in the workspace directory.`,
+		Example: `  melange shell [config.yaml] [-- command [args...]]`,
+		Args:    cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			// Arguments after -- are the command to run instead of a shell.
+			configFile, command := "", []string{}
+			switch n := cmd.ArgsLenAtDash(); {
+			case n < 0 && len(args) > 1:
+				return fmt.Errorf("expected at most one configuration file, use -- before the command to run")
+			case n < 0:
+				if len(args) == 1 {
+					configFile = args[0]
+				}
+			case n > 1:
+				return fmt.Errorf("expected at most one configuration file, got %d", n)
+			default:
+				if n == 1 {
+					configFile = args[0]
+				}
+				command = args[n:]
+			}
+
+			r, err := getRunner(ctx, runner)
+			if err != nil {
+				return err
+			}
+
+			options := []build.Option{
+				build.WithArch(apko_types.ParseArchitecture(arch)),
+				build.WithWorkspaceDir(workspaceDir),
+				build.WithPipelineDir(pipelineDir),
+				build.WithPipelineDir(BuiltinPipelineDir),
+				build.WithCacheDir(cacheDir),
+				build.WithPackageCacheDir(apkCacheDir),
+				build.WithEnvFile(envFile),
+				build.WithVarsFile(varsFile),
+				build.WithEnabledBuildOptions(buildOption),
+				build.WithExtraKeys(extraKeys),
+				build.WithExtraRepos(extraRepos),
+				build.WithExtraPackages(extraPackages),
+				build.WithEmptyWorkspace(emptyWorkspace),
+				build.WithRunner(r),
+				// An explicit workspace is kept, so that the exploration
+				// can be picked up again.
+				build.WithRemove(workspaceDir == ""),
+			}
+
+			if configFile != "" {
+				options = append(options, build.WithConfig(configFile))
+
+				if sourceDir == "" {
+					sourceDir = filepath.Dir(configFile)
+				}
+			}
+
+			if sourceDir != "" {
+				options = append(options, build.WithSourceDir(sourceDir))
+			}
+
+			bc, err := build.New(ctx, options...)
+			if err != nil {
+				return err
+			}
+			defer bc.Close(ctx)
+
+			return bc.Shell(ctx, fetchSources, command...)
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "architecture of the build environment")
+	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build, which is kept after the shell exits")
+	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
+	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
+	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
+	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
+	cmd.Flags().StringSliceVar(&buildOption, "build-option", []string{}, "build options to enable")
+	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
+	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
+	cmd.Flags().StringSliceVar(&extraPackages, "package-append", []string{}, "extra packages to install in the build environment")
+	cmd.Flags().StringVar(&runner, "runner", "", fmt.Sprintf("which runner to use to enable running commands, default is based on your platform. Options are %q", build.GetAllRunners()))
+	cmd.Flags().BoolVar(&fetchSources, "fetch-sources", false, "run the leading fetch, git-checkout and patch steps of the main pipeline before opening the shell")
+	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the workspace should be empty")
+
+	return cmd
+}
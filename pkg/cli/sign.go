@@ -15,21 +15,15 @@
 package cli
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
-	"fmt"
-	"io"
-	"os"
+	"path/filepath"
 
 	"github.com/chainguard-dev/clog"
-	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
-	"github.com/klauspost/compress/gzip"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 
-	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/signing"
 )
 
 type signIndexOpts struct {
@@ -44,22 +38,31 @@ func SignIndex() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "sign-index",
 		Short: "Sign an APK index",
-		Long:  `Sign an APK index.`,
+		Long: `Sign an APK index.
+
+Indexes which are already signed are left as they are, unless --force is
+given, in which case their signatures are replaced with one made with the
+signing key.`,
 		Example: `
-    # Re-sign an index with the same signature
+    # Sign an index which is not signed yet
     melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz>
 
-    # Sign a new index with a new signature
+    # Replace the signature of an index with a new one
     melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz> --force
     `,
 		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return o.SignIndex(cmd.Context(), args[0])
+			for _, arg := range args {
+				if err := o.SignIndex(cmd.Context(), arg); err != nil {
+					return err
+				}
+			}
+			return nil
 		},
 	}
 
 	cmd.Flags().StringVar(&o.Key, "signing-key", "melange.rsa", "the signing key to use")
-	cmd.Flags().BoolVarP(&o.Force, "force", "f", false, "when toggled, overwrites the specified index with a new index using the provided signature")
+	cmd.Flags().BoolVarP(&o.Force, "force", "f", false, "when toggled, replaces the signatures of indexes which are already signed")
 
 	return cmd
 }
@@ -70,84 +73,8 @@ func (o signIndexOpts) SignIndex(ctx context.Context, indexFile string) error {
 		return sign.SignIndex(ctx, o.Key, indexFile)
 	}
 
-	idx, err := parseIndexWithoutSignature(ctx, indexFile)
-	if err != nil {
-		return err
-	}
-
-	t, err := os.Create(fmt.Sprintf("%s.new", indexFile))
-	if err != nil {
-		return err
-	}
-
-	if _, err := t.Write(idx); err != nil {
-		return err
-	}
-
-	if err := t.Sync(); err != nil {
-		return err
-	}
-
-	if _, err := t.Seek(0, io.SeekStart); err != nil {
-		return err
-	}
-
-	if err := sign.SignIndex(ctx, o.Key, t.Name()); err != nil {
-		return err
-	}
-
-	log.Infof("Replacing existing signed index (%s) with signed index with key %s", indexFile, o.Key)
-	return os.Rename(t.Name(), indexFile)
-}
-
-// parseIndexWithoutSignature takes in an index file and returns the unsigned []byte representation of it
-func parseIndexWithoutSignature(_ context.Context, indexFile string) ([]byte, error) {
-	orig, err := os.Open(indexFile)
-	if err != nil {
-		return nil, err
-	}
-	defer orig.Close()
-
-	gr, err := gzip.NewReader(orig)
-	if err != nil {
-		return nil, err
-	}
-	defer gr.Close()
-
-	tr := tar.NewReader(gr)
-
-	var nb bytes.Buffer
-
-	gw := gzip.NewWriter(&nb)
-	tw := tar.NewWriter(gw)
-
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		if hdr.Name == "DESCRIPTION" || hdr.Name == "APKINDEX" {
-			if err := tw.WriteHeader(hdr); err != nil {
-				return nil, err
-			}
-			if _, err := io.Copy(tw, tr); err != nil {
-				return nil, err
-			}
-		}
-	}
-
-	if err := tw.Close(); err != nil {
-		return nil, err
-	}
-	if err := gw.Close(); err != nil {
-		return nil, err
-	}
-
-	return nb.Bytes(), nil
+	log.Infof("Replacing the signature of %s with one made with key %s", indexFile, o.Key)
+	return signing.Index(ctx, indexFile, o.Key, "")
 }
 
 type signOpts struct {
@@ -194,67 +121,59 @@ func (o signOpts) RunAllE(ctx context.Context, pkgs ...string) error {
 func (o signOpts) run(ctx context.Context, pkg string) error {
 	clog.FromContext(ctx).Infof("Processing apk %s", pkg)
 
-	apkr, err := os.Open(pkg)
-	if err != nil {
-		return err
-	}
-
-	eapk, err := expandapk.ExpandApk(ctx, apkr, "")
-	if err != nil {
-		return fmt.Errorf("expanding apk: %w", err)
-	}
-	defer eapk.Close()
-
-	if err := apkr.Close(); err != nil {
-		return err
-	}
-
-	// Split the streams and then rebuild
-	cf, err := os.Open(eapk.ControlFile)
-	if err != nil {
-		return err
-	}
-	defer cf.Close()
+	return signing.Package(ctx, pkg, o.Key, "")
+}
 
-	// Use the control sections ModTime (set to SDE) for the signature
-	cfinfo, err := os.Stat(eapk.ControlFile)
-	if err != nil {
-		return err
-	}
+// ReSign is a constructor for a cobra.Command which wraps the ReSignCmd function.
+func ReSign() *cobra.Command {
+	var signingKey, passphrase string
+	var archs []string
 
-	pc := &build.PackageBuild{
-		Build: &build.Build{
-			SigningKey:        o.Key,
-			SigningPassphrase: "",
+	cmd := &cobra.Command{
+		Use:   "re-sign DIR...",
+		Short: "Re-sign the packages and the index of a repository with a new key",
+		Long: `Re-sign the packages and the index of a repository with a new key.
+
+Replaces the signature of every apk in each repository, and then the signature
+of its APKINDEX.tar.gz, with one made with the signing key.  The packages are
+not rebuilt: only their signature changes, so their index entries stay valid.
+
+This rotates the key of an existing repository.  Clients only trust the
+repository again once they have the new public key.`,
+		Example: `  melange re-sign --signing-key melange-2024.rsa --arch x86_64,aarch64 ./packages`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ReSignCmd(cmd.Context(), signingKey, passphrase, archs, args...)
 		},
 	}
 
-	cdata, err := os.ReadFile(eapk.ControlFile)
-	if err != nil {
-		return err
-	}
+	cmd.Flags().StringVar(&signingKey, "signing-key", "melange.rsa", "the signing key to use")
+	cmd.Flags().StringVar(&passphrase, "signing-passphrase", "", "the passphrase of the signing key, if it is encrypted")
+	cmd.Flags().StringSliceVar(&archs, "arch", nil, "architectures to re-sign, each in its own subdirectory of DIR")
 
-	sigData, err := build.EmitSignature(ctx, pc.Signer(), cdata, cfinfo.ModTime())
-	if err != nil {
-		return err
-	}
+	return cmd
+}
 
-	df, err := os.Open(eapk.PackageFile)
-	if err != nil {
-		return err
-	}
-	defer df.Close()
+// ReSignCmd is the backend implementation of the "melange re-sign" command.
+func ReSignCmd(ctx context.Context, signingKey, passphrase string, archs []string, dirs ...string) error {
+	log := clog.FromContext(ctx)
 
-	// Replace the package file with the new one
-	f, err := os.Create(pkg)
-	if err != nil {
-		return err
+	if len(archs) == 0 {
+		archs = []string{""}
 	}
-	defer f.Close()
 
-	for _, fp := range []io.Reader{bytes.NewBuffer(sigData), cf, df} {
-		if _, err := io.Copy(f, fp); err != nil {
-			return err
+	for _, dir := range dirs {
+		for _, arch := range archs {
+			repo := filepath.Join(dir, arch)
+			res, err := signing.Repository(ctx, repo, signingKey, passphrase)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("re-signed %d packages in %s", len(res.Packages), repo)
+			if res.Index != "" {
+				log.Infof("re-signed %s", filepath.Join(repo, res.Index))
+			}
 		}
 	}
 
@@ -32,6 +32,7 @@ func Test() *cobra.Command {
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
+	var cacheKey string
 	var apkCacheDir string
 	var guestDir string
 	var archstrs []string
@@ -65,6 +66,7 @@ func Test() *cobra.Command {
 				build.WithTestWorkspaceDir(workspaceDir),
 				build.WithTestCacheDir(cacheDir),
 				build.WithTestCacheSource(cacheSource),
+				build.WithTestCacheKey(cacheKey),
 				build.WithTestPackageCacheDir(apkCacheDir),
 				build.WithTestGuestDir(guestDir),
 				build.WithTestExtraKeys(extraKeys),
@@ -102,6 +104,7 @@ func Test() *cobra.Command {
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
+	cmd.Flags().StringVar(&cacheKey, "cache-key", "", "decrypt the objects of the cache bucket with the passphrase at env:NAME, file:PATH or the output of cmd:COMMAND")
 	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
 	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
@@ -112,7 +115,7 @@ func Test() *cobra.Command {
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of test pipelines (sets -x for steps)")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
-	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, attaches stdin with a tty to the pod on failure")
+	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, opens a shell in the build environment, in the working directory of a step which fails")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
 	cmd.Flags().StringSliceVar(&extraTestPackages, "test-package-append", []string{}, "extra packages to install for each of the test environments")
 
@@ -17,6 +17,7 @@ package cli
 import (
 	"github.com/spf13/cobra"
 
+	"chainguard.dev/melange/pkg/cachecrypt"
 	"chainguard.dev/melange/pkg/renovate"
 	"chainguard.dev/melange/pkg/renovate/cache"
 )
@@ -24,6 +25,7 @@ import (
 // UpdateCache is a constructor for a cobra.Command which provides the "melange update-cache" command.
 func UpdateCache() *cobra.Command {
 	var cacheDir string
+	var cacheKey string
 
 	cmd := &cobra.Command{
 		Use:     "update-cache",
@@ -41,9 +43,16 @@ func UpdateCache() *cobra.Command {
 
 			rc := renovate.RenovationContext{Context: rctx}
 
-			cacheRenovator := cache.New(
-				cache.WithCacheDir(cacheDir),
-			)
+			opts := []cache.Option{cache.WithCacheDir(cacheDir)}
+			if cacheKey != "" {
+				key, err := cachecrypt.LoadKey(ctx, cacheKey)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, cache.WithKey(key))
+			}
+
+			cacheRenovator := cache.New(opts...)
 
 			if err := rc.LoadConfig(ctx); err != nil {
 				return err
@@ -53,6 +62,7 @@ func UpdateCache() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "/var/cache/melange", "directory used for cached inputs")
+	cmd.Flags().StringVar(&cacheKey, "cache-key", "", "encrypt the cached inputs with the passphrase at env:NAME, file:PATH or the output of cmd:COMMAND")
 
 	return cmd
 }
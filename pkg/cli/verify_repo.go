@@ -0,0 +1,144 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/verify"
+)
+
+// VerifyRepo is a constructor for a cobra.Command which wraps the VerifyRepoCmd function.
+func VerifyRepo() *cobra.Command {
+	var keys []string
+	var extraIndexes []string
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "verify-repo",
+		Short: "Audit the integrity of a package repository",
+		Long: `Audit the integrity of a package repository.
+
+Checks the index signature, the signature of every package, that the checksum
+and datahash of every package match its contents, that every dependency is
+satisfied, and reports duplicate provides and apk files which are not in the
+index.  A directory may either contain an APKINDEX.tar.gz, or a subdirectory
+with one for each architecture.`,
+		Example: `  melange verify-repo -k melange.rsa.pub ./packages`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return VerifyRepoCmd(cmd.Context(), output, args, keys, extraIndexes)
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&keys, "keyring-append", "k", []string{}, "path to public keys which packages and indexes must be signed with")
+	cmd.Flags().StringSliceVar(&extraIndexes, "index-append", []string{}, "path to indexes of other repositories which may satisfy dependencies")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the JSON report to FILE instead of stdout")
+
+	return cmd
+}
+
+// repositoryDirs returns dir if it contains an index, otherwise each of its
+// subdirectories which does.
+func repositoryDirs(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "APKINDEX.tar.gz")); err == nil {
+		return []string{dir}, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(dir, "*", "APKINDEX.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no APKINDEX.tar.gz found in %s", dir)
+	}
+
+	for i := range dirs {
+		dirs[i] = filepath.Dir(dirs[i])
+	}
+
+	return dirs, nil
+}
+
+// VerifyRepoCmd is the backend implementation of the "melange verify-repo" command.
+func VerifyRepoCmd(ctx context.Context, output string, dirs, keyPaths, extraIndexes []string) error {
+	log := clog.FromContext(ctx)
+
+	keys, err := verify.LoadKeys(keyPaths)
+	if err != nil {
+		return err
+	}
+
+	reports := []*verify.Report{}
+	failed := false
+	for _, arg := range dirs {
+		repos, err := repositoryDirs(arg)
+		if err != nil {
+			return err
+		}
+
+		for _, dir := range repos {
+			r, err := verify.Repository(ctx, dir, verify.WithKeys(keys), verify.WithExtraIndexes(extraIndexes))
+			if err != nil {
+				return fmt.Errorf("verifying %s: %w", dir, err)
+			}
+
+			for _, f := range r.Findings {
+				if f.Severity == verify.SeverityError {
+					log.Errorf("%s: %s: %s %s", dir, f.Check, f.Package, f.Message)
+				} else {
+					log.Warnf("%s: %s: %s %s", dir, f.Check, f.Package, f.Message)
+				}
+			}
+
+			failed = failed || r.Failed()
+			reports = append(reports, r)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating report: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reports); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+
+	if failed {
+		return fmt.Errorf("repository verification failed")
+	}
+
+	return nil
+}
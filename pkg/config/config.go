@@ -12,6 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package config parses melange build configurations.  It does not depend on
+// the build, so that other tools can read the packages a configuration
+// produces, their dependencies and their sources.
+//
+// ParseConfiguration returns a configuration ready to build.  Tools which
+// need the configuration as it is written can use its stages separately:
+// Load decodes a file, Resolve expands its subpackage ranges and substitutes
+// its variables, and Validate checks the result.
 package config
 
 import (
@@ -20,7 +28,9 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -32,10 +42,13 @@ import (
 	apko_types "chainguard.dev/apko/pkg/build/types"
 
 	"github.com/chainguard-dev/clog"
+	"github.com/dustin/go-humanize"
 	"github.com/go-git/go-git/v5"
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
 
+	"chainguard.dev/melange/pkg/cond"
 	linter_defaults "chainguard.dev/melange/pkg/linter/defaults"
 	"chainguard.dev/melange/pkg/util"
 )
@@ -78,6 +91,194 @@ type PackageOption struct {
 	NoDepends bool `json:"no-depends" yaml:"no-depends"`
 	// Optional: Mark this package as not providing any executables
 	NoCommands bool `json:"no-commands" yaml:"no-commands"`
+	// Optional: The directories of the package which are searched for the
+	// commands it provides, which default to bin, sbin, usr/bin and usr/sbin
+	CommandPaths []string `json:"command-paths,omitempty" yaml:"command-paths,omitempty"`
+	// Optional: The directories of the package, besides lib, usr/lib, lib64
+	// and usr/lib64, whose shared objects are provided to other packages
+	LibraryPaths []string `json:"library-paths,omitempty" yaml:"library-paths,omitempty"`
+	// Optional: Patterns of the paths of shared objects which are private to
+	// the package, and not provided even though they are in a library
+	// directory, e.g. usr/lib/libfoo-internal.so.*
+	PrivateLibraries []string `json:"private-libraries,omitempty" yaml:"private-libraries,omitempty"`
+	// Optional: Patterns of the directories of the package which are shipped
+	// even when they are empty, which are otherwise removed
+	KeepDirs []string `json:"keep-dirs,omitempty" yaml:"keep-dirs,omitempty"`
+	// Optional: What to do with insecure or non-portable RPATH and RUNPATH
+	// entries in ELF files: warn (the default) reports them through the rpath
+	// linter, fail fails the build and strip removes them from the files
+	RPath string `json:"rpath,omitempty" yaml:"rpath,omitempty"`
+	// Optional: Rewrites of the RPATH and RUNPATH entries in ELF files, which
+	// are applied before the rpath option.  Each entry is rewritten by the
+	// first rewrite which matches it
+	RPathRewrites []RPathRewrite `json:"rpath-rewrites,omitempty" yaml:"rpath-rewrites,omitempty"`
+	// Optional: Glob patterns of the files which the previous release of the
+	// package shipped and which are no longer shipped on purpose
+	RemovedFiles []string `json:"removed-files,omitempty" yaml:"removed-files,omitempty"`
+	// Optional: Do not install the license files of the sources in
+	// usr/share/licenses
+	NoLicenseFiles bool `json:"no-license-files,omitempty" yaml:"no-license-files,omitempty"`
+	// Optional: What to do with the static libraries and headers of packages
+	// other than -dev and -static ones: warn (the default) reports them
+	// through the static and headers linters, move moves them from the main
+	// package to its -static and -dev subpackages and keep ships them as
+	// they are
+	DevFiles string `json:"dev-files,omitempty" yaml:"dev-files,omitempty"`
+	// Optional: The package ships no files by design, e.g. a meta package
+	// which only carries dependencies.  The empty linter is skipped, and the
+	// build fails if the package ships files
+	Empty bool `json:"empty,omitempty" yaml:"empty,omitempty"`
+	// Optional: The largest installed size of the package, e.g. 100MiB
+	MaxInstalledSize string `json:"max-installed-size,omitempty" yaml:"max-installed-size,omitempty"`
+	// Optional: The largest size of the apk of the package, e.g. 20MiB
+	MaxAPKSize string `json:"max-apk-size,omitempty" yaml:"max-apk-size,omitempty"`
+	// Optional: What to do when the package exceeds max-installed-size or
+	// max-apk-size: fail (the default) fails the build and warn reports it
+	SizeBudget string `json:"size-budget,omitempty" yaml:"size-budget,omitempty"`
+}
+
+// RPathRewrite rewrites the RPATH and RUNPATH entries it matches.
+type RPathRewrite struct {
+	// Required: The regular expression matching whole entries
+	Match string `json:"match" yaml:"match" jsonschema:"required"`
+	// Optional: The entry to replace them with, which may refer to the groups
+	// of the match as $1.  The entries are removed if it is empty
+	Replace string `json:"replace,omitempty" yaml:"replace,omitempty"`
+}
+
+// Regexp returns the regular expression of the rewrite, anchored to match
+// whole entries.
+func (r RPathRewrite) Regexp() (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + r.Match + ")$")
+}
+
+// The policies which may be set with the rpath package option.
+const (
+	RPathPolicyWarn  = "warn"
+	RPathPolicyFail  = "fail"
+	RPathPolicyStrip = "strip"
+)
+
+func validateRPathPolicy(policy string) error {
+	switch policy {
+	case "", RPathPolicyWarn, RPathPolicyFail, RPathPolicyStrip:
+		return nil
+	}
+
+	return fmt.Errorf("rpath option %q must be one of %s, %s or %s", policy, RPathPolicyWarn, RPathPolicyFail, RPathPolicyStrip)
+}
+
+// The policies which may be set with the dev-files package option.
+const (
+	DevFilesPolicyWarn = "warn"
+	DevFilesPolicyMove = "move"
+	DevFilesPolicyKeep = "keep"
+)
+
+func validateDevFilesPolicy(policy string) error {
+	switch policy {
+	case "", DevFilesPolicyWarn, DevFilesPolicyMove, DevFilesPolicyKeep:
+		return nil
+	}
+
+	return fmt.Errorf("dev-files option %q must be one of %s, %s or %s", policy, DevFilesPolicyWarn, DevFilesPolicyMove, DevFilesPolicyKeep)
+}
+
+func validateChecks(chk Checks) error {
+	for name, sev := range chk.Severity {
+		switch sev {
+		case "info", "warning", "error":
+		default:
+			return fmt.Errorf("severity %q of linter %s must be one of info, warning or error", sev, name)
+		}
+	}
+
+	for _, patterns := range [][]string{chk.Paths.MustExist, chk.Paths.MustNotExist, chk.Paths.MustBeExecutable} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("path check %q is not a valid pattern: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// The policies which may be set with the size-budget package option.
+const (
+	SizeBudgetPolicyFail = "fail"
+	SizeBudgetPolicyWarn = "warn"
+)
+
+func validateSizeBudget(opts PackageOption) error {
+	switch opts.SizeBudget {
+	case "", SizeBudgetPolicyFail, SizeBudgetPolicyWarn:
+	default:
+		return fmt.Errorf("size-budget option %q must be one of %s or %s", opts.SizeBudget, SizeBudgetPolicyFail, SizeBudgetPolicyWarn)
+	}
+
+	for _, o := range []struct{ option, size string }{
+		{"max-installed-size", opts.MaxInstalledSize},
+		{"max-apk-size", opts.MaxAPKSize},
+	} {
+		if o.size == "" {
+			continue
+		}
+		if _, err := humanize.ParseBytes(o.size); err != nil {
+			return fmt.Errorf("%s option %q must be a size, e.g. 100MiB: %w", o.option, o.size, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePackagePaths validates the directories of a package which an
+// option names, which are relative to its root.
+func validatePackagePaths(what string, paths []string) error {
+	for _, p := range paths {
+		if p == "" || p == "." || path.IsAbs(p) || path.Clean(p) != strings.TrimSuffix(p, "/") || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("%s %q must be a clean path relative to the root of the package, e.g. usr/libexec/foo", what, p)
+		}
+	}
+
+	return nil
+}
+
+func validatePackageOptionPaths(opts PackageOption) error {
+	if err := validatePackagePaths("command path", opts.CommandPaths); err != nil {
+		return err
+	}
+
+	if err := validatePackagePaths("library path", opts.LibraryPaths); err != nil {
+		return err
+	}
+
+	for _, pattern := range opts.PrivateLibraries {
+		if _, err := path.Match(pattern, ""); err != nil || path.IsAbs(pattern) {
+			return fmt.Errorf("private library %q must be a pattern of paths relative to the root of the package", pattern)
+		}
+	}
+
+	for _, pattern := range opts.KeepDirs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("kept directory %q must be a pattern of the directories of the package: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRPathRewrites(rewrites []RPathRewrite) error {
+	for _, r := range rewrites {
+		if r.Match == "" {
+			return fmt.Errorf("rpath-rewrites entries require a match")
+		}
+		if _, err := r.Regexp(); err != nil {
+			return fmt.Errorf("rpath-rewrites match %q does not compile into a regex: %w", r.Match, err)
+		}
+	}
+
+	return nil
 }
 
 type Checks struct {
@@ -85,13 +286,31 @@ type Checks struct {
 	Enabled []string `json:"enabled,omitempty" yaml:"enabled,omitempty"`
 	// Optional: disable these linters that are not enabled by default.
 	Disabled []string `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	// Optional: override the severity of linters: info, which is reported
+	// and never fails the build, warning, or error, which fails the build.
+	Severity map[string]string `json:"severity,omitempty" yaml:"severity,omitempty"`
+	// Optional: assertions on the paths of the package, which are checked
+	// before it is emitted
+	Paths PathChecks `json:"paths,omitempty" yaml:"paths,omitempty"`
+}
+
+// PathChecks are assertions on the paths of a package, as glob patterns
+// relative to its root such as usr/lib/libfoo.so.*
+type PathChecks struct {
+	// Optional: patterns each of which must match a path of the package
+	MustExist []string `json:"must-exist,omitempty" yaml:"must-exist,omitempty"`
+	// Optional: patterns which must not match any path of the package
+	MustNotExist []string `json:"must-not-exist,omitempty" yaml:"must-not-exist,omitempty"`
+	// Optional: patterns each of which must match a path of the package,
+	// all of whose matches must be executable files
+	MustBeExecutable []string `json:"must-be-executable,omitempty" yaml:"must-be-executable,omitempty"`
 }
 
 type Package struct {
 	// The name of the package
-	Name string `json:"name" yaml:"name"`
+	Name string `json:"name" yaml:"name" jsonschema:"required"`
 	// The version of the package
-	Version string `json:"version" yaml:"version"`
+	Version string `json:"version" yaml:"version" jsonschema:"required"`
 	// The monotone increasing epoch of the package
 	Epoch uint64 `json:"epoch" yaml:"epoch"`
 	// A human readable description of the package
@@ -100,6 +319,13 @@ type Package struct {
 	URL string `json:"url,omitempty" yaml:"url,omitempty"`
 	// Optional: The git commit of the package build configuration
 	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// Optional: The maintainer of the package and its subpackages, e.g.
+	// Jane Doe <jane@example.com>
+	Maintainer string `json:"maintainer,omitempty" yaml:"maintainer,omitempty"`
+	// Optional: A conditional statement to evaluate for the package, e.g.
+	// against ${{build.arch}}.  Where it is false, the package is neither
+	// built nor tested
+	If string `json:"if,omitempty" yaml:"if,omitempty"`
 	// List of target architectures for which this package should be build for
 	TargetArchitecture []string `json:"target-architecture,omitempty" yaml:"target-architecture,omitempty"`
 	// The list of copyrights for this package
@@ -113,11 +339,34 @@ type Package struct {
 	Scriptlets Scriptlets `json:"scriptlets,omitempty" yaml:"scriptlets,omitempty"`
 	// Optional: enabling, disabling, and configuration of build checks
 	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
+	// Optional: The owners of files of the package, which replace the ones
+	// the files have in the workspace, e.g. for rootless builds which cannot
+	// change them
+	Owners []FileOwner `json:"owners,omitempty" yaml:"owners,omitempty"`
+	// Optional: Extra key = value pairs to write in the .PKGINFO of the
+	// package and its subpackages, for custom apk tooling.  The keys melange
+	// and apk use are reserved
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
 
 	// Optional: The amount of time to allow this build to take before timing out.
-	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" jsonschema:"oneof_type=string;integer"`
 	// Optional: Resources to allocate to the build.
 	Resources *Resources `json:"resources,omitempty" yaml:"resources,omitempty"`
+	// Optional: Overrides for name resolution inside the build environment.
+	Resolver *Resolver `json:"resolver,omitempty" yaml:"resolver,omitempty"`
+}
+
+// FileOwner gives a file of a package its owner, as chown would in the build
+// environment.
+type FileOwner struct {
+	// Required: The absolute path of the file in the package
+	Path string `json:"path" yaml:"path" jsonschema:"required"`
+	// Optional: The user owning the file, as a name of the build environment
+	// or a numeric ID
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// Optional: The group owning the file, as a name of the build environment
+	// or a numeric ID
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
 }
 
 type Resources struct {
@@ -125,6 +374,17 @@ type Resources struct {
 	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
 }
 
+type Resolver struct {
+	// Optional: The nameservers to use in the build environment instead of
+	// the ones configured on the host.
+	Nameservers []string `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
+	// Optional: The DNS search domains to use in the build environment.
+	Search []string `json:"search,omitempty" yaml:"search,omitempty"`
+	// Optional: Static entries to add to /etc/hosts in the build environment,
+	// mapping a hostname to an IP address.
+	Hosts map[string]string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+}
+
 // PackageURL returns the package URL ("purl") for the package. For more
 // information, see https://github.com/package-url/purl-spec#purl.
 func (p Package) PackageURL(distro string) string {
@@ -202,6 +462,65 @@ func (cfg *Configuration) applySubstitutionsForReplaces() error {
 	return nil
 }
 
+func (cfg *Configuration) applySubstitutionsForInstallIf() error {
+	nw := buildConfigMap(cfg)
+	for i, dep := range cfg.Package.Dependencies.InstallIf {
+		var err error
+		cfg.Package.Dependencies.InstallIf[i], err = util.MutateStringFromMap(nw, dep)
+		if err != nil {
+			return fmt.Errorf("failed to apply replacement to install-if %q: %w", dep, err)
+		}
+	}
+	for _, srt := range cfg.Subpackages {
+		for i, dep := range srt.Dependencies.InstallIf {
+			var err error
+			srt.Dependencies.InstallIf[i], err = util.MutateStringFromMap(nw, dep)
+			if err != nil {
+				return fmt.Errorf("failed to apply replacement to install-if %q: %w", dep, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pinInstallIf pins install-if entries which name a package built from this
+// configuration without a version to the version being built, so that an
+// integration subpackage is only installed alongside the matching build of
+// its parent.
+func (cfg *Configuration) pinInstallIf() {
+	built := map[string]bool{cfg.Package.Name: true}
+	for _, sp := range cfg.Subpackages {
+		built[sp.Name] = true
+	}
+
+	pin := func(deps []string) {
+		for i, dep := range deps {
+			if built[dep] {
+				version, epoch := cfg.VersionOf(dep)
+				deps[i] = fmt.Sprintf("%s=%s-r%d", dep, version, epoch)
+			}
+		}
+	}
+
+	pin(cfg.Package.Dependencies.InstallIf)
+	for _, sp := range cfg.Subpackages {
+		pin(sp.Dependencies.InstallIf)
+	}
+}
+
+func validateInstallIf(name string, deps []string) error {
+	for _, dep := range deps {
+		if dep == "" {
+			return fmt.Errorf("package %q has an empty install-if entry", name)
+		}
+		if util.DependencyName(dep) == name {
+			return fmt.Errorf("package %q cannot be installed if it is installed itself", name)
+		}
+	}
+
+	return nil
+}
+
 func (cfg *Configuration) applySubstitutionsForPackages() error {
 	nw := buildConfigMap(cfg)
 	for i, runtime := range cfg.Environment.Contents.Packages {
@@ -322,6 +641,42 @@ type Pipeline struct {
 	WorkDir string `json:"working-directory,omitempty" yaml:"working-directory,omitempty"`
 	// Optional: environment variables to override the apko environment
 	Environment map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// Optional: Whether the pipeline has network access, which its nested
+	// pipelines inherit.  Build pipelines have none unless they set it
+	Network *bool `json:"network,omitempty" yaml:"network,omitempty"`
+	// Optional: The amount of time to allow the pipeline, including its
+	// nested pipelines, to take before timing out.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty" jsonschema:"oneof_type=string;integer"`
+	// Optional: Limits on the resources of the steps of the pipeline, which
+	// its nested pipelines inherit unless they set their own.
+	Limits *Limits `json:"limits,omitempty" yaml:"limits,omitempty"`
+	// Optional: How many times the commands of the steps of the pipeline
+	// are retried when they fail, with a growing delay in between, which
+	// its nested pipelines inherit unless they set their own.
+	Retries int `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// Optional: The failures which are retried.  Every failure is retried
+	// if it is not set.
+	RetryOn *RetryOn `json:"retry-on,omitempty" yaml:"retry-on,omitempty"`
+}
+
+// RetryOn selects the failures of a step which are retried: those which
+// exit with one of the exit codes, or whose output matches the regular
+// expression.
+type RetryOn struct {
+	// Optional: The exit codes of the failures to retry
+	ExitCodes []int `json:"exit-codes,omitempty" yaml:"exit-codes,omitempty"`
+	// Optional: A regular expression matching a line of the output of the
+	// failures to retry
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+}
+
+// Limits are enforced on each process of a step with rlimits, so that they
+// hold with every runner.
+type Limits struct {
+	// Optional: The memory each process may allocate, e.g. 4Gi
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	// Optional: The CPU time each process may use
+	CPUTime time.Duration `json:"cpu-time,omitempty" yaml:"cpu-time,omitempty" jsonschema:"oneof_type=string;integer"`
 }
 
 type Subpackage struct {
@@ -330,9 +685,25 @@ type Subpackage struct {
 	// Optional: The iterable used to generate multiple subpackages
 	Range string `json:"range,omitempty" yaml:"range,omitempty"`
 	// Required: Name of the subpackage
-	Name string `json:"name" yaml:"name"`
+	Name string `json:"name" yaml:"name" jsonschema:"required"`
+	// Optional: The version of the subpackage, which replaces the one of the
+	// package, e.g. for a compat package which provides the soname of an
+	// older release.  Subpackages have the version of the package otherwise.
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// Optional: The epoch of the subpackage, which may only be set along
+	// with its version
+	Epoch uint64 `json:"epoch,omitempty" yaml:"epoch,omitempty"`
 	// Optional: The list of pipelines that produce subpackage.
 	Pipeline []Pipeline `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+	// Optional: A manifest of glob patterns, relative to the main package, of
+	// the files which make up this subpackage. Matching files are moved out of
+	// the main package after all pipelines have run. Every pattern must match
+	// at least one file, and no file may be claimed by more than one
+	// subpackage. A "**" path segment matches any number of directories.
+	Files []string `json:"files,omitempty" yaml:"files,omitempty"`
+	// Optional: Symlinks from legacy paths which make this subpackage a
+	// compat package of the main package.
+	Compat Compat `json:"compat,omitempty" yaml:"compat,omitempty"`
 	// Optional: List of packages to depend on
 	Dependencies Dependencies `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
 	// Optional: Options that alter the packages behavior
@@ -340,16 +711,235 @@ type Subpackage struct {
 	Scriptlets Scriptlets    `json:"scriptlets,omitempty" yaml:"scriptlets,omitempty"`
 	// Optional: The human readable description of the subpackage
 	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Optional: The copyrights of the subpackage, which replace the ones of
+	// the package, e.g. for documentation under another license
+	Copyright []Copyright `json:"copyright,omitempty" yaml:"copyright,omitempty"`
 	// Optional: The URL to the package's homepage
 	URL string `json:"url,omitempty" yaml:"url,omitempty"`
 	// Optional: The git commit of the subpackage build configuration
 	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
 	// Optional: enabling, disabling, and configuration of build checks
 	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
+	// Optional: The owners of files of the subpackage, which replace the ones
+	// the files have in the workspace
+	Owners []FileOwner `json:"owners,omitempty" yaml:"owners,omitempty"`
 	// Test section for the subpackage.
 	Test Test `json:"test,omitempty" yaml:"test,omitempty"`
 }
 
+// Compat declares the symlinks of a compat subpackage, which keeps legacy
+// paths working, e.g. /usr/bin/python pointing at python3.  The subpackage
+// depends on the main package at the same version, and provides and replaces
+// what it needs to, so the metadata is not written by hand.
+type Compat struct {
+	// Required: The symlinks which make up the subpackage
+	Links []CompatLink `json:"links,omitempty" yaml:"links,omitempty"`
+}
+
+type CompatLink struct {
+	// Required: The absolute legacy path of the symlink
+	Path string `json:"path" yaml:"path" jsonschema:"required"`
+	// Required: What the symlink points at, either an absolute path or one
+	// relative to the directory of the symlink
+	Target string `json:"target" yaml:"target" jsonschema:"required"`
+}
+
+// compatBinDirs are the directories whose symlinks provide commands.
+var compatBinDirs = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
+
+// applyCompat adds the dependencies of a compat subpackage: it depends on the
+// main package at the same version, provides the commands of its links, and
+// replaces the main package, which may have shipped the legacy paths itself.
+func (sp *Subpackage) applyCompat(origin string, r *strings.Replacer) {
+	if len(sp.Compat.Links) == 0 {
+		return
+	}
+
+	links := make([]CompatLink, len(sp.Compat.Links))
+	for i, l := range sp.Compat.Links {
+		links[i] = CompatLink{Path: r.Replace(l.Path), Target: r.Replace(l.Target)}
+	}
+	sp.Compat.Links = links
+
+	add := func(deps []string, dep string) []string {
+		if slices.Contains(deps, dep) {
+			return deps
+		}
+		return append(deps, dep)
+	}
+
+	version := SubstitutionPackageFullVersion
+	sp.Dependencies.Runtime = add(sp.Dependencies.Runtime, origin+"="+version)
+	sp.Dependencies.Replaces = add(sp.Dependencies.Replaces, origin)
+	for _, l := range links {
+		if slices.Contains(compatBinDirs, path.Dir(l.Path)) {
+			sp.Dependencies.Provides = add(sp.Dependencies.Provides, "cmd:"+path.Base(l.Path)+"="+version)
+		}
+	}
+}
+
+func validateCompat(c Compat) error {
+	paths := map[string]bool{}
+	for _, l := range c.Links {
+		if !path.IsAbs(l.Path) || path.Clean(l.Path) != l.Path || l.Path == "/" {
+			return fmt.Errorf("compat link path %q must be a clean absolute path", l.Path)
+		}
+		if l.Target == "" {
+			return fmt.Errorf("compat link %q has no target", l.Path)
+		}
+		if paths[l.Path] {
+			return fmt.Errorf("compat link %q is declared more than once", l.Path)
+		}
+		paths[l.Path] = true
+	}
+
+	return nil
+}
+
+// subpackageVersionRegex matches the versions apk compares, without the
+// epoch, which is declared on its own.
+var subpackageVersionRegex = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*[a-z]?(_(alpha|beta|pre|rc)[0-9]*)?(_(cvs|svn|git|hg|p)[0-9]*)?$`)
+
+func validateSubpackageVersion(sp Subpackage) error {
+	if sp.Version == "" {
+		if sp.Epoch != 0 {
+			return fmt.Errorf("epoch %d requires a version of the subpackage", sp.Epoch)
+		}
+		return nil
+	}
+	if !subpackageVersionRegex.MatchString(sp.Version) {
+		return fmt.Errorf("version %q is not a valid apk version", sp.Version)
+	}
+
+	return nil
+}
+
+// VersionOf returns the version and the epoch of the package built as name,
+// which are the ones of the subpackage of that name if it has its own, and
+// the ones of the package otherwise.
+func (cfg Configuration) VersionOf(name string) (string, uint64) {
+	for _, sp := range cfg.Subpackages {
+		if sp.Name == name && sp.Version != "" {
+			return sp.Version, sp.Epoch
+		}
+	}
+
+	return cfg.Package.Version, cfg.Package.Epoch
+}
+
+func validateOwners(owners []FileOwner) error {
+	paths := map[string]bool{}
+	for _, o := range owners {
+		if !path.IsAbs(o.Path) || path.Clean(o.Path) != o.Path || o.Path == "/" {
+			return fmt.Errorf("owner path %q must be a clean absolute path", o.Path)
+		}
+		if o.User == "" && o.Group == "" {
+			return fmt.Errorf("owner of %q has neither a user nor a group", o.Path)
+		}
+		if paths[o.Path] {
+			return fmt.Errorf("owner of %q is declared more than once", o.Path)
+		}
+		paths[o.Path] = true
+	}
+
+	return nil
+}
+
+// The points of the lifecycle of a build which hooks run at.
+const (
+	HookPreBuild  = "pre-build"
+	HookPostBuild = "post-build"
+	HookPreEmit   = "pre-emit"
+	HookPostEmit  = "post-emit"
+)
+
+// HookPoints are the points of the lifecycle of a build which hooks run at.
+var HookPoints = []string{HookPreBuild, HookPostBuild, HookPreEmit, HookPostEmit}
+
+// Hook is a command run on the host at a point of the lifecycle of the build.
+type Hook struct {
+	// Required: The point of the lifecycle the hook runs at: pre-build,
+	// post-build, pre-emit or post-emit
+	On string `json:"on" yaml:"on"`
+	// Required: The command run with sh -c, with the context of the hook as
+	// JSON on its standard input
+	Runs string `json:"runs" yaml:"runs"`
+}
+
+// Secret declares a secret of the build, whose value is given with --secret
+// and masked in the output of the build.
+type Secret struct {
+	// Required: The name of the secret, which is the name of the environment
+	// variable holding it, or of its file in /run/secrets
+	Name string `json:"name" yaml:"name" jsonschema:"required"`
+	// Optional: Whether the secret is a file in /run/secrets, e.g. a .netrc,
+	// rather than an environment variable
+	File bool `json:"file,omitempty" yaml:"file,omitempty"`
+	// Optional: Whether the build runs without the secret when it is not
+	// given
+	Optional bool `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+// secretName is what the names of secrets are made of, so that they are
+// valid both as environment variables and as file names.
+var secretName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateSecrets(secrets []Secret) error {
+	seen := map[string]bool{}
+	for _, s := range secrets {
+		if !secretName.MatchString(s.Name) {
+			return fmt.Errorf("secret name %q must be letters, digits and underscores, not starting with a digit", s.Name)
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("secret %s is declared more than once", s.Name)
+		}
+		seen[s.Name] = true
+	}
+
+	return nil
+}
+
+// ReservedMetadataKeys are the keys of .PKGINFO which melange or apk use,
+// and which the metadata of a package may not set.
+var ReservedMetadataKeys = []string{
+	"arch", "builddate", "commit", "datahash", "depend", "install_if",
+	"license", "maintainer", "origin", "packager", "pkgdesc", "pkgname",
+	"pkgver", "provider_priority", "provides", "replaces",
+	"replaces_priority", "size", "triggers", "url",
+}
+
+// metadataKey is what the keys of .PKGINFO are made of.
+var metadataKey = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+func validateMetadata(metadata map[string]string) error {
+	for k, v := range metadata {
+		if !metadataKey.MatchString(k) {
+			return fmt.Errorf("metadata key %q must be lowercase letters, digits, underscores and dashes", k)
+		}
+		if slices.Contains(ReservedMetadataKeys, k) {
+			return fmt.Errorf("metadata key %q is reserved", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("metadata %s must be a single line", k)
+		}
+	}
+
+	return nil
+}
+
+func validateHooks(hooks []Hook) error {
+	for _, h := range hooks {
+		if !slices.Contains(HookPoints, h.On) {
+			return fmt.Errorf("hook on %q must be one of %s", h.On, strings.Join(HookPoints, ", "))
+		}
+		if h.Runs == "" {
+			return fmt.Errorf("%s hook has no command", h.On)
+		}
+	}
+
+	return nil
+}
+
 // PackageURL returns the package URL ("purl") for the subpackage. For more
 // information, see https://github.com/package-url/purl-spec#purl.
 func (spkg Subpackage) PackageURL(distro, packageVersionWithRelease string) string {
@@ -380,7 +970,7 @@ type Input struct {
 // The root melange configuration
 type Configuration struct {
 	// Package metadata
-	Package Package `json:"package" yaml:"package"`
+	Package Package `json:"package" yaml:"package" jsonschema:"required"`
 	// The specification for the packages build environment
 	Environment apko_types.ImageConfiguration `json:"environment" yaml:"environment"`
 	// Required: The list of pipelines that produce the package.
@@ -393,19 +983,31 @@ type Configuration struct {
 	// Optional: The update block determining how this package is auto updated
 	Update Update `json:"update,omitempty" yaml:"update,omitempty"`
 	// Optional: A map of arbitrary variables that can be used via templating in
-	// the pipeline
+	// the pipeline, the package metadata and the subpackages.  They may refer
+	// to each other, the package and the environment as ${{env.NAME}}
 	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
 	// Optional: A list of transformations to create for the builtin template
 	// variables
 	VarTransforms []VarTransforms `json:"var-transforms,omitempty" yaml:"var-transforms,omitempty"`
 	// Optional: Deviations to the build
 	Options map[string]BuildOption `json:"options,omitempty" yaml:"options,omitempty"`
+	// Optional: Commands run on the host at points of the lifecycle of the
+	// build, which are only run if the build is run with --config-hooks
+	Hooks []Hook `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+	// Optional: The secrets the build needs, such as the tokens of private
+	// source repositories.  Their values are never part of the
+	// configuration: they are given to the build with --secret
+	Secrets []Secret `json:"secrets,omitempty" yaml:"secrets,omitempty"`
 
 	// Test section for the main package.
 	Test Test `json:"test,omitempty" yaml:"test,omitempty"`
 
 	// Parsed AST for this configuration
 	root *yaml.Node
+	// The path the configuration was loaded from, for errors
+	path string
+	// Whether Resolve has been applied
+	resolved bool
 }
 
 type Test struct {
@@ -428,15 +1030,15 @@ type VarTransforms struct {
 	// Required: The original template variable.
 	//
 	// Example: ${{package.version}}
-	From string `json:"from" yaml:"from"`
+	From string `json:"from" yaml:"from" jsonschema:"required"`
 	// Required: The regular expression to match against the `from` variable
-	Match string `json:"match" yaml:"match"`
+	Match string `json:"match" yaml:"match" jsonschema:"required"`
 	// Required: The repl to replace on all `match` matches
-	Replace string `json:"replace" yaml:"replace"`
+	Replace string `json:"replace" yaml:"replace" jsonschema:"required"`
 	// Required: The name of the new variable to create
 	//
 	// Example: mangeled-package-version
-	To string `json:"to" yaml:"to"`
+	To string `json:"to" yaml:"to" jsonschema:"required"`
 }
 
 // Update provides information used to describe how to keep the package up to date
@@ -457,6 +1059,9 @@ type Update struct {
 	ReleaseMonitor *ReleaseMonitor `json:"release-monitor,omitempty" yaml:"release-monitor,omitempty"`
 	// The configuration block for updates tracked via the Github API
 	GitHubMonitor *GitHubMonitor `json:"github,omitempty" yaml:"github,omitempty"`
+	// The configuration block for updates tracked via the tags of a git
+	// repository
+	GitMonitor *GitMonitor `json:"git,omitempty" yaml:"git,omitempty"`
 	// The configuration block for transforming the `package.version` into an APK version
 	VersionTransform []VersionTransform `json:"version-transform,omitempty" yaml:"version-transform,omitempty"`
 }
@@ -464,7 +1069,7 @@ type Update struct {
 // ReleaseMonitor indicates using the API for https://release-monitoring.org/
 type ReleaseMonitor struct {
 	// Required: ID number for release monitor
-	Identifier int `json:"identifier" yaml:"identifier"`
+	Identifier int `json:"identifier" yaml:"identifier" jsonschema:"required"`
 	// If the version in release monitor contains a prefix which should be ignored
 	StripPrefix string `json:"strip-prefix,omitempty" yaml:"strip-prefix,omitempty"`
 	// If the version in release monitor contains a suffix which should be ignored
@@ -474,7 +1079,7 @@ type ReleaseMonitor struct {
 // GitHubMonitor indicates using the GitHub API
 type GitHubMonitor struct {
 	// Org/repo for GitHub
-	Identifier string `json:"identifier" yaml:"identifier"`
+	Identifier string `json:"identifier" yaml:"identifier" jsonschema:"required"`
 	// If the version in GitHub contains a prefix which should be ignored
 	StripPrefix string `json:"strip-prefix,omitempty" yaml:"strip-prefix,omitempty"`
 	// If the version in GitHub contains a suffix which should be ignored
@@ -491,17 +1096,31 @@ type GitHubMonitor struct {
 	UseTags bool `json:"use-tag,omitempty" yaml:"use-tag,omitempty"`
 }
 
+// GitMonitor indicates using the tags of a git repository
+type GitMonitor struct {
+	// Optional: The repository, which defaults to the repository of the
+	// git-checkout step of the pipeline
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty"`
+	// Optional: A regular expression which the tags which are releases
+	// match.  If it has a capture group, the first one is the version
+	TagRegex string `json:"tag-regex,omitempty" yaml:"tag-regex,omitempty"`
+	// If the version in the tags contains a prefix which should be ignored
+	StripPrefix string `json:"strip-prefix,omitempty" yaml:"strip-prefix,omitempty"`
+	// If the version in the tags contains a suffix which should be ignored
+	StripSuffix string `json:"strip-suffix,omitempty" yaml:"strip-suffix,omitempty"`
+}
+
 // VersionTransform allows mapping the package version to an APK version
 type VersionTransform struct {
 	// Required: The regular expression to match against the `package.version` variable
-	Match string `json:"match" yaml:"match"`
+	Match string `json:"match" yaml:"match" jsonschema:"required"`
 	// Required: The repl to replace on all `match` matches
-	Replace string `json:"replace" yaml:"replace"`
+	Replace string `json:"replace" yaml:"replace" jsonschema:"required"`
 }
 
 type RangeData struct {
-	Name  string    `json:"name" yaml:"name"`
-	Items DataItems `json:"items" yaml:"items"`
+	Name  string    `json:"name" yaml:"name" jsonschema:"required"`
+	Items DataItems `json:"items" yaml:"items" jsonschema:"required"`
 }
 
 type DataItems map[string]string
@@ -516,6 +1135,12 @@ type Dependencies struct {
 	// Optional: An integer compared against other equal package provides used to
 	// determine priority
 	ProviderPriority int `json:"provider-priority,omitempty" yaml:"provider-priority,omitempty"`
+	// Optional: An integer used to determine which package owns a file when
+	// several packages replace each other
+	ReplacesPriority int `json:"replaces-priority,omitempty" yaml:"replaces-priority,omitempty"`
+	// Optional: List of packages which, when all of them are installed, cause
+	// this package to be installed automatically
+	InstallIf []string `json:"install-if,omitempty" yaml:"install-if,omitempty"`
 
 	// List of self-provided dependencies found outside of lib directories
 	// ("lib", "usr/lib", "lib64", or "usr/lib64").
@@ -588,7 +1213,8 @@ func detectCommit(ctx context.Context, dirPath string) string {
 	// Best-effort detection of current commit, to be used when not specified in the config file
 
 	// TODO: figure out how to use an abstract FS
-	repo, err := git.PlainOpen(dirPath)
+	// The configuration may be in a subdirectory of the repository.
+	repo, err := git.PlainOpenWithOptions(dirPath, &git.PlainOpenOptions{DetectDotGit: true})
 	if err != nil {
 		log.Debugf("unable to detect git commit for build configuration: %v", err)
 		return ""
@@ -604,19 +1230,13 @@ func detectCommit(ctx context.Context, dirPath string) string {
 }
 
 // buildConfigMap builds a map used to prepare a replacer for variable substitution.
+// The variables which cannot be resolved when parsing the configuration,
+// e.g. because they refer to the build architecture, are left out.
 func buildConfigMap(cfg *Configuration) map[string]string {
-	out := map[string]string{
-		SubstitutionPackageName:        cfg.Package.Name,
-		SubstitutionPackageVersion:     cfg.Package.Version,
-		SubstitutionPackageDescription: cfg.Package.Description,
-		SubstitutionPackageEpoch:       strconv.FormatUint(cfg.Package.Epoch, 10),
-		SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%d", cfg.Package.Version, cfg.Package.Epoch),
-	}
+	out := packageSubstitutions(cfg)
 
-	for k, v := range cfg.Vars {
-		nk := fmt.Sprintf("${{vars.%s}}", k)
-		out[nk] = v
-	}
+	// Leniently, so errors are only reported for the variables in use.
+	_ = newVariables(cfg, out, true).resolve(out, true)
 
 	return out
 }
@@ -640,6 +1260,78 @@ func replaceAll(r *strings.Replacer, in []string) []string {
 	return out
 }
 
+// expandRange returns the subpackage generated for an item of its range,
+// with the range references of its strings replaced by r.
+func (sp Subpackage) expandRange(r *strings.Replacer) Subpackage {
+	out := sp
+	out.Range = ""
+	out.If = r.Replace(sp.If)
+	out.Name = r.Replace(sp.Name)
+	out.Version = r.Replace(sp.Version)
+	out.Description = r.Replace(sp.Description)
+	out.URL = r.Replace(sp.URL)
+	out.Files = replaceAll(r, sp.Files)
+	if sp.Compat.Links != nil {
+		out.Compat.Links = make([]CompatLink, len(sp.Compat.Links))
+		for i, l := range sp.Compat.Links {
+			out.Compat.Links[i] = CompatLink{Path: r.Replace(l.Path), Target: r.Replace(l.Target)}
+		}
+	}
+	out.Dependencies.Runtime = replaceAll(r, sp.Dependencies.Runtime)
+	out.Dependencies.Provides = replaceAll(r, sp.Dependencies.Provides)
+	out.Dependencies.Replaces = replaceAll(r, sp.Dependencies.Replaces)
+	out.Dependencies.InstallIf = replaceAll(r, sp.Dependencies.InstallIf)
+
+	out.Scriptlets.Trigger.Script = r.Replace(sp.Scriptlets.Trigger.Script)
+	out.Scriptlets.Trigger.Paths = replaceAll(r, sp.Scriptlets.Trigger.Paths)
+	out.Scriptlets.PreInstall = r.Replace(sp.Scriptlets.PreInstall)
+	out.Scriptlets.PostInstall = r.Replace(sp.Scriptlets.PostInstall)
+	out.Scriptlets.PreDeinstall = r.Replace(sp.Scriptlets.PreDeinstall)
+	out.Scriptlets.PostDeinstall = r.Replace(sp.Scriptlets.PostDeinstall)
+	out.Scriptlets.PreUpgrade = r.Replace(sp.Scriptlets.PreUpgrade)
+	out.Scriptlets.PostUpgrade = r.Replace(sp.Scriptlets.PostUpgrade)
+
+	out.Pipeline = replacePipelines(r, sp.Pipeline)
+	out.Test.Pipeline = replacePipelines(r, sp.Test.Pipeline)
+	out.Test.Environment.Contents.Packages = replaceAll(r, sp.Test.Environment.Contents.Packages)
+
+	return out
+}
+
+// replacePipelines returns copies of the pipelines, and of the pipelines
+// nested in them, with their strings replaced by r.
+func replacePipelines(r *strings.Replacer, in []Pipeline) []Pipeline {
+	if in == nil {
+		return nil
+	}
+	out := make([]Pipeline, len(in))
+	for i, p := range in {
+		p.Name = r.Replace(p.Name)
+		p.Uses = r.Replace(p.Uses)
+		p.Runs = r.Replace(p.Runs)
+		p.If = r.Replace(p.If)
+		p.WorkDir = r.Replace(p.WorkDir)
+		p.With = replaceValues(r, p.With)
+		p.Environment = replaceValues(r, p.Environment)
+		p.Pipeline = replacePipelines(r, p.Pipeline)
+		out[i] = p
+	}
+	return out
+}
+
+// replaceValues returns a copy of the map with its values replaced by r.
+func replaceValues(r *strings.Replacer, in map[string]string) map[string]string {
+	// if the map is empty, leave it nil to avoid serializing an empty map
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = r.Replace(v)
+	}
+	return out
+}
+
 // propagateChildPipelines performs downward propagation of configuration values.
 func (p *Pipeline) propagateChildPipelines() {
 	for idx := range p.Pipeline {
@@ -668,9 +1360,39 @@ func (cfg *Configuration) propagatePipelines() {
 }
 
 // ParseConfiguration returns a decoded build Configuration using the parsing options provided.
+// It is Load, Resolve and Validate in turn.
 func ParseConfiguration(ctx context.Context, configurationFilePath string, opts ...ConfigurationParsingOption) (*Configuration, error) {
+	cfg, err := Load(ctx, configurationFilePath, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Resolve(opts...); err != nil {
+		return nil, err
+	}
+
+	// Finally, validate the configuration we ended up with before returning it for use downstream.
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("validating configuration %q: %w", cfg.Package.Name, err)
+	}
+
+	// The licenses are only checked by builds which fail on unknown
+	// licenses, so the others just warn about them.
+	if err := cfg.ValidateLicenses(); err != nil {
+		clog.FromContext(ctx).Warnf("%s: %v", configurationFilePath, err)
+	}
+
+	return cfg, nil
+}
+
+// Load decodes the configuration at configurationFilePath and checks it
+// against the schema.  Its subpackage ranges are not expanded and its
+// variables are not substituted until it is resolved.  Packages without a
+// commit get the commit of the git checkout the file is in, if any.
+func Load(ctx context.Context, configurationFilePath string, opts ...ConfigurationParsingOption) (*Configuration, error) {
 	options := &configOptions{}
 	configurationDirPath := filepath.Dir(configurationFilePath)
+	displayPath := configurationFilePath
 	options.include(opts...)
 
 	if options.filesystem == nil {
@@ -692,7 +1414,7 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 
 	root := yaml.Node{}
 
-	cfg := Configuration{root: &root}
+	cfg := Configuration{root: &root, path: configurationFilePath}
 
 	// Unmarshal into a node first
 	decoderNode := yaml.NewDecoder(f)
@@ -701,6 +1423,12 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		return nil, fmt.Errorf("unable to decode configuration file %q: %w", configurationFilePath, err)
 	}
 
+	// Validate against the schema first, as it reports every problem along
+	// with its position.
+	if err := validateSchema(displayPath, &root); err != nil {
+		return nil, ErrInvalidConfiguration{Problem: fmt.Errorf("\n%w", err)}
+	}
+
 	// XXX(Elizafox) - Node.Decode doesn't allow setting of KnownFields, so we do this cheesy hack below
 	data, err := yaml.Marshal(&root)
 	if err != nil {
@@ -716,28 +1444,44 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		return nil, fmt.Errorf("unable to decode configuration file %q: %w", configurationFilePath, err)
 	}
 
-	detectedCommit := detectCommit(ctx, configurationDirPath)
 	if cfg.Package.Commit == "" {
-		cfg.Package.Commit = detectedCommit
+		cfg.Package.Commit = detectCommit(ctx, configurationDirPath)
+	}
+	for i := range cfg.Subpackages {
+		if cfg.Subpackages[i].Commit == "" {
+			cfg.Subpackages[i].Commit = cfg.Package.Commit
+		}
 	}
 
+	return &cfg, nil
+}
+
+// Resolve expands the subpackage ranges of the configuration, merges the
+// environment and variables files of the options, substitutes the variables
+// and propagates the pipelines, like a build does.  A configuration can only
+// be resolved once.
+func (cfg *Configuration) Resolve(opts ...ConfigurationParsingOption) error {
+	if cfg.resolved {
+		return errors.New("configuration is already resolved")
+	}
+	cfg.resolved = true
+
+	options := &configOptions{}
+	options.include(opts...)
+
 	datas := make(map[string]DataItems)
 	for _, d := range cfg.Data {
 		datas[d.Name] = d.Items
 	}
 	subpackages := []Subpackage{}
 	for _, sp := range cfg.Subpackages {
-		if sp.Commit == "" {
-			sp.Commit = detectedCommit
-		}
-
 		if sp.Range == "" {
 			subpackages = append(subpackages, sp)
 			continue
 		}
 		items, ok := datas[sp.Range]
 		if !ok {
-			return nil, fmt.Errorf("unable to parse configuration file %q: subpackage %q specified undefined range: %q", configurationFilePath, sp.Name, sp.Range)
+			return fmt.Errorf("unable to parse configuration file %q: subpackage %q specified undefined range: %q", cfg.path, sp.Name, sp.Range)
 		}
 
 		// Ensure iterating over items is deterministic by sorting keys alphabetically
@@ -747,77 +1491,33 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		}
 		sort.Strings(keys)
 
+		names := map[string]struct{}{}
 		for _, k := range keys {
 			v := items[k]
 			replacer := replacerFromMap(map[string]string{
 				"${{range.key}}":   k,
 				"${{range.value}}": v,
 			})
-			thingToAdd := Subpackage{
-				Name:        replacer.Replace(sp.Name),
-				Description: replacer.Replace(sp.Description),
-				Dependencies: Dependencies{
-					Runtime:          replaceAll(replacer, sp.Dependencies.Runtime),
-					Provides:         replaceAll(replacer, sp.Dependencies.Provides),
-					Replaces:         replaceAll(replacer, sp.Dependencies.Replaces),
-					ProviderPriority: sp.Dependencies.ProviderPriority,
-				},
-				Options: sp.Options,
-				URL:     replacer.Replace(sp.URL),
-				If:      replacer.Replace(sp.If),
+			expanded := sp.expandRange(replacer)
+			if _, ok := names[expanded.Name]; ok {
+				return fmt.Errorf("unable to parse configuration file %q: subpackage %q expands to duplicate subpackage %q over range %q", cfg.path, sp.Name, expanded.Name, sp.Range)
 			}
-			for _, p := range sp.Pipeline {
-				// take a copy of the with map, so we can replace the values
-				replacedWith := make(map[string]string)
-				for key, value := range p.With {
-					replacedWith[key] = replacer.Replace(value)
-				}
-
-				// if the map is empty, set it to nil to avoid serializing an empty map
-				if len(replacedWith) == 0 {
-					replacedWith = nil
-				}
-
-				thingToAdd.Pipeline = append(thingToAdd.Pipeline, Pipeline{
-					Name:   p.Name,
-					Uses:   p.Uses,
-					With:   replacedWith,
-					Inputs: p.Inputs,
-					Needs:  p.Needs,
-					Label:  p.Label,
-					Runs:   replacer.Replace(p.Runs),
-					// TODO: p.Pipeline?
-				})
-			}
-			for _, p := range sp.Test.Pipeline {
-				// take a copy of the with map, so we can replace the values
-				replacedWith := make(map[string]string)
-				for key, value := range p.With {
-					replacedWith[key] = replacer.Replace(value)
-				}
-
-				// if the map is empty, set it to nil to avoid serializing an empty map
-				if len(replacedWith) == 0 {
-					replacedWith = nil
-				}
-
-				thingToAdd.Test.Pipeline = append(thingToAdd.Test.Pipeline, Pipeline{
-					Name:   p.Name,
-					Uses:   p.Uses,
-					With:   replacedWith,
-					Inputs: p.Inputs,
-					Needs:  p.Needs,
-					Label:  p.Label,
-					Runs:   replacer.Replace(p.Runs),
-					// TODO: p.Pipeline?
-				})
-			}
-			subpackages = append(subpackages, thingToAdd)
+			names[expanded.Name] = struct{}{}
+			subpackages = append(subpackages, expanded)
 		}
 	}
 	cfg.Data = nil // TODO: zero this out or not?
 	cfg.Subpackages = subpackages
 
+	for i, cp := range cfg.Package.Copyright {
+		cfg.Package.Copyright[i].License = NormalizeLicense(cp.License)
+	}
+	for i, sp := range cfg.Subpackages {
+		for j, cp := range sp.Copyright {
+			cfg.Subpackages[i].Copyright[j].License = NormalizeLicense(cp.License)
+		}
+	}
+
 	// TODO: validate that subpackage ranges have been consumed and applied
 
 	grp := apko_types.Group{
@@ -838,7 +1538,7 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	if envFile := options.envFilePath; envFile != "" {
 		envMap, err := godotenv.Read(envFile)
 		if err != nil {
-			return nil, fmt.Errorf("loading environment file: %w", err)
+			return fmt.Errorf("loading environment file: %w", err)
 		}
 
 		curEnv := cfg.Environment.Environment
@@ -875,14 +1575,14 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	if varsFile := options.varsFilePath; varsFile != "" {
 		f, err := os.Open(varsFile)
 		if err != nil {
-			return nil, fmt.Errorf("loading variables file: %w", err)
+			return fmt.Errorf("loading variables file: %w", err)
 		}
 		defer f.Close()
 
 		vars := map[string]string{}
 		err = yaml.NewDecoder(f).Decode(&vars)
 		if err != nil {
-			return nil, fmt.Errorf("loading variables file: %w", err)
+			return fmt.Errorf("loading variables file: %w", err)
 		}
 
 		for k, v := range vars {
@@ -890,8 +1590,15 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		}
 	}
 
-	// Mutate config properties with substitutions.
-	configMap := buildConfigMap(&cfg)
+	// Mutate config properties with substitutions.  The package fields may
+	// refer to vars, which may refer to the package fields in turn.
+	vars := newVariables(cfg, map[string]string{SubstitutionPackageEpoch: strconv.FormatUint(cfg.Package.Epoch, 10)}, true)
+	vars.templates[SubstitutionPackageName] = cfg.Package.Name
+	vars.templates[SubstitutionPackageVersion] = cfg.Package.Version
+	vars.templates[SubstitutionPackageDescription] = cfg.Package.Description
+	vars.templates[SubstitutionPackageFullVersion] = fmt.Sprintf("%s-r%d", SubstitutionPackageVersion, cfg.Package.Epoch)
+	configMap := map[string]string{}
+	_ = vars.resolve(configMap, true)
 	replacer := replacerFromMap(configMap)
 
 	cfg.Package.Name = replacer.Replace(cfg.Package.Name)
@@ -902,7 +1609,9 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 
 	for _, sp := range cfg.Subpackages {
 		sp.Name = replacer.Replace(sp.Name)
+		sp.Version = replacer.Replace(sp.Version)
 		sp.Description = replacer.Replace(sp.Description)
+		sp.applyCompat(cfg.Package.Name, replacer)
 
 		subpackages = append(subpackages, sp)
 	}
@@ -910,17 +1619,21 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	cfg.Subpackages = subpackages
 
 	if err := cfg.applySubstitutionsForProvides(); err != nil {
-		return nil, err
+		return err
 	}
 	if err := cfg.applySubstitutionsForRuntime(); err != nil {
-		return nil, err
+		return err
 	}
 	if err := cfg.applySubstitutionsForReplaces(); err != nil {
-		return nil, err
+		return err
+	}
+	if err := cfg.applySubstitutionsForInstallIf(); err != nil {
+		return err
 	}
 	if err := cfg.applySubstitutionsForPackages(); err != nil {
-		return nil, err
+		return err
 	}
+	cfg.pinInstallIf()
 
 	// Propagate all child pipelines
 	cfg.propagatePipelines()
@@ -935,18 +1648,75 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		cfg.Package.Resources.Memory = options.memory
 	}
 
-	// Finally, validate the configuration we ended up with before returning it for use downstream.
-	if err = cfg.validate(); err != nil {
-		return nil, fmt.Errorf("validating configuration %q: %w", cfg.Package.Name, err)
-	}
+	return nil
+}
 
-	return &cfg, nil
+// Validate checks a resolved configuration.
+func (cfg Configuration) Validate() error {
+	return cfg.validate()
 }
 
 func (cfg Configuration) Root() *yaml.Node {
 	return cfg.root
 }
 
+// PackageLine returns the line of the configuration file where the package
+// or subpackage called name is declared, or 0 if it is unknown.
+func (cfg Configuration) PackageLine(name string) int {
+	if cfg.root == nil || len(cfg.root.Content) == 0 {
+		return 0
+	}
+
+	doc := cfg.root.Content[0]
+	if name == cfg.Package.Name {
+		if k, _ := mappingEntry(doc, "package"); k != nil {
+			return k.Line
+		}
+		return 0
+	}
+
+	_, subpackages := mappingEntry(doc, "subpackages")
+	if subpackages == nil || subpackages.Kind != yaml.SequenceNode {
+		return 0
+	}
+	// Without ranges, the subpackages are in the order they are written.
+	ranged := false
+	for _, sp := range subpackages.Content {
+		if k, _ := mappingEntry(sp, "range"); k != nil {
+			ranged = true
+		}
+	}
+	if !ranged && len(subpackages.Content) == len(cfg.Subpackages) {
+		for i, sp := range cfg.Subpackages {
+			if sp.Name == name {
+				return subpackages.Content[i].Line
+			}
+		}
+	}
+	for _, sp := range subpackages.Content {
+		if _, n := mappingEntry(sp, "name"); n != nil && n.Value == name {
+			return sp.Line
+		}
+	}
+
+	return 0
+}
+
+// mappingEntry returns the key and value nodes of key in the mapping node n,
+// or nils.
+func mappingEntry(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+
+	return nil, nil
+}
+
 type ErrInvalidConfiguration struct {
 	Problem error
 }
@@ -972,18 +1742,160 @@ func (cfg Configuration) validate() error {
 
 	// TODO: try to validate value of .package.version
 
+	if r := cfg.Package.Resolver; r != nil {
+		for _, ns := range r.Nameservers {
+			if net.ParseIP(ns) == nil {
+				return ErrInvalidConfiguration{Problem: fmt.Errorf("resolver nameserver %q is not an IP address", ns)}
+			}
+		}
+
+		for host, addr := range r.Hosts {
+			if net.ParseIP(addr) == nil {
+				return ErrInvalidConfiguration{Problem: fmt.Errorf("resolver host %q maps to %q, which is not an IP address", host, addr)}
+			}
+		}
+	}
+
+	if err := validateCondition(cfg.Package.If); err != nil {
+		return ErrInvalidConfiguration{Problem: fmt.Errorf("package: %w", err)}
+	}
+
 	if err := validatePipelines(cfg.Pipeline); err != nil {
 		return ErrInvalidConfiguration{Problem: err}
 	}
 
+	if err := validateRPathPolicy(cfg.Package.Options.RPath); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateDevFilesPolicy(cfg.Package.Options.DevFiles); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+	if cfg.Package.Options.DevFiles == DevFilesPolicyMove && !slices.ContainsFunc(cfg.Subpackages, func(sp Subpackage) bool {
+		return sp.Name == cfg.Package.Name+"-dev" || sp.Name == cfg.Package.Name+"-static"
+	}) {
+		return ErrInvalidConfiguration{Problem: fmt.Errorf("dev-files option is move, but there is no %s-dev or %s-static subpackage to move the files to", cfg.Package.Name, cfg.Package.Name)}
+	}
+
+	if err := validateChecks(cfg.Package.Checks); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateRPathRewrites(cfg.Package.Options.RPathRewrites); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validatePackageOptionPaths(cfg.Package.Options); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateSizeBudget(cfg.Package.Options); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateRemovedFiles(cfg.Package.Options.RemovedFiles); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateInstallIf(cfg.Package.Name, cfg.Package.Dependencies.InstallIf); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateOwners(cfg.Package.Owners); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateMetadata(cfg.Package.Metadata); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateHooks(cfg.Hooks); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
+	if err := validateSecrets(cfg.Secrets); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
+
 	for i, sp := range cfg.Subpackages {
 		if !packageNameRegex.MatchString(sp.Name) {
 			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage name %q (subpackages index: %d) must match regex %q", sp.Name, i, packageNameRegex)}
 		}
 
+		if err := validateCondition(sp.If); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
 		if err := validatePipelines(sp.Pipeline); err != nil {
 			return ErrInvalidConfiguration{Problem: err}
 		}
+
+		if err := validateRPathPolicy(sp.Options.RPath); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateDevFilesPolicy(sp.Options.DevFiles); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+		if sp.Options.DevFiles == DevFilesPolicyMove {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: the dev-files option can only move files out of the main package", sp.Name)}
+		}
+
+		if err := validateChecks(sp.Checks); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateRPathRewrites(sp.Options.RPathRewrites); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validatePackageOptionPaths(sp.Options); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateSizeBudget(sp.Options); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateRemovedFiles(sp.Options.RemovedFiles); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateInstallIf(sp.Name, sp.Dependencies.InstallIf); err != nil {
+			return ErrInvalidConfiguration{Problem: err}
+		}
+
+		if err := validateCompat(sp.Compat); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateOwners(sp.Owners); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		if err := validateSubpackageVersion(sp); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q: %w", sp.Name, err)}
+		}
+
+		for _, pattern := range sp.Files {
+			if err := util.ValidateGlob(pattern); err != nil {
+				return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q has invalid files pattern %q: %w", sp.Name, pattern, err)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateCondition checks the syntax of an if-conditional, whose variables
+// are only known during the build.
+func validateCondition(expr string) error {
+	if expr == "" {
+		return nil
+	}
+
+	if _, err := cond.Evaluate(expr); err != nil {
+		return fmt.Errorf("invalid if-conditional %q: %w", expr, err)
 	}
 
 	return nil
@@ -999,6 +1911,22 @@ func validatePipelines(ps []Pipeline) error {
 			return fmt.Errorf("pipeline cannot contain both with and runs")
 		}
 
+		if err := validateCondition(p.If); err != nil {
+			return err
+		}
+
+		if p.Timeout < 0 {
+			return fmt.Errorf("pipeline timeout %s cannot be negative", p.Timeout)
+		}
+
+		if err := validateLimits(p.Limits); err != nil {
+			return err
+		}
+
+		if err := validateRetries(p.Retries, p.RetryOn); err != nil {
+			return err
+		}
+
 		if err := validatePipelines(p.Pipeline); err != nil {
 			return err
 		}
@@ -1006,6 +1934,65 @@ func validatePipelines(ps []Pipeline) error {
 	return nil
 }
 
+func validateRemovedFiles(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := util.ValidateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid removed-files pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func validateLimits(l *Limits) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.Memory != "" {
+		q, err := resource.ParseQuantity(l.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit %q: %w", l.Memory, err)
+		}
+		if q.Value() < 1024 {
+			return fmt.Errorf("memory limit %q must be at least 1Ki", l.Memory)
+		}
+	}
+
+	if l.CPUTime < 0 {
+		return fmt.Errorf("cpu-time limit %s cannot be negative", l.CPUTime)
+	}
+
+	return nil
+}
+
+func validateRetries(retries int, on *RetryOn) error {
+	if retries < 0 {
+		return fmt.Errorf("pipeline retries %d cannot be negative", retries)
+	}
+
+	if on == nil {
+		return nil
+	}
+
+	if retries == 0 {
+		return fmt.Errorf("pipeline retry-on requires retries")
+	}
+	if len(on.ExitCodes) == 0 && on.Output == "" {
+		return fmt.Errorf("pipeline retry-on must have exit-codes or output")
+	}
+	for _, code := range on.ExitCodes {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("retry-on exit code %d must be between 1 and 255", code)
+		}
+	}
+	if _, err := regexp.Compile(on.Output); err != nil {
+		return fmt.Errorf("invalid retry-on output %q: %w", on.Output, err)
+	}
+
+	return nil
+}
+
 // PackageURLs returns a list of package URLs ("purls") for the given
 // configuration. The first PURL is always the origin package, and any subsequent
 // items are the PURLs for the Configuration's subpackages. For more information
@@ -1017,7 +2004,8 @@ func (cfg Configuration) PackageURLs(distro string) []string {
 	purls = append(purls, p.PackageURL(distro))
 
 	for _, subpackage := range cfg.Subpackages {
-		version := fmt.Sprintf("%s-r%d", p.Version, p.Epoch)
+		v, epoch := cfg.VersionOf(subpackage.Name)
+		version := fmt.Sprintf("%s-r%d", v, epoch)
 		purls = append(purls, subpackage.PackageURL(distro, version))
 	}
 
@@ -4,8 +4,11 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/stretchr/testify/require"
 )
 
@@ -52,6 +55,9 @@ subpackages:
         - subpackage-bar=${{vars.bar}}
       replaces:
         - james=${{package.name}}
+      install-if:
+        - ${{package.name}}=${{package.full-version}}
+        - ${{vars.foo}}
 
 test:
   environment:
@@ -94,6 +100,11 @@ test:
 		"james=replacement-provides",
 	}, cfg.Subpackages[0].Dependencies.Replaces)
 
+	require.Equal(t, []string{
+		"replacement-provides=0.0.1-r7",
+		"FOO",
+	}, cfg.Subpackages[0].Dependencies.InstallIf)
+
 	require.Equal(t, []string{
 		"dep~0.0.1",
 	}, cfg.Environment.Contents.Packages)
@@ -140,6 +151,196 @@ subpackages:
 	require.True(t, cfg.Subpackages[0].Options.NoProvides)
 }
 
+func Test_installIf(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: bash
+  version: 5.2.21
+  epoch: 3
+
+subpackages:
+  - name: bash-doc
+  - name: bash-bash-completion
+    dependencies:
+      install-if:
+        - bash
+        - bash-completion
+  - name: bash-doc-extra
+    dependencies:
+      install-if:
+        - bash-doc>=5
+        - docs
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	require.Equal(t, []string{"bash=5.2.21-r3", "bash-completion"}, cfg.Subpackages[1].Dependencies.InstallIf)
+	require.Equal(t, []string{"bash-doc>=5", "docs"}, cfg.Subpackages[2].Dependencies.InstallIf)
+
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: bash
+  version: 5.2.21
+
+subpackages:
+  - name: bash-bash-completion
+    dependencies:
+      install-if:
+        - bash-bash-completion
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, "cannot be installed if it is installed itself")
+}
+
+func Test_compat(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: python-3.12
+  version: 3.12.2
+  epoch: 1
+
+vars:
+  major: "3"
+
+subpackages:
+  - name: python-3-compat
+    compat:
+      links:
+        - path: /usr/bin/python
+          target: python${{vars.major}}
+        - path: /usr/lib/libpython.so
+          target: libpython3.so
+    dependencies:
+      runtime:
+        - python-3.12=${{package.full-version}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+
+	sp := cfg.Subpackages[0]
+	require.Equal(t, []CompatLink{
+		{Path: "/usr/bin/python", Target: "python3"},
+		{Path: "/usr/lib/libpython.so", Target: "libpython3.so"},
+	}, sp.Compat.Links)
+	require.Equal(t, []string{"python-3.12=3.12.2-r1"}, sp.Dependencies.Runtime)
+	require.Equal(t, []string{"cmd:python=3.12.2-r1"}, sp.Dependencies.Provides)
+	require.Equal(t, []string{"python-3.12"}, sp.Dependencies.Replaces)
+
+	for _, tc := range []struct {
+		links string
+		err   string
+	}{{
+		links: "- path: usr/bin/python\n          target: python3",
+		err:   "must be a clean absolute path",
+	}, {
+		links: "- path: /usr/bin/python\n          target: \"\"",
+		err:   "has no target",
+	}, {
+		links: "- path: /usr/bin/python\n          target: python3\n        - path: /usr/bin/python\n          target: python3.12",
+		err:   "declared more than once",
+	}} {
+		if err := os.WriteFile(fp, []byte(`
+package:
+  name: python-3.12
+  version: 3.12.2
+
+subpackages:
+  - name: python-3-compat
+    compat:
+      links:
+        `+tc.links+`
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseConfiguration(ctx, fp)
+		require.ErrorContains(t, err, tc.err)
+	}
+}
+
+func Test_pipelineLimits(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.2.3
+
+pipeline:
+  - runs: make
+    limits:
+      memory: 4Gi
+      cpu-time: 2h
+  - runs: make check
+    timeout: 30m
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	require.Equal(t, &Limits{Memory: "4Gi", CPUTime: 2 * time.Hour}, cfg.Pipeline[0].Limits)
+	require.Equal(t, 30*time.Minute, cfg.Pipeline[1].Timeout)
+
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.2.3
+
+pipeline:
+  - runs: make
+    limits:
+      memory: lots
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, `invalid memory limit "lots"`)
+}
+
+func Test_pipelineRetries(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, tc := range []struct {
+		step string
+		err  string
+	}{
+		{step: "retries: 2\n    retry-on:\n      exit-codes: [1, 75]\n      output: 'connection (reset|refused)'"},
+		{step: "retries: -1", err: "pipeline retries -1 cannot be negative"},
+		{step: "retry-on:\n      exit-codes: [75]", err: "pipeline retry-on requires retries"},
+		{step: "retries: 2\n    retry-on: {}", err: "pipeline retry-on must have exit-codes or output"},
+		{step: "retries: 2\n    retry-on:\n      exit-codes: [256]", err: "retry-on exit code 256 must be between 1 and 255"},
+		{step: "retries: 2\n    retry-on:\n      output: '(reset'", err: `invalid retry-on output "(reset"`},
+	} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte("package:\n  name: foo\n  version: 1.2.3\npipeline:\n  - runs: make check\n    "+tc.step+"\n"), 0644))
+		cfg, err := ParseConfiguration(ctx, fp)
+		if tc.err != "" {
+			require.ErrorContains(t, err, tc.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, 2, cfg.Pipeline[0].Retries)
+		require.Equal(t, &RetryOn{ExitCodes: []int{1, 75}, Output: "connection (reset|refused)"}, cfg.Pipeline[0].RetryOn)
+	}
+}
+
 func Test_propagatePipelines(t *testing.T) {
 	ctx := slogtest.TestContextWithLogger(t)
 
@@ -262,3 +463,862 @@ pipeline:
 	require.Equal(t, "/home/build/baz", cfg.Pipeline[1].Pipeline[0].Pipeline[1].WorkDir)
 	require.Equal(t, "/home/build/baz", cfg.Pipeline[1].Pipeline[0].Pipeline[2].WorkDir)
 }
+
+func Test_varSubstitutions(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo-${{vars.major}}
+  version: 1.2.3
+  epoch: 0
+  description: foo ${{vars.underscored}} for ${{env.FLAVOR}}
+  dependencies:
+    runtime:
+      - foo-libs=${{vars.underscored}}
+
+environment:
+  environment:
+    FLAVOR: gnu
+
+vars:
+  summary: foo ${{vars.underscored}} built with ${{vars.toolchain}}
+  toolchain: ${{env.FLAVOR}}-${{build.arch}}
+  id: ${{package.name}}-${{env.FLAVOR}}
+
+var-transforms:
+  - from: ${{package.version}}
+    match: \.
+    replace: _
+    to: underscored
+  - from: ${{package.version}}
+    match: ^(\d+)\..*
+    replace: $1
+    to: major
+
+data:
+  - name: flavors
+    items:
+      static: ${{vars.id}}
+
+subpackages:
+  - range: flavors
+    name: ${{package.name}}-${{range.key}}
+    dependencies:
+      runtime:
+        - ${{range.value}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+
+	require.Equal(t, "foo-1", cfg.Package.Name)
+	require.Equal(t, "foo 1_2_3 for gnu", cfg.Package.Description)
+	require.Equal(t, []string{"foo-libs=1_2_3"}, cfg.Package.Dependencies.Runtime)
+	require.Equal(t, "foo-1-static", cfg.Subpackages[0].Name)
+	require.Equal(t, []string{"foo-1-gnu"}, cfg.Subpackages[0].Dependencies.Runtime)
+
+	// The build architecture is only known when building.
+	nw := map[string]string{
+		SubstitutionPackageName:    cfg.Package.Name,
+		SubstitutionPackageVersion: "1.3.0",
+		SubstitutionBuildArch:      "x86_64",
+	}
+	require.NoError(t, cfg.PerformVarSubstitutions(nw))
+	require.Equal(t, "foo 1_3_0 built with gnu-x86_64", nw["${{vars.summary}}"])
+	require.Equal(t, "gnu", nw["${{env.FLAVOR}}"])
+}
+
+func Test_varSubstitutionCycle(t *testing.T) {
+	cfg := Configuration{
+		Vars: map[string]string{
+			"a": "${{vars.b}}",
+			"b": "x-${{vars.a}}",
+		},
+	}
+
+	err := cfg.PerformVarSubstitutions(map[string]string{})
+	require.ErrorContains(t, err, "refers to itself")
+}
+
+func Test_rpathRewrites(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+  options:
+    rpath-rewrites:
+      - match: /home/build/(.*)
+        replace: /usr/lib/$1
+
+subpackages:
+  - name: foo-dev
+    options:
+      rpath-rewrites:
+        - match: /tmp/[
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, `subpackage "foo-dev": rpath-rewrites match "/tmp/[" does not compile`)
+}
+
+func Test_commandPaths(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		paths string
+		err   string
+	}{
+		{paths: "[usr/libexec/foo/bin, opt/foo/bin/]"},
+		{paths: "[/usr/libexec/foo/bin]", err: `command path "/usr/libexec/foo/bin" must be a clean path`},
+		{paths: "[../bin]", err: `command path "../bin" must be a clean path`},
+		{paths: "[usr//bin]", err: `command path "usr//bin" must be a clean path`},
+	} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+subpackages:
+  - name: foo-tools
+    options:
+      command-paths: `+c.paths+`
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := ParseConfiguration(ctx, fp)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []string{"usr/libexec/foo/bin", "opt/foo/bin/"}, cfg.Subpackages[0].Options.CommandPaths)
+	}
+}
+
+func Test_libraryOptions(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		options string
+		err     string
+	}{
+		{options: "{library-paths: [opt/foo/lib], private-libraries: [usr/lib/libfoo-*.so.*]}"},
+		{options: "{library-paths: [/opt/foo/lib]}", err: `library path "/opt/foo/lib" must be a clean path`},
+		{options: "{private-libraries: [\"usr/lib/[\"]}", err: `private library "usr/lib/[" must be a pattern`},
+		{options: "{keep-dirs: [var/lib/foo, \"var/cache/*\"]}"},
+		{options: "{keep-dirs: [\"var/[\"]}", err: `kept directory "var/[" must be a pattern`},
+	} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+  options: `+c.options+`
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func Test_sizeBudget(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		options string
+		err     string
+	}{
+		{options: "{max-installed-size: 100MiB, max-apk-size: 20MB, size-budget: warn}"},
+		{options: "{max-apk-size: big}", err: `max-apk-size option "big" must be a size`},
+		{options: "{max-installed-size: 1GiB, size-budget: ignore}", err: `size-budget option "ignore" must be one of fail or warn`},
+	} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+subpackages:
+  - name: foo-data
+    options: `+c.options+`
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+}
+
+func Test_pathChecks(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+  checks:
+    paths:
+      must-exist: [usr/bin/foo]
+      must-not-exist: [usr/include/*]
+      must-be-executable: [/usr/bin/*]
+subpackages:
+  - name: foo-dev
+    checks:
+      paths:
+        must-exist: ["usr/include/[foo.h"]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, `subpackage "foo-dev": path check "usr/include/[foo.h" is not a valid pattern`)
+}
+
+func Test_devFiles(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{{
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  options:
+    dev-files: move
+subpackages:
+  - name: foo-static
+`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  options:
+    dev-files: move
+subpackages:
+  - name: foo-doc
+`,
+		err: "there is no foo-dev or foo-static subpackage",
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+subpackages:
+  - name: foo-dev
+    options:
+      dev-files: move
+`,
+		err: `subpackage "foo-dev": the dev-files option can only move files out of the main package`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  options:
+    dev-files: drop
+`,
+		err: `dev-files option "drop" must be one of warn, move or keep`,
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.ErrorContains(t, err, c.err)
+		}
+	}
+}
+
+func Test_owners(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{{
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  owners:
+    - path: /var/lib/foo
+      user: foo
+      group: "1000"
+subpackages:
+  - name: foo-doc
+    owners:
+      - path: /usr/share/doc/foo
+        group: doc
+`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  owners:
+    - path: var/lib/foo
+      user: foo
+`,
+		err: `owner path "var/lib/foo" must be a clean absolute path`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  owners:
+    - path: /var/lib/foo
+`,
+		err: `owner of "/var/lib/foo" has neither a user nor a group`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+subpackages:
+  - name: foo-doc
+    owners:
+      - path: /usr/share/doc/foo
+        user: foo
+      - path: /usr/share/doc/foo
+        group: foo
+`,
+		err: `subpackage "foo-doc": owner of "/usr/share/doc/foo" is declared more than once`,
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.ErrorContains(t, err, c.err)
+		}
+	}
+}
+
+func Test_hooks(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{{
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+hooks:
+  - on: post-emit
+    runs: jq -r .apk | xargs scan
+`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+hooks:
+  - on: post-upload
+    runs: notify
+`,
+		err: `hook on "post-upload" must be one of pre-build, post-build, pre-emit, post-emit`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+hooks:
+  - on: pre-build
+`,
+		err: `pre-build hook has no command`,
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.ErrorContains(t, err, c.err)
+		}
+	}
+}
+
+func Test_rangeExpansion(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: php
+  version: 8.3.0
+
+data:
+  - name: extensions
+    items:
+      curl: cURL
+      zip: Zip
+
+subpackages:
+  - range: extensions
+    name: php-${{range.key}}
+    description: The ${{range.value}} extension
+    files:
+      - usr/lib/php/modules/${{range.key}}.so
+    checks:
+      disabled:
+        - empty
+    scriptlets:
+      post-install: echo ${{range.key}}
+    pipeline:
+      - working-directory: ext/${{range.key}}
+        environment:
+          EXT: ${{range.key}}
+        pipeline:
+          - runs: make install-${{range.key}}
+    test:
+      environment:
+        contents:
+          packages:
+            - php-${{range.key}}-tests
+      pipeline:
+        - uses: test/php-ext
+          with:
+            name: ${{range.key}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+
+	require.Len(t, cfg.Subpackages, 2)
+	sp := cfg.Subpackages[1]
+	require.Equal(t, "php-zip", sp.Name)
+	require.Equal(t, "The Zip extension", sp.Description)
+	require.Equal(t, []string{"usr/lib/php/modules/zip.so"}, sp.Files)
+	require.Equal(t, []string{"empty"}, sp.Checks.Disabled)
+	require.Equal(t, "echo zip", sp.Scriptlets.PostInstall)
+	require.Equal(t, "ext/zip", sp.Pipeline[0].WorkDir)
+	require.Equal(t, "zip", sp.Pipeline[0].Environment["EXT"])
+	require.Equal(t, "make install-zip", sp.Pipeline[0].Pipeline[0].Runs)
+	require.Equal(t, "ext/zip", sp.Pipeline[0].Pipeline[0].WorkDir)
+	require.Contains(t, sp.Test.Environment.Contents.Packages, "php-zip-tests")
+	require.Equal(t, "zip", sp.Test.Pipeline[0].With["name"])
+	require.Equal(t, "php-curl", cfg.Subpackages[0].Name)
+
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: php
+  version: 8.3.0
+
+data:
+  - name: extensions
+    items:
+      curl: cURL
+      zip: Zip
+
+subpackages:
+  - range: extensions
+    name: php-extension
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, `expands to duplicate subpackage "php-extension"`)
+}
+
+func Test_conditions(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		name, config, want string
+	}{{
+		name: "valid",
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  if: ${{build.arch}} != 'riscv64'
+
+pipeline:
+  - if: ${{build.arch}} == 'x86_64' || ${{build.arch}} == 'aarch64'
+    runs: make
+
+subpackages:
+  - name: foo-systemd
+    if: (${{build.arch}} != 's390x' && ${{build.arch}} != 'riscv64') || ${{vars.systemd}} == 'true'
+`,
+	}, {
+		name: "package",
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  if: ${{build.arch}} = 'riscv64'
+`,
+		want: `package: invalid if-conditional "${{build.arch}} = 'riscv64'"`,
+	}, {
+		name: "subpackage",
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+
+subpackages:
+  - name: foo-systemd
+    if: (${{build.arch}} != 's390x'
+`,
+		want: `subpackage "foo-systemd": invalid if-conditional`,
+	}, {
+		name: "nested pipeline",
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+
+pipeline:
+  - pipeline:
+      - if: x86_64
+        runs: make
+`,
+		want: `invalid if-conditional "x86_64"`,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			fp := filepath.Join(t.TempDir(), "melange.yaml")
+			require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+
+			_, err := ParseConfiguration(ctx, fp)
+			if c.want == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, c.want)
+			}
+		})
+	}
+}
+
+func Test_loadResolveValidate(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(`
+package:
+  name: python-${{vars.py}}
+  version: 1.0.0
+  epoch: 2
+
+vars:
+  py: "3.12"
+
+data:
+  - name: extras
+    items:
+      dev: Development files
+
+subpackages:
+  - range: extras
+    name: ${{package.name}}-${{range.key}}
+    description: ${{range.value}}
+`), 0644))
+
+	cfg, err := Load(ctx, fp)
+	require.NoError(t, err)
+
+	// Loading leaves the configuration as it is written.
+	require.Equal(t, "python-${{vars.py}}", cfg.Package.Name)
+	require.Len(t, cfg.Subpackages, 1)
+	require.Equal(t, "extras", cfg.Subpackages[0].Range)
+
+	require.NoError(t, cfg.Resolve())
+	require.Equal(t, "python-3.12", cfg.Package.Name)
+	require.Len(t, cfg.Subpackages, 1)
+	require.Equal(t, "python-3.12-dev", cfg.Subpackages[0].Name)
+	require.Equal(t, "Development files", cfg.Subpackages[0].Description)
+	require.NoError(t, cfg.Validate())
+
+	require.ErrorContains(t, cfg.Resolve(), "already resolved")
+
+	parsed, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, parsed.Package, cfg.Package)
+	require.Equal(t, parsed.Subpackages, cfg.Subpackages)
+}
+
+func Test_validate(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: ${{vars.version}}
+
+vars:
+  version: ""
+`), 0644))
+
+	cfg, err := Load(ctx, fp)
+	require.NoError(t, err)
+	require.NoError(t, cfg.Resolve())
+	require.ErrorContains(t, cfg.Validate(), "package version must not be empty")
+}
+
+func TestPackageLine(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(`package:
+  name: hello
+  version: 1.0.0
+
+data:
+  - name: extras
+    items:
+      dev: Development files
+
+subpackages:
+  - name: ${{package.name}}-doc
+
+  - range: extras
+    name: ${{package.name}}-${{range.key}}
+
+  - name: hello-libs
+`), 0644))
+
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, cfg.PackageLine("hello"))
+	require.Equal(t, 16, cfg.PackageLine("hello-libs"))
+	// With ranges, subpackages whose names are substituted are unknown.
+	require.Equal(t, 0, cfg.PackageLine("hello-doc"))
+	require.Equal(t, 0, cfg.PackageLine("hello-dev"))
+	require.Equal(t, 0, cfg.PackageLine("missing"))
+
+	require.NoError(t, os.WriteFile(fp, []byte(`package:
+  name: hello
+  version: 1.0.0
+
+subpackages:
+  - name: ${{package.name}}-doc
+  - name: ${{package.name}}-dev
+`), 0644))
+
+	cfg, err = ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, 7, cfg.PackageLine("hello-dev"))
+}
+
+func Test_detectCommit(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	root := t.TempDir()
+	repo, err := git.PlainInit(root, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+
+	// The configuration is in a subdirectory of the repository.
+	fp := filepath.Join(root, "hello", "hello.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(fp), 0o755))
+	require.NoError(t, os.WriteFile(fp, []byte(`
+package:
+  name: hello
+  version: 1.0.0
+subpackages:
+  - name: hello-doc
+  - name: hello-dev
+    commit: cafe
+`), 0o644))
+	_, err = wt.Add("hello/hello.yaml")
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "hello", Email: "hello@example.com", When: time.Unix(0, 0)}
+	commit, err := wt.Commit("hello", &git.CommitOptions{Author: sig})
+	require.NoError(t, err)
+
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, commit.String(), cfg.Package.Commit)
+	require.Equal(t, commit.String(), cfg.Subpackages[0].Commit)
+	require.Equal(t, "cafe", cfg.Subpackages[1].Commit)
+}
+
+func Test_metadata(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{{
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  metadata:
+    support-tier: gold
+    cpe_vendor: gnu
+`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  metadata:
+    pkgver: 2.0.0
+`,
+		err: `metadata key "pkgver" is reserved`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  metadata:
+    Support Tier: gold
+`,
+		err: `metadata key "Support Tier" must be lowercase letters, digits, underscores and dashes`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 1.0.0
+  metadata:
+    notes: "one\ntwo"
+`,
+		err: `metadata notes must be a single line`,
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+		_, err := ParseConfiguration(ctx, fp)
+		if c.err == "" {
+			require.NoError(t, err)
+		} else {
+			require.ErrorContains(t, err, c.err)
+		}
+	}
+}
+
+func Test_subpackageVersion(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{{
+		config: `
+package:
+  name: foo
+  version: 2.0.0
+  epoch: 3
+subpackages:
+  - name: foo-compat
+    version: 1.9_rc1
+    epoch: 1
+  - name: foo-dev
+    dependencies:
+      install-if:
+        - foo-compat
+`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 2.0.0
+subpackages:
+  - name: foo-compat
+    version: 1.9-r1
+`,
+		err: `subpackage "foo-compat": version "1.9-r1" is not a valid apk version`,
+	}, {
+		config: `
+package:
+  name: foo
+  version: 2.0.0
+subpackages:
+  - name: foo-compat
+    epoch: 1
+`,
+		err: `subpackage "foo-compat": epoch 1 requires a version of the subpackage`,
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte(c.config), 0644))
+		cfg, err := ParseConfiguration(ctx, fp)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err)
+			continue
+		}
+		require.NoError(t, err)
+
+		version, epoch := cfg.VersionOf("foo-compat")
+		require.Equal(t, "1.9_rc1", version)
+		require.Equal(t, uint64(1), epoch)
+		version, epoch = cfg.VersionOf("foo-dev")
+		require.Equal(t, "2.0.0", version)
+		require.Equal(t, uint64(3), epoch)
+
+		require.Equal(t, []string{"foo-compat=1.9_rc1-r1"}, cfg.Subpackages[1].Dependencies.InstallIf)
+		require.Equal(t, []string{
+			"pkg:apk/wolfi/foo@2.0.0-r3",
+			"pkg:apk/wolfi/foo-compat@1.9_rc1-r1",
+			"pkg:apk/wolfi/foo-dev@2.0.0-r3",
+		}, cfg.PackageURLs("wolfi"))
+	}
+}
+
+func Test_secrets(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		secrets string
+		err     string
+	}{{
+		secrets: `
+  - name: GITHUB_TOKEN
+  - name: NETRC
+    file: true
+    optional: true
+`,
+	}, {
+		secrets: `
+  - name: 1PASSWORD
+`,
+		err: `secret name "1PASSWORD" must be letters, digits and underscores, not starting with a digit`,
+	}, {
+		secrets: `
+  - name: GITHUB_TOKEN
+  - name: GITHUB_TOKEN
+    file: true
+`,
+		err: "secret GITHUB_TOKEN is declared more than once",
+	}} {
+		fp := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(fp, []byte("package:\n  name: foo\n  version: 1.0.0\nsecrets:"+c.secrets), 0644))
+		cfg, err := ParseConfiguration(ctx, fp)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []Secret{
+			{Name: "GITHUB_TOKEN"},
+			{Name: "NETRC", File: true, Optional: true},
+		}, cfg.Secrets)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/github/go-spdx/v2/spdxexp"
+)
+
+// licenseAliases maps the upper-cased names licenses are commonly written
+// with to their SPDX identifiers.
+var licenseAliases = map[string]string{
+	"GPL2":      "GPL-2.0-only",
+	"GPLV2":     "GPL-2.0-only",
+	"GPL-2":     "GPL-2.0-only",
+	"GPL2+":     "GPL-2.0-or-later",
+	"GPLV2+":    "GPL-2.0-or-later",
+	"GPL-2+":    "GPL-2.0-or-later",
+	"GPL3":      "GPL-3.0-only",
+	"GPLV3":     "GPL-3.0-only",
+	"GPL-3":     "GPL-3.0-only",
+	"GPL3+":     "GPL-3.0-or-later",
+	"GPLV3+":    "GPL-3.0-or-later",
+	"GPL-3+":    "GPL-3.0-or-later",
+	"LGPL2":     "LGPL-2.0-only",
+	"LGPL2+":    "LGPL-2.0-or-later",
+	"LGPL2.1":   "LGPL-2.1-only",
+	"LGPLV2.1":  "LGPL-2.1-only",
+	"LGPL2.1+":  "LGPL-2.1-or-later",
+	"LGPLV2.1+": "LGPL-2.1-or-later",
+	"LGPL3":     "LGPL-3.0-only",
+	"LGPLV3":    "LGPL-3.0-only",
+	"LGPL3+":    "LGPL-3.0-or-later",
+	"LGPLV3+":   "LGPL-3.0-or-later",
+	"AGPL3":     "AGPL-3.0-only",
+	"AGPLV3":    "AGPL-3.0-only",
+	"AGPL3+":    "AGPL-3.0-or-later",
+	"AGPLV3+":   "AGPL-3.0-or-later",
+	"APACHE2":   "Apache-2.0",
+	"APACHEV2":  "Apache-2.0",
+	"APACHE-2":  "Apache-2.0",
+	"APACHE2.0": "Apache-2.0",
+	"ASL2":      "Apache-2.0",
+	"ASL-2.0":   "Apache-2.0",
+	"BSD2":      "BSD-2-Clause",
+	"BSD-2":     "BSD-2-Clause",
+	"BSD3":      "BSD-3-Clause",
+	"BSD-3":     "BSD-3-Clause",
+	"MPL2":      "MPL-2.0",
+	"MPL-2":     "MPL-2.0",
+	"EXPAT":     "MIT",
+	"BOOST":     "BSL-1.0",
+	"PSF":       "PSF-2.0",
+}
+
+// NormalizeLicense rewrites a license expression with the SPDX identifiers
+// of its licenses: common aliases are replaced, e.g. GPL2 with GPL-2.0-only,
+// identifiers are spelled like in the SPDX license list, and deprecated ones
+// are replaced, e.g. GPL-2.0+ with GPL-2.0-or-later.  Unknown licenses are
+// left as they are.
+func NormalizeLicense(expr string) string {
+	tokens := []string{}
+	for _, field := range strings.Fields(expr) {
+		// Parentheses are tokens of their own, even when they are not
+		// separated from licenses by spaces.
+		for field != "" {
+			i := strings.IndexAny(field, "()")
+			switch {
+			case i == -1:
+				tokens = append(tokens, field)
+				field = ""
+			case i == 0:
+				tokens = append(tokens, field[:1])
+				field = field[1:]
+			default:
+				tokens = append(tokens, field[:i])
+				field = field[i:]
+			}
+		}
+	}
+
+	for i, tok := range tokens {
+		switch upper := strings.ToUpper(tok); {
+		case upper == "AND" || upper == "OR" || upper == "WITH":
+			tokens[i] = upper
+		case tok == "(" || tok == ")":
+		case i > 0 && tokens[i-1] == "WITH":
+			tokens[i] = normalizeLicenseException(tok)
+		default:
+			tokens[i] = normalizeLicenseID(tok)
+		}
+	}
+
+	normalized := strings.Join(tokens, " ")
+	normalized = strings.ReplaceAll(normalized, "( ", "(")
+	normalized = strings.ReplaceAll(normalized, " )", ")")
+
+	return normalized
+}
+
+func normalizeLicenseID(id string) string {
+	if alias, ok := licenseAliases[strings.ToUpper(id)]; ok {
+		return alias
+	}
+	if strings.HasPrefix(id, "LicenseRef-") || strings.HasPrefix(id, "DocumentRef-") {
+		return id
+	}
+
+	base, plus := strings.CutSuffix(id, "+")
+	canonical, ok := canonicalLicense(base)
+	if !ok {
+		return id
+	}
+
+	// GPL-2.0 is deprecated in favor of GPL-2.0-only, and GPL-2.0+ in favor
+	// of GPL-2.0-or-later.
+	if plus {
+		if later, ok := canonicalLicense(canonical + "-or-later"); ok {
+			return later
+		}
+		return canonical + "+"
+	}
+	if only, ok := canonicalLicense(canonical + "-only"); ok {
+		return only
+	}
+
+	return canonical
+}
+
+// canonicalLicense returns how id is spelled in the SPDX license list.
+func canonicalLicense(id string) (string, bool) {
+	if strings.ContainsAny(id, "+()") {
+		return "", false
+	}
+	licenses, err := spdxexp.ExtractLicenses(id)
+	if err != nil || len(licenses) != 1 {
+		return "", false
+	}
+
+	// The -or-later licenses are extracted with a redundant +.
+	return strings.TrimSuffix(licenses[0], "+"), true
+}
+
+func normalizeLicenseException(id string) string {
+	licenses, err := spdxexp.ExtractLicenses("MIT WITH " + id)
+	if err != nil || len(licenses) != 1 {
+		return id
+	}
+	_, exception, ok := strings.Cut(licenses[0], " WITH ")
+	if !ok {
+		return id
+	}
+
+	return exception
+}
+
+// ValidateLicenses returns an error for each license of the package and its
+// subpackages which is not a valid SPDX license expression.
+func (cfg Configuration) ValidateLicenses() error {
+	copyrights := slices.Clone(cfg.Package.Copyright)
+	for _, sp := range cfg.Subpackages {
+		copyrights = append(copyrights, sp.Copyright...)
+	}
+
+	errs := []error{}
+	for _, cp := range copyrights {
+		if cp.License == "" {
+			continue
+		}
+		if valid, _ := spdxexp.ValidateLicenses([]string{cp.License}); !valid {
+			errs = append(errs, fmt.Errorf("license %q is not a valid SPDX license expression", cp.License))
+		}
+	}
+
+	return errors.Join(errs...)
+}
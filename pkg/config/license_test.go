@@ -0,0 +1,83 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeLicense(t *testing.T) {
+	for expr, want := range map[string]string{
+		"":                               "",
+		"MIT":                            "MIT",
+		"mit":                            "MIT",
+		"GPL2":                           "GPL-2.0-only",
+		"gplv3+":                         "GPL-3.0-or-later",
+		"GPL-2.0":                        "GPL-2.0-only",
+		"GPL-2.0+":                       "GPL-2.0-or-later",
+		"GPL-2.0-or-later":               "GPL-2.0-or-later",
+		"LGPL-2.1":                       "LGPL-2.1-only",
+		"apache-2.0 with llvm-exception": "Apache-2.0 WITH LLVM-exception",
+		"MIT and (BSD3 or Apache2)":      "MIT AND (BSD-3-Clause OR Apache-2.0)",
+		"( MIT OR bsd-2-clause )":        "(MIT OR BSD-2-Clause)",
+		"LicenseRef-custom":              "LicenseRef-custom",
+		"Some Proprietary License":       "Some Proprietary License",
+		"${{vars.license}}":              "${{vars.license}}",
+		"GPL-2.0-only WITH Classpath-exception-2.0": "GPL-2.0-only WITH Classpath-exception-2.0",
+	} {
+		require.Equal(t, want, NormalizeLicense(expr), "NormalizeLicense(%q)", expr)
+	}
+}
+
+func TestValidateLicenses(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(`
+package:
+  name: hello
+  version: 1.0.0
+  copyright:
+    - license: gpl2+
+    - license: Some Proprietary License
+    - license: mit and bsd3
+subpackages:
+  - name: hello-doc
+    copyright:
+      - license: cc-by-sa-4.0
+`), 0644))
+
+	// Unknown licenses are only warned about.
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+
+	require.Equal(t, "GPL-2.0-or-later", cfg.Package.Copyright[0].License)
+	require.Equal(t, "Some Proprietary License", cfg.Package.Copyright[1].License)
+	require.Equal(t, "MIT AND BSD-3-Clause", cfg.Package.Copyright[2].License)
+	require.Equal(t, "CC-BY-SA-4.0", cfg.Subpackages[0].Copyright[0].License)
+
+	require.EqualError(t, cfg.ValidateLicenses(), `license "Some Proprietary License" is not a valid SPDX license expression`)
+
+	cfg.Package.Copyright = cfg.Package.Copyright[:1]
+	require.NoError(t, cfg.ValidateLicenses())
+
+	cfg.Subpackages[0].Copyright[0].License = "Docs License"
+	require.EqualError(t, cfg.ValidateLicenses(), `license "Docs License" is not a valid SPDX license expression`)
+}
@@ -0,0 +1,342 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	spdxexp "github.com/github/go-spdx/v2/spdxexp"
+	"gopkg.in/yaml.v3"
+)
+
+// The checks of Lint.
+const (
+	LintSchema              = "schema"
+	LintInvalid             = "invalid"
+	LintUnusedInput         = "unused-input"
+	LintUnknownPipeline     = "unknown-pipeline"
+	LintUnpinnedFetch       = "unpinned-fetch"
+	LintMissingChecksum     = "missing-checksum"
+	LintDuplicateSubpackage = "duplicate-subpackage"
+	LintLicense             = "license"
+	LintUndefinedVariable   = "undefined-variable"
+)
+
+// LintFinding is a problem found in a configuration file by Lint.
+type LintFinding struct {
+	// The check which found the problem
+	Check string `json:"check"`
+	File  string `json:"file"`
+	// The line of the problem, or 0 if it is about the whole file
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f LintFinding) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("%s: %s (%s)", f.File, f.Message, f.Check)
+	}
+	return fmt.Sprintf("%s:%d: %s (%s)", f.File, f.Line, f.Message, f.Check)
+}
+
+// PipelineInputsFunc returns the inputs of the pipeline which a step uses.
+type PipelineInputsFunc func(uses string) (map[string]Input, error)
+
+// Lint checks the configuration file at configurationFilePath against the
+// schema, then for the mistakes which a build would not catch, or only once
+// it reaches them: the inputs given to pipelines which do not have them,
+// the sources which are not pinned to the version of the package or
+// verified by a checksum, the duplicate subpackages, the licenses which are
+// not SPDX expressions and the references to undefined variables.  The
+// inputs of the pipelines are those of inputs, and are not checked if it is
+// nil.  Only the files which cannot be decoded are an error.
+func Lint(ctx context.Context, configurationFilePath string, inputs PipelineInputsFunc, opts ...ConfigurationParsingOption) ([]LintFinding, error) {
+	cfg, err := Load(ctx, configurationFilePath, opts...)
+	if err != nil {
+		var schemaErrs interface{ Unwrap() []error }
+		if !errors.As(err, &schemaErrs) {
+			return nil, err
+		}
+
+		findings := []LintFinding{}
+		for _, err := range schemaErrs.Unwrap() {
+			var se SchemaError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			findings = append(findings, LintFinding{Check: LintSchema, File: se.File, Line: se.Line, Message: se.Message})
+		}
+		return findings, nil
+	}
+
+	l := &configLinter{cfg: cfg, file: configurationFilePath, inputs: inputs}
+	if root := cfg.Root(); root != nil && len(root.Content) != 0 {
+		doc := root.Content[0]
+		l.lintSteps(doc)
+		l.lintSubpackages(doc)
+		l.lintLicenses(doc)
+		l.lintVariables(doc, false)
+	}
+
+	if err := cfg.Resolve(opts...); err != nil {
+		l.report(LintInvalid, nil, "%v", err)
+	} else if err := cfg.Validate(); err != nil {
+		l.report(LintInvalid, nil, "%v", err)
+	}
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		return l.findings[i].Line < l.findings[j].Line
+	})
+
+	return l.findings, nil
+}
+
+type configLinter struct {
+	cfg      *Configuration
+	file     string
+	inputs   PipelineInputsFunc
+	findings []LintFinding
+}
+
+// report records a finding of check at the line of n, if any.
+func (l *configLinter) report(check string, n *yaml.Node, format string, args ...any) {
+	f := LintFinding{Check: check, File: l.file, Message: fmt.Sprintf(format, args...)}
+	if n != nil {
+		f.Line = n.Line
+	}
+	l.findings = append(l.findings, f)
+}
+
+// stringEntry returns the node and the value of the scalar key of the
+// mapping node n, or nil and "".
+func stringEntry(n *yaml.Node, key string) (*yaml.Node, string) {
+	if n == nil {
+		return nil, ""
+	}
+	_, v := mappingEntry(n, key)
+	if v == nil || v.Kind != yaml.ScalarNode {
+		return nil, ""
+	}
+	return v, v.Value
+}
+
+// lintSteps checks the pipeline steps under n: those of the package, the
+// subpackages and the tests.
+func (l *configLinter) lintSteps(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			l.lintSteps(c)
+		}
+		return
+	case yaml.MappingNode:
+	default:
+		return
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		l.lintSteps(n.Content[i+1])
+	}
+
+	usesNode, uses := stringEntry(n, "uses")
+	if usesNode == nil || strings.Contains(uses, "${{") {
+		return
+	}
+	_, with := mappingEntry(n, "with")
+	if with != nil && with.Kind != yaml.MappingNode {
+		with = nil
+	}
+
+	if l.inputs != nil {
+		inputs, err := l.inputs(uses)
+		if err != nil {
+			l.report(LintUnknownPipeline, usesNode, "pipeline %q cannot be loaded: %v", uses, err)
+		} else if with != nil {
+			for i := 0; i+1 < len(with.Content); i += 2 {
+				if k := with.Content[i]; !hasInput(inputs, k.Value) {
+					l.report(LintUnusedInput, k, "%q is not an input of pipeline %q, which ignores it", k.Value, uses)
+				}
+			}
+		}
+	}
+
+	input := func(key string) (*yaml.Node, string) {
+		if with == nil {
+			return nil, ""
+		}
+		return stringEntry(with, key)
+	}
+
+	switch uses {
+	case "fetch":
+		if uriNode, uri := input("uri"); uriNode != nil && !l.pinned(uri) {
+			l.report(LintUnpinnedFetch, uriNode, "%s does not refer to the version of the package, so what it fetches can change without the build file changing", uri)
+		}
+		sha256, _ := input("expected-sha256")
+		sha512, _ := input("expected-sha512")
+		if sha256 == nil && sha512 == nil {
+			l.report(LintMissingChecksum, usesNode, "fetch has neither an expected-sha256 nor an expected-sha512")
+		}
+
+	case "git-checkout":
+		if commit, _ := input("expected-commit"); commit != nil {
+			return
+		}
+		if tag, _ := input("tag"); tag != nil {
+			l.report(LintMissingChecksum, usesNode, "git-checkout has no expected-commit for its tag")
+		} else {
+			l.report(LintUnpinnedFetch, usesNode, "git-checkout has neither a tag nor an expected-commit, so what it checks out can change without the build file changing")
+		}
+	}
+}
+
+func hasInput(inputs map[string]Input, name string) bool {
+	_, ok := inputs[name]
+	return ok
+}
+
+// pinned returns whether a URI refers to the version of the package,
+// literally or through a variable.
+func (l *configLinter) pinned(uri string) bool {
+	return strings.Contains(uri, "${{") || (l.cfg.Package.Version != "" && strings.Contains(uri, l.cfg.Package.Version))
+}
+
+// lintSubpackages checks that the names of the subpackages are unique.
+func (l *configLinter) lintSubpackages(doc *yaml.Node) {
+	_, pkg := mappingEntry(doc, "package")
+	_, name := stringEntry(pkg, "name")
+	seen := map[string]bool{name: true}
+
+	_, subpackages := mappingEntry(doc, "subpackages")
+	if subpackages == nil || subpackages.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, sp := range subpackages.Content {
+		n, name := stringEntry(sp, "name")
+		// The names of ranges are only known once they are expanded.
+		if n == nil || strings.Contains(name, "${{") {
+			continue
+		}
+		if seen[name] {
+			l.report(LintDuplicateSubpackage, n, "package %q is declared more than once", name)
+		}
+		seen[name] = true
+	}
+}
+
+// lintLicenses checks that the licenses of the package and the subpackages
+// are SPDX expressions.
+func (l *configLinter) lintLicenses(doc *yaml.Node) {
+	copyrights := func(n *yaml.Node) {
+		if n == nil {
+			return
+		}
+		_, cps := mappingEntry(n, "copyright")
+		if cps == nil || cps.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, cp := range cps.Content {
+			n, license := stringEntry(cp, "license")
+			if n == nil || license == "" {
+				continue
+			}
+			if valid, _ := spdxexp.ValidateLicenses([]string{license}); !valid {
+				l.report(LintLicense, n, "license %q is not a valid SPDX license expression", license)
+			}
+		}
+	}
+
+	_, pkg := mappingEntry(doc, "package")
+	copyrights(pkg)
+	if _, subpackages := mappingEntry(doc, "subpackages"); subpackages != nil && subpackages.Kind == yaml.SequenceNode {
+		for _, sp := range subpackages.Content {
+			copyrights(sp)
+		}
+	}
+}
+
+// variableRef matches the references to variables.
+var variableRef = regexp.MustCompile(`\$\{\{\s*([^}\s]+)\s*\}\}`)
+
+// lintVariables checks that the variables which the strings under n refer
+// to are defined.  inRange is whether n is a subpackage with a range.
+func (l *configLinter) lintVariables(n *yaml.Node, inRange bool) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		for _, m := range variableRef.FindAllStringSubmatch(n.Value, -1) {
+			if !l.defined(m[1], inRange) {
+				l.report(LintUndefinedVariable, n, "variable %s is not defined", m[1])
+			}
+		}
+	case yaml.MappingNode:
+		if k, _ := mappingEntry(n, "range"); k != nil {
+			inRange = true
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			l.lintVariables(n.Content[i+1], inRange)
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, c := range n.Content {
+			l.lintVariables(c, inRange)
+		}
+	}
+}
+
+// defined returns whether the variable name is defined.  The inputs of the
+// pipelines and the environment are only known during the build.
+func (l *configLinter) defined(name string, inRange bool) bool {
+	switch {
+	case strings.HasPrefix(name, "inputs."), strings.HasPrefix(name, "env."):
+		return true
+	case inRange && (name == "range.key" || name == "range.value"):
+		return true
+	case strings.HasPrefix(name, "vars."):
+		v := strings.TrimPrefix(name, "vars.")
+		if _, ok := l.cfg.Vars[v]; ok {
+			return true
+		}
+		return slices.ContainsFunc(l.cfg.VarTransforms, func(t VarTransforms) bool { return t.To == v })
+	case strings.HasPrefix(name, "options.") && strings.HasSuffix(name, ".enabled"):
+		_, ok := l.cfg.Options[strings.TrimSuffix(strings.TrimPrefix(name, "options."), ".enabled")]
+		return ok
+	case strings.HasPrefix(name, "targets.package."):
+		pkg := strings.TrimPrefix(name, "targets.package.")
+		return pkg == l.cfg.Package.Name || slices.ContainsFunc(l.cfg.Subpackages, func(sp Subpackage) bool { return sp.Name == pkg })
+	}
+
+	return slices.Contains([]string{
+		SubstitutionPackageName,
+		SubstitutionPackageVersion,
+		SubstitutionPackageFullVersion,
+		SubstitutionPackageEpoch,
+		SubstitutionPackageDescription,
+		SubstitutionTargetsDestdir,
+		SubstitutionTargetsContextdir,
+		SubstitutionSubPkgDir,
+		SubstitutionHostTripletGnu,
+		SubstitutionHostTripletRust,
+		SubstitutionCrossTripletGnuGlibc,
+		SubstitutionCrossTripletGnuMusl,
+		SubstitutionCrossTripletRustGlibc,
+		SubstitutionCrossTripletRustMusl,
+		SubstitutionBuildArch,
+	}, "${{"+name+"}}")
+}
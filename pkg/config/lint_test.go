@@ -0,0 +1,168 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	inputs := func(uses string) (map[string]Input, error) {
+		switch uses {
+		case "fetch":
+			return map[string]Input{"uri": {Required: true}, "expected-sha256": {}, "expected-sha512": {}}, nil
+		case "git-checkout":
+			return map[string]Input{"repository": {Required: true}, "tag": {}, "branch": {}, "expected-commit": {}}, nil
+		}
+		return nil, fmt.Errorf("could not find 'uses' pipeline %q", uses)
+	}
+
+	lint := func(t *testing.T, data string) []LintFinding {
+		t.Helper()
+		p := filepath.Join(t.TempDir(), "hello.yaml")
+		require.NoError(t, os.WriteFile(p, []byte(data), 0o644))
+		findings, err := Lint(ctx, p, inputs)
+		require.NoError(t, err)
+		for i := range findings {
+			require.Equal(t, p, findings[i].File)
+			findings[i].File = ""
+		}
+		return findings
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		require.Empty(t, lint(t, `
+package:
+  name: hello
+  version: 1.2.3
+  copyright:
+    - license: Apache-2.0 OR MIT
+vars:
+  tag: v${{package.version}}
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/hello-${{package.version}}.tar.gz
+      expected-sha256: abc
+  - uses: git-checkout
+    with:
+      repository: https://example.com/hello.git
+      tag: ${{vars.tag}}
+      expected-commit: abc
+  - runs: make DESTDIR=${{targets.destdir}} install
+subpackages:
+  - name: hello-doc
+    pipeline:
+      - runs: mv ${{targets.destdir}}/usr/share ${{targets.subpkgdir}}/usr/share
+  - range: docs
+    name: hello-${{range.key}}
+    pipeline:
+      - runs: echo ${{range.value}} > ${{targets.package.hello-doc}}/x
+data:
+  - name: docs
+    items:
+      a: A
+`))
+	})
+
+	t.Run("problems", func(t *testing.T) {
+		got := lint(t, `
+package:
+  name: hello
+  version: 1.2.3
+  copyright:
+    - license: Apache 2
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/hello-latest.tar.gz
+      sha256: abc
+  - uses: git-checkout
+    with:
+      repository: https://example.com/hello.git
+      branch: main
+  - uses: git-checkout
+    with:
+      repository: https://example.com/hello.git
+      tag: v1.2.3
+  - uses: autoconf/nope
+  - runs: echo ${{vars.missing}} ${{package.name}}
+subpackages:
+  - name: hello-doc
+  - name: hello-doc
+    copyright:
+      - license: GPL-2.0-or-later
+  - name: hello
+`)
+		want := []LintFinding{
+			{Check: LintLicense, Line: 6, Message: `license "Apache 2" is not a valid SPDX license expression`},
+			{Check: LintMissingChecksum, Line: 8, Message: "fetch has neither an expected-sha256 nor an expected-sha512"},
+			{Check: LintUnpinnedFetch, Line: 10, Message: "https://example.com/hello-latest.tar.gz does not refer to the version of the package, so what it fetches can change without the build file changing"},
+			{Check: LintUnusedInput, Line: 11, Message: `"sha256" is not an input of pipeline "fetch", which ignores it`},
+			{Check: LintUnpinnedFetch, Line: 12, Message: "git-checkout has neither a tag nor an expected-commit, so what it checks out can change without the build file changing"},
+			{Check: LintMissingChecksum, Line: 16, Message: "git-checkout has no expected-commit for its tag"},
+			{Check: LintUnknownPipeline, Line: 20, Message: `pipeline "autoconf/nope" cannot be loaded: could not find 'uses' pipeline "autoconf/nope"`},
+			{Check: LintUndefinedVariable, Line: 21, Message: "variable vars.missing is not defined"},
+			{Check: LintDuplicateSubpackage, Line: 24, Message: `package "hello-doc" is declared more than once`},
+			{Check: LintDuplicateSubpackage, Line: 27, Message: `package "hello" is declared more than once`},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Lint() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		got := lint(t, `
+package:
+  name: hello
+  version: 1.2.3
+  epoch: many
+pipeline:
+  - uses: fetch
+    wiht:
+      uri: https://example.com
+`)
+		require.Len(t, got, 2)
+		require.Equal(t, LintSchema, got[0].Check)
+		require.Equal(t, 5, got[0].Line)
+		require.Equal(t, LintSchema, got[1].Check)
+		require.Equal(t, 8, got[1].Line)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		got := lint(t, `
+package:
+  name: hello
+  version: 1.2.3
+subpackages:
+  - name: hello doc
+`)
+		require.Len(t, got, 1)
+		require.Equal(t, LintInvalid, got[0].Check)
+		require.Contains(t, got[0].Message, `subpackage name "hello doc" (subpackages index: 0) must match regex`)
+	})
+
+	_, err := Lint(ctx, filepath.Join(t.TempDir(), "missing.yaml"), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,316 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// schemaJSON is generated from Configuration by internal/gen-jsonschema.
+//
+//go:embed schema.json
+var schemaJSON []byte
+
+// schema is the subset of JSON schema used by the generated schema.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Defs                 map[string]*schema `json:"$defs"`
+	Type                 string             `json:"type"`
+	OneOf                []*schema          `json:"oneOf"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Required             []string           `json:"required"`
+}
+
+var (
+	loadSchemaOnce sync.Once
+	rootSchema     *schema
+	errSchema      error
+)
+
+func loadSchema() (*schema, error) {
+	loadSchemaOnce.Do(func() {
+		rootSchema = &schema{}
+		errSchema = json.Unmarshal(schemaJSON, rootSchema)
+	})
+
+	return rootSchema, errSchema
+}
+
+// maxSchemaErrors is the number of problems reported before giving up.
+const maxSchemaErrors = 20
+
+// SchemaError is a problem found while validating a configuration file
+// against its schema.
+type SchemaError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// Location returns the file and line of the problem.
+func (e SchemaError) Location() (string, int) {
+	return e.File, e.Line
+}
+
+type schemaValidator struct {
+	root *schema
+	file string
+	errs []error
+}
+
+func (v *schemaValidator) report(n *yaml.Node, format string, args ...any) {
+	v.errs = append(v.errs, SchemaError{
+		File:    v.file,
+		Line:    n.Line,
+		Column:  n.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *schemaValidator) resolve(s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = v.root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+
+	return s
+}
+
+// matches returns whether n has the type required by s, without reporting
+// anything.
+func (v *schemaValidator) matches(n *yaml.Node, s *schema) bool {
+	saved := v.errs
+	v.errs = nil
+	v.validate(n, s, "")
+	ok := len(v.errs) == 0
+	v.errs = saved
+
+	return ok
+}
+
+func kindName(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a map"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+
+	switch n.Tag {
+	case "!!int":
+		return "an integer"
+	case "!!bool":
+		return "a boolean"
+	case "!!float":
+		return "a number"
+	}
+
+	return fmt.Sprintf("%q", n.Value)
+}
+
+func (v *schemaValidator) validate(n *yaml.Node, s *schema, path string) {
+	if len(v.errs) >= maxSchemaErrors {
+		return
+	}
+
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	s = v.resolve(s)
+	if s == nil {
+		return
+	}
+
+	// A null value decodes to the zero value of any type.
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+
+	if len(s.OneOf) != 0 {
+		for _, alt := range s.OneOf {
+			if v.matches(n, alt) {
+				return
+			}
+		}
+		v.report(n, "%s has an invalid value %s", path, kindName(n))
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		if n.Kind != yaml.MappingNode {
+			v.report(n, "%s must be a map, not %s", path, kindName(n))
+			return
+		}
+		v.validateMap(n, s, path)
+
+	case "array":
+		if n.Kind != yaml.SequenceNode {
+			v.report(n, "%s must be a list, not %s", path, kindName(n))
+			return
+		}
+		for i, item := range n.Content {
+			v.validate(item, s.Items, fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case "string":
+		if n.Kind != yaml.ScalarNode {
+			v.report(n, "%s must be a string, not %s", path, kindName(n))
+		}
+
+	case "integer":
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!int" {
+			v.report(n, "%s must be an integer, not %s", path, kindName(n))
+		}
+
+	case "boolean":
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!bool" {
+			v.report(n, "%s must be true or false, not %s", path, kindName(n))
+		}
+	}
+}
+
+func (v *schemaValidator) validateMap(n *yaml.Node, s *schema, path string) {
+	var additional *schema
+	closed := false
+	if len(s.AdditionalProperties) != 0 {
+		if string(s.AdditionalProperties) == "false" {
+			closed = true
+		} else if string(s.AdditionalProperties) != "true" {
+			additional = &schema{}
+			if err := json.Unmarshal(s.AdditionalProperties, additional); err != nil {
+				additional = nil
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+
+		// Merge keys are expanded by the decoder.
+		if key.Tag == "!!merge" {
+			continue
+		}
+
+		keyPath := key.Value
+		if path != "" {
+			keyPath = path + "." + key.Value
+		}
+
+		if seen[key.Value] {
+			v.report(key, "%s is defined more than once", keyPath)
+			continue
+		}
+		seen[key.Value] = true
+
+		if prop, ok := s.Properties[key.Value]; ok {
+			v.validate(value, prop, keyPath)
+		} else if additional != nil {
+			v.validate(value, additional, keyPath)
+		} else if closed {
+			if suggestion := closestName(key.Value, s.Properties); suggestion != "" {
+				v.report(key, "unknown field %s, did you mean %s?", keyPath, suggestion)
+			} else {
+				v.report(key, "unknown field %s", keyPath)
+			}
+		}
+	}
+
+	for _, req := range s.Required {
+		if !seen[req] {
+			if path != "" {
+				v.report(n, "%s is missing required field %s", path, req)
+			} else {
+				v.report(n, "missing required field %s", req)
+			}
+		}
+	}
+}
+
+// closestName returns the property which is closest to name, if it is close
+// enough to be a likely typo.
+func closestName(name string, props map[string]*schema) string {
+	names := make([]string, 0, len(props))
+	for prop := range props {
+		names = append(names, prop)
+	}
+	sort.Strings(names)
+
+	best, bestDist := "", len(name)/3+1
+	for _, prop := range names {
+		if d := editDistance(name, prop); d <= bestDist && (best == "" || d < editDistance(name, best)) {
+			best = prop
+		}
+	}
+
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+// validateSchema validates the document in root against the configuration
+// schema, reporting unknown fields, values of the wrong type and missing
+// required fields along with their position in file.
+func validateSchema(file string, root *yaml.Node) error {
+	s, err := loadSchema()
+	if err != nil {
+		return fmt.Errorf("loading configuration schema: %w", err)
+	}
+
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+
+	v := &schemaValidator{root: s, file: file}
+	v.validate(root.Content[0], s, "")
+
+	return errors.Join(v.errs...)
+}
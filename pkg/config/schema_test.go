@@ -0,0 +1,110 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, c := range []struct {
+		name, config string
+		want         []string
+	}{{
+		name: "valid",
+		config: `
+package:
+  name: hello
+  version: 1.0.0
+  epoch: 0
+  timeout: 10m
+  dependencies:
+    runtime:
+      - busybox
+pipeline:
+  - uses: fetch
+    with:
+      expected-sha256: 0
+      extract: true
+`,
+	}, {
+		name: "typo",
+		config: `
+package:
+  name: hello
+  version: 1.0.0
+  dependancies:
+    runtime:
+      - busybox
+`,
+		want: []string{"melange.yaml:5:3: unknown field package.dependancies, did you mean dependencies?"},
+	}, {
+		name: "types",
+		config: `
+package:
+  name: hello
+  version: 1.0.0
+  epoch: one
+  options:
+    no-provides: maybe
+subpackages:
+  name: hello-dev
+`,
+		want: []string{
+			`melange.yaml:5:10: package.epoch must be an integer, not "one"`,
+			`melange.yaml:7:18: package.options.no-provides must be true or false, not "maybe"`,
+			`melange.yaml:9:3: subpackages must be a list, not a map`,
+		},
+	}, {
+		name: "missing",
+		config: `
+package:
+  name: hello
+subpackages:
+  - description: no name
+  - name: hello-doc
+  - name: hello-doc
+    name: hello-dev
+`,
+		want: []string{
+			`melange.yaml:3:3: package is missing required field version`,
+			`melange.yaml:5:5: subpackages[0] is missing required field name`,
+			`melange.yaml:8:5: subpackages[2].name is defined more than once`,
+		},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "melange.yaml"), []byte(c.config), 0o644))
+
+			_, err := ParseConfiguration(ctx, "melange.yaml", WithFS(os.DirFS(dir)))
+			if len(c.want) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorAs(t, err, &ErrInvalidConfiguration{})
+			for _, want := range c.want {
+				require.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
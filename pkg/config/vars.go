@@ -17,8 +17,11 @@ package config
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
-	"chainguard.dev/melange/pkg/util"
+	"chainguard.dev/melange/pkg/cond"
 )
 
 const (
@@ -39,41 +42,160 @@ const (
 	SubstitutionBuildArch             = "${{build.arch}}"
 )
 
-// Get variables from configuration and return them in a map
-func (cfg Configuration) GetVarsFromConfig() (map[string]string, error) {
-	nw := map[string]string{}
+// variables resolves substitutions lazily, so that vars, var-transforms
+// and the package fields may refer to each other in any order.
+type variables struct {
+	// fixed are the substitutions whose values are known.
+	fixed map[string]string
+	// templates are substituted themselves to get their values.
+	templates map[string]string
+	// transforms compute their values from the substituted from values.
+	transforms map[string]VarTransforms
+
+	resolved  map[string]string
+	resolving map[string]bool
+}
 
-	for k, v := range cfg.Vars {
-		nk := fmt.Sprintf("${{vars.%s}}", k)
+// newVariables returns the variables of the configuration: its vars,
+// optionally its var-transforms, and the environment of the build as
+// ${{env.NAME}}, on top of the fixed substitutions.
+func newVariables(cfg *Configuration, fixed map[string]string, withTransforms bool) *variables {
+	v := &variables{
+		fixed:      map[string]string{},
+		templates:  map[string]string{},
+		transforms: map[string]VarTransforms{},
+		resolved:   map[string]string{},
+		resolving:  map[string]bool{},
+	}
 
-		nv, err := util.MutateStringFromMap(nw, v)
-		if err != nil {
-			return nil, err
+	for k, val := range cfg.Environment.Environment {
+		v.fixed[fmt.Sprintf("${{env.%s}}", k)] = val
+	}
+	for k, val := range fixed {
+		v.fixed[k] = val
+	}
+	for k, val := range cfg.Vars {
+		v.templates[fmt.Sprintf("${{vars.%s}}", k)] = val
+	}
+	if withTransforms {
+		for _, t := range cfg.VarTransforms {
+			v.transforms[fmt.Sprintf("${{vars.%s}}", t.To)] = t
 		}
+	}
 
-		nw[nk] = nv
+	return v
+}
+
+// lookup returns the value of the variable name, e.g. vars.foo.
+func (v *variables) lookup(name string) (string, error) {
+	key := fmt.Sprintf("${{%s}}", name)
+	if val, ok := v.resolved[key]; ok {
+		return val, nil
 	}
 
-	return nw, nil
+	t, isTransform := v.transforms[key]
+	tmpl, isTemplate := v.templates[key]
+	if !isTransform && !isTemplate {
+		if val, ok := v.fixed[key]; ok {
+			return val, nil
+		}
+		return "", fmt.Errorf("variable %s not defined", name)
+	}
+
+	if v.resolving[key] {
+		return "", fmt.Errorf("variable %s refers to itself", name)
+	}
+	v.resolving[key] = true
+	defer delete(v.resolving, key)
+
+	var val string
+	var err error
+	if isTransform {
+		val, err = v.transform(t)
+	} else {
+		val, err = cond.Subst(tmpl, v.lookup)
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", name, err)
+	}
+
+	v.resolved[key] = val
+	return val, nil
 }
 
-// Perform variable substitutions from the configuration on a given map
-func (cfg Configuration) PerformVarSubstitutions(nw map[string]string) error {
-	for _, v := range cfg.VarTransforms {
-		nk := fmt.Sprintf("${{vars.%s}}", v.To)
-		from, err := util.MutateStringFromMap(nw, v.From)
-		if err != nil {
+// transform applies a var-transform to its substituted from value.
+func (v *variables) transform(t VarTransforms) (string, error) {
+	from, err := cond.Subst(t.From, v.lookup)
+	if err != nil {
+		return "", err
+	}
+
+	re, err := regexp.Compile(t.Match)
+	if err != nil {
+		return "", fmt.Errorf("match value: %s string does not compile into a regex: %w", t.Match, err)
+	}
+
+	return re.ReplaceAllString(from, t.Replace), nil
+}
+
+// resolve adds the environment and the resolved templates and transforms
+// to nw.  If lenient, the variables which cannot be resolved are left out
+// rather than failing.
+func (v *variables) resolve(nw map[string]string, lenient bool) error {
+	keys := []string{}
+	for k := range v.templates {
+		keys = append(keys, k)
+	}
+	for k := range v.transforms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := strings.TrimSuffix(strings.TrimPrefix(k, "${{"), "}}")
+		if _, err := v.lookup(name); err != nil && !lenient {
 			return err
 		}
+	}
 
-		re, err := regexp.Compile(v.Match)
-		if err != nil {
-			return fmt.Errorf("match value: %s string does not compile into a regex: %w", v.Match, err)
+	for k, val := range v.fixed {
+		if strings.HasPrefix(k, "${{env.") {
+			nw[k] = val
 		}
-
-		output := re.ReplaceAllString(from, v.Replace)
-		nw[nk] = output
+	}
+	for k, val := range v.resolved {
+		nw[k] = val
 	}
 
 	return nil
 }
+
+// Get variables from configuration and return them in a map.  Vars may
+// refer to the package fields, the environment as ${{env.NAME}} and each
+// other.
+func (cfg Configuration) GetVarsFromConfig() (map[string]string, error) {
+	nw := map[string]string{}
+	if err := newVariables(&cfg, packageSubstitutions(&cfg), false).resolve(nw, false); err != nil {
+		return nil, err
+	}
+
+	return nw, nil
+}
+
+// Perform variable substitutions from the configuration on a given map:
+// the vars and var-transforms are resolved against the substitutions in the
+// map, and each other, and added to it.
+func (cfg Configuration) PerformVarSubstitutions(nw map[string]string) error {
+	return newVariables(&cfg, nw, true).resolve(nw, false)
+}
+
+// packageSubstitutions returns the substitutions of the package fields.
+func packageSubstitutions(cfg *Configuration) map[string]string {
+	return map[string]string{
+		SubstitutionPackageName:        cfg.Package.Name,
+		SubstitutionPackageVersion:     cfg.Package.Version,
+		SubstitutionPackageDescription: cfg.Package.Description,
+		SubstitutionPackageEpoch:       strconv.FormatUint(cfg.Package.Epoch, 10),
+		SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%d", cfg.Package.Version, cfg.Package.Epoch),
+	}
+}
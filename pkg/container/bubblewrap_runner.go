@@ -17,12 +17,14 @@ package container
 import (
 	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	apko_build "chainguard.dev/apko/pkg/build"
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -30,13 +32,29 @@ import (
 	"github.com/chainguard-dev/clog"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/sys/unix"
 )
 
 var _ Debugger = (*bubblewrap)(nil)
+var _ NetworkIsolator = (*bubblewrap)(nil)
+var _ RootlessRunner = (*bubblewrap)(nil)
 
 const BubblewrapName = "bubblewrap"
 
+// BubblewrapSandboxName is the name of the bubblewrap runner which isolates
+// the build further, for untrusted packages.
+const BubblewrapSandboxName = "bubblewrap-sandbox"
+
+// sandboxSystemDirs are the directories of the guest which the sandbox
+// mounts read-only.
+var sandboxSystemDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib64"}
+
 type bubblewrap struct {
+	// sandbox mounts the system directories of the guest read-only and /tmp
+	// on a tmpfs, drops all capabilities and unshares every namespace.
+	sandbox bool
+	// binds are the extra bind mounts of the sandbox.
+	binds []BindMount
 }
 
 // BubblewrapRunner returns a Bubblewrap Runner implementation.
@@ -44,15 +62,47 @@ func BubblewrapRunner() Runner {
 	return &bubblewrap{}
 }
 
+// BubblewrapSandboxRunner returns a Bubblewrap Runner implementation which
+// isolates the build further: the system directories of the guest are
+// read-only, /tmp is a tmpfs, and the commands run without capabilities in
+// their own IPC, UTS and cgroup namespaces.  binds are mounted on top of the
+// mounts of the build.  As with every bubblewrap runner, the commands cannot
+// gain privileges, e.g. through setuid executables.
+func BubblewrapSandboxRunner(binds []BindMount) Runner {
+	return &bubblewrap{sandbox: true, binds: binds}
+}
+
 func (bw *bubblewrap) Close() error {
 	return nil
 }
 
 // Name name of the runner
 func (bw *bubblewrap) Name() string {
+	if bw.sandbox {
+		return BubblewrapSandboxName
+	}
 	return BubblewrapName
 }
 
+// IsolatesNetwork implements NetworkIsolator.
+func (bw *bubblewrap) IsolatesNetwork() bool {
+	return true
+}
+
+// rootlessArgs are the arguments of bwrap which run the command as root in a
+// new user namespace, which maps only the user running melange.
+var rootlessArgs = []string{"--unshare-user", "--uid", "0", "--gid", "0"}
+
+// TestRootless implements RootlessRunner.
+func (bw *bubblewrap) TestRootless(ctx context.Context) error {
+	args := append(append([]string{}, rootlessArgs...), "--ro-bind", "/", "/", "true")
+	if out, err := exec.CommandContext(ctx, "bwrap", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("bwrap cannot create user namespaces: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
 // Run runs a Bubblewrap task given a Config and command string.
 func (bw *bubblewrap) Run(ctx context.Context, cfg *Config, args ...string) error {
 	execCmd := bw.cmd(ctx, cfg, false, args...)
@@ -65,7 +115,23 @@ func (bw *bubblewrap) Run(ctx context.Context, cfg *Config, args ...string) erro
 	execCmd.Stdout = stdout
 	execCmd.Stderr = stderr
 
-	return execCmd.Run()
+	// bwrap exits with the status of the command.
+	var exitErr *exec.ExitError
+	if err := execCmd.Run(); errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &ExitError{Code: exitErr.ExitCode()}
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// bindArgs returns the arguments of bwrap which mount bind.
+func bindArgs(bind BindMount) []string {
+	if bind.ReadOnly {
+		return []string{"--ro-bind", bind.Source, bind.Destination}
+	}
+	return []string{"--bind", bind.Source, bind.Destination}
 }
 
 func (bw *bubblewrap) cmd(ctx context.Context, cfg *Config, debug bool, args ...string) *exec.Cmd {
@@ -74,16 +140,35 @@ func (bw *bubblewrap) cmd(ctx context.Context, cfg *Config, debug bool, args ...
 	// always be sure to mount the / first!
 	baseargs = append(baseargs, "--bind", cfg.ImgRef, "/")
 
+	if bw.sandbox {
+		for _, dir := range sandboxSystemDirs {
+			// Symlinks, e.g. /lib64 pointing at /lib, are left alone.
+			if fi, err := os.Lstat(filepath.Join(cfg.ImgRef, dir)); err == nil && fi.IsDir() {
+				baseargs = append(baseargs, "--ro-bind", filepath.Join(cfg.ImgRef, dir), dir)
+			}
+		}
+		baseargs = append(baseargs, "--tmpfs", "/tmp")
+	}
+
 	for _, bind := range cfg.Mounts {
-		baseargs = append(baseargs, "--bind", bind.Source, bind.Destination)
+		baseargs = append(baseargs, bindArgs(bind)...)
+	}
+	if bw.sandbox {
+		for _, bind := range bw.binds {
+			baseargs = append(baseargs, bindArgs(bind)...)
+		}
+		baseargs = append(baseargs, "--cap-drop", "ALL", "--unshare-ipc", "--unshare-uts", "--unshare-cgroup-try")
 	}
 	// add the ref of the directory
 
+	if cfg.Rootless {
+		baseargs = append(baseargs, rootlessArgs...)
+	}
+
 	baseargs = append(baseargs, "--unshare-pid", "--die-with-parent",
 		"--dev", "/dev",
 		"--proc", "/proc",
-		"--chdir", runnerWorkdir,
-		"--clearenv")
+		"--chdir", runnerWorkdir)
 
 	if !debug {
 		// This flag breaks job control, which we only care about for --interactive debugging.
@@ -95,13 +180,17 @@ func (bw *bubblewrap) cmd(ctx context.Context, cfg *Config, debug bool, args ...
 		baseargs = append(baseargs, "--unshare-net")
 	}
 
-	for k, v := range cfg.Environment {
-		baseargs = append(baseargs, "--setenv", k, v)
-	}
-
 	args = append(baseargs, args...)
 	execCmd := exec.CommandContext(ctx, "bwrap", args...)
 
+	// The environment is passed through that of bwrap, which the guest
+	// inherits, rather than with --setenv: the arguments of a process can
+	// be read by anyone, and the environment includes the secrets.
+	execCmd.Env = []string{}
+	for k, v := range cfg.Environment {
+		execCmd.Env = append(execCmd.Env, k+"="+v)
+	}
+
 	clog.FromContext(ctx).Infof("executing: %s", strings.Join(execCmd.Args, " "))
 
 	return execCmd
@@ -163,16 +252,51 @@ func (bw *bubblewrap) WorkspaceTar(ctx context.Context, cfg *Config) (io.ReadClo
 
 type bubblewrapOCILoader struct{}
 
+// guestLocks holds the flock(2) locks on the guest directories of the
+// images loaded by bubblewrap, by path, until they are removed.  Like those
+// melange takes on its other temporary directories, they keep the guests of
+// running builds from being removed as the debris of crashed ones.
+var guestLocks sync.Map
+
+// lockGuest takes an exclusive lock on the guest directory dir.
+func lockGuest(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		return fmt.Errorf("locking %s: %w", dir, err)
+	}
+	guestLocks.Store(dir, f)
+	return nil
+}
+
+// unlockGuest releases the lock on the guest directory dir, if any.
+func unlockGuest(dir string) error {
+	f, ok := guestLocks.LoadAndDelete(dir)
+	if !ok {
+		return nil
+	}
+	return f.(*os.File).Close()
+}
+
 func (b bubblewrapOCILoader) LoadImage(ctx context.Context, layer v1.Layer, arch apko_types.Architecture, bc *apko_build.Context) (ref string, err error) {
 	_, span := otel.Tracer("melange").Start(ctx, "bubblewrap.LoadImage")
 	defer span.End()
 
 	// bubblewrap does not have the idea of container images or layers or such, just
-	// straight out chroot, so we create the guest dir
-	guestDir, err := os.MkdirTemp("", "melange-guest-*")
+	// straight out chroot, so we create the guest dir.  It is locked, and
+	// named like the temporary directories which builds lock, for them to
+	// clean it up if melange crashes.
+	guestDir, err := os.MkdirTemp("", "melange-locked-guest-*")
 	if err != nil {
 		return ref, fmt.Errorf("failed to create guest dir: %w", err)
 	}
+	if err := lockGuest(guestDir); err != nil {
+		os.RemoveAll(guestDir)
+		return ref, fmt.Errorf("failed to lock guest dir: %w", err)
+	}
 	rc, err := layer.Uncompressed()
 	if err != nil {
 		return ref, fmt.Errorf("failed to read layer tarball: %w", err)
@@ -219,5 +343,6 @@ func (b bubblewrapOCILoader) LoadImage(ctx context.Context, layer v1.Layer, arch
 
 func (b bubblewrapOCILoader) RemoveImage(ctx context.Context, ref string) error {
 	clog.FromContext(ctx).Infof("removing image path %s", ref)
-	return os.RemoveAll(ref)
+	err := os.RemoveAll(ref)
+	return errors.Join(err, unlockGuest(ref))
 }
@@ -0,0 +1,100 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseBindMount(t *testing.T) {
+	bm, err := ParseBindMount("/srv/mirror:/mirror")
+	require.NoError(t, err)
+	require.Equal(t, BindMount{Source: "/srv/mirror", Destination: "/mirror"}, bm)
+
+	bm, err = ParseBindMount("/srv/mirror:/mirror:ro")
+	require.NoError(t, err)
+	require.Equal(t, BindMount{Source: "/srv/mirror", Destination: "/mirror", ReadOnly: true}, bm)
+
+	for _, s := range []string{"/srv/mirror", "/srv/mirror:mirror", ":/mirror", "/srv/mirror:/mirror:rw"} {
+		_, err := ParseBindMount(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestBubblewrapSandbox(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	guest := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "usr", "bin"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "lib"), 0o755))
+	require.NoError(t, os.Symlink("lib", filepath.Join(guest, "lib64")))
+
+	cfg := &Config{
+		ImgRef:       guest,
+		Mounts:       []BindMount{{Source: "/tmp/ws", Destination: DefaultWorkspaceDir}},
+		Capabilities: Capabilities{Networking: true},
+		Environment:  map[string]string{"TOKEN": "s3cr3t"},
+	}
+
+	bw := BubblewrapRunner().(*bubblewrap)
+	require.Equal(t, BubblewrapName, bw.Name())
+	args := strings.Join(bw.cmd(ctx, cfg, false, "true").Args, " ")
+	require.NotContains(t, args, "--ro-bind")
+	require.NotContains(t, args, "--tmpfs")
+	require.NotContains(t, args, "--cap-drop")
+
+	// The environment is not in the arguments, where anyone could read the
+	// secrets.
+	cmd := bw.cmd(ctx, cfg, false, "true")
+	require.NotContains(t, strings.Join(cmd.Args, " "), "s3cr3t")
+	require.Equal(t, []string{"TOKEN=s3cr3t"}, cmd.Env)
+
+	bw = BubblewrapSandboxRunner([]BindMount{{Source: "/srv/mirror", Destination: "/mirror", ReadOnly: true}}).(*bubblewrap)
+	require.Equal(t, BubblewrapSandboxName, bw.Name())
+	args = strings.Join(bw.cmd(ctx, cfg, false, "true").Args, " ")
+	for _, want := range []string{
+		"--bind " + guest + " / --ro-bind " + guest + "/usr /usr --ro-bind " + guest + "/lib /lib --tmpfs /tmp --bind /tmp/ws /home/build --ro-bind /srv/mirror /mirror",
+		"--cap-drop ALL --unshare-ipc --unshare-uts --unshare-cgroup-try",
+	} {
+		require.Contains(t, args, want)
+	}
+	require.NotContains(t, args, "/lib64")
+}
+
+func TestBubblewrapGuestLock(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, lockGuest(dir))
+
+	// The guest is locked until it is removed, so that melange does not
+	// take it for the debris of a crashed build.
+	locked := func() bool {
+		f, err := os.Open(dir)
+		require.NoError(t, err)
+		defer f.Close()
+		return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) != nil
+	}
+	require.True(t, locked())
+
+	require.NoError(t, unlockGuest(dir))
+	require.False(t, locked())
+	require.NoError(t, unlockGuest(dir))
+}
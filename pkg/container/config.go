@@ -15,6 +15,9 @@
 package container
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -31,11 +34,36 @@ const (
 	DefaultCacheDir = "/var/cache/melange"
 	// DefaultResolvConfPath is the default path to the resolv.conf file in the runner's environment.
 	DefaultResolvConfPath = "/etc/resolv.conf"
+	// DefaultHostsPath is the default path to the hosts file in the runner's environment.
+	DefaultHostsPath = "/etc/hosts"
 )
 
 type BindMount struct {
 	Source      string
 	Destination string
+	// ReadOnly mounts the source read-only, for the runners which support
+	// it.
+	ReadOnly bool
+}
+
+// ParseBindMount parses a bind mount given as source:destination, with an
+// optional :ro suffix which makes it read-only.
+func ParseBindMount(s string) (BindMount, error) {
+	parts := strings.Split(s, ":")
+	bm := BindMount{}
+	switch {
+	case len(parts) == 3 && parts[2] == "ro":
+		bm.ReadOnly = true
+	case len(parts) != 2:
+		return BindMount{}, fmt.Errorf("invalid bind mount %q, must be source:destination[:ro]", s)
+	}
+	bm.Source, bm.Destination = parts[0], parts[1]
+
+	if bm.Source == "" || !filepath.IsAbs(bm.Destination) {
+		return BindMount{}, fmt.Errorf("invalid bind mount %q, must have a source and an absolute destination", s)
+	}
+
+	return bm, nil
 }
 
 type Capabilities struct {
@@ -53,4 +81,7 @@ type Config struct {
 	WorkspaceDir string
 	CPU, Memory  string
 	Timeout      time.Duration
+	// Rootless runs the commands in a user namespace in which the user
+	// running melange is root, for runners implementing RootlessRunner.
+	Rootless bool
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"go.opentelemetry.io/otel"
 	"golang.org/x/sync/errgroup"
@@ -36,7 +37,9 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	image_spec "github.com/opencontainers/image-spec/specs-go/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
@@ -45,6 +48,7 @@ var _ mcontainer.Debugger = (*docker)(nil)
 
 const (
 	DockerName = "docker"
+	PodmanName = "podman"
 
 	runnerWorkdir = "/home/build"
 )
@@ -52,6 +56,8 @@ const (
 // docker is a Runner implementation that uses the docker library.
 type docker struct {
 	cli *client.Client
+	// name is the name of the runner, as podman serves the Docker API too.
+	name string
 }
 
 // NewRunner returns a Docker Runner implementation.
@@ -62,12 +68,45 @@ func NewRunner(ctx context.Context) (mcontainer.Runner, error) {
 	}
 
 	return &docker{
-		cli: cli,
+		cli:  cli,
+		name: DockerName,
 	}, nil
 }
 
+// NewPodmanRunner returns a Runner implementation which uses the Docker
+// compatible API of podman, at the address podmanHost returns.
+func NewPodmanRunner(ctx context.Context) (mcontainer.Runner, error) {
+	cli, err := client.NewClientWithOpts(client.WithHost(podmanHost()), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	return &docker{
+		cli:  cli,
+		name: PodmanName,
+	}, nil
+}
+
+// podmanHost returns the address of the API of podman: the CONTAINER_HOST
+// environment variable, or the socket of the podman service of the user if
+// it exists, or the socket of the system one.
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sock := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(sock); err == nil {
+			return "unix://" + sock
+		}
+	}
+
+	return "unix:///run/podman/podman.sock"
+}
+
 func (dk *docker) Name() string {
-	return DockerName
+	return dk.name
 }
 
 func (dk *docker) Close() error {
@@ -85,9 +124,10 @@ func (dk *docker) StartPod(ctx context.Context, cfg *mcontainer.Config) error {
 	mounts := []mount.Mount{}
 	for _, bind := range cfg.Mounts {
 		mounts = append(mounts, mount.Mount{
-			Type:   mount.TypeBind,
-			Source: bind.Source,
-			Target: bind.Destination,
+			Type:     mount.TypeBind,
+			Source:   bind.Source,
+			Target:   bind.Destination,
+			ReadOnly: bind.ReadOnly,
 		})
 	}
 
@@ -167,7 +207,7 @@ func (dk *docker) TerminatePod(ctx context.Context, cfg *mcontainer.Config) erro
 func (dk *docker) TestUsability(ctx context.Context) bool {
 	log := clog.FromContext(ctx)
 	if _, err := dk.cli.Ping(ctx); err != nil {
-		log.Infof("cannot use docker for containers: %v", err)
+		log.Infof("cannot use %s for containers: %v", dk.name, err)
 		return false
 	}
 
@@ -256,7 +296,7 @@ func (dk *docker) Run(ctx context.Context, cfg *mcontainer.Config, args ...strin
 	case 0:
 		return nil
 	default:
-		return fmt.Errorf("task exited with code %d", inspectResp.ExitCode)
+		return &mcontainer.ExitError{Code: inspectResp.ExitCode}
 	}
 }
 
@@ -352,7 +392,7 @@ func (dk *docker) Debug(ctx context.Context, cfg *mcontainer.Config, args ...str
 	case 0:
 		return nil
 	default:
-		return fmt.Errorf("task exited with code %d", inspectResp.ExitCode)
+		return &mcontainer.ExitError{Code: inspectResp.ExitCode}
 	}
 }
 
@@ -380,10 +420,21 @@ func (d *dockerLoader) LoadImage(ctx context.Context, layer v1.Layer, arch apko_
 		return "", err
 	}
 
-	ref, err := apko_oci.LoadImage(ctx, img, []string{"melange:latest"})
+	// The image is written with the client of the runner, which may not be
+	// the daemon of the environment, e.g. for podman.
+	hash, err := img.Digest()
 	if err != nil {
 		return "", err
 	}
+	ref, err := name.NewTag(fmt.Sprintf("%s/%s:%s", apko_oci.LocalDomain, apko_oci.LocalRepo, hash.Hex))
+	if err != nil {
+		return "", err
+	}
+	clog.FromContext(ctx).Infof("saving OCI image locally: %s", ref.Name())
+	if _, err := daemon.Write(ref, img, daemon.WithContext(ctx), daemon.WithClient(d.cli)); err != nil {
+		return "", fmt.Errorf("failed to save OCI image locally: %w", err)
+	}
+
 	return ref.String(), nil
 }
 
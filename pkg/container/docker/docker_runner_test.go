@@ -0,0 +1,38 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPodmanHost(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CONTAINER_HOST", "")
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	require.Equal(t, "unix:///run/podman/podman.sock", podmanHost())
+
+	sock := filepath.Join(dir, "podman", "podman.sock")
+	require.NoError(t, os.MkdirAll(filepath.Dir(sock), 0o755))
+	require.NoError(t, os.WriteFile(sock, nil, 0o600))
+	require.Equal(t, "unix://"+sock, podmanHost())
+
+	t.Setenv("CONTAINER_HOST", "tcp://127.0.0.1:8080")
+	require.Equal(t, "tcp://127.0.0.1:8080", podmanHost())
+}
@@ -423,6 +423,11 @@ func (k *k8s) filterMounts(ctx context.Context, mount container.BindMount) bool
 		return true
 	}
 
+	if mount.Destination == container.DefaultResolvConfPath || mount.Destination == container.DefaultHostsPath {
+		log.Warnf("skipping k8s runner unsupported resolver override %s -> %s", mount.Source, mount.Destination)
+		return true
+	}
+
 	if mount.Destination == container.DefaultCacheDir {
 		log.Warnf("skipping k8s runner irrelevant cache mount %s -> %s", mount.Source, mount.Destination)
 		return true
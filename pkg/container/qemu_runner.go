@@ -0,0 +1,399 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"chainguard.dev/melange/internal/logwriter"
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var _ Debugger = (*qemu)(nil)
+var _ NetworkIsolator = (*qemu)(nil)
+
+const QEMUName = "qemu"
+
+// QEMUKernelEnv names the environment variable holding the path of the
+// kernel booted by the QEMU runner.  The kernel must have virtio, 9p and
+// devtmpfs support built in.
+const QEMUKernelEnv = "QEMU_KERNEL_IMAGE"
+
+// qemuControlDir is where the commands run in the VM and their exit status
+// are exchanged, relative to the guest root.
+const qemuControlDir = ".melange-vm"
+
+// qemuInit mounts the virtual filesystems and the shared directories, runs
+// the command and powers the VM off.  The exit status of the command is
+// written to the control directory, as the exit status of the VM does not
+// carry it.
+const qemuInit = `#!/bin/sh
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev
+mkdir -p /dev/pts /dev/shm
+mount -t devpts devpts /dev/pts
+mount -t tmpfs tmpfs /dev/shm
+. /.melange-vm/mounts
+ip link set lo up 2>/dev/null
+if [ -f /.melange-vm/network ]; then
+  ip link set eth0 up
+  ip addr add 10.0.2.15/24 dev eth0
+  ip route add default via 10.0.2.2
+fi
+cd /home/build
+(
+  . /.melange-vm/env
+  . /.melange-vm/cmd
+)
+echo $? > /.melange-vm/status
+sync
+echo o > /proc/sysrq-trigger
+`
+
+type qemu struct {
+	kernel string
+}
+
+// QEMURunner returns a Runner which runs each command in a QEMU virtual
+// machine booted from the build environment.  It is meant for packages
+// which need kernel features containers cannot provide, like loading
+// kernel modules, nested containers or specific sysctls.
+func QEMURunner() Runner {
+	return &qemu{kernel: os.Getenv(QEMUKernelEnv)}
+}
+
+func (q *qemu) Close() error {
+	return nil
+}
+
+// Name name of the runner
+func (q *qemu) Name() string {
+	return QEMUName
+}
+
+// IsolatesNetwork implements NetworkIsolator.
+func (q *qemu) IsolatesNetwork() bool {
+	return true
+}
+
+// shellQuote quotes s for use in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// qemuMachine returns the QEMU binary, machine type and console device for
+// an architecture.
+func qemuMachine(arch string) (binary, machine, console string, err error) {
+	switch arch {
+	case "x86_64":
+		return "qemu-system-x86_64", "microvm", "ttyS0", nil
+	case "aarch64":
+		return "qemu-system-aarch64", "virt", "ttyAMA0", nil
+	case "riscv64":
+		return "qemu-system-riscv64", "virt", "ttyS0", nil
+	}
+
+	return "", "", "", fmt.Errorf("the qemu runner does not support %s", arch)
+}
+
+// prepare writes the init script and the command to run into the guest,
+// and returns the mounts to share with it.  9p only shares directories, so
+// the files mounted, like /etc/resolv.conf or the secrets, are copied into
+// the guest instead.
+func (q *qemu) prepare(cfg *Config, args []string) ([]BindMount, error) {
+	dir := filepath.Join(cfg.ImgRef, qemuControlDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{"init": qemuInit}
+
+	shared := []BindMount{}
+	mounts := strings.Builder{}
+	for _, bind := range cfg.Mounts {
+		fi, err := os.Stat(bind.Source)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := copyIntoGuest(cfg.ImgRef, bind, fi.Mode().Perm()); err != nil {
+				return nil, fmt.Errorf("copying %s into the guest: %w", bind.Source, err)
+			}
+			continue
+		}
+
+		fmt.Fprintf(&mounts, "mkdir -p %s\n", shellQuote(bind.Destination))
+		fmt.Fprintf(&mounts, "mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 mount%d %s\n", len(shared), shellQuote(bind.Destination))
+		shared = append(shared, bind)
+	}
+	files["mounts"] = mounts.String()
+
+	keys := make([]string, 0, len(cfg.Environment))
+	for k := range cfg.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	env := strings.Builder{}
+	for _, k := range keys {
+		fmt.Fprintf(&env, "export %s=%s\n", k, shellQuote(cfg.Environment[k]))
+	}
+	files["env"] = env.String()
+
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	files["cmd"] = strings.Join(quoted, " ") + "\n"
+
+	if cfg.Capabilities.Networking {
+		files["network"] = ""
+	} else if err := os.Remove(filepath.Join(dir, "network")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, "status")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return shared, nil
+}
+
+// copyIntoGuest copies the file mounted by bind into the guest root.  What
+// is at its destination is replaced rather than written through, as it may
+// be a symlink which points out of the guest root.
+func copyIntoGuest(root string, bind BindMount, perm os.FileMode) error {
+	data, err := os.ReadFile(bind.Source)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(root, bind.Destination)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.WriteFile(dest, data, perm)
+}
+
+// cmd returns the QEMU command which boots the guest and runs args.
+func (q *qemu) cmd(ctx context.Context, cfg *Config, args ...string) (*exec.Cmd, error) {
+	binary, machine, console, err := qemuMachine(cfg.Arch.ToAPK())
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := q.prepare(cfg, args)
+	if err != nil {
+		return nil, fmt.Errorf("preparing VM: %w", err)
+	}
+
+	cpus := 2
+	if cfg.CPU != "" {
+		res, err := resource.ParseQuantity(cfg.CPU)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CPU resource: %w", err)
+		}
+		cpus = max(1, int(res.Value()))
+	}
+
+	memory := int64(4096)
+	if cfg.Memory != "" {
+		res, err := resource.ParseQuantity(cfg.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("parsing memory resource: %w", err)
+		}
+		memory = max(256, res.Value()/(1024*1024))
+	}
+
+	qargs := []string{
+		"-machine", machine,
+		"-smp", strconv.Itoa(cpus),
+		"-m", fmt.Sprintf("%dM", memory),
+		"-nographic", "-no-reboot", "-nodefaults",
+		"-serial", "stdio",
+		"-kernel", q.kernel,
+		"-append", fmt.Sprintf("console=%s root=rootfs rootfstype=9p rootflags=trans=virtio,version=9p2000.L,msize=512000 rw init=/%s/init quiet loglevel=0 panic=-1", console, qemuControlDir),
+		"-fsdev", fmt.Sprintf("local,id=rootfs,path=%s,security_model=none", cfg.ImgRef),
+		"-device", "virtio-9p-device,fsdev=rootfs,mount_tag=rootfs",
+	}
+
+	// Hardware acceleration is only available for the host architecture.
+	if _, err := os.Stat("/dev/kvm"); err == nil && cfg.Arch.ToAPK() == hostArch() {
+		qargs = append(qargs, "-accel", "kvm", "-cpu", "host")
+	} else {
+		qargs = append(qargs, "-accel", "tcg", "-cpu", "max")
+	}
+
+	for i, bind := range shared {
+		qargs = append(qargs,
+			"-fsdev", fmt.Sprintf("local,id=mount%d,path=%s,security_model=none", i, bind.Source),
+			"-device", fmt.Sprintf("virtio-9p-device,fsdev=mount%d,mount_tag=mount%d", i, i))
+	}
+
+	if cfg.Capabilities.Networking {
+		qargs = append(qargs, "-netdev", "user,id=net0", "-device", "virtio-net-device,netdev=net0")
+	}
+
+	execCmd := exec.CommandContext(ctx, binary, qargs...)
+	clog.FromContext(ctx).Infof("executing: %s", strings.Join(execCmd.Args, " "))
+
+	return execCmd, nil
+}
+
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+
+	return runtime.GOARCH
+}
+
+// status returns the exit status of the command run in the VM.
+func (q *qemu) status(cfg *Config) error {
+	data, err := os.ReadFile(filepath.Join(cfg.ImgRef, qemuControlDir, "status"))
+	if err != nil {
+		return fmt.Errorf("the VM did not report an exit status, it may have crashed: %w", err)
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("parsing exit status: %w", err)
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+
+	return nil
+}
+
+// Run boots a VM which runs the given command and powers off.
+func (q *qemu) Run(ctx context.Context, cfg *Config, args ...string) error {
+	execCmd, err := q.cmd(ctx, cfg, args...)
+	if err != nil {
+		return err
+	}
+
+	log := clog.FromContext(ctx)
+	stdout := logwriter.New(log.Info)
+	defer stdout.Close()
+
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stdout
+
+	if err := execCmd.Run(); err != nil {
+		return err
+	}
+
+	return q.status(cfg)
+}
+
+func (q *qemu) Debug(ctx context.Context, cfg *Config, args ...string) error {
+	execCmd, err := q.cmd(ctx, cfg, args...)
+	if err != nil {
+		return err
+	}
+
+	execCmd.Stdout = os.Stdout
+	execCmd.Stderr = os.Stderr
+	execCmd.Stdin = os.Stdin
+
+	if err := execCmd.Run(); err != nil {
+		return err
+	}
+
+	return q.status(cfg)
+}
+
+// TestUsability determines if the QEMU runner can be used.
+func (q *qemu) TestUsability(ctx context.Context) bool {
+	log := clog.FromContext(ctx)
+
+	if q.kernel == "" {
+		log.Warnf("cannot use qemu for builds: %s is not set", QEMUKernelEnv)
+		return false
+	}
+	if _, err := os.Stat(q.kernel); err != nil {
+		log.Warnf("cannot use qemu for builds: %v", err)
+		return false
+	}
+
+	binary, _, _, err := qemuMachine(hostArch())
+	if err != nil {
+		log.Warnf("cannot use qemu for builds: %v", err)
+		return false
+	}
+	if _, err := exec.LookPath(binary); err != nil {
+		log.Warnf("cannot use qemu for builds: %s not found on $PATH", binary)
+		return false
+	}
+
+	return true
+}
+
+// OCIImageLoader used to load OCI images in.  Like bubblewrap, the image is
+// unpacked into a directory, which is shared with the VM as its root.
+func (q *qemu) OCIImageLoader() Loader {
+	return &bubblewrapOCILoader{}
+}
+
+// TempDir returns the base for temporary directory. For qemu, this is empty.
+func (q *qemu) TempDir() string {
+	return ""
+}
+
+// StartPod runs ldconfig to prime ld.so.cache for glibc < 2.37 builds.
+// There is no long-running VM: every command boots its own.
+func (q *qemu) StartPod(ctx context.Context, cfg *Config) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "qemu.StartPod")
+	defer span.End()
+
+	script := "[ -x /sbin/ldconfig ] && /sbin/ldconfig /lib || true"
+	return q.Run(ctx, cfg, "/bin/sh", "-c", script)
+}
+
+// TerminatePod is a noop, as every VM powers off after its command.
+func (q *qemu) TerminatePod(ctx context.Context, cfg *Config) error {
+	return nil
+}
+
+// WorkspaceTar is a noop, as the workspace is shared with the VM.
+func (q *qemu) WorkspaceTar(ctx context.Context, cfg *Config) (io.ReadCloser, error) {
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQEMUCmd(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	guest := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(guest, "etc"), 0o755))
+	// The file mounts replace what the guest has, without writing through
+	// its symlinks.
+	outside := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(outside, []byte("host\n"), 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(guest, "etc", "resolv.conf")))
+
+	host := t.TempDir()
+	ws := filepath.Join(host, "workspace")
+	require.NoError(t, os.Mkdir(ws, 0o755))
+	resolv := filepath.Join(host, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolv, []byte("nameserver 10.0.2.3\n"), 0o644))
+	secret := filepath.Join(host, "token")
+	require.NoError(t, os.WriteFile(secret, []byte("s3cr3t"), 0o600))
+	cache := filepath.Join(host, "cache")
+	require.NoError(t, os.Mkdir(cache, 0o755))
+
+	cfg := &Config{
+		Arch:   apko_types.ParseArchitecture("aarch64"),
+		ImgRef: guest,
+		Mounts: []BindMount{
+			{Source: ws, Destination: DefaultWorkspaceDir},
+			{Source: resolv, Destination: "/etc/resolv.conf"},
+			{Source: secret, Destination: "/run/secrets/token"},
+			{Source: cache, Destination: "/var/cache/melange"},
+		},
+		Environment: map[string]string{"HOME": "/home/build", "QUOTE": "it's"},
+		CPU:         "4",
+		Memory:      "1Gi",
+	}
+
+	q := &qemu{kernel: "/boot/vmlinuz"}
+	cmd, err := q.cmd(ctx, cfg, "/bin/sh", "-c", "make install")
+	require.NoError(t, err)
+	require.Equal(t, "qemu-system-aarch64", filepath.Base(cmd.Args[0]))
+	args := strings.Join(cmd.Args[1:], " ")
+	require.Contains(t, args, "-machine virt -smp 4 -m 1024M ")
+	require.Contains(t, args, "-kernel /boot/vmlinuz ")
+	require.Contains(t, args, "console=ttyAMA0 ")
+	require.Contains(t, args, "-fsdev local,id=rootfs,path="+guest+",security_model=none")
+
+	// Only the directories are shared with the guest.
+	require.Contains(t, args, "-fsdev local,id=mount0,path="+ws+",security_model=none -device virtio-9p-device,fsdev=mount0,mount_tag=mount0")
+	require.Contains(t, args, "-fsdev local,id=mount1,path="+cache+",security_model=none -device virtio-9p-device,fsdev=mount1,mount_tag=mount1")
+	require.NotContains(t, args, "mount2")
+	require.NotContains(t, args, resolv)
+	require.NotContains(t, args, secret)
+	require.NotContains(t, args, "-netdev")
+
+	control := filepath.Join(guest, qemuControlDir)
+	mounts, err := os.ReadFile(filepath.Join(control, "mounts"))
+	require.NoError(t, err)
+	require.Equal(t, `mkdir -p '/home/build'
+mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 mount0 '/home/build'
+mkdir -p '/var/cache/melange'
+mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 mount1 '/var/cache/melange'
+`, string(mounts))
+
+	// The files are copied into the guest instead.
+	data, err := os.ReadFile(filepath.Join(guest, "etc", "resolv.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.2.3\n", string(data))
+	data, err = os.ReadFile(outside)
+	require.NoError(t, err)
+	require.Equal(t, "host\n", string(data))
+	fi, err := os.Stat(filepath.Join(guest, "run", "secrets", "token"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	env, err := os.ReadFile(filepath.Join(control, "env"))
+	require.NoError(t, err)
+	require.Equal(t, "export HOME='/home/build'\nexport QUOTE='it'\\''s'\n", string(env))
+	command, err := os.ReadFile(filepath.Join(control, "cmd"))
+	require.NoError(t, err)
+	require.Equal(t, "'/bin/sh' '-c' 'make install'\n", string(command))
+	init, err := os.ReadFile(filepath.Join(control, "init"))
+	require.NoError(t, err)
+	require.Equal(t, qemuInit, string(init))
+	require.NoFileExists(t, filepath.Join(control, "network"))
+
+	// Networking adds a NIC, which the init script brings up.
+	cfg.Capabilities.Networking = true
+	cmd, err = q.cmd(ctx, cfg, "true")
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(cmd.Args, " "), "-netdev user,id=net0 -device virtio-net-device,netdev=net0")
+	require.FileExists(t, filepath.Join(control, "network"))
+
+	// A mount whose source is missing is an error rather than a VM which
+	// cannot boot.
+	cfg.Mounts = append(cfg.Mounts, BindMount{Source: filepath.Join(host, "missing"), Destination: "/missing"})
+	_, err = q.cmd(ctx, cfg, "true")
+	require.Error(t, err)
+
+	cfg.Arch = apko_types.ParseArchitecture("s390x")
+	_, err = q.cmd(ctx, cfg, "true")
+	require.ErrorContains(t, err, "does not support s390x")
+}
@@ -16,6 +16,7 @@ package container
 
 import (
 	"context"
+	"fmt"
 	"io"
 
 	apko_build "chainguard.dev/apko/pkg/build"
@@ -27,6 +28,32 @@ type Debugger interface {
 	Debug(context.Context, *Config, ...string) error
 }
 
+// NetworkIsolator is implemented by the runners which honor the networking
+// capability of the config passed to each Run, rather than only the one the
+// pod was started with.
+type NetworkIsolator interface {
+	IsolatesNetwork() bool
+}
+
+// RootlessRunner is implemented by the runners which can run the build
+// without privileges, in a user namespace in which the user running melange
+// is root, when the Rootless field of the config is set.
+type RootlessRunner interface {
+	// TestRootless returns an error if the runner cannot create user
+	// namespaces on this host.
+	TestRootless(ctx context.Context) error
+}
+
+// ExitError is returned by Run when the command exits with a non-zero
+// status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
 type Runner interface {
 	Close() error
 	Name() string
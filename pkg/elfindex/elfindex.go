@@ -0,0 +1,306 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package elfindex indexes the metadata of the ELF files of a package, so
+// that the dependency generators, the linters and the other consumers of
+// this metadata read every file once and agree on what they found.
+package elfindex
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/internal/hardlink"
+	"golang.org/x/sync/errgroup"
+)
+
+var elfMagic = []byte{'\x7f', 'E', 'L', 'F'}
+
+// File is the metadata of an ELF file.
+type File struct {
+	// Path is the path of the file, relative to the package root.
+	Path string
+	// Mode is the mode of the file.
+	Mode fs.FileMode
+
+	Class   elf.Class
+	Machine elf.Machine
+	Type    elf.Type
+
+	// Interpreter is the PT_INTERP of the file, if it has one.
+	Interpreter string
+	// Needed are the DT_NEEDED entries of the file.
+	Needed []string
+	// SONames are the DT_SONAME entries of the file.
+	SONames []string
+	// RPath are the entries of the DT_RPATH and DT_RUNPATH of the file.
+	RPath []string
+	// BuildID is the GNU build ID of the file, in hex.
+	BuildID string
+	// Sections are the names of the sections of the file.
+	Sections []string
+
+	Hardening Hardening
+}
+
+// Hardening describes the exploit mitigations an ELF file was built with.
+type Hardening struct {
+	// PIE is set for position independent executables.
+	PIE bool
+	// RELRO is set if the file has a PT_GNU_RELRO segment.
+	RELRO bool
+	// BindNow is set if the dynamic linker must resolve every symbol at
+	// load time, which makes RELRO cover the GOT.
+	BindNow bool
+	// NXStack is set if the file declares a non-executable stack.
+	NXStack bool
+	// StackProtector is set if the file uses the stack protector.
+	StackProtector bool
+	// Fortify is set if the file calls fortified libc functions.
+	Fortify bool
+}
+
+// Index is the metadata of the ELF files of a package.
+type Index struct {
+	files map[string]*File
+}
+
+// workers is how many files are indexed at once.
+var workers = runtime.GOMAXPROCS(0)
+
+// New indexes the regular files of fsys which are ELF files.  Files which
+// cannot be parsed as ELF are left out of the index.
+//
+// The files are read by a pool of workers as the walk finds them, as reading
+// them is what takes time for packages with tens of thousands of files.
+func New(fsys fs.FS) (*Index, error) {
+	idx := &Index{files: map[string]*File{}}
+	var mu sync.Mutex
+
+	// The hard links to a file, as texlive has many of, are indexed once,
+	// under the first path found.
+	first := map[hardlink.ID]string{}
+	links := map[string][]string{}
+
+	var g errgroup.Group
+	g.SetLimit(workers)
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() < int64(len(elfMagic)) {
+			return nil
+		}
+
+		if id, ok := hardlink.Of(info); ok {
+			if p, linked := first[id]; linked {
+				links[p] = append(links[p], path)
+				return nil
+			}
+			first[id] = path
+		}
+
+		g.Go(func() error {
+			f, err := indexFile(fsys, path)
+			if err != nil {
+				return fmt.Errorf("indexing %s: %w", path, err)
+			}
+			if f != nil {
+				f.Mode = info.Mode()
+				mu.Lock()
+				idx.files[path] = f
+				mu.Unlock()
+			}
+			return nil
+		})
+
+		return nil
+	}); err != nil {
+		_ = g.Wait()
+		return nil, err
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	for p, paths := range links {
+		f, ok := idx.files[p]
+		if !ok {
+			continue
+		}
+		for _, link := range paths {
+			linked := *f
+			linked.Path = link
+			idx.files[link] = &linked
+		}
+	}
+
+	return idx, nil
+}
+
+// Get returns the metadata of the ELF file at path, relative to the package
+// root, or nil if it is not an ELF file.
+func (idx *Index) Get(path string) *File {
+	return idx.files[strings.TrimPrefix(path, "/")]
+}
+
+// Files returns the metadata of the ELF files, sorted by path.
+func (idx *Index) Files() []*File {
+	files := make([]*File, 0, len(idx.files))
+	for _, f := range idx.files {
+		files = append(files, f)
+	}
+	slices.SortFunc(files, func(a, b *File) int { return strings.Compare(a.Path, b.Path) })
+
+	return files
+}
+
+// indexFile returns the metadata of the file at path, or nil if it is not
+// an ELF file.
+func indexFile(fsys fs.FS, path string) (*File, error) {
+	rf, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+
+	// Both os.DirFS and go-apk return files which implement ReaderAt.
+	r, ok := rf.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(rf)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	hdr := make([]byte, len(elfMagic))
+	if _, err := r.ReadAt(hdr, 0); err != nil || !bytes.Equal(hdr, elfMagic) {
+		return nil, nil
+	}
+
+	ef, err := elf.NewFile(r)
+	if err != nil {
+		return nil, nil
+	}
+	defer ef.Close()
+
+	f := &File{
+		Path:    path,
+		Class:   ef.Class,
+		Machine: ef.Machine,
+		Type:    ef.Type,
+	}
+
+	for _, s := range ef.Sections {
+		f.Sections = append(f.Sections, s.Name)
+	}
+
+	for _, prog := range ef.Progs {
+		switch prog.Type {
+		case elf.PT_INTERP:
+			interp, err := io.ReadAll(prog.Open())
+			if err == nil {
+				f.Interpreter = string(bytes.Trim(interp, "\x00"))
+			}
+		case elf.PT_GNU_RELRO:
+			f.Hardening.RELRO = true
+		case elf.PT_GNU_STACK:
+			f.Hardening.NXStack = prog.Flags&elf.PF_X == 0
+		}
+	}
+
+	// The dynamic section is missing from static files, and may be broken in
+	// others, which then have no dynamic metadata.
+	f.Needed, _ = ef.DynString(elf.DT_NEEDED)
+	f.SONames, _ = ef.DynString(elf.DT_SONAME)
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, _ := ef.DynString(tag)
+		for _, value := range values {
+			f.RPath = append(f.RPath, strings.Split(value, ":")...)
+		}
+	}
+
+	flags, _ := ef.DynValue(elf.DT_FLAGS)
+	flags1, _ := ef.DynValue(elf.DT_FLAGS_1)
+	bindNow, _ := ef.DynValue(elf.DT_BIND_NOW)
+	f.Hardening.BindNow = len(bindNow) > 0 ||
+		slices.ContainsFunc(flags, func(v uint64) bool { return v&uint64(elf.DF_BIND_NOW) != 0 }) ||
+		slices.ContainsFunc(flags1, func(v uint64) bool { return v&uint64(elf.DF_1_NOW) != 0 })
+	f.Hardening.PIE = ef.Type == elf.ET_DYN && (f.Interpreter != "" ||
+		slices.ContainsFunc(flags1, func(v uint64) bool { return v&uint64(elf.DF_1_PIE) != 0 }))
+
+	syms, _ := ef.ImportedSymbols()
+	for _, sym := range syms {
+		switch {
+		case sym.Name == "__stack_chk_fail" || sym.Name == "__stack_chk_guard":
+			f.Hardening.StackProtector = true
+		case strings.HasPrefix(sym.Name, "__") && strings.HasSuffix(sym.Name, "_chk"):
+			f.Hardening.Fortify = true
+		}
+	}
+
+	if s := ef.Section(".note.gnu.build-id"); s != nil {
+		if data, err := s.Data(); err == nil {
+			f.BuildID = buildID(ef.ByteOrder, data)
+		}
+	}
+
+	return f, nil
+}
+
+// buildID returns the descriptor of the NT_GNU_BUILD_ID note in data, in
+// hex.
+func buildID(order binary.ByteOrder, data []byte) string {
+	const ntGNUBuildID = 3
+
+	for len(data) >= 12 {
+		namesz := int(order.Uint32(data[0:4]))
+		descsz := int(order.Uint32(data[4:8]))
+		typ := order.Uint32(data[8:12])
+		data = data[12:]
+
+		// The name and the descriptor are padded to 4 bytes.
+		nameEnd := (namesz + 3) &^ 3
+		descEnd := nameEnd + (descsz+3)&^3
+		if namesz < 0 || descsz < 0 || descEnd > len(data) {
+			return ""
+		}
+
+		if typ == ntGNUBuildID && string(bytes.TrimRight(data[:namesz], "\x00")) == "GNU" {
+			return hex.EncodeToString(data[nameEnd : nameEnd+descsz])
+		}
+		data = data[descEnd:]
+	}
+
+	return ""
+}
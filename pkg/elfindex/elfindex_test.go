@@ -0,0 +1,137 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elfindex
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexApk(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(context.Background(), f, "")
+	require.NoError(t, err)
+	defer exp.Close()
+
+	idx, err := New(exp.TarFS)
+	require.NoError(t, err)
+
+	files := idx.Files()
+	require.Len(t, files, 2)
+	require.Equal(t, "usr/lib/libcap.so.2.69", files[0].Path)
+	require.Equal(t, "usr/lib/libpsx.so.2.69", files[1].Path)
+
+	lib := idx.Get("/usr/lib/libcap.so.2.69")
+	require.Equal(t, files[0], lib)
+	require.Equal(t, elf.EM_AARCH64, lib.Machine)
+	require.Equal(t, elf.ET_DYN, lib.Type)
+	require.Equal(t, "/lib/ld-linux-aarch64.so.1", lib.Interpreter)
+	require.Equal(t, []string{"libc.so.6", "ld-linux-aarch64.so.1"}, lib.Needed)
+	require.Equal(t, []string{"libcap.so.2"}, lib.SONames)
+	require.Empty(t, lib.RPath)
+	require.Equal(t, Hardening{
+		PIE:            true,
+		RELRO:          true,
+		BindNow:        true,
+		NXStack:        true,
+		StackProtector: true,
+		Fortify:        true,
+	}, lib.Hardening)
+
+	require.Nil(t, idx.Get("usr/lib/libcap.so.2"), "symlinks are not indexed")
+}
+
+func TestIndexDir(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "hello.c")
+	require.NoError(t, os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0o644))
+
+	bin := filepath.Join(dir, "usr", "bin", "hello")
+	require.NoError(t, os.MkdirAll(filepath.Dir(bin), 0o755))
+	out, err := exec.Command(cc, "-o", bin, src, "-Wl,--build-id=sha1,--enable-new-dtags,-rpath,/usr/lib/hello:$ORIGIN").CombinedOutput()
+	if err != nil {
+		t.Skipf("unable to compile test program: %v: %s", err, out)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "script"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "tiny"), []byte("\x7f"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "bin", "broken"), []byte("\x7fELF garbage"), 0o755))
+
+	idx, err := New(os.DirFS(dir))
+	require.NoError(t, err)
+
+	files := idx.Files()
+	require.Len(t, files, 1)
+
+	hello := files[0]
+	require.Equal(t, "usr/bin/hello", hello.Path)
+	require.Equal(t, []string{"/usr/lib/hello", "$ORIGIN"}, hello.RPath)
+	require.Len(t, hello.BuildID, 40)
+	require.Contains(t, hello.Sections, ".text")
+	require.NotEmpty(t, hello.Needed)
+}
+
+func TestIndexHardLinks(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(context.Background(), f, "")
+	require.NoError(t, err)
+	defer exp.Close()
+
+	lib, err := fs.ReadFile(exp.TarFS, "usr/lib/libcap.so.2.69")
+	require.NoError(t, err)
+
+	// More files than workers, some of which are hard links to others.
+	dir := t.TempDir()
+	for i := 0; i < 4*workers; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+		require.NoError(t, os.Mkdir(sub, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(sub, "libcap.so.2"), lib, 0o755))
+		require.NoError(t, os.Link(filepath.Join(sub, "libcap.so.2"), filepath.Join(sub, "libcap-link.so.2")))
+	}
+
+	idx, err := New(os.DirFS(dir))
+	require.NoError(t, err)
+	require.Len(t, idx.Files(), 8*workers)
+
+	for i := 0; i < 4*workers; i++ {
+		orig := idx.Get(fmt.Sprintf("d%d/libcap.so.2", i))
+		link := idx.Get(fmt.Sprintf("d%d/libcap-link.so.2", i))
+		require.NotNil(t, orig)
+		require.NotNil(t, link)
+		require.Equal(t, fmt.Sprintf("d%d/libcap-link.so.2", i), link.Path)
+		require.Equal(t, []string{"libcap.so.2"}, link.SONames)
+		require.Equal(t, orig.BuildID, link.BuildID)
+	}
+}
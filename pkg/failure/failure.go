@@ -0,0 +1,114 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package failure categorizes the errors of melange, so that CI can tell
+// transient failures, which are worth retrying, from real breakages.  The
+// category of an error decides the exit code of melange, and is recorded in
+// the build report.
+package failure
+
+import (
+	"errors"
+)
+
+// Kind is the category of a failure.
+type Kind string
+
+const (
+	// Unknown is every failure which was not categorized.
+	Unknown Kind = "unknown"
+	// Fetch is a failure to download something, which may be transient.
+	Fetch Kind = "fetch"
+	// Checksum is a download which does not match its expected digest.
+	Checksum Kind = "checksum"
+	// Pipeline is a pipeline step which failed.
+	Pipeline Kind = "pipeline"
+	// Packaging is a failure to assemble or write a package.
+	Packaging Kind = "packaging"
+	// Signing is a failure to sign a package or an index.
+	Signing Kind = "signing"
+	// Policy is a check which the build does not pass, such as a linter,
+	// a signature verification or a promotion policy.
+	Policy Kind = "policy"
+)
+
+// The exit codes of each kind of failure.  1 is any other failure, as it is
+// for most commands.
+var exitCodes = map[Kind]int{
+	Fetch:     10,
+	Checksum:  11,
+	Pipeline:  12,
+	Packaging: 13,
+	Signing:   14,
+	Policy:    15,
+}
+
+// Error is an error with the category of the failure.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap categorizes err, unless it is nil or was categorized already, since
+// the innermost category is the most precise.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var fe *Error
+	if errors.As(err, &fe) {
+		return err
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the category of err, which is Unknown if it was not
+// categorized.
+func KindOf(err error) Kind {
+	var fe *Error
+	if errors.As(err, &fe) {
+		return fe.Kind
+	}
+
+	return Unknown
+}
+
+// ExitCode returns the exit code of a command which failed with err: 0 if it
+// is nil, the code of its category, or 1.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if code, ok := exitCodes[KindOf(err)]; ok {
+		return code
+	}
+
+	return 1
+}
+
+// Retryable returns whether the failure may be transient.
+func Retryable(err error) bool {
+	return KindOf(err) == Fetch
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	require.NoError(t, Wrap(Fetch, nil))
+
+	base := errors.New("connection reset")
+	err := Wrap(Fetch, base)
+	require.ErrorIs(t, err, base)
+	require.Equal(t, "connection reset", err.Error())
+	require.Equal(t, Fetch, KindOf(err))
+
+	// The innermost category is kept.
+	err = Wrap(Pipeline, fmt.Errorf("running step: %w", err))
+	require.Equal(t, Fetch, KindOf(err))
+	require.True(t, Retryable(err))
+
+	require.Equal(t, Unknown, KindOf(base))
+	require.False(t, Retryable(base))
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, 0, ExitCode(nil))
+	require.Equal(t, 1, ExitCode(errors.New("bad flag")))
+	require.Equal(t, 11, ExitCode(Wrap(Checksum, errors.New("digest mismatch"))))
+	require.Equal(t, 15, ExitCode(fmt.Errorf("linting: %w", Wrap(Policy, errors.New("setuid file")))))
+}
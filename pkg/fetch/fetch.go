@@ -0,0 +1,325 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fetch downloads source artifacts into a content-addressed cache,
+// verifying them against their expected digests.  The cache is laid out
+// like the melange cache directory, with every artifact named after its
+// digest, e.g. sha256:<hex>, so that the fetch pipeline finds it there.
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+var (
+	// ErrNoDigest is returned when a source has no expected digest.
+	ErrNoDigest = errors.New("one of expected-sha256 or expected-sha512 is required")
+
+	// ErrDigestMismatch is returned when an artifact does not have its
+	// expected digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+
+	// errNoRetry marks the errors which fetching again cannot fix.
+	errNoRetry = errors.New("not retrying")
+)
+
+// Source is an artifact to fetch.
+type Source struct {
+	// URI is where the artifact is fetched from.
+	URI string
+	// Mirrors are URL templates tried, in order, if the artifact cannot be
+	// fetched from URI.  The placeholders {algo} and {digest} are replaced
+	// with the digest algorithm and the expected digest of the artifact.
+	Mirrors []string
+	// SHA256 is the expected SHA256 of the artifact, in hex.
+	SHA256 string
+	// SHA512 is the expected SHA512 of the artifact, in hex.
+	SHA512 string
+}
+
+// Digest returns the algorithm and the digest the artifact is cached
+// under, preferring SHA256 like the fetch pipeline.
+func (s Source) Digest() (string, string, error) {
+	switch {
+	case s.SHA256 != "":
+		return "sha256", s.SHA256, nil
+	case s.SHA512 != "":
+		return "sha512", s.SHA512, nil
+	}
+
+	return "", "", ErrNoDigest
+}
+
+// Origins returns the URLs the artifact may be fetched from, in order.
+func (s Source) Origins() ([]string, error) {
+	algo, digest, err := s.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	origins := []string{s.URI}
+	r := strings.NewReplacer("{algo}", algo, "{digest}", digest)
+	for _, m := range s.Mirrors {
+		origins = append(origins, r.Replace(m))
+	}
+
+	return origins, nil
+}
+
+// verify returns an error unless the digests match those expected.
+func (s Source) verify(sum256, sum512 string) error {
+	if s.SHA256 != "" && !strings.EqualFold(s.SHA256, sum256) {
+		return fmt.Errorf("%w: expected sha256 %s, got %s", ErrDigestMismatch, s.SHA256, sum256)
+	}
+	if s.SHA512 != "" && !strings.EqualFold(s.SHA512, sum512) {
+		return fmt.Errorf("%w: expected sha512 %s, got %s", ErrDigestMismatch, s.SHA512, sum512)
+	}
+
+	return nil
+}
+
+// Fetcher fetches artifacts into a cache directory.
+type Fetcher struct {
+	cacheDir string
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+}
+
+type Option func(*Fetcher) error
+
+// New returns a Fetcher which keeps artifacts in cacheDir.
+func New(cacheDir string, opts ...Option) (*Fetcher, error) {
+	f := &Fetcher{
+		cacheDir: cacheDir,
+		client:   http.DefaultClient,
+		retries:  5,
+		backoff:  time.Second,
+	}
+
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// WithClient sets the HTTP client used to fetch artifacts.
+func WithClient(client *http.Client) Option {
+	return func(f *Fetcher) error {
+		f.client = client
+		return nil
+	}
+}
+
+// WithRetries sets the number of times fetching from an origin is retried
+// before trying the next one.
+func WithRetries(retries int) Option {
+	return func(f *Fetcher) error {
+		if retries < 0 {
+			return fmt.Errorf("retries must not be negative")
+		}
+		f.retries = retries
+		return nil
+	}
+}
+
+// WithBackoff sets the delay before the first retry.  It doubles with
+// every retry.
+func WithBackoff(backoff time.Duration) Option {
+	return func(f *Fetcher) error {
+		f.backoff = backoff
+		return nil
+	}
+}
+
+// CachePath returns where the artifact is kept in the cache.
+func (f *Fetcher) CachePath(s Source) (string, error) {
+	algo, digest, err := s.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(f.cacheDir, algo+":"+digest), nil
+}
+
+// Fetch returns the path of the artifact in the cache, fetching it first
+// if it is not there.
+func (f *Fetcher) Fetch(ctx context.Context, s Source) (string, error) {
+	log := clog.FromContext(ctx)
+
+	path, err := f.CachePath(s)
+	if err != nil {
+		return "", err
+	}
+	origins, err := s.Origins()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		err := f.verifyCached(path, s)
+		if err == nil {
+			log.Infof("fetch: found %s in cache", filepath.Base(path))
+			return path, nil
+		}
+
+		log.Warnf("fetch: removing %s from cache: %v", path, err)
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(f.cacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	errs := []error{}
+	for _, origin := range origins {
+		err := f.fetchWithRetries(ctx, origin, s, path)
+		if err == nil {
+			log.Infof("fetch: fetched %s from %s", s.URI, origin)
+			return path, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		log.Warnf("fetch: unable to fetch %s from %s: %v", s.URI, origin, err)
+		errs = append(errs, fmt.Errorf("%s: %w", origin, err))
+	}
+
+	return "", fmt.Errorf("unable to fetch %s from any origin: %w", s.URI, errors.Join(errs...))
+}
+
+func (f *Fetcher) verifyCached(path string, s Source) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h256, h512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(h256, h512), file); err != nil {
+		return err
+	}
+
+	return s.verify(hexSum(h256), hexSum(h512))
+}
+
+func (f *Fetcher) fetchWithRetries(ctx context.Context, origin string, s Source, path string) error {
+	backoff := f.backoff
+	for attempt := 0; ; attempt++ {
+		err := f.download(ctx, origin, s, path)
+		if err == nil || attempt >= f.retries || !retryable(err) {
+			return err
+		}
+
+		clog.FromContext(ctx).Infof("fetch: retrying %s in %s: %v", origin, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// statusError is returned for unsuccessful HTTP responses.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+// retryable returns whether fetching again may succeed.
+func retryable(err error) bool {
+	if errors.Is(err, errNoRetry) || errors.Is(err, ErrDigestMismatch) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var se statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusRequestTimeout || se.code == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+// download fetches the artifact from url, verifies it and moves it into
+// the cache at path.
+func (f *Fetcher) download(ctx context.Context, url string, s Source, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNoRetry, err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError{resp.StatusCode}
+	}
+
+	// Download next to the cache entry, so that it is moved atomically.
+	tmp, err := os.CreateTemp(f.cacheDir, ".fetch-*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNoRetry, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h256, h512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h256, h512), resp.Body); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := s.verify(hexSum(h256), hexSum(h512)); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
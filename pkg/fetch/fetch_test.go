@@ -0,0 +1,133 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const artifact = "hello, world\n"
+
+func sum256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sum512(s string) string {
+	sum := sha512.Sum512([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+
+	var requests atomic.Int32
+	flaky := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/good.tar.gz", "/mirror/sha256/" + sum256(artifact):
+			w.Write([]byte(artifact))
+		case "/flaky.tar.gz":
+			if flaky > 0 {
+				flaky--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(artifact))
+		case "/tampered.tar.gz":
+			w.Write([]byte("something else\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cache := t.TempDir()
+	f, err := New(cache, WithRetries(3), WithBackoff(time.Millisecond))
+	require.NoError(t, err)
+
+	t.Run("fetch and cache", func(t *testing.T) {
+		s := Source{URI: srv.URL + "/good.tar.gz", SHA256: sum256(artifact)}
+		path, err := f.Fetch(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(cache, "sha256:"+sum256(artifact)), path)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, artifact, string(data))
+
+		// The second fetch is served from the cache.
+		before := requests.Load()
+		_, err = f.Fetch(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, before, requests.Load())
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		path, err := f.Fetch(ctx, Source{URI: srv.URL + "/flaky.tar.gz", SHA512: sum512(artifact)})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(cache, "sha512:"+sum512(artifact)), path)
+	})
+
+	t.Run("mirrors", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(filepath.Join(cache, "sha256:"+sum256(artifact))))
+
+		before := requests.Load()
+		_, err := f.Fetch(ctx, Source{
+			URI:     srv.URL + "/missing.tar.gz",
+			Mirrors: []string{srv.URL + "/tampered.tar.gz", srv.URL + "/mirror/{algo}/{digest}"},
+			SHA256:  sum256(artifact),
+		})
+		require.NoError(t, err)
+		// Neither a missing artifact nor a digest mismatch is retried.
+		require.Equal(t, before+3, requests.Load())
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		_, err := f.Fetch(ctx, Source{URI: srv.URL + "/tampered.tar.gz", SHA256: sum256(artifact), SHA512: sum512("other")})
+		require.ErrorIs(t, err, ErrDigestMismatch)
+	})
+
+	t.Run("corrupt cache entry", func(t *testing.T) {
+		s := Source{URI: srv.URL + "/good.tar.gz", SHA256: sum256(artifact)}
+		path, err := f.CachePath(s)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte("corrupt"), 0o644))
+
+		_, err = f.Fetch(ctx, s)
+		require.NoError(t, err)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, artifact, string(data))
+	})
+
+	t.Run("no digest", func(t *testing.T) {
+		_, err := f.Fetch(ctx, Source{URI: srv.URL + "/good.tar.gz"})
+		require.ErrorIs(t, err, ErrNoDigest)
+	})
+}
@@ -0,0 +1,274 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graph resolves the dependencies between the configurations of a
+// repository, and the order they have to be built in.
+package graph
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// The kinds of dependencies between configurations.
+const (
+	// The configuration installs a package of the other to build.
+	KindBuild = "build"
+	// A package of the configuration depends on a package of the other at
+	// runtime.
+	KindRuntime = "runtime"
+)
+
+// Node is a configuration of the repository.
+type Node struct {
+	// The name of the main package
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// The file name of the configuration, relative to the repository
+	File string `json:"file"`
+	// The packages the configuration builds, including subpackages
+	Packages []string `json:"packages"`
+}
+
+// Edge is a dependency of a configuration on another.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// build or runtime
+	Kind string `json:"kind"`
+	// The dependency which the other configuration provides, e.g.
+	// so:libz.so.1
+	Via string `json:"via"`
+}
+
+// Graph is the dependencies between the configurations of a repository.
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Load parses every configuration in dir, and resolves the build-time and
+// runtime dependencies between them.  Dependencies which no configuration of
+// dir provides are left out.
+func Load(ctx context.Context, dir string) (*Graph, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgs := []*config.Configuration{}
+	files := map[string]string{}
+	g := &Graph{Nodes: []Node{}, Edges: []Edge{}}
+	for _, ent := range entries {
+		ext := filepath.Ext(ent.Name())
+		if ent.IsDir() || strings.HasPrefix(ent.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		cfg, err := config.ParseConfiguration(ctx, filepath.Join(dir, ent.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", ent.Name(), err)
+		}
+
+		if other, ok := files[cfg.Package.Name]; ok {
+			return nil, fmt.Errorf("%s is built by both %s and %s", cfg.Package.Name, other, ent.Name())
+		}
+		files[cfg.Package.Name] = ent.Name()
+
+		node := Node{
+			Name:     cfg.Package.Name,
+			Version:  fmt.Sprintf("%s-r%d", cfg.Package.Version, cfg.Package.Epoch),
+			File:     ent.Name(),
+			Packages: []string{cfg.Package.Name},
+		}
+		for _, sp := range cfg.Subpackages {
+			node.Packages = append(node.Packages, sp.Name)
+		}
+
+		cfgs = append(cfgs, cfg)
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	// providers maps the names of packages and what they provide to the
+	// configuration which builds them.
+	providers := map[string]string{}
+	for _, cfg := range cfgs {
+		origin := cfg.Package.Name
+		providers[origin] = origin
+		for _, p := range cfg.Package.Dependencies.Provides {
+			providers[util.DependencyName(p)] = origin
+		}
+		for _, sp := range cfg.Subpackages {
+			providers[sp.Name] = origin
+			for _, p := range sp.Dependencies.Provides {
+				providers[util.DependencyName(p)] = origin
+			}
+		}
+	}
+
+	for _, cfg := range cfgs {
+		from := cfg.Package.Name
+		seen := map[Edge]bool{}
+		add := func(kind string, deps []string) {
+			for _, dep := range deps {
+				if strings.HasPrefix(dep, "!") {
+					continue
+				}
+				name := util.DependencyName(dep)
+				to, ok := providers[name]
+				if !ok || to == from {
+					continue
+				}
+				e := Edge{From: from, To: to, Kind: kind, Via: name}
+				if !seen[e] {
+					seen[e] = true
+					g.Edges = append(g.Edges, e)
+				}
+			}
+		}
+
+		add(KindBuild, cfg.Environment.Contents.Packages)
+		add(KindRuntime, cfg.Package.Dependencies.Runtime)
+		for _, sp := range cfg.Subpackages {
+			add(KindRuntime, sp.Dependencies.Runtime)
+		}
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Name < g.Nodes[j].Name })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Via < b.Via
+	})
+
+	return g, nil
+}
+
+// needs maps each configuration to the ones which have to be built before
+// it: the ones it installs to build, and the runtime dependencies of those,
+// as they are installed too.
+func (g *Graph) needs() map[string]map[string]bool {
+	build := map[string][]string{}
+	runtime := map[string][]string{}
+	for _, e := range g.Edges {
+		switch e.Kind {
+		case KindBuild:
+			build[e.From] = append(build[e.From], e.To)
+		case KindRuntime:
+			runtime[e.From] = append(runtime[e.From], e.To)
+		}
+	}
+
+	needs := map[string]map[string]bool{}
+	for _, n := range g.Nodes {
+		needs[n.Name] = map[string]bool{}
+		queue := append([]string{}, build[n.Name]...)
+		for len(queue) != 0 {
+			dep := queue[0]
+			queue = queue[1:]
+			if dep == n.Name || needs[n.Name][dep] {
+				continue
+			}
+			needs[n.Name][dep] = true
+			queue = append(queue, runtime[dep]...)
+		}
+	}
+
+	return needs
+}
+
+// Order returns the order to build the configurations in.  A configuration
+// is built after the configurations it installs to build, and after the
+// runtime dependencies of those, as they are installed too.  Configurations
+// which could be built in either order are sorted by name.
+func (g *Graph) Order() ([]string, error) {
+	needs := g.needs()
+
+	order := []string{}
+	done := map[string]bool{}
+	for len(order) != len(g.Nodes) {
+		ready := []string{}
+		for _, n := range g.Nodes {
+			if done[n.Name] {
+				continue
+			}
+			blocked := false
+			for dep := range needs[n.Name] {
+				if !done[dep] {
+					blocked = true
+					break
+				}
+			}
+			if !blocked {
+				ready = append(ready, n.Name)
+			}
+		}
+
+		if len(ready) == 0 {
+			blocked := []string{}
+			for _, n := range g.Nodes {
+				if !done[n.Name] {
+					blocked = append(blocked, n.Name)
+				}
+			}
+			return nil, fmt.Errorf("unable to order %s: their build dependencies form a cycle", strings.Join(blocked, ", "))
+		}
+
+		// Nodes are sorted by name, so ready is too.
+		for _, name := range ready {
+			done[name] = true
+		}
+		order = append(order, ready...)
+	}
+
+	return order, nil
+}
+
+// WriteDOT writes the graph to w in the DOT language of graphviz.  Runtime
+// dependencies are dashed.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "digraph melange {")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(bw, "  %q [label=%q];\n", n.Name, n.Name+"-"+n.Version)
+	}
+	for _, e := range g.Edges {
+		style := ""
+		if e.Kind == KindRuntime {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(bw, "  %q -> %q [label=%q%s];\n", e.From, e.To, e.Via, style)
+	}
+	fmt.Fprintln(bw, "}")
+
+	return bw.Flush()
+}
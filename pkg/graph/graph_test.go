@@ -0,0 +1,186 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigs(t *testing.T, configs map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, cfg := range configs {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(cfg), 0o644))
+	}
+
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir := writeConfigs(t, map[string]string{
+		"zlib.yaml": `
+package:
+  name: zlib
+  version: 1.3.1
+  epoch: 0
+  dependencies:
+    provides:
+      - so:libz.so.1=1
+
+subpackages:
+  - name: zlib-dev
+    dependencies:
+      runtime:
+        - zlib
+`,
+		"openssl.yaml": `
+package:
+  name: openssl
+  version: 3.3.0
+  epoch: 1
+  dependencies:
+    runtime:
+      - so:libz.so.1
+
+environment:
+  contents:
+    packages:
+      - busybox
+      - zlib-dev
+
+subpackages:
+  - name: openssl-dev
+    dependencies:
+      runtime:
+        - openssl=${{package.full-version}}
+`,
+		"curl.yaml": `
+package:
+  name: curl
+  version: 8.8.0
+  epoch: 0
+
+environment:
+  contents:
+    packages:
+      - openssl-dev
+`,
+		"README.md": "not a configuration",
+	})
+
+	g, err := Load(ctx, dir)
+	require.NoError(t, err)
+
+	require.Equal(t, []Node{
+		{Name: "curl", Version: "8.8.0-r0", File: "curl.yaml", Packages: []string{"curl"}},
+		{Name: "openssl", Version: "3.3.0-r1", File: "openssl.yaml", Packages: []string{"openssl", "openssl-dev"}},
+		{Name: "zlib", Version: "1.3.1-r0", File: "zlib.yaml", Packages: []string{"zlib", "zlib-dev"}},
+	}, g.Nodes)
+	require.Equal(t, []Edge{
+		{From: "curl", To: "openssl", Kind: KindBuild, Via: "openssl-dev"},
+		{From: "openssl", To: "zlib", Kind: KindBuild, Via: "zlib-dev"},
+		{From: "openssl", To: "zlib", Kind: KindRuntime, Via: "so:libz.so.1"},
+	}, g.Edges)
+
+	order, err := g.Order()
+	require.NoError(t, err)
+	require.Equal(t, []string{"zlib", "openssl", "curl"}, order)
+
+	var buf bytes.Buffer
+	require.NoError(t, g.WriteDOT(&buf))
+	require.Equal(t, `digraph melange {
+  "curl" [label="curl-8.8.0-r0"];
+  "openssl" [label="openssl-3.3.0-r1"];
+  "zlib" [label="zlib-1.3.1-r0"];
+  "curl" -> "openssl" [label="openssl-dev"];
+  "openssl" -> "zlib" [label="zlib-dev"];
+  "openssl" -> "zlib" [label="so:libz.so.1", style=dashed];
+}
+`, buf.String())
+}
+
+func TestOrder(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		edges   []Edge
+		want    []string
+		wantErr string
+	}{{
+		name: "independent",
+		want: []string{"a", "b", "c"},
+	}, {
+		name: "runtime dependencies of build dependencies",
+		edges: []Edge{
+			{From: "a", To: "b", Kind: KindBuild},
+			{From: "b", To: "c", Kind: KindRuntime},
+			{From: "c", To: "b", Kind: KindBuild},
+		},
+		want: []string{"b", "c", "a"},
+	}, {
+		name: "runtime dependencies are not needed to build",
+		edges: []Edge{
+			{From: "a", To: "b", Kind: KindRuntime},
+		},
+		want: []string{"a", "b", "c"},
+	}, {
+		name: "runtime cycles",
+		edges: []Edge{
+			{From: "a", To: "b", Kind: KindRuntime},
+			{From: "b", To: "a", Kind: KindRuntime},
+		},
+		want: []string{"a", "b", "c"},
+	}, {
+		name: "build cycles",
+		edges: []Edge{
+			{From: "a", To: "b", Kind: KindBuild},
+			{From: "b", To: "a", Kind: KindBuild},
+		},
+		wantErr: "unable to order a, b",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			g := &Graph{Nodes: []Node{{Name: "a"}, {Name: "b"}, {Name: "c"}}, Edges: c.edges}
+			order, err := g.Order()
+			if c.wantErr != "" {
+				require.ErrorContains(t, err, c.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, order)
+		})
+	}
+}
+
+func TestLoad_duplicate(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	cfg := `
+package:
+  name: zlib
+  version: 1.3.1
+`
+	dir := writeConfigs(t, map[string]string{"a.yaml": cfg, "b.yaml": cfg})
+
+	_, err := Load(ctx, dir)
+	require.ErrorContains(t, err, "zlib is built by both a.yaml and b.yaml")
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// Walk calls fn for every configuration once the configurations it needs
+// have been walked, like Order, with up to jobs calls at a time.  When fn
+// fails, the configurations which need the failed one are skipped, and the
+// others are still walked.  Walk returns the errors of fn, and fails before
+// calling fn if the configurations cannot be ordered.
+func (g *Graph) Walk(ctx context.Context, jobs int, fn func(context.Context, Node) error) error {
+	log := clog.FromContext(ctx)
+
+	if _, err := g.Order(); err != nil {
+		return err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+
+	needs := g.needs()
+	results := make(chan result)
+	// finished maps the configurations which were walked or skipped to
+	// whether they succeeded.
+	finished := map[string]bool{}
+	started := map[string]bool{}
+	running := 0
+	errs := []error{}
+
+	for len(finished) != len(g.Nodes) {
+		for progress := true; progress; {
+			progress = false
+			for _, n := range g.Nodes {
+				if started[n.Name] {
+					continue
+				}
+
+				failed, waiting := []string{}, false
+				for dep := range needs[n.Name] {
+					ok, done := finished[dep]
+					switch {
+					case !done:
+						waiting = true
+					case !ok:
+						failed = append(failed, dep)
+					}
+				}
+
+				if len(failed) != 0 {
+					sort.Strings(failed)
+					log.Warnf("skipping %s, as %v failed", n.Name, failed)
+					started[n.Name] = true
+					finished[n.Name] = false
+					progress = true
+					continue
+				}
+				if waiting || running == jobs || ctx.Err() != nil {
+					continue
+				}
+
+				started[n.Name] = true
+				running++
+				progress = true
+				go func(n Node) {
+					err := fn(ctx, n)
+					if err != nil {
+						err = fmt.Errorf("%s: %w", n.Name, err)
+					}
+					results <- result{name: n.Name, err: err}
+				}(n)
+			}
+		}
+
+		if running == 0 {
+			// Nothing can be started: the context was cancelled.
+			errs = append(errs, ctx.Err())
+			break
+		}
+
+		r := <-results
+		running--
+		finished[r.name] = r.err == nil
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
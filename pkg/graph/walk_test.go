@@ -0,0 +1,114 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	g := &Graph{
+		Nodes: []Node{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}},
+		Edges: []Edge{
+			{From: "a", To: "b", Kind: KindBuild},
+			{From: "b", To: "c", Kind: KindBuild},
+		},
+	}
+
+	var mu sync.Mutex
+	walked := []string{}
+	running, maxRunning := 0, 0
+	err := g.Walk(ctx, 2, func(_ context.Context, n Node) error {
+		mu.Lock()
+		walked = append(walked, n.Name)
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, walked, 4)
+	require.Equal(t, 2, maxRunning)
+
+	// b is only walked after c, and a after b.
+	index := func(name string) int {
+		for i, w := range walked {
+			if w == name {
+				return i
+			}
+		}
+		return -1
+	}
+	require.Less(t, index("c"), index("b"))
+	require.Less(t, index("b"), index("a"))
+}
+
+func TestWalk_failure(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	g := &Graph{
+		Nodes: []Node{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+		Edges: []Edge{
+			{From: "a", To: "b", Kind: KindBuild},
+		},
+	}
+
+	var mu sync.Mutex
+	walked := []string{}
+	err := g.Walk(ctx, 1, func(_ context.Context, n Node) error {
+		mu.Lock()
+		defer mu.Unlock()
+		walked = append(walked, n.Name)
+		if n.Name == "b" {
+			return errors.New("broken")
+		}
+		return nil
+	})
+	require.EqualError(t, err, "b: broken")
+	require.Equal(t, []string{"b", "c"}, walked)
+}
+
+func TestWalk_cycle(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	g := &Graph{
+		Nodes: []Node{{Name: "a"}, {Name: "b"}},
+		Edges: []Edge{
+			{From: "a", To: "b", Kind: KindBuild},
+			{From: "b", To: "a", Kind: KindBuild},
+		},
+	}
+
+	err := g.Walk(ctx, 1, func(context.Context, Node) error {
+		t.Fatal("walked a configuration of a cycle")
+		return nil
+	})
+	require.ErrorContains(t, err, "unable to order a, b")
+}
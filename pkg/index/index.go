@@ -29,6 +29,8 @@ import (
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/sync/errgroup"
+
+	"chainguard.dev/melange/pkg/failure"
 )
 
 type Index struct {
@@ -187,6 +189,11 @@ func (idx *Index) UpdateIndex(ctx context.Context) error {
 	}
 
 	for _, pkg := range packages {
+		// Packages of an unexpected architecture were left out.
+		if pkg == nil {
+			continue
+		}
+
 		found := false
 
 		for i, p := range idx.Index.Packages {
@@ -229,28 +236,45 @@ func (idx *Index) GenerateIndex(ctx context.Context) error {
 	return nil
 }
 
+// WriteArchiveIndex writes the index to destinationFile and signs it.  The
+// index is written and signed beside destinationFile and then renamed over
+// it, so that builds installing from the repository never read a partially
+// written index.
 func (idx *Index) WriteArchiveIndex(ctx context.Context, destinationFile string) error {
 	log := clog.FromContext(ctx)
 	archive, err := apkrepo.ArchiveFromIndex(&idx.Index)
 	if err != nil {
 		return fmt.Errorf("failed to create archive from index object: %w", err)
 	}
-	outFile, err := os.Create(destinationFile)
+	outFile, err := os.CreateTemp(filepath.Dir(destinationFile), "."+filepath.Base(destinationFile)+"-*")
 	if err != nil {
 		return fmt.Errorf("failed to create archive file: %w", err)
 	}
+	defer os.Remove(outFile.Name())
 	defer outFile.Close()
 	if _, err = io.Copy(outFile, archive); err != nil {
 		return fmt.Errorf("failed to write contents to archive file: %w", err)
 	}
 
+	if err := outFile.Chmod(0o644); err != nil {
+		return fmt.Errorf("failed to write contents to archive file: %w", err)
+	}
+
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("failed to write contents to archive file: %w", err)
+	}
+
 	if idx.SigningKey != "" {
-		log.Infof("signing apk index at %s", idx.IndexFile)
-		if err := sign.SignIndex(ctx, idx.SigningKey, idx.IndexFile); err != nil {
-			return fmt.Errorf("failed to sign apk index: %w", err)
+		log.Infof("signing apk index at %s", destinationFile)
+		if err := sign.SignIndex(ctx, idx.SigningKey, outFile.Name()); err != nil {
+			return failure.Wrap(failure.Signing, fmt.Errorf("failed to sign apk index: %w", err))
 		}
 	}
 
+	if err := os.Rename(outFile.Name(), destinationFile); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+
 	return nil
 }
 
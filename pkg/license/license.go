@@ -0,0 +1,140 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package license finds license files, and recognizes the common licenses
+// from their text.
+package license
+
+import (
+	"regexp"
+	"strings"
+)
+
+// fileRegex matches the names of license files, e.g. LICENSE, LICENSE.md,
+// COPYING.LIB or LICENSE-APACHE.
+var fileRegex = regexp.MustCompile(`(?i)^(?:licen[cs]e|copying|copyright)(?:[.\-_].*)?$`)
+
+// IsFile returns whether name is the name of a license file.
+func IsFile(name string) bool {
+	return fileRegex.MatchString(name)
+}
+
+// signature recognizes a license by phrases of its text.
+type signature struct {
+	id string
+	// The text has all of these phrases
+	all []string
+	// and none of these
+	none []string
+}
+
+// The phrases are normalized like the texts they are looked for in.
+var signatures = []signature{{
+	id:  "AGPL-3.0",
+	all: []string{"gnu affero general public license", "version 3"},
+}, {
+	id:  "LGPL-3.0",
+	all: []string{"gnu lesser general public license", "version 3"},
+}, {
+	id:  "LGPL-2.1",
+	all: []string{"gnu lesser general public license", "version 2 1"},
+}, {
+	id:  "LGPL-2.0",
+	all: []string{"gnu library general public license", "version 2"},
+}, {
+	id:   "GPL-3.0",
+	all:  []string{"gnu general public license", "version 3 29 june 2007"},
+	none: []string{"gnu lesser general public license", "gnu affero general public license"},
+}, {
+	id:   "GPL-2.0",
+	all:  []string{"gnu general public license", "version 2 june 1991"},
+	none: []string{"gnu lesser general public license", "gnu library general public license"},
+}, {
+	id:  "Apache-2.0",
+	all: []string{"apache license", "version 2 0"},
+}, {
+	id:  "MPL-2.0",
+	all: []string{"mozilla public license version 2 0"},
+}, {
+	id:  "MIT",
+	all: []string{"permission is hereby granted free of charge to any person obtaining a copy"},
+}, {
+	id:  "BSD-3-Clause",
+	all: []string{"redistribution and use in source and binary forms", "neither the name"},
+}, {
+	id:   "BSD-2-Clause",
+	all:  []string{"redistribution and use in source and binary forms"},
+	none: []string{"neither the name", "all advertising materials"},
+}, {
+	id:  "ISC",
+	all: []string{"permission to use copy modify and or distribute this software for any purpose with or without fee is hereby granted", "provided that the above copyright notice and this permission notice appear in all copies"},
+}, {
+	id:  "Zlib",
+	all: []string{"altered source versions must be plainly marked as such", "this notice may not be removed or altered from any source distribution"},
+}, {
+	id:  "Unlicense",
+	all: []string{"this is free and unencumbered software released into the public domain"},
+}, {
+	id:  "BSL-1.0",
+	all: []string{"boost software license version 1 0"},
+}, {
+	id:  "PSF-2.0",
+	all: []string{"python software foundation license version 2"},
+}}
+
+var nonWordRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normalize lower-cases text and collapses everything but letters and
+// digits, so that phrases are found however the text is wrapped and
+// punctuated.
+func normalize(text string) string {
+	return " " + strings.TrimSpace(nonWordRegex.ReplaceAllString(strings.ToLower(text), " ")) + " "
+}
+
+// Classify returns the SPDX identifiers of the licenses recognized in the
+// text of a license file, without the -only or -or-later suffixes, which
+// cannot be told from the text.  Files may hold several licenses.
+func Classify(text []byte) []string {
+	norm := normalize(string(text))
+	contains := func(phrase string) bool {
+		return strings.Contains(norm, " "+phrase+" ")
+	}
+
+	ids := []string{}
+	for _, sig := range signatures {
+		matches := true
+		for _, phrase := range sig.all {
+			matches = matches && contains(phrase)
+		}
+		for _, phrase := range sig.none {
+			matches = matches && !contains(phrase)
+		}
+		if matches {
+			ids = append(ids, sig.id)
+		}
+	}
+
+	return ids
+}
+
+// Matches returns whether the license identified by id, as returned by
+// Classify, is the license declared as declared, e.g. GPL-2.0 matches
+// GPL-2.0-or-later.
+func Matches(id, declared string) bool {
+	declared = strings.TrimSuffix(declared, "+")
+	declared = strings.TrimSuffix(declared, "-only")
+	declared = strings.TrimSuffix(declared, "-or-later")
+
+	return strings.EqualFold(id, declared)
+}
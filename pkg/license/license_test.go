@@ -0,0 +1,94 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package license
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mitText = `MIT License
+
+Copyright (c) 2024 Hello
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction.`
+
+const bsd3Text = `Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+...
+3. Neither the name of the copyright holder nor the names of its
+   contributors may be used to endorse or promote products derived from
+   this software without specific prior written permission.`
+
+const gpl2Text = `		    GNU GENERAL PUBLIC LICENSE
+		       Version 2, June 1991
+
+ Copyright (C) 1989, 1991 Free Software Foundation, Inc.`
+
+const lgpl21Text = `		  GNU LESSER GENERAL PUBLIC LICENSE
+		       Version 2.1, February 1999
+
+ [This is the first released version of the Lesser GPL.  It also counts
+ as the successor of the GNU Library Public License, version 2, hence
+ the version number 2.1.]
+
+ This license, the Lesser General Public License, applies to some
+ specially designated software packages.  ... the ordinary GNU General
+ Public License, Version 2, June 1991.`
+
+const apacheText = `
+                                 Apache License
+                           Version 2.0, January 2004
+                        http://www.apache.org/licenses/`
+
+func TestClassify(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"mit", mitText, []string{"MIT"}},
+		{"bsd-3", bsd3Text, []string{"BSD-3-Clause"}},
+		{"gpl-2", gpl2Text, []string{"GPL-2.0"}},
+		{"lgpl-2.1", lgpl21Text, []string{"LGPL-2.1"}},
+		{"apache", apacheText, []string{"Apache-2.0"}},
+		{"dual", mitText + "\n\n" + apacheText, []string{"Apache-2.0", "MIT"}},
+		{"unknown", "All rights reserved.", []string{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.want, Classify([]byte(c.text)))
+		})
+	}
+}
+
+func TestIsFile(t *testing.T) {
+	for _, name := range []string{"LICENSE", "LICENSE.md", "license.txt", "LICENCE", "COPYING", "COPYING.LIB", "LICENSE-APACHE", "COPYRIGHT"} {
+		require.True(t, IsFile(name), name)
+	}
+	for _, name := range []string{"README", "licenses.go", "LICENSES", "main.c"} {
+		require.False(t, IsFile(name), name)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	require.True(t, Matches("GPL-2.0", "GPL-2.0-only"))
+	require.True(t, Matches("GPL-2.0", "GPL-2.0-or-later"))
+	require.True(t, Matches("MIT", "MIT"))
+	require.False(t, Matches("GPL-2.0", "LGPL-2.0-only"))
+	require.False(t, Matches("MIT", "Apache-2.0"))
+}
@@ -34,14 +34,19 @@ var defaultLinters = []string{
 	"dev",
 	"documentation",
 	"empty",
+	"headers",
 	"opt",
 	"object",
+	"python/bytecode",
 	"python/docs",
 	"python/multiple",
 	"python/test",
+	"rpath",
 	"srv",
 	"setuidgid",
+	"static",
 	"strip",
+	"symlink",
 	"tempdir",
 	"usrlocal",
 	"varempty",
@@ -15,17 +15,18 @@
 package linter
 
 import (
-	"bytes"
 	"context"
-	"debug/elf"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
+	"chainguard.dev/melange/pkg/elfindex"
 	linter_defaults "chainguard.dev/melange/pkg/linter/defaults"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 
@@ -35,10 +36,52 @@ import (
 type LinterContext struct {
 	pkgname string
 	fsys    fs.FS
+	elf     *elfindex.Index
+	// severities override the severities of linters
+	severities map[string]Severity
 }
 
 func NewLinterContext(name string, fsys fs.FS) LinterContext {
-	return LinterContext{name, fsys}
+	return LinterContext{pkgname: name, fsys: fsys}
+}
+
+// Severity is how much the findings of a linter matter.
+type Severity string
+
+const (
+	// The finding is reported, and never fails the build.
+	SeverityInfo Severity = "info"
+	// The finding is reported, and fails the build with
+	// --fail-on-lint-warning.
+	SeverityWarning Severity = "warning"
+	// The finding fails the build.
+	SeverityError Severity = "error"
+)
+
+// ParseSeverity parses the severity of a linter, as written in the checks of
+// a package.
+func ParseSeverity(s string) (Severity, error) {
+	switch sev := Severity(s); sev {
+	case SeverityInfo, SeverityWarning, SeverityError:
+		return sev, nil
+	}
+	return "", fmt.Errorf("unknown severity %q, must be one of info, warning or error", s)
+}
+
+// Finding is a problem found by a linter whose severity is not error, which
+// is passed to the warn function of the Lint functions.
+type Finding struct {
+	Linter   string
+	Severity Severity
+	Err      error
+}
+
+func (f *Finding) Error() string {
+	return fmt.Sprintf("%s: %v", f.Linter, f.Err)
+}
+
+func (f *Finding) Unwrap() error {
+	return f.Err
 }
 
 type linterFunc func(lctx LinterContext, path string, d fs.DirEntry) error
@@ -46,7 +89,7 @@ type linterFunc func(lctx LinterContext, path string, d fs.DirEntry) error
 type linter struct {
 	LinterFunc  linterFunc
 	LinterClass linter_defaults.LinterClass
-	FailOnError bool
+	Severity    Severity
 	Explain     string
 }
 
@@ -55,108 +98,146 @@ type postLinterFunc func(lctx LinterContext, fsys fs.FS) error
 type postLinter struct {
 	LinterFunc  postLinterFunc
 	LinterClass linter_defaults.LinterClass
-	FailOnError bool
+	Severity    Severity
 	Explain     string
 }
 
+// severity returns the severity of the findings of a linter.
+func (lctx LinterContext) severity(name string, def Severity) Severity {
+	if sev, ok := lctx.severities[name]; ok {
+		return sev
+	}
+	return def
+}
+
 var linterMap = map[string]linter{
 	"dev": {
 		LinterFunc:  devLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "If this package is creating /dev nodes, it should use udev instead; otherwise, remove any files in /dev",
 	},
 	"documentation": {
 		LinterFunc:  documentationLinter,
 		LinterClass: linter_defaults.LinterClassApk | linter_defaults.LinterClassBuild,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Place documentation into a separate package or remove it",
 	},
 	"opt": {
 		LinterFunc:  optLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "This package should be a -compat package",
 	},
 	"object": {
 		LinterFunc:  objectLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "This package contains intermediate object files",
 	},
 	"sbom": {
 		LinterFunc:  sbomLinter,
 		LinterClass: linter_defaults.LinterClassBuild,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Remove any files in /var/lib/db/sbom from the package",
 	},
 	"setuidgid": {
 		LinterFunc:  isSetUIDOrGIDLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Unset the setuid/setgid bit on the relevant files, or remove this linter",
 	},
 	"srv": {
 		LinterFunc:  srvLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "This package should be a -compat package",
 	},
 	"tempdir": {
 		LinterFunc:  tempDirLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Remove any offending files in temporary dirs in the pipeline",
 	},
 	"usrlocal": {
 		LinterFunc:  usrLocalLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "This package should be a -compat package",
 	},
 	"varempty": {
 		LinterFunc:  varEmptyLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Remove any offending files in /var/empty in the pipeline",
 	},
 	"worldwrite": {
 		LinterFunc:  worldWriteableLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Change the permissions of any world-writeable files in the package, disable the linter, or make this a -compat package",
 	},
 	"strip": {
 		LinterFunc:  strippedLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Properly strip all binaries in the pipeline",
 	},
+	"static": {
+		LinterFunc:  staticLinter,
+		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
+		Severity:    SeverityWarning,
+		Explain:     "Move the static libraries to a -static or -dev subpackage, e.g. with the split/static pipeline or the dev-files package option",
+	},
+	"headers": {
+		LinterFunc:  headersLinter,
+		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
+		Severity:    SeverityWarning,
+		Explain:     "Move the headers to a -dev subpackage, e.g. with the split/dev pipeline or the dev-files package option",
+	},
+	"python/bytecode": {
+		LinterFunc:  pythonBytecodeLinter,
+		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
+		Severity:    SeverityWarning,
+		Explain:     "Ship the Python sources along with their byte-compiled files, or remove the byte-compiled files",
+	},
+	"rpath": {
+		LinterFunc:  rpathLinter,
+		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
+		Severity:    SeverityWarning,
+		Explain:     "Remove RPATH and RUNPATH entries which point outside the system library directories or the package, or set the rpath package option to strip",
+	},
 }
 
 var postLinterMap = map[string]postLinter{
 	"empty": {
 		LinterFunc:  emptyPostLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
-		Explain:     "Verify that this package is supposed to be empty; if it is, disable this linter; otherwise check the build",
+		Severity:    SeverityWarning,
+		Explain:     "Verify that this package is supposed to be empty; if it is, set the empty option; otherwise check the build",
 	},
 	"python/docs": {
 		LinterFunc:  pythonDocsPostLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Remove all docs directories from the package",
 	},
+	"symlink": {
+		LinterFunc:  symlinkPostLinter,
+		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
+		Severity:    SeverityInfo,
+		Explain:     "Fix the target of the symlink, or make sure a dependency of the package provides it",
+	},
 	"python/multiple": {
 		LinterFunc:  pythonMultiplePackagesPostLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Split this package up into multiple packages and verify you are not improperly using pip install",
 	},
 	"python/test": {
 		LinterFunc:  pythonTestPostLinter,
 		LinterClass: linter_defaults.LinterClassBuild | linter_defaults.LinterClassApk,
-		FailOnError: false,
+		Severity:    SeverityWarning,
 		Explain:     "Remove all test directories from the package",
 	},
 }
@@ -207,6 +288,42 @@ func documentationLinter(lc LinterContext, path string, _ fs.DirEntry) error {
 	return nil
 }
 
+// isStaticLibraryRegex matches the static libraries of the library
+// directories.
+var isStaticLibraryRegex = regexp.MustCompile(`^(?:usr/)?lib(?:32|64)?/(?:.*/)?[^/]+\.a$`)
+
+// IsStaticLibrary returns whether path is a static library, which belongs in
+// a -static or -dev package.
+func IsStaticLibrary(path string) bool {
+	return isStaticLibraryRegex.MatchString(path)
+}
+
+// IsHeader returns whether path is a C or C++ header, which belongs in a -dev
+// package.
+func IsHeader(path string) bool {
+	return strings.HasPrefix(path, "usr/include/")
+}
+
+func staticLinter(lc LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || !IsStaticLibrary(path) {
+		return nil
+	}
+	if strings.HasSuffix(lc.pkgname, "-static") || strings.HasSuffix(lc.pkgname, "-dev") {
+		return nil
+	}
+	return fmt.Errorf("package contains static library %s but is not a -static or -dev package", path)
+}
+
+func headersLinter(lc LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || !IsHeader(path) {
+		return nil
+	}
+	if strings.HasSuffix(lc.pkgname, "-dev") || strings.HasSuffix(lc.pkgname, "-headers") {
+		return nil
+	}
+	return fmt.Errorf("package contains header %s but is not a -dev package", path)
+}
+
 func isSetUIDOrGIDLinter(_ LinterContext, path string, d fs.DirEntry) error {
 	if isIgnoredPath(path) {
 		return nil
@@ -293,8 +410,6 @@ func worldWriteableLinter(_ LinterContext, path string, d fs.DirEntry) error {
 	return nil
 }
 
-var elfMagic = []byte{'\x7f', 'E', 'L', 'F'}
-
 func strippedLinter(lctx LinterContext, path string, d fs.DirEntry) error {
 	if isIgnoredPath(path) {
 		return nil
@@ -310,11 +425,6 @@ func strippedLinter(lctx LinterContext, path string, d fs.DirEntry) error {
 		return err
 	}
 
-	if info.Size() < int64(len(elfMagic)) {
-		// This is definitely not an ELF file.
-		return nil
-	}
-
 	ext := filepath.Ext(path)
 	mode := info.Mode()
 	if mode&0111 == 0 && !isObjectFileRegex.MatchString(ext) {
@@ -322,44 +432,202 @@ func strippedLinter(lctx LinterContext, path string, d fs.DirEntry) error {
 		return nil
 	}
 
-	f, err := lctx.fsys.Open(path)
-	if err != nil {
-		return fmt.Errorf("opening file: %w", err)
+	file := lctx.elf.Get(path)
+	if file == nil {
+		// Not an ELF file.
+		return nil
 	}
-	defer f.Close()
 
-	// Both os.DirFS and go-apk return a file that implements ReaderAt.
-	// We don't have any other callers, so this should never fail.
-	readerAt, ok := f.(io.ReaderAt)
-	if !ok {
-		return fmt.Errorf("fs.File does not impl ReaderAt: %T", f)
+	// No debug sections allowed
+	if slices.Contains(file.Sections, ".debug") || slices.Contains(file.Sections, ".zdebug") {
+		return fmt.Errorf("ELF file is not stripped")
+	}
+
+	return nil
+}
+
+// insecureRPathPrefixes are directories which are only present while the
+// package is being built.
+var insecureRPathPrefixes = []string{
+	"/home/",
+	"/tmp/",
+	"/var/tmp/",
+	"/build/",
+	"/usr/src/",
+}
+
+// InsecureRPath returns why entry, an entry of the DT_RPATH or DT_RUNPATH of
+// the ELF file at path (relative to the package root), is insecure or
+// non-portable, or an empty string if it is not.
+func InsecureRPath(path, entry string) string {
+	if entry == "" {
+		return "empty entry searches the current directory"
 	}
 
-	hdr := make([]byte, len(elfMagic))
-	if _, err := readerAt.ReadAt(hdr, 0); err != nil {
-		return fmt.Errorf("failed to read %d bytes for magic ELF header: %w", len(elfMagic), err)
+	for _, origin := range []string{"$ORIGIN", "${ORIGIN}"} {
+		if rest, ok := strings.CutPrefix(entry, origin); ok {
+			resolved := filepath.Join(filepath.Dir(path), rest)
+			if resolved == ".." || strings.HasPrefix(resolved, "../") {
+				return fmt.Sprintf("%s points outside the package", entry)
+			}
+			return ""
+		}
+	}
+
+	if !filepath.IsAbs(entry) {
+		return fmt.Sprintf("%s is a relative path", entry)
+	}
+
+	if strings.Contains(entry, "melange-out") {
+		return fmt.Sprintf("%s points into the build workspace", entry)
+	}
+	for _, prefix := range insecureRPathPrefixes {
+		if strings.HasPrefix(filepath.Clean(entry)+"/", prefix) {
+			return fmt.Sprintf("%s points into a build-time directory", entry)
+		}
+	}
+
+	return ""
+}
+
+func rpathLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	if isIgnoredPath(path) {
+		return nil
 	}
 
-	if !bytes.Equal(elfMagic, hdr) {
-		// No magic header, definitely not ELF.
+	file := lctx.elf.Get(path)
+	if file == nil {
+		// Not an ELF file.
 		return nil
 	}
 
-	file, err := elf.NewFile(readerAt)
-	if err != nil {
-		// We don't particularly care if this fails otherwise.
-		fmt.Printf("WARNING: Could not open file %q as executable: %v\n", path, err)
+	problems := []string{}
+	for _, entry := range file.RPath {
+		if reason := InsecureRPath(path, entry); reason != "" {
+			problems = append(problems, reason)
+		}
 	}
-	defer file.Close()
 
-	// No debug sections allowed
-	if file.Section(".debug") != nil || file.Section(".zdebug") != nil {
-		return fmt.Errorf("ELF file is not stripped")
+	if len(problems) > 0 {
+		return fmt.Errorf("%s has insecure RPATH or RUNPATH: %s", path, strings.Join(problems, ", "))
 	}
 
 	return nil
 }
 
+// readlinkDirFS is os.DirFS, which can read symlinks like the file systems
+// of APKs.
+type readlinkDirFS struct {
+	fs.FS
+	dir string
+}
+
+func (fsys readlinkDirFS) Readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(fsys.dir, filepath.FromSlash(name)))
+}
+
+// maxSymlinks is how many symlinks are followed to resolve a path.
+const maxSymlinks = 40
+
+// symlinkPostLinter reports the symlinks whose targets are not in the
+// package.  Their targets may be in the dependencies of the package, which is
+// why the linter only informs by default.
+func symlinkPostLinter(_ LinterContext, fsys fs.FS) error {
+	rl, ok := fsys.(interface {
+		Readlink(name string) (string, error)
+	})
+	if !ok {
+		return nil
+	}
+
+	// targets maps the paths of the package to the targets of the symlinks,
+	// and to "" for the other files.
+	targets := map[string]string{}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		targets[p] = ""
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := rl.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			target = "."
+		}
+		targets[p] = target
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	broken := []string{}
+	for p, target := range targets {
+		if target == "" {
+			continue
+		}
+		if !resolves(targets, p) {
+			broken = append(broken, fmt.Sprintf("%s -> %s", p, target))
+		}
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+
+	slices.Sort(broken)
+	return fmt.Errorf("symlinks point at files which are not in the package: %s", strings.Join(broken, ", "))
+}
+
+// resolves returns whether the symlink at p points at a file of the package,
+// following the symlinks it points at.
+func resolves(targets map[string]string, p string) bool {
+	for i := 0; i < maxSymlinks; i++ {
+		target, ok := targets[p]
+		switch {
+		case !ok:
+			return false
+		case target == "":
+			return true
+		case path.IsAbs(target):
+			p = path.Clean(strings.TrimPrefix(target, "/"))
+		default:
+			p = path.Join(path.Dir(p), target)
+		}
+		if p == "" || p == ".." || strings.HasPrefix(p, "../") {
+			return false
+		}
+	}
+
+	// A symlink loop.
+	return false
+}
+
+// isPythonBytecodeRegex matches byte-compiled Python files, capturing the
+// name of their source without the .py extension.
+var isPythonBytecodeRegex = regexp.MustCompile(`^(?:(?:(.*)/)?__pycache__/([^/.]+)\.[^/]+|(.*?))\.py[co]$`)
+
+func pythonBytecodeLinter(lctx LinterContext, p string, d fs.DirEntry) error {
+	m := isPythonBytecodeRegex.FindStringSubmatch(p)
+	if m == nil || d.IsDir() {
+		return nil
+	}
+
+	// __pycache__/mod.cpython-312.pyc is compiled from ../mod.py, and the
+	// legacy mod.pyc from mod.py next to it.
+	source := m[3] + ".py"
+	if m[2] != "" {
+		source = path.Join(m[1], m[2]+".py")
+	}
+	if _, err := fs.Stat(lctx.fsys, source); err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("byte-compiled file %s has no source %s", p, source)
+}
+
 func emptyPostLinter(_ LinterContext, fsys fs.FS) error {
 	foundfile := false
 	walkCb := func(path string, d fs.DirEntry, err error) error {
@@ -390,7 +658,7 @@ func emptyPostLinter(_ LinterContext, fsys fs.FS) error {
 		return nil
 	}
 
-	return fmt.Errorf("package is empty but no-provides is not set")
+	return fmt.Errorf("package is empty but neither the empty nor the no-provides option is set")
 }
 
 func getPythonSitePackages(fsys fs.FS) (matches []string, err error) {
@@ -538,20 +806,38 @@ func (lctx LinterContext) lintPackageFs(warn func(error), linters []string, lint
 	if len(badLints) > 0 {
 		return fmt.Errorf("unknown linter(s): %s", strings.Join(badLints, ", "))
 	}
+	for name := range lctx.severities {
+		if len(CheckValidLinters([]string{name})) != 0 {
+			return fmt.Errorf("unknown linter %s in severities", name)
+		}
+	}
+
+	// We already checked that all linters are valid, so the ones which are
+	// not walking linters must be post linters.
+	walkLinters, postLinters := []string{}, []string{}
+	for _, linterName := range linters {
+		if _, present := linterMap[linterName]; present {
+			walkLinters = append(walkLinters, linterName)
+		} else {
+			postLinters = append(postLinters, linterName)
+		}
+	}
+
+	if lctx.elf == nil {
+		idx, err := elfindex.New(lctx.fsys)
+		if err != nil {
+			return fmt.Errorf("indexing ELF files: %w", err)
+		}
+		lctx.elf = idx
+	}
 
-	postLinters := []string{}
 	walkCb := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("error traversing tree at %s: %w", path, err)
 		}
 
-		for _, linterName := range linters {
-			linter, present := linterMap[linterName]
-			if !present {
-				// We already checked that all linters are valid, so this must be a post linter
-				postLinters = append(postLinters, linterName)
-				continue
-			}
+		for _, linterName := range walkLinters {
+			linter := linterMap[linterName]
 
 			if linter.LinterClass&linterClass == 0 {
 				// Linter not in class, ignored
@@ -560,10 +846,11 @@ func (lctx LinterContext) lintPackageFs(warn func(error), linters []string, lint
 
 			err = linter.LinterFunc(lctx, path, d)
 			if err != nil {
-				if linter.FailOnError {
+				sev := lctx.severity(linterName, linter.Severity)
+				if sev == SeverityError {
 					return fmt.Errorf("linter %s failed at path %q: %w; suggest: %s", linterName, path, err, linter.Explain)
 				}
-				warn(err)
+				warn(&Finding{Linter: linterName, Severity: sev, Err: err})
 			}
 		}
 
@@ -585,10 +872,11 @@ func (lctx LinterContext) lintPackageFs(warn func(error), linters []string, lint
 
 		err := linter.LinterFunc(lctx, lctx.fsys)
 		if err != nil {
-			if linter.FailOnError {
-				return fmt.Errorf("linter %s failed; suggest: %s", linterName, linter.Explain)
+			sev := lctx.severity(linterName, linter.Severity)
+			if sev == SeverityError {
+				return fmt.Errorf("linter %s failed: %w; suggest: %s", linterName, err, linter.Explain)
 			}
-			warn(err)
+			warn(&Finding{Linter: linterName, Severity: sev, Err: err})
 		}
 	}
 
@@ -597,9 +885,23 @@ func (lctx LinterContext) lintPackageFs(warn func(error), linters []string, lint
 
 // Lint the given build directory at the given path
 func LintBuild(packageName string, path string, warn func(error), linters []string) error {
-	fsys := os.DirFS(path)
+	return LintBuildWithIndex(packageName, path, nil, warn, linters, nil)
+}
+
+// LintBuildWithIndex lints the given build directory at the given path,
+// reading the metadata of its ELF files from index, which is built if nil.
+// The severities override those of the linters.
+func LintBuildWithIndex(packageName string, path string, index *elfindex.Index, warn func(error), linters []string, severities map[string]Severity) error {
+	return LintBuildFS(packageName, readlinkDirFS{FS: os.DirFS(path), dir: path}, index, warn, linters, severities)
+}
 
+// LintBuildFS is LintBuildWithIndex for the files of the package in fsys.
+// The symlink linter only checks the symlinks of a fsys which has a
+// Readlink method.
+func LintBuildFS(packageName string, fsys fs.FS, index *elfindex.Index, warn func(error), linters []string, severities map[string]Severity) error {
 	lctx := NewLinterContext(packageName, fsys)
+	lctx.elf = index
+	lctx.severities = severities
 
 	return lctx.lintPackageFs(warn, linters, linter_defaults.LinterClassBuild)
 }
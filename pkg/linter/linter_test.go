@@ -18,6 +18,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/chainguard-dev/clog/slogtest"
@@ -63,6 +64,23 @@ func Test_emptyLinter(t *testing.T) {
 	assert.True(t, called)
 }
 
+func Test_postLinterRunsOnce(t *testing.T) {
+	dir := t.TempDir()
+	sbomDir := filepath.Join(dir, "var", "lib", "db", "sbom")
+	assert.NoError(t, os.MkdirAll(sbomDir, 0700))
+	for _, name := range []string{"a.spdx.json", "b.spdx.json", "c.spdx.json"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(sbomDir, name), []byte("{}"), 0700))
+	}
+
+	// The package only holds SBOMs, so it is empty, and the post linter
+	// warns once however many files were walked.
+	calls := 0
+	assert.NoError(t, LintBuild("testempty", dir, func(err error) {
+		calls++
+	}, []string{"empty"}))
+	assert.Equal(t, 1, calls)
+}
+
 func Test_usrLocalLinter(t *testing.T) {
 	dir, err := os.MkdirTemp("", "melange.XXXXX")
 	defer os.RemoveAll(dir)
@@ -643,3 +661,158 @@ func Test_lintApk(t *testing.T) {
 	}, linter_defaults.GetDefaultLinters(linter_defaults.LinterClassApk)))
 	assert.True(t, called)
 }
+
+func TestInsecureRPath(t *testing.T) {
+	for _, c := range []struct {
+		path, entry string
+		insecure    bool
+	}{
+		{"usr/bin/foo", "/usr/lib", false},
+		{"usr/bin/foo", "$ORIGIN/../lib", false},
+		{"usr/lib/foo/bar.so", "${ORIGIN}/../..", false},
+		{"usr/bin/foo", "$ORIGIN/../../../lib", true},
+		{"usr/bin/foo", "", true},
+		{"usr/bin/foo", "lib", true},
+		{"usr/bin/foo", "/home/build/lib", true},
+		{"usr/bin/foo", "/tmp", true},
+		{"usr/bin/foo", "/usr/melange-out/foo/usr/lib", true},
+		{"usr/bin/foo", "/homework/lib", false},
+	} {
+		got := InsecureRPath(c.path, c.entry)
+		assert.Equal(t, c.insecure, got != "", "%s: %q: %s", c.path, c.entry, got)
+	}
+}
+
+func Test_symlinkLinter(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "lib"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "lib", "libfoo.so.1"), []byte{}, 0o644))
+	for link, target := range map[string]string{
+		"usr/lib/libfoo.so":   "libfoo.so.1",
+		"usr/lib/libfoo.so.0": "/usr/lib/libfoo.so",
+		"usr/lib/libbar.so":   "libbar.so.1",
+		"usr/lib/escape":      "../../../etc/passwd",
+		"usr/lib/loop":        "loop",
+	} {
+		assert.NoError(t, os.Symlink(target, filepath.Join(dir, link)))
+	}
+
+	findings := []error{}
+	assert.NoError(t, LintBuild("testsymlink", dir, func(err error) {
+		findings = append(findings, err)
+	}, []string{"symlink"}))
+	assert.Len(t, findings, 1)
+	assert.EqualError(t, findings[0], "symlink: symlinks point at files which are not in the package: usr/lib/escape -> ../../../etc/passwd, usr/lib/libbar.so -> libbar.so.1, usr/lib/loop -> loop")
+
+	// The targets of symlinks may be provided by dependencies, so the
+	// linter only informs by default.
+	finding := &Finding{}
+	assert.ErrorAs(t, findings[0], &finding)
+	assert.Equal(t, SeverityInfo, finding.Severity)
+}
+
+func Test_pythonBytecodeLinter(t *testing.T) {
+	dir := t.TempDir()
+	site := filepath.Join(dir, "usr", "lib", "python3.12", "site-packages", "foo")
+	assert.NoError(t, os.MkdirAll(filepath.Join(site, "__pycache__"), 0o755))
+	for _, name := range []string{
+		"__init__.py",
+		"__pycache__/__init__.cpython-312.pyc",
+		"__pycache__/__init__.cpython-312.opt-1.pyc",
+		"legacy.py",
+		"legacy.pyc",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(site, name), []byte{}, 0o644))
+	}
+
+	called := false
+	assert.NoError(t, LintBuild("testbytecode", dir, func(err error) {
+		called = true
+	}, []string{"python/bytecode"}))
+	assert.False(t, called)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(site, "__pycache__", "secret.cpython-312.pyc"), []byte{}, 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(site, "orphan.pyc"), []byte{}, 0o644))
+
+	findings := []string{}
+	assert.NoError(t, LintBuild("testbytecode", dir, func(err error) {
+		findings = append(findings, err.Error())
+	}, []string{"python/bytecode"}))
+	assert.Equal(t, []string{
+		"python/bytecode: byte-compiled file usr/lib/python3.12/site-packages/foo/__pycache__/secret.cpython-312.pyc has no source usr/lib/python3.12/site-packages/foo/secret.py",
+		"python/bytecode: byte-compiled file usr/lib/python3.12/site-packages/foo/orphan.pyc has no source usr/lib/python3.12/site-packages/foo/orphan.py",
+	}, findings)
+}
+
+func Test_devFilesLinters(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"usr/lib/libfoo.a",
+		"usr/lib/libfoo.so.1",
+		"usr/lib/foo/plugins/libbar.a",
+		"usr/include/foo/foo.h",
+		"usr/share/foo/data.a",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{}, 0o644))
+	}
+
+	for _, c := range []struct {
+		pkg  string
+		want []string
+	}{{
+		pkg: "foo",
+		want: []string{
+			"headers: package contains header usr/include/foo/foo.h but is not a -dev package",
+			"static: package contains static library usr/lib/foo/plugins/libbar.a but is not a -static or -dev package",
+			"static: package contains static library usr/lib/libfoo.a but is not a -static or -dev package",
+		},
+	}, {
+		pkg:  "foo-dev",
+		want: []string{},
+	}, {
+		pkg:  "foo-static",
+		want: []string{"headers: package contains header usr/include/foo/foo.h but is not a -dev package"},
+	}} {
+		findings := []string{}
+		assert.NoError(t, LintBuild(c.pkg, dir, func(err error) {
+			findings = append(findings, err.Error())
+		}, []string{"headers", "static"}))
+		slices.Sort(findings)
+		assert.Equal(t, c.want, findings, c.pkg)
+	}
+}
+
+func Test_severities(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "usr", "local"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "usr", "local", "foo"), []byte{}, 0o755))
+
+	var findings []*Finding
+	warn := func(err error) {
+		finding := &Finding{}
+		assert.ErrorAs(t, err, &finding)
+		findings = append(findings, finding)
+	}
+
+	assert.NoError(t, LintBuildWithIndex("testseverity", dir, nil, warn, []string{"usrlocal"}, nil))
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "usrlocal", findings[0].Linter)
+	assert.Equal(t, SeverityWarning, findings[0].Severity)
+
+	findings = nil
+	assert.NoError(t, LintBuildWithIndex("testseverity", dir, nil, warn, []string{"usrlocal"}, map[string]Severity{"usrlocal": SeverityInfo}))
+	assert.Len(t, findings, 1)
+	assert.Equal(t, SeverityInfo, findings[0].Severity)
+
+	findings = nil
+	err := LintBuildWithIndex("testseverity", dir, nil, warn, []string{"usrlocal"}, map[string]Severity{"usrlocal": SeverityError})
+	assert.ErrorContains(t, err, "linter usrlocal failed")
+	assert.Empty(t, findings)
+
+	err = LintBuildWithIndex("testseverity", dir, nil, warn, []string{"usrlocal"}, map[string]Severity{"nope": SeverityError})
+	assert.ErrorContains(t, err, "unknown linter nope")
+
+	_, err = ParseSeverity("fatal")
+	assert.Error(t, err)
+}
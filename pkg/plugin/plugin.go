@@ -0,0 +1,232 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugin runs external executables which extend a build.  The
+// protocol is described in docs/PLUGINS.md.
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// ProtocolVersion is the version of the plugin protocol.  It is incremented
+// whenever a field is removed or its meaning is changed.
+const ProtocolVersion = 1
+
+// Kind is the kind of extension a plugin provides.
+type Kind string
+
+const (
+	// KindGenerator plugins generate dependencies and provides for a package.
+	KindGenerator Kind = "generator"
+	// KindLinter plugins report problems with the contents of a package.
+	KindLinter Kind = "linter"
+	// KindSBOM plugins enrich the SBOM of a package.
+	KindSBOM Kind = "sbom"
+)
+
+var kinds = []Kind{KindGenerator, KindLinter, KindSBOM}
+
+// Plugin is an executable discovered in a plugins directory.
+type Plugin struct {
+	// The name of the plugin, e.g. foo for melange-generator-foo
+	Name string
+	// The kind of extension the plugin provides
+	Kind Kind
+	// The path of the executable
+	Path string
+}
+
+// Package describes the package a plugin is run for.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Epoch   uint64 `json:"epoch"`
+	Arch    string `json:"arch"`
+	// The name of the origin package, which differs from the name for
+	// subpackages
+	Origin string `json:"origin"`
+}
+
+// Request is written to the standard input of a plugin.
+type Request struct {
+	// The version of the protocol
+	Version int `json:"version"`
+	// The kind of the plugin being run
+	Kind Kind `json:"kind"`
+	// The package the plugin is run for
+	Package Package `json:"package"`
+	// The directory holding the contents of the package
+	Path string `json:"path"`
+	// The SBOM document of the package, for sbom plugins
+	SBOM json.RawMessage `json:"sbom,omitempty"`
+}
+
+// Dependencies are the dependencies returned by a generator plugin.
+type Dependencies struct {
+	Runtime  []string `json:"runtime,omitempty"`
+	Provides []string `json:"provides,omitempty"`
+	Vendored []string `json:"vendored,omitempty"`
+}
+
+// Finding is a single problem reported by a linter plugin.
+type Finding struct {
+	// The path of the offending file, relative to the package root, if any
+	Path string `json:"path,omitempty"`
+	// A human readable description of the problem
+	Message string `json:"message"`
+}
+
+// Response is read from the standard output of a plugin.
+type Response struct {
+	// The version of the protocol
+	Version int `json:"version"`
+	// The dependencies found by a generator plugin
+	Dependencies Dependencies `json:"dependencies"`
+	// The problems found by a linter plugin
+	Findings []Finding `json:"findings,omitempty"`
+	// The enriched SBOM document returned by an sbom plugin.  If it is not
+	// set, the SBOM is left unchanged.
+	SBOM json.RawMessage `json:"sbom,omitempty"`
+}
+
+// Discover returns the plugins in dirs.  A plugin is an executable file
+// named melange-<kind>-<name>, e.g. melange-linter-licenses.  Directories
+// which do not exist are ignored.
+func Discover(dirs ...string) ([]Plugin, error) {
+	plugins := []Plugin{}
+	seen := map[string]bool{}
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading plugins directory %s: %w", dir, err)
+		}
+
+		for _, ent := range entries {
+			p, ok := parseName(ent.Name())
+			if !ok {
+				continue
+			}
+
+			info, err := os.Stat(filepath.Join(dir, ent.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+				continue
+			}
+
+			// Earlier directories take precedence.
+			if seen[ent.Name()] {
+				continue
+			}
+			seen[ent.Name()] = true
+
+			p.Path = filepath.Join(dir, ent.Name())
+			plugins = append(plugins, p)
+		}
+	}
+
+	sort.SliceStable(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+
+	return plugins, nil
+}
+
+func parseName(name string) (Plugin, bool) {
+	rest, ok := strings.CutPrefix(name, "melange-")
+	if !ok {
+		return Plugin{}, false
+	}
+
+	for _, kind := range kinds {
+		if pname, ok := strings.CutPrefix(rest, string(kind)+"-"); ok && pname != "" {
+			return Plugin{Name: pname, Kind: kind}, true
+		}
+	}
+
+	return Plugin{}, false
+}
+
+// OfKind returns the plugins of the given kind.
+func OfKind(plugins []Plugin, kind Kind) []Plugin {
+	filtered := []Plugin{}
+	for _, p := range plugins {
+		if p.Kind == kind {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered
+}
+
+// Run runs the plugin with req on its standard input and decodes the
+// response from its standard output.  Anything the plugin writes to its
+// standard error is logged.  The plugin fails if it exits with a non-zero
+// status.
+func (p Plugin) Run(ctx context.Context, req Request) (*Response, error) {
+	log := clog.FromContext(ctx)
+
+	req.Version = ProtocolVersion
+	req.Kind = p.Kind
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding plugin request: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("running %s plugin %s", p.Kind, p.Name)
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" {
+			log.Infof("%s: %s", p.Name, line)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running %s plugin %s: %w", p.Kind, p.Name, err)
+	}
+
+	resp := Response{}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("decoding response of %s plugin %s: %w", p.Kind, p.Name, err)
+	}
+
+	if resp.Version != ProtocolVersion {
+		return nil, fmt.Errorf("%s plugin %s speaks protocol version %d, expected %d", p.Kind, p.Name, resp.Version, ProtocolVersion)
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writePlugin(t *testing.T, dir, name, script string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0o755))
+}
+
+func TestDiscover(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+
+	writePlugin(t, first, "melange-generator-foo", "")
+	writePlugin(t, first, "melange-linter-bar", "")
+	writePlugin(t, second, "melange-linter-bar", "")
+	writePlugin(t, second, "melange-sbom-baz", "")
+	writePlugin(t, second, "melange-unknown-qux", "")
+	writePlugin(t, second, "melange-linter-", "")
+	require.NoError(t, os.WriteFile(filepath.Join(second, "melange-generator-noexec"), nil, 0o644))
+
+	plugins, err := Discover(first, second, filepath.Join(first, "missing"))
+	require.NoError(t, err)
+	require.Equal(t, []Plugin{
+		{Name: "bar", Kind: KindLinter, Path: filepath.Join(first, "melange-linter-bar")},
+		{Name: "baz", Kind: KindSBOM, Path: filepath.Join(second, "melange-sbom-baz")},
+		{Name: "foo", Kind: KindGenerator, Path: filepath.Join(first, "melange-generator-foo")},
+	}, plugins)
+
+	require.Len(t, OfKind(plugins, KindLinter), 1)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// The plugin echoes the package name back as a provide.
+	writePlugin(t, dir, "melange-generator-echo", `
+name=$(sed -e 's/.*"name":"\([^"]*\)".*/\1/')
+echo "running for $name" >&2
+printf '{"version": 1, "dependencies": {"provides": ["cmd:%s"]}}' "$name"
+`)
+	writePlugin(t, dir, "melange-linter-fail", "echo broken >&2; exit 1\n")
+	writePlugin(t, dir, "melange-linter-old", `echo '{"version": 0}'`+"\n")
+
+	plugins, err := Discover(dir)
+	require.NoError(t, err)
+	require.Len(t, plugins, 3)
+
+	resp, err := plugins[0].Run(ctx, Request{Package: Package{Name: "hello"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"cmd:hello"}, resp.Dependencies.Provides)
+
+	_, err = plugins[1].Run(ctx, Request{})
+	require.ErrorContains(t, err, "running linter plugin fail")
+
+	_, err = plugins[2].Run(ctx, Request{})
+	require.ErrorContains(t, err, "protocol version 0")
+}
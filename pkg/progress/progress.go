@@ -0,0 +1,421 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress reports the state of each package of a build: the
+// pipeline step it runs or whether it is being emitted.  On a terminal, a
+// line per package is redrawn in place below the logs; elsewhere, a line is
+// logged as each step and package is done.
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"golang.org/x/term"
+)
+
+// tickInterval is how often the lines of a terminal are redrawn, to animate
+// the spinners and update the durations.
+const tickInterval = 100 * time.Millisecond
+
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+type state int
+
+const (
+	waiting state = iota
+	running
+	done
+	failed
+	skipped
+)
+
+// group is the progress of a package.
+type group struct {
+	name  string
+	state state
+	// task is the task running, or the last one which ran.
+	task  string
+	start time.Time
+	// began is when the first task of the package began.
+	began time.Time
+	ended time.Time
+	tasks int
+	// flushed is whether the final line of the group was drawn above the
+	// lines which are redrawn.
+	flushed bool
+}
+
+// Tracker tracks the progress of the packages of one or more builds.  The
+// methods of a nil Tracker do nothing.
+type Tracker struct {
+	mu     sync.Mutex
+	groups []*group
+	byName map[string]*group
+
+	// out is the terminal the lines are drawn on, or nil to log them.
+	out   io.Writer
+	width func() int
+	// drawn is how many lines were drawn, which are erased before the next
+	// draw.
+	drawn int
+	frame int
+	// stop stops redrawing the terminal periodically.
+	stop chan struct{}
+}
+
+// New returns a Tracker which draws on f if it is a terminal, or logs the
+// progress otherwise.
+func New(f *os.File) *Tracker {
+	if !term.IsTerminal(int(f.Fd())) {
+		return NewLogger()
+	}
+
+	return NewTerminal(f, func() int {
+		w, _, err := term.GetSize(int(f.Fd()))
+		if err != nil {
+			return 0
+		}
+		return w
+	})
+}
+
+// NewTerminal returns a Tracker which draws a line per package on out, in
+// place.  width returns the width of the terminal, which lines are cut to,
+// or 0 if it is unknown.
+func NewTerminal(out io.Writer, width func() int) *Tracker {
+	return &Tracker{byName: map[string]*group{}, out: out, width: width}
+}
+
+// NewLogger returns a Tracker which logs a line as each task and package is
+// done.
+func NewLogger() *Tracker {
+	return &Tracker{byName: map[string]*group{}}
+}
+
+type trackerKey struct{}
+
+// WithTracker returns a context which carries t.
+func WithTracker(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// FromContext returns the Tracker of ctx, or nil.
+func FromContext(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// Writer returns a writer which writes to w, erasing the lines drawn on the
+// terminal first and drawing them again after, so that the logs written to
+// the same terminal scroll above them.
+func (t *Tracker) Writer(w io.Writer) io.Writer {
+	if t == nil || t.out == nil {
+		return w
+	}
+	return &writer{t: t, w: w}
+}
+
+type writer struct {
+	t *Tracker
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+
+	w.t.erase()
+	n, err := w.w.Write(p)
+	w.t.draw()
+
+	return n, err
+}
+
+// Add adds a package which waits for its first task.
+func (t *Tracker) Add(name string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.group(name)
+	t.redraw()
+}
+
+// group returns the group named name, adding it if needed.
+func (t *Tracker) group(name string) *group {
+	g, ok := t.byName[name]
+	if !ok {
+		g = &group{name: name}
+		t.byName[name] = g
+		t.groups = append(t.groups, g)
+	}
+	return g
+}
+
+// Begin starts the task of the package name, e.g. a pipeline step, and
+// returns the function which ends it with the error of the task.
+func (t *Tracker) Begin(ctx context.Context, name, task string) func(error) {
+	if t == nil {
+		return func(error) {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	g := t.group(name)
+	g.state, g.task, g.start = running, task, time.Now()
+	if g.began.IsZero() {
+		g.began = g.start
+	}
+	t.startTicker()
+	t.redraw()
+
+	return func(err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		elapsed := time.Since(g.start).Round(time.Second)
+		g.tasks++
+		if err != nil {
+			g.state, g.ended = failed, time.Now()
+		} else {
+			g.state = waiting
+		}
+
+		if t.out == nil {
+			log := clog.FromContext(ctx)
+			if err != nil {
+				log.Errorf("%s: %s failed after %s", name, task, elapsed)
+			} else {
+				log.Infof("%s: %s done in %s", name, task, elapsed)
+			}
+		}
+		t.redraw()
+	}
+}
+
+// Done marks the package name as done.
+func (t *Tracker) Done(ctx context.Context, name string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.finish(ctx, t.group(name), done)
+	t.redraw()
+}
+
+// Skip marks the package name as skipped.
+func (t *Tracker) Skip(ctx context.Context, name string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.finish(ctx, t.group(name), skipped)
+	t.redraw()
+}
+
+// Settle marks the packages of names which are not finished yet as failed
+// if err is set, or as done, e.g. when their build returns.
+func (t *Tracker) Settle(ctx context.Context, names []string, err error) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, name := range names {
+		g := t.group(name)
+		switch {
+		case g.state >= done:
+		case err != nil:
+			t.finish(ctx, g, failed)
+		default:
+			t.finish(ctx, g, done)
+		}
+	}
+	t.redraw()
+}
+
+func (t *Tracker) finish(ctx context.Context, g *group, s state) {
+	g.state, g.ended = s, time.Now()
+	if t.out == nil && s == done {
+		clog.FromContext(ctx).Infof("%s: %s", g.name, g.status(g.ended))
+	}
+}
+
+// status describes the state of the group at now.
+func (g *group) status(now time.Time) string {
+	switch g.state {
+	case running:
+		return fmt.Sprintf("%s (%s)", g.task, now.Sub(g.start).Round(time.Second))
+	case done:
+		if g.began.IsZero() {
+			return "done"
+		}
+		return fmt.Sprintf("done in %s", g.ended.Sub(g.began).Round(time.Second))
+	case failed:
+		if g.task == "" {
+			return "failed"
+		}
+		return fmt.Sprintf("failed: %s", g.task)
+	case skipped:
+		return "skipped"
+	}
+
+	switch g.tasks {
+	case 0:
+		return "waiting"
+	case 1:
+		return "1 step done"
+	}
+	return fmt.Sprintf("%d steps done", g.tasks)
+}
+
+// symbol is the mark of the line of the group.
+func (g *group) symbol(frame int) string {
+	switch g.state {
+	case running:
+		return spinner[frame%len(spinner)]
+	case done:
+		return "✓"
+	case failed:
+		return "✗"
+	case skipped:
+		return "-"
+	}
+	return "·"
+}
+
+// startTicker starts redrawing the terminal periodically, until no package
+// is running.
+func (t *Tracker) startTicker() {
+	if t.out == nil || t.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	t.stop = stop
+	go func() {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.mu.Lock()
+				t.frame++
+				t.redraw()
+				t.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// redraw draws the lines on the terminal again.
+func (t *Tracker) redraw() {
+	if t.out == nil {
+		return
+	}
+
+	t.erase()
+	t.draw()
+
+	if t.stop != nil && !t.busy() {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+// busy returns whether a package is running a task.
+func (t *Tracker) busy() bool {
+	for _, g := range t.groups {
+		if g.state == running {
+			return true
+		}
+	}
+	return false
+}
+
+// erase erases the lines drawn on the terminal.
+func (t *Tracker) erase() {
+	if t.drawn == 0 {
+		return
+	}
+	fmt.Fprintf(t.out, "\x1b[%dA\x1b[J", t.drawn)
+	t.drawn = 0
+}
+
+// draw draws the final line of each package which finished once, above the
+// lines of the packages which did not finish, which are drawn again next
+// time.
+func (t *Tracker) draw() {
+	now := time.Now()
+
+	pad := 0
+	for _, g := range t.groups {
+		if !g.flushed {
+			pad = max(pad, len(g.name))
+		}
+	}
+
+	var sb strings.Builder
+	live := 0
+	for _, g := range t.groups {
+		if g.flushed || g.state < done {
+			continue
+		}
+		sb.WriteString(t.line(g, pad, now))
+		g.flushed = true
+	}
+	for _, g := range t.groups {
+		if g.state >= done {
+			continue
+		}
+		sb.WriteString(t.line(g, pad, now))
+		live++
+	}
+
+	io.WriteString(t.out, sb.String()) //nolint:errcheck
+	t.drawn = live
+}
+
+// line returns the line of the group, cut to the width of the terminal so
+// that it does not wrap.
+func (t *Tracker) line(g *group, pad int, now time.Time) string {
+	line := []rune(fmt.Sprintf("%s %-*s %s", g.symbol(t.frame), pad, g.name, g.status(now)))
+	if t.width != nil {
+		if w := t.width(); w > 1 && len(line) >= w {
+			line = line[:w-1]
+		}
+	}
+	return string(line) + "\n"
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTerminal(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	var out bytes.Buffer
+	tr := NewTerminal(&out, func() int { return 40 })
+
+	tr.Add("hello")
+	tr.Add("hello-dev")
+	tr.Add("hello-doc")
+	require.Equal(t, "· hello     waiting\n· hello-dev waiting\n· hello-doc waiting\n", lastDraw(out.String()))
+
+	end := tr.Begin(ctx, "hello", `step "autoconf/make"`)
+	require.Contains(t, lastDraw(out.String()), `hello     step "autoconf/make" (0s)`)
+	end(nil)
+	require.Contains(t, lastDraw(out.String()), "· hello     1 step done\n")
+
+	tr.Skip(ctx, "hello-doc")
+	require.True(t, strings.HasSuffix(out.String(), "- hello-doc skipped\n· hello     1 step done\n· hello-dev waiting\n"), out.String())
+
+	// Logs are written above the lines of the packages which are running.
+	log := tr.Writer(&out)
+	_, err := log.Write([]byte("a log line\n"))
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(out.String(), "\x1b[2A\x1b[Ja log line\n· hello     1 step done\n· hello-dev waiting\n"), out.String())
+
+	end = tr.Begin(ctx, "hello-dev", `step "split/dev"`)
+	end(errors.New("exit status 1"))
+	tr.Settle(ctx, []string{"hello", "hello-dev", "hello-doc"}, errors.New("exit status 1"))
+	require.Contains(t, out.String(), "✗ hello-dev failed: step \"split/dev\"\n")
+	require.Contains(t, out.String(), "✗ hello failed: step \"autoconf/make\"\n")
+	require.Equal(t, 1, strings.Count(out.String(), "- hello-doc skipped"))
+}
+
+func TestTerminalWidth(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTerminal(&out, func() int { return 10 })
+
+	tr.Add("a-very-long-package-name")
+	require.Equal(t, "· a-very-\n", out.String())
+}
+
+func TestNilTracker(t *testing.T) {
+	ctx := context.Background()
+
+	var tr *Tracker
+	tr.Add("hello")
+	tr.Begin(ctx, "hello", "emitting")(nil)
+	tr.Done(ctx, "hello")
+	tr.Skip(ctx, "hello")
+	tr.Settle(ctx, []string{"hello"}, nil)
+
+	var out bytes.Buffer
+	require.Equal(t, &out, tr.Writer(&out))
+	require.Nil(t, FromContext(ctx))
+}
+
+// lastDraw returns what was drawn after the lines were last erased.
+func lastDraw(s string) string {
+	if i := strings.LastIndex(s, "\x1b[J"); i >= 0 {
+		return s[i+len("\x1b[J"):]
+	}
+	return s
+}
@@ -0,0 +1,408 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package promote moves packages between the tiers of a repository, such as
+// from staging to stable, along with their index entries and the files which
+// accompany them.
+package promote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"go.opentelemetry.io/otel"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/failure"
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/verify"
+)
+
+const indexName = "APKINDEX.tar.gz"
+
+// Policy is what a package must meet to be promoted.
+type Policy struct {
+	// Whether the package must be signed by one of the keys
+	Signed bool `json:"signed,omitempty" yaml:"signed,omitempty"`
+	// The suffixes of the files which must accompany the package, e.g.
+	// ".intoto.jsonl" for its attestation, or ".tested" for the record that
+	// its tests passed
+	Require []string `json:"require,omitempty" yaml:"require,omitempty"`
+	// The minimum time since the package was built
+	MinAge time.Duration `json:"min-age,omitempty" yaml:"min-age,omitempty"`
+}
+
+// LoadPolicy reads a policy from a YAML file.
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening policy: %w", err)
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing policy %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+type options struct {
+	policy     Policy
+	keys       verify.Keys
+	signingKey string
+}
+
+type Option func(*options) error
+
+// WithPolicy sets the policy which the packages must meet to be promoted.
+func WithPolicy(p Policy) Option {
+	return func(o *options) error {
+		o.policy = p
+		return nil
+	}
+}
+
+// WithKeys sets the public keys which the packages must be signed with, if
+// the policy requires it.
+func WithKeys(keys verify.Keys) Option {
+	return func(o *options) error {
+		o.keys = keys
+		return nil
+	}
+}
+
+// WithSigningKey sets the key to sign the updated indexes with.
+func WithSigningKey(signingKey string) Option {
+	return func(o *options) error {
+		o.signingKey = signingKey
+		return nil
+	}
+}
+
+// Result is what a transition moved.
+type Result struct {
+	// The packages which were moved, as name-version
+	Packages []string `json:"packages"`
+	// The names of the files which were moved
+	Files []string `json:"files"`
+}
+
+// Promote moves the selected packages of the repository in from to the one
+// in to, once every one of them meets the policy.  A selector is either the
+// name of a package, which selects all of its versions, or its name-version.
+func Promote(ctx context.Context, from, to string, selectors []string, opts ...Option) (*Result, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "promote.Promote")
+	defer span.End()
+
+	return transition(ctx, from, to, selectors, true, opts)
+}
+
+// Demote moves the selected packages of the repository in from to the one in
+// to, such as back from stable to staging, without checking the policy.
+func Demote(ctx context.Context, from, to string, selectors []string, opts ...Option) (*Result, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "promote.Demote")
+	defer span.End()
+
+	return transition(ctx, from, to, selectors, false, opts)
+}
+
+// transition moves packages between repositories.  Nothing is changed until
+// every package was checked, and the files and indexes are changed in an
+// order which keeps both repositories consistent if it is interrupted: the
+// files are copied, the index of to is replaced to add the packages, the one
+// of from is replaced to remove them, and only then are the files of from
+// removed.  An interrupted transition leaves at worst packages in both
+// repositories, and can be run again, or files which are in no index.
+func transition(ctx context.Context, from, to string, selectors []string, checkPolicy bool, opts []Option) (*Result, error) {
+	log := clog.FromContext(ctx)
+
+	o := options{}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	if checkPolicy && o.policy.Signed && len(o.keys) == 0 {
+		return nil, fmt.Errorf("the policy requires signed packages, but no keys were provided")
+	}
+
+	if _, err := os.Stat(filepath.Join(from, indexName)); err != nil {
+		return nil, fmt.Errorf("reading index of %s: %w", from, err)
+	}
+	if err := os.MkdirAll(to, 0o755); err != nil {
+		return nil, err
+	}
+
+	src, err := loadIndex(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := loadIndex(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := selectPackages(src.Index.Packages, selectors)
+	if err != nil {
+		return nil, fmt.Errorf("selecting packages in %s: %w", from, err)
+	}
+
+	existing := map[string]*apkrepo.Package{}
+	for _, pkg := range dst.Index.Packages {
+		existing[pkg.Filename()] = pkg
+	}
+
+	res := &Result{}
+	errs := []error{}
+	for _, pkg := range selected {
+		id := fmt.Sprintf("%s-%s", pkg.Name, pkg.Version)
+
+		if err := o.check(ctx, from, pkg, checkPolicy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+
+		if prev, ok := existing[pkg.Filename()]; ok && !bytes.Equal(prev.Checksum, pkg.Checksum) {
+			errs = append(errs, failure.Wrap(failure.Policy, fmt.Errorf("%s: a different build is already in %s", id, to)))
+			continue
+		}
+
+		files, err := packageFiles(from, pkg)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Packages = append(res.Packages, id)
+		res.Files = append(res.Files, files...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("unable to move packages from %s to %s:\n%w", from, to, err)
+	}
+
+	for _, name := range res.Files {
+		if err := copyFile(filepath.Join(from, name), filepath.Join(to, name)); err != nil {
+			return nil, fmt.Errorf("copying %s to %s: %w", name, to, err)
+		}
+	}
+
+	for _, pkg := range selected {
+		if _, ok := existing[pkg.Filename()]; !ok {
+			dst.Index.Packages = append(dst.Index.Packages, pkg)
+		}
+	}
+	if err := writeIndex(ctx, dst, to, o.signingKey); err != nil {
+		return nil, err
+	}
+
+	moved := map[*apkrepo.Package]bool{}
+	for _, pkg := range selected {
+		moved[pkg] = true
+	}
+	kept := make([]*apkrepo.Package, 0, len(src.Index.Packages))
+	for _, pkg := range src.Index.Packages {
+		if !moved[pkg] {
+			kept = append(kept, pkg)
+		}
+	}
+	src.Index.Packages = kept
+	if err := writeIndex(ctx, src, from, o.signingKey); err != nil {
+		return nil, err
+	}
+
+	for _, name := range res.Files {
+		if err := os.Remove(filepath.Join(from, name)); err != nil {
+			return nil, fmt.Errorf("removing %s from %s: %w", name, from, err)
+		}
+	}
+
+	log.Infof("moved %v from %s to %s", res.Packages, from, to)
+
+	return res, nil
+}
+
+func loadIndex(ctx context.Context, dir string) (*index.Index, error) {
+	idx, err := index.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.LoadIndex(ctx, filepath.Join(dir, indexName)); err != nil {
+		return nil, fmt.Errorf("reading index of %s: %w", dir, err)
+	}
+
+	return idx, nil
+}
+
+// writeIndex replaces the index of dir by writing it next to it first, so
+// that readers of the repository see either the old or the new index.
+func writeIndex(ctx context.Context, idx *index.Index, dir, signingKey string) error {
+	tmp, err := os.CreateTemp(dir, ".APKINDEX-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	idx.SigningKey = signingKey
+	if err := idx.WriteArchiveIndex(ctx, tmp.Name()); err != nil {
+		return fmt.Errorf("writing index of %s: %w", dir, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, indexName))
+}
+
+// selectPackages returns the packages matched by the selectors, each of
+// which must match at least one.
+func selectPackages(packages []*apkrepo.Package, selectors []string) ([]*apkrepo.Package, error) {
+	selected := []*apkrepo.Package{}
+	seen := map[*apkrepo.Package]bool{}
+	for _, sel := range selectors {
+		found := false
+		for _, pkg := range packages {
+			if pkg.Name != sel && pkg.Name+"-"+pkg.Version != sel {
+				continue
+			}
+
+			found = true
+			if !seen[pkg] {
+				seen[pkg] = true
+				selected = append(selected, pkg)
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no package matches %s", sel)
+		}
+	}
+
+	return selected, nil
+}
+
+// packageFiles returns the names of the apk of a package and of the files
+// which accompany it, such as its signature, SBOM or attestations, which are
+// named after the apk.
+func packageFiles(dir string, pkg *apkrepo.Package) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{pkg.Filename()}
+	for _, ent := range entries {
+		if !ent.IsDir() && strings.HasPrefix(ent.Name(), pkg.Filename()+".") {
+			files = append(files, ent.Name())
+		}
+	}
+
+	return files, nil
+}
+
+// check returns why a package may not be moved: its apk must match its index
+// entry, and meet the policy when it is checked.
+func (o *options) check(ctx context.Context, dir string, pkg *apkrepo.Package, checkPolicy bool) error {
+	f, err := os.Open(filepath.Join(dir, pkg.Filename()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return fmt.Errorf("unable to expand package: %w", err)
+	}
+	defer exp.Close()
+
+	if !bytes.Equal(exp.ControlHash, pkg.Checksum) {
+		return failure.Wrap(failure.Checksum, fmt.Errorf("the package does not match its index entry"))
+	}
+
+	if !checkPolicy {
+		return nil
+	}
+
+	errs := []error{}
+	if o.policy.Signed {
+		if _, err := verify.PackageSignature(exp, o.keys); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, suffix := range o.policy.Require {
+		if _, err := os.Stat(filepath.Join(dir, pkg.Filename()+suffix)); err != nil {
+			errs = append(errs, fmt.Errorf("required %s is missing", pkg.Filename()+suffix))
+		}
+	}
+
+	if age := time.Since(pkg.BuildTime); o.policy.MinAge > 0 && age < o.policy.MinAge {
+		errs = append(errs, fmt.Errorf("built %s ago, less than %s", age.Round(time.Second), o.policy.MinAge))
+	}
+
+	return failure.Wrap(failure.Policy, errors.Join(errs...))
+}
+
+// copyFile copies src to dst through a temporary file, so that dst is never
+// partially written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(fi.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
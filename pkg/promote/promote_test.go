@@ -0,0 +1,154 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promote
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/verify"
+)
+
+const testApk = "libcap-2.69-r0.apk"
+
+func writeRepository(t *testing.T, dir string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", testApk))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testApk), data, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testApk+".spdx.json"), []byte("{}"), 0o644))
+
+	idx, err := index.New(
+		index.WithPackageDir(dir),
+		index.WithIndexFile(filepath.Join(dir, indexName)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(slogtest.TestContextWithLogger(t)))
+}
+
+func indexedPackages(t *testing.T, dir string) []string {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join(dir, indexName))
+	require.NoError(t, err)
+	defer f.Close()
+
+	idx, err := apkrepo.IndexFromArchive(f)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, pkg := range idx.Packages {
+		names = append(names, pkg.Filename())
+	}
+	return names
+}
+
+func TestPromote(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	staging := t.TempDir()
+	stable := filepath.Join(t.TempDir(), "stable")
+	writeRepository(t, staging)
+
+	policy := Policy{Require: []string{".tested"}, MinAge: 24 * time.Hour}
+
+	_, err := Promote(ctx, staging, stable, []string{"libcap"}, WithPolicy(policy))
+	require.ErrorContains(t, err, "required libcap-2.69-r0.apk.tested is missing")
+	require.Equal(t, []string{testApk}, indexedPackages(t, staging))
+	require.NoFileExists(t, filepath.Join(stable, indexName))
+
+	_, err = Promote(ctx, staging, stable, []string{"libcap-2.70-r0"}, WithPolicy(policy))
+	require.ErrorContains(t, err, "no package matches libcap-2.70-r0")
+
+	// The test package was built at the epoch.
+	_, err = Promote(ctx, staging, stable, []string{"libcap"}, WithPolicy(Policy{MinAge: 100 * 365 * 24 * time.Hour}))
+	require.ErrorContains(t, err, "less than")
+
+	require.NoError(t, os.WriteFile(filepath.Join(staging, testApk+".tested"), nil, 0o644))
+
+	res, err := Promote(ctx, staging, stable, []string{"libcap-2.69-r0"}, WithPolicy(policy))
+	require.NoError(t, err)
+	require.Equal(t, []string{"libcap-2.69-r0"}, res.Packages)
+	require.ElementsMatch(t, []string{testApk, testApk + ".spdx.json", testApk + ".tested"}, res.Files)
+
+	require.Empty(t, indexedPackages(t, staging))
+	require.Equal(t, []string{testApk}, indexedPackages(t, stable))
+	for _, f := range res.Files {
+		require.NoFileExists(t, filepath.Join(staging, f))
+		require.FileExists(t, filepath.Join(stable, f))
+	}
+
+	r, err := verify.Repository(ctx, stable)
+	require.NoError(t, err)
+	for _, f := range r.Findings {
+		require.NotContains(t, []string{verify.CheckChecksum, verify.CheckDataHash, verify.CheckMissingFile, verify.CheckOrphanedFile}, f.Check)
+	}
+
+	_, err = Demote(ctx, stable, staging, []string{"libcap"})
+	require.NoError(t, err)
+	require.Equal(t, []string{testApk}, indexedPackages(t, staging))
+	require.Empty(t, indexedPackages(t, stable))
+}
+
+func TestPromote_Signed(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	staging := t.TempDir()
+	writeRepository(t, staging)
+
+	_, err := Promote(ctx, staging, t.TempDir(), []string{"libcap"}, WithPolicy(Policy{Signed: true}))
+	require.ErrorContains(t, err, "no keys were provided")
+
+	// The test package is signed by another key.
+	keys := verify.Keys{"test.rsa.pub": nil}
+	_, err = Promote(ctx, staging, t.TempDir(), []string{"libcap"}, WithPolicy(Policy{Signed: true}), WithKeys(keys))
+	require.ErrorContains(t, err, "no key found to verify signature")
+}
+
+func TestPromote_DifferentBuild(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	staging := t.TempDir()
+	stable := t.TempDir()
+	writeRepository(t, staging)
+	writeRepository(t, stable)
+
+	// The same build may be promoted again, as when a promotion was
+	// interrupted.
+	_, err := Promote(ctx, staging, stable, []string{"libcap"})
+	require.NoError(t, err)
+	require.Equal(t, []string{testApk}, indexedPackages(t, stable))
+
+	writeRepository(t, staging)
+	f, err := os.Open(filepath.Join(stable, indexName))
+	require.NoError(t, err)
+	idx, err := apkrepo.IndexFromArchive(f)
+	f.Close()
+	require.NoError(t, err)
+
+	idx.Packages[0].Checksum = []byte("something else")
+	stableIdx, err := index.New()
+	require.NoError(t, err)
+	stableIdx.Index = *idx
+	require.NoError(t, stableIdx.WriteArchiveIndex(ctx, filepath.Join(stable, indexName)))
+
+	_, err = Promote(ctx, staging, stable, []string{"libcap"})
+	require.ErrorContains(t, err, "a different build is already in")
+}
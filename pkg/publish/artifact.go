@@ -0,0 +1,141 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/chainguard-dev/clog"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The types of the artifacts which are pushed for a package.
+const (
+	SBOMArtifactType        types.MediaType = "application/spdx+json"
+	AttestationArtifactType types.MediaType = "application/vnd.in-toto+json"
+)
+
+// attestationSuffix is the suffix of the attestation of a package, which is
+// beside it.
+const attestationSuffix = ".intoto.jsonl"
+
+// PushArtifact pushes apk to repo as an OCI artifact of type
+// application/vnd.apk, tagged with the name, version and architecture of
+// the package.  Its SBOM, and its attestation if a .intoto.jsonl file is
+// beside it, are pushed as artifacts which refer to it, like cosign attach
+// does; registries which do not support the referrers API list them in the
+// sha256-<digest> tag instead.  It returns the digest of the artifact.
+func PushArtifact(ctx context.Context, repo name.Repository, apk string) (name.Digest, error) {
+	log := clog.FromContext(ctx)
+
+	data, err := os.ReadFile(apk)
+	if err != nil {
+		return name.Digest{}, err
+	}
+	pkg, err := apkrepo.ParsePackage(ctx, bytes.NewReader(data))
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("parsing %s: %w", apk, err)
+	}
+	sbom, err := packageSBOM(ctx, data, pkg)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("reading the SBOM of %s: %w", apk, err)
+	}
+
+	layer, err := writeBlob(ctx, repo, data, apkMediaType, filepath.Base(apk))
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("uploading %s: %w", filepath.Base(apk), err)
+	}
+	tag := ArtifactTag(pkg)
+	subject, err := putManifest(ctx, repo, tag, apkMediaType, []v1.Descriptor{layer}, nil)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("pushing %s: %w", repo.Tag(tag), err)
+	}
+	digest := repo.Digest(subject.Digest.String())
+	log.Infof("pushed %s to %s", filepath.Base(apk), digest)
+
+	if err := attach(ctx, repo, subject, SBOMArtifactType, sbom, fmt.Sprintf("%s-%s.spdx.json", pkg.Name, pkg.Version)); err != nil {
+		return name.Digest{}, fmt.Errorf("attaching the SBOM of %s: %w", filepath.Base(apk), err)
+	}
+
+	attestation, err := os.ReadFile(apk + attestationSuffix)
+	switch {
+	case err == nil:
+		if err := attach(ctx, repo, subject, AttestationArtifactType, attestation, filepath.Base(apk)+attestationSuffix); err != nil {
+			return name.Digest{}, fmt.Errorf("attaching the attestation of %s: %w", filepath.Base(apk), err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		log.Infof("%s has no attestation to attach", filepath.Base(apk))
+	default:
+		return name.Digest{}, err
+	}
+
+	return digest, nil
+}
+
+// ArtifactTag returns the tag of the artifact of pkg, e.g.
+// libstdc__-13.2.0-r0-x86_64 for libstdc++-13.2.0-r0 built for x86_64: the
+// characters which tags may not hold are replaced with underscores.
+func ArtifactTag(pkg *apkrepo.Package) string {
+	tag := []byte(fmt.Sprintf("%s-%s-%s", pkg.Name, pkg.Version, pkg.Arch))
+	for i, c := range tag {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_':
+		case (c == '.' || c == '-') && i > 0:
+		default:
+			tag[i] = '_'
+		}
+	}
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return string(tag)
+}
+
+// attach pushes data as an artifact of artifactType which refers to subject.
+func attach(ctx context.Context, repo name.Repository, subject v1.Descriptor, artifactType types.MediaType, data []byte, title string) error {
+	layer, err := writeBlob(ctx, repo, data, artifactType, title)
+	if err != nil {
+		return err
+	}
+	desc, err := putManifest(ctx, repo, "", artifactType, []v1.Descriptor{layer}, &subject)
+	if err != nil {
+		return err
+	}
+
+	clog.FromContext(ctx).Infof("attached %s to %s as %s", title, subject.Digest, desc.Digest)
+	return nil
+}
+
+// packageSBOM returns the SBOM which melange wrote in the apk of pkg.
+func packageSBOM(ctx context.Context, apk []byte, pkg *apkrepo.Package) ([]byte, error) {
+	exp, err := expandapk.ExpandApk(ctx, bytes.NewReader(apk), "")
+	if err != nil {
+		return nil, err
+	}
+	defer exp.Close()
+
+	return fs.ReadFile(exp.TarFS, path.Join("var/lib/db/sbom", pkg.Name+"-"+pkg.Version+".spdx.json"))
+}
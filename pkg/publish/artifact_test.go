@@ -0,0 +1,99 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactTag(t *testing.T) {
+	for _, test := range []struct {
+		pkg  apkrepo.Package
+		want string
+	}{
+		{apkrepo.Package{Name: "libcap", Version: "2.69-r0", Arch: "aarch64"}, "libcap-2.69-r0-aarch64"},
+		{apkrepo.Package{Name: "libstdc++", Version: "13.2.0-r0", Arch: "x86_64"}, "libstdc__-13.2.0-r0-x86_64"},
+		{apkrepo.Package{Name: ".hidden", Version: "1_rc1-r0", Arch: "x86_64"}, "_hidden-1_rc1-r0-x86_64"},
+		{apkrepo.Package{Name: strings.Repeat("a", 200), Version: "1-r0", Arch: "x86_64"}, strings.Repeat("a", 128)},
+	} {
+		require.Equal(t, test.want, ArtifactTag(&test.pkg))
+	}
+}
+
+func TestPushArtifact(t *testing.T) {
+	for _, referrers := range []bool{true, false} {
+		srv := httptest.NewServer(registry.New(registry.WithReferrersSupport(referrers)))
+		defer srv.Close()
+
+		ctx := slogtest.TestContextWithLogger(t)
+		repo, err := name.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/packages")
+		require.NoError(t, err)
+
+		apk := filepath.Join(t.TempDir(), filepath.Base(testAPK))
+		data, err := os.ReadFile(testAPK)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(apk, data, 0o644))
+
+		// Without an attestation, only the SBOM is attached.
+		digest, err := PushArtifact(ctx, repo, apk)
+		require.NoError(t, err)
+
+		desc, err := remote.Get(repo.Tag("libcap-2.69-r0-aarch64"))
+		require.NoError(t, err)
+		require.Equal(t, digest.DigestStr(), desc.Digest.String())
+
+		require.Equal(t, []string{string(SBOMArtifactType)}, referrerTypes(t, digest))
+
+		require.NoError(t, os.WriteFile(apk+".intoto.jsonl", []byte(`{"payloadType":"application/vnd.in-toto+json"}`), 0o644))
+		digest, err = PushArtifact(ctx, repo, apk)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{string(SBOMArtifactType), string(AttestationArtifactType)}, referrerTypes(t, digest))
+	}
+}
+
+// referrerTypes returns the types of the distinct artifacts which refer to
+// digest.
+func referrerTypes(t *testing.T, digest name.Digest) []string {
+	t.Helper()
+
+	idx, err := remote.Referrers(digest)
+	require.NoError(t, err)
+	m, err := idx.IndexManifest()
+	require.NoError(t, err)
+
+	types := map[string]bool{}
+	for _, d := range m.Manifests {
+		types[d.ArtifactType] = true
+	}
+	got := []string{}
+	for typ := range types {
+		got = append(got, typ)
+	}
+	sort.Strings(got)
+	return got
+}
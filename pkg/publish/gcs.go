@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// gcsObjects are the objects of a Google Cloud Storage bucket.
+type gcsObjects struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSStore(ctx context.Context, location string) (Store, error) {
+	bucket, prefix, _ := strings.Cut(location, "/")
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage client: %w", err)
+	}
+
+	return &bucketStore{
+		objects: &gcsObjects{bucket: client.Bucket(bucket)},
+		url:     "gs://" + strings.TrimSuffix(location, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (o *gcsObjects) get(ctx context.Context, key string) ([]byte, string, error) {
+	r, err := o.bucket.Object(key).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, "", fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	return data, strconv.FormatInt(r.Attrs.Generation, 10), err
+}
+
+func (o *gcsObjects) put(ctx context.Context, key, path string) error {
+	return o.upload(ctx, o.bucket.Object(key), path)
+}
+
+// putIf makes the upload conditional on the generation of the object,
+// which Cloud Storage checks and fails with 412 Precondition Failed.
+func (o *gcsObjects) putIf(ctx context.Context, key, path, version string) error {
+	cond := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		gen, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid generation %q of %s: %w", version, key, err)
+		}
+		cond = storage.Conditions{GenerationMatch: gen}
+	}
+
+	err := o.upload(ctx, o.bucket.Object(key).If(cond), path)
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s: %w", key, ErrIndexChanged)
+	}
+	return err
+}
+
+// upload uploads the file at path to obj.
+func (o *gcsObjects) upload(ctx context.Context, obj *storage.ObjectHandle, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := obj.NewWriter(ctx)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,271 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// The media types of the OCI artifact holding the packages of an
+// architecture.
+const (
+	apkMediaType   types.MediaType = "application/vnd.apk"
+	indexMediaType types.MediaType = "application/vnd.apk.index.v2+gzip"
+	emptyMediaType types.MediaType = "application/vnd.oci.empty.v1+json"
+)
+
+// annotationTitle names the files of an artifact.
+const annotationTitle = "org.opencontainers.image.title"
+
+// emptyConfig is the config of the artifacts, which has no content.
+var emptyConfig = []byte("{}")
+
+// ociStore is a Store in an OCI registry.  The packages of an architecture
+// are the layers of an artifact tagged with the architecture, along with
+// their index, each named by its org.opencontainers.image.title annotation.
+// Pushing the manifest of the artifact replaces all of them at once.
+type ociStore struct {
+	repo name.Repository
+}
+
+func newOCIStore(location string) (Store, error) {
+	repo, err := name.NewRepository(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI repository %q: %w", location, err)
+	}
+
+	return &ociStore{repo: repo}, nil
+}
+
+func remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+}
+
+// manifest returns the manifest of the artifact of arch and its digest, or
+// an error which is fs.ErrNotExist if there is none.
+func (s *ociStore) manifest(ctx context.Context, arch string) (*v1.Manifest, string, error) {
+	desc, err := remote.Get(s.repo.Tag(arch), remoteOptions(ctx)...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, "", fmt.Errorf("%s: %w", s.repo.Tag(arch), fs.ErrNotExist)
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	m, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	return m, desc.Digest.String(), err
+}
+
+// The version of the index is the digest of the manifest of the artifact.
+func (s *ociStore) Index(ctx context.Context, arch string) ([]byte, string, error) {
+	m, digest, err := s.manifest(ctx, arch)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, l := range m.Layers {
+		if l.Annotations[annotationTitle] != indexName {
+			continue
+		}
+
+		layer, err := remote.Layer(s.repo.Digest(l.Digest.String()), remoteOptions(ctx)...)
+		if err != nil {
+			return nil, "", err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		return data, digest, err
+	}
+
+	return nil, digest, fmt.Errorf("%s has no %s: %w", s.repo.Tag(arch), indexName, fs.ErrNotExist)
+}
+
+// Registries cannot push a manifest on condition, so the manifest is
+// checked to still be at version right before the new one is pushed, which
+// leaves concurrent publishers a much narrower window to race in.
+func (s *ociStore) Publish(ctx context.Context, arch string, apks []string, index, version string) error {
+	// The packages which are not replaced are kept, by reference.
+	replaced := map[string]bool{indexName: true}
+	for _, apk := range apks {
+		replaced[filepath.Base(apk)] = true
+	}
+	layers := []v1.Descriptor{}
+	m, digest, err := s.manifest(ctx, arch)
+	if err == nil {
+		for _, l := range m.Layers {
+			if !replaced[l.Annotations[annotationTitle]] {
+				layers = append(layers, l)
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if digest != version {
+		return fmt.Errorf("%s: %w", s.repo.Tag(arch), ErrIndexChanged)
+	}
+
+	for _, apk := range apks {
+		desc, err := writeFile(ctx, s.repo, apk, apkMediaType)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", filepath.Base(apk), err)
+		}
+		layers = append(layers, desc)
+	}
+	desc, err := writeFile(ctx, s.repo, index, indexMediaType)
+	if err != nil {
+		return fmt.Errorf("uploading the index: %w", err)
+	}
+	layers = append(layers, desc)
+
+	if _, digest, err := s.manifest(ctx, arch); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if digest != version {
+		return fmt.Errorf("%s: %w", s.repo.Tag(arch), ErrIndexChanged)
+	}
+
+	_, err = putManifest(ctx, s.repo, arch, emptyMediaType, layers, nil)
+	return err
+}
+
+func (s *ociStore) String() string {
+	return "oci://" + s.repo.String()
+}
+
+// writeFile uploads the file at path as a blob of repo, and returns its
+// descriptor.
+func writeFile(ctx context.Context, repo name.Repository, path string, mediaType types.MediaType) (v1.Descriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return writeBlob(ctx, repo, data, mediaType, filepath.Base(path))
+}
+
+// writeBlob uploads data as a blob of repo, and returns its descriptor,
+// annotated with title.
+func writeBlob(ctx context.Context, repo name.Repository, data []byte, mediaType types.MediaType, title string) (v1.Descriptor, error) {
+	layer := static(data, mediaType)
+	if err := remote.WriteLayer(repo, layer, remoteOptions(ctx)...); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	desc, err := partial.Descriptor(layer)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{annotationTitle: title}
+
+	return *desc, nil
+}
+
+// putManifest pushes the manifest of an artifact of artifactType made of
+// layers to repo, along with its empty config, and returns its descriptor.
+// The manifest is tagged with tag, unless it is empty.  An artifact with a
+// subject is listed among the referrers of the subject.
+func putManifest(ctx context.Context, repo name.Repository, tag string, artifactType types.MediaType, layers []v1.Descriptor, subject *v1.Descriptor) (v1.Descriptor, error) {
+	// The media type of the config is the type of the artifact, which is
+	// what the referrers of a subject are filtered by.
+	config := static(emptyConfig, artifactType)
+	if err := remote.WriteLayer(repo, config, remoteOptions(ctx)...); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("uploading the config: %w", err)
+	}
+	configDesc, err := partial.Descriptor(config)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	m := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        *configDesc,
+		Layers:        layers,
+		Subject:       subject,
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	hash, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	var ref name.Reference = repo.Digest(hash.String())
+	if tag != "" {
+		ref = repo.Tag(tag)
+	}
+	if err := remote.Put(ref, rawManifest(raw), remoteOptions(ctx)...); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	return v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: hash, Size: size}, nil
+}
+
+// rawManifest is a manifest which is pushed as it is.
+type rawManifest []byte
+
+func (m rawManifest) RawManifest() ([]byte, error) {
+	return m, nil
+}
+
+func (m rawManifest) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+// staticBlob is a blob held in memory, which is uploaded as it is.
+type staticBlob struct {
+	data      []byte
+	hash      v1.Hash
+	mediaType types.MediaType
+}
+
+func static(data []byte, mediaType types.MediaType) v1.Layer {
+	hash, _, _ := v1.SHA256(bytes.NewReader(data))
+	layer, _ := partial.CompressedToLayer(&staticBlob{data: data, hash: hash, mediaType: mediaType})
+	return layer
+}
+
+func (b *staticBlob) Digest() (v1.Hash, error) { return b.hash, nil }
+
+func (b *staticBlob) Compressed() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+func (b *staticBlob) Size() (int64, error) { return int64(len(b.data)), nil }
+
+func (b *staticBlob) MediaType() (types.MediaType, error) { return b.mediaType, nil }
@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCIStore(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	s, err := newOCIStore(strings.TrimPrefix(srv.URL, "http://") + "/os")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, version, err := s.Index(ctx, "x86_64")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Empty(t, version)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	foo := write("foo-1.0-r0.apk", "foo")
+	require.NoError(t, s.Publish(ctx, "x86_64", []string{foo}, write(indexName, "index 1"), ""))
+
+	data, version, err := s.Index(ctx, "x86_64")
+	require.NoError(t, err)
+	require.Equal(t, "index 1", string(data))
+
+	// The artifact is only replaced if it is still at the version its
+	// index was downloaded at.
+	bar := write("bar-1.0-r0.apk", "bar")
+	require.ErrorIs(t, s.Publish(ctx, "x86_64", []string{bar}, write(indexName, "index 2"), ""), ErrIndexChanged)
+
+	// Publishing more packages keeps the others, and replaces the index.
+	require.NoError(t, s.Publish(ctx, "x86_64", []string{bar}, write(indexName, "index 2"), version))
+
+	data, _, err = s.Index(ctx, "x86_64")
+	require.NoError(t, err)
+	require.Equal(t, "index 2", string(data))
+
+	m, _, err := s.(*ociStore).manifest(ctx, "x86_64")
+	require.NoError(t, err)
+	titles := []string{}
+	for _, l := range m.Layers {
+		titles = append(titles, l.Annotations[annotationTitle])
+	}
+	require.Equal(t, []string{"foo-1.0-r0.apk", "bar-1.0-r0.apk", indexName}, titles)
+
+	// The other architectures have their own artifacts.
+	_, _, err = s.Index(ctx, "aarch64")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
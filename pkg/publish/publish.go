@@ -0,0 +1,239 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package publish uploads the packages emitted by a build to a remote
+// repository, along with the index of the repository regenerated with them.
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/index"
+)
+
+// indexName is the name of the index of the packages of an architecture.
+const indexName = "APKINDEX.tar.gz"
+
+// ErrIndexChanged is returned by Store.Publish when the index was replaced
+// since it was downloaded, e.g. by another publisher.
+var ErrIndexChanged = errors.New("the index changed since it was downloaded")
+
+// Store is a remote repository, which holds the packages of each
+// architecture along with their index.
+type Store interface {
+	// Index returns the index of the packages of arch and its version, or
+	// an error which is fs.ErrNotExist if the repository has none, along
+	// with the version to publish the first one at.
+	Index(ctx context.Context, arch string) ([]byte, string, error)
+	// Publish uploads the apks of arch and then their index, so that the
+	// index never lists packages which are not uploaded yet.  The index is
+	// only replaced if it is still at version, as returned by Index, and
+	// the error is ErrIndexChanged otherwise.
+	Publish(ctx context.Context, arch string, apks []string, index, version string) error
+	// String returns the URL of the repository.
+	String() string
+}
+
+// New returns the Store at url: s3://bucket/path, gs://bucket/path (or
+// gcs://bucket/path) or oci://registry/repository.
+func New(ctx context.Context, url string) (Store, error) {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("invalid repository %q, must be s3://, gs:// or oci:// followed by its location", url)
+	}
+
+	switch scheme {
+	case "s3":
+		return newS3Store(ctx, rest)
+	case "gs", "gcs":
+		return newGCSStore(ctx, rest)
+	case "oci":
+		return newOCIStore(rest)
+	}
+
+	return nil, fmt.Errorf("invalid repository %q, must be s3://, gs:// or oci:// followed by its location", url)
+}
+
+// Publisher uploads the packages emitted by a build to a Store.
+type Publisher struct {
+	Store Store
+	// SigningKey signs the regenerated index, if it is set.
+	SigningKey string
+	// DryRun logs what would be uploaded instead of uploading it.
+	DryRun bool
+	// Attempts is how many times the index is downloaded and the packages
+	// uploaded before giving up.
+	Attempts int
+	// Backoff is how long to wait after the first failed attempt, which
+	// doubles after each one.
+	Backoff time.Duration
+}
+
+// Publish uploads apks, which are packages of arch, and the index of arch
+// in the repository regenerated with them.
+func (p *Publisher) Publish(ctx context.Context, arch string, apks []string) error {
+	log := clog.FromContext(ctx)
+
+	if p.DryRun {
+		for _, apk := range apks {
+			log.Infof("would publish %s to %s/%s", filepath.Base(apk), p.Store, arch)
+		}
+		log.Infof("would publish the index of %s/%s, with %d more packages", p.Store, arch, len(apks))
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "melange-publish-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	indexFile := filepath.Join(dir, indexName)
+
+	// The index is merged with the packages and replaced at once, so that
+	// the packages of concurrent publishers are not dropped: the publisher
+	// whose index was replaced in between starts over.
+	if err := p.retry(ctx, func() error {
+		return p.publish(ctx, arch, apks, indexFile)
+	}); err != nil {
+		return fmt.Errorf("publishing to %s/%s: %w", p.Store, arch, err)
+	}
+	log.Infof("published %d packages to %s/%s", len(apks), p.Store, arch)
+
+	return nil
+}
+
+// publish downloads the index of arch, merges apks into it at indexFile and
+// uploads them, provided the index was not replaced in between.
+func (p *Publisher) publish(ctx context.Context, arch string, apks []string, indexFile string) error {
+	data, version, err := p.Store.Index(ctx, arch)
+	if errors.Is(err, fs.ErrNotExist) {
+		clog.FromContext(ctx).Infof("%s/%s has no index yet", p.Store, arch)
+		data = nil
+	} else if err != nil {
+		return fmt.Errorf("downloading the index: %w", err)
+	}
+
+	// The index of an earlier attempt is not merged again.
+	if err := os.Remove(indexFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if data != nil {
+		if err := os.WriteFile(indexFile, data, 0o644); err != nil {
+			return err
+		}
+	}
+
+	idx, err := index.New(
+		index.WithIndexFile(indexFile),
+		index.WithMergeIndexFileFlag(true),
+		index.WithPackageFiles(apks),
+		index.WithSigningKey(p.SigningKey),
+		index.WithExpectedArch(arch),
+	)
+	if err != nil {
+		return err
+	}
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("regenerating the index: %w", err)
+	}
+
+	return p.Store.Publish(ctx, arch, apks, indexFile, version)
+}
+
+// retry calls f until it succeeds, up to Attempts times.
+func (p *Publisher) retry(ctx context.Context, f func() error) error {
+	log := clog.FromContext(ctx)
+
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.Attempts {
+			return err
+		}
+
+		log.Warnf("attempt %d of %d failed, retrying in %s: %v", attempt, p.Attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// objects are the objects of a bucket.
+type objects interface {
+	// get returns the contents of the object key and its version, or an
+	// error which is fs.ErrNotExist if there is none.
+	get(ctx context.Context, key string) ([]byte, string, error)
+	// put uploads the file at path to the object key.
+	put(ctx context.Context, key, path string) error
+	// putIf uploads the file at path to the object key if it is still at
+	// version, or still missing if version is empty, and returns
+	// ErrIndexChanged otherwise.
+	putIf(ctx context.Context, key, path, version string) error
+}
+
+// bucketStore is a Store in a bucket, which holds the packages of each
+// architecture like a local repository: in a directory named after the
+// architecture, beside their index.
+type bucketStore struct {
+	objects objects
+	url     string
+	prefix  string
+}
+
+func (s *bucketStore) key(arch, name string) string {
+	if s.prefix == "" {
+		return arch + "/" + name
+	}
+	return s.prefix + "/" + arch + "/" + name
+}
+
+func (s *bucketStore) Index(ctx context.Context, arch string) ([]byte, string, error) {
+	return s.objects.get(ctx, s.key(arch, indexName))
+}
+
+func (s *bucketStore) Publish(ctx context.Context, arch string, apks []string, index, version string) error {
+	log := clog.FromContext(ctx)
+
+	for _, apk := range apks {
+		key := s.key(arch, filepath.Base(apk))
+		log.Infof("uploading %s to %s", filepath.Base(apk), key)
+		if err := s.objects.put(ctx, key, apk); err != nil {
+			return fmt.Errorf("uploading %s: %w", filepath.Base(apk), err)
+		}
+	}
+
+	// The index is uploaded last, and an object is replaced at once, so the
+	// index of the repository always lists packages which are there.
+	if err := s.objects.putIf(ctx, s.key(arch, indexName), index, version); err != nil {
+		return fmt.Errorf("uploading the index: %w", err)
+	}
+
+	return nil
+}
+
+func (s *bucketStore) String() string {
+	return s.url
+}
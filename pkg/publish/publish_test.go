@@ -0,0 +1,208 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPK = "../sca/testdata/libcap-2.69-r0.apk"
+
+// memoryObjects are objects held in memory, which fail the first failures
+// uploads.  beforePutIf, if set, is called before each conditional upload.
+type memoryObjects struct {
+	mu          sync.Mutex
+	objects     map[string][]byte
+	versions    map[string]int
+	puts        []string
+	failures    int
+	beforePutIf func()
+}
+
+func (o *memoryObjects) get(_ context.Context, key string) ([]byte, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	data, ok := o.objects[key]
+	if !ok {
+		return nil, "", fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return data, strconv.Itoa(o.versions[key]), nil
+}
+
+func (o *memoryObjects) putIf(ctx context.Context, key, path, version string) error {
+	if o.beforePutIf != nil {
+		o.beforePutIf()
+	}
+
+	o.mu.Lock()
+	current := ""
+	if _, ok := o.objects[key]; ok {
+		current = strconv.Itoa(o.versions[key])
+	}
+	o.mu.Unlock()
+	if current != version {
+		return fmt.Errorf("%s: %w", key, ErrIndexChanged)
+	}
+
+	return o.put(ctx, key, path)
+}
+
+func (o *memoryObjects) put(_ context.Context, key, path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.failures > 0 {
+		o.failures--
+		return errors.New("unavailable")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	o.objects[key] = data
+	if o.versions == nil {
+		o.versions = map[string]int{}
+	}
+	o.versions[key]++
+	o.puts = append(o.puts, key)
+	return nil
+}
+
+func indexedPackages(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	idx, err := apkrepo.IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, pkg := range idx.Packages {
+		names = append(names, pkg.Name+"-"+pkg.Version)
+	}
+	return names
+}
+
+func TestPublish(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	objects := &memoryObjects{objects: map[string][]byte{}}
+	p := &Publisher{
+		Store:    &bucketStore{objects: objects, url: "mem://bucket/os", prefix: "os"},
+		Attempts: 1,
+	}
+
+	require.NoError(t, p.Publish(ctx, "aarch64", []string{testAPK}))
+
+	// The index is uploaded after the packages it lists.
+	require.Equal(t, []string{"os/aarch64/libcap-2.69-r0.apk", "os/aarch64/APKINDEX.tar.gz"}, objects.puts)
+	require.Equal(t, []string{"libcap-2.69-r0"}, indexedPackages(t, objects.objects["os/aarch64/APKINDEX.tar.gz"]))
+
+	// Publishing again replaces the package in the index, rather than
+	// listing it twice.
+	require.NoError(t, p.Publish(ctx, "aarch64", []string{testAPK}))
+	require.Equal(t, []string{"libcap-2.69-r0"}, indexedPackages(t, objects.objects["os/aarch64/APKINDEX.tar.gz"]))
+}
+
+func TestPublishRetries(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	objects := &memoryObjects{objects: map[string][]byte{}, failures: 2}
+	p := &Publisher{
+		Store:    &bucketStore{objects: objects, url: "mem://bucket"},
+		Attempts: 3,
+	}
+
+	require.NoError(t, p.Publish(ctx, "aarch64", []string{testAPK}))
+	require.Contains(t, objects.objects, "aarch64/APKINDEX.tar.gz")
+
+	objects.failures = 3
+	require.ErrorContains(t, p.Publish(ctx, "aarch64", []string{testAPK}), "unavailable")
+}
+
+func TestPublishConcurrently(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	objects := &memoryObjects{objects: map[string][]byte{}}
+	p := &Publisher{
+		Store:    &bucketStore{objects: objects, url: "mem://bucket"},
+		Attempts: 2,
+	}
+
+	// Another publisher replaces the index while the first one uploads its
+	// packages: the first one merges its packages into the new index rather
+	// than dropping those of the other.
+	other := *p
+	objects.beforePutIf = func() {
+		objects.beforePutIf = nil
+		require.NoError(t, other.Publish(ctx, "aarch64", []string{"../sca/testdata/aws-c-s3-0.4.9-r0.apk"}))
+	}
+	require.NoError(t, p.Publish(ctx, "aarch64", []string{testAPK}))
+	require.ElementsMatch(t, []string{"libcap-2.69-r0", "aws-c-s3-0.4.9-r0"}, indexedPackages(t, objects.objects["aarch64/APKINDEX.tar.gz"]))
+
+	// The publisher gives up once it is out of attempts.
+	p.Attempts = 1
+	objects.beforePutIf = func() {
+		objects.beforePutIf = nil
+		require.NoError(t, other.Publish(ctx, "aarch64", []string{"../sca/testdata/aws-c-s3-0.4.9-r0.apk"}))
+	}
+	require.ErrorIs(t, p.Publish(ctx, "aarch64", []string{testAPK}), ErrIndexChanged)
+}
+
+func TestPublishDryRun(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	objects := &memoryObjects{objects: map[string][]byte{}}
+	p := &Publisher{
+		Store:    &bucketStore{objects: objects, url: "mem://bucket"},
+		DryRun:   true,
+		Attempts: 1,
+	}
+
+	require.NoError(t, p.Publish(ctx, "aarch64", []string{testAPK}))
+	require.Empty(t, objects.objects)
+}
+
+func TestNew(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, url := range []string{"", "bucket/path", "s3://", "ftp://host/path"} {
+		_, err := New(ctx, url)
+		require.Error(t, err, url)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	s, err := New(ctx, "s3://bucket/os/")
+	require.NoError(t, err)
+	require.Equal(t, "s3://bucket/os", s.String())
+
+	s, err = New(ctx, "oci://registry.example.com/os")
+	require.NoError(t, err)
+	require.Equal(t, "oci://registry.example.com/os", s.String())
+}
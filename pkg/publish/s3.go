@@ -0,0 +1,132 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// s3Objects are the objects of an S3 bucket.  The credentials, the region
+// and the endpoint are loaded like the AWS CLI does, so $AWS_ENDPOINT_URL_S3
+// or $AWS_ENDPOINT_URL point at an S3 compatible service instead of AWS.
+type s3Objects struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3Store(ctx context.Context, location string) (Store, error) {
+	bucket, prefix, _ := strings.Cut(location, "/")
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	// Other services address the bucket in the path, AWS in the host.
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = o.BaseEndpoint != nil
+	})
+
+	return &bucketStore{
+		objects: &s3Objects{client: client, bucket: bucket},
+		url:     "s3://" + strings.TrimSuffix(location, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (o *s3Objects) get(ctx context.Context, key string) ([]byte, string, error) {
+	out, err := o.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(key),
+	})
+	if s3StatusCode(err) == http.StatusNotFound {
+		return nil, "", fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	return data, aws.ToString(out.ETag), err
+}
+
+func (o *s3Objects) put(ctx context.Context, key, path string) error {
+	return o.upload(ctx, key, path)
+}
+
+// putIf makes the upload conditional on the ETag of the object, which S3
+// checks and fails with 412 Precondition Failed, or 409 Conflict when
+// another conditional upload of the object is in progress.
+func (o *s3Objects) putIf(ctx context.Context, key, path, version string) error {
+	// This version of the SDK does not model the conditions of uploads, so
+	// their headers are added to the request.
+	cond := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if version != "" {
+		cond = smithyhttp.SetHeaderValue("If-Match", version)
+	}
+
+	err := o.upload(ctx, key, path, s3.WithAPIOptions(cond))
+	if code := s3StatusCode(err); code == http.StatusPreconditionFailed || code == http.StatusConflict {
+		return fmt.Errorf("%s: %w", key, ErrIndexChanged)
+	}
+	return err
+}
+
+// upload uploads the file at path to the object key.
+func (o *s3Objects) upload(ctx context.Context, key, path string, optFns ...func(*s3.Options)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = o.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(o.bucket),
+		Key:           aws.String(key),
+		Body:          f,
+		ContentLength: aws.Int64(info.Size()),
+	}, optFns...)
+	return err
+}
+
+// s3StatusCode returns the HTTP status of the response S3 failed a request
+// with, or 0 if err is not such an error.
+func s3StatusCode(err error) int {
+	var rerr interface{ HTTPStatusCode() int }
+	if errors.As(err, &rerr) {
+		return rerr.HTTPStatusCode()
+	}
+	return 0
+}
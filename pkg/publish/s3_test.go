@@ -0,0 +1,110 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3Objects(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		data, ok := objects[r.URL.Path]
+		etag := fmt.Sprintf("%q", data)
+		switch r.Method {
+		case http.MethodPut:
+			if (r.Header.Get("If-None-Match") == "*" && ok) || (r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(data)
+		case http.MethodGet:
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			io.WriteString(w, data)
+		}
+	}))
+	defer srv.Close()
+
+	// Only the environment configures the client.
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	ctx := context.Background()
+	s, err := newS3Store(ctx, "bucket/os")
+	require.NoError(t, err)
+
+	_, version, err := s.Index(ctx, "x86_64")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Empty(t, version)
+
+	dir := t.TempDir()
+	apk := filepath.Join(dir, "foo-1.0-r0.apk")
+	index := filepath.Join(dir, indexName)
+	require.NoError(t, os.WriteFile(apk, []byte("apk"), 0o644))
+	require.NoError(t, os.WriteFile(index, []byte("index"), 0o644))
+
+	require.NoError(t, s.Publish(ctx, "x86_64", []string{apk}, index, ""))
+	require.Equal(t, map[string]string{
+		"/bucket/os/x86_64/foo-1.0-r0.apk":  "apk",
+		"/bucket/os/x86_64/APKINDEX.tar.gz": "index",
+	}, objects)
+
+	data, version, err := s.Index(ctx, "x86_64")
+	require.NoError(t, err)
+	require.Equal(t, "index", string(data))
+	require.Equal(t, `"index"`, version)
+
+	// The index is only replaced if it is still at the version it was
+	// downloaded at.
+	require.ErrorIs(t, s.Publish(ctx, "x86_64", []string{apk}, index, ""), ErrIndexChanged)
+	require.ErrorIs(t, s.Publish(ctx, "x86_64", []string{apk}, index, `"other"`), ErrIndexChanged)
+	require.NoError(t, s.Publish(ctx, "x86_64", []string{apk}, index, version))
+
+	// The endpoint of AWS addresses the bucket in the host.
+	t.Setenv("AWS_ENDPOINT_URL_S3", "")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	s, err = newS3Store(ctx, "bucket")
+	require.NoError(t, err)
+	opts := s.(*bucketStore).objects.(*s3Objects).client.Options()
+	require.False(t, opts.UsePathStyle)
+	require.Equal(t, "eu-west-1", opts.Region)
+}
@@ -25,6 +25,10 @@ import (
 
 	"github.com/chainguard-dev/clog"
 	"github.com/dprotaso/go-yit"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"gopkg.in/yaml.v3"
 
 	"chainguard.dev/melange/pkg/config"
@@ -86,10 +90,19 @@ func New(ctx context.Context, opts ...Option) renovate.Renovator {
 			return err
 		}
 
+		if bcfg.TargetVersion == "" {
+			bcfg.TargetVersion = versionNode.Value
+		}
+
 		// if the version is changing then reset the epoch to 0 else if the version is the same then increment the epoch by 1
 		epochNode, err := renovate.NodeFromMapping(packageNode, "epoch")
 		if err != nil {
-			return err
+			// The epoch defaults to 0 when it is left out.
+			epochNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: "0"}
+			packageNode.Content = append(packageNode.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "epoch"},
+				epochNode,
+			)
 		}
 
 		if versionNode.Value != bcfg.TargetVersion {
@@ -138,7 +151,7 @@ func New(ctx context.Context, opts ...Option) renovate.Renovator {
 			Filter(yit.WithMapValue("git-checkout"))
 
 		for gitCheckoutNode, ok := it(); ok; gitCheckoutNode, ok = it() {
-			if err := updateGitCheckout(ctx, gitCheckoutNode, bcfg.ExpectedCommit); err != nil {
+			if err := updateGitCheckout(ctx, rc, gitCheckoutNode, bcfg.ExpectedCommit); err != nil {
 				return err
 			}
 		}
@@ -204,7 +217,8 @@ func updateFetch(ctx context.Context, rc *renovate.RenovationContext, node *yaml
 }
 
 // updateGitCheckout takes a "git-checkout" pipeline node and updates the parameters of it.
-func updateGitCheckout(ctx context.Context, node *yaml.Node, expectedGitSha string) error {
+// Unless the expected commit is given, it is resolved from the tag of the checkout.
+func updateGitCheckout(ctx context.Context, rc *renovate.RenovationContext, node *yaml.Node, expectedGitSha string) error {
 	log := clog.FromContext(ctx)
 
 	withNode, err := renovate.NodeFromMapping(node, "with")
@@ -225,14 +239,72 @@ func updateGitCheckout(ctx context.Context, node *yaml.Node, expectedGitSha stri
 
 	log.Infof("processing git-checkout node")
 
-	if expectedGitSha != "" {
-		// Update expected hash nodes.
-		nodeCommit, err := renovate.NodeFromMapping(withNode, "expected-commit")
-		if err == nil {
-			nodeCommit.Value = expectedGitSha
-			log.Infof("  expected-commit: %s", expectedGitSha)
+	nodeCommit, err := renovate.NodeFromMapping(withNode, "expected-commit")
+	if err != nil {
+		return nil
+	}
+
+	if expectedGitSha == "" {
+		if tag == nil {
+			log.Infof("  no expected-commit was given, and there is no tag to resolve it from")
+			return nil
+		}
+
+		repoNode, err := renovate.NodeFromMapping(withNode, "repository")
+		if err != nil {
+			return err
+		}
+
+		evaluatedTag, err := util.MutateStringFromMap(rc.Vars, tag.Value)
+		if err != nil {
+			return err
+		}
+		log.Infof("  repository: %s", repoNode.Value)
+		log.Infof("  tag: %s", evaluatedTag)
+
+		expectedGitSha, err = resolveTag(ctx, repoNode.Value, evaluatedTag)
+		if err != nil {
+			return err
 		}
 	}
 
+	// Update expected hash nodes.
+	nodeCommit.Value = expectedGitSha
+	log.Infof("  expected-commit: %s", expectedGitSha)
+
 	return nil
 }
+
+// resolveTag returns the commit which a tag of a remote repository points
+// to, like git ls-remote.  Annotated tags are peeled to their commit.
+func resolveTag(ctx context.Context, repository, tag string) (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repository},
+	})
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{PeelingOption: git.AppendPeeled})
+	if err != nil {
+		return "", fmt.Errorf("listing the tags of %s: %w", repository, err)
+	}
+
+	name := plumbing.NewTagReferenceName(tag)
+	commit, peeled := "", ""
+	for _, ref := range refs {
+		switch ref.Name() {
+		case name:
+			commit = ref.Hash().String()
+		case name + "^{}":
+			peeled = ref.Hash().String()
+		}
+	}
+
+	if peeled != "" {
+		return peeled, nil
+	}
+	if commit == "" {
+		return "", fmt.Errorf("%s has no tag %s", repository, tag)
+	}
+
+	return commit, nil
+}
@@ -11,6 +11,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 
 	"chainguard.dev/melange/pkg/renovate"
 	"github.com/stretchr/testify/assert"
@@ -152,3 +156,66 @@ func setupTestServer(t *testing.T) (error, *httptest.Server) {
 	}))
 	return err, server
 }
+
+func TestBump_resolvesExpectedCommit(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	// An upstream repository with an annotated tag for the new version.
+	upstream := t.TempDir()
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(upstream, "README"), []byte("cheese"), 0o644))
+	_, err = wt.Add("README")
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "cheese", Email: "cheese@example.com", When: time.Unix(0, 0)}
+	commit, err := wt.Commit("cheese", &git.CommitOptions{Author: sig})
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v7.0.1", commit, &git.CreateTagOptions{Tagger: sig, Message: "7.0.1"})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "cheese.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(`package:
+  name: cheese
+  version: 6.8
+  description: "a cheesy library"
+
+pipeline:
+  # the main checkout
+  - uses: git-checkout
+    with:
+      repository: `+upstream+`
+      tag: v${{package.version}}
+      expected-commit: foo
+`), 0o644))
+
+	rctx, err := renovate.New(renovate.WithConfig(fp))
+	require.NoError(t, err)
+	require.NoError(t, rctx.Renovate(ctx, New(ctx, WithTargetVersion("7.0.1"))))
+
+	rs, err := config.ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, "7.0.1", rs.Package.Version)
+	require.Equal(t, uint64(0), rs.Package.Epoch)
+	require.Equal(t, commit.String(), rs.Pipeline[0].With["expected-commit"])
+
+	data, err := os.ReadFile(fp)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "# the main checkout")
+
+	// Without a version, only the epoch is bumped, even though it was left
+	// out.
+	rctx, err = renovate.New(renovate.WithConfig(fp))
+	require.NoError(t, err)
+	require.NoError(t, rctx.Renovate(ctx, New(ctx)))
+
+	rs, err = config.ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, "7.0.1", rs.Package.Version)
+	require.Equal(t, uint64(1), rs.Package.Epoch)
+
+	_, err = resolveTag(ctx, upstream, "v8")
+	require.ErrorContains(t, err, "has no tag v8")
+}
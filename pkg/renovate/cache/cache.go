@@ -29,6 +29,7 @@ import (
 	"github.com/dprotaso/go-yit"
 	"gopkg.in/yaml.v3"
 
+	"chainguard.dev/melange/pkg/cachecrypt"
 	"chainguard.dev/melange/pkg/renovate"
 	"chainguard.dev/melange/pkg/util"
 )
@@ -37,6 +38,7 @@ import (
 // renovator.
 type CacheConfig struct {
 	CacheDir       string
+	Key            *cachecrypt.Key
 	packageName    string
 	packageVersion string
 }
@@ -53,6 +55,15 @@ func WithCacheDir(cacheDir string) Option {
 	}
 }
 
+// WithKey sets the key to encrypt the cache artifacts with, for caches which
+// are shared through storage that may not see their contents.
+func WithKey(key *cachecrypt.Key) Option {
+	return func(cfg *CacheConfig) error {
+		cfg.Key = key
+		return nil
+	}
+}
+
 // New returns a renovator which fetches cache dependencies.
 func New(opts ...Option) renovate.Renovator {
 	cfg := CacheConfig{}
@@ -207,7 +218,11 @@ func addFileToCache(ctx context.Context, cfg CacheConfig, downloadedFile string,
 	}
 	defer sourceFile.Close()
 
-	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+	if cfg.Key != nil {
+		if err := cfg.Key.Encrypt(destinationFile, sourceFile); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(destinationFile, sourceFile); err != nil {
 		return err
 	}
 
@@ -41,8 +41,12 @@ type pkg struct {
 	LicenseConcluded string
 	Namespace        string
 	Arch             string
+	DownloadLocation string
 	Checksums        map[string]string
-	Relationships    []relationship
+	// TrustedKeys are the fingerprints of the keys the build environment
+	// of the package was verified with.
+	TrustedKeys   []string
+	Relationships []relationship
 }
 
 func (p *pkg) ID() string {
@@ -17,6 +17,7 @@ package sbom
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"time"
 
 	"github.com/chainguard-dev/clog"
@@ -28,7 +29,10 @@ func NewGenerator() *Generator {
 }
 
 type Spec struct {
-	Path            string
+	Path string
+	// FS holds the files of the package when they are not in Path.  The
+	// SBOM is written to Path either way.
+	FS              fs.FS
 	PackageName     string
 	PackageVersion  string
 	License         string // Full SPDX license expression
@@ -36,6 +40,16 @@ type Spec struct {
 	Namespace       string
 	Arch            string
 	SourceDateEpoch time.Time
+	// OriginName is the name of the package whose build produced this
+	// subpackage.  It is empty for the origin package itself.
+	OriginName string
+	// SourceLocation is the SPDX download location of the sources of the
+	// origin package, if known.
+	SourceLocation string
+	// TrustedKeys are the fingerprints of the keys which verified the
+	// repositories the build environment was installed from, if they were
+	// verified.
+	TrustedKeys []string
 }
 
 type Generator struct{}
@@ -71,6 +85,10 @@ func (g *Generator) GenerateSBOM(ctx context.Context, spec *Spec) error {
 		return fmt.Errorf("reading SBOM file inventory: %w", err)
 	}
 
+	// Relate the package to the sources and the origin package shared by
+	// all the packages of the build.
+	addOriginRelationships(spec, &pkg)
+
 	sbomDoc.Packages = append(sbomDoc.Packages, pkg)
 
 	// Finally, write the SBOM data to disk
@@ -20,10 +20,14 @@ package sbom
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -40,7 +44,6 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
-	"sigs.k8s.io/release-utils/hash"
 	"sigs.k8s.io/release-utils/version"
 
 	"chainguard.dev/apko/pkg/sbom/generator/spdx"
@@ -62,6 +65,10 @@ func stringToIdentifier(in string) (out string) {
 }
 
 func checkEnvironment(spec *Spec) (bool, error) {
+	if spec.FS != nil {
+		return true, nil
+	}
+
 	dirPath, err := filepath.Abs(spec.Path)
 	if err != nil {
 		return false, fmt.Errorf("getting absolute directory path: %w", err)
@@ -96,6 +103,7 @@ func generateAPKPackage(spec *Spec) (pkg, error) {
 		Namespace:        spec.Namespace,
 		Arch:             spec.Arch,
 		Originator:       "Organization: " + cases.Title(language.English).String(spec.Namespace),
+		TrustedKeys:      spec.TrustedKeys,
 	}
 
 	if spec.License != "" {
@@ -105,14 +113,78 @@ func generateAPKPackage(spec *Spec) (pkg, error) {
 	return newPackage, nil
 }
 
+// originName returns the name of the origin package of the package.
+func originName(spec *Spec) string {
+	if spec.OriginName != "" {
+		return spec.OriginName
+	}
+	return spec.PackageName
+}
+
+// addOriginRelationships relates the apk package to the sources of its
+// build and, for subpackages, to the origin package.  The related packages
+// have the same identifiers in the SBOMs of every package of the build, so
+// that they can be grouped by origin.
+func addOriginRelationships(spec *Spec, p *pkg) {
+	origin := originName(spec)
+
+	source := &pkg{
+		id:               stringToIdentifier(fmt.Sprintf("%s-%s-source", origin, spec.PackageVersion)),
+		Name:             origin,
+		Version:          spec.PackageVersion,
+		Relationships:    []relationship{},
+		LicenseDeclared:  p.LicenseDeclared,
+		LicenseConcluded: spdx.NOASSERTION,
+		Copyright:        spec.Copyright,
+		Originator:       p.Originator,
+		DownloadLocation: spec.SourceLocation,
+	}
+	p.Relationships = append(p.Relationships, relationship{
+		Source: p,
+		Target: source,
+		Type:   "GENERATED_FROM",
+	})
+
+	if origin == spec.PackageName {
+		return
+	}
+
+	originPkg := &pkg{
+		id:               stringToIdentifier(fmt.Sprintf("%s-%s", origin, spec.PackageVersion)),
+		Name:             origin,
+		Version:          spec.PackageVersion,
+		Relationships:    []relationship{},
+		LicenseDeclared:  p.LicenseDeclared,
+		LicenseConcluded: spdx.NOASSERTION,
+		Copyright:        spec.Copyright,
+		Namespace:        spec.Namespace,
+		Arch:             spec.Arch,
+		Originator:       p.Originator,
+	}
+	originPkg.Relationships = append(originPkg.Relationships, relationship{
+		Source: originPkg,
+		Target: source,
+		Type:   "GENERATED_FROM",
+	})
+	p.Relationships = append(p.Relationships, relationship{
+		Source: p,
+		Target: originPkg,
+		Type:   "VARIANT_OF",
+	})
+}
+
 // scanFiles reads the files to be packaged in the apk and
 // extracts the required data for the SBOM.
 func scanFiles(spec *Spec, dirPackage *pkg) error {
-	dirPath, err := filepath.Abs(spec.Path)
-	if err != nil {
-		return fmt.Errorf("getting absolute directory path: %w", err)
+	fsys := spec.FS
+	if fsys == nil {
+		dirPath, err := filepath.Abs(spec.Path)
+		if err != nil {
+			return fmt.Errorf("getting absolute directory path: %w", err)
+		}
+		fsys = os.DirFS(dirPath)
 	}
-	fileList, err := getDirectoryTree(dirPath)
+	fileList, err := getDirectoryTree(fsys)
 	if err != nil {
 		return fmt.Errorf("building directory tree: %w", err)
 	}
@@ -127,27 +199,18 @@ func scanFiles(spec *Spec, dirPackage *pkg) error {
 		i, path := i, path
 
 		g.Go(func() error {
-			f := file{
+			// Hash the file contents
+			csums, err := hashFile(fsys, strings.TrimPrefix(path, "/"))
+			if err != nil {
+				return fmt.Errorf("hashing file %s: %w", path, err)
+			}
+
+			files[i] = file{
 				id:            stringToIdentifier(path),
 				Name:          strings.TrimPrefix(path, "/"),
-				Checksums:     map[string]string{},
+				Checksums:     csums,
 				Relationships: []relationship{},
 			}
-
-			// Hash the file contents
-			for algo, fn := range map[string]func(string) (string, error){
-				"SHA1":   hash.SHA1ForFile,
-				"SHA256": hash.SHA256ForFile,
-				"SHA512": hash.SHA512ForFile,
-			} {
-				csum, err := fn(filepath.Join(dirPath, path))
-				if err != nil {
-					return fmt.Errorf("hashing %s file %s: %w", algo, path, err)
-				}
-				f.Checksums[algo] = csum
-			}
-
-			files[i] = f
 			return nil
 		})
 	}
@@ -207,6 +270,10 @@ func addPackage(doc *spdx.Document, p *pkg) {
 		Originator:           p.Originator,
 	}
 
+	if p.DownloadLocation != "" {
+		spdxPkg.DownloadLocation = p.DownloadLocation
+	}
+
 	algos := []string{}
 	for algo := range p.Checksums {
 		algos = append(algos, algo)
@@ -236,7 +303,11 @@ func addPackage(doc *spdx.Document, p *pkg) {
 		}
 	}
 
-	verificationCode := computeVerificationCode(hashList)
+	// Related packages, like the sources, have no file inventory.
+	verificationCode := ""
+	if p.FilesAnalyzed {
+		verificationCode = computeVerificationCode(hashList)
+	}
 	if verificationCode != "" {
 		spdxPkg.VerificationCode = &spdx.PackageVerificationCode{
 			Value: verificationCode,
@@ -264,6 +335,16 @@ func addPackage(doc *spdx.Document, p *pkg) {
 		})
 	}
 
+	// SPDX has no notion of the keys a build environment was verified
+	// with, so they are recorded as references of their own type.
+	for _, fingerprint := range p.TrustedKeys {
+		spdxPkg.ExternalRefs = append(spdxPkg.ExternalRefs, spdx.ExternalRef{
+			Category: "OTHER",
+			Locator:  fingerprint,
+			Type:     "melange-trusted-key",
+		})
+	}
+
 	doc.Packages = append(doc.Packages, spdxPkg)
 
 	// Cycle the related objects and add them
@@ -420,11 +501,40 @@ func writeSBOM(ctx context.Context, spec *Spec, doc *bom) error {
 	return nil
 }
 
-// getDirectoryTree reads a directory and returns a list of strings of all files init
-func getDirectoryTree(dirPath string) ([]string, error) {
+// hashFile returns the SHA1, SHA256 and SHA512 checksums of the file name
+// of fsys.
+func hashFile(fsys fs.FS, name string) (map[string]string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := map[string]hash.Hash{
+		"SHA1":   sha1.New(),
+		"SHA256": sha256.New(),
+		"SHA512": sha512.New(),
+	}
+	w := []io.Writer{}
+	for _, h := range hashes {
+		w = append(w, h)
+	}
+	if _, err := io.Copy(io.MultiWriter(w...), f); err != nil {
+		return nil, err
+	}
+
+	csums := map[string]string{}
+	for algo, h := range hashes {
+		csums[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+	return csums, nil
+}
+
+// getDirectoryTree reads a filesystem and returns a list of strings of all files in it
+func getDirectoryTree(fsys fs.FS) ([]string, error) {
 	fileList := []string{}
 
-	if err := fs.WalkDir(os.DirFS(dirPath), ".", func(path string, d fs.DirEntry, err error) error {
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
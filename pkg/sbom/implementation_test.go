@@ -18,10 +18,14 @@
 package sbom
 
 import (
+	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
 
+	"chainguard.dev/apko/pkg/sbom/generator/spdx"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,7 +43,144 @@ func TestGetDirectoryTree(t *testing.T) {
 		require.NoError(t, os.MkdirAll(filepath.Join(d, dir), os.FileMode(0o755)))
 		require.NoError(t, os.WriteFile(filepath.Join(d, tf), []byte("dummy"), os.FileMode(0o644)))
 	}
-	readList, err := getDirectoryTree(d)
+	readList, err := getDirectoryTree(os.DirFS(d))
 	require.NoError(t, err)
 	require.Equal(t, original, readList)
 }
+
+func TestScanFiles_FS(t *testing.T) {
+	// The files of the package are read from FS rather than Path.
+	spec := &Spec{
+		Path: t.TempDir(),
+		FS: fstest.MapFS{
+			"usr/bin/hello": {Data: []byte("hello"), Mode: 0o755},
+		},
+	}
+	p := pkg{}
+	require.NoError(t, scanFiles(spec, &p))
+	require.Len(t, p.Relationships, 1)
+	f := p.Relationships[0].Target.(*file)
+	require.Equal(t, "usr/bin/hello", f.Name)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", f.Checksums["SHA256"])
+	require.Equal(t, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", f.Checksums["SHA1"])
+}
+
+func TestOriginRelationships(t *testing.T) {
+	ctx := context.Background()
+
+	generate := func(name, origin string) *spdx.Document {
+		d := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(d, name), []byte(name), 0o644))
+
+		require.NoError(t, NewGenerator().GenerateSBOM(ctx, &Spec{
+			Path:           d,
+			PackageName:    name,
+			PackageVersion: "2.12-r0",
+			Namespace:      "wolfi",
+			Arch:           "x86_64",
+			OriginName:     origin,
+			SourceLocation: "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz",
+		}))
+
+		data, err := os.ReadFile(filepath.Join(d, "var", "lib", "db", "sbom", name+"-2.12-r0.spdx.json"))
+		require.NoError(t, err)
+		doc := &spdx.Document{}
+		require.NoError(t, json.Unmarshal(data, doc))
+		return doc
+	}
+
+	relationships := func(doc *spdx.Document) []spdx.Relationship {
+		rels := []spdx.Relationship{}
+		for _, rel := range doc.Relationships {
+			if rel.Type != "CONTAINS" {
+				rels = append(rels, rel)
+			}
+		}
+		return rels
+	}
+
+	pkg := func(doc *spdx.Document, id string) spdx.Package {
+		for _, p := range doc.Packages {
+			if p.ID == id {
+				return p
+			}
+		}
+		t.Fatalf("no package %s", id)
+		return spdx.Package{}
+	}
+
+	origin := generate("hello", "")
+	require.Equal(t, []spdx.Relationship{{
+		Element: "SPDXRef-Package-hello-2.12-r0",
+		Type:    "GENERATED_FROM",
+		Related: "SPDXRef-Package-hello-2.12-r0-source",
+	}}, relationships(origin))
+
+	sub := generate("hello-doc", "hello")
+	require.Equal(t, []spdx.Relationship{{
+		Element: "SPDXRef-Package-hello-doc-2.12-r0",
+		Type:    "GENERATED_FROM",
+		Related: "SPDXRef-Package-hello-2.12-r0-source",
+	}, {
+		Element: "SPDXRef-Package-hello-2.12-r0",
+		Type:    "GENERATED_FROM",
+		Related: "SPDXRef-Package-hello-2.12-r0-source",
+	}, {
+		Element: "SPDXRef-Package-hello-doc-2.12-r0",
+		Type:    "VARIANT_OF",
+		Related: "SPDXRef-Package-hello-2.12-r0",
+	}}, relationships(sub))
+
+	// The sources are the same package in both SBOMs.
+	require.Equal(t, pkg(origin, "SPDXRef-Package-hello-2.12-r0-source"), pkg(sub, "SPDXRef-Package-hello-2.12-r0-source"))
+	require.Equal(t, "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz", pkg(sub, "SPDXRef-Package-hello-2.12-r0-source").DownloadLocation)
+	require.Equal(t, "pkg:apk/wolfi/hello@2.12-r0?arch=x86_64", pkg(sub, "SPDXRef-Package-hello-2.12-r0").ExternalRefs[0].Locator)
+	require.False(t, pkg(sub, "SPDXRef-Package-hello-2.12-r0").FilesAnalyzed)
+}
+
+func TestTrustedKeys(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+
+	fingerprints := []string{
+		"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+	}
+	require.NoError(t, NewGenerator().GenerateSBOM(ctx, &Spec{
+		Path:           d,
+		PackageName:    "hello",
+		PackageVersion: "2.12-r0",
+		Namespace:      "wolfi",
+		Arch:           "x86_64",
+		TrustedKeys:    fingerprints,
+	}))
+
+	data, err := os.ReadFile(filepath.Join(d, "var", "lib", "db", "sbom", "hello-2.12-r0.spdx.json"))
+	require.NoError(t, err)
+	doc := &spdx.Document{}
+	require.NoError(t, json.Unmarshal(data, doc))
+
+	for _, p := range doc.Packages {
+		if p.ID != "SPDXRef-Package-hello-2.12-r0" {
+			// Only the package was built in the verified environment.
+			for _, ref := range p.ExternalRefs {
+				require.NotEqual(t, "melange-trusted-key", ref.Type)
+			}
+			continue
+		}
+
+		require.Equal(t, []spdx.ExternalRef{{
+			Category: "PACKAGE_MANAGER",
+			Locator:  "pkg:apk/wolfi/hello@2.12-r0?arch=x86_64",
+			Type:     "purl",
+		}, {
+			Category: "OTHER",
+			Locator:  fingerprints[0],
+			Type:     "melange-trusted-key",
+		}, {
+			Category: "OTHER",
+			Locator:  fingerprints[1],
+			Type:     "melange-trusted-key",
+		}}, p.ExternalRefs)
+	}
+}
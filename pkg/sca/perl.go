@@ -0,0 +1,264 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// perlLibDirs are the directories Perl modules are installed in.  Modules
+// may be installed in one of perlVendorDirs below them.
+var (
+	perlLibDirs    = []string{"usr/share/perl5/", "usr/lib/perl5/"}
+	perlVendorDirs = []string{"vendor_perl/", "core_perl/", "site_perl/"}
+)
+
+var (
+	// perlVersionRe matches the assignment of $VERSION, e.g.
+	// our $VERSION = '1.23';
+	perlVersionRe = regexp.MustCompile(`^\s*(?:our\s+)?\$(?:[\w:]+::)?VERSION\s*=\s*['"]?v?([0-9][0-9._]*)['"]?\s*;`)
+	// perlPackageVersionRe matches a package declaration with a version,
+	// e.g. package Foo::Bar 1.23;
+	perlPackageVersionRe = regexp.MustCompile(`^\s*package\s+[\w:]+\s+v?([0-9][0-9._]*)\s*[;{]`)
+	// perlUseRe matches the use and require statements of a module, e.g.
+	// use Foo::Bar qw(baz); or require Foo::Bar;
+	perlUseRe = regexp.MustCompile(`^\s*(?:use|require)\s+([A-Za-z_]\w*(?:::\w+)*)(?:[\s;(]|$)`)
+)
+
+// perlModuleName returns the name of the module installed at path, e.g.
+// Foo::Bar for usr/share/perl5/vendor_perl/Foo/Bar.pm, and whether path is a
+// module.
+func perlModuleName(path string) (string, bool) {
+	if filepath.Ext(path) != ".pm" {
+		return "", false
+	}
+
+	var rel string
+	for _, dir := range perlLibDirs {
+		if strings.HasPrefix(path, dir) {
+			rel = strings.TrimPrefix(path, dir)
+			break
+		}
+	}
+	if rel == "" {
+		return "", false
+	}
+	for _, dir := range perlVendorDirs {
+		if strings.HasPrefix(rel, dir) {
+			rel = strings.TrimPrefix(rel, dir)
+			break
+		}
+	}
+
+	// auto holds the shared objects and the packlists of modules.
+	if strings.HasPrefix(rel, "auto/") {
+		return "", false
+	}
+
+	return strings.ReplaceAll(strings.TrimSuffix(rel, ".pm"), "/", "::"), true
+}
+
+// perlVersion returns a Perl module version as an apk version, or "" if it
+// cannot be expressed as one.  Underscores of development releases are
+// dropped, as Perl does when it compares versions, e.g. 1.23_01 is 1.2301.
+func perlVersion(v string) string {
+	v = strings.TrimSuffix(strings.ReplaceAll(v, "_", ""), ".")
+	if v == "" {
+		return ""
+	}
+	for _, part := range strings.Split(v, ".") {
+		if part == "" {
+			return ""
+		}
+	}
+
+	return v
+}
+
+// perlModule is what a Perl module declares: its version, and the modules it
+// uses.
+type perlModule struct {
+	version string
+	uses    []string
+}
+
+// parsePerlModule reads the version of a Perl module and the modules it uses
+// or requires.  Pragmas, which are named in lowercase, are left out, as are
+// the statements in POD and after __END__ or __DATA__.
+func parsePerlModule(fsys fs.FS, path string) (perlModule, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return perlModule{}, err
+	}
+	defer f.Close()
+
+	mod := perlModule{}
+	pod := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "=cut"):
+			pod = false
+			continue
+		case strings.HasPrefix(line, "="):
+			pod = true
+			continue
+		case pod:
+			continue
+		case line == "__END__" || line == "__DATA__":
+			return mod, scanner.Err()
+		}
+
+		if mod.version == "" {
+			if m := perlVersionRe.FindStringSubmatch(line); m != nil {
+				mod.version = perlVersion(m[1])
+			} else if m := perlPackageVersionRe.FindStringSubmatch(line); m != nil {
+				mod.version = perlVersion(m[1])
+			}
+		}
+
+		if m := perlUseRe.FindStringSubmatch(line); m != nil && unicode.IsUpper(rune(m[1][0])) {
+			mod.uses = append(mod.uses, m[1])
+		}
+	}
+
+	return mod, scanner.Err()
+}
+
+// perlMeta is the part of a CPAN META.json which lists the modules a
+// distribution needs at runtime.
+type perlMeta struct {
+	Prereqs struct {
+		Runtime struct {
+			Requires map[string]any `json:"requires"`
+		} `json:"runtime"`
+	} `json:"prereqs"`
+}
+
+// parsePerlMeta returns the runtime prerequisites of a META.json or
+// MYMETA.json, other than perl itself.
+func parsePerlMeta(fsys fs.FS, path string) ([]string, error) {
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta perlMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	requires := []string{}
+	for mod := range meta.Prereqs.Runtime.Requires {
+		if mod != "perl" {
+			requires = append(requires, mod)
+		}
+	}
+	sort.Strings(requires)
+
+	return requires, nil
+}
+
+// generatePerlDeps generates perl:Module::Name provides for the Perl modules
+// a package installs, and perl:Module::Name runtime dependencies on the
+// modules they use.  When the package ships the META.json or MYMETA.json of
+// its distribution, its runtime prerequisites are used instead of the use and
+// require statements of the modules.
+func generatePerlDeps(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	log := clog.FromContext(ctx)
+	log.Infof("scanning for perl modules...")
+
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		return err
+	}
+	deps := newDependencySet(generated)
+
+	provided := map[string]bool{}
+	uses := []string{}
+	meta := []string{}
+	metaFound := false
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !allowedPrefix(path, perlLibDirs) {
+			return nil
+		}
+
+		if base := filepath.Base(path); base == "META.json" || base == "MYMETA.json" {
+			requires, err := parsePerlMeta(fsys, path)
+			if err != nil {
+				log.Warnf("  unable to read perl prerequisites: %v", err)
+				return nil
+			}
+			metaFound = true
+			meta = append(meta, requires...)
+			return nil
+		}
+
+		name, ok := perlModuleName(path)
+		if !ok {
+			return nil
+		}
+
+		mod, err := parsePerlModule(fsys, path)
+		if err != nil {
+			return err
+		}
+
+		provided[name] = true
+		log.Infof("  found perl module %s", name)
+		if mod.version != "" {
+			deps.provides(fmt.Sprintf("perl:%s=%s", name, mod.version))
+		} else {
+			deps.provides(fmt.Sprintf("perl:%s", name))
+		}
+		uses = append(uses, mod.uses...)
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if metaFound {
+		uses = meta
+	}
+	for _, name := range uses {
+		if provided[name] {
+			continue
+		}
+		log.Infof("  found perl dependency %s", name)
+		deps.runtime(fmt.Sprintf("perl:%s", name))
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+const perlFooBar = `package Foo::Bar;
+use strict;
+use warnings;
+use 5.010;
+
+use Foo::Baz;
+use List::Util qw(first);
+use JSON::PP ();
+require File::Spec;
+
+our $VERSION = '1.23_01';
+
+my $mod = "Foo::" . $name;
+require $mod;
+
+=head1 SYNOPSIS
+
+  use Not::A::Dependency;
+
+=cut
+
+sub new { bless {}, shift }
+
+1;
+
+__END__
+
+use Not::A::Dependency::Either;
+`
+
+const perlFooBaz = `package Foo::Baz 0.5;
+use parent 'Foo::Bar';
+1;
+`
+
+func TestGeneratePerlDeps(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	t.Run("use statements", func(t *testing.T) {
+		hdl := newFSHandle(t, "perl-foo-bar", map[string]string{
+			"usr/share/perl5/vendor_perl/Foo/Bar.pm":             perlFooBar,
+			"usr/share/perl5/vendor_perl/Foo/Baz.pm":             perlFooBaz,
+			"usr/share/perl5/vendor_perl/auto/Foo/Bar/.packlist": "",
+			"usr/share/perl5/vendor_perl/auto/Foo/Bar/Bar.pm":    "package Not::A::Module;",
+			"usr/share/man/man3/Foo::Bar.3pm":                    "",
+		})
+
+		got := config.Dependencies{}
+		if err := generatePerlDeps(ctx, hdl, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"perl:Foo::Bar=1.2301", "perl:Foo::Baz=0.5"}, got.Provides); diff != "" {
+			t.Errorf("provides: (-want, +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"perl:List::Util", "perl:JSON::PP", "perl:File::Spec"}, got.Runtime); diff != "" {
+			t.Errorf("runtime: (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("META.json", func(t *testing.T) {
+		hdl := newFSHandle(t, "perl-foo-bar", map[string]string{
+			"usr/lib/perl5/vendor_perl/Foo/Bar.pm": perlFooBar,
+			"usr/lib/perl5/vendor_perl/auto/Foo/Bar/META.json": `{
+  "prereqs": {
+    "runtime": {
+      "requires": {"perl": "5.010", "Try::Tiny": "0", "Moo": "2.0"}
+    },
+    "test": {
+      "requires": {"Test::More": "0"}
+    }
+  }
+}`,
+		})
+
+		got := config.Dependencies{}
+		if err := generatePerlDeps(ctx, hdl, &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"perl:Foo::Bar=1.2301"}, got.Provides); diff != "" {
+			t.Errorf("provides: (-want, +got):\n%s", diff)
+		}
+		if diff := cmp.Diff([]string{"perl:Moo", "perl:Try::Tiny"}, got.Runtime); diff != "" {
+			t.Errorf("runtime: (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no modules", func(t *testing.T) {
+		hdl := newFSHandle(t, "hello", map[string]string{
+			"usr/bin/hello": "#!/usr/bin/perl\nuse Foo::Bar;\n",
+		})
+
+		got := config.Dependencies{}
+		if err := generatePerlDeps(ctx, hdl, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Provides) != 0 || len(got.Runtime) != 0 {
+			t.Errorf("want no dependencies, got %+v", got)
+		}
+	})
+}
+
+func TestPerlVersion(t *testing.T) {
+	for in, want := range map[string]string{
+		"1.23":    "1.23",
+		"1.23_01": "1.2301",
+		"1.2.3":   "1.2.3",
+		"1.":      "1",
+		"1..2":    "",
+	} {
+		if got := perlVersion(in); got != want {
+			t.Errorf("perlVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
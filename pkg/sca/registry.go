@@ -0,0 +1,121 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Generator describes a dependency generator which is run by Analyze.
+type Generator struct {
+	// Name identifies the generator.  It is recorded in the dependency log
+	// and must be unique.
+	Name string
+
+	// Priority orders the generators: generators with a lower priority run
+	// first, and generators with the same priority run in the order they
+	// were registered.  The built-in generators use multiples of 100.
+	Priority int
+
+	// Disabled turns the generator off until it is enabled with
+	// SetGeneratorEnabled.
+	Disabled bool
+
+	// Enabled, if set, is consulted for every package before running the
+	// generator, and the generator is skipped if it returns false.
+	Enabled func(SCAHandle) bool
+
+	// Generate runs the generator.
+	Generate DependencyGenerator
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = []Generator{}
+)
+
+// RegisterGenerator adds a dependency generator to the set run by Analyze.
+// It is intended to be called from an init function by programs embedding
+// melange.
+func RegisterGenerator(g Generator) error {
+	if g.Name == "" {
+		return fmt.Errorf("dependency generator must have a name")
+	}
+	if g.Generate == nil {
+		return fmt.Errorf("dependency generator %s has no Generate function", g.Name)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, r := range registry {
+		if r.Name == g.Name {
+			return fmt.Errorf("dependency generator %s is already registered", g.Name)
+		}
+	}
+
+	registry = append(registry, g)
+	sort.SliceStable(registry, func(i, j int) bool {
+		return registry[i].Priority < registry[j].Priority
+	})
+
+	return nil
+}
+
+// SetGeneratorEnabled enables or disables a registered dependency generator.
+func SetGeneratorEnabled(name string, enabled bool) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for i := range registry {
+		if registry[i].Name == name {
+			registry[i].Disabled = !enabled
+			return nil
+		}
+	}
+
+	return fmt.Errorf("dependency generator %s is not registered", name)
+}
+
+// Generators returns the registered dependency generators in the order they
+// are run.
+func Generators() []Generator {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	gens := make([]Generator, len(registry))
+	copy(gens, registry)
+
+	return gens
+}
+
+func mustRegisterGenerator(g Generator) {
+	if err := RegisterGenerator(g); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	mustRegisterGenerator(Generator{Name: "soname", Priority: 100, Generate: generateSharedObjectNameDeps})
+	mustRegisterGenerator(Generator{Name: "cmd", Priority: 200, Generate: generateCmdProviders})
+	mustRegisterGenerator(Generator{Name: "pkgconfig", Priority: 300, Generate: generatePkgConfigDeps})
+	mustRegisterGenerator(Generator{Name: "python", Priority: 400, Generate: generatePythonDeps})
+	mustRegisterGenerator(Generator{Name: "perl", Priority: 500, Generate: generatePerlDeps})
+	mustRegisterGenerator(Generator{Name: "ruby", Priority: 600, Generate: generateRubyDeps})
+	mustRegisterGenerator(Generator{Name: "shebang", Priority: 700, Generate: generateShebangDeps})
+	mustRegisterGenerator(Generator{Name: "symlink", Priority: 800, Generate: generateSymlinkDeps})
+}
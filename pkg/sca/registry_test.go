@@ -0,0 +1,90 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func restoreRegistry(t *testing.T) {
+	t.Helper()
+	saved := Generators()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		registry = saved
+	})
+}
+
+func TestRegisterGenerator(t *testing.T) {
+	restoreRegistry(t)
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
+	defer th.exp.Close()
+
+	gen := func(provides string) DependencyGenerator {
+		return func(_ context.Context, _ SCAHandle, generated *config.Dependencies) error {
+			generated.Provides = append(generated.Provides, provides)
+			return nil
+		}
+	}
+
+	if err := RegisterGenerator(Generator{Name: "late", Priority: 1000, Generate: gen("late=1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGenerator(Generator{Name: "early", Priority: 0, Generate: gen("early=1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGenerator(Generator{Name: "off", Priority: 500, Disabled: true, Generate: gen("off=1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGenerator(Generator{Name: "early", Generate: gen("dup=1")}); err == nil {
+		t.Error("registering a duplicate generator should fail")
+	}
+
+	results, err := AnalyzeResults(ctx, th)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, res := range results {
+		names = append(names, res.Generator)
+	}
+	if diff := cmp.Diff([]string{"early", "soname", "cmd", "pkgconfig", "python", "perl", "ruby", "shebang", "symlink", "late"}, names); diff != "" {
+		t.Errorf("generator order: (-want, +got):\n%s", diff)
+	}
+
+	if err := SetGeneratorEnabled("off", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGeneratorEnabled("soname", false); err != nil {
+		t.Fatal(err)
+	}
+
+	got := config.Dependencies{}
+	if err := Analyze(ctx, th, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"early=1", "off=1", "late=1"}, got.Provides); diff != "" {
+		t.Errorf("Analyze() provides: (-want, +got):\n%s", diff)
+	}
+}
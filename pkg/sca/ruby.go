@@ -0,0 +1,158 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+var (
+	// rubyNameRe and rubyVersionRe match the name and the version of an
+	// installed gemspec, e.g. s.name = "rake".freeze
+	rubyNameRe    = regexp.MustCompile(`^\s*\w+\.name\s*=\s*(?:%q<([^>]+)>|["']([^"']+)["'])`)
+	rubyVersionRe = regexp.MustCompile(`^\s*\w+\.version\s*=\s*(?:%q<([^>]+)>|["']([^"']+)["'])`)
+	// rubyDependencyRe matches a runtime dependency of a gemspec, e.g.
+	// s.add_runtime_dependency(%q<concurrent-ruby>.freeze, ["~> 1.0"])
+	rubyDependencyRe = regexp.MustCompile(`^\s*\w+\.add_(?:runtime_)?dependency[\s(]*(?:%q<([^>]+)>|["']([^"']+)["'])`)
+	// rubyReleaseRe matches the versions of releases, which are apk versions
+	// too, unlike the versions of prereleases such as 2.0.0.rc1.
+	rubyReleaseRe = regexp.MustCompile(`^[0-9]+(?:\.[0-9]+)*$`)
+)
+
+// rubyGem is what an installed gemspec declares.
+type rubyGem struct {
+	name    string
+	version string
+	depends []string
+}
+
+// isGemspec returns whether path is an installed gemspec, e.g.
+// usr/lib/ruby/gems/3.3.0/specifications/rake-13.0.6.gemspec, including the
+// gemspecs of the default gems.
+func isGemspec(path string) bool {
+	if filepath.Ext(path) != ".gemspec" {
+		return false
+	}
+
+	dir := filepath.Dir(path)
+	if filepath.Base(dir) == "default" {
+		dir = filepath.Dir(dir)
+	}
+
+	return filepath.Base(dir) == "specifications" && strings.Contains(path, "/gems/")
+}
+
+// firstMatch returns the first non-empty group of a match of re.
+func firstMatch(re *regexp.Regexp, line string) string {
+	m := re.FindStringSubmatch(line)
+	for _, g := range m[1:] {
+		if g != "" {
+			return g
+		}
+	}
+	return ""
+}
+
+// parseGemspec reads the name, the version and the runtime dependencies of
+// an installed gemspec.  Development dependencies are left out.
+func parseGemspec(fsys fs.FS, path string) (rubyGem, error) {
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return rubyGem{}, err
+	}
+
+	gem := rubyGem{}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case gem.name == "" && rubyNameRe.MatchString(line):
+			gem.name = firstMatch(rubyNameRe, line)
+		case gem.version == "" && rubyVersionRe.MatchString(line):
+			gem.version = firstMatch(rubyVersionRe, line)
+		case rubyDependencyRe.MatchString(line):
+			gem.depends = append(gem.depends, firstMatch(rubyDependencyRe, line))
+		}
+	}
+
+	if gem.name == "" {
+		return rubyGem{}, fmt.Errorf("%s has no name", path)
+	}
+
+	return gem, nil
+}
+
+// generateRubyDeps generates ruby:NAME=VERSION provides for the gems a
+// package installs, or ruby:NAME for prereleases, and ruby:NAME runtime
+// dependencies on the gems they depend on at runtime.  The version
+// requirements of the dependencies are left out, as they follow the
+// semantics of RubyGems rather than apk.
+func generateRubyDeps(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	log := clog.FromContext(ctx)
+	log.Infof("scanning for ruby gems...")
+
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		return err
+	}
+	deps := newDependencySet(generated)
+
+	provided := map[string]bool{}
+	depends := []string{}
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !isGemspec(path) {
+			return nil
+		}
+
+		gem, err := parseGemspec(fsys, path)
+		if err != nil {
+			log.Warnf("  unable to read gemspec: %v", err)
+			return nil
+		}
+
+		provided[gem.name] = true
+		log.Infof("  found ruby gem %s %s", gem.name, gem.version)
+		if rubyReleaseRe.MatchString(gem.version) {
+			deps.provides(fmt.Sprintf("ruby:%s=%s", gem.name, gem.version))
+		} else {
+			deps.provides(fmt.Sprintf("ruby:%s", gem.name))
+		}
+		depends = append(depends, gem.depends...)
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range depends {
+		if provided[name] {
+			continue
+		}
+		log.Infof("  found ruby gem dependency %s", name)
+		deps.runtime(fmt.Sprintf("ruby:%s", name))
+	}
+
+	return nil
+}
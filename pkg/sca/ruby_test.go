@@ -0,0 +1,72 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+const railtiesGemspec = `# -*- encoding: utf-8 -*-
+# stub: railties 7.1.3 ruby lib
+
+Gem::Specification.new do |s|
+  s.name = "railties".freeze
+  s.version = "7.1.3".freeze
+
+  s.required_rubygems_version = Gem::Requirement.new(">= 0".freeze) if s.respond_to? :required_rubygems_version=
+  s.authors = ["David Heinemeier Hansson".freeze]
+
+  s.specification_version = 4
+
+  s.add_runtime_dependency(%q<activesupport>.freeze, ["= 7.1.3".freeze])
+  s.add_runtime_dependency(%q<rackup>.freeze, [">= 1.0.0".freeze])
+  s.add_dependency(%q<thor>.freeze, ["~> 1.0".freeze, ">= 1.2.2".freeze])
+  s.add_development_dependency(%q<rspec>.freeze, [">= 0".freeze])
+end
+`
+
+const thorGemspec = `Gem::Specification.new do |s|
+  s.name = %q<thor>
+  s.version = "2.0.0.rc1"
+end
+`
+
+func TestGenerateRubyDeps(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	hdl := newFSHandle(t, "ruby3.3-railties", map[string]string{
+		"usr/lib/ruby/gems/3.3.0/specifications/railties-7.1.3.gemspec":         railtiesGemspec,
+		"usr/lib/ruby/gems/3.3.0/specifications/default/thor-2.0.0.rc1.gemspec": thorGemspec,
+		"usr/lib/ruby/gems/3.3.0/gems/railties-7.1.3/railties.gemspec":          railtiesGemspec,
+		"usr/lib/ruby/gems/3.3.0/cache/railties-7.1.3.gem":                      "",
+	})
+
+	got := config.Dependencies{}
+	if err := generateRubyDeps(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"ruby:thor", "ruby:railties=7.1.3"}, got.Provides); diff != "" {
+		t.Errorf("provides: (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ruby:activesupport", "ruby:rackup"}, got.Runtime); diff != "" {
+		t.Errorf("runtime: (-want, +got):\n%s", diff)
+	}
+}
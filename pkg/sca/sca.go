@@ -15,14 +15,13 @@
 package sca
 
 import (
-	"bytes"
 	"context"
-	"debug/elf"
 	"fmt"
 	"io"
 	"io/fs"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"unicode"
 
@@ -31,8 +30,10 @@ import (
 	"github.com/chainguard-dev/go-pkgconfig"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/elfindex"
 )
 
+// libDirs are the directories whose shared objects are provided by default.
 var libDirs = []string{"lib/", "usr/lib/", "lib64/", "usr/lib64/"}
 
 // SCAFS represents the minimum required filesystem accessors which are needed by
@@ -55,6 +56,10 @@ type SCAHandle interface {
 	// Version returns the version and epoch of the package being analyzed.
 	Version() string
 
+	// VersionForRelative returns the version and epoch of a given package
+	// name, which subpackages with their own version do not share.
+	VersionForRelative(pkgName string) string
+
 	// FilesystemForRelative returns a usable filesystem representing the package
 	// contents for a given package name.
 	FilesystemForRelative(pkgName string) (SCAFS, error)
@@ -63,6 +68,10 @@ type SCAHandle interface {
 	// It is equivalent to FilesystemForRelative(PackageName()).
 	Filesystem() (SCAFS, error)
 
+	// ELFIndexForRelative returns the index of the ELF files of the package
+	// contents for a given package name.
+	ELFIndexForRelative(pkgName string) (*elfindex.Index, error)
+
 	// Options returns a config.PackageOption struct.
 	Options() config.PackageOption
 
@@ -71,6 +80,50 @@ type SCAHandle interface {
 	BaseDependencies() config.Dependencies
 }
 
+// dependencySet adds each dependency to a generated set once, so that what
+// a generator keeps depends on the distinct dependencies it finds rather
+// than on the number of files it finds them in.
+type dependencySet struct {
+	generated *config.Dependencies
+	seen      map[string]struct{}
+}
+
+func newDependencySet(generated *config.Dependencies) *dependencySet {
+	s := &dependencySet{generated: generated, seen: map[string]struct{}{}}
+	for _, dep := range generated.Runtime {
+		s.seen["runtime:"+dep] = struct{}{}
+	}
+	for _, dep := range generated.Provides {
+		s.seen["provides:"+dep] = struct{}{}
+	}
+	for _, dep := range generated.Vendored {
+		s.seen["vendored:"+dep] = struct{}{}
+	}
+
+	return s
+}
+
+func (s *dependencySet) add(deps *[]string, kind, dep string) {
+	key := kind + ":" + dep
+	if _, ok := s.seen[key]; ok {
+		return
+	}
+	s.seen[key] = struct{}{}
+	*deps = append(*deps, dep)
+}
+
+func (s *dependencySet) runtime(dep string) {
+	s.add(&s.generated.Runtime, "runtime", dep)
+}
+
+func (s *dependencySet) provides(dep string) {
+	s.add(&s.generated.Provides, "provides", dep)
+}
+
+func (s *dependencySet) vendored(dep string) {
+	s.add(&s.generated.Vendored, "vendored", dep)
+}
+
 // DependencyGenerator takes an SCAHandle and config.Dependencies pointer and returns
 // findings based on analysis.
 type DependencyGenerator func(context.Context, SCAHandle, *config.Dependencies) error
@@ -85,8 +138,78 @@ func allowedPrefix(path string, prefixes []string) bool {
 	return false
 }
 
+// cmdPrefixes are the directories searched for commands by default.
 var cmdPrefixes = []string{"bin/", "sbin/", "usr/bin/", "usr/sbin/"}
 
+// commandPrefixes returns the directories of the package searched for
+// commands, as prefixes of its paths.
+func commandPrefixes(opts config.PackageOption) []string {
+	if len(opts.CommandPaths) == 0 {
+		return cmdPrefixes
+	}
+
+	prefixes := make([]string, 0, len(opts.CommandPaths))
+	for _, p := range opts.CommandPaths {
+		prefixes = append(prefixes, strings.TrimSuffix(p, "/")+"/")
+	}
+
+	return prefixes
+}
+
+// isExecutable returns whether mode is that of a file which everyone may
+// execute.
+func isExecutable(mode fs.FileMode) bool {
+	return mode.IsRegular() && mode.Perm()&0555 == 0555
+}
+
+// linkedCommands resolves the symlinks of a package which may be commands,
+// e.g. busybox applets and update-alternatives style links, through the
+// package and then the other packages of the build.
+type linkedCommands struct {
+	hdl       SCAHandle
+	links     packageLinks
+	relatives []packageLinks
+}
+
+// isExecutable returns whether the symlink p resolves to an executable file.
+func (lc *linkedCommands) isExecutable(p string) (bool, error) {
+	q, ok := lc.links.resolve(p)
+	if ok {
+		fi, err := lc.links.fsys.Stat(q)
+		return err == nil && isExecutable(fi.Mode()), nil
+	}
+	if q == "" {
+		return false, nil
+	}
+
+	if lc.relatives == nil {
+		lc.relatives = []packageLinks{}
+		for _, name := range lc.hdl.RelativeNames() {
+			if name == lc.hdl.PackageName() {
+				continue
+			}
+			rfs, err := lc.hdl.FilesystemForRelative(name)
+			if err != nil {
+				return false, err
+			}
+			rel, err := readPackageLinks(rfs)
+			if err != nil {
+				return false, err
+			}
+			lc.relatives = append(lc.relatives, rel)
+		}
+	}
+
+	for _, rel := range lc.relatives {
+		if r, ok := rel.resolve(q); ok {
+			fi, err := rel.fsys.Stat(r)
+			return err == nil && isExecutable(fi.Mode()), nil
+		}
+	}
+
+	return false, nil
+}
+
 func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
 	log := clog.FromContext(ctx)
 	if hdl.Options().NoCommands {
@@ -98,29 +221,45 @@ func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.
 	if err != nil {
 		return err
 	}
+	deps := newDependencySet(generated)
+	prefixes := commandPrefixes(hdl.Options())
+
+	links, err := readPackageLinks(fsys)
+	if err != nil {
+		return err
+	}
+	lc := &linkedCommands{hdl: hdl, links: links}
 
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if !allowedPrefix(path, prefixes) {
+			return nil
+		}
+
 		fi, err := d.Info()
 		if err != nil {
 			return err
 		}
 
 		mode := fi.Mode()
-		if !mode.IsRegular() {
-			return nil
-		}
-
-		if mode.Perm()&0555 == 0555 {
-			if allowedPrefix(path, cmdPrefixes) {
-				basename := filepath.Base(path)
-				log.Infof("  found command %s", path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("cmd:%s=%s", basename, hdl.Version()))
+		if mode&fs.ModeSymlink != 0 {
+			ok, err := lc.isExecutable(path)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
 			}
+			log.Infof("  found command %s -> %s", path, links.links[path])
+		} else if isExecutable(mode) {
+			log.Infof("  found command %s", path)
+		} else {
+			return nil
 		}
+		deps.provides(fmt.Sprintf("cmd:%s=%s", filepath.Base(path), hdl.Version()))
 
 		return nil
 	}); err != nil {
@@ -130,27 +269,97 @@ func generateCmdProviders(ctx context.Context, hdl SCAHandle, generated *config.
 	return nil
 }
 
-// findInterpreter looks for the PT_INTERP header and extracts the interpreter so that it
-// may be used as a dependency.
-func findInterpreter(bin *elf.File) (string, error) {
-	for _, prog := range bin.Progs {
-		if prog.Type != elf.PT_INTERP {
-			continue
+// libraryDirs returns the directories of the package whose shared objects
+// are provided, as prefixes of its paths.
+func libraryDirs(opts config.PackageOption) []string {
+	dirs := slices.Clone(libDirs)
+	for _, p := range opts.LibraryPaths {
+		dirs = append(dirs, strings.TrimSuffix(p, "/")+"/")
+	}
+
+	return dirs
+}
+
+// inLibraryDir returns whether the file p is right in one of the library
+// directories dirs.  Their subdirectories hold private libraries, e.g. the
+// plugins of a program, which are loaded through a RUNPATH or by path.
+func inLibraryDir(p string, dirs []string) bool {
+	return slices.Contains(dirs, filepath.Dir(p)+"/")
+}
+
+// isPrivateLibrary returns whether the package marks the shared object p as
+// private.
+func isPrivateLibrary(p string, opts config.PackageOption) bool {
+	for _, pattern := range opts.PrivateLibraries {
+		// The patterns were validated with the configuration.
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
 		}
+	}
 
-		reader := prog.Open()
-		interpBuf, err := io.ReadAll(reader)
-		if err != nil {
-			return "", err
+	return false
+}
+
+// runpathDir returns the directory of the package which the RUNPATH entry
+// of the file p names, or "" for entries outside of the package.
+func runpathDir(p, entry string) string {
+	origin := "/" + filepath.Dir(p)
+	entry = strings.NewReplacer("${ORIGIN}", origin, "$ORIGIN", origin).Replace(entry)
+	if !filepath.IsAbs(entry) {
+		return ""
+	}
+
+	return strings.TrimPrefix(filepath.Clean(entry), "/")
+}
+
+// runpathLibrary returns which of the packages of the build has the library
+// lib needed by ef in a directory of its RUNPATH other than the library
+// directories dirs, or "".
+func runpathLibrary(hdl SCAHandle, ef *elfindex.File, lib string, dirs []string) (string, error) {
+	for _, entry := range ef.RPath {
+		dir := runpathDir(ef.Path, entry)
+		if dir == "" || slices.Contains(dirs, dir+"/") {
+			continue
 		}
 
-		interpBuf = bytes.Trim(interpBuf, "\x00")
-		return string(interpBuf), nil
+		for _, name := range hdl.RelativeNames() {
+			fsys, err := hdl.FilesystemForRelative(name)
+			if err != nil {
+				return "", err
+			}
+			if _, err := fsys.Stat(filepath.Join(dir, lib)); err == nil {
+				return name, nil
+			}
+		}
 	}
 
 	return "", nil
 }
 
+// muslInterpreter matches the program interpreters of musl, which are
+// symlinks to its libc, e.g. ld-musl-x86_64.so.1 to libc.musl-x86_64.so.1.
+var muslInterpreter = regexp.MustCompile(`^ld-musl-([^.]+)\.so\.1$`)
+
+// interpreterDep returns the dependency on the program interpreter interp,
+// e.g. so:ld-linux-x86-64.so.2 for glibc, or so:ld-linux.so.2 for 32-bit x86
+// programs.  There is none for an interpreter which the package has itself,
+// or which is not an absolute path out of the workspace.
+func interpreterDep(fsys SCAFS, interp string) string {
+	if !filepath.IsAbs(interp) || strings.HasPrefix(interp, "/home/build/") {
+		return ""
+	}
+	if _, err := fsys.Stat(strings.TrimPrefix(interp, "/")); err == nil {
+		return ""
+	}
+
+	base := filepath.Base(interp)
+	if m := muslInterpreter.FindStringSubmatch(base); m != nil {
+		return fmt.Sprintf("so:libc.musl-%s.so.1", m[1])
+	}
+
+	return fmt.Sprintf("so:%s", base)
+}
+
 // dereferenceCrossPackageSymlink attempts to dereference a symlink across multiple package
 // directories.
 func dereferenceCrossPackageSymlink(hdl SCAHandle, path string) (string, string, error) {
@@ -174,7 +383,7 @@ func dereferenceCrossPackageSymlink(hdl SCAHandle, path string) (string, string,
 			return "", "", err
 		}
 
-		for _, libDir := range libDirs {
+		for _, libDir := range libraryDirs(hdl.Options()) {
 			testPath := filepath.Join(libDir, realPath)
 
 			if _, err := baseFS.Stat(testPath); err == nil {
@@ -190,11 +399,16 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 	log := clog.FromContext(ctx)
 	log.Infof("scanning for shared object dependencies...")
 
-	depends := map[string][]string{}
 	fsys, err := hdl.Filesystem()
 	if err != nil {
 		return err
 	}
+	index, err := hdl.ELFIndexForRelative(hdl.PackageName())
+	if err != nil {
+		return err
+	}
+	deps := newDependencySet(generated)
+	dirs := libraryDirs(hdl.Options())
 
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -219,41 +433,27 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 				return nil
 			}
 
-			targetFS, err := hdl.FilesystemForRelative(targetPkg)
-			if err != nil {
-				return nil
-			}
-
 			if realPath != "" {
-				rawFile, err := targetFS.Open(realPath)
+				targetIndex, err := hdl.ELFIndexForRelative(targetPkg)
 				if err != nil {
 					return nil
 				}
-				defer rawFile.Close()
-
-				seekableFile, ok := rawFile.(io.ReaderAt)
-				if !ok {
-					return nil
-				}
 
-				ef, err := elf.NewFile(seekableFile)
-				if err != nil {
+				ef := targetIndex.Get(realPath)
+				if ef == nil {
 					return nil
 				}
-				defer ef.Close()
 
-				sonames, err := ef.DynString(elf.DT_SONAME)
-				// most likely SONAME is not set on this object
-				if err != nil {
+				if len(ef.SONames) == 0 {
 					log.Warnf("library %s lacks SONAME", path)
 					return nil
 				}
 
-				for _, soname := range sonames {
+				for _, soname := range ef.SONames {
 					log.Infof("  found soname %s for %s", soname, path)
 
 					if !hdl.Options().NoDepends {
-						generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", soname))
+						deps.runtime(fmt.Sprintf("so:%s", soname))
 					}
 				}
 			}
@@ -272,51 +472,44 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 
 		basename := filepath.Base(path)
 
-		// most likely a shell script instead of an ELF, so treat any
-		// error as non-fatal.
-		rawFile, err := fsys.Open(path)
-		if err != nil {
+		// most likely a shell script instead of an ELF.
+		ef := index.Get(path)
+		if ef == nil {
 			return nil
 		}
-		defer rawFile.Close()
 
-		seekableFile, ok := rawFile.(io.ReaderAt)
-		if !ok {
-			return nil
-		}
-
-		ef, err := elf.NewFile(seekableFile)
-		if err != nil {
-			return nil
-		}
-		defer ef.Close()
-
-		interp, err := findInterpreter(ef)
-		if err != nil {
-			return err
-		}
+		interp := ef.Interpreter
 		if interp != "" && !hdl.Options().NoDepends {
-			log.Infof("interpreter for %s => %s", basename, interp)
+			log.Infof("interpreter for %s (%s %s) => %s", basename, ef.Class, ef.Machine, interp)
 
-			// musl interpreter is a symlink back to itself, so we want to use the non-symlink name as
-			// the dependency.
-			interpName := fmt.Sprintf("so:%s", filepath.Base(interp))
-			interpName = strings.ReplaceAll(interpName, "so:ld-musl", "so:libc.musl")
-			generated.Runtime = append(generated.Runtime, interpName)
-		}
-
-		libs, err := ef.ImportedLibraries()
-		if err != nil {
-			log.Warnf("WTF: ImportedLibraries() returned error: %v", err)
-			return nil
+			if dep := interpreterDep(fsys, interp); dep != "" {
+				deps.runtime(dep)
+			} else if !filepath.IsAbs(interp) || strings.HasPrefix(interp, "/home/build/") {
+				log.Warnf("%s has the interpreter %s, which is not in the filesystem it is installed to", path, interp)
+			}
 		}
 
 		if !hdl.Options().NoDepends {
-			for _, lib := range libs {
-				if strings.Contains(lib, ".so.") {
+			for _, lib := range ef.Needed {
+				if !strings.Contains(lib, ".so.") {
+					continue
+				}
+
+				// Libraries found through the RUNPATH in a private
+				// directory are not provided, so depend on their package.
+				pkg, err := runpathLibrary(hdl, ef, lib, dirs)
+				if err != nil {
+					return err
+				}
+				switch pkg {
+				case "":
 					log.Infof("  found lib %s for %s", lib, path)
-					generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", lib))
-					depends[lib] = append(depends[lib], path)
+					deps.runtime(fmt.Sprintf("so:%s", lib))
+				case hdl.PackageName():
+					log.Infof("  found private lib %s for %s", lib, path)
+				default:
+					log.Infof("  found private lib %s of %s for %s", lib, pkg, path)
+					deps.runtime(fmt.Sprintf("%s=%s", pkg, hdl.VersionForRelative(pkg)))
 				}
 			}
 		}
@@ -336,20 +529,13 @@ func generateSharedObjectNameDeps(ctx context.Context, hdl SCAHandle, generated
 		// As a rough heuristic, we assume that if the filename contains ".so.",
 		// it is meant to be used as a shared object.
 		if interp == "" || strings.Contains(basename, ".so.") {
-			sonames, err := ef.DynString(elf.DT_SONAME)
-			// most likely SONAME is not set on this object
-			if err != nil {
-				log.Warnf("library %s lacks SONAME", path)
-				return nil
-			}
-
-			for _, soname := range sonames {
+			for _, soname := range ef.SONames {
 				libver := sonameLibver(soname)
 
-				if allowedPrefix(path, libDirs) {
-					generated.Provides = append(generated.Provides, fmt.Sprintf("so:%s=%s", soname, libver))
+				if inLibraryDir(path, dirs) && !isPrivateLibrary(path, hdl.Options()) {
+					deps.provides(fmt.Sprintf("so:%s=%s", soname, libver))
 				} else {
-					generated.Vendored = append(generated.Vendored, fmt.Sprintf("so:%s=%s", soname, libver))
+					deps.vendored(fmt.Sprintf("so:%s=%s", soname, libver))
 				}
 			}
 		}
@@ -379,6 +565,7 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 	if err != nil {
 		return err
 	}
+	deps := newDependencySet(generated)
 
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -428,10 +615,10 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 		if !hdl.Options().NoProvides {
 			if allowedPrefix(path, pcDirs) {
 				log.Infof("  found pkg-config %s for %s", pcName, path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("pc:%s=%s", pcName, apkVersion))
+				deps.provides(fmt.Sprintf("pc:%s=%s", pcName, apkVersion))
 			} else {
 				log.Infof("  found vendored pkg-config %s for %s", pcName, path)
-				generated.Vendored = append(generated.Vendored, fmt.Sprintf("pc:%s=%s", pcName, apkVersion))
+				deps.vendored(fmt.Sprintf("pc:%s=%s", pcName, apkVersion))
 			}
 		}
 
@@ -440,17 +627,17 @@ func generatePkgConfigDeps(ctx context.Context, hdl SCAHandle, generated *config
 			// so much though for us.
 			for _, dep := range pkg.Requires {
 				log.Infof("  found pkg-config dependency (requires) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				deps.runtime(fmt.Sprintf("pc:%s", dep.Identifier))
 			}
 
 			for _, dep := range pkg.RequiresPrivate {
 				log.Infof("  found pkg-config dependency (requires private) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				deps.runtime(fmt.Sprintf("pc:%s", dep.Identifier))
 			}
 
 			for _, dep := range pkg.RequiresInternal {
 				log.Infof("  found pkg-config dependency (requires internal) %s for %s", dep.Identifier, path)
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				deps.runtime(fmt.Sprintf("pc:%s", dep.Identifier))
 			}
 		}
 
@@ -472,6 +659,7 @@ func generatePythonDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 	if err != nil {
 		return err
 	}
+	deps := newDependencySet(generated)
 
 	var pythonModuleVer string
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
@@ -523,7 +711,7 @@ func generatePythonDeps(ctx context.Context, hdl SCAHandle, generated *config.De
 	// We use the python3 name here instead of the python-3 name so that we can be
 	// compatible with Alpine and Adelie.  Only Wolfi provides the python-3 name.
 	log.Infof("  found python module, generating python3~%s dependency", pythonModuleVer)
-	generated.Runtime = append(generated.Runtime, fmt.Sprintf("python3~%s", pythonModuleVer))
+	deps.runtime(fmt.Sprintf("python3~%s", pythonModuleVer))
 
 	return nil
 }
@@ -546,24 +734,58 @@ func sonameLibver(soname string) string {
 	return libver
 }
 
-// Analyze runs the SCA analyzers on a given SCA handle, modifying the generated dependencies
-// set as needed.
-func Analyze(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+// Result holds the dependencies found by a single dependency generator.
+type Result struct {
+	// Generator is the name of the generator, e.g. "soname" or "cmd".
+	Generator string
+
+	// Dependencies holds the dependencies found by the generator.
+	Dependencies config.Dependencies
+}
+
+// AnalyzeResults runs the enabled dependency generators on a given SCA
+// handle in order, returning the findings of each generator separately.
+func AnalyzeResults(ctx context.Context, hdl SCAHandle) ([]Result, error) {
 	if hdl.Options().NoProvides {
-		return nil
-	}
-	generators := []DependencyGenerator{
-		generateSharedObjectNameDeps,
-		generateCmdProviders,
-		generatePkgConfigDeps,
-		generatePythonDeps,
+		return nil, nil
 	}
 
-	for _, gen := range generators {
-		if err := gen(ctx, hdl, generated); err != nil {
-			return err
+	gens := Generators()
+	results := make([]Result, 0, len(gens))
+	for _, g := range gens {
+		if g.Disabled || (g.Enabled != nil && !g.Enabled(hdl)) {
+			continue
+		}
+
+		res := Result{Generator: g.Name}
+		if err := g.Generate(ctx, hdl, &res.Dependencies); err != nil {
+			return nil, fmt.Errorf("%s dependency generator: %w", g.Name, err)
 		}
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// Analyze runs the SCA analyzers on a given SCA handle, modifying the generated dependencies
+// set as needed.
+func Analyze(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	results, err := AnalyzeResults(ctx, hdl)
+	if err != nil {
+		return err
 	}
 
+	MergeResults(results, generated)
+
 	return nil
 }
+
+// MergeResults appends the findings of each generator to the generated
+// dependencies set.
+func MergeResults(results []Result, generated *config.Dependencies) {
+	for _, res := range results {
+		generated.Runtime = append(generated.Runtime, res.Dependencies.Runtime...)
+		generated.Provides = append(generated.Provides, res.Dependencies.Provides...)
+		generated.Vendored = append(generated.Vendored, res.Dependencies.Vendored...)
+	}
+}
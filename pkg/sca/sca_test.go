@@ -17,16 +17,21 @@ package sca
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/elfindex"
 	"chainguard.dev/melange/pkg/util"
 	"github.com/chainguard-dev/clog/slogtest"
 	"github.com/chainguard-dev/go-apk/pkg/apk"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/google/go-cmp/cmp"
 	"gopkg.in/ini.v1"
 )
@@ -45,6 +50,10 @@ func (th *testHandle) Version() string {
 	return th.pkg.Version
 }
 
+func (th *testHandle) VersionForRelative(string) string {
+	return th.pkg.Version
+}
+
 func (th *testHandle) RelativeNames() []string {
 	// TODO: Support subpackages?
 	return []string{th.pkg.Origin}
@@ -62,6 +71,15 @@ func (th *testHandle) Filesystem() (SCAFS, error) {
 	return th.exp.TarFS, nil
 }
 
+func (th *testHandle) ELFIndexForRelative(pkgName string) (*elfindex.Index, error) {
+	fsys, err := th.FilesystemForRelative(pkgName)
+	if err != nil {
+		return nil, err
+	}
+
+	return elfindex.New(fsys)
+}
+
 func (th *testHandle) Options() config.PackageOption {
 	return th.cfg.Package.Options
 }
@@ -116,6 +134,85 @@ func handleFromApk(ctx context.Context, t *testing.T, apkfile, melangefile strin
 	}
 }
 
+// fsHandle is an SCAHandle of packages whose contents are in memory.
+type fsHandle struct {
+	name     string
+	packages map[string]apkofs.FullFS
+	options  config.PackageOption
+}
+
+func (h *fsHandle) PackageName() string { return h.name }
+
+func (h *fsHandle) Version() string { return "1.0-r0" }
+
+func (h *fsHandle) VersionForRelative(string) string { return "1.0-r0" }
+
+func (h *fsHandle) RelativeNames() []string {
+	names := []string{}
+	for name := range h.packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *fsHandle) FilesystemForRelative(pkgName string) (SCAFS, error) {
+	fsys, ok := h.packages[pkgName]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a relative of %s", pkgName, h.name)
+	}
+	return fsys, nil
+}
+
+func (h *fsHandle) Filesystem() (SCAFS, error) {
+	return h.FilesystemForRelative(h.name)
+}
+
+func (h *fsHandle) ELFIndexForRelative(pkgName string) (*elfindex.Index, error) {
+	fsys, err := h.FilesystemForRelative(pkgName)
+	if err != nil {
+		return nil, err
+	}
+	return elfindex.New(fsys)
+}
+
+func (h *fsHandle) Options() config.PackageOption { return h.options }
+
+func (h *fsHandle) BaseDependencies() config.Dependencies { return config.Dependencies{} }
+
+// fsys returns the contents of the package being analyzed.
+func (h *fsHandle) fsys() apkofs.FullFS { return h.packages[h.name] }
+
+// addPackage adds a relative package holding the files, with their path as
+// their contents, or the targets of symlinks for the paths mapped to "->
+// TARGET".
+func (h *fsHandle) addPackage(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	fsys := apkofs.NewMemFS()
+	for path, content := range files {
+		if err := fsys.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if target, ok := strings.CutPrefix(content, "-> "); ok {
+			if err := fsys.Symlink(target, path); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := fsys.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.packages[name] = fsys
+}
+
+func newFSHandle(t *testing.T, name string, files map[string]string) *fsHandle {
+	t.Helper()
+	h := &fsHandle{name: name, packages: map[string]apkofs.FullFS{}}
+	h.addPackage(t, name, files)
+	return h
+}
+
 func TestExecableSharedObjects(t *testing.T) {
 	ctx := slogtest.TestContextWithLogger(t)
 	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
@@ -216,3 +313,195 @@ func TestUnstableSonames(t *testing.T) {
 		t.Errorf("Analyze(): (-want, +got):\n%s", diff)
 	}
 }
+
+func TestAnalyzeResults(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "neon.yaml")
+	defer th.exp.Close()
+
+	results, err := AnalyzeResults(ctx, th)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]config.Dependencies{}
+	for _, res := range results {
+		got[res.Generator] = res.Dependencies
+	}
+
+	if diff := cmp.Diff([]string{"so:libcap.so.2=2", "so:libpsx.so.2=2"}, util.Dedup(got["soname"].Provides)); diff != "" {
+		t.Errorf("soname provides: (-want, +got):\n%s", diff)
+	}
+
+	if len(got["pkgconfig"].Provides) != 0 {
+		t.Errorf("pkgconfig provides: want none, got %v", got["pkgconfig"].Provides)
+	}
+}
+
+func TestGenerateCmdProviders(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	hdl := newFSHandle(t, "busybox", map[string]string{
+		"usr/bin/ls":                "-> ../../bin/busybox",
+		"usr/bin/vi":                "-> /usr/libexec/vim/vim",
+		"usr/bin/broken":            "-> missing",
+		"usr/bin/README":            "-> ../share/doc/busybox/README",
+		"usr/libexec/busybox/bin/x": "-> ../../../../bin/busybox",
+	})
+	hdl.addPackage(t, "vim", nil)
+	for pkg, files := range map[string]map[string]fs.FileMode{
+		"busybox": {
+			"bin/busybox":                  0o755,
+			"usr/share/doc/busybox/README": 0o644,
+			"usr/libexec/busybox/helper":   0o755,
+		},
+		"vim": {"usr/libexec/vim/vim": 0o755},
+	} {
+		for path, mode := range files {
+			if err := hdl.packages[pkg].MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := hdl.packages[pkg].WriteFile(path, []byte(path), mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	got := config.Dependencies{}
+	if err := generateCmdProviders(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cmd:busybox=1.0-r0", "cmd:ls=1.0-r0", "cmd:vi=1.0-r0"}
+	if diff := cmp.Diff(want, got.Provides); diff != "" {
+		t.Errorf("provides: (-want, +got):\n%s", diff)
+	}
+
+	hdl.options.CommandPaths = []string{"usr/libexec/busybox/bin"}
+	got = config.Dependencies{}
+	if err := generateCmdProviders(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"cmd:x=1.0-r0"}
+	if diff := cmp.Diff(want, got.Provides); diff != "" {
+		t.Errorf("provides: (-want, +got):\n%s", diff)
+	}
+}
+
+func TestLibraryDirectories(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	th := handleFromApk(ctx, t, "libcap-2.69-r0.apk", "libcap.yaml")
+	defer th.exp.Close()
+	lib, err := fs.ReadFile(th.exp.TarFS, "usr/lib/libcap.so.2.69")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdl := newFSHandle(t, "foo", nil)
+	for _, path := range []string{
+		"usr/lib/libcap.so.2.69",
+		"usr/lib64/libcap.so.2.69",
+		"usr/lib/foo/libcap.so.2.69",
+		"opt/foo/lib/libcap.so.2.69",
+		"usr/lib/libcap-internal.so.2.69",
+	} {
+		if err := hdl.fsys().MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := hdl.fsys().WriteFile(path, lib, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdl.options = config.PackageOption{
+		LibraryPaths:     []string{"opt/foo/lib"},
+		PrivateLibraries: []string{"usr/lib/libcap-internal.so.*"},
+	}
+
+	got := config.Dependencies{}
+	if err := generateSharedObjectNameDeps(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+	// Only the library in usr/lib/foo and the one marked private are not
+	// provided, as the sonames are all the same.
+	if diff := cmp.Diff([]string{"so:libcap.so.2=2"}, got.Provides); diff != "" {
+		t.Errorf("provides: (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"so:libcap.so.2=2"}, got.Vendored); diff != "" {
+		t.Errorf("vendored: (-want, +got):\n%s", diff)
+	}
+
+	opts := hdl.options
+	for path, want := range map[string]bool{
+		"usr/lib/libfoo.so.1":           true,
+		"usr/lib64/libfoo.so.1":         true,
+		"opt/foo/lib/libfoo.so.1":       true,
+		"usr/lib/foo/libfoo.so.1":       false,
+		"usr/libexec/foo/libfoo.so.1":   false,
+		"usr/lib/libcap-internal.so.2":  false,
+		"usr/lib/libcap-internal.so.2x": false,
+	} {
+		if got := inLibraryDir(path, libraryDirs(opts)) && !isPrivateLibrary(path, opts); got != want {
+			t.Errorf("%s provided = %t, want %t", path, got, want)
+		}
+	}
+}
+
+func TestRunpathLibrary(t *testing.T) {
+	for _, c := range []struct{ entry, want string }{
+		{"$ORIGIN/../lib/foo", "usr/lib/foo"},
+		{"${ORIGIN}", "usr/bin"},
+		{"/opt/foo/lib/", "opt/foo/lib"},
+		{"lib", ""},
+		{"/", ""},
+	} {
+		if got := runpathDir("usr/bin/foo", c.entry); got != c.want {
+			t.Errorf("runpathDir(%q) = %q, want %q", c.entry, got, c.want)
+		}
+	}
+
+	hdl := newFSHandle(t, "foo", map[string]string{
+		"usr/lib/foo/libfoo-private.so.1": "",
+		"usr/lib/libfoo.so.1":             "",
+	})
+	hdl.addPackage(t, "foo-libs", map[string]string{
+		"usr/lib/foo-libs/libfoo-util.so.1": "",
+	})
+
+	ef := &elfindex.File{Path: "usr/bin/foo", RPath: []string{"/usr/lib", "$ORIGIN/../lib/foo", "/usr/lib/foo-libs"}}
+	for lib, want := range map[string]string{
+		"libfoo-private.so.1": "foo",
+		"libfoo-util.so.1":    "foo-libs",
+		// The library directories are not private.
+		"libfoo.so.1": "",
+		"libc.so.6":   "",
+	} {
+		got, err := runpathLibrary(hdl, ef, lib, libDirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("runpathLibrary(%q) = %q, want %q", lib, got, want)
+		}
+	}
+}
+
+func TestInterpreterDep(t *testing.T) {
+	hdl := newFSHandle(t, "foo", map[string]string{
+		"opt/foo/lib/ld-foo.so.1": "",
+	})
+
+	for interp, want := range map[string]string{
+		"/lib64/ld-linux-x86-64.so.2":   "so:ld-linux-x86-64.so.2",
+		"/lib/ld-linux-aarch64.so.1":    "so:ld-linux-aarch64.so.1",
+		"/lib/ld-linux.so.2":            "so:ld-linux.so.2",
+		"/lib/ld-musl-x86_64.so.1":      "so:libc.musl-x86_64.so.1",
+		"/lib/ld-musl-armhf.so.1":       "so:libc.musl-armhf.so.1",
+		"/opt/foo/lib/ld-foo.so.1":      "",
+		"/home/build/lib/ld-linux.so.2": "",
+		"lib/ld-linux-x86-64.so.2":      "",
+		"/usr/glibc-compat/lib/ld.so.1": "so:ld.so.1",
+	} {
+		if got := interpreterDep(hdl.fsys(), interp); got != want {
+			t.Errorf("interpreterDep(%q) = %q, want %q", interp, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// shebangInterpreter returns the interpreter of a script from its shebang
+// line, e.g. usr/bin/python3 for #!/usr/bin/python3 and python3 for
+// #!/usr/bin/env python3, and "" if the line is not a shebang.
+func shebangInterpreter(line string) string {
+	line, ok := strings.CutPrefix(line, "#!")
+	if !ok {
+		return ""
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interp := strings.TrimPrefix(fields[0], "/")
+	if filepath.Base(interp) != "env" {
+		return interp
+	}
+
+	// env runs the first argument which is not an option or a variable,
+	// e.g. #!/usr/bin/env -S VAR=1 python3 -u.
+	for _, arg := range fields[1:] {
+		if strings.HasPrefix(arg, "-") || strings.Contains(arg, "=") {
+			continue
+		}
+		return arg
+	}
+
+	return interp
+}
+
+// generateShebangDeps generates cmd: runtime dependencies on the
+// interpreters of the executable scripts a package installs, when the
+// interpreter is a command, or is looked up with env.  Interpreters the
+// package installs itself are left out.
+func generateShebangDeps(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	log := clog.FromContext(ctx)
+	log.Infof("scanning for script interpreters...")
+
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		return err
+	}
+	deps := newDependencySet(generated)
+
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm()&0o111 == 0 {
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		line, _ := bufio.NewReaderSize(f, 256).ReadString('\n')
+		interp := shebangInterpreter(strings.TrimSpace(line))
+		if interp == "" {
+			return nil
+		}
+
+		if strings.Contains(interp, "/") {
+			if !allowedPrefix(interp, cmdPrefixes) {
+				return nil
+			}
+			if _, err := fsys.Stat(interp); err == nil {
+				return nil
+			}
+		} else {
+			for _, pfx := range cmdPrefixes {
+				if _, err := fsys.Stat(pfx + interp); err == nil {
+					return nil
+				}
+			}
+		}
+
+		log.Infof("  found interpreter %s for %s", interp, path)
+		deps.runtime(fmt.Sprintf("cmd:%s", filepath.Base(interp)))
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestShebangInterpreter(t *testing.T) {
+	for line, want := range map[string]string{
+		"#!/usr/bin/python3":                  "usr/bin/python3",
+		"#! /bin/bash -e":                     "bin/bash",
+		"#!/usr/bin/env python3":              "python3",
+		"#!/usr/bin/env -S VAR=1 perl -w":     "perl",
+		"#!/usr/bin/env":                      "usr/bin/env",
+		"#!":                                  "",
+		"# comment":                           "",
+		"\x7fELF\x02\x01\x01\x00\x00\x00\x00": "",
+	} {
+		if got := shebangInterpreter(line); got != want {
+			t.Errorf("shebangInterpreter(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestGenerateShebangDeps(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	hdl := newFSHandle(t, "hello", nil)
+	for path, script := range map[string]string{
+		"usr/bin/hello-py":             "#!/usr/bin/python3\nprint('hello')\n",
+		"usr/bin/hello-sh":             "#!/bin/bash\necho hello\n",
+		"usr/bin/hello-env":            "#!/usr/bin/env ruby\nputs 'hello'\n",
+		"usr/bin/hello-own":            "#!/usr/bin/hello\n",
+		"usr/bin/hello":                "\x7fELF",
+		"usr/libexec/hello/helper":     "#!/opt/hello/bin/interp\n",
+		"usr/share/hello/not-a-script": "#!/usr/bin/perl\n",
+	} {
+		mode := 0o755
+		if path == "usr/share/hello/not-a-script" {
+			mode = 0o644
+		}
+		if err := hdl.fsys().MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := hdl.fsys().WriteFile(path, []byte(script), fs.FileMode(mode)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := config.Dependencies{}
+	if err := generateShebangDeps(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"cmd:ruby", "cmd:python3", "cmd:bash"}, got.Runtime); diff != "" {
+		t.Errorf("runtime: (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// maxSymlinks is how many symlinks are followed to resolve a path.
+const maxSymlinks = 40
+
+// packageLinks holds the symlinks of a package, mapped to their targets.
+// Only the symlinks are kept, so that the memory used does not grow with the
+// number of files of the package.
+type packageLinks struct {
+	fsys  SCAFS
+	links map[string]string
+}
+
+func readPackageLinks(fsys SCAFS) (packageLinks, error) {
+	pl := packageLinks{fsys: fsys, links: map[string]string{}}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := fsys.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			target = "."
+		}
+		pl.links[p] = target
+		return nil
+	}); err != nil {
+		return packageLinks{}, err
+	}
+
+	return pl, nil
+}
+
+// firstLink returns the first component of p which is a symlink, or "".
+func (pl packageLinks) firstLink(p string) string {
+	for i := 0; i <= len(p); i++ {
+		if i == len(p) || p[i] == '/' {
+			if _, ok := pl.links[p[:i]]; ok {
+				return p[:i]
+			}
+		}
+	}
+	return ""
+}
+
+// resolve follows the symlinks of p through the package.  It returns the
+// path it resolves to and true if that is a file of the package, or the path
+// which is not in the package and false.  A symlink loop or a path above the
+// root resolves to "".
+func (pl packageLinks) resolve(p string) (string, bool) {
+	for i := 0; i < maxSymlinks; i++ {
+		link := pl.firstLink(p)
+		if link == "" {
+			// No component of p is a symlink, so stat does not follow any.
+			_, err := pl.fsys.Stat(p)
+			return p, err == nil
+		}
+
+		target := pl.links[link]
+		var q string
+		if path.IsAbs(target) {
+			q = path.Clean(strings.TrimPrefix(target, "/"))
+		} else {
+			q = path.Join(path.Dir(link), target)
+		}
+		if q == ".." || strings.HasPrefix(q, "../") {
+			return "", false
+		}
+		if rest := strings.TrimPrefix(p, link); rest != "" {
+			q = path.Join(q, rest)
+		}
+		p = q
+	}
+
+	return "", false
+}
+
+// generateSymlinkDeps generates runtime dependencies on the packages of the
+// build which ship the targets of the symlinks of a package, e.g. a -dev
+// subpackage linking to a file of the main package.  The symlinks whose
+// targets no package of the build ships are logged, as they dangle unless a
+// dependency of the package ships their target.
+func generateSymlinkDeps(ctx context.Context, hdl SCAHandle, generated *config.Dependencies) error {
+	log := clog.FromContext(ctx)
+	log.Infof("scanning for symlinks to other packages...")
+
+	fsys, err := hdl.Filesystem()
+	if err != nil {
+		return err
+	}
+	deps := newDependencySet(generated)
+
+	links, err := readPackageLinks(fsys)
+	if err != nil {
+		return err
+	}
+
+	// outside maps the symlinks whose targets are not in the package to the
+	// path they leave the package at.
+	outside := map[string]string{}
+	for p := range links.links {
+		if q, ok := links.resolve(p); !ok {
+			outside[p] = q
+		}
+	}
+	if len(outside) == 0 {
+		return nil
+	}
+
+	relatives := map[string]packageLinks{}
+	for _, name := range hdl.RelativeNames() {
+		if name == hdl.PackageName() {
+			continue
+		}
+		rfs, err := hdl.FilesystemForRelative(name)
+		if err != nil {
+			return err
+		}
+		if relatives[name], err = readPackageLinks(rfs); err != nil {
+			return err
+		}
+	}
+
+	paths := make([]string, 0, len(outside))
+	for p := range outside {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		found := false
+		if q := outside[p]; q != "" {
+			for _, name := range hdl.RelativeNames() {
+				rel, ok := relatives[name]
+				if !ok {
+					continue
+				}
+				if _, ok := rel.resolve(q); ok {
+					log.Infof("  found symlink %s to %s of %s", p, q, name)
+					deps.runtime(fmt.Sprintf("%s=%s", name, hdl.VersionForRelative(name)))
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			log.Infof("  %s points at %s, which no package of the build ships: a runtime dependency must ship it", p, links.links[p])
+		}
+	}
+
+	return nil
+}
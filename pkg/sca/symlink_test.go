@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sca
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-cmp/cmp"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestGenerateSymlinkDeps(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	hdl := newFSHandle(t, "hello-dev", map[string]string{
+		"usr/include/hello.h":       "",
+		"usr/include/hello-local.h": "-> hello.h",
+		"usr/lib/libhello.so":       "-> libhello.so.1",
+		"usr/share/hello/data":      "-> /usr/share/hello-data/data",
+		"usr/bin/hello-config":      "-> ../libexec/hello/config",
+		"usr/share/hello/loop":      "-> loop",
+		"usr/share/hello/missing":   "-> /opt/missing",
+	})
+	hdl.addPackage(t, "hello", map[string]string{
+		"usr/lib/libhello.so.1":     "-> libhello.so.1.2.3",
+		"usr/lib/libhello.so.1.2.3": "",
+	})
+	hdl.addPackage(t, "hello-data", map[string]string{
+		"usr/share/hello-data/data": "",
+	})
+	hdl.addPackage(t, "hello-libexec", map[string]string{
+		"usr/libexec/hello/config": "",
+	})
+
+	got := config.Dependencies{}
+	if err := generateSymlinkDeps(ctx, hdl, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"hello-libexec=1.0-r0", "hello=1.0-r0", "hello-data=1.0-r0"}
+	if diff := cmp.Diff(want, got.Runtime); diff != "" {
+		t.Errorf("runtime: (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPackageLinksResolve(t *testing.T) {
+	hdl := newFSHandle(t, "hello", map[string]string{
+		"usr/bin/foo":     "",
+		"usr/bin/bar":     "-> foo",
+		"usr/bin/baz":     "-> /usr/bin/bar",
+		"usr/bin/up":      "-> ../../../etc/foo",
+		"usr/bin/loop":    "-> loop",
+		"usr/bin/outside": "-> ../lib/foo",
+		"usr/sbin":        "-> bin",
+		"usr/local":       "-> /opt/local",
+	})
+	links, err := readPackageLinks(hdl.fsys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]struct {
+		path string
+		ok   bool
+	}{
+		"usr/bin/baz":       {"usr/bin/foo", true},
+		"usr/bin/up":        {"", false},
+		"usr/bin/loop":      {"", false},
+		"usr/bin/outside":   {"usr/lib/foo", false},
+		"usr/sbin/baz":      {"usr/bin/foo", true},
+		"usr/local/bin/foo": {"opt/local/bin/foo", false},
+	} {
+		got, ok := links.resolve(p)
+		if got != want.path || ok != want.ok {
+			t.Errorf("resolve(%q) = %q, %v, want %q, %v", p, got, ok, want.path, want.ok)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scan runs vulnerability scanners over the build environment and
+// the packages of a build.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// The scanners which may be run.
+const (
+	ToolGrype = "grype"
+	ToolTrivy = "trivy"
+)
+
+// The severities of findings, from the least to the most severe.
+const (
+	SeverityUnknown    = "unknown"
+	SeverityNegligible = "negligible"
+	SeverityLow        = "low"
+	SeverityMedium     = "medium"
+	SeverityHigh       = "high"
+	SeverityCritical   = "critical"
+)
+
+var severities = []string{SeverityUnknown, SeverityNegligible, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
+
+// ValidateSeverity checks that severity is one of the severities of
+// findings.
+func ValidateSeverity(severity string) error {
+	if !slices.Contains(severities, severity) {
+		return fmt.Errorf("severity %q must be one of %s", severity, strings.Join(severities, ", "))
+	}
+
+	return nil
+}
+
+// Finding is a vulnerability found by a scanner.
+type Finding struct {
+	// The identifier of the vulnerability, e.g. CVE-2024-1234
+	ID string `json:"id" yaml:"id"`
+	// The name of the vulnerable package
+	Package string `json:"package" yaml:"package"`
+	// The version of the vulnerable package
+	Version string `json:"version" yaml:"version"`
+	// The severity of the vulnerability, e.g. high
+	Severity string `json:"severity" yaml:"severity"`
+	// The version which fixes the vulnerability, if there is one
+	FixedIn string `json:"fixed-in,omitempty" yaml:"fixed-in,omitempty"`
+}
+
+// AtLeast returns whether the finding is at least as severe as severity.
+func (f Finding) AtLeast(severity string) bool {
+	return slices.Index(severities, f.Severity) >= slices.Index(severities, severity)
+}
+
+func (f Finding) String() string {
+	s := fmt.Sprintf("%s (%s) in %s-%s", f.ID, f.Severity, f.Package, f.Version)
+	if f.FixedIn != "" {
+		s += ", fixed in " + f.FixedIn
+	}
+	return s
+}
+
+// Scanner runs a vulnerability scanner.
+type Scanner struct {
+	// The scanner which is run, grype or trivy
+	Tool string
+	// The path of its executable
+	Path string
+}
+
+// New returns a Scanner running tool, which is looked up in $PATH.
+func New(tool string) (*Scanner, error) {
+	if tool != ToolGrype && tool != ToolTrivy {
+		return nil, fmt.Errorf("scanner %q must be %s or %s", tool, ToolGrype, ToolTrivy)
+	}
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, fmt.Errorf("finding scanner %s: %w", tool, err)
+	}
+
+	return &Scanner{Tool: tool, Path: path}, nil
+}
+
+// ScanDir scans the root filesystem at dir, such as the build environment.
+func (s *Scanner) ScanDir(ctx context.Context, dir string) ([]Finding, error) {
+	if s.Tool == ToolGrype {
+		return s.run(ctx, "dir:"+dir, "-o", "json", "-q")
+	}
+	return s.run(ctx, "rootfs", "--format", "json", "--quiet", dir)
+}
+
+// ScanSBOM scans the packages of the SPDX document at path, such as the
+// SBOM of a package.
+func (s *Scanner) ScanSBOM(ctx context.Context, path string) ([]Finding, error) {
+	if s.Tool == ToolGrype {
+		return s.run(ctx, "sbom:"+path, "-o", "json", "-q")
+	}
+	return s.run(ctx, "sbom", "--format", "json", "--quiet", path)
+}
+
+// run runs the scanner with args and parses its report.
+func (s *Scanner) run(ctx context.Context, args ...string) ([]Finding, error) {
+	log := clog.FromContext(ctx)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("running %s %s", s.Tool, strings.Join(args, " "))
+	err := cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != "" {
+			log.Infof("%s: %s", s.Tool, line)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", s.Tool, err)
+	}
+
+	var findings []Finding
+	if s.Tool == ToolGrype {
+		findings, err = parseGrype(stdout.Bytes())
+	} else {
+		findings, err = parseTrivy(stdout.Bytes())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding the report of %s: %w", s.Tool, err)
+	}
+
+	return dedupe(findings), nil
+}
+
+// grypeReport is the part of the JSON report of grype which is read.
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+			Fix      struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+}
+
+func parseGrype(data []byte) ([]Finding, error) {
+	report := grypeReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+	for _, m := range report.Matches {
+		findings = append(findings, Finding{
+			ID:       m.Vulnerability.ID,
+			Package:  m.Artifact.Name,
+			Version:  m.Artifact.Version,
+			Severity: normalizeSeverity(m.Vulnerability.Severity),
+			FixedIn:  strings.Join(m.Vulnerability.Fix.Versions, ", "),
+		})
+	}
+
+	return findings, nil
+}
+
+// trivyReport is the part of the JSON report of trivy which is read.
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func parseTrivy(data []byte) ([]Finding, error) {
+	report := trivyReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	findings := []Finding{}
+	for _, r := range report.Results {
+		for _, v := range r.Vulnerabilities {
+			findings = append(findings, Finding{
+				ID:       v.VulnerabilityID,
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				Severity: normalizeSeverity(v.Severity),
+				FixedIn:  v.FixedVersion,
+			})
+		}
+	}
+
+	return findings, nil
+}
+
+// normalizeSeverity maps the severities of the scanners, e.g. HIGH or
+// High, to the ones of findings.
+func normalizeSeverity(severity string) string {
+	severity = strings.ToLower(severity)
+	if !slices.Contains(severities, severity) {
+		return SeverityUnknown
+	}
+	return severity
+}
+
+// dedupe sorts findings, from the most severe, and drops those reported
+// more than once, as scanners do for a package matched several ways.
+func dedupe(findings []Finding) []Finding {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Severity != b.Severity {
+			return slices.Index(severities, a.Severity) > slices.Index(severities, b.Severity)
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.ID < b.ID
+	})
+
+	return slices.CompactFunc(findings, func(a, b Finding) bool {
+		return a.ID == b.ID && a.Package == b.Package && a.Version == b.Version
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+const grypeJSON = `{
+  "matches": [
+    {
+      "vulnerability": {"id": "CVE-2024-0002", "severity": "Medium", "fix": {"versions": []}},
+      "artifact": {"name": "openssl", "version": "3.1.4-r0"}
+    },
+    {
+      "vulnerability": {"id": "CVE-2024-0001", "severity": "Critical", "fix": {"versions": ["1.2.3-r1"]}},
+      "artifact": {"name": "zlib", "version": "1.2.3-r0"}
+    },
+    {
+      "vulnerability": {"id": "CVE-2024-0001", "severity": "Critical", "fix": {"versions": ["1.2.3-r1"]}},
+      "artifact": {"name": "zlib", "version": "1.2.3-r0"}
+    }
+  ]
+}`
+
+const trivyJSON = `{
+  "Results": [
+    {"Vulnerabilities": [
+      {"VulnerabilityID": "CVE-2024-0003", "PkgName": "busybox", "InstalledVersion": "1.36.1-r0", "Severity": "LOW"}
+    ]},
+    {"Vulnerabilities": [
+      {"VulnerabilityID": "CVE-2024-0004", "PkgName": "curl", "InstalledVersion": "8.5.0-r0", "FixedVersion": "8.6.0-r0", "Severity": "HIGH"},
+      {"VulnerabilityID": "CVE-2024-0005", "PkgName": "curl", "InstalledVersion": "8.5.0-r0", "Severity": "WHATEVER"}
+    ]}
+  ]
+}`
+
+// fakeScanner returns a Scanner running a script which prints report and
+// records its arguments in args.
+func fakeScanner(t *testing.T, tool, report string) (s *Scanner, args string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	args = filepath.Join(dir, "args")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "report.json"), []byte(report), 0o644))
+
+	path := filepath.Join(dir, tool)
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\ncat " + filepath.Join(dir, "report.json") + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o755))
+
+	return &Scanner{Tool: tool, Path: path}, args
+}
+
+func TestScanGrype(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	s, args := fakeScanner(t, ToolGrype, grypeJSON)
+
+	findings, err := s.ScanDir(ctx, "/guest")
+	require.NoError(t, err)
+	require.Equal(t, []Finding{
+		{ID: "CVE-2024-0001", Package: "zlib", Version: "1.2.3-r0", Severity: SeverityCritical, FixedIn: "1.2.3-r1"},
+		{ID: "CVE-2024-0002", Package: "openssl", Version: "3.1.4-r0", Severity: SeverityMedium},
+	}, findings)
+
+	data, err := os.ReadFile(args)
+	require.NoError(t, err)
+	require.Equal(t, "dir:/guest -o json -q\n", string(data))
+
+	_, err = s.ScanSBOM(ctx, "/sbom.spdx.json")
+	require.NoError(t, err)
+	data, err = os.ReadFile(args)
+	require.NoError(t, err)
+	require.Equal(t, "sbom:/sbom.spdx.json -o json -q\n", string(data))
+}
+
+func TestScanTrivy(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	s, args := fakeScanner(t, ToolTrivy, trivyJSON)
+
+	findings, err := s.ScanSBOM(ctx, "/sbom.spdx.json")
+	require.NoError(t, err)
+	require.Equal(t, []Finding{
+		{ID: "CVE-2024-0004", Package: "curl", Version: "8.5.0-r0", Severity: SeverityHigh, FixedIn: "8.6.0-r0"},
+		{ID: "CVE-2024-0003", Package: "busybox", Version: "1.36.1-r0", Severity: SeverityLow},
+		{ID: "CVE-2024-0005", Package: "curl", Version: "8.5.0-r0", Severity: SeverityUnknown},
+	}, findings)
+
+	data, err := os.ReadFile(args)
+	require.NoError(t, err)
+	require.Equal(t, "sbom --format json --quiet /sbom.spdx.json\n", string(data))
+}
+
+func TestScanFailure(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	s, _ := fakeScanner(t, ToolGrype, "not json")
+
+	_, err := s.ScanDir(ctx, "/guest")
+	require.ErrorContains(t, err, "decoding the report of grype")
+
+	s.Path = filepath.Join(t.TempDir(), "missing")
+	_, err = s.ScanDir(ctx, "/guest")
+	require.ErrorContains(t, err, "running grype")
+}
+
+func TestSeverity(t *testing.T) {
+	f := Finding{ID: "CVE-2024-0001", Package: "zlib", Version: "1.2.3-r0", Severity: SeverityHigh, FixedIn: "1.2.3-r1"}
+	require.True(t, f.AtLeast(SeverityMedium))
+	require.True(t, f.AtLeast(SeverityHigh))
+	require.False(t, f.AtLeast(SeverityCritical))
+	require.Equal(t, "CVE-2024-0001 (high) in zlib-1.2.3-r0, fixed in 1.2.3-r1", f.String())
+
+	require.NoError(t, ValidateSeverity(SeverityNegligible))
+	require.ErrorContains(t, ValidateSeverity("severe"), `severity "severe" must be one of unknown, negligible, low, medium, high, critical`)
+
+	_, err := New("clair")
+	require.ErrorContains(t, err, `scanner "clair" must be grype or trivy`)
+}
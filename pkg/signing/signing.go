@@ -0,0 +1,231 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signing replaces the signatures of existing packages and indexes,
+// so that the key of a repository can be rotated without rebuilding it.
+//
+// The signature of an apk or an APKINDEX.tar.gz is a gzip stream prepended
+// to the signed data, so it is replaced by dropping the leading signature
+// streams and prepending a new one.  The checksum of a package in its index
+// is the hash of its control section, which is left untouched, so the index
+// of a repository stays valid when its packages are re-signed.
+package signing
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/build"
+)
+
+const indexName = "APKINDEX.tar.gz"
+
+// Package replaces the signature of the apk at path with one made with the
+// key.  The signature keeps the timestamp of the .PKGINFO of the package,
+// so that re-signing a package with the same key reproduces it.
+func Package(ctx context.Context, path, keyFile, passphrase string) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "signing.Package")
+	defer span.End()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return fmt.Errorf("expanding %s: %w", path, err)
+	}
+	defer exp.Close()
+
+	control, err := os.ReadFile(exp.ControlFile)
+	if err != nil {
+		return err
+	}
+
+	mtime, err := pkginfoTime(control)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	signer := build.KeyApkSigner{KeyFile: keyFile, KeyPassphrase: passphrase}
+	sig, err := build.EmitSignature(ctx, signer, control, mtime)
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", path, err)
+	}
+
+	data, err := os.Open(exp.PackageFile)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	return replaceFile(path, bytes.NewReader(sig), bytes.NewReader(control), data)
+}
+
+// pkginfoTime returns the timestamp of the .PKGINFO entry of the control
+// section of a package, which is the one its signature was made with.
+func pkginfoTime(control []byte) (time.Time, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(control))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return time.Time{}, errors.New("the control section has no .PKGINFO")
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		if hdr.Name == ".PKGINFO" {
+			return hdr.ModTime, nil
+		}
+	}
+}
+
+// Index replaces the signatures of the APKINDEX.tar.gz at path with one made
+// with the key.
+func Index(ctx context.Context, path, keyFile, passphrase string) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "signing.Index")
+	defer span.End()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	unsigned, err := stripSignatures(data)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	// The signature of an index is made over the whole index, like the one
+	// of a package is made over its control section.
+	signer := build.KeyApkSigner{KeyFile: keyFile, KeyPassphrase: passphrase}
+	sig, err := build.EmitSignature(ctx, signer, unsigned, time.Unix(0, 0))
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", path, err)
+	}
+
+	return replaceFile(path, bytes.NewReader(sig), bytes.NewReader(unsigned))
+}
+
+// stripSignatures drops the leading signature streams of an index.
+func stripSignatures(data []byte) ([]byte, error) {
+	for {
+		stream, err := apk.ReadSignatureStream(bytes.NewReader(data))
+		if errors.Is(err, apk.ErrNotSigned) {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data = data[stream.Length:]
+	}
+}
+
+// replaceFile replaces path with the concatenation of the readers, through
+// a temporary file so that path is never partially written.
+func replaceFile(path string, parts ...io.Reader) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	for _, part := range parts {
+		if _, err := io.Copy(out, part); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Chmod(fi.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), path)
+}
+
+// Result lists the files which were re-signed in a repository.
+type Result struct {
+	Packages []string
+	Index    string
+}
+
+// Repository re-signs every apk in dir with the key, then its index if it
+// has one.
+func Repository(ctx context.Context, dir, keyFile, passphrase string) (*Result, error) {
+	log := clog.FromContext(ctx)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{Packages: []string{}}
+	for _, ent := range entries {
+		if ent.IsDir() || !strings.HasSuffix(ent.Name(), ".apk") {
+			continue
+		}
+
+		path := filepath.Join(dir, ent.Name())
+		if err := Package(ctx, path, keyFile, passphrase); err != nil {
+			return nil, err
+		}
+		log.Debugf("re-signed %s", path)
+		res.Packages = append(res.Packages, ent.Name())
+	}
+	sort.Strings(res.Packages)
+
+	path := filepath.Join(dir, indexName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := Index(ctx, path, keyFile, passphrase); err != nil {
+		return nil, err
+	}
+	res.Index = indexName
+
+	return res, nil
+}
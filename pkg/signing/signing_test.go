@@ -0,0 +1,161 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/apk"
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/verify"
+)
+
+func writeKeypair(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	privPath := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), 0o600))
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	pubPath := privPath + ".pub"
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0o644))
+
+	return privPath, pubPath
+}
+
+func TestRepository(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+	keys := t.TempDir()
+	oldPriv, oldPub := writeKeypair(t, keys, "old.rsa")
+	newPriv, newPub := writeKeypair(t, keys, "new.rsa")
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	apkPath := filepath.Join(dir, "libcap-2.69-r0.apk")
+	require.NoError(t, os.WriteFile(apkPath, data, 0o644))
+	require.NoError(t, Package(ctx, apkPath, oldPriv, ""))
+
+	idx, err := index.New(
+		index.WithPackageDir(dir),
+		index.WithIndexFile(filepath.Join(dir, indexName)),
+		index.WithSigningKey(oldPriv),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	// Re-signing twice leaves a single signature.
+	for i := 0; i < 2; i++ {
+		res, err := Repository(ctx, dir, newPriv, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"libcap-2.69-r0.apk"}, res.Packages)
+		require.Equal(t, indexName, res.Index)
+	}
+
+	k, err := verify.LoadKeys([]string{newPub})
+	require.NoError(t, err)
+	r, err := verify.Repository(ctx, dir, verify.WithKeys(k))
+	require.NoError(t, err)
+	require.Equal(t, "new.rsa.pub", r.IndexKey)
+	for _, f := range r.Findings {
+		require.NotEqual(t, verify.CheckIndexSignature, f.Check, f.Message)
+		require.NotEqual(t, verify.CheckPackageSignature, f.Check, f.Message)
+		// The index entry still matches the package.
+		require.NotEqual(t, verify.CheckChecksum, f.Check, f.Message)
+	}
+
+	k, err = verify.LoadKeys([]string{oldPub})
+	require.NoError(t, err)
+	idxData, err := os.ReadFile(filepath.Join(dir, indexName))
+	require.NoError(t, err)
+	_, err = verify.IndexSignature(idxData, k)
+	require.ErrorContains(t, err, "no key found")
+
+	unsigned, err := stripSignatures(idxData)
+	require.NoError(t, err)
+	_, err = apk.ReadSignatureStream(bytes.NewReader(unsigned))
+	require.ErrorIs(t, err, apk.ErrNotSigned)
+}
+
+func TestPackage_reproducible(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	priv, _ := writeKeypair(t, t.TempDir(), "melange.rsa")
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+
+	// Re-signing with the same key gives the same package, whenever it is
+	// done, as the signature has the timestamp of the .PKGINFO.
+	signed := [][]byte{}
+	for i := 0; i < 2; i++ {
+		apkPath := filepath.Join(t.TempDir(), "libcap-2.69-r0.apk")
+		require.NoError(t, os.WriteFile(apkPath, data, 0o644))
+		require.NoError(t, Package(ctx, apkPath, priv, ""))
+		out, err := os.ReadFile(apkPath)
+		require.NoError(t, err)
+		signed = append(signed, out)
+		time.Sleep(1100 * time.Millisecond)
+	}
+	require.Equal(t, signed[0], signed[1])
+
+	stream, err := apk.ReadSignatureStream(bytes.NewReader(signed[0]))
+	require.NoError(t, err)
+	require.Len(t, stream.Signatures, 1)
+	n := stream.Length
+	gr, err := gzip.NewReader(bytes.NewReader(signed[0][:n]))
+	require.NoError(t, err)
+	hdr, err := tar.NewReader(gr).Next()
+	require.NoError(t, err)
+
+	// The control section follows the signature.
+	want, err := pkginfoTime(signed[0][n:])
+	require.NoError(t, err)
+	require.False(t, want.IsZero())
+	require.True(t, want.Equal(hdr.ModTime), "%v != %v", want, hdr.ModTime)
+}
+
+func TestRepository_noIndex(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	priv, _ := writeKeypair(t, t.TempDir(), "melange.rsa")
+
+	res, err := Repository(ctx, t.TempDir(), priv, "")
+	require.NoError(t, err)
+	require.Empty(t, res.Packages)
+	require.Empty(t, res.Index)
+}
@@ -0,0 +1,421 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package upstream finds the latest upstream version of a package, from the
+// update block of its configuration.
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// The sources of upstream versions.
+const (
+	SourceReleaseMonitor = "release-monitor"
+	SourceGitHub         = "github"
+	SourceGit            = "git"
+)
+
+// Result is the outcome of checking a package for a newer upstream version.
+type Result struct {
+	Package string `json:"package"`
+	Current string `json:"current"`
+	// The latest upstream version, if one was found
+	Latest string `json:"latest,omitempty"`
+	// Where the latest version comes from: release-monitor, github or git
+	Source string `json:"source,omitempty"`
+	// Whether the latest version is newer than the current one
+	UpdateAvailable bool `json:"update-available"`
+	// Whether the package is updated by hand
+	Manual bool `json:"manual,omitempty"`
+	// Why the package could not be checked
+	Error string `json:"error,omitempty"`
+}
+
+// Checker finds upstream versions.  The zero value uses the public APIs.
+type Checker struct {
+	// The HTTP client, which defaults to http.DefaultClient
+	Client *http.Client
+	// The base URL of release-monitoring.org
+	ReleaseMonitorURL string
+	// The base URL of the GitHub API
+	GitHubURL string
+	// The token to authenticate to the GitHub API with, which defaults to
+	// $GITHUB_TOKEN
+	GitHubToken string
+}
+
+// ErrNotMonitored is returned for configurations whose update block does
+// not say how to find their upstream versions.
+var ErrNotMonitored = errors.New("the update block has no release-monitor, github or git configuration")
+
+// Check finds the latest upstream version of the package of cfg, once the
+// prefixes, suffixes, separators and transforms of the update block are
+// applied to the upstream versions.  Updates which are disabled are not
+// checked.
+func (c *Checker) Check(ctx context.Context, cfg *config.Configuration) (*Result, error) {
+	res := &Result{
+		Package: cfg.Package.Name,
+		Current: cfg.Package.Version,
+		Manual:  cfg.Update.Manual,
+	}
+
+	if !cfg.Update.Enabled {
+		return res, nil
+	}
+
+	var versions []string
+	var err error
+	u := cfg.Update
+	switch {
+	case u.ReleaseMonitor != nil:
+		res.Source = SourceReleaseMonitor
+		versions, err = c.releaseMonitorVersions(ctx, u.ReleaseMonitor.Identifier)
+		versions = strip(versions, u.ReleaseMonitor.StripPrefix, u.ReleaseMonitor.StripSuffix)
+	case u.GitHubMonitor != nil:
+		res.Source = SourceGitHub
+		versions, err = c.gitHubVersions(ctx, u.GitHubMonitor)
+		versions = strip(versions, u.GitHubMonitor.StripPrefix, u.GitHubMonitor.StripSuffix)
+	case u.GitMonitor != nil:
+		res.Source = SourceGit
+		versions, err = gitVersions(ctx, cfg, u.GitMonitor)
+		versions = strip(versions, u.GitMonitor.StripPrefix, u.GitMonitor.StripSuffix)
+	default:
+		return nil, ErrNotMonitored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ignore := []*regexp.Regexp{}
+	for _, pattern := range u.IgnoreRegexPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore-regex-patterns %q: %w", pattern, err)
+		}
+		ignore = append(ignore, re)
+	}
+
+	transforms := []*regexp.Regexp{}
+	for _, t := range u.VersionTransform {
+		re, err := regexp.Compile(t.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version-transform %q: %w", t.Match, err)
+		}
+		transforms = append(transforms, re)
+	}
+
+	for _, v := range versions {
+		if u.VersionSeparator != "" {
+			v = strings.ReplaceAll(v, u.VersionSeparator, ".")
+		}
+		for i, re := range transforms {
+			v = re.ReplaceAllString(v, u.VersionTransform[i].Replace)
+		}
+		if v == "" || ignored(v, ignore) {
+			continue
+		}
+		if res.Latest == "" || Compare(v, res.Latest) > 0 {
+			res.Latest = v
+		}
+	}
+
+	res.UpdateAvailable = res.Latest != "" && Compare(res.Latest, res.Current) > 0
+
+	return res, nil
+}
+
+func ignored(v string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func strip(versions []string, prefix, suffix string) []string {
+	out := make([]string, 0, len(versions))
+	for _, v := range versions {
+		out = append(out, strings.TrimSuffix(strings.TrimPrefix(v, prefix), suffix))
+	}
+	return out
+}
+
+func (c *Checker) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// getJSON decodes the JSON response to a GET request of url into v.
+func (c *Checker) getJSON(ctx context.Context, url string, header http.Header, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%d when getting %s", resp.StatusCode, url)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s: %w", url, err)
+	}
+
+	return nil
+}
+
+// releaseMonitorVersions returns the stable versions of a project of
+// release-monitoring.org.
+func (c *Checker) releaseMonitorVersions(ctx context.Context, id int) ([]string, error) {
+	base := c.ReleaseMonitorURL
+	if base == "" {
+		base = "https://release-monitoring.org"
+	}
+
+	var resp struct {
+		StableVersions []string `json:"stable_versions"`
+	}
+	url := fmt.Sprintf("%s/api/v2/versions/?project_id=%d", strings.TrimSuffix(base, "/"), id)
+	if err := c.getJSON(ctx, url, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.StableVersions, nil
+}
+
+// gitHubVersions returns the tags of the releases of a GitHub repository,
+// or all of its tags if the releases are not used, which pass the filters.
+func (c *Checker) gitHubVersions(ctx context.Context, m *config.GitHubMonitor) ([]string, error) {
+	base := c.GitHubURL
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	base = strings.TrimSuffix(base, "/")
+
+	header := http.Header{}
+	token := c.GitHubToken
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	tags := []string{}
+	if m.UseTags {
+		var resp []struct {
+			Name string `json:"name"`
+		}
+		url := fmt.Sprintf("%s/repos/%s/tags?per_page=100", base, m.Identifier)
+		if err := c.getJSON(ctx, url, header, &resp); err != nil {
+			return nil, err
+		}
+		for _, t := range resp {
+			tags = append(tags, t.Name)
+		}
+	} else {
+		var resp []struct {
+			TagName    string `json:"tag_name"`
+			Draft      bool   `json:"draft"`
+			Prerelease bool   `json:"prerelease"`
+		}
+		url := fmt.Sprintf("%s/repos/%s/releases?per_page=100", base, m.Identifier)
+		if err := c.getJSON(ctx, url, header, &resp); err != nil {
+			return nil, err
+		}
+		for _, r := range resp {
+			if !r.Draft && !r.Prerelease {
+				tags = append(tags, r.TagName)
+			}
+		}
+	}
+
+	prefix := m.TagFilterPrefix
+	if prefix == "" {
+		prefix = m.TagFilter
+	}
+	versions := []string{}
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) && strings.Contains(t, m.TagFilterContains) {
+			versions = append(versions, t)
+		}
+	}
+
+	return versions, nil
+}
+
+// gitVersions returns the tags of a git repository which match the tag
+// regex, or their first capture group.
+func gitVersions(ctx context.Context, cfg *config.Configuration, m *config.GitMonitor) ([]string, error) {
+	repository := m.Repository
+	if repository == "" {
+		r, err := checkoutRepository(cfg)
+		if err != nil {
+			return nil, err
+		}
+		repository = r
+	}
+
+	var re *regexp.Regexp
+	if m.TagRegex != "" {
+		var err error
+		if re, err = regexp.Compile(m.TagRegex); err != nil {
+			return nil, fmt.Errorf("invalid tag-regex %q: %w", m.TagRegex, err)
+		}
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repository},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing the tags of %s: %w", repository, err)
+	}
+
+	versions := []string{}
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+		tag := ref.Name().Short()
+		if re == nil {
+			versions = append(versions, tag)
+			continue
+		}
+		m := re.FindStringSubmatch(tag)
+		switch {
+		case m == nil:
+		case len(m) > 1:
+			versions = append(versions, m[1])
+		default:
+			versions = append(versions, tag)
+		}
+	}
+
+	return versions, nil
+}
+
+// checkoutRepository returns the repository of the git-checkout step of the
+// pipeline.
+func checkoutRepository(cfg *config.Configuration) (string, error) {
+	vars, err := cfg.GetVarsFromConfig()
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range cfg.Pipeline {
+		if p.Uses != "git-checkout" || p.With["repository"] == "" {
+			continue
+		}
+		return util.MutateStringFromMap(vars, p.With["repository"])
+	}
+
+	return "", errors.New("the git update block has no repository, and the pipeline has no git-checkout step")
+}
+
+// Compare compares two upstream versions, returning -1, 0 or 1 like
+// strings.Compare.  The versions are split into runs of digits, which are
+// compared as numbers, and runs of other characters, which are compared as
+// strings, so that 1.10 is newer than 1.9.  A version which is a prefix of
+// the other is older, so that 1.2 is older than 1.2.1, unless the other is
+// a pre-release of it, like 1.2-rc1.
+func Compare(a, b string) int {
+	as, bs := segments(a), segments(b)
+	n := min(len(as), len(bs))
+	for i := 0; i < n; i++ {
+		if c := compareSegments(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	longer, sign := as, 1
+	switch {
+	case len(as) == len(bs):
+		return 0
+	case len(as) < len(bs):
+		longer, sign = bs, -1
+	}
+	if preRelease.MatchString(longer[n]) {
+		return -sign
+	}
+	return sign
+}
+
+var preRelease = regexp.MustCompile(`(?i)alpha|beta|rc|pre|dev`)
+
+func compareSegments(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aerr == nil:
+		// Numbers are newer than suffixes, e.g. 1.0 is newer than 1-rc1.
+		return 1
+	case berr == nil:
+		return -1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// segments splits a version into runs of digits and runs of other
+// characters.
+func segments(v string) []string {
+	out := []string{}
+	start := 0
+	for i := 1; i <= len(v); i++ {
+		if i == len(v) || unicode.IsDigit(rune(v[i])) != unicode.IsDigit(rune(v[i-1])) {
+			out = append(out, v[start:i])
+			start = i
+		}
+	}
+	return out
+}
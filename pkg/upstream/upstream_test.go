@@ -0,0 +1,220 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestCompare(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.2-rc1", "1.2", -1},
+		{"1.2.0", "1.2-rc1", 1},
+		{"1.1.1a", "1.1.1", 1},
+		{"1.1.1b", "1.1.1a", 1},
+		{"2024.01.02", "2023.12.31", 1},
+	} {
+		require.Equal(t, c.want, Compare(c.a, c.b), "Compare(%q, %q)", c.a, c.b)
+		require.Equal(t, -c.want, Compare(c.b, c.a), "Compare(%q, %q)", c.b, c.a)
+	}
+}
+
+func parse(t *testing.T, cfg string) *config.Configuration {
+	t.Helper()
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(fp, []byte(cfg), 0o644))
+	c, err := config.ParseConfiguration(slogtest.TestContextWithLogger(t), fp)
+	require.NoError(t, err)
+
+	return c
+}
+
+func TestCheck_releaseMonitor(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v2/versions/?project_id=1234", r.URL.String())
+		w.Write([]byte(`{"latest_version": "2.0-beta1", "stable_versions": ["v1.10p1", "v1.9.3", "v1.2.0"]}`))
+	}))
+	defer srv.Close()
+
+	cfg := parse(t, `
+package:
+  name: hello
+  version: 1.9.3
+
+update:
+  enabled: true
+  release-monitor:
+    identifier: 1234
+    strip-prefix: v
+  version-transform:
+    - match: p(\d+)$
+      replace: .${1}
+`)
+
+	c := &Checker{ReleaseMonitorURL: srv.URL}
+	res, err := c.Check(ctx, cfg)
+	require.NoError(t, err)
+	require.Equal(t, &Result{
+		Package:         "hello",
+		Current:         "1.9.3",
+		Latest:          "1.10.1",
+		Source:          SourceReleaseMonitor,
+		UpdateAvailable: true,
+	}, res)
+}
+
+func TestCheck_gitHub(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/repos/hello/hello/releases":
+			w.Write([]byte(`[
+  {"tag_name": "hello-3.0.0", "prerelease": true},
+  {"tag_name": "hello-2.1.0"},
+  {"tag_name": "tools-9.0.0"},
+  {"tag_name": "hello-2.0.0"}
+]`))
+		case "/repos/hello/hello/tags":
+			w.Write([]byte(`[{"name": "hello-3.0.0"}, {"name": "hello-2.1.0"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Checker{GitHubURL: srv.URL, GitHubToken: "secret"}
+
+	res, err := c.Check(ctx, parse(t, `
+package:
+  name: hello
+  version: 2.1.0
+
+update:
+  enabled: true
+  github:
+    identifier: hello/hello
+    tag-filter-prefix: hello-
+    strip-prefix: hello-
+`))
+	require.NoError(t, err)
+	require.Equal(t, "2.1.0", res.Latest)
+	require.False(t, res.UpdateAvailable)
+
+	res, err = c.Check(ctx, parse(t, `
+package:
+  name: hello
+  version: 2.1.0
+
+update:
+  enabled: true
+  github:
+    identifier: hello/hello
+    strip-prefix: hello-
+    use-tag: true
+`))
+	require.NoError(t, err)
+	require.Equal(t, "3.0.0", res.Latest)
+	require.True(t, res.UpdateAvailable)
+}
+
+func TestCheck_git(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	upstream := t.TempDir()
+	repo, err := git.PlainInit(upstream, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(upstream, "README"), []byte("hello"), 0o644))
+	_, err = wt.Add("README")
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "hello", Email: "hello@example.com", When: time.Unix(0, 0)}
+	commit, err := wt.Commit("hello", &git.CommitOptions{Author: sig})
+	require.NoError(t, err)
+	for _, tag := range []string{"release_1_2_0", "release_1_10_0", "nightly-20240101"} {
+		_, err = repo.CreateTag(tag, commit, nil)
+		require.NoError(t, err)
+	}
+
+	res, err := (&Checker{}).Check(ctx, parse(t, `
+package:
+  name: hello
+  version: 1.2.0
+
+pipeline:
+  - uses: git-checkout
+    with:
+      repository: `+upstream+`
+      tag: release_${{vars.underscored}}
+      expected-commit: `+commit.String()+`
+
+vars:
+  underscored: 1_2_0
+
+update:
+  enabled: true
+  version-separator: _
+  git:
+    tag-regex: ^release_(.*)$
+`))
+	require.NoError(t, err)
+	require.Equal(t, &Result{
+		Package:         "hello",
+		Current:         "1.2.0",
+		Latest:          "1.10.0",
+		Source:          SourceGit,
+		UpdateAvailable: true,
+	}, res)
+}
+
+func TestCheck_notMonitored(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	cfg := parse(t, `
+package:
+  name: hello
+  version: 1.0.0
+`)
+	res, err := (&Checker{}).Check(ctx, cfg)
+	require.NoError(t, err)
+	require.Equal(t, &Result{Package: "hello", Current: "1.0.0"}, res)
+
+	cfg.Update.Enabled = true
+	_, err = (&Checker{}).Check(ctx, cfg)
+	require.ErrorIs(t, err, ErrNotMonitored)
+}
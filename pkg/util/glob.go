@@ -0,0 +1,80 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchGlob reports whether name matches the slash-separated shell pattern.
+// Each path segment is matched with path.Match, except that a segment
+// consisting solely of "**" matches zero or more path segments.  Leading and
+// trailing slashes are ignored on both the pattern and the name.
+func MatchGlob(pattern, name string) (bool, error) {
+	return matchSegments(splitGlob(pattern), splitGlob(name))
+}
+
+// ValidateGlob returns an error if the pattern is malformed.
+func ValidateGlob(pattern string) error {
+	for _, seg := range splitGlob(pattern) {
+		if _, err := path.Match(seg, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func splitGlob(s string) []string {
+	s = strings.Trim(path.Clean("/"+s), "/")
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, "/")
+}
+
+func matchSegments(pat, name []string) (bool, error) {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return true, nil
+			}
+
+			for i := 0; i <= len(name); i++ {
+				ok, err := matchSegments(pat[1:], name[i:])
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return false, nil
+		}
+
+		ok, err := path.Match(pat[0], name[0])
+		if err != nil || !ok {
+			return false, err
+		}
+
+		pat, name = pat[1:], name[1:]
+	}
+
+	return len(name) == 0, nil
+}
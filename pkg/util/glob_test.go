@@ -0,0 +1,48 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"usr/lib/*.a", "usr/lib/libfoo.a", true},
+		{"usr/lib/*.a", "usr/lib/sub/libfoo.a", false},
+		{"usr/lib/**/*.a", "usr/lib/libfoo.a", true},
+		{"usr/lib/**/*.a", "usr/lib/sub/dir/libfoo.a", true},
+		{"usr/include", "usr/include", true},
+		{"/usr/include/", "usr/include", true},
+		{"usr/include", "usr/include/foo.h", false},
+		{"usr/include/**", "usr/include/foo/bar.h", true},
+		{"usr/share/man/man?/*", "usr/share/man/man1/foo.1", true},
+		{"usr/bin/foo", "usr/bin/foobar", false},
+	} {
+		got, err := MatchGlob(c.pattern, c.name)
+		require.NoError(t, err)
+		require.Equal(t, c.want, got, "MatchGlob(%q, %q)", c.pattern, c.name)
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	require.NoError(t, ValidateGlob("usr/lib/**/*.so.[0-9]*"))
+	require.Error(t, ValidateGlob("usr/lib/[unterminated"))
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"slices"
 	"sort"
+	"strings"
 )
 
 // DownloadFile downloads a file and returns a path to it in temporary storage.
@@ -123,3 +124,12 @@ func Dedup[S ~[]E, E cmp.Ordered](s S) S {
 	slices.Sort(s)
 	return slices.Compact(s)
 }
+
+// DependencyName returns the name of a dependency without its version
+// constraint, e.g. "so:libz.so.1" for "so:libz.so.1=1.3".
+func DependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "=<>~"); i != -1 {
+		return dep[:i]
+	}
+	return dep
+}
@@ -12,3 +12,9 @@ func TestDedup(t *testing.T) {
 
 	require.Equal(t, len(b), 12, "the deduplicated list should have 12 elements")
 }
+
+func TestDependencyName(t *testing.T) {
+	require.Equal(t, "so:libc.so.6", DependencyName("so:libc.so.6"))
+	require.Equal(t, "python3", DependencyName("python3~3.12"))
+	require.Equal(t, "foo", DependencyName("foo>=1.2"))
+}
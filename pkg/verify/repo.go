@@ -0,0 +1,355 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/clog"
+	apkrepo "github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+
+	"chainguard.dev/melange/pkg/util"
+)
+
+// The checks which are performed on a repository.
+const (
+	CheckIndexSignature   = "index-signature"
+	CheckPackageSignature = "package-signature"
+	CheckChecksum         = "checksum"
+	CheckDataHash         = "datahash"
+	CheckDependency       = "dependency"
+	CheckDuplicateProvide = "duplicate-provides"
+	CheckMissingFile      = "missing-file"
+	CheckOrphanedFile     = "orphaned-file"
+)
+
+// The severities of a finding.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Finding is a single problem found in a repository.
+type Finding struct {
+	// The check which produced the finding
+	Check string `json:"check"`
+	// Whether the finding is an error or a warning
+	Severity string `json:"severity"`
+	// The package the finding is about, if any
+	Package string `json:"package,omitempty"`
+	// A human readable description of the problem
+	Message string `json:"message"`
+}
+
+// Report is the result of verifying a repository.
+type Report struct {
+	// The directory which was verified
+	Path string `json:"path"`
+	// The number of packages in the index
+	Packages int `json:"packages"`
+	// The key which signed the index, if it was verified
+	IndexKey string `json:"index-key,omitempty"`
+	// The problems which were found
+	Findings []Finding `json:"findings"`
+
+	mu sync.Mutex
+}
+
+func (r *Report) add(check, severity, pkg, format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Findings = append(r.Findings, Finding{
+		Check:    check,
+		Severity: severity,
+		Package:  pkg,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Failed returns whether any error was found.
+func (r *Report) Failed() bool {
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+type options struct {
+	keys         Keys
+	extraIndexes []string
+}
+
+type Option func(*options) error
+
+// WithKeys sets the public keys which the index and packages must be signed
+// with.  If no keys are provided, signatures are not verified.
+func WithKeys(keys Keys) Option {
+	return func(o *options) error {
+		o.keys = keys
+		return nil
+	}
+}
+
+// WithExtraIndexes adds indexes of other repositories which may satisfy the
+// dependencies of packages in the repository being verified.
+func WithExtraIndexes(paths []string) Option {
+	return func(o *options) error {
+		o.extraIndexes = append(o.extraIndexes, paths...)
+		return nil
+	}
+}
+
+// Repository audits the repository in dir, which must contain an
+// APKINDEX.tar.gz and the packages it references.
+func Repository(ctx context.Context, dir string, opts ...Option) (*Report, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "verify.Repository")
+	defer span.End()
+
+	log := clog.FromContext(ctx)
+
+	o := options{}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &Report{Path: dir, Findings: []Finding{}}
+
+	indexData, err := os.ReadFile(filepath.Join(dir, "APKINDEX.tar.gz"))
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+
+	index, err := apkrepo.IndexFromArchive(io.NopCloser(bytes.NewReader(indexData)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
+	r.Packages = len(index.Packages)
+	log.Infof("verifying %d packages in %s", r.Packages, dir)
+
+	if len(o.keys) == 0 {
+		r.add(CheckIndexSignature, SeverityWarning, "", "no keys were provided, signatures were not verified")
+	} else if key, err := IndexSignature(indexData, o.keys); err != nil {
+		r.add(CheckIndexSignature, SeverityError, "", "index signature: %v", err)
+	} else {
+		r.IndexKey = key
+	}
+
+	var g errgroup.Group
+	g.SetLimit(4)
+	for _, pkg := range index.Packages {
+		pkg := pkg
+		g.Go(func() error {
+			verifyPackage(ctx, r, dir, pkg, o.keys)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	extra := []*apkrepo.Package{}
+	for _, path := range o.extraIndexes {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening index %s: %w", path, err)
+		}
+		idx, err := apkrepo.IndexFromArchive(f)
+		if err != nil {
+			return nil, fmt.Errorf("parsing index %s: %w", path, err)
+		}
+		extra = append(extra, idx.Packages...)
+	}
+
+	checkClosure(r, index.Packages, extra)
+	checkDuplicateProvides(r, index.Packages)
+
+	if err := checkOrphans(r, dir, index.Packages); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		if r.Findings[i].Package != r.Findings[j].Package {
+			return r.Findings[i].Package < r.Findings[j].Package
+		}
+		return r.Findings[i].Check < r.Findings[j].Check
+	})
+
+	return r, nil
+}
+
+func packageFilename(pkg *apkrepo.Package) string {
+	return fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version)
+}
+
+func verifyPackage(ctx context.Context, r *Report, dir string, pkg *apkrepo.Package, keys Keys) {
+	id := fmt.Sprintf("%s-%s", pkg.Name, pkg.Version)
+
+	f, err := os.Open(filepath.Join(dir, packageFilename(pkg)))
+	if err != nil {
+		r.add(CheckMissingFile, SeverityError, id, "%v", err)
+		return
+	}
+	defer f.Close()
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		r.add(CheckDataHash, SeverityError, id, "unable to expand package: %v", err)
+		return
+	}
+	defer exp.Close()
+
+	if len(keys) != 0 {
+		if _, err := PackageSignature(exp, keys); err != nil {
+			r.add(CheckPackageSignature, SeverityError, id, "%v", err)
+		}
+	}
+
+	if !bytes.Equal(exp.ControlHash, pkg.Checksum) {
+		r.add(CheckChecksum, SeverityError, id, "index checksum %x does not match control section checksum %x", pkg.Checksum, exp.ControlHash)
+	}
+
+	datahash, err := controlValue(exp, "datahash")
+	if err != nil {
+		r.add(CheckDataHash, SeverityError, id, "reading .PKGINFO: %v", err)
+		return
+	}
+	if got := hex.EncodeToString(exp.PackageHash); datahash != got {
+		r.add(CheckDataHash, SeverityError, id, ".PKGINFO datahash %s does not match data section digest %s", datahash, got)
+	}
+}
+
+// controlValue returns the value of key in the .PKGINFO of an expanded apk.
+func controlValue(exp *expandapk.APKExpanded, key string) (string, error) {
+	f, err := exp.ControlFS.Open(".PKGINFO")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), " = ")
+		if ok && k == key {
+			return v, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s is not set", key)
+}
+
+// checkClosure reports dependencies which are not satisfied by any package
+// in the repository or the extra indexes.
+func checkClosure(r *Report, packages, extra []*apkrepo.Package) {
+	provided := map[string]bool{}
+	// slices.Concat needs go1.22; clipping packages makes append copy it
+	// rather than write extra into its spare capacity.
+	for _, pkg := range append(slices.Clip(packages), extra...) {
+		provided[pkg.Name] = true
+		for _, prov := range pkg.Provides {
+			provided[util.DependencyName(prov)] = true
+		}
+	}
+
+	for _, pkg := range packages {
+		for _, dep := range pkg.Dependencies {
+			if dep == "" || strings.HasPrefix(dep, "!") {
+				continue
+			}
+			if !provided[util.DependencyName(dep)] {
+				r.add(CheckDependency, SeverityError, fmt.Sprintf("%s-%s", pkg.Name, pkg.Version), "nothing provides %s", dep)
+			}
+		}
+	}
+}
+
+// checkDuplicateProvides reports provides which are provided by more than one
+// package name.  Several versions of the same package providing the same
+// name is expected.
+func checkDuplicateProvides(r *Report, packages []*apkrepo.Package) {
+	providers := map[string]map[string]bool{}
+	for _, pkg := range packages {
+		for _, prov := range pkg.Provides {
+			name := util.DependencyName(prov)
+			if providers[name] == nil {
+				providers[name] = map[string]bool{}
+			}
+			providers[name][pkg.Name] = true
+		}
+	}
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(providers[name]) < 2 {
+			continue
+		}
+
+		pkgs := make([]string, 0, len(providers[name]))
+		for pkg := range providers[name] {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+
+		r.add(CheckDuplicateProvide, SeverityWarning, "", "%s is provided by %s", name, strings.Join(pkgs, ", "))
+	}
+}
+
+// checkOrphans reports apk files in dir which are not in the index.
+func checkOrphans(r *Report, dir string, packages []*apkrepo.Package) error {
+	indexed := map[string]bool{}
+	for _, pkg := range packages {
+		indexed[packageFilename(pkg)] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", dir, err)
+	}
+
+	for _, ent := range entries {
+		if ent.IsDir() || !strings.HasSuffix(ent.Name(), ".apk") || indexed[ent.Name()] {
+			continue
+		}
+		r.add(CheckOrphanedFile, SeverityWarning, "", "%s is not in the index", ent.Name())
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/index"
+)
+
+func writeKeypair(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	privPath := filepath.Join(dir, "test.rsa")
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), 0o600))
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	pubPath := filepath.Join(dir, "test.rsa.pub")
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0o644))
+
+	return privPath, pubPath
+}
+
+func findings(r *Report, check string) []Finding {
+	found := []Finding{}
+	for _, f := range r.Findings {
+		if f.Check == check {
+			found = append(found, f)
+		}
+	}
+	return found
+}
+
+func TestRepository(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+	privPath, pubPath := writeKeypair(t, t.TempDir())
+
+	data, err := os.ReadFile(filepath.Join("..", "sca", "testdata", "libcap-2.69-r0.apk"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "libcap-2.69-r0.apk"), data, 0o644))
+
+	idx, err := index.New(
+		index.WithPackageDir(dir),
+		index.WithIndexFile(filepath.Join(dir, "APKINDEX.tar.gz")),
+		index.WithSigningKey(privPath),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	// An apk which is not in the index.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stray-1.0-r0.apk"), data, 0o644))
+
+	keys, err := LoadKeys([]string{pubPath})
+	require.NoError(t, err)
+
+	r, err := Repository(ctx, dir, WithKeys(keys))
+	require.NoError(t, err)
+
+	require.Equal(t, 1, r.Packages)
+	require.Equal(t, "test.rsa.pub", r.IndexKey)
+	require.Empty(t, findings(r, CheckIndexSignature))
+	require.Empty(t, findings(r, CheckChecksum))
+	require.Empty(t, findings(r, CheckDataHash))
+
+	// The test package is not signed.
+	require.Len(t, findings(r, CheckPackageSignature), 1)
+
+	// libcap needs libc, which is not in the repository.
+	require.NotEmpty(t, findings(r, CheckDependency))
+
+	orphans := findings(r, CheckOrphanedFile)
+	require.Len(t, orphans, 1)
+	require.Contains(t, orphans[0].Message, "stray-1.0-r0.apk")
+
+	require.True(t, r.Failed())
+}
+
+func TestIndexSignature_WrongKey(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+	privPath, _ := writeKeypair(t, t.TempDir())
+	_, otherPub := writeKeypair(t, t.TempDir())
+
+	idx, err := index.New(
+		index.WithIndexFile(filepath.Join(dir, "APKINDEX.tar.gz")),
+		index.WithSigningKey(privPath),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	data, err := os.ReadFile(filepath.Join(dir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+
+	keys, err := LoadKeys([]string{otherPub})
+	require.NoError(t, err)
+
+	_, err = IndexSignature(data, keys)
+	require.ErrorContains(t, err, "no key found")
+}
+
+func TestKeysFingerprint(t *testing.T) {
+	_, pubPath := writeKeypair(t, t.TempDir())
+	keys, err := LoadKeys([]string{pubPath})
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(keys["test.rsa.pub"])
+	sum := sha256.Sum256(block.Bytes)
+
+	fingerprint, err := keys.Fingerprint("test.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), fingerprint)
+
+	_, err = keys.Fingerprint("missing.rsa.pub")
+	require.ErrorContains(t, err, "unknown key")
+
+	keys["garbage.rsa.pub"] = []byte("garbage")
+	_, err = keys.Fingerprint("garbage.rsa.pub")
+	require.ErrorContains(t, err, "not PEM encoded")
+}
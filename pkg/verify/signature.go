@@ -0,0 +1,139 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+
+	"chainguard.dev/melange/pkg/apk"
+)
+
+// Keys maps the file name of a public key to its PEM encoded contents.
+type Keys map[string][]byte
+
+// LoadKeys reads the public keys at the given paths.
+func LoadKeys(paths []string) (Keys, error) {
+	keys := Keys{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %s: %w", path, err)
+		}
+		keys[filepath.Base(path)] = data
+	}
+
+	return keys, nil
+}
+
+// Fingerprint returns the fingerprint of a public key, the SHA-256 digest of
+// its DER encoding, which is what `openssl pkey -pubin -outform DER |
+// sha256sum` prints and what melange keygen records.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Fingerprint returns the fingerprint of the key name.
+func (keys Keys) Fingerprint(name string) (string, error) {
+	data, ok := keys[name]
+	if !ok {
+		return "", fmt.Errorf("unknown key %s", name)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("key %s is not PEM encoded", name)
+	}
+
+	return Fingerprint(block.Bytes), nil
+}
+
+// verifyDigest checks an RSA signature over a SHA1 digest, trying the key
+// named by the signature file first and then every other key.  It returns
+// the name of the key which verified the signature.
+func (keys Keys) verifyDigest(digest []byte, sigName string, sig []byte) (string, error) {
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no keys provided to verify signature")
+	}
+
+	keyName := strings.TrimPrefix(sigName, ".SIGN.RSA.")
+	if key, ok := keys[keyName]; ok {
+		if err := sign.RSAVerifySHA1Digest(digest, sig, key); err == nil {
+			return keyName, nil
+		}
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := sign.RSAVerifySHA1Digest(digest, sig, keys[name]); err == nil {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no key found to verify signature %s", sigName)
+}
+
+// IndexSignature verifies the signature of an APKINDEX.tar.gz, returning the
+// name of the key which signed it.
+func IndexSignature(data []byte, keys Keys) (string, error) {
+	stream, err := apk.ReadSignatureStream(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	// Everything after the signature stream is signed.
+	sig := stream.Signatures[0]
+	digest := sha1.Sum(data[stream.Length:]) //nolint:gosec
+	return keys.verifyDigest(digest[:], sig.Name, sig.Data)
+}
+
+// PackageSignature verifies the signature of an expanded apk, returning the
+// name of the key which signed it.
+func PackageSignature(exp *expandapk.APKExpanded, keys Keys) (string, error) {
+	if !exp.Signed {
+		return "", fmt.Errorf("package is not signed")
+	}
+
+	f, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stream, err := apk.ReadSignatureStream(f)
+	if err != nil {
+		return "", err
+	}
+
+	sig := stream.Signatures[0]
+	return keys.verifyDigest(exp.ControlHash, sig.Name, sig.Data)
+}